@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package st
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Header used to send API key to Syncthing REST API
+const apiKeyHeaderName = "X-API-Key"
+
+// Number of attempts (one per second) to reach Syncthing using a new key
+const apiKeyVerifyRetry = 10
+
+// xmlAPIKey Generated API key stored on disk
+type xmlAPIKey struct {
+	XMLName   xml.Name  `xml:"SyncthingAPIKey"`
+	Version   string    `xml:"version,attr"`
+	Key       string    `xml:"Key"`
+	CreatedAt time.Time `xml:"CreatedAt"`
+}
+
+// APIKeyStatus returns information about the key used to access Syncthing REST API
+func (s *SyncThing) APIKeyStatus() xsapiv1.SyncAPIKeyStatus {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	st := xsapiv1.SyncAPIKeyStatus{Managed: !s.apiKeyStatic}
+	if s.apiKeyStatic {
+		return st
+	}
+	st.CreatedAt = s.apiKeyCreatedAt.String()
+	if exp := s.apiKeyExpireAt(s.apiKeyCreatedAt); !exp.IsZero() {
+		st.ExpireAt = exp.String()
+	}
+	return st
+}
+
+// RotateAPIKey replaces the key used to access Syncthing REST API: new key is
+// set in Syncthing configuration, then used by server client and by
+// syncthing-inotify (restarted)
+func (s *SyncThing) RotateAPIKey() (xsapiv1.SyncAPIKeyStatus, error) {
+	s.rotateMutex.Lock()
+	defer s.rotateMutex.Unlock()
+
+	if s.apiKeyStatic {
+		return s.APIKeyStatus(), fmt.Errorf("API key set in server config file (gui-apikey), cannot be rotated")
+	}
+
+	data, err := apiKeyNew()
+	if err != nil {
+		return s.APIKeyStatus(), err
+	}
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return s.APIKeyStatus(), fmt.Errorf("Cannot retrieve Syncthing config: %v", err)
+	}
+	stCfg.GUI.APIKey = data.Key
+	if err := s.ConfigSet(stCfg); err != nil {
+		return s.APIKeyStatus(), fmt.Errorf("Cannot set Syncthing API key: %v", err)
+	}
+
+	// Syncthing restarts its REST API when GUI settings change, so new key
+	// may not be usable immediately
+	var client *common.HTTPClient
+	for retry := apiKeyVerifyRetry; retry > 0; retry-- {
+		var res []byte
+		if client, err = s.newClient(data.Key); err == nil {
+			if err = client.HTTPGet("system/status", &res); err == nil {
+				break
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		s.log.Errorf("Syncthing not reachable using new API key, restore previous one: %v", err)
+		stCfg.GUI.APIKey = s.APIKey
+		if errR := s.ConfigSet(stCfg); errR != nil {
+			s.log.Errorf("Cannot restore Syncthing API key: %v", errR)
+		}
+		return s.APIKeyStatus(), fmt.Errorf("Syncthing not reachable using new API key: %v", err)
+	}
+
+	s.clientMutex.Lock()
+	s.client = client
+	s.APIKey = data.Key
+	s.apiKeyCreatedAt = data.CreatedAt
+	s.clientMutex.Unlock()
+	s.log.Infof("Syncthing API key rotated")
+
+	// Key is already used by Syncthing, so keep going on error to restart inotify
+	errSave := s.apiKeySave(data)
+	if errSave != nil {
+		s.log.Errorf("Cannot save Syncthing API key: %v", errSave)
+	}
+
+	if s.STICmd != nil {
+		s.StopInotify()
+		if _, err := s.StartInotify(); err != nil {
+			return s.APIKeyStatus(), fmt.Errorf("Cannot restart syncthing-inotify: %v", err)
+		}
+	}
+
+	if errSave != nil {
+		return s.APIKeyStatus(), fmt.Errorf("API key rotated but cannot be saved: %v", errSave)
+	}
+	return s.APIKeyStatus(), nil
+}
+
+/*** Private functions ***/
+
+// apiKeyInit sets the key used to access Syncthing REST API: a key defined in
+// server config file is used as is, otherwise the generated key stored on disk
+// is used (and renewed when missing or expired)
+func (s *SyncThing) apiKeyInit() error {
+	if s.APIKey != "" {
+		s.apiKeyStatic = true
+		return nil
+	}
+
+	data, err := s.apiKeyLoad()
+	if err != nil {
+		s.log.Warningf("Cannot load Syncthing API key, generate a new one: %v", err)
+	}
+	if data == nil || s.apiKeyExpired(data.CreatedAt) {
+		if data, err = apiKeyNew(); err != nil {
+			return err
+		}
+		if err := s.apiKeySave(data); err != nil {
+			return fmt.Errorf("Cannot save Syncthing API key: %v", err)
+		}
+		s.log.Infof("New Syncthing API key generated")
+	}
+	s.APIKey = data.Key
+	s.apiKeyCreatedAt = data.CreatedAt
+	return nil
+}
+
+// apiKeyExpireAt returns the date after which a generated key is renewed
+// (zero when keys never expire)
+func (s *SyncThing) apiKeyExpireAt(createdAt time.Time) time.Time {
+	if s.apiKeyMaxAgeDays <= 0 {
+		return time.Time{}
+	}
+	return createdAt.AddDate(0, 0, s.apiKeyMaxAgeDays)
+}
+
+// apiKeyExpired returns true when a generated key must be renewed
+func (s *SyncThing) apiKeyExpired(createdAt time.Time) bool {
+	exp := s.apiKeyExpireAt(createdAt)
+	return !exp.IsZero() && time.Now().After(exp)
+}
+
+// apiKeyNew generates a new random key
+func apiKeyNew() (*xmlAPIKey, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("Cannot generate Syncthing API key: %v", err)
+	}
+	return &xmlAPIKey{Version: "1", Key: hex.EncodeToString(b), CreatedAt: time.Now()}, nil
+}
+
+// apiKeyLoad reads generated key from disk (nil when not existing)
+func (s *SyncThing) apiKeyLoad() (*xmlAPIKey, error) {
+	file, err := xdsconfig.SyncthingAPIKeyFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return nil, err
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	data := xmlAPIKey{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Key == "" {
+		return nil, fmt.Errorf("empty key")
+	}
+	return &data, nil
+}
+
+// apiKeySave writes generated key on disk
+func (s *SyncThing) apiKeySave(data *xmlAPIKey) error {
+	file, err := xdsconfig.SyncthingAPIKeyFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Only owner can read key
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(data)
+}
@@ -32,14 +32,11 @@ import (
 
 	"io"
 
-	"io/ioutil"
-
-	"regexp"
-
 	"github.com/Sirupsen/logrus"
 	common "github.com/iotbzh/xds-common/golib"
 	"github.com/iotbzh/xds-server/lib/xdsconfig"
 	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/sync"
 )
 
 // SyncThing .
@@ -53,6 +50,9 @@ type SyncThing struct {
 	Connected bool
 	Events    *Events
 
+	// RequestHook is called (when set) before each REST request (used for fault injection)
+	RequestHook func(url string)
+
 	// Private fields
 	binDir      string
 	logsDir     string
@@ -61,6 +61,15 @@ type SyncThing struct {
 	client      *common.HTTPClient
 	log         *logrus.Logger
 	conf        *xdsconfig.Config
+	receiveOnly map[string]bool // folders using receive-only type (see ConfigSet)
+	roMutex     sync.Mutex
+
+	// API key management (see st-apikey.go)
+	apiKeyStatic     bool // key set in server config file
+	apiKeyCreatedAt  time.Time
+	apiKeyMaxAgeDays int
+	clientMutex      sync.RWMutex // protects client and APIKey
+	rotateMutex      sync.Mutex
 }
 
 // ExitChan Channel used for process exit
@@ -108,6 +117,7 @@ type FolderStatus struct {
 // NewSyncThing creates a new instance of Syncthing
 func NewSyncThing(conf *xdsconfig.Config, log *logrus.Logger) *SyncThing {
 	var url, apiKey, home, binDir string
+	var apiKeyMaxAge int
 
 	stCfg := conf.FileConf.SThgConf
 	if stCfg != nil {
@@ -115,6 +125,7 @@ func NewSyncThing(conf *xdsconfig.Config, log *logrus.Logger) *SyncThing {
 		apiKey = stCfg.GuiAPIKey
 		home = stCfg.Home
 		binDir = stCfg.BinDir
+		apiKeyMaxAge = stCfg.APIKeyMaxAgeDays
 	}
 
 	if url == "" {
@@ -136,6 +147,13 @@ func NewSyncThing(conf *xdsconfig.Config, log *logrus.Logger) *SyncThing {
 		logsDir: conf.FileConf.LogsDir,
 		log:     log,
 		conf:    conf,
+
+		receiveOnly: make(map[string]bool),
+		roMutex:     sync.NewMutex(),
+
+		apiKeyMaxAgeDays: apiKeyMaxAge,
+		clientMutex:      sync.NewRWMutex(),
+		rotateMutex:      sync.NewMutex(),
 	}
 
 	// Create Events monitoring
@@ -234,35 +252,28 @@ func (s *SyncThing) Start() (*exec.Cmd, error) {
 		"--gui-address=" + s.BaseURL,
 	}
 
-	if s.APIKey != "" {
-		args = append(args, "-gui-apikey=\""+s.APIKey+"\"")
-		s.log.Infof(" ST apikey=%s", s.APIKey)
-	}
 	if s.log.Level == logrus.DebugLevel {
 		args = append(args, "-verbose")
 	}
 
+	// API key is not passed on command line to not expose it in processes list
+	if err = s.apiKeyInit(); err != nil {
+		return nil, err
+	}
+	if s.apiKeyStatic {
+		s.log.Infof(" ST apikey set in config file")
+	} else {
+		s.log.Infof(" ST apikey generated on %v", s.apiKeyCreatedAt)
+	}
+
 	env := []string{
 		"STNODEFAULTFOLDER=1",
 		"STNOUPGRADE=1",
+		"STGUIAPIKEY=" + s.APIKey,
 	}
 
 	s.STCmd, err = s.startProc("syncthing", args, env, &s.exitSTChan)
 
-	// Use autogenerated apikey if not set by server-config.json
-	if err == nil && s.APIKey == "" {
-		if fd, err := os.Open(filepath.Join(s.Home, "config.xml")); err == nil {
-			defer fd.Close()
-			if b, err := ioutil.ReadAll(fd); err == nil {
-				re := regexp.MustCompile("<apikey>(.*)</apikey>")
-				key := re.FindStringSubmatch(string(b))
-				if len(key) >= 1 {
-					s.APIKey = key[1]
-				}
-			}
-		}
-	}
-
 	return s.STCmd, err
 }
 
@@ -278,7 +289,6 @@ func (s *SyncThing) StartInotify() (*exec.Cmd, error) {
 	}
 	if s.APIKey != "" {
 		args = append(args, "-api="+s.APIKey)
-		s.log.Infof("%s uses apikey=%s", exeName, s.APIKey)
 	}
 	if s.log.Level == logrus.DebugLevel {
 		args = append(args, "-verbosity=4")
@@ -330,15 +340,9 @@ func (s *SyncThing) StopInotify() {
 func (s *SyncThing) Connect() error {
 	var err error
 	s.Connected = false
-	s.client, err = common.HTTPNewClient(s.BaseURL,
-		common.HTTPClientConfig{
-			URLPrefix:           "/rest",
-			HeaderClientKeyName: "X-Syncthing-ID",
-			LogOut:              s.conf.LogVerboseOut,
-			LogPrefix:           "SYNCTHING: ",
-			LogLevel:            common.HTTPLogLevelWarning,
-		})
-	s.client.SetLogLevel(s.log.Level.String())
+	s.clientMutex.Lock()
+	s.client, err = s.newClient(s.APIKey)
+	s.clientMutex.Unlock()
 
 	if err != nil {
 		msg := ": " + err.Error()
@@ -364,10 +368,54 @@ func (s *SyncThing) Connect() error {
 	return err
 }
 
+// newClient creates a HTTP client of Syncthing REST API using a key
+func (s *SyncThing) newClient(apiKey string) (*common.HTTPClient, error) {
+	client, err := common.HTTPNewClient(s.BaseURL,
+		common.HTTPClientConfig{
+			URLPrefix:           "/rest",
+			HeaderAPIKeyName:    apiKeyHeaderName,
+			Apikey:              apiKey,
+			HeaderClientKeyName: "X-Syncthing-ID",
+			LogOut:              s.conf.LogVerboseOut,
+			LogPrefix:           "SYNCTHING: ",
+			LogLevel:            common.HTTPLogLevelWarning,
+		})
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		client.SetLogLevel(s.log.Level.String())
+	}
+	return client, nil
+}
+
+// httpClient returns current client (replaced on API key rotation)
+func (s *SyncThing) httpClient() *common.HTTPClient {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+	return s.client
+}
+
+// httpGet sends a GET request to Syncthing REST API
+func (s *SyncThing) httpGet(url string, data *[]byte) error {
+	if s.RequestHook != nil {
+		s.RequestHook(url)
+	}
+	return s.httpClient().HTTPGet(url, data)
+}
+
+// httpPost sends a POST request to Syncthing REST API
+func (s *SyncThing) httpPost(url string, body string) error {
+	if s.RequestHook != nil {
+		s.RequestHook(url)
+	}
+	return s.httpClient().HTTPPost(url, body)
+}
+
 // IDGet returns the Syncthing ID of Syncthing instance running locally
 func (s *SyncThing) IDGet() (string, error) {
 	var data []byte
-	if err := s.client.HTTPGet("system/status", &data); err != nil {
+	if err := s.httpGet("system/status", &data); err != nil {
 		return "", err
 	}
 	status := make(map[string]interface{})
@@ -379,7 +427,7 @@ func (s *SyncThing) IDGet() (string, error) {
 func (s *SyncThing) ConfigGet() (config.Configuration, error) {
 	var data []byte
 	config := config.Configuration{}
-	if err := s.client.HTTPGet("system/config", &data); err != nil {
+	if err := s.httpGet("system/config", &data); err != nil {
 		return config, err
 	}
 	err := json.Unmarshal(data, &config)
@@ -392,14 +440,42 @@ func (s *SyncThing) ConfigSet(cfg config.Configuration) error {
 	if err != nil {
 		return err
 	}
-	return s.client.HTTPPost("system/config", string(body))
+	if body, err = s.patchReceiveOnly(body); err != nil {
+		return err
+	}
+	return s.httpPost("system/config", string(body))
+}
+
+// patchReceiveOnly Sets receive-only type of folders in JSON config
+// (type only available since Syncthing v0.14.50, unknown by config package
+// used by server that decodes it as sendreceive)
+func (s *SyncThing) patchReceiveOnly(body []byte) ([]byte, error) {
+	s.roMutex.Lock()
+	defer s.roMutex.Unlock()
+	if len(s.receiveOnly) == 0 {
+		return body, nil
+	}
+
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	folders, _ := raw["folders"].([]interface{})
+	for _, f := range folders {
+		if fld, ok := f.(map[string]interface{}); ok {
+			if id, _ := fld["id"].(string); s.receiveOnly[id] {
+				fld["type"] = "receiveonly"
+			}
+		}
+	}
+	return json.Marshal(raw)
 }
 
 // IsConfigInSync Returns true if configuration is in sync
 func (s *SyncThing) IsConfigInSync() (bool, error) {
 	var data []byte
 	var d configInSync
-	if err := s.client.HTTPGet("system/config/insync", &data); err != nil {
+	if err := s.httpGet("system/config/insync", &data); err != nil {
 		return false, err
 	}
 	if err := json.Unmarshal(data, &d); err != nil {
@@ -407,3 +483,39 @@ func (s *SyncThing) IsConfigInSync() (bool, error) {
 	}
 	return d.ConfigInSync, nil
 }
+
+// DeviceConnected Returns true when a device is connected
+func (s *SyncThing) DeviceConnected(devID string) (bool, error) {
+	var data []byte
+	res := struct {
+		Connections map[string]struct {
+			Connected bool `json:"connected"`
+		} `json:"connections"`
+	}{}
+	if err := s.httpGet("system/connections", &data); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return false, err
+	}
+	return res.Connections[devID].Connected, nil
+}
+
+// Restart Requests a restart of Syncthing (REST API unavailable for a while)
+func (s *SyncThing) Restart() error {
+	return s.httpPost("system/restart", "")
+}
+
+// BandwidthSet Updates send and receive rate limits (in KiB/s, 0 = unlimited)
+func (s *SyncThing) BandwidthSet(maxSendKbps, maxRecvKbps int) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	if stCfg.Options.MaxSendKbps == maxSendKbps && stCfg.Options.MaxRecvKbps == maxRecvKbps {
+		return nil
+	}
+	stCfg.Options.MaxSendKbps = maxSendKbps
+	stCfg.Options.MaxRecvKbps = maxRecvKbps
+	return s.ConfigSet(stCfg)
+}
@@ -165,7 +165,7 @@ func (e *Events) getEvents(since int) ([]STEvent, error) {
 	if since != -1 {
 		url += "?since=" + strconv.Itoa(since)
 	}
-	if err := e.st.client.HTTPGet(url, &data); err != nil {
+	if err := e.st.httpGet(url, &data); err != nil {
 		return ev, err
 	}
 	err := json.Unmarshal(data, &ev)
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
@@ -120,6 +121,14 @@ func (s *SyncThing) FolderChange(f xsapiv1.FolderConfig) (string, error) {
 		Path:  filepath.Join(s.conf.FileConf.ShareRootDir, f.ClientPath),
 	}
 
+	// Server changes must not be sent to clients on read-only folders
+	s.setReceiveOnly(id, f.ReadOnly)
+
+	// Preserve permissions (IOW exec bits) unless explicitly disabled
+	folder.Versioning = versioningConfig(f.Versioning)
+	folder.IgnorePerms = f.FileAttrs.IgnorePerms ||
+		(s.conf.FileConf.FileAttrsConf != nil && s.conf.FileConf.FileAttrsConf.IgnorePerms)
+
 	if s.conf.FileConf.SThgConf.RescanIntervalS > 0 {
 		folder.RescanIntervalS = s.conf.FileConf.SThgConf.RescanIntervalS
 	}
@@ -173,6 +182,148 @@ func (s *SyncThing) FolderDelete(id string) error {
 	return nil
 }
 
+// FolderExport Creates (or updates) a send-only folder used to export an
+// existing server directory to a single device (server files are never changed)
+func (s *SyncThing) FolderExport(folderID, label, path, devID string) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+
+	var dev protocol.DeviceID
+	if err := dev.UnmarshalText([]byte(devID)); err != nil {
+		return fmt.Errorf("not a valid device id %s (%v)", devID, err)
+	}
+	found := false
+	for _, device := range stCfg.Devices {
+		if device.DeviceID == dev {
+			found = true
+			break
+		}
+	}
+	if !found {
+		stCfg.Devices = append(stCfg.Devices, stconfig.DeviceConfiguration{
+			DeviceID:  dev,
+			Name:      devID,
+			Addresses: []string{"dynamic"},
+		})
+	}
+
+	folder := stconfig.FolderConfiguration{
+		ID:          folderID,
+		Label:       label,
+		Path:        path,
+		Type:        stconfig.FolderTypeSendOnly,
+		IgnorePerms: s.conf.FileConf.FileAttrsConf != nil && s.conf.FileConf.FileAttrsConf.IgnorePerms,
+		Devices:     []stconfig.FolderDeviceConfiguration{{DeviceID: dev}},
+	}
+	if s.conf.FileConf.SThgConf.RescanIntervalS > 0 {
+		folder.RescanIntervalS = s.conf.FileConf.SThgConf.RescanIntervalS
+	}
+
+	found = false
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			stCfg.Folders[i] = folder
+			found = true
+			break
+		}
+	}
+	if !found {
+		stCfg.Folders = append(stCfg.Folders, folder)
+	}
+	return s.ConfigSet(stCfg)
+}
+
+// FolderRescanIntervalSet Update the rescan interval (in seconds) of a folder
+func (s *SyncThing) FolderRescanIntervalSet(folderID string, interval int) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			if f.RescanIntervalS == interval {
+				return nil
+			}
+			stCfg.Folders[i].RescanIntervalS = interval
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
+}
+
+// FolderMove Updates label and path of a folder (files must already be moved)
+func (s *SyncThing) FolderMove(folderID, label, path string) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			if label != "" {
+				stCfg.Folders[i].Label = label
+			}
+			stCfg.Folders[i].Path = path
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
+}
+
+// FolderIgnorePermsSet Enables or disables permissions synchronization of a folder
+func (s *SyncThing) FolderIgnorePermsSet(folderID string, ignore bool) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			if f.IgnorePerms == ignore {
+				return nil
+			}
+			stCfg.Folders[i].IgnorePerms = ignore
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
+}
+
+// FolderVersioningSet Sets file versioning settings of a folder
+func (s *SyncThing) FolderVersioningSet(folderID string, v xsapiv1.FolderVersioning) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			stCfg.Folders[i].Versioning = versioningConfig(v)
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
+}
+
+// versioningConfig converts versioning settings to Syncthing parameters
+func versioningConfig(v xsapiv1.FolderVersioning) stconfig.VersioningConfiguration {
+	params := make(map[string]string)
+	switch v.Type {
+	case xsapiv1.VersioningSimple:
+		keep := v.Keep
+		if keep <= 0 {
+			keep = 5
+		}
+		params["keep"] = strconv.Itoa(keep)
+		params["cleanoutDays"] = strconv.Itoa(v.CleanoutDays)
+	case xsapiv1.VersioningTrashcan:
+		params["cleanoutDays"] = strconv.Itoa(v.CleanoutDays)
+	case xsapiv1.VersioningStaggered:
+		params["maxAge"] = strconv.Itoa(v.MaxAgeDays * 24 * 3600)
+		params["cleanInterval"] = "3600"
+	}
+	return stconfig.VersioningConfiguration{Type: v.Type, Params: params}
+}
+
 // FolderConfigGet Returns the configuration of a specific folder
 func (s *SyncThing) FolderConfigGet(folderID string) (stconfig.FolderConfiguration, error) {
 	fc := stconfig.FolderConfiguration{}
@@ -199,7 +350,7 @@ func (s *SyncThing) FolderStatus(folderID string) (*FolderStatus, error) {
 	if folderID == "" {
 		return nil, fmt.Errorf("folderID not set")
 	}
-	if err := s.client.HTTPGet("db/status?folder="+folderID, &data); err != nil {
+	if err := s.httpGet("db/status?folder="+folderID, &data); err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal(data, &res); err != nil {
@@ -208,6 +359,27 @@ func (s *SyncThing) FolderStatus(folderID string) (*FolderStatus, error) {
 	return &res, nil
 }
 
+// FolderError Error of a file that cannot be synchronized
+type FolderError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// FolderErrors Returns files that cannot be synchronized
+func (s *SyncThing) FolderErrors(folderID string) ([]FolderError, error) {
+	var data []byte
+	res := struct {
+		Errors []FolderError `json:"errors"`
+	}{}
+	if err := s.httpGet("folder/errors?folder="+folderID, &data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res.Errors, nil
+}
+
 // IsFolderInSync Returns true when folder is in sync
 func (s *SyncThing) IsFolderInSync(folderID string) (bool, error) {
 	sts, err := s.FolderStatus(folderID)
@@ -228,5 +400,124 @@ func (s *SyncThing) FolderScan(folderID string, subpath string) error {
 			url += "&sub=" + subpath
 		}
 	}
-	return s.client.HTTPPost(url, "")
+	return s.httpPost(url, "")
+}
+
+// FolderIgnoresGet Returns ignore patterns (content of .stignore) of a folder
+// and the expanded list (IOW including patterns of #include files)
+func (s *SyncThing) FolderIgnoresGet(folderID string) ([]string, []string, error) {
+	var data []byte
+	res := struct {
+		Ignore   []string `json:"ignore"`
+		Expanded []string `json:"expanded"`
+	}{}
+	if folderID == "" {
+		return nil, nil, fmt.Errorf("folderID not set")
+	}
+	if err := s.httpGet("db/ignores?folder="+folderID, &data); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, nil, err
+	}
+	return res.Ignore, res.Expanded, nil
+}
+
+// FolderIgnoresSet Writes ignore patterns (.stignore file) of a folder
+func (s *SyncThing) FolderIgnoresSet(folderID string, ignore []string) error {
+	if folderID == "" {
+		return fmt.Errorf("folderID not set")
+	}
+	body, err := json.Marshal(struct {
+		Ignore []string `json:"ignore"`
+	}{ignore})
+	if err != nil {
+		return err
+	}
+	return s.httpPost("db/ignores?folder="+folderID, string(body))
+}
+
+// FolderDevicesSet Sets the remote devices a folder is shared with
+// (devices are added to Syncthing config when needed)
+func (s *SyncThing) FolderDevicesSet(folderID string, devIDs []string) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+
+	devices := []stconfig.FolderDeviceConfiguration{}
+	for _, id := range devIDs {
+		var devID protocol.DeviceID
+		if err := devID.UnmarshalText([]byte(id)); err != nil {
+			return fmt.Errorf("not a valid device id %s (%v)", id, err)
+		}
+		found := false
+		for _, device := range stCfg.Devices {
+			if device.DeviceID == devID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stCfg.Devices = append(stCfg.Devices, stconfig.DeviceConfiguration{
+				DeviceID:  devID,
+				Name:      id,
+				Addresses: []string{"dynamic"},
+			})
+		}
+		devices = append(devices, stconfig.FolderDeviceConfiguration{DeviceID: devID})
+	}
+
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			stCfg.Folders[i].Devices = devices
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
+}
+
+// FolderReceiveOnlySet Sets (or unsets) receive-only type of a folder
+// (IOW local changes are never sent to other devices)
+func (s *SyncThing) FolderReceiveOnlySet(folderID string, receiveOnly bool) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	for _, f := range stCfg.Folders {
+		if f.ID == folderID {
+			s.setReceiveOnly(folderID, receiveOnly)
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
+}
+
+// setReceiveOnly Registers folder type applied by ConfigSet
+func (s *SyncThing) setReceiveOnly(folderID string, receiveOnly bool) {
+	s.roMutex.Lock()
+	defer s.roMutex.Unlock()
+	if receiveOnly {
+		s.receiveOnly[folderID] = true
+	} else {
+		delete(s.receiveOnly, folderID)
+	}
+}
+
+// FolderPausedSet Pauses or resumes synchronization of a folder
+func (s *SyncThing) FolderPausedSet(folderID string, paused bool) error {
+	stCfg, err := s.ConfigGet()
+	if err != nil {
+		return err
+	}
+	for i, f := range stCfg.Folders {
+		if f.ID == folderID {
+			if f.Paused == paused {
+				return nil
+			}
+			stCfg.Folders[i].Paused = paused
+			return s.ConfigSet(stCfg)
+		}
+	}
+	return fmt.Errorf("id not found")
 }
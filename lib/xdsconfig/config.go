@@ -47,6 +47,7 @@ type Options struct {
 	LogLevel       string
 	LogFile        string
 	NoFolderConfig bool
+	SeedDemo       bool
 }
 
 // Config default values
@@ -56,6 +57,11 @@ const (
 	DefaultShareDir      = "${HOME}/.xds/server/projects"
 	DefaultSTHomeDir     = "${HOME}/.xds/server/syncthing-config"
 	DefaultSdkScriptsDir = "${EXEPATH}/sdks"
+	DefaultStoreDir      = "${HOME}/.xds/server/store"
+	DefaultSecretsDir    = "${HOME}/.xds/server/secrets"
+	DefaultEncryptDir    = "${HOME}/.xds/server/encrypted"
+	DefaultCcacheDir     = "${HOME}/.xds/server/ccache"
+	DefaultExecLogsDir   = "${HOME}/.xds/server/exec-logs"
 )
 
 // Init loads the configuration on start-up
@@ -64,12 +70,24 @@ func Init(cliCtx *cli.Context, log *logrus.Logger) (*Config, error) {
 
 	dfltShareDir := DefaultShareDir
 	dfltSTHomeDir := DefaultSTHomeDir
+	dfltStoreDir := DefaultStoreDir
+	dfltSecretsDir := DefaultSecretsDir
+	dfltEncryptDir := DefaultEncryptDir
 	if resDir, err := common.ResolveEnvVar(DefaultShareDir); err == nil {
 		dfltShareDir = resDir
 	}
 	if resDir, err := common.ResolveEnvVar(DefaultSTHomeDir); err == nil {
 		dfltSTHomeDir = resDir
 	}
+	if resDir, err := common.ResolveEnvVar(DefaultStoreDir); err == nil {
+		dfltStoreDir = resDir
+	}
+	if resDir, err := common.ResolveEnvVar(DefaultSecretsDir); err == nil {
+		dfltSecretsDir = resDir
+	}
+	if resDir, err := common.ResolveEnvVar(DefaultEncryptDir); err == nil {
+		dfltEncryptDir = resDir
+	}
 
 	// Retrieve Server ID (or create one the first time)
 	uuid, err := ServerIDGet()
@@ -93,6 +111,7 @@ func Init(cliCtx *cli.Context, log *logrus.Logger) (*Config, error) {
 			LogLevel:       cliCtx.GlobalString("log"),
 			LogFile:        cliCtx.GlobalString("logfile"),
 			NoFolderConfig: cliCtx.GlobalBool("no-folderconfig"),
+			SeedDemo:       cliCtx.GlobalBool("seed-demo"),
 		},
 		FileConf: FileConfig{
 			WebAppDir:     "webapp/dist",
@@ -101,6 +120,9 @@ func Init(cliCtx *cli.Context, log *logrus.Logger) (*Config, error) {
 			HTTPPort:      DefaultPort,
 			SThgConf:      &SyncThingConf{Home: dfltSTHomeDir},
 			LogsDir:       "",
+			StoreDir:      dfltStoreDir,
+			SecretsDir:    dfltSecretsDir,
+			EncryptDir:    dfltEncryptDir,
 		},
 		Log: log,
 	}
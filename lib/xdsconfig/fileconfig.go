@@ -26,6 +26,7 @@ import (
 	"strings"
 
 	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
 // ConfigDir Directory in user HOME directory where xds config will be saved
@@ -38,8 +39,62 @@ const (
 	ServerDataFilename = "server-data.xml"
 	// FoldersConfigFilename Folders config filename
 	FoldersConfigFilename = "server-config_folders.xml"
+	// LocalSdksConfigFilename SDKs registered from a local directory filename
+	LocalSdksConfigFilename = "server-config_sdks-local.xml"
+	// SdksUsageFilename SDKs usage statistics filename
+	SdksUsageFilename = "server-data_sdks-usage.xml"
+	// SyncBandwidthConfigFilename Synchronization rate limits set using REST API filename
+	SyncBandwidthConfigFilename = "server-config_sync-bandwidth.xml"
+	// FolderSnapshotsFilename Folders snapshots definition filename
+	FolderSnapshotsFilename = "server-data_folder-snapshots.xml"
+	// ExecHistoryFilename History of executed commands filename
+	ExecHistoryFilename = "server-data_exec-history.xml"
+	// ExecArtifactsFilename Artifacts collected after commands exit filename
+	ExecArtifactsFilename = "server-data_exec-artifacts.xml"
+	// ExecLogsFilename Complete output of commands saved in store (spill policy) filename
+	ExecLogsFilename = "server-data_exec-logs.xml"
+	// ExecPresetsConfigFilename Command templates defined using REST API filename
+	ExecPresetsConfigFilename = "server-config_exec-presets.xml"
+	// DeployTargetsConfigFilename Deployment targets registered using REST API filename
+	DeployTargetsConfigFilename = "server-config_deploy-targets.xml"
+	// SchedulesConfigFilename Scheduled commands filename
+	SchedulesConfigFilename = "server-config_schedules.xml"
+	// APITokensConfigFilename API tokens (hashed) filename
+	APITokensConfigFilename = "server-config_api-tokens.xml"
+	// RolesConfigFilename Roles of users assigned using REST API filename
+	RolesConfigFilename = "server-config_roles.xml"
+	// TLSCertFilename Generated self-signed certificate filename
+	TLSCertFilename = "server-data_tls-cert.pem"
+	// TLSKeyFilename Generated self-signed certificate key filename
+	TLSKeyFilename = "server-data_tls-key.pem"
+	// AgentsCACertFilename CA certificate used to issue agents certificates filename
+	AgentsCACertFilename = "server-data_agents-ca-cert.pem"
+	// AgentsCAKeyFilename CA private key filename
+	AgentsCAKeyFilename = "server-data_agents-ca-key.pem"
+	// AgentsConfigFilename Certificates issued to paired agents filename
+	AgentsConfigFilename = "server-config_agents.xml"
+	// SessionsFilename Client sessions (restored on restart) filename
+	SessionsFilename = "server-data_sessions.xml"
+	// AuditFilename Audit trail filename (one JSON entry per line)
+	AuditFilename = "server-data_audit.log"
+	// SecretsFilename Encrypted secrets store filename
+	SecretsFilename = "server-data_secrets.xml"
+	// SyncthingAPIKeyFilename Generated Syncthing API key filename
+	SyncthingAPIKeyFilename = "server-data_syncthing-apikey.xml"
+	// WebhooksConfigFilename Webhooks registered using REST API filename
+	WebhooksConfigFilename = "server-config_webhooks.xml"
 )
 
+// StreamConf definition of output streaming (commands and SDK installation)
+// to client connections
+type StreamConf struct {
+	BatchDelayMs int    `json:"batchDelayMs"` // maximum delay before output is sent (default 100)
+	BatchSize    int    `json:"batchSize"`    // size in bytes from which output is sent without delay (default 4096)
+	MaxPending   int    `json:"maxPending"`   // maximum size in bytes of output waiting to be sent to a connection (default 1MB)
+	Policy       string `json:"policy"`       // applied when maxPending is reached: "spill" (default) or "drop"
+	MaxSpill     int64  `json:"maxSpill"`     // maximum size in bytes written on disk per connection (default 64MB)
+}
+
 // SyncThingConf definition
 type SyncThingConf struct {
 	BinDir          string `json:"binDir"`
@@ -47,6 +102,309 @@ type SyncThingConf struct {
 	GuiAddress      string `json:"gui-address"`
 	GuiAPIKey       string `json:"gui-apikey"`
 	RescanIntervalS int    `json:"rescanIntervalS"`
+
+	// Rescan interval used when inotify watches limit is reached
+	FallbackRescanIntervalS int `json:"fallbackRescanIntervalS"`
+
+	// Send/receive rate limits (optionally scheduled by time of day)
+	Bandwidth *xsapiv1.SyncBandwidthConfig `json:"bandwidth"`
+
+	// Lifetime of generated API key, renewed on startup (0 = never expires)
+	APIKeyMaxAgeDays int `json:"apikeyMaxAgeDays"`
+}
+
+// ApprovalConf definition of operations that require a confirmation or an approval
+type ApprovalConf struct {
+	Operations []string `json:"operations"` // operations to protect (eg. folder-delete, sdk-remove)
+	Mode       string   `json:"mode"`       // "delay" (default) or "approval"
+	DelayS     int      `json:"delayS"`     // delay in seconds before confirmation is accepted
+	ExpireS    int      `json:"expireS"`    // pending operation lifetime in seconds
+}
+
+// FileAttrsConf definition of file attributes preserved by sync, archive,
+// artifact and deploy operations
+type FileAttrsConf struct {
+	IgnorePerms bool              `json:"ignorePerms"` // don't preserve POSIX permissions (preserved by default)
+	Owner       string            `json:"owner"`       // ownership rule: "none" (default), "keep" or "map"
+	OwnerMap    map[string]string `json:"ownerMap"`    // uid/gid mapping used by "map" rule (eg. {"1000": "0"})
+	Xattrs      bool              `json:"xattrs"`      // preserve extended attributes
+}
+
+// NetMountConf definition of helpers used to mount/umount network folders
+// (NFS/CIFS), mount is not managed by server when helpers are not set
+type NetMountConf struct {
+	MountHelper  string `json:"mountHelper"`  // called with: <type> <source> <mount point> <options>
+	UmountHelper string `json:"umountHelper"` // called with: <mount point>
+	CheckS       int    `json:"checkS"`       // interval in seconds between two health checks
+}
+
+// QuotaConf definition of folders disk quota
+type QuotaConf struct {
+	DefaultMB      int64 `json:"defaultMB"`      // quota of folders that don't define their own quota (0: no quota)
+	WarningPercent int   `json:"warningPercent"` // usage threshold to emit a warning (default 90)
+	CheckS         int   `json:"checkS"`         // interval in seconds between two usage computations
+}
+
+// PathMapConf definition of PathMap folders validation and provisioning
+type PathMapConf struct {
+	NoAutoCreate bool   `json:"noAutoCreate"` // fail when ServerPath doesn't exist (created by default)
+	DirMode      string `json:"dirMode"`      // octal permissions of created directories (default "0755")
+	Owner        string `json:"owner"`        // owner of created directories: "user[:group]" (names or ids)
+	MountPoint   string `json:"mountPoint"`   // ServerPath must be located on this mount (eg. shared volume)
+}
+
+// GitCloneConf definition of credentials used to clone Git repositories of
+// folders (a folder can only use the secret bound to host of its URL)
+type GitCloneConf struct {
+	Credentials map[string]string `json:"credentials"` // host pattern (eg. "*.example.com") -> name of secret
+}
+
+// SchedulerConf definition of exec commands concurrency limits (excess
+// commands are queued)
+type SchedulerConf struct {
+	MaxJobs           int `json:"maxJobs"`           // maximum number of concurrent commands (0: no limit)
+	MaxJobsPerSession int `json:"maxJobsPerSession"` // maximum number of concurrent commands of a session (0: no limit)
+}
+
+// ExecConf definition of environment of executed commands
+type ExecConf struct {
+	// Client variables injected in commands (shell patterns, eg. "LC_*"),
+	// all variables are injected when not set
+	EnvPassThrough []string `json:"envPassThrough"`
+	// Variables set for every command (override client ones), values can
+	// reference server environment (eg. "${http_proxy}")
+	Env map[string]string `json:"env"`
+	// Delay in seconds between SIGTERM and SIGKILL when a command is cancelled
+	CancelGraceS int `json:"cancelGraceS"`
+	// Default CPU and I/O priorities of commands (see ExecArgs nice and ionice)
+	Nice   int    `json:"nice"`
+	IONice string `json:"ionice"`
+	// Local user (name or uid) that executes commands instead of server user
+	// (server must be started as root), folders are chowned to this user
+	User string `json:"user"`
+	// Local users of clients (user name sent by client in XDS-User header ->
+	// local user), User is used for unmapped clients
+	UserMap map[string]string `json:"userMap"`
+	// Directories (besides shareRootDir and ccache directory) under which
+	// folders can be chowned to users of commands, commands of folders located
+	// elsewhere (eg. path-mapping folder of /etc) cannot be executed as user
+	UserRoots []string `json:"userRoots"`
+	// Secrets masked (replaced by ***) in output and history of commands:
+	// values of variables (shell patterns, eg. "*_TOKEN") and regexp matches
+	MaskEnv      []string `json:"maskEnv"`
+	MaskPatterns []string `json:"maskPatterns"`
+	// Maximum output size (in bytes) sent for a command (0: unlimited) and
+	// policy applied when reached (see ExecArgs outputLimit and outputPolicy)
+	OutputLimit  int64  `json:"outputLimit"`
+	OutputPolicy string `json:"outputPolicy"`
+	// Default shell and shell options of commands (see ExecArgs shell and
+	// shellOptions)
+	Shell        string   `json:"shell"`
+	ShellOptions []string `json:"shellOptions"`
+}
+
+// ContainerConf definition of container images used to execute commands
+// (folder and SDK directories are bind mounted at the same path)
+type ContainerConf struct {
+	Runtime       string            `json:"runtime"`       // "docker" or "podman" (default: first one installed)
+	DefaultImage  string            `json:"defaultImage"`  // image used when neither request nor SDK define one
+	SdkImages     map[string]string `json:"sdkImages"`     // default image of SDKs (key: SDK id, name or family name)
+	RunArgs       []string          `json:"runArgs"`       // additional options of run command (eg. --network=none)
+	AllowedImages []string          `json:"allowedImages"` // images that clients may request (patterns, eg. "registry.local/sdk/*"), default: configured images only
+}
+
+// CcacheConf definition of ccache directories provisioned for commands
+// (CCACHE_DIR is set in commands environment)
+type CcacheConf struct {
+	Disabled bool   `json:"disabled"`
+	Dir      string `json:"dir"`     // root directory of caches (default ${HOME}/.xds/server/ccache)
+	Scope    string `json:"scope"`   // one cache per "folder" (default) or per "sdk"
+	MaxSize  string `json:"maxSize"` // default size limit of a cache (eg. "5G")
+}
+
+// NodesConf definition of builder nodes: secondary servers register with a
+// primary server that dispatches exec commands on them
+type NodesConf struct {
+	Token    string `json:"token"`    // secret shared by primary and nodes (required)
+	Primary  string `json:"primary"`  // node: API URL of primary server (eg. http://primary:8000/api/v1)
+	Name     string `json:"name"`     // node: name advertised to primary (default: hostname)
+	URL      string `json:"url"`      // node: API URL advertised to primary
+	Capacity int    `json:"capacity"` // node: maximum number of dispatched commands (default: number of CPUs)
+	Disabled bool   `json:"disabled"` // primary: never dispatch commands (unless requested by client)
+}
+
+// HooksConf definition of hooks triggered when commands exited (see
+// FolderConfig hooks)
+type HooksConf struct {
+	Disabled bool      `json:"disabled"`
+	TimeoutS int       `json:"timeoutS"` // maximum duration of a hook (default 60)
+	SMTP     *SMTPConf `json:"smtp"`     // mail server used by email hooks
+	// Secrets that webhooks may use, per URL host (key: host name pattern,
+	// eg. "*.iot.bzh", value: secret name)
+	WebhookSecrets map[string]string `json:"webhookSecrets"`
+	// Allowed recipients of email hooks (address patterns, eg. "*@iot.bzh")
+	EmailRecipients []string `json:"emailRecipients"`
+}
+
+// SMTPConf definition of a mail server
+type SMTPConf struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"` // default 25
+	User   string `json:"user"`
+	Secret string `json:"secret"` // name of server secret that holds password
+	From   string `json:"from"`
+}
+
+// WebhooksConf definition of server events notification to HTTP endpoints
+// registered using REST API (see /admin/webhooks)
+type WebhooksConf struct {
+	Disabled    bool `json:"disabled"`
+	TimeoutS    int  `json:"timeoutS"`    // maximum duration of a request (default 10)
+	MaxAttempts int  `json:"maxAttempts"` // attempts before a delivery fails (default 5)
+	RetryDelayS int  `json:"retryDelayS"` // delay before first retry, doubled on each retry (default 10)
+}
+
+// MQTTConf definition of MQTT broker on which events are published (see
+// /admin/mqtt)
+type MQTTConf struct {
+	URL                string            `json:"url"`      // tcp://host[:port] or ssl://host[:port]
+	ClientID           string            `json:"clientID"` // default xds-server-<hostname>
+	User               string            `json:"user"`
+	Secret             string            `json:"secret"` // name of server secret that holds password
+	CAFile             string            `json:"caFile"` // PEM CA certificates used to check broker certificate
+	InsecureSkipVerify bool              `json:"insecureSkipVerify"`
+	TimeoutS           int               `json:"timeoutS"`   // default 10
+	KeepAliveS         int               `json:"keepAliveS"` // default 60
+	QoS                int               `json:"qos"`        // 0 (default) or 1
+	Retain             bool              `json:"retain"`
+	TopicPrefix        string            `json:"topicPrefix"` // default xds
+	Topics             map[string]string `json:"topics"`      // event type -> topic that may contain {folderID}, {sdkID} or {cmdID} (default <topicPrefix>/<event name>)
+	Events             []string          `json:"events"`      // published events (default SDK install, remove and state change, folder state change and exec exit)
+}
+
+// AuditConf definition of audit trail of user operations (exec, SDKs and
+// folders changes)
+type AuditConf struct {
+	Disabled      bool   `json:"disabled"`
+	Syslog        bool   `json:"syslog"`        // also forward entries to syslog
+	SyslogNetwork string `json:"syslogNetwork"` // eg. udp or tcp (default: local syslog)
+	SyslogAddr    string `json:"syslogAddr"`    // eg. loghost:514
+	SyslogTag     string `json:"syslogTag"`     // default xds-server
+}
+
+// OIDCConf definition of OpenID Connect authentication (login delegated to
+// an identity provider, eg. corporate SSO)
+type OIDCConf struct {
+	Issuer       string            `json:"issuer"` // provider URL (see /.well-known/openid-configuration)
+	ClientID     string            `json:"clientID"`
+	ClientSecret string            `json:"clientSecret"` // name of server secret that holds client secret
+	RedirectURL  string            `json:"redirectURL"`  // eg. https://xds.example.com/api/v1/auth/callback
+	Scopes       []string          `json:"scopes"`       // default: openid profile email
+	UserClaim    string            `json:"userClaim"`    // claim used as xds user (default preferred_username)
+	UserMap      map[string]string `json:"userMap"`      // claim value -> xds user (default: claim value)
+	Required     bool              `json:"required"`     // reject API requests of not authenticated clients
+}
+
+// LDAPConf definition of LDAP/Active Directory authentication (password
+// checked by binding as user, roles granted according to groups of user)
+type LDAPConf struct {
+	URL                string            `json:"url"` // ldap://host[:port] or ldaps://host[:port]
+	StartTLS           bool              `json:"startTLS"`
+	CAFile             string            `json:"caFile"` // PEM CA certificates used to check server certificate
+	InsecureSkipVerify bool              `json:"insecureSkipVerify"`
+	TimeoutS           int               `json:"timeoutS"`      // default 10
+	BindDN             string            `json:"bindDN"`        // account used to search users (default anonymous)
+	BindSecret         string            `json:"bindSecret"`    // name of server secret that holds password of bindDN
+	BaseDN             string            `json:"baseDN"`        // base of users (and groups) search
+	UserFilter         string            `json:"userFilter"`    // default (uid=%s), eg. (sAMAccountName=%s) for Active Directory
+	UserDN             string            `json:"userDN"`        // bind as user without search when bindDN not set, eg. %s@corp.example.com
+	UserAttr           string            `json:"userAttr"`      // attribute used as xds user (default login name)
+	GroupAttr          string            `json:"groupAttr"`     // attribute of user listing groups (default memberOf)
+	GroupBaseDN        string            `json:"groupBaseDN"`   // base of groups search (default baseDN)
+	GroupFilter        string            `json:"groupFilter"`   // search groups instead of using groupAttr, eg. (member=%s) (%s replaced by user DN)
+	GroupRoles         map[string]string `json:"groupRoles"`    // group DN or name -> xds role
+	GroupRequired      bool              `json:"groupRequired"` // reject users that are not member of a group of groupRoles
+	Required           bool              `json:"required"`      // reject API requests of not authenticated clients
+}
+
+// RBACConf definition of role-based access control (roles of users are
+// assigned using REST API), only authenticated users (OpenID Connect, LDAP or
+// API tokens) get a role other than default one
+type RBACConf struct {
+	Enabled     bool     `json:"enabled"`
+	DefaultRole string   `json:"defaultRole"` // role of users without assignment (default developer)
+	Admins      []string `json:"admins"`      // users that are always admin
+}
+
+// TLSConf definition of HTTPS support of web server (REST API, websocket and
+// web app), certificate is reloaded on SIGHUP or when files changed
+type TLSConf struct {
+	CertFile     string    `json:"certFile"`     // PEM certificate (chain)
+	KeyFile      string    `json:"keyFile"`      // PEM private key
+	SelfSigned   bool      `json:"selfSigned"`   // generate a self-signed certificate when files don't exist
+	ReloadCheckS int       `json:"reloadCheckS"` // period of certificate files check (default 60, -1 to disable)
+	MTLSConf     *MTLSConf `json:"mtls"`
+}
+
+// MTLSConf definition of mutual TLS between xds-agent and xds-server: server
+// maintains a CA and issues client certificates to paired agents
+type MTLSConf struct {
+	Required       bool `json:"required"`       // reject requests of agents without valid certificate
+	CertDays       int  `json:"certDays"`       // validity of issued certificates (default 365)
+	PairingExpireS int  `json:"pairingExpireS"` // lifetime of pairing codes (default 600)
+}
+
+// SessionConf definition of client sessions lifetime
+type SessionConf struct {
+	MaxAgeS      int `json:"maxAgeS"`      // maximum lifetime of a session (default 3600)
+	IdleTimeoutS int `json:"idleTimeoutS"` // session expires after this inactivity period (0 to disable)
+	WarnBeforeS  int `json:"warnBeforeS"`  // delay of expiring warning before forced logout (default 60)
+}
+
+// RateLimitConf definition of requests rate limiting (token bucket per client
+// IP, or per bearer token when set)
+type RateLimitConf struct {
+	RequestsPerS      float64  `json:"requestsPerS"`      // sustained REST API requests rate per IP (0 to disable)
+	Burst             int      `json:"burst"`             // requests accepted in a burst (default 20)
+	TokenRequestsPerS float64  `json:"tokenRequestsPerS"` // rate per bearer token (default requestsPerS)
+	TokenBurst        int      `json:"tokenBurst"`        // (default burst)
+	EventsPerMin      float64  `json:"eventsPerMin"`      // events (un)registrations per client (0 to disable)
+	EventsBurst       int      `json:"eventsBurst"`       // (default 10)
+	Exempt            []string `json:"exempt"`            // client IPs never limited
+	TrustProxy        bool     `json:"trustProxy"`        // limit per X-Forwarded-For/X-Real-Ip addresses set by a reverse proxy
+}
+
+// CORSConf definition of cross-origin requests policy (origins support
+// wildcards, eg. "*" or "https://*.example.com")
+type CORSConf struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods"`   // default GET, POST, PUT, DELETE
+	AllowedHeaders   []string `json:"allowedHeaders"`   // default Content-Type, Authorization, XDS-SID and XDS-User ("*" to allow all)
+	ExposedHeaders   []string `json:"exposedHeaders"`   // default XDS-SID, XDS-Version and XDS-API-Version
+	AllowCredentials bool     `json:"allowCredentials"` // allow cookies (origin is then never replied as "*")
+	MaxAgeS          int      `json:"maxAgeS"`          // lifetime of preflight result (default 3600)
+}
+
+// UnixConf definition of API served on a Unix domain socket
+type UnixConf struct {
+	Path       string `json:"path"`
+	Mode       string `json:"mode"`       // socket file permissions (octal, default 0660)
+	Group      string `json:"group"`      // group owner of socket file (access granted to its members)
+	DisableTCP bool   `json:"disableTCP"` // only serve on Unix socket (don't listen on httpPort)
+}
+
+// IPACLConf definition of network access control list (IP or CIDR, deny
+// list has precedence, empty allow list allows every address)
+type IPACLConf struct {
+	Allow      []string `json:"allow"`
+	Deny       []string `json:"deny"`
+	TrustProxy bool     `json:"trustProxy"` // use X-Forwarded-For/X-Real-Ip headers set by a reverse proxy
+}
+
+// SecretsConf definition of encrypted secrets store (master key may also be
+// set using XDS_SECRETS_KEY environment variable)
+type SecretsConf struct {
+	MasterKey string `json:"masterKey"`
 }
 
 // FileConfig is the JSON structure of xds-server config file (server-config.json)
@@ -57,6 +415,35 @@ type FileConfig struct {
 	HTTPPort      string         `json:"httpPort"`
 	SThgConf      *SyncThingConf `json:"syncthing"`
 	LogsDir       string         `json:"logsDir"`
+	ApprovalConf  *ApprovalConf  `json:"approval"`
+	StoreDir      string         `json:"storeDir"` // content-addressed store of logs and artifacts
+	FileAttrsConf *FileAttrsConf `json:"fileAttributes"`
+	NetMountConf  *NetMountConf  `json:"netMount"`
+	SecretsDir    string         `json:"secretsDir"` // credentials used to access external resources
+	QuotaConf     *QuotaConf     `json:"quota"`
+	PathMapConf   *PathMapConf   `json:"pathMap"`
+	GitCloneConf  *GitCloneConf  `json:"gitClone"`
+	EncryptDir    string         `json:"encryptDir"` // encrypted files of folders with at rest encryption
+	SchedulerConf *SchedulerConf `json:"scheduler"`
+	ExecConf      *ExecConf      `json:"exec"`
+	ContainerConf *ContainerConf `json:"container"`
+	CcacheConf    *CcacheConf    `json:"ccache"`
+	NodesConf     *NodesConf     `json:"nodes"`
+	HooksConf     *HooksConf     `json:"hooks"`
+	AuditConf     *AuditConf     `json:"audit"`
+	OIDCConf      *OIDCConf      `json:"oidc"`
+	RBACConf      *RBACConf      `json:"rbac"`
+	LDAPConf      *LDAPConf      `json:"ldap"`
+	TLSConf       *TLSConf       `json:"tls"`
+	SessionConf   *SessionConf   `json:"session"`
+	RateLimitConf *RateLimitConf `json:"rateLimit"`
+	CORSConf      *CORSConf      `json:"cors"`
+	UnixConf      *UnixConf      `json:"unixSocket"`
+	IPACLConf     *IPACLConf     `json:"ipACL"`
+	SecretsConf   *SecretsConf   `json:"secrets"`
+	StreamConf    *StreamConf    `json:"outputStream"`
+	WebhooksConf  *WebhooksConf  `json:"webhooks"`
+	MQTTConf      *MQTTConf      `json:"mqtt"`
 }
 
 // readGlobalConfig reads configuration from a config file.
@@ -118,10 +505,31 @@ func readGlobalConfig(c *Config, confFile string) error {
 		&fCfg.WebAppDir,
 		&fCfg.ShareRootDir,
 		&fCfg.SdkScriptsDir,
-		&fCfg.LogsDir}
+		&fCfg.LogsDir,
+		&fCfg.StoreDir,
+		&fCfg.SecretsDir,
+		&fCfg.EncryptDir}
 	if fCfg.SThgConf != nil {
 		vars = append(vars, &fCfg.SThgConf.Home, &fCfg.SThgConf.BinDir)
 	}
+	if fCfg.NetMountConf != nil {
+		vars = append(vars, &fCfg.NetMountConf.MountHelper, &fCfg.NetMountConf.UmountHelper)
+	}
+	if fCfg.PathMapConf != nil {
+		vars = append(vars, &fCfg.PathMapConf.MountPoint)
+	}
+	if fCfg.CcacheConf != nil {
+		vars = append(vars, &fCfg.CcacheConf.Dir)
+	}
+	if fCfg.UnixConf != nil {
+		vars = append(vars, &fCfg.UnixConf.Path)
+	}
+	if fCfg.SecretsConf != nil {
+		vars = append(vars, &fCfg.SecretsConf.MasterKey)
+	}
+	if fCfg.LDAPConf != nil {
+		vars = append(vars, &fCfg.LDAPConf.CAFile)
+	}
 	for _, field := range vars {
 		var err error
 		if *field, err = common.ResolveEnvVar(*field); err != nil {
@@ -145,6 +553,15 @@ func readGlobalConfig(c *Config, confFile string) error {
 	if fCfg.LogsDir == "" {
 		fCfg.LogsDir = c.FileConf.LogsDir
 	}
+	if fCfg.StoreDir == "" {
+		fCfg.StoreDir = c.FileConf.StoreDir
+	}
+	if fCfg.SecretsDir == "" {
+		fCfg.SecretsDir = c.FileConf.SecretsDir
+	}
+	if fCfg.EncryptDir == "" {
+		fCfg.EncryptDir = c.FileConf.EncryptDir
+	}
 
 	// Resolve webapp dir (support relative or full path)
 	fCfg.WebAppDir = strings.Trim(fCfg.WebAppDir, " ")
@@ -182,3 +599,113 @@ func FoldersConfigFilenameGet() (string, error) {
 func ServerDataFilenameGet() (string, error) {
 	return configFilenameGet(ServerDataFilename)
 }
+
+// LocalSdksConfigFilenameGet
+func LocalSdksConfigFilenameGet() (string, error) {
+	return configFilenameGet(LocalSdksConfigFilename)
+}
+
+// SdksUsageFilenameGet
+func SdksUsageFilenameGet() (string, error) {
+	return configFilenameGet(SdksUsageFilename)
+}
+
+// SyncBandwidthConfigFilenameGet
+func SyncBandwidthConfigFilenameGet() (string, error) {
+	return configFilenameGet(SyncBandwidthConfigFilename)
+}
+
+// FolderSnapshotsFilenameGet
+func FolderSnapshotsFilenameGet() (string, error) {
+	return configFilenameGet(FolderSnapshotsFilename)
+}
+
+// ExecHistoryFilenameGet
+func ExecHistoryFilenameGet() (string, error) {
+	return configFilenameGet(ExecHistoryFilename)
+}
+
+// ExecArtifactsFilenameGet
+func ExecArtifactsFilenameGet() (string, error) {
+	return configFilenameGet(ExecArtifactsFilename)
+}
+
+// ExecLogsFilenameGet
+func ExecLogsFilenameGet() (string, error) {
+	return configFilenameGet(ExecLogsFilename)
+}
+
+// ExecPresetsConfigFilenameGet
+func ExecPresetsConfigFilenameGet() (string, error) {
+	return configFilenameGet(ExecPresetsConfigFilename)
+}
+
+// DeployTargetsConfigFilenameGet
+func DeployTargetsConfigFilenameGet() (string, error) {
+	return configFilenameGet(DeployTargetsConfigFilename)
+}
+
+// SchedulesConfigFilenameGet
+func SchedulesConfigFilenameGet() (string, error) {
+	return configFilenameGet(SchedulesConfigFilename)
+}
+
+// APITokensConfigFilenameGet
+func APITokensConfigFilenameGet() (string, error) {
+	return configFilenameGet(APITokensConfigFilename)
+}
+
+// RolesConfigFilenameGet
+func RolesConfigFilenameGet() (string, error) {
+	return configFilenameGet(RolesConfigFilename)
+}
+
+// TLSCertFilenameGet
+func TLSCertFilenameGet() (string, error) {
+	return configFilenameGet(TLSCertFilename)
+}
+
+// TLSKeyFilenameGet
+func TLSKeyFilenameGet() (string, error) {
+	return configFilenameGet(TLSKeyFilename)
+}
+
+// AgentsCACertFilenameGet
+func AgentsCACertFilenameGet() (string, error) {
+	return configFilenameGet(AgentsCACertFilename)
+}
+
+// AgentsCAKeyFilenameGet
+func AgentsCAKeyFilenameGet() (string, error) {
+	return configFilenameGet(AgentsCAKeyFilename)
+}
+
+// AgentsConfigFilenameGet
+func AgentsConfigFilenameGet() (string, error) {
+	return configFilenameGet(AgentsConfigFilename)
+}
+
+// SessionsFilenameGet
+func SessionsFilenameGet() (string, error) {
+	return configFilenameGet(SessionsFilename)
+}
+
+// AuditFilenameGet
+func AuditFilenameGet() (string, error) {
+	return configFilenameGet(AuditFilename)
+}
+
+// SecretsFilenameGet
+func SecretsFilenameGet() (string, error) {
+	return configFilenameGet(SecretsFilename)
+}
+
+// SyncthingAPIKeyFilenameGet
+func SyncthingAPIKeyFilenameGet() (string, error) {
+	return configFilenameGet(SyncthingAPIKeyFilename)
+}
+
+// WebhooksConfigFilenameGet
+func WebhooksConfigFilenameGet() (string, error) {
+	return configFilenameGet(WebhooksConfigFilename)
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const agentsCADuration = 10 * 365 * 24 * time.Hour // Validity of generated CA
+const agentDefaultCertDays = 365                   // Default validity (in days) of agents certificates
+const agentDefaultPairingExpire = 600              // Default lifetime (in seconds) of pairing codes
+
+// AgentsCA Certificate authority used to authenticate xds-agent (mutual TLS)
+type AgentsCA struct {
+	*Context
+	conf     xdsconfig.MTLSConf
+	caCert   *x509.Certificate
+	caKey    crypto.Signer
+	caPEM    []byte
+	agents   map[string]*xsapiv1.AgentCert // serial -> agent
+	pairings map[string]pairingCode        // code -> pairing
+	mutex    sync.Mutex
+}
+
+// pairingCode Hold a one-time pairing code
+type pairingCode struct {
+	expireAt time.Time
+	user     string
+}
+
+// Use XML format to be consistent with other config files
+type xmlAgents struct {
+	XMLName xml.Name            `xml:"agents"`
+	Version string              `xml:"version,attr"`
+	Agents  []xsapiv1.AgentCert `xml:"agent"`
+}
+
+// NewAgentsCA creates a new instance of AgentsCA (CA is generated on first start)
+func NewAgentsCA(ctx *Context, conf *xdsconfig.MTLSConf) (*AgentsCA, error) {
+	a := AgentsCA{
+		Context:  ctx,
+		conf:     *conf,
+		agents:   make(map[string]*xsapiv1.AgentCert),
+		pairings: make(map[string]pairingCode),
+		mutex:    sync.NewMutex(),
+	}
+	if a.conf.CertDays <= 0 {
+		a.conf.CertDays = agentDefaultCertDays
+	}
+	if a.conf.PairingExpireS <= 0 {
+		a.conf.PairingExpireS = agentDefaultPairingExpire
+	}
+
+	if err := a.loadCA(); err != nil {
+		return nil, fmt.Errorf("Cannot setup agents CA: %v", err)
+	}
+	a.load()
+	a.Log.Infof("Agents mutual TLS enabled (required %v, %d agent(s) paired)", a.conf.Required, len(a.agents))
+	return &a, nil
+}
+
+// Required returns true when requests of agents without valid certificate are rejected
+func (a *AgentsCA) Required() bool {
+	return a.conf.Required
+}
+
+// SetupTLS configures web server to request and verify agents certificates
+func (a *AgentsCA) SetupTLS(cfg *tls.Config) {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.caCert)
+	cfg.ClientCAs = pool
+	// Browsers don't have certificate, so rejection is done by API (see agentsMiddleware)
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.VerifyPeerCertificate = a.verifyPeer
+}
+
+// Verified returns the agent that sent a request (nil when no valid certificate)
+func (a *AgentsCA) Verified(r *http.Request) *xsapiv1.AgentCert {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ag := a._valid(r.TLS.VerifiedChains[0][0])
+	if ag == nil {
+		return nil
+	}
+	res := *ag
+	return &res
+}
+
+// PairingCreate creates a one-time code that an agent uses to get its certificate
+func (a *AgentsCA) PairingCreate(user string) (*xsapiv1.AgentPairingCode, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("Cannot generate pairing code: %v", err)
+	}
+	code := strings.ToUpper(hex.EncodeToString(b))
+	expire := time.Now().Add(time.Duration(a.conf.PairingExpireS) * time.Second)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for c, p := range a.pairings {
+		if time.Now().After(p.expireAt) {
+			delete(a.pairings, c)
+		}
+	}
+	a.pairings[code] = pairingCode{expireAt: expire, user: user}
+
+	return &xsapiv1.AgentPairingCode{Code: code, ExpireAt: expire.Format(time.RFC3339)}, nil
+}
+
+// Pair issues a client certificate to an agent that owns a valid pairing code
+func (a *AgentsCA) Pair(args xsapiv1.AgentPairArgs) (*xsapiv1.AgentPairResult, error) {
+	if args.Name == "" {
+		return nil, fmt.Errorf("agent name must be set")
+	}
+
+	// Code is consumed even when pairing fails
+	a.mutex.Lock()
+	p, exist := a.pairings[strings.ToUpper(strings.TrimSpace(args.Code))]
+	delete(a.pairings, strings.ToUpper(strings.TrimSpace(args.Code)))
+	a.mutex.Unlock()
+	if !exist || time.Now().After(p.expireAt) {
+		return nil, fmt.Errorf("invalid or expired pairing code")
+	}
+
+	res := xsapiv1.AgentPairResult{CACert: string(a.caPEM)}
+	var pubKey interface{}
+	if args.CSR != "" {
+		blk, _ := pem.Decode([]byte(args.CSR))
+		if blk == nil || blk.Type != "CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("invalid certificate request")
+		}
+		csr, err := x509.ParseCertificateRequest(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate request: %v", err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+		}
+		pubKey = csr.PublicKey
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pubKey = &key.PublicKey
+		res.Key = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: args.Name, Organization: []string{"XDS agent"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Duration(a.conf.CertDays) * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, a.caCert, pubKey, a.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot issue certificate: %v", err)
+	}
+	fp := sha256.Sum256(der)
+	res.Cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	res.Agent = xsapiv1.AgentCert{
+		Serial:      serial.Text(16),
+		Name:        args.Name,
+		Fingerprint: hex.EncodeToString(fp[:]),
+		IssuedAt:    now.Format(time.RFC3339),
+		ExpireAt:    tmpl.NotAfter.Format(time.RFC3339),
+		IssuedBy:    p.user,
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ag := res.Agent
+	a.agents[ag.Serial] = &ag
+	if err := a.save(); err != nil {
+		delete(a.agents, ag.Serial)
+		return nil, fmt.Errorf("Cannot save agents: %v", err)
+	}
+
+	a.Log.Infof("Agent %s paired (certificate serial %s)", ag.Name, ag.Serial)
+	return &res, nil
+}
+
+// GetAll returns certificates issued to agents
+func (a *AgentsCA) GetAll() []xsapiv1.AgentCert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	res := []xsapiv1.AgentCert{}
+	for _, ag := range a.agents {
+		res = append(res, *ag)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].IssuedAt < res[j].IssuedAt })
+	return res
+}
+
+// Revoke revokes the certificate of an agent (serial or name)
+func (a *AgentsCA) Revoke(id string) (*xsapiv1.AgentCert, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, ag := range a.agents {
+		if (ag.Serial != id && ag.Name != id) || ag.Revoked {
+			continue
+		}
+		ag.Revoked = true
+		if err := a.save(); err != nil {
+			ag.Revoked = false
+			return nil, fmt.Errorf("Cannot save agents: %v", err)
+		}
+		a.Log.Infof("Certificate of agent %s revoked (serial %s)", ag.Name, ag.Serial)
+		res := *ag
+		return &res, nil
+	}
+	return nil, fmt.Errorf("unknown agent")
+}
+
+/*** Private functions ***/
+
+// verifyPeer rejects during TLS handshake certificates that are revoked or
+// unknown (certificate chain is already verified using CA)
+func (a *AgentsCA) verifyPeer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a._valid(verifiedChains[0][0]) == nil {
+		return fmt.Errorf("agent certificate revoked or unknown")
+	}
+	return nil
+}
+
+// _valid returns agent of a certificate when not revoked (mutex must be locked)
+func (a *AgentsCA) _valid(cert *x509.Certificate) *xsapiv1.AgentCert {
+	ag, exist := a.agents[cert.SerialNumber.Text(16)]
+	if !exist || ag.Revoked {
+		return nil
+	}
+	return ag
+}
+
+// loadCA loads CA certificate and key (created when not existing)
+func (a *AgentsCA) loadCA() error {
+	certFile, err := xdsconfig.AgentsCACertFilenameGet()
+	if err != nil {
+		return err
+	}
+	keyFile, err := xdsconfig.AgentsCAKeyFilenameGet()
+	if err != nil {
+		return err
+	}
+	if !common.Exists(certFile) && !common.Exists(keyFile) {
+		if err := a.generateCA(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported CA key type")
+	}
+	if a.caCert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return err
+	}
+	a.caKey = signer
+	a.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.Certificate[0]})
+	return nil
+}
+
+// generateCA creates a new self-signed CA
+func (a *AgentsCA) generateCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "XDS agents CA " + host, Organization: []string{"XDS server"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(agentsCADuration),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	a.Log.Infof("Agents CA generated: %s", certFile)
+	return nil
+}
+
+// load reads certificates issued to agents
+func (a *AgentsCA) load() {
+	file, err := xdsconfig.AgentsConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		a.Log.Errorf("Cannot read agents: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlAgents{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		a.Log.Errorf("Cannot decode agents: %v", err)
+		return
+	}
+	for i := range data.Agents {
+		ag := data.Agents[i]
+		a.agents[ag.Serial] = &ag
+	}
+}
+
+// save writes certificates issued to agents on disk (mutex must be locked)
+func (a *AgentsCA) save() error {
+	file, err := xdsconfig.AgentsConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	data := xmlAgents{Version: "1", Agents: []xsapiv1.AgentCert{}}
+	for _, ag := range a.agents {
+		data.Agents = append(data.Agents, *ag)
+	}
+	sort.Slice(data.Agents, func(i, j int) bool { return data.Agents[i].IssuedAt < data.Agents[j].IssuedAt })
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&data)
+}
+
+// newSerialNumber returns a random certificate serial number
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const apiTokenPrefix = "xds_"        // prefix of generated tokens (ease detection in logs or repos)
+const apiTokenAuthScheme = "Bearer " // scheme of Authorization header
+const apiTokenSubject = "apitoken:"  // prefix of subject of API tokens identities
+
+// APITokens Long-lived tokens used by non-browser clients
+// Only the sha256 of tokens is saved, tokens are returned once on creation.
+type APITokens struct {
+	*Context
+	tokens  []xsapiv1.APIToken
+	changed bool // last usage dates not saved yet
+	mutex   sync.Mutex
+}
+
+// Use XML format and not json to be able to save hash (masked in json)
+type xmlAPITokens struct {
+	XMLName xml.Name           `xml:"apiTokens"`
+	Version string             `xml:"version,attr"`
+	Tokens  []xsapiv1.APIToken `xml:"token"`
+}
+
+// NewAPITokens creates a new instance of APITokens
+func NewAPITokens(ctx *Context) *APITokens {
+	t := APITokens{
+		Context: ctx,
+		tokens:  []xsapiv1.APIToken{},
+		mutex:   sync.NewMutex(),
+	}
+	t.load()
+	return &t
+}
+
+// Stop saves last usage dates of tokens
+func (t *APITokens) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.changed {
+		if err := t.save(); err != nil {
+			t.Log.Errorf("Cannot save API tokens: %v", err)
+		}
+	}
+}
+
+// Create generates a new token (returned only once)
+func (t *APITokens) Create(args xsapiv1.APITokenCreateArgs) (*xsapiv1.APIToken, error) {
+	if args.Name == "" {
+		return nil, fmt.Errorf("token name must be set")
+	}
+	if args.ExpireDays < 0 {
+		return nil, fmt.Errorf("invalid expireDays")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("Cannot generate token: %v", err)
+	}
+	token := apiTokenPrefix + hex.EncodeToString(b)
+
+	now := time.Now()
+	tok := xsapiv1.APIToken{
+		ID:        uuid.NewV4().String(),
+		Name:      args.Name,
+		User:      args.User,
+		CreatedAt: now.Format(time.RFC3339),
+		Hash:      apiTokenHash(token),
+	}
+	if args.ExpireDays > 0 {
+		tok.ExpireAt = now.AddDate(0, 0, args.ExpireDays).Format(time.RFC3339)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, tt := range t.tokens {
+		if tt.Name == args.Name {
+			return nil, fmt.Errorf("token %s already exists", args.Name)
+		}
+	}
+	t.tokens = append(t.tokens, tok)
+	if err := t.save(); err != nil {
+		t.tokens = t.tokens[:len(t.tokens)-1]
+		return nil, err
+	}
+
+	t.Log.Infof("New API token %s (%s)", tok.ID, tok.Name)
+	tok.Token = token
+	return &tok, nil
+}
+
+// GetAll returns all tokens (without secrets)
+func (t *APITokens) GetAll() []xsapiv1.APIToken {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := append([]xsapiv1.APIToken{}, t.tokens...)
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt < res[j].CreatedAt })
+	return res
+}
+
+// Revoke deletes a token (using its ID or name)
+func (t *APITokens) Revoke(id string) (*xsapiv1.APIToken, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, tok := range t.tokens {
+		if tok.ID == id || tok.Name == id {
+			t.tokens = append(t.tokens[:i], t.tokens[i+1:]...)
+			t.Log.Infof("API token %s (%s) revoked", tok.ID, tok.Name)
+			return &tok, t.save()
+		}
+	}
+	return nil, fmt.Errorf("unknown token")
+}
+
+// Check returns the definition of a token (sent in Authorization header)
+func (t *APITokens) Check(token string) (*xsapiv1.APIToken, error) {
+	hash := apiTokenHash(token)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i := range t.tokens {
+		tok := &t.tokens[i]
+		if tok.Hash != hash {
+			continue
+		}
+		now := time.Now()
+		if tok.ExpireAt != "" {
+			if exp, err := time.Parse(time.RFC3339, tok.ExpireAt); err != nil || now.After(exp) {
+				return nil, fmt.Errorf("token expired")
+			}
+		}
+		tok.LastUsedAt = now.Format(time.RFC3339)
+		t.changed = true
+		res := *tok
+		return &res, nil
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+/*** Private functions ***/
+
+// apiTokenHash returns the hash saved for a token
+func apiTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// load reads tokens from disk
+func (t *APITokens) load() {
+	file, err := xdsconfig.APITokensConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		t.Log.Errorf("Cannot read API tokens: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlAPITokens{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		t.Log.Errorf("Cannot decode API tokens: %v", err)
+		return
+	}
+	t.tokens = data.Tokens
+}
+
+// save writes tokens on disk (mutex must be locked)
+func (t *APITokens) save() error {
+	file, err := xdsconfig.APITokensConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Only owner can read hashes
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&xmlAPITokens{Version: "1", Tokens: t.tokens}); err != nil {
+		return err
+	}
+	t.changed = false
+	return nil
+}
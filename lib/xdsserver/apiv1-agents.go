@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// agentsMiddleware rejects requests of agents without valid certificate when
+// mutual TLS is required (pairing and version requests, builder nodes requests
+// with a valid node token, and clients authenticated using OpenID Connect or
+// API tokens are accepted)
+func (s *APIService) agentsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.agentsCA == nil || !s.agentsCA.Required() || s.agentsCA.Verified(c.Request) != nil {
+			c.Next()
+			return
+		}
+		path := strings.TrimPrefix(c.Request.URL.Path, s.apiRouter.BasePath())
+		if nodeRoute(c, path) {
+			s.nodeAuth(c)
+			return
+		}
+		if path == "/agents/pair" || path == "/version" {
+			c.Next()
+			return
+		}
+		if sess := s.sessions.Get(c); sess == nil || !sess.IsAuthenticated() {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "Valid agent certificate required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// getAgents returns certificates issued to agents
+func (s *APIService) getAgents(c *gin.Context) {
+	if s.agentsCA == nil {
+		common.APIError(c, "Agents mutual TLS not configured")
+		return
+	}
+	c.JSON(http.StatusOK, s.agentsCA.GetAll())
+}
+
+// createAgentPairing creates a one-time code used to pair an agent
+func (s *APIService) createAgentPairing(c *gin.Context) {
+	if s.agentsCA == nil {
+		common.APIError(c, "Agents mutual TLS not configured")
+		return
+	}
+	code, err := s.agentsCA.PairingCreate(s.roleUser(s.sessions.Get(c)))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, code)
+}
+
+// pairAgent issues a client certificate to an agent (pairing code is the
+// credential of this request)
+func (s *APIService) pairAgent(c *gin.Context) {
+	if s.agentsCA == nil {
+		common.APIError(c, "Agents mutual TLS not configured")
+		return
+	}
+	var args xsapiv1.AgentPairArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	res, err := s.agentsCA.Pair(args)
+	target := ""
+	if res != nil {
+		target = res.Agent.Serial
+	}
+	s.auditRecord(c, xsapiv1.AuditActionAgentPair, target, "Pair agent "+args.Name, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// revokeAgent revokes the certificate of an agent
+func (s *APIService) revokeAgent(c *gin.Context) {
+	if s.agentsCA == nil {
+		common.APIError(c, "Agents mutual TLS not configured")
+		return
+	}
+	ag, err := s.agentsCA.Revoke(c.Param("id"))
+	s.auditRecord(c, xsapiv1.AuditActionAgentRevoke, c.Param("id"), "Revoke agent certificate", err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ag)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getPendingOps returns operations of client waiting for confirmation or
+// approval (and the ones client can approve)
+func (s *APIService) getPendingOps(c *gin.Context) {
+	sid := ""
+	if sess := s.sessions.Get(c); sess != nil {
+		sid = sess.ID
+	}
+	c.JSON(http.StatusOK, s.approvals.GetAll(sid, s.hasRole(c, xsapiv1.RoleAdmin)))
+}
+
+// confirmPendingOp confirms (delay mode) a pending operation
+func (s *APIService) confirmPendingOp(c *gin.Context) {
+	var args xsapiv1.PendingOpConfirmArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	res, err := s.approvals.Confirm(c.Param("id"), args.Token, sess.ID)
+	s.auditPendingOp(c, "Confirm", res, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// approvePendingOp approves (approval mode) a pending operation
+func (s *APIService) approvePendingOp(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	res, err := s.approvals.Approve(c.Param("id"), sess.ID)
+	s.auditPendingOp(c, "Approve", res, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// cancelPendingOp cancels a pending operation
+func (s *APIService) cancelPendingOp(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	op, err := s.approvals.Cancel(c.Param("id"), sess.ID)
+	desc := "Cancel pending operation"
+	if op != nil {
+		desc += ": " + op.Description
+	}
+	s.auditRecord(c, xsapiv1.AuditActionPendingOp, c.Param("id"), desc, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, op)
+}
+
+// auditPendingOp adds to audit trail the confirmation or approval of a
+// pending operation (failed when operation itself failed)
+func (s *APIService) auditPendingOp(c *gin.Context, verb string, res *xsapiv1.PendingOpResult, err error) {
+	desc := verb + " pending operation"
+	if res != nil {
+		desc += ": " + res.Operation.Description
+		if err == nil && res.Operation.Error != "" {
+			err = errors.New(res.Operation.Error)
+		}
+	}
+	s.auditRecord(c, xsapiv1.AuditActionPendingOp, c.Param("id"), desc, err)
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const auditDefaultLimit = 100
+const auditMaxLimit = 1000
+
+// getAudit returns audit entries (most recent first) filtered using action,
+// target, sessionID, user, from and to (RFC3339 dates), paginated using offset and
+// limit
+func (s *APIService) getAudit(c *gin.Context) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		common.APIError(c, "Invalid offset")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(auditDefaultLimit)))
+	if err != nil || limit <= 0 || limit > auditMaxLimit {
+		common.APIError(c, fmt.Sprintf("Invalid limit (must be between 1 and %d)", auditMaxLimit))
+		return
+	}
+
+	filter := AuditFilter{
+		Action:    c.Query("action"),
+		Target:    c.Query("target"),
+		SessionID: c.Query("sessionID"),
+		User:      c.Query("user"),
+	}
+	for _, d := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := c.Query(d.name); v != "" {
+			if *d.t, err = time.Parse(time.RFC3339, v); err != nil {
+				common.APIError(c, "Invalid "+d.name+" date (RFC3339 expected)")
+				return
+			}
+		}
+	}
+
+	res, err := s.audit.Query(filter, offset, limit)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// auditRecord adds to audit trail an operation requested by client (failed
+// when err is set)
+func (s *APIService) auditRecord(c *gin.Context, action, target, details string, err error) {
+	res := xsapiv1.AuditResultSuccess
+	if err != nil {
+		res = xsapiv1.AuditResultFailure
+	}
+	s.auditAdd(c, action, target, details, res, err)
+}
+
+// auditPending adds to audit trail an operation waiting for approval
+func (s *APIService) auditPending(c *gin.Context, action, target string, pOp *xsapiv1.PendingOperation) {
+	s.auditAdd(c, action, target, pOp.Description+" (pending operation "+pOp.ID+")", xsapiv1.AuditResultPending, nil)
+}
+
+func (s *APIService) auditAdd(c *gin.Context, action, target, details, result string, err error) {
+	entry := xsapiv1.AuditEntry{
+		Action:   action,
+		Target:   target,
+		Details:  details,
+		ClientIP: c.ClientIP(),
+		Result:   result,
+	}
+	if sess := s.sessions.Get(c); sess != nil {
+		entry.SessionID = sess.ID
+		entry.User = sess.User
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit.Add(entry)
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// authMiddleware rejects requests of not authenticated clients when
+// authentication is required (login, version and agents pairing requests are
+// always accepted, builder nodes requests must carry a valid node token)
+func (s *APIService) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authRequired() {
+			c.Next()
+			return
+		}
+		path := strings.TrimPrefix(c.Request.URL.Path, s.apiRouter.BasePath())
+		if nodeRoute(c, path) {
+			s.nodeAuth(c)
+			return
+		}
+		if strings.HasPrefix(path, "/auth/") || path == "/version" || path == "/agents/pair" {
+			c.Next()
+			return
+		}
+		if sess := s.sessions.Get(c); sess == nil || !sess.IsAuthenticated() {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "Authentication required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// getAuthUser returns identity of the authenticated user of session
+func (s *APIService) getAuthUser(c *gin.Context) {
+	res := xsapiv1.AuthUser{Enabled: s.authEnabled(), Methods: []string{}, Required: s.authRequired()}
+	if s.oidc != nil {
+		res.Methods = append(res.Methods, xsapiv1.AuthMethodOIDC)
+	}
+	if s.ldap != nil {
+		res.Methods = append(res.Methods, xsapiv1.AuthMethodLDAP)
+	}
+	sess := s.sessions.Get(c)
+	res.Role = s.roles.Get(s.roleUser(sess))
+	if sess != nil {
+		res.User = sess.User
+		if sess.IsAuthenticated() {
+			res.Authenticated = true
+			res.Subject = sess.identity.subject
+			res.Email = sess.identity.email
+			res.Name = sess.identity.name
+			if !sess.identity.expireAt.IsZero() {
+				res.ExpireAt = sess.identity.expireAt.Format(time.RFC3339)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// authLogin redirects client to identity provider
+// (use ?redirect=/path to select web app page displayed once logged in)
+func (s *APIService) authLogin(c *gin.Context) {
+	if s.oidc == nil {
+		common.APIError(c, "OpenID Connect authentication not configured")
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	loginURL, err := s.oidc.LoginURL(sess.ID, authRedirectPath(c.Query("redirect")))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.Redirect(http.StatusFound, loginURL)
+}
+
+// authCallback completes a login (client redirected by identity provider)
+func (s *APIService) authCallback(c *gin.Context) {
+	if s.oidc == nil {
+		common.APIError(c, "OpenID Connect authentication not configured")
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		common.APIError(c, "Login failed: "+e+" "+c.Query("error_description"))
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	sid, redirect, ident, err := s.oidc.Callback(c.Query("state"), c.Query("code"))
+	if err == nil && sid != sess.ID {
+		// Also protect against login of client in the session of another one
+		err = fmt.Errorf("session changed during login, retry")
+	}
+	if err != nil {
+		s.auditRecord(c, xsapiv1.AuditActionLogin, "", "OpenID Connect login", err)
+		common.APIError(c, err.Error())
+		return
+	}
+	s.sessions.SetIdentity(sess.ID, ident)
+	s.auditRecord(c, xsapiv1.AuditActionLogin, ident.subject, "OpenID Connect login of "+ident.user, nil)
+	s.Log.Infof("User %s (%s) logged in (session %s)", ident.user, ident.subject, sess.ID)
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// authLDAPLogin checks user password using LDAP and sets identity of session
+func (s *APIService) authLDAPLogin(c *gin.Context) {
+	if s.ldap == nil {
+		common.APIError(c, "LDAP authentication not configured")
+		return
+	}
+	var args xsapiv1.AuthLoginArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	ident, err := s.ldap.Authenticate(args.User, args.Password)
+	if err != nil {
+		s.auditRecord(c, xsapiv1.AuditActionLogin, "", "LDAP login of "+args.User, err)
+		common.APIError(c, err.Error())
+		return
+	}
+	s.roles.SetDirectoryRole(ident.user, ident.role)
+	s.sessions.SetIdentity(sess.ID, ident)
+	s.auditRecord(c, xsapiv1.AuditActionLogin, ident.subject, "LDAP login of "+ident.user, nil)
+	s.Log.Infof("User %s (%s) logged in (session %s)", ident.user, ident.subject, sess.ID)
+	s.getAuthUser(c)
+}
+
+// authLogout removes identity of session
+func (s *APIService) authLogout(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	s.sessions.SetIdentity(sess.ID, nil)
+	s.getAuthUser(c)
+}
+
+// authEnabled returns true when clients may authenticate (OpenID Connect
+// or LDAP)
+func (ctx *Context) authEnabled() bool {
+	return ctx.oidc != nil || ctx.ldap != nil
+}
+
+// authRequired returns true when API requests must be authenticated
+func (ctx *Context) authRequired() bool {
+	return (ctx.oidc != nil && ctx.oidc.Required()) || (ctx.ldap != nil && ctx.ldap.Required())
+}
+
+// authRedirectPath only accepts paths of web app (no redirection to other sites)
+func authRedirectPath(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.Contains(redirect, "\\") {
+		return "/"
+	}
+	return redirect
+}
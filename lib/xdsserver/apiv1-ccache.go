@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getCcaches returns statistics of all compiler caches
+func (s *APIService) getCcaches(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	// Folder caches are only returned when folder is accessible
+	res := []xsapiv1.CcacheInfo{}
+	for _, info := range s.ccache.List() {
+		if info.Scope == xsapiv1.CcacheScopeFolder && !s.mfolders.HasAccess(info.ID, sess.ID, xsapiv1.FolderAccessRead) {
+			continue
+		}
+		res = append(res, info)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getCcache returns statistics (size, hit rate) of a compiler cache
+func (s *APIService) getCcache(c *gin.Context) {
+	scope, id, ok := s.ccacheTarget(c, xsapiv1.FolderAccessRead)
+	if !ok {
+		return
+	}
+	info, err := s.ccache.Get(scope, id)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// setCcache sets size limit of a compiler cache
+func (s *APIService) setCcache(c *gin.Context) {
+	var args xsapiv1.CcacheSetArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	scope, id, ok := s.ccacheTarget(c, xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	info, err := s.ccache.SetMaxSize(scope, id, args.MaxSize)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// clearCcache removes all files of a compiler cache
+func (s *APIService) clearCcache(c *gin.Context) {
+	scope, id, ok := s.ccacheTarget(c, xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	info, err := s.ccache.Clear(scope, id)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// ccacheTarget resolves scope and id of a cache and checks folder access
+// (an error is returned to client when not ok)
+func (s *APIService) ccacheTarget(c *gin.Context, access string) (string, string, bool) {
+	scope, id := c.Param("scope"), c.Param("id")
+	var err error
+	switch scope {
+	case xsapiv1.CcacheScopeFolder:
+		sess := s.sessions.Get(c)
+		if sess == nil {
+			common.APIError(c, "Unknown sessions")
+			return "", "", false
+		}
+		if id, err = s.mfolders.ResolveID(id); err != nil {
+			common.APIError(c, err.Error())
+			return "", "", false
+		}
+		if !s.mfolders.HasAccess(id, sess.ID, access) {
+			common.APIError(c, "Permission denied on folder")
+			return "", "", false
+		}
+	case xsapiv1.CcacheScopeSdk:
+		if access != xsapiv1.FolderAccessRead && !s.hasRole(c, xsapiv1.RoleAdmin) {
+			common.APIError(c, "Permission denied (admin role required)")
+			return "", "", false
+		}
+		if id, err = s.sdks.ResolveID(id); err != nil {
+			common.APIError(c, err.Error())
+			return "", "", false
+		}
+	default:
+		common.APIError(c, "Invalid scope")
+		return "", "", false
+	}
+	return scope, id, true
+}
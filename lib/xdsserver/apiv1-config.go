@@ -55,3 +55,64 @@ func (s *APIService) setConfig(c *gin.Context) {
 
 	common.APIError(c, "Not Supported")
 }
+
+// getSyncConfig returns synchronization rate limits
+func (s *APIService) getSyncConfig(c *gin.Context) {
+	if s.bandwidth == nil {
+		common.APIError(c, "CloudSync not supported")
+		return
+	}
+	c.JSON(http.StatusOK, s.bandwidth.Get())
+}
+
+// setSyncConfig sets synchronization rate limits
+func (s *APIService) setSyncConfig(c *gin.Context) {
+	if s.bandwidth == nil {
+		common.APIError(c, "CloudSync not supported")
+		return
+	}
+
+	var cfgArg xsapiv1.SyncBandwidthConfig
+	if c.BindJSON(&cfgArg) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	s.Log.Debugln("SET sync config: ", cfgArg)
+
+	res, err := s.bandwidth.Set(cfgArg)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getSyncAPIKey returns information about the key used to access Syncthing
+func (s *APIService) getSyncAPIKey(c *gin.Context) {
+	if s.SThg == nil {
+		common.APIError(c, "CloudSync not supported")
+		return
+	}
+	c.JSON(http.StatusOK, s.SThg.APIKeyStatus())
+}
+
+// rotateSyncAPIKey replaces the key used to access Syncthing
+func (s *APIService) rotateSyncAPIKey(c *gin.Context) {
+	if s.SThg == nil {
+		common.APIError(c, "CloudSync not supported")
+		return
+	}
+
+	res, err := s.SThg.RotateAPIKey()
+	// syncthing-inotify has been restarted
+	if s.SThg.STICmd != nil {
+		s.SThgInotCmd = s.SThg.STICmd
+	}
+	s.auditRecord(c, xsapiv1.AuditActionSyncKeyRotate, "syncthing", "Rotate Syncthing API key", err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getDebugSessions returns debug sessions of the requester session
+func (s *APIService) getDebugSessions(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	c.JSON(http.StatusOK, s.debugs.GetAll(sess.ID))
+}
+
+// getDebugSession returns a debug session (status and breakpoints)
+func (s *APIService) getDebugSession(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	ds, err := s.debugs.Get(c.Param("id"), sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ds)
+}
+
+// getDebugOutput returns lines received from gdb after 'since' sequence number
+func (s *APIService) getDebugOutput(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	since := uint64(0)
+	if v := c.Query("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			common.APIError(c, "Invalid since parameter")
+			return
+		}
+	}
+	lines, err := s.debugs.Output(c.Param("id"), sess.ID, since)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, lines)
+}
+
+// startDebugSession starts gdb in the environment of a folder
+func (s *APIService) startDebugSession(c *gin.Context) {
+	var args xsapiv1.DebugStartArgs
+	if c.BindJSON(&args) != nil || args.Program == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	id, err := s.mfolders.ResolveID(args.FolderID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	if !s.mfolders.HasAccess(id, sess.ID, xsapiv1.FolderAccessReadWrite) {
+		common.APIError(c, "Permission denied on folder")
+		return
+	}
+	fld := s.mfolders.Get(id)
+	if fld == nil {
+		common.APIError(c, "Unknown id")
+		return
+	}
+	fc := (*fld).GetConfig()
+
+	if args.Target != "" {
+		if _, _, err := net.SplitHostPort(args.Target); err != nil {
+			common.APIError(c, "Invalid target (must be host:port)")
+			return
+		}
+	}
+
+	// Program path is relative to working directory or a client absolute path
+	workDir, err := s.mfolders.WorkDir(id, args.RPath)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	program := (*fld).ConvPathCli2Svr(args.Program)
+	if !filepath.IsAbs(program) {
+		program = filepath.Join(workDir, program)
+	}
+	root := (*fld).GetFullPath("")
+	if err := fsCheckInside(root, program); err != nil {
+		if fc.OutputPath == "" || fsCheckInside(fc.OutputPath, program) != nil {
+			common.APIError(c, "Program must be inside folder")
+			return
+		}
+	}
+	if _, err := os.Stat(program); err != nil {
+		common.APIError(c, "Unknown program "+args.Program)
+		return
+	}
+
+	// gdb of SDK is used when defined (GDB variable), sysroot is only set for
+	// remote debugging of target binaries
+	gdb := []string{"exec", "${GDB:-gdb}", "--interpreter=mi2", "--nx", "-q"}
+	if args.Target != "" {
+		gdb = append(gdb, `${SDKTARGETSYSROOT:+-ex "set sysroot $SDKTARGETSYSROOT"}`,
+			"-ex", shellQuote("target remote "+args.Target), shellQuote(program))
+	} else {
+		gdb = append(gdb, "--args", shellQuote(program))
+		for _, a := range args.Args {
+			gdb = append(gdb, shellQuote(a))
+		}
+	}
+	cmdLine, err := s.autoBuild.folderCommand(fc, root, args.SdkID, args.RPath, strings.Join(gdb, " "))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	env := []string{"CLIENT_PROJECT_DIR=" + fc.ClientPath}
+	env = append(env, s.mfolders.DependenciesEnv(id)...)
+
+	ds, err := s.debugs.Start(xsapiv1.DebugSession{
+		FolderID:  id,
+		SdkID:     args.SdkID,
+		Program:   args.Program,
+		Target:    args.Target,
+		SessionID: sess.ID,
+	}, cmdLine, env)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ds)
+}
+
+// debugMICmd sends a GDB/MI command to a debug session
+func (s *APIService) debugMICmd(c *gin.Context) {
+	var args xsapiv1.DebugMIInMsg
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	if err := s.debugs.Write(c.Param("id"), sess.ID, args.Line); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
+
+// delDebugSession kills gdb and forgets debug session
+func (s *APIService) delDebugSession(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	if err := s.debugs.Kill(c.Param("id"), sess.ID); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
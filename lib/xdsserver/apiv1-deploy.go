@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getDeployTargets returns registered deployment targets
+func (s *APIService) getDeployTargets(c *gin.Context) {
+	c.JSON(http.StatusOK, s.deploys.GetTargets())
+}
+
+// setDeployTarget registers or replaces a deployment target
+func (s *APIService) setDeployTarget(c *gin.Context) {
+	var t xsapiv1.DeployTarget
+	if c.BindJSON(&t) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	t.Name = c.Param("name")
+
+	res, err := s.deploys.SetTarget(t)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// delDeployTarget removes a deployment target
+func (s *APIService) delDeployTarget(c *gin.Context) {
+	if err := s.deploys.DeleteTarget(c.Param("name")); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
+
+// getDeploys returns running and last finished deployments
+func (s *APIService) getDeploys(c *gin.Context) {
+	c.JSON(http.StatusOK, s.deploys.GetAll())
+}
+
+// getDeploy returns a deployment
+func (s *APIService) getDeploy(c *gin.Context) {
+	dep, err := s.deploys.Get(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, dep)
+}
+
+// startDeploy copies files of a folder on a target and executes install commands
+func (s *APIService) startDeploy(c *gin.Context) {
+	var args xsapiv1.DeployArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	id, err := s.mfolders.ResolveID(args.FolderID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	args.FolderID = id
+
+	dep, err := s.deploys.Start(args, sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, dep)
+}
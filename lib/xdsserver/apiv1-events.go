@@ -18,28 +18,155 @@
 package xdsserver
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	common "github.com/iotbzh/xds-common/golib"
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
+const eventStreamPingTime = 15 // Time (in seconds) between keep-alive comments of event streams
+
 // eventsList Registering for events that will be send over a WS
 func (s *APIService) eventsList(c *gin.Context) {
 	c.JSON(http.StatusOK, s.events.GetList())
 }
 
+// eventsHistory returns events emitted after 'since' (sequence number of last
+// received event or RFC3339 date) of types listed in 'type' (comma separated,
+// all types when not set), 'cmdID' restricts result to events of a command
+func (s *APIService) eventsHistory(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	filter := EventHistoryFilter{Types: eventsQueryTypes(c), CmdID: c.Query("cmdID")}
+	if v := c.Query("since"); v != "" {
+		var err error
+		if filter.Since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			if filter.SinceTime, err = time.Parse(time.RFC3339, v); err != nil {
+				common.APIError(c, "Invalid since parameter (sequence number or RFC3339 date expected)")
+				return
+			}
+		}
+	}
+
+	res, err := s.events.History(sess.ID, filter)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// eventsStream sends events using Server-Sent Events, events following
+// Last-Event-ID header (or 'since' sequence number) are replayed from history.
+// Events are selected using 'type', 'filter', 'folderID', 'sdkID' and 'cmdID'
+// query parameters (comma separated lists)
+func (s *APIService) eventsStream(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	filter, err := eventFilterNew(c.Query("filter"), eventsQueryList(c.Query("folderID")),
+		eventsQueryList(c.Query("sdkID")), eventsQueryList(c.Query("cmdID")))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	lastID := c.Request.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("since")
+	}
+	var since uint64
+	if lastID != "" {
+		if since, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			common.APIError(c, "Invalid last event ID (sequence number expected)")
+			return
+		}
+	}
+
+	// Subscribe before reading history to not miss any event
+	sub, err := s.events.Subscribe(sess.ID, eventsQueryTypes(c), filter)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	defer s.events.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // disable buffering of proxies (eg. nginx)
+	c.Status(http.StatusOK)
+
+	var lastSeq uint64
+	if lastID != "" {
+		hist, err := s.events.Replay(sub, since)
+		if err != nil {
+			return
+		}
+		if hist.Truncated {
+			data, _ := json.Marshal(xsapiv1.EventHistory{LastSeq: hist.LastSeq, Truncated: true, Events: []xsapiv1.EventMsg{}})
+			fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", xsapiv1.EventStreamTruncated, data)
+		}
+		for _, msg := range hist.Events {
+			if err := eventStreamWrite(c.Writer, msg); err != nil {
+				return
+			}
+			lastSeq = msg.Seq
+		}
+	}
+	c.Writer.Flush()
+
+	closed := c.Writer.CloseNotify()
+	ping := time.NewTicker(eventStreamPingTime * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-sub.Lost:
+			// Client reconnects and gets dropped events from history
+			return
+		case <-ping.C:
+			fmt.Fprint(c.Writer, ": ping\n\n")
+		case msg := <-sub.C:
+			if msg.Seq <= lastSeq {
+				// Already sent from history
+				continue
+			}
+			if err := eventStreamWrite(c.Writer, msg); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
 // eventsRegister Registering for events that will be send over a WS
 func (s *APIService) eventsRegister(c *gin.Context) {
 	var args xsapiv1.EventRegisterArgs
 
-	if c.BindJSON(&args) != nil || args.Name == "" {
+	if c.BindJSON(&args) != nil || (args.Name == "" && len(args.Types) == 0) {
 		common.APIError(c, "Invalid arguments")
 		return
 	}
 
-	// TODO: add args.Filter support
+	filter, err := eventFilterNew(args.Filter, args.FolderIDs, args.SdkIDs, args.CmdIDs)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
 
 	sess := s.sessions.Get(c)
 	if sess == nil {
@@ -47,20 +174,29 @@ func (s *APIService) eventsRegister(c *gin.Context) {
 		return
 	}
 
-	// Register to all or to a specific events
-	if err := s.events.Register(args.Name, sess.ID); err != nil {
+	// Payload version of events sent to client
+	version, err := s.events.Negotiate(sess.ID, args.Versions)
+	if err != nil {
 		common.APIError(c, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+	// Register to all or to a specific events
+	for _, name := range eventsNames(args.Name, args.Types) {
+		if err := s.events.Register(name, sess.ID, filter); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, xsapiv1.EventRegisterResult{Status: "OK", Version: version})
 }
 
 // eventsRegister Registering for events that will be send over a WS
 func (s *APIService) eventsUnRegister(c *gin.Context) {
 	var args xsapiv1.EventUnRegisterArgs
 
-	if c.BindJSON(&args) != nil || args.Name == "" {
+	if c.BindJSON(&args) != nil || (args.Name == "" && len(args.Types) == 0) {
 		common.APIError(c, "Invalid arguments")
 		return
 	}
@@ -72,10 +208,91 @@ func (s *APIService) eventsUnRegister(c *gin.Context) {
 	}
 
 	// Register to all or to a specific events
-	if err := s.events.UnRegister(args.Name, sess.ID); err != nil {
-		common.APIError(c, err.Error())
-		return
+	for _, name := range eventsNames(args.Name, args.Types) {
+		if err := s.events.UnRegister(name, sess.ID); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "OK"})
 }
+
+// eventsNames returns the list of events to (un)register (name and/or types)
+func eventsNames(name string, types []string) []string {
+	names := []string{}
+	if name != "" {
+		names = append(names, name)
+	}
+	for _, t := range types {
+		if t = strings.TrimSpace(t); t != "" {
+			names = append(names, t)
+		}
+	}
+	return names
+}
+
+// eventStreamWrite writes an event using Server-Sent Events format
+func eventStreamWrite(w io.Writer, msg xsapiv1.EventMsg) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.Seq, msg.Type, data)
+	return err
+}
+
+// eventsQueryTypes returns event types listed in 'type' query parameter
+// (comma separated, empty for all types)
+func eventsQueryTypes(c *gin.Context) []string {
+	types := []string{}
+	for _, t := range eventsQueryList(c.Query("type")) {
+		if t != xsapiv1.EVTAll {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// eventsQueryList splits a comma separated query parameter
+func eventsQueryList(value string) []string {
+	res := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// eventFilterNew returns filter of events (nil when no filter is set)
+func eventFilterNew(flt string, folderIDs, sdkIDs, cmdIDs []string) (*EventFilter, error) {
+	var filter *EventFilter
+	switch flt {
+	case xsapiv1.EventFilterNone:
+	case xsapiv1.EventFilterOwnFolders:
+		filter = &EventFilter{OwnFolders: true}
+	default:
+		return nil, fmt.Errorf("Invalid filter")
+	}
+	idsMap := func(ids []string) map[string]bool {
+		if filter == nil {
+			filter = &EventFilter{}
+		}
+		res := make(map[string]bool)
+		for _, id := range ids {
+			res[id] = true
+		}
+		return res
+	}
+	if len(folderIDs) > 0 {
+		filter.FolderIDs = idsMap(folderIDs)
+	}
+	if len(sdkIDs) > 0 {
+		filter.SdkIDs = idsMap(sdkIDs)
+	}
+	if len(cmdIDs) > 0 {
+		filter.CmdIDs = idsMap(cmdIDs)
+	}
+	return filter, nil
+}
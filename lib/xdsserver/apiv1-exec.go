@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -35,16 +36,29 @@ import (
 
 var execCommandID = 1
 
+const execHistoryDefaultLimit = 50 // Default number of history entries returned
+const execHistoryMaxLimit = 500
+
 // ExecCmd executes remotely a command
 func (s *APIService) execCmd(c *gin.Context) {
-	var gdbPty, gdbTty *os.File
-	var err error
 	var args xsapiv1.ExecArgs
 	if c.BindJSON(&args) != nil {
 		common.APIError(c, "Invalid arguments")
 		return
 	}
 
+	// Allow to pass id in url (/exec/:id) or as JSON argument
+	if idArg := c.Param("id"); idArg != "" {
+		args.ID = idArg
+	}
+	s.execRun(c, args)
+}
+
+// execRun executes a command (used by exec and exec preset commands)
+func (s *APIService) execRun(c *gin.Context, args xsapiv1.ExecArgs) {
+	var gdbPty, gdbTty *os.File
+	var err error
+
 	// TODO: add permission ?
 
 	// Retrieve session info
@@ -59,16 +73,11 @@ func (s *APIService) execCmd(c *gin.Context) {
 		return
 	}
 
-	// Allow to pass id in url (/exec/:id) or as JSON argument
-	idArg := c.Param("id")
-	if idArg == "" {
-		idArg = args.ID
-	}
-	if idArg == "" {
+	if args.ID == "" {
 		common.APIError(c, "Invalid id")
 		return
 	}
-	id, err := s.mfolders.ResolveID(idArg)
+	id, err := s.mfolders.ResolveID(args.ID)
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -81,27 +90,123 @@ func (s *APIService) execCmd(c *gin.Context) {
 	fld := *f
 	prj := fld.GetConfig()
 
+	if !s.mfolders.HasAccess(id, sess.ID, xsapiv1.FolderAccessReadWrite) {
+		common.APIError(c, "Permission denied on folder")
+		return
+	}
+
+	// Command output would be written in folder
+	if s.folderWatch.IsQuotaExceeded(id) {
+		common.APIError(c, "Folder disk quota exceeded")
+		return
+	}
+	if s.folderCrypt.IsLocked(prj) {
+		common.APIError(c, "Folder is locked")
+		return
+	}
+	if args.PTY && args.Stdin {
+		common.APIError(c, "stdin and pty options cannot be used together")
+		return
+	}
+	switch args.OutputMode {
+	case "", xsapiv1.ExecOutputModeRaw, xsapiv1.ExecOutputModeTerminal:
+	default:
+		common.APIError(c, "Invalid output mode")
+		return
+	}
+	cmdDesc := args.Cmd
+	if len(args.Steps) > 0 {
+		if args.Cmd != "" || len(args.Args) > 0 || args.TTY || args.Container {
+			common.APIError(c, "steps cannot be used with cmd, args, tty or container options")
+			return
+		}
+		if args.Shell != "" || args.ShellOptions != nil {
+			common.APIError(c, "steps cannot be used with shell options")
+			return
+		}
+		if err := s.execSteps.Check(args.Steps); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		stepCmds := []string{}
+		for _, st := range args.Steps {
+			stepCmds = append(stepCmds, st.Cmd)
+		}
+		cmdDesc = strings.Join(stepCmds, " ; ")
+	} else if args.Cmd == "" {
+		common.APIError(c, "Invalid cmd")
+		return
+	}
+	shell, err := s.execShellGet(args.Shell, args.ShellOptions, !args.Container)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
 	// Build command line
 	cmd := []string{}
-	// Setup env var regarding Sdk ID (used for example to setup cross toolchain)
-	if envCmd := s.sdks.GetEnvCmd(args.SdkID, prj.DefaultSdk); len(envCmd) > 0 {
+	// Setup env var regarding Sdk ID (used for example to setup cross toolchain),
+	// SDK bound to project is used when sdkID is not set (unless noSdkEnv is set)
+	defaultSdk := prj.DefaultSdk
+	if args.NoSdkEnv {
+		defaultSdk = ""
+	}
+	envCmd, err := s.sdks.GetEnvCmd(args.SdkID, defaultSdk)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	if len(envCmd) > 0 {
 		cmd = append(cmd, envCmd...)
 		cmd = append(cmd, "&&")
-	} else {
-		// It's an error if no envcmd found while a sdkid has been provided
-		if args.SdkID != "" {
-			common.APIError(c, "Unknown sdkid")
-			return
-		}
 	}
 
-	cmd = append(cmd, "cd", "\""+fld.GetFullPath(args.RPath)+"\"")
+	// SDK used by command (if any)
+	var sdk *xsapiv1.SDK
+	sdkID := args.SdkID
+	if sdkID == "" {
+		sdkID = defaultSdk
+	}
+	if iid, err := s.sdks.ResolveID(sdkID); err == nil {
+		sdk = s.sdks.Get(iid)
+	}
+
+	// Builder node that executes command (nil: local execution)
+	nodeSdkID := ""
+	if sdk != nil {
+		nodeSdkID = sdk.ID
+	}
+	dispatchable := !args.PTY && !args.TTY && !args.Stdin && !args.Container &&
+		len(args.Steps) == 0 && len(args.Artifacts) == 0
+	node, err := s.nodes.Select(args.Node, id, nodeSdkID, dispatchable)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	// Working directory is checked here to return a clear error (instead of a
+	// failure of cd command)
+	workDir, err := s.mfolders.WorkDir(id, args.RPath)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	cmd = append(cmd, "cd", "\""+workDir+"\"")
+
+	if err := s.artifacts.CheckPatterns(args.Artifacts); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
 	// FIXME - add 'exec' prevents to use syntax:
 	//       xds-exec -l debug -c xds-config.env -- "cd build && cmake .."
 	//  but exec is mandatory to allow to pass correctly signals
 	//  As workaround, exec is set for now on client side (eg. in xds-gdb)
 	//cmd = append(cmd, "&&", "exec", args.Cmd)
-	cmd = append(cmd, "&&", args.Cmd)
+	if len(args.Steps) > 0 {
+		cmd = append(cmd, "&&", s.execSteps.Script(args.Steps))
+	} else {
+		cmd = append(cmd, "&&", args.Cmd)
+	}
 
 	// Process command arguments
 	cmdArgs := make([]string, len(args.Args)+1)
@@ -127,33 +232,373 @@ func (s *APIService) execCmd(c *gin.Context) {
 		cmdArgs = append(cmdArgs, "--tty="+gdbTty.Name())
 	}
 
+	// Command (and its arguments) interpreted by selected shell
+	if len(args.Steps) == 0 && !shell.isDefault() {
+		cmd[len(cmd)-1] = shell.command(args.Cmd, cmdArgs)
+		cmdArgs = []string{}
+	}
+
 	// Unique ID for each commands
 	if args.CmdID == "" {
 		args.CmdID = s.Config.ServerUID[:18] + "_" + strconv.Itoa(execCommandID)
 		execCommandID++
 	}
+	// ID set by client must not be used by another command (checked before
+	// any resource of command is allocated)
+	if _, queued := s.scheduler.Job(args.CmdID); queued || s.execOutputs.Known(args.CmdID) || !s.execHistory.Reserve(args.CmdID) {
+		common.APIError(c, "command ID "+args.CmdID+" already used")
+		return
+	}
+	defer s.execHistory.Release(args.CmdID)
 
-	// Create new execution over WS context
-	execWS := eows.New(strings.Join(cmd, " "), cmdArgs, sop, sess.ID, args.CmdID)
-	execWS.Log = s.Log
+	// Append client project dir to environment (client variables are
+	// filtered by server and request whitelists)
+	env := append(s.execClientEnv(args.Env, args.EnvPassThrough), "CLIENT_PROJECT_DIR="+prj.ClientPath)
+
+	// Terminal output mode: tools emit colors even if output is not a tty
+	if args.OutputMode == xsapiv1.ExecOutputModeTerminal {
+		env = append(env, execOutTerminalEnv...)
+	}
+
+	// Builder nodes set their own server variables
+	nodeEnv := env[:len(env):len(env)]
+
+	// Append staging directories of folder dependencies
+	env = append(env, s.mfolders.DependenciesEnv(id)...)
 
-	// Append client project dir to environment
-	execWS.Env = append(args.Env, "CLIENT_PROJECT_DIR="+prj.ClientPath)
+	// Compiler cache of folder (or of SDK)
+	ccacheEnv := s.ccache.Env(id, sdkID)
+	env = append(env, ccacheEnv...)
+
+	// Server mandatory variables (eg. LANG, proxy settings)
+	env = append(env, s.execServerEnv()...)
+
+	// Used to find all processes of command when it is cancelled
+	env = append(env, s.cancels.EnvMarker(args.CmdID))
+
+	// Output limits and secrets masked in output and history
+	outOpts, err := s.execOutOptionsGet(env, args.OutputLimit, args.OutputPolicy)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	outOpts.coalesce = args.OutputMode == xsapiv1.ExecOutputModeTerminal
+	if args.Problems {
+		outOpts.problemsDir = fld.ConvPathSvr2Cli(workDir)
+	}
+	mask := outOpts.mask
+	cmdDesc = mask.apply(cmdDesc)
+
+	// CPU and I/O priorities (set by the shell that executes command)
+	prio, err := s.execPriorityGet(args.Nice, args.IONice)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	// Local user that executes command (see user and userMap of exec config)
+	eu, err := s.execUserGet(sess.User)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	if eu != nil {
+		ccacheDirs := []string{}
+		for _, e := range ccacheEnv {
+			ccacheDirs = append(ccacheDirs, strings.TrimPrefix(e, "CCACHE_DIR="))
+		}
+		if err := s.execUserSetup(eu, prj, fld.GetFullPath(""), ccacheDirs...); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		if gdbTty != nil {
+			if err := eu.chown(gdbTty.Name()); err != nil {
+				common.APIError(c, err.Error())
+				return
+			}
+		}
+	}
+
+	cmdLine := prio.shellPrefix() + strings.Join(cmd, " ")
+	if eu != nil && !args.Container {
+		cmdLine, err = eu.command(strings.TrimSpace(cmdLine + " " + strings.Join(cmdArgs, " ")))
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		cmdArgs = []string{}
+	}
+	if args.Container {
+		// Containerized command: folder (read-only except output directory for
+		// read-only folders) and SDK are bind mounted in image
+		run := containerRun{
+			cmdID:   args.CmdID,
+			mounts:  []containerMount{{dir: fld.GetFullPath(""), readOnly: prj.ReadOnly}},
+			env:     env,
+			tty:     args.PTY,
+			command: cmdLine + " " + strings.Join(cmdArgs, " "),
+		}
+		if eu != nil {
+			run.user = strconv.Itoa(eu.uid) + ":" + strconv.Itoa(eu.gid)
+		}
+		if prj.ReadOnly && prj.OutputPath != "" {
+			out := filepath.Join(fld.GetFullPath(""), filepath.FromSlash(prj.OutputPath))
+			if err := os.MkdirAll(out, 0755); err != nil {
+				common.APIError(c, fmt.Sprintf("Cannot create output directory: %v", err))
+				return
+			}
+			run.mounts = append(run.mounts, containerMount{dir: out})
+		}
+		if sdk != nil && sdk.Path != "" {
+			run.mounts = append(run.mounts, containerMount{dir: sdk.Path, readOnly: true})
+		}
+		for _, e := range ccacheEnv {
+			run.mounts = append(run.mounts, containerMount{dir: strings.TrimPrefix(e, "CCACHE_DIR=")})
+		}
+		if run.image, err = s.containers.Image(args.Image, sdk); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		if cmdLine, err = s.containers.command(run); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		cmdArgs = []string{}
+	} else if prj.ReadOnly {
+		// Read-only folder: command can only write in folder output directory
+		cmdLine, err = readOnlyCommand(fld.GetFullPath(""), prj.OutputPath, cmdLine+" "+strings.Join(cmdArgs, " "))
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		cmdArgs = []string{}
+	}
+
+	// Redirect command stdin to an input channel (see execInputCmd)
+	if args.Stdin {
+		prefix, err := s.execInputs.Open(args.CmdID, sess.ID, id)
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		cmdLine = prefix + cmdLine
+	}
+
+	// Step boundaries of a pipeline are reported on a pipe (see ExecSteps)
+	if len(args.Steps) > 0 {
+		stepsEnv, err := s.execSteps.Open(args.CmdID, sess.ID, args.Steps, eu)
+		if err != nil {
+			s.execInputs.Close(args.CmdID)
+			common.APIError(c, err.Error())
+			return
+		}
+		env = append(env, stepsEnv)
+	}
+
+	// Concurrent commands of different clients are not allowed in shared folders
+	if err := s.mfolders.ExecAcquire(id, sess.ID, args.CmdID); err != nil {
+		s.execInputs.Close(args.CmdID)
+		s.execSteps.Close(args.CmdID)
+		common.APIError(c, err.Error())
+		return
+	}
 
 	// Set command execution timeout
-	if args.CmdTimeout == 0 {
+	cmdTimeout := args.CmdTimeout
+	if cmdTimeout == 0 {
 		// 0 : default timeout
 		// TODO get default timeout from server-config.json file
-		execWS.CmdExecTimeout = 24 * 60 * 60 // 1 day
-	} else {
-		execWS.CmdExecTimeout = args.CmdTimeout
+		cmdTimeout = 24 * 60 * 60 // 1 day
+	}
+
+	// Close client tty
+	closeTty := func() {
+		if gdbPty != nil {
+			gdbPty.Close()
+		}
+		if gdbTty != nil {
+			gdbTty.Close()
+		}
+	}
+
+	// Collect files declared as artifacts (before exit event is sent)
+	collectArtifacts := func(cmdID string) {
+		if len(args.Artifacts) > 0 {
+			s.artifacts.Collect(cmdID, id, fld.GetFullPath(""), args.Artifacts)
+		}
+	}
+
+	// Commands are started by scheduler (queued when concurrency limits are reached)
+	job := xsapiv1.ExecJob{
+		CmdID:     args.CmdID,
+		SessionID: sess.ID,
+		FolderID:  id,
+		Cmd:       cmdDesc,
+		Priority:  args.Priority,
+	}
+
+	// Record command in history (completed when command exited)
+	hist := xsapiv1.ExecHistoryEntry{
+		CmdID:     args.CmdID,
+		FolderID:  id,
+		Cmd:       mask.apply(strings.TrimSpace(cmdDesc + " " + strings.Join(args.Args, " "))),
+		RPath:     args.RPath,
+		SdkID:     sdkID,
+		SessionID: sess.ID,
+		User:      s.sessionAuthUser(sess.ID),
+	}
+	if sdk != nil {
+		hist.SdkID = sdk.ID
+		hist.SdkName = sdk.Name
+	}
+	if node != nil {
+		hist.Node = node.Name
+	}
+	s.execHistory.Start(hist)
+	s.auditRecord(c, xsapiv1.AuditActionExec, id, "Command "+args.CmdID+": "+hist.Cmd, nil)
+	abort := func(err error) {
+		closeTty()
+		s.execHistory.End(args.CmdID, -1, nil)
+		s.mfolders.ExecRelease(id, args.CmdID)
+		s.execInputs.Close(args.CmdID)
+		s.execSteps.Close(args.CmdID)
+		s.emitExecExit(sess.ID, id, true, xsapiv1.ExecExitMsg{
+			CmdID:     args.CmdID,
+			Code:      -1,
+			Error:     err,
+			OutputSeq: s.execOutputs.Close(args.CmdID),
+		})
+	}
+
+	// Command dispatched on a builder node: output is forwarded to client
+	if node != nil {
+		nodeArgs := xsapiv1.NodeExecArgs{
+			CmdID:        args.CmdID,
+			FolderID:     id,
+			SdkID:        nodeSdkID,
+			NoSdkEnv:     args.NoSdkEnv,
+			RPath:        args.RPath,
+			Cmd:          args.Cmd,
+			Args:         args.Args,
+			Env:          nodeEnv,
+			TimeoutS:     cmdTimeout,
+			Nice:         args.Nice,
+			IONice:       args.IONice,
+			Shell:        shell.name,
+			ShellOptions: shell.options,
+		}
+		outBatch := s.outStreams.newBatcher(sess.ID, func(stdout, stderr string) {
+			s.execOutputs.Emit(args.CmdID, "", stdout, stderr, s.outStreams.execEmitFunc(sess.ID))
+		})
+		outCB := func(stdout, stderr string) {
+			s.execMetrics.AddOutput(args.CmdID, len(stdout)+len(stderr))
+			outBatch.Write(stdout, stderr)
+		}
+		exitCB := func(code int, err error) {
+			outBatch.Flush()
+			s.folderStats.RecordBuild(id)
+			s.mfolders.ExecRelease(id, args.CmdID)
+			s.scheduler.Done(args.CmdID)
+			metrics := s.execMetrics.End(args.CmdID)
+			s.execHistory.End(args.CmdID, code, metrics)
+			s.emitExecExit(sess.ID, id, args.ExitImmediate, xsapiv1.ExecExitMsg{
+				CmdID:     args.CmdID,
+				Code:      code,
+				Error:     err,
+				Metrics:   metrics,
+				OutputSeq: s.execOutputs.Close(args.CmdID),
+			})
+		}
+		start := func() error {
+			s.Log.Infof("Execute on node %s [Cmd ID %s]: %v %v", node.Name, args.CmdID, args.Cmd, args.Args)
+			s.execMetrics.Start(args.CmdID)
+			s.execOutputs.Open(args.CmdID, id, outOpts)
+			err := s.nodes.Exec(node.Name, nodeArgs, outCB, exitCB)
+			if err != nil {
+				s.execMetrics.End(args.CmdID)
+			}
+			return err
+		}
+
+		res, err := s.scheduler.Submit(job, start, abort)
+		if err != nil {
+			s.execHistory.End(args.CmdID, -1, nil)
+			s.mfolders.ExecRelease(id, args.CmdID)
+			common.APIError(c, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, xsapiv1.ExecResult{Status: "OK", CmdID: args.CmdID, Position: res.Position})
+		return
 	}
 
+	// Interactive command: run it in a pseudo-terminal (raw output, see execResizeCmd)
+	if args.PTY {
+		exitCB := func(cmdID string, code int, err error) {
+			closeTty()
+			s.folderStats.RecordBuild(id)
+			s.mfolders.ExecRelease(id, cmdID)
+			s.execSteps.Close(cmdID)
+			s.scheduler.Done(cmdID)
+			metrics := s.execMetrics.End(cmdID)
+			s.execHistory.End(cmdID, code, metrics)
+			collectArtifacts(cmdID)
+			s.emitExecExit(sess.ID, id, args.ExitImmediate, xsapiv1.ExecExitMsg{
+				CmdID:     cmdID,
+				Code:      code,
+				Error:     err,
+				Metrics:   metrics,
+				OutputSeq: s.execOutputs.Close(cmdID),
+			})
+		}
+
+		cmdLine = strings.TrimSpace(cmdLine + " " + strings.Join(cmdArgs, " "))
+		start := func() error {
+			s.Log.Infof("Execute in pty [Cmd ID %s]: %v", args.CmdID, cmdLine)
+			s.execMetrics.Start(args.CmdID)
+			s.execOutputs.Open(args.CmdID, id, outOpts)
+			err := s.execPtys.Start(args.CmdID, sess.ID, cmdLine, env, args.Rows, args.Cols, cmdTimeout, exitCB)
+			if err != nil {
+				s.execMetrics.End(args.CmdID)
+			}
+			return err
+		}
+
+		res, err := s.scheduler.Submit(job, start, abort)
+		if err != nil {
+			closeTty()
+			s.execHistory.End(args.CmdID, -1, nil)
+			s.mfolders.ExecRelease(id, args.CmdID)
+			s.execSteps.Close(args.CmdID)
+			common.APIError(c, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, xsapiv1.ExecResult{Status: "OK", CmdID: args.CmdID, Position: res.Position})
+		return
+	}
+
+	// Create new execution over WS context
+	execWS := eows.New(cmdLine, cmdArgs, sop, sess.ID, args.CmdID)
+	execWS.Log = s.Log
+	execWS.Env = env
+	execWS.CmdExecTimeout = cmdTimeout
+
 	// Define callback for input (stdin)
 	execWS.InputEvent = xsapiv1.ExecInEvent
 	execWS.InputCB = func(e *eows.ExecOverWS, stdin string) (string, error) {
 		s.Log.Debugf("STDIN <<%v>>", strings.Replace(stdin, "\n", "\\n", -1))
 
+		// Send data on input channel when command has been started with one
+		if s.execInputs.Exists(e.CmdID) {
+			eof := len(stdin) == 1 && stdin == "\x04"
+			if eof {
+				stdin = ""
+			}
+			if err := s.execInputs.Write(e.CmdID, e.Sid, stdin, eof); err != nil {
+				s.Log.Errorf("InputCB: %v", err)
+			}
+			return "", nil
+		}
+
 		// Handle Ctrl-D
 		if len(stdin) == 1 && stdin == "\x04" {
 			// Close stdin
@@ -175,14 +620,14 @@ func (s *APIService) execCmd(c *gin.Context) {
 		return stdin, nil
 	}
 
+	// Output is batched then sequenced (and kept for replay)
+	outBatch := s.outStreams.newBatcher(sess.ID, func(stdout, stderr string) {
+		s.execOutputs.Emit(args.CmdID, "", stdout, stderr, s.outStreams.execEmitFunc(sess.ID))
+	})
+
 	// Define callback for output (stdout+stderr)
 	execWS.OutputCB = func(e *eows.ExecOverWS, stdout, stderr string) {
-		// IO socket can be nil when disconnected
-		so := s.sessions.IOSocketGet(e.Sid)
-		if so == nil {
-			s.Log.Infof("%s not emitted: WS closed (sid:%s, msgid:%s)", xsapiv1.ExecOutEvent, e.Sid, e.CmdID)
-			return
-		}
+		s.execMetrics.AddOutput(e.CmdID, len(stdout)+len(stderr))
 
 		// Retrieve project ID and RootPath
 		data := e.UserData
@@ -207,19 +652,12 @@ func (s *APIService) execCmd(c *gin.Context) {
 		}
 
 		// FIXME replace by .BroadcastTo a room
-		err := (*so).Emit(xsapiv1.ExecOutEvent, xsapiv1.ExecOutMsg{
-			CmdID:     e.CmdID,
-			Timestamp: time.Now().String(),
-			Stdout:    stdout,
-			Stderr:    stderr,
-		})
-		if err != nil {
-			s.Log.Errorf("WS Emit : %v", err)
-		}
+		outBatch.Write(stdout, stderr)
 
 		// XXX - Workaround due to gdbserver bug that doesn't redirect
 		// inferior output (https://bugs.eclipse.org/bugs/show_bug.cgi?id=437532#c13)
-		if gdbServerTTY == "workaround" && len(stdout) > 1 && stdout[0] == '&' {
+		so := s.sessions.IOSocketGet(e.Sid)
+		if so != nil && gdbServerTTY == "workaround" && len(stdout) > 1 && stdout[0] == '&' {
 
 			// Extract and cleanup string like &"bla bla\n"
 			re := regexp.MustCompile("&\"(.*)\"")
@@ -231,6 +669,7 @@ func (s *APIService) execCmd(c *gin.Context) {
 						out = strings.Replace(o[1], "\\n", "\n", -1)
 						out = strings.Replace(out, "\\r", "\r", -1)
 						out = strings.Replace(out, "\\t", "\t", -1)
+						out = s.execOutputs.Mask(e.CmdID, out)
 
 						s.Log.Debugf("STDOUT INFERIOR: <<%v>>", out)
 						err := (*so).Emit(xsapiv1.ExecInferiorOutEvent, xsapiv1.ExecOutMsg{
@@ -253,60 +692,32 @@ func (s *APIService) execCmd(c *gin.Context) {
 	// Define callback for output
 	execWS.ExitCB = func(e *eows.ExecOverWS, code int, err error) {
 		s.Log.Debugf("Command [Cmd ID %s] exited: code %d, error: %v", e.CmdID, code, err)
+		outBatch.Flush()
 
 		// Close client tty
-		defer func() {
-			if gdbPty != nil {
-				gdbPty.Close()
-			}
-			if gdbTty != nil {
-				gdbTty.Close()
-			}
-		}()
+		defer closeTty()
 
-		// IO socket can be nil when disconnected
-		so := s.sessions.IOSocketGet(e.Sid)
-		if so == nil {
-			s.Log.Infof("%s not emitted - WS closed (id:%s)", xsapiv1.ExecExitEvent, e.CmdID)
-			return
-		}
+		s.folderStats.RecordBuild((*e.UserData)["ID"].(string))
+		s.mfolders.ExecRelease((*e.UserData)["ID"].(string), e.CmdID)
+		s.execInputs.Close(e.CmdID)
+		s.execSteps.Close(e.CmdID)
+		s.scheduler.Done(e.CmdID)
+		metrics := s.execMetrics.End(e.CmdID)
+		s.execHistory.End(e.CmdID, code, metrics)
+		collectArtifacts(e.CmdID)
 
 		// Retrieve project ID and RootPath
 		data := e.UserData
 		prjID := (*data)["ID"].(string)
 		exitImm := (*data)["ExitImmediate"].(bool)
 
-		// XXX - workaround to be sure that Syncthing detected all changes
-		if err := s.mfolders.ForceSync(prjID); err != nil {
-			s.Log.Errorf("Error while syncing folder %s: %v", prjID, err)
-		}
-		if !exitImm {
-			// Wait end of file sync
-			// FIXME pass as argument
-			tmo := 60
-			for t := tmo; t > 0; t-- {
-				s.Log.Debugf("Wait file in-sync for %s (%d/%d)", prjID, t, tmo)
-				if sync, err := s.mfolders.IsFolderInSync(prjID); sync || err != nil {
-					if err != nil {
-						s.Log.Errorf("ERROR IsFolderInSync (%s): %v", prjID, err)
-					}
-					break
-				}
-				time.Sleep(time.Second)
-			}
-			s.Log.Debugf("OK file are synchronized.")
-		}
-
-		// FIXME replace by .BroadcastTo a room
-		errSoEmit := (*so).Emit(xsapiv1.ExecExitEvent, xsapiv1.ExecExitMsg{
+		s.emitExecExit(e.Sid, prjID, exitImm, xsapiv1.ExecExitMsg{
 			CmdID:     e.CmdID,
-			Timestamp: time.Now().String(),
 			Code:      code,
 			Error:     err,
+			Metrics:   metrics,
+			OutputSeq: s.execOutputs.Close(e.CmdID),
 		})
-		if errSoEmit != nil {
-			s.Log.Errorf("WS Emit : %v", errSoEmit)
-		}
 	}
 
 	// User data (used within callbacks)
@@ -321,18 +732,33 @@ func (s *APIService) execCmd(c *gin.Context) {
 	execWS.UserData = &data
 
 	// Start command execution
-	s.Log.Infof("Execute [Cmd ID %s]: %v %v", execWS.CmdID, execWS.Cmd, execWS.Args)
+	start := func() error {
+		s.Log.Infof("Execute [Cmd ID %s]: %v %v", execWS.CmdID, execWS.Cmd, execWS.Args)
+		s.execMetrics.Start(execWS.CmdID)
+		s.execOutputs.Open(execWS.CmdID, id, outOpts)
+		err := execWS.Start()
+		if err != nil {
+			s.execMetrics.End(execWS.CmdID)
+		}
+		return err
+	}
 
-	err = execWS.Start()
+	res, err := s.scheduler.Submit(job, start, abort)
 	if err != nil {
+		closeTty()
+		s.execHistory.End(execWS.CmdID, -1, nil)
+		s.mfolders.ExecRelease(id, execWS.CmdID)
+		s.execInputs.Close(execWS.CmdID)
+		s.execSteps.Close(execWS.CmdID)
 		common.APIError(c, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, xsapiv1.ExecResult{Status: "OK", CmdID: execWS.CmdID})
+	c.JSON(http.StatusOK, xsapiv1.ExecResult{Status: "OK", CmdID: execWS.CmdID, Position: res.Position})
 }
 
-// ExecCmd executes remotely a command
+// execSignalCmd sends a signal to a running command (or to all its processes
+// when group is set), queued commands are removed from scheduler queue
 func (s *APIService) execSignalCmd(c *gin.Context) {
 	var args xsapiv1.ExecSignalArgs
 
@@ -341,15 +767,37 @@ func (s *APIService) execSignalCmd(c *gin.Context) {
 		return
 	}
 
-	s.Log.Debugf("Signal %s for command ID %s", args.Signal, args.CmdID)
+	s.Log.Debugf("Signal %s for command ID %s (group %v)", args.Signal, args.CmdID, args.Group)
+	if !s.execOwner(c, args.CmdID) {
+		return
+	}
+
+	sig, err := parseSignal(args.Signal)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
 
-	e := eows.GetEows(args.CmdID)
-	if e == nil {
-		common.APIError(c, "unknown cmdID")
+	// Command not started yet: remove it from scheduler queue
+	if s.scheduler.IsQueued(args.CmdID) {
+		if _, err := s.scheduler.Cancel(args.CmdID); err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, xsapiv1.ExecSigResult{Status: "OK", CmdID: args.CmdID})
 		return
 	}
 
-	err := e.Signal(args.Signal)
+	if s.execPtys.Exists(args.CmdID) {
+		err = s.execPtys.Signal(args.CmdID, args.Signal, args.Group)
+	} else if s.nodes.IsRemote(args.CmdID) {
+		err = s.nodes.Signal(args.CmdID, args.Signal, args.Group)
+	} else if eows.GetEows(args.CmdID) == nil {
+		err = fmt.Errorf("unknown cmdID")
+	} else {
+		// Processes of command are found using its environment marker
+		err = execSignal(args.CmdID, sig, args.Group)
+	}
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -357,3 +805,402 @@ func (s *APIService) execSignalCmd(c *gin.Context) {
 
 	c.JSON(http.StatusOK, xsapiv1.ExecSigResult{Status: "OK", CmdID: args.CmdID})
 }
+
+// execCancelCmd cancels a command: SIGTERM is sent to command, then its
+// processes are killed once grace period is elapsed
+func (s *APIService) execCancelCmd(c *gin.Context) {
+	var args xsapiv1.ExecCancelArgs
+
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	if !s.execOwner(c, args.CmdID) {
+		return
+	}
+	if err := s.cancels.Cancel(args.CmdID, args.GraceS); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, xsapiv1.ExecCancelResult{Status: "OK", CmdID: args.CmdID})
+}
+
+// execReniceCmd changes CPU and I/O priorities of a running command
+func (s *APIService) execReniceCmd(c *gin.Context) {
+	var args xsapiv1.ExecReniceArgs
+
+	if c.BindJSON(&args) != nil || (args.Nice == nil && args.IONice == "") {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	if !s.execOwner(c, args.CmdID) {
+		return
+	}
+	n, err := execRenice(args.CmdID, args.Nice, args.IONice)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	s.Log.Infof("Command %s reniced (%d processes)", args.CmdID, n)
+
+	c.JSON(http.StatusOK, xsapiv1.ExecReniceResult{Status: "OK", CmdID: args.CmdID, Processes: n})
+}
+
+// execInputCmd sends data on stdin of a command started with an input channel
+func (s *APIService) execInputCmd(c *gin.Context) {
+	var args xsapiv1.ExecInMsg
+
+	if c.BindJSON(&args) != nil || args.CmdID == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	if s.execPtys.Exists(args.CmdID) {
+		err := s.execPtys.Write(args.CmdID, sess.ID, args.Stdin)
+		if err == nil && args.EOF {
+			// Ctrl-D: end of input in canonical terminal mode
+			err = s.execPtys.Write(args.CmdID, sess.ID, "\x04")
+		}
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+	} else if err := s.execInputs.Write(args.CmdID, sess.ID, args.Stdin, args.EOF); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, xsapiv1.ExecInResult{Status: "OK", CmdID: args.CmdID})
+}
+
+// execResizeCmd changes terminal size of a command running in a pty
+func (s *APIService) execResizeCmd(c *gin.Context) {
+	var args xsapiv1.ExecResizeArgs
+
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	if err := s.execPtys.Resize(args.CmdID, sess.ID, args.Rows, args.Cols); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, xsapiv1.ExecResizeResult{Status: "OK", CmdID: args.CmdID})
+}
+
+// getExec dispatches GET /exec/:id requests (/exec/history or details of
+// a running command)
+func (s *APIService) getExec(c *gin.Context) {
+	switch c.Param("id") {
+	case "history":
+		s.getExecHistory(c)
+	default:
+		s.getExecRunningCmd(c)
+	}
+}
+
+// getExecRunning returns running and queued commands visible by client
+// (see execVisible)
+func (s *APIService) getExecRunning(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	res := []xsapiv1.ExecRunningCmd{}
+	for _, e := range s.execHistory.Running() {
+		if !s.mfolders.HasAccess(e.FolderID, sess.ID, xsapiv1.FolderAccessRead) || !s.execVisible(&e, sess.ID) {
+			continue
+		}
+		if cmd, ok := s.execRunningCmd(e); ok {
+			res = append(res, cmd)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getExecRunningCmd returns details (including current metrics) of a running
+// or queued command
+func (s *APIService) getExecRunningCmd(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	e, exist := s.execHistory.GetRunning(c.Param("id"))
+	if !exist {
+		common.APIError(c, "Unknown cmdID or command not running")
+		return
+	}
+	if !s.mfolders.HasAccess(e.FolderID, sess.ID, xsapiv1.FolderAccessRead) || !s.execVisible(&e, sess.ID) {
+		common.APIError(c, "Permission denied (command of another session)")
+		return
+	}
+	cmd, ok := s.execRunningCmd(e)
+	if !ok {
+		common.APIError(c, "Unknown cmdID or command not running")
+		return
+	}
+	cmd.Metrics = s.execMetrics.Get(cmd.CmdID)
+	cmd.Steps = s.execSteps.Get(cmd.CmdID)
+	c.JSON(http.StatusOK, cmd)
+}
+
+// execRunningCmd returns state of a command recorded in history (false when
+// command is not known by scheduler: being started or exited)
+func (s *APIService) execRunningCmd(e xsapiv1.ExecHistoryEntry) (xsapiv1.ExecRunningCmd, bool) {
+	job, exist := s.scheduler.Job(e.CmdID)
+	if !exist {
+		return xsapiv1.ExecRunningCmd{}, false
+	}
+	cmd := xsapiv1.ExecRunningCmd{
+		CmdID:       e.CmdID,
+		FolderID:    e.FolderID,
+		Cmd:         e.Cmd,
+		RPath:       e.RPath,
+		SdkID:       e.SdkID,
+		SdkName:     e.SdkName,
+		SessionID:   e.SessionID,
+		User:        e.User,
+		Status:      job.Status,
+		Position:    job.Position,
+		SubmittedAt: e.StartedAt,
+		StartedAt:   job.StartedAt,
+		Node:        e.Node,
+	}
+	seq, last := s.execOutputs.Last(e.CmdID)
+	cmd.OutputSeq = seq
+	if !last.IsZero() {
+		cmd.LastOutputAt = last.String()
+	}
+	return cmd, true
+}
+
+// getExecOutput returns output chunks kept by server after sequence number
+// 'since' (last chunk received by client before disconnection)
+func (s *APIService) getExecOutput(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	since := uint64(0)
+	if v := c.Query("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			common.APIError(c, "Invalid since parameter")
+			return
+		}
+	}
+
+	res, folderID, err := s.execOutputs.Replay(c.Param("id"), since)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	if !s.mfolders.HasAccess(folderID, sess.ID, xsapiv1.FolderAccessRead) {
+		common.APIError(c, "Permission denied on folder")
+		return
+	}
+	if !s.execCmdVisible(c.Param("id"), sess.ID) {
+		common.APIError(c, "Permission denied (command of another session)")
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getExecLog returns the complete output of a command which output limit has
+// been reached (spill policy, saved in store once command exited)
+func (s *APIService) getExecLog(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	digest, folderID, err := s.execOutputs.LogDigest(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	if !s.mfolders.HasAccess(folderID, sess.ID, xsapiv1.FolderAccessRead) {
+		common.APIError(c, "Permission denied on folder")
+		return
+	}
+	if !s.execCmdVisible(c.Param("id"), sess.ID) {
+		common.APIError(c, "Permission denied (command of another session)")
+		return
+	}
+	s.serveStoreBlob(c, digest, "output.log")
+}
+
+// getExecArtifacts returns the list of artifacts collected after a command
+// exit (use ?format=tar|tar.gz|zip to download an archive of all artifacts
+// or ?path=file to download a single file)
+func (s *APIService) getExecArtifacts(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	arts := s.artifacts.Get(c.Param("id"))
+	if arts == nil {
+		common.APIError(c, "Unknown cmdID or command without artifacts")
+		return
+	}
+	if !s.mfolders.HasAccess(arts.FolderID, sess.ID, xsapiv1.FolderAccessRead) {
+		common.APIError(c, "Permission denied on folder")
+		return
+	}
+	if !s.execCmdVisible(arts.CmdID, sess.ID) {
+		common.APIError(c, "Permission denied (command of another session)")
+		return
+	}
+
+	if path := strings.Trim(c.Query("path"), "/"); path != "" {
+		for _, f := range arts.Files {
+			if f.Path == path {
+				s.serveStoreBlob(c, f.Digest, filepath.Base(f.Path))
+				return
+			}
+		}
+		common.APIError(c, "Unknown artifact")
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		c.JSON(http.StatusOK, arts)
+		return
+	}
+	if format == "tgz" {
+		format = xsapiv1.ArchiveFormatTarGz
+	}
+	contentType := map[string]string{
+		xsapiv1.ArchiveFormatTar:   "application/x-tar",
+		xsapiv1.ArchiveFormatTarGz: "application/gzip",
+		xsapiv1.ArchiveFormatZip:   "application/zip",
+	}[format]
+	if contentType == "" {
+		common.APIError(c, "Invalid format")
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename=\"artifacts-"+arts.CmdID+"."+format+"\"")
+	c.Status(http.StatusOK)
+
+	// Headers already sent, errors can only be logged
+	if err := s.artifacts.WriteArchive(c.Writer, format, arts); err != nil {
+		s.Log.Errorf("Error while sending artifacts of command %s: %v", arts.CmdID, err)
+	}
+}
+
+// getExecHistory returns history of executed commands (of a folder when
+// folderID is set), paginated using offset and limit
+func (s *APIService) getExecHistory(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		common.APIError(c, "Invalid offset")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(execHistoryDefaultLimit)))
+	if err != nil || limit <= 0 || limit > execHistoryMaxLimit {
+		common.APIError(c, fmt.Sprintf("Invalid limit (must be between 1 and %d)", execHistoryMaxLimit))
+		return
+	}
+
+	folderID := c.Query("folderID")
+	if folderID != "" {
+		id, err := s.mfolders.ResolveID(folderID)
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		if !s.mfolders.HasAccess(id, sess.ID, xsapiv1.FolderAccessRead) {
+			common.APIError(c, "Permission denied on folder")
+			return
+		}
+		folderID = id
+	}
+
+	// Only return commands visible by session
+	accept := func(e *xsapiv1.ExecHistoryEntry) bool {
+		if folderID != "" && e.FolderID != folderID {
+			return false
+		}
+		return s.mfolders.HasAccess(e.FolderID, sess.ID, xsapiv1.FolderAccessRead) && s.execVisible(e, sess.ID)
+	}
+
+	c.JSON(http.StatusOK, s.execHistory.Get(accept, offset, limit))
+}
+
+// emitExecExit waits folder synchronization (unless exitImm is set) and
+// sends command exit event (including command metrics) to the session
+func (s *APIService) emitExecExit(sid, prjID string, exitImm bool, msg xsapiv1.ExecExitMsg) {
+	// Exit is also notified as an event (kept in events history, IOW
+	// available for clients that were disconnected)
+	msg.FolderID = prjID
+	msg.Timestamp = time.Now().String()
+	if err := s.events.Emit(xsapiv1.EVTExecExit, msg, sid); err != nil {
+		s.Log.Warningf("Cannot notify command exit: %v", err)
+	}
+
+	// IO socket can be nil when disconnected
+	so := s.sessions.IOSocketGet(sid)
+	if so == nil {
+		s.Log.Infof("%s not emitted - WS closed (id:%s)", xsapiv1.ExecExitEvent, msg.CmdID)
+		return
+	}
+
+	// XXX - workaround to be sure that Syncthing detected all changes
+	if err := s.mfolders.ForceSync(prjID); err != nil {
+		s.Log.Errorf("Error while syncing folder %s: %v", prjID, err)
+	}
+	if !exitImm {
+		// Wait end of file sync
+		// FIXME pass as argument
+		tmo := 60
+		for t := tmo; t > 0; t-- {
+			s.Log.Debugf("Wait file in-sync for %s (%d/%d)", prjID, t, tmo)
+			if sync, err := s.mfolders.IsFolderInSync(prjID); sync || err != nil {
+				if err != nil {
+					s.Log.Errorf("ERROR IsFolderInSync (%s): %v", prjID, err)
+				}
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		s.Log.Debugf("OK file are synchronized.")
+	}
+
+	// FIXME replace by .BroadcastTo a room
+	// (sent after queued output of command)
+	msg.Timestamp = time.Now().String()
+	s.outStreams.Emit(sid, xsapiv1.ExecExitEvent, msg, 0)
+}
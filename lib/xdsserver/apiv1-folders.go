@@ -19,6 +19,7 @@ package xdsserver
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	common "github.com/iotbzh/xds-common/golib"
@@ -27,7 +28,11 @@ import (
 
 // getFolders returns all folders configuration
 func (s *APIService) getFolders(c *gin.Context) {
-	c.JSON(http.StatusOK, s.mfolders.GetConfigArr())
+	clientID := ""
+	if sess := s.sessions.Get(c); sess != nil {
+		clientID = sess.ID
+	}
+	c.JSON(http.StatusOK, s.mfolders.GetConfigArrFor(clientID))
 }
 
 // getFolder returns a specific folder configuration
@@ -43,7 +48,7 @@ func (s *APIService) getFolder(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, (*f).GetConfig())
+	c.JSON(http.StatusOK, s.mfolders.withRuntime((*f).GetConfig()))
 }
 
 // addFolder adds a new folder to server config
@@ -54,20 +59,64 @@ func (s *APIService) addFolder(c *gin.Context) {
 		return
 	}
 
+	// Folder belongs to the client that registers it
+	cfgArg.Owner = ""
+	cfgArg.OwnerUser = ""
+	cfgArg.Shares = nil
+	if sess := s.sessions.Get(c); sess != nil {
+		cfgArg.Owner = sess.ID
+		cfgArg.OwnerUser = s.sessionAuthUser(sess.ID)
+	}
+
 	s.Log.Debugln("Add folder config: ", cfgArg)
 
 	newFld, err := s.mfolders.Add(cfgArg)
+	desc := "Add " + string(cfgArg.Type) + " folder " + cfgArg.Label + " (" + cfgArg.ClientPath + ")"
 	if err != nil {
+		s.auditRecord(c, xsapiv1.AuditActionFolderAdd, "", desc, err)
 		common.APIError(c, err.Error())
 		return
 	}
+	s.auditRecord(c, xsapiv1.AuditActionFolderAdd, newFld.ID, desc, nil)
 
 	c.JSON(http.StatusOK, newFld)
 }
 
+// postFolderAction dispatches POST /folders/:id/<action> commands
+// (/folders/sync/:id is kept for backward compatibility, a static route
+// cannot be used because it would conflict with /folders/:id/<action>)
+func (s *APIService) postFolderAction(c *gin.Context) {
+	switch {
+	case c.Param("id") == "sync":
+		s.syncFolder(c, c.Param("action"))
+	case c.Param("action") == "conflicts":
+		s.resolveFolderConflict(c)
+	case c.Param("action") == "versions":
+		s.restoreFileVersion(c)
+	case c.Param("action") == "rescan":
+		s.rescanFolder(c)
+	case c.Param("action") == "pause":
+		s.pauseFolder(c, true)
+	case c.Param("action") == "resume":
+		s.pauseFolder(c, false)
+	case c.Param("action") == "snapshots":
+		s.createFolderSnapshot(c)
+	case c.Param("action") == "restore":
+		s.restoreFolderSnapshot(c)
+	case c.Param("action") == "devices":
+		s.addFolderDevice(c)
+	case c.Param("action") == "unlock":
+		s.unlockFolder(c)
+	case c.Param("action") == "lock":
+		s.lockFolder(c)
+	default:
+		common.APIError(c, "Invalid command")
+	}
+}
+
 // syncFolder force synchronization of folder files
-func (s *APIService) syncFolder(c *gin.Context) {
-	id, err := s.mfolders.ResolveID(c.Param("id"))
+func (s *APIService) syncFolder(c *gin.Context, fldID string) {
+	id, err := s.mfolders.ResolveID(fldID)
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -93,7 +142,28 @@ func (s *APIService) delFolder(c *gin.Context) {
 
 	s.Log.Debugln("Delete folder id ", id)
 
+	// Deleting a folder and its content may require a confirmation
+	if s.approvals.IsRequired(xsapiv1.ApprovalOpFolderDelete) && s.mfolders.IsDeleteDestructive(id) {
+		sess := s.sessions.Get(c)
+		if sess == nil {
+			common.APIError(c, "Unknown sessions")
+			return
+		}
+		desc := "Delete folder " + id + " and its content"
+		pOp, err := s.approvals.Add(xsapiv1.ApprovalOpFolderDelete, id, desc, sess.ID, func() (interface{}, error) {
+			return s.mfolders.Delete(id)
+		})
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		s.auditPending(c, xsapiv1.AuditActionFolderDelete, id, pOp)
+		c.JSON(http.StatusAccepted, pOp)
+		return
+	}
+
 	delEntry, err := s.mfolders.Delete(id)
+	s.auditRecord(c, xsapiv1.AuditActionFolderDelete, id, "Delete folder "+id, err)
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -118,9 +188,495 @@ func (s *APIService) updateFolder(c *gin.Context) {
 	}
 
 	upFld, err := s.mfolders.Update(id, cfgArg)
+	s.auditRecord(c, xsapiv1.AuditActionFolderUpdate, id, "Update folder "+id, err)
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
 	}
 	c.JSON(http.StatusOK, upFld)
 }
+
+// getFolderIgnores returns ignore patterns of a CloudSync folder
+func (s *APIService) getFolderIgnores(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	ign, err := s.mfolders.GetIgnores(id)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ign)
+}
+
+// setFolderIgnores updates ignore patterns of a CloudSync folder
+func (s *APIService) setFolderIgnores(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	var args xsapiv1.FolderIgnores
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	s.Log.Debugf("Set ignores of folder id %s: %v", id, args.Ignore)
+
+	ign, err := s.mfolders.SetIgnores(id, args.Ignore)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ign)
+}
+
+// getFolderConflicts returns sync conflicts of a CloudSync folder
+func (s *APIService) getFolderConflicts(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	conflicts, err := s.mfolders.GetConflicts(id)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, conflicts)
+}
+
+// resolveFolderConflict resolves a sync conflict of a CloudSync folder
+func (s *APIService) resolveFolderConflict(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	var args xsapiv1.FolderConflictResolveArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	res, err := s.mfolders.ResolveConflict(id, args)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getFileVersions returns previous versions of a file of a CloudSync folder
+func (s *APIService) getFileVersions(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	versions, err := s.mfolders.GetFileVersions(id, c.Query("path"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// restoreFileVersion restores a previous version of a file of a CloudSync folder
+func (s *APIService) restoreFileVersion(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	var args xsapiv1.FileVersionRestoreArgs
+	if c.BindJSON(&args) != nil || args.Path == "" || args.Version == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	res, err := s.mfolders.RestoreFileVersion(id, args)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// rescanFolder queues an immediate rescan of folder files
+func (s *APIService) rescanFolder(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	s.Log.Debugln("Rescan folder id: ", id)
+
+	if err := s.mfolders.Rescan(id); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, "")
+}
+
+// pauseFolder pauses or resumes synchronization of a CloudSync folder
+func (s *APIService) pauseFolder(c *gin.Context, paused bool) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	s.Log.Debugf("Set paused=%v folder id: %s", paused, id)
+
+	fld, err := s.mfolders.SetPaused(id, paused)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fld)
+}
+
+// getFolderStats returns statistics of folder files
+// (computed in background, use ?refresh=1 to force a new computation)
+func (s *APIService) getFolderStats(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	stats, err := s.folderStats.Get(id, c.Query("refresh") == "1")
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// getFolderBuildStats returns metrics of commands executed in a folder,
+// aggregated by command line (used to detect build time regressions)
+func (s *APIService) getFolderBuildStats(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, s.execHistory.BuildStats(id))
+}
+
+// getFolderSnapshots returns snapshots of a folder
+func (s *APIService) getFolderSnapshots(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, s.snapshots.List(id))
+}
+
+// createFolderSnapshot saves current content of a folder
+func (s *APIService) createFolderSnapshot(c *gin.Context) {
+	var args xsapiv1.FolderSnapshotArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	sn, err := s.snapshots.Create(id, args)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sn)
+}
+
+// delFolderSnapshot deletes a snapshot of a folder
+func (s *APIService) delFolderSnapshot(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	sn, err := s.snapshots.Delete(id, c.Param("name"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sn)
+}
+
+// restoreFolderSnapshot replaces content of a folder by a snapshot
+func (s *APIService) restoreFolderSnapshot(c *gin.Context) {
+	var args xsapiv1.FolderRestoreArgs
+	if c.BindJSON(&args) != nil || args.Name == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	s.Log.Debugf("Restore snapshot %s of folder id %s", args.Name, id)
+
+	// Current folder content is lost, may require a confirmation
+	if s.approvals.IsRequired(xsapiv1.ApprovalOpFolderRestore) {
+		sess := s.sessions.Get(c)
+		if sess == nil {
+			common.APIError(c, "Unknown sessions")
+			return
+		}
+		desc := "Restore snapshot " + args.Name + " of folder " + id
+		pOp, err := s.approvals.Add(xsapiv1.ApprovalOpFolderRestore, id, desc, sess.ID, func() (interface{}, error) {
+			return s.snapshots.Restore(id, args.Name)
+		})
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		s.auditPending(c, xsapiv1.AuditActionFolderRestore, id, pOp)
+		c.JSON(http.StatusAccepted, pOp)
+		return
+	}
+
+	sn, err := s.snapshots.Restore(id, args.Name)
+	s.auditRecord(c, xsapiv1.AuditActionFolderRestore, id, "Restore snapshot "+args.Name+" of folder "+id, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sn)
+}
+
+// getFolderArchive streams an archive of folder files
+// (use ?path=sub/dir to only archive a sub-tree and ?format=tar|tar.gz|zip)
+func (s *APIService) getFolderArchive(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	format := c.DefaultQuery("format", xsapiv1.ArchiveFormatTarGz)
+	if format == "tgz" {
+		format = xsapiv1.ArchiveFormatTarGz
+	}
+	contentType := map[string]string{
+		xsapiv1.ArchiveFormatTar:   "application/x-tar",
+		xsapiv1.ArchiveFormatTarGz: "application/gzip",
+		xsapiv1.ArchiveFormatZip:   "application/zip",
+	}[format]
+	if contentType == "" {
+		common.APIError(c, "Invalid format")
+		return
+	}
+
+	dir, skip, err := s.mfolders.ArchiveDir(id, c.Query("path"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	name := (*s.mfolders.Get(id)).GetConfig().Label
+	if sub := strings.Trim(c.Query("path"), "/"); sub != "" {
+		name += "-" + strings.Replace(sub, "/", "-", -1)
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename=\""+name+"."+format+"\"")
+	c.Status(http.StatusOK)
+
+	// Headers already sent, errors can only be logged
+	if err := writeArchive(c.Writer, format, s.fileAttrs, dir, skip); err != nil {
+		s.Log.Errorf("Error while sending archive of folder %s: %v", id, err)
+	}
+}
+
+// folderAccess returns a handler that rejects requests of clients without
+// the requested access on folder (set in :id route parameter)
+func (s *APIService) folderAccess(need string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idArg := c.Param("id")
+		if idArg == "sync" && c.Param("action") != "" {
+			// legacy /folders/sync/:id route
+			idArg = c.Param("action")
+		}
+		id, err := s.mfolders.ResolveID(idArg)
+		if err != nil {
+			// let handler report the error
+			c.Next()
+			return
+		}
+
+		clientID := ""
+		if sess := s.sessions.Get(c); sess != nil {
+			clientID = sess.ID
+		}
+		if !s.mfolders.HasAccess(id, clientID, need) {
+			common.APIError(c, "Permission denied on folder")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// setFolderShares replaces the list of clients a folder is shared with
+func (s *APIService) setFolderShares(c *gin.Context) {
+	var shares []xsapiv1.FolderShare
+	if c.BindJSON(&shares) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	fld, err := s.mfolders.SetShares(id, shares)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fld)
+}
+
+// addFolderDevice synchronizes a CloudSync folder with an additional device
+func (s *APIService) addFolderDevice(c *gin.Context) {
+	var args xsapiv1.FolderDeviceArgs
+	if c.BindJSON(&args) != nil || args.DeviceID == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	fld, err := s.mfolders.AddDevice(id, args.DeviceID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fld)
+}
+
+// delFolderDevice stops synchronization of a CloudSync folder with a device
+func (s *APIService) delFolderDevice(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	fld, err := s.mfolders.RemoveDevice(id, c.Param("devid"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fld)
+}
+
+// getFolderFS returns a directory listing or information about a file of a
+// folder (use ?path=sub/file and ?content=1 to also get text file content)
+func (s *APIService) getFolderFS(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	withContent := c.Query("content") == "1" || c.Query("content") == "true"
+	entry, err := s.mfolders.FSStat(id, c.Query("path"), withContent)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// putFolderFS creates or replaces a text file of a folder (?path=sub/file)
+func (s *APIService) putFolderFS(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	var args xsapiv1.FolderFSWriteArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	entry, err := s.mfolders.FSWrite(id, c.Query("path"), args.Content)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// unlockFolder gives access to files of an encrypted folder
+// (folder is locked again when session is closed)
+func (s *APIService) unlockFolder(c *gin.Context) {
+	var args xsapiv1.FolderUnlockArgs
+	if c.BindJSON(&args) != nil || args.Passphrase == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	fld, err := s.mfolders.Unlock(id, args.Passphrase, sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fld)
+}
+
+// lockFolder releases access to files of an encrypted folder
+func (s *APIService) lockFolder(c *gin.Context) {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	fld, err := s.mfolders.Lock(id, sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fld)
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+)
+
+// getInotifyStatus returns inotify watches usage and folders using periodic scan
+func (s *APIService) getInotifyStatus(c *gin.Context) {
+	if s.inotify == nil {
+		common.APIError(c, "inotify watches monitoring not enabled")
+		return
+	}
+	c.JSON(http.StatusOK, s.inotify.GetStatus())
+}
+
+// checkInotifyStatus forces a new check of inotify watches usage
+func (s *APIService) checkInotifyStatus(c *gin.Context) {
+	if s.inotify == nil {
+		common.APIError(c, "inotify watches monitoring not enabled")
+		return
+	}
+	st, err := s.inotify.Check()
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getMatrices returns running and last finished matrices
+func (s *APIService) getMatrices(c *gin.Context) {
+	c.JSON(http.StatusOK, s.matrices.GetAll())
+}
+
+// getMatrix returns a matrix (consolidated pass/fail summary)
+func (s *APIService) getMatrix(c *gin.Context) {
+	mx, err := s.matrices.Get(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, mx)
+}
+
+// startMatrix executes a command of a folder against several SDKs
+func (s *APIService) startMatrix(c *gin.Context) {
+	var args xsapiv1.MatrixArgs
+	if c.BindJSON(&args) != nil || args.FolderID == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	id, err := s.mfolders.ResolveID(args.FolderID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	args.FolderID = id
+
+	mx, err := s.matrices.Start(args, sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, mx)
+}
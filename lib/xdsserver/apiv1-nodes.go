@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// nodeRoute returns true when request is sent by a builder node or by the
+// primary server (authenticated using node token instead of session)
+func nodeRoute(c *gin.Context, path string) bool {
+	return c.Request.Method == "POST" && (path == "/nodes" || path == "/executor/exec" || path == "/executor/signal")
+}
+
+// nodeAuth accepts requests of builder nodes with a valid node token
+func (s *APIService) nodeAuth(c *gin.Context) {
+	if err := s.nodes.CheckToken(c.Request.Header.Get(nodeTokenHeaderName)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// getNodes returns all registered builder nodes
+func (s *APIService) getNodes(c *gin.Context) {
+	c.JSON(http.StatusOK, s.nodes.GetAll())
+}
+
+// registerNode adds or refreshes a builder node (heartbeat sent by nodes)
+func (s *APIService) registerNode(c *gin.Context) {
+	if err := s.nodes.CheckToken(c.Request.Header.Get(nodeTokenHeaderName)); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	var args xsapiv1.NodeRegisterArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	c.JSON(http.StatusOK, s.nodes.Register(args))
+}
+
+// delNode removes a builder node
+func (s *APIService) delNode(c *gin.Context) {
+	node, err := s.nodes.Delete(c.Param("name"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, node)
+}
+
+// executorExec executes a command dispatched by primary server, output and
+// exit status are streamed as JSON lines (see NodeExecMsg)
+func (s *APIService) executorExec(c *gin.Context) {
+	if err := s.nodes.CheckToken(c.Request.Header.Get(nodeTokenHeaderName)); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	var args xsapiv1.NodeExecArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	out := make(chan xsapiv1.NodeExecMsg, 64)
+	go s.nodes.Execute(args, out, c.Writer.CloseNotify())
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	for msg := range out {
+		// Keep reading messages when primary is disconnected (command is cancelled)
+		if err := enc.Encode(msg); err == nil {
+			c.Writer.Flush()
+		}
+	}
+}
+
+// executorSignal sends a signal to a command dispatched by primary server
+func (s *APIService) executorSignal(c *gin.Context) {
+	if err := s.nodes.CheckToken(c.Request.Header.Get(nodeTokenHeaderName)); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	var args xsapiv1.NodeSignalArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	if err := s.nodes.SignalLocal(args.CmdID, args.Signal, args.Group); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, xsapiv1.ExecSigResult{Status: "OK", CmdID: args.CmdID})
+}
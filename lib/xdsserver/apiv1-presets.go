@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getExecPresets returns command presets (available in a folder when
+// folderID is set)
+func (s *APIService) getExecPresets(c *gin.Context) {
+	folderID, ok := s.presetFolderID(c, c.Query("folderID"), xsapiv1.FolderAccessRead)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, s.presets.List(folderID))
+}
+
+// setExecPreset creates or replaces a preset (global or of a folder)
+func (s *APIService) setExecPreset(c *gin.Context) {
+	var ps xsapiv1.ExecPreset
+	if c.BindJSON(&ps) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	folderID, ok := s.presetFolderID(c, ps.FolderID, xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	ps.Name = c.Param("name")
+	ps.FolderID = folderID
+
+	res, err := s.presets.Set(ps)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// delExecPreset removes a preset (of a folder when folderID is set)
+func (s *APIService) delExecPreset(c *gin.Context) {
+	folderID, ok := s.presetFolderID(c, c.Query("folderID"), xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	if err := s.presets.Delete(c.Param("name"), folderID); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
+
+// postExecAction dispatches POST /exec/:id/:name requests (/exec/preset/:name)
+func (s *APIService) postExecAction(c *gin.Context) {
+	switch c.Param("id") {
+	case "preset":
+		s.execPresetCmd(c)
+	default:
+		common.APIError(c, "Invalid request")
+	}
+}
+
+// execPresetCmd executes the command of a preset
+func (s *APIService) execPresetCmd(c *gin.Context) {
+	var args xsapiv1.ExecPresetArgs
+	if c.BindJSON(&args) != nil || args.ID == "" {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	id, err := s.mfolders.ResolveID(args.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	ps, err := s.presets.Get(c.Param("name"), id)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	cmd, err := s.presets.Render(ps, args.Params)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	s.Log.Debugf("Preset %s of folder %s: %s", ps.Name, id, cmd)
+	args.ExecArgs.Cmd = cmd
+	args.ExecArgs.Args = []string{}
+	s.execRun(c, args.ExecArgs)
+}
+
+// presetFolderID resolves folder of a preset and checks session access (an
+// error is returned to client when not ok)
+func (s *APIService) presetFolderID(c *gin.Context, folderID, access string) (string, bool) {
+	if folderID == "" {
+		// Global presets are managed by admins
+		if access != xsapiv1.FolderAccessRead && !s.hasRole(c, xsapiv1.RoleAdmin) {
+			common.APIError(c, "Permission denied (admin role required)")
+			return "", false
+		}
+		return "", true
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return "", false
+	}
+	id, err := s.mfolders.ResolveID(folderID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return "", false
+	}
+	if !s.mfolders.HasAccess(id, sess.ID, access) {
+		common.APIError(c, "Permission denied on folder")
+		return "", false
+	}
+	return id, true
+}
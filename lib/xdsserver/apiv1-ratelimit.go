@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitMiddleware rejects requests of clients that exceed rate limits
+// (clients using a bearer token are limited per token, others per IP)
+func (s *APIService) rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.rateLimit == nil {
+			c.Next()
+			return
+		}
+
+		token := ""
+		if auth := c.Request.Header.Get("Authorization"); strings.HasPrefix(auth, sessionAuthScheme) {
+			// Don't keep tokens in memory
+			sum := sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(auth, sessionAuthScheme))))
+			token = hex.EncodeToString(sum[:8])
+		}
+		path := strings.TrimPrefix(c.Request.URL.Path, s.apiRouter.BasePath())
+		isEvent := strings.HasPrefix(path, "/events/")
+
+		// Forwarded headers can be set by anyone, only trust them behind a proxy
+		ip := c.ClientIP()
+		if !s.rateLimit.proxy {
+			ip = strings.TrimSpace(c.Request.RemoteAddr)
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
+		}
+
+		if ok, wait := s.rateLimit.Allow(ip, token, isEvent); !ok {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": "error", "error": "Too many requests, retry later"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
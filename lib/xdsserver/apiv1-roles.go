@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// roleUser returns the user used to select role of session (only users of
+// authenticated sessions are trusted, XDS-User header can be set by anyone)
+func (ctx *Context) roleUser(sess *ClientSession) string {
+	if sess == nil || !sess.IsAuthenticated() {
+		return ""
+	}
+	return sess.User
+}
+
+// hasRole returns true when client has (at least) privileges of a role
+func (s *APIService) hasRole(c *gin.Context, role string) bool {
+	return s.roles.Allowed(s.roleUser(s.sessions.Get(c)), role)
+}
+
+// execOwner returns false (and replies an error) when client is not allowed
+// to manage a command of another session (see sessionOwns)
+func (s *APIService) execOwner(c *gin.Context, cmdID string) bool {
+	e, running := s.execHistory.GetRunning(cmdID)
+	if !running || e.SessionID == "" {
+		return true
+	}
+	sid := ""
+	if sess := s.sessions.Get(c); sess != nil {
+		sid = sess.ID
+	}
+	if !s.sessionOwns(sid, e.SessionID, e.User) {
+		common.APIError(c, "Permission denied (command of another session)")
+		return false
+	}
+	return true
+}
+
+// rolesMiddleware rejects requests that modify something when client is
+// read-only (events registration, login, session lifetime and agents pairing
+// requests are always accepted, builder nodes requests must carry a valid node
+// token)
+func (s *APIService) rolesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.roles.Enabled() || c.Request.Method == "GET" {
+			c.Next()
+			return
+		}
+		path := strings.TrimPrefix(c.Request.URL.Path, s.apiRouter.BasePath())
+		if nodeRoute(c, path) {
+			s.nodeAuth(c)
+			return
+		}
+		if strings.HasPrefix(path, "/auth/") || strings.HasPrefix(path, "/events/") || strings.HasPrefix(path, "/sessions/") ||
+			path == "/agents/pair" {
+			c.Next()
+			return
+		}
+		if !s.hasRole(c, xsapiv1.RoleDeveloper) {
+			c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": "Permission denied (read-only role)"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// roleRequired returns a middleware that rejects requests of clients that
+// don't have a role
+func (s *APIService) roleRequired(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.hasRole(c, role) {
+			c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": "Permission denied (" + role + " role required)"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// getRoles returns roles of users
+func (s *APIService) getRoles(c *gin.Context) {
+	c.JSON(http.StatusOK, s.roles.GetAll())
+}
+
+// setRole assigns a role to a user
+func (s *APIService) setRole(c *gin.Context) {
+	var args xsapiv1.RoleSetArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	ur, err := s.roles.Set(c.Param("user"), args.Role)
+	s.auditRecord(c, xsapiv1.AuditActionRoleSet, c.Param("user"), "Assign role "+args.Role, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ur)
+}
+
+// delRole removes the role assigned to a user
+func (s *APIService) delRole(c *gin.Context) {
+	ur, err := s.roles.Delete(c.Param("user"))
+	s.auditRecord(c, xsapiv1.AuditActionRoleSet, c.Param("user"), "Remove role", err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, ur)
+}
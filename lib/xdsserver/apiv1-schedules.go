@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getSchedules returns scheduled commands of folders accessible by client
+// (filtered on folderID query parameter when set)
+func (s *APIService) getSchedules(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	folderID := c.Query("folderID")
+	if folderID != "" {
+		id, err := s.mfolders.ResolveID(folderID)
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		folderID = id
+	}
+
+	res := []xsapiv1.CmdSchedule{}
+	for _, sc := range s.schedules.GetAll(folderID) {
+		if s.mfolders.HasAccess(sc.FolderID, sess.ID, xsapiv1.FolderAccessRead) {
+			res = append(res, sc)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getSchedule returns a scheduled command
+func (s *APIService) getSchedule(c *gin.Context) {
+	sc, ok := s.scheduleAccess(c, c.Param("id"), xsapiv1.FolderAccessRead)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+// addSchedule registers a command executed periodically in a folder
+func (s *APIService) addSchedule(c *gin.Context) {
+	var args xsapiv1.CmdSchedule
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	id, err := s.mfolders.ResolveID(args.FolderID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	if !s.mfolders.HasAccess(id, sess.ID, xsapiv1.FolderAccessReadWrite) {
+		common.APIError(c, "Permission denied on folder")
+		return
+	}
+	args.FolderID = id
+
+	sc, err := s.schedules.Add(args, sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+// updateSchedule replaces definition of a scheduled command
+func (s *APIService) updateSchedule(c *gin.Context) {
+	var args xsapiv1.CmdSchedule
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	prev, ok := s.scheduleAccess(c, c.Param("id"), xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	if id, err := s.mfolders.ResolveID(args.FolderID); err == nil {
+		args.FolderID = id
+	}
+
+	sc, err := s.schedules.Update(prev.ID, args)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+// delSchedule removes a scheduled command
+func (s *APIService) delSchedule(c *gin.Context) {
+	sc, ok := s.scheduleAccess(c, c.Param("id"), xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	if err := s.schedules.Delete(sc.ID); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+// runSchedule executes immediately a scheduled command
+func (s *APIService) runSchedule(c *gin.Context) {
+	sc, ok := s.scheduleAccess(c, c.Param("id"), xsapiv1.FolderAccessReadWrite)
+	if !ok {
+		return
+	}
+	res, err := s.schedules.Run(sc.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// scheduleAccess returns a scheduled command when client has access to its
+// folder (error is returned to client otherwise)
+func (s *APIService) scheduleAccess(c *gin.Context, id, access string) (*xsapiv1.CmdSchedule, bool) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return nil, false
+	}
+	sc, err := s.schedules.Get(id)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return nil, false
+	}
+	if !s.mfolders.HasAccess(sc.FolderID, sess.ID, access) {
+		common.APIError(c, "Permission denied on folder")
+		return nil, false
+	}
+	return sc, true
+}
@@ -19,6 +19,8 @@ package xdsserver
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	common "github.com/iotbzh/xds-common/golib"
@@ -26,12 +28,53 @@ import (
 )
 
 // getSdks returns all SDKs configuration
+// Support conditional request using If-None-Match header and changedSince
+// parameter (RFC3339 date or unix timestamp) to only get modified SDKs
+// (removed SDKs are then returned with "Removed" status)
 func (s *APIService) getSdks(c *gin.Context) {
-	c.JSON(http.StatusOK, s.sdks.GetAll())
+	since := time.Time{}
+	if cs := c.Query("changedSince"); cs != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, cs); err != nil {
+			ts, errI := strconv.ParseInt(cs, 10, 64)
+			if errI != nil {
+				common.APIError(c, "Invalid changedSince parameter")
+				return
+			}
+			since = time.Unix(ts, 0)
+		}
+	}
+
+	sdks, etag, lastMod := s.sdks.GetAllChangedSince(since)
+
+	c.Header("ETag", etag)
+	if !lastMod.IsZero() {
+		c.Header("Last-Modified", lastMod.UTC().Format(http.TimeFormat))
+	}
+	if match := c.Request.Header.Get("If-None-Match"); match != "" && match == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if !since.IsZero() && len(sdks) == 0 {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.JSON(http.StatusOK, sdks)
 }
 
 // getSdk returns a specific Sdk configuration
 func (s *APIService) getSdk(c *gin.Context) {
+	// Note: dedicated routes cannot be used because they would conflict with /sdks/:id
+	switch c.Param("id") {
+	case "prerequisites":
+		s.getSdksPrerequisites(c)
+		return
+	case "families":
+		c.JSON(http.StatusOK, s.sdks.GetFamilies())
+		return
+	}
+
 	id, err := s.sdks.ResolveID(c.Param("id"))
 	if err != nil {
 		common.APIError(c, err.Error())
@@ -46,6 +89,11 @@ func (s *APIService) getSdk(c *gin.Context) {
 	c.JSON(http.StatusOK, sdk)
 }
 
+// getSdksPrerequisites returns host prerequisites status of each SDKs family
+func (s *APIService) getSdksPrerequisites(c *gin.Context) {
+	c.JSON(http.StatusOK, s.sdks.CheckPrerequisites())
+}
+
 // installSdk Install a new Sdk
 func (s *APIService) installSdk(c *gin.Context) {
 	var args xsapiv1.SDKInstallArgs
@@ -60,8 +108,31 @@ func (s *APIService) installSdk(c *gin.Context) {
 		return
 	}
 
-	// Support install from ID->URL or from local file
+	// Support install from ID->URL, from local file or from local directory
+	if args.Dir != "" {
+		if id != "" || args.Filename != "" {
+			common.APIError(c, "invalid parameter, dir cannot be combined with id or filename")
+			return
+		}
+		s.Log.Debugf("Registering SDK directory %s (force %v)", args.Dir, args.Force)
+		sdk, err := s.sdks.InstallFromDir(args.Dir, args.Force)
+		if err != nil {
+			s.auditRecord(c, xsapiv1.AuditActionSdkInstall, "", "Register SDK directory "+args.Dir, err)
+			common.APIError(c, err.Error())
+			return
+		}
+		s.auditRecord(c, xsapiv1.AuditActionSdkInstall, sdk.ID, "Register SDK directory "+args.Dir, nil)
+		if sess := s.sessions.Get(c); sess != nil {
+			s.sdks.SetOwner(sdk.ID, sess.ID, s.sessionAuthUser(sess.ID))
+			sdk = s.sdks.Get(sdk.ID)
+		}
+		c.JSON(http.StatusOK, sdk)
+		return
+	}
 	if id != "" {
+		if !s.sdkOwner(c, id) {
+			return
+		}
 		s.Log.Debugf("Installing SDK id %s (force %v)", id, args.Force)
 	} else if args.Filename != "" {
 		s.Log.Debugf("Installing SDK filename %s (force %v)", args.Filename, args.Force)
@@ -75,11 +146,76 @@ func (s *APIService) installSdk(c *gin.Context) {
 	}
 
 	sdk, err := s.sdks.Install(id, args.Filename, args.Force, args.Timeout, args.InstallArgs, sess)
+	desc := "Install SDK " + id
+	if args.Filename != "" {
+		desc = "Install SDK file " + args.Filename
+	}
+	if err != nil {
+		s.auditRecord(c, xsapiv1.AuditActionSdkInstall, id, desc, err)
+		common.APIError(c, err.Error())
+		return
+	}
+	s.auditRecord(c, xsapiv1.AuditActionSdkInstall, sdk.ID, desc, nil)
+	s.sdks.SetOwner(sdk.ID, sess.ID, s.sessionAuthUser(sess.ID))
+
+	c.JSON(http.StatusOK, sdk)
+}
+
+// postSdkAction dispatches POST /sdks/<action> commands
+// (a static route cannot be used because it would conflict with /sdks/:id/verify)
+func (s *APIService) postSdkAction(c *gin.Context) {
+	switch c.Param("id") {
+	case "abortinstall":
+		s.abortInstallSdk(c)
+	default:
+		common.APIError(c, "Invalid command")
+	}
+}
+
+// postSdkIDAction dispatches POST /sdks/:id/<action> commands
+func (s *APIService) postSdkIDAction(c *gin.Context) {
+	switch {
+	case c.Param("action") == "verify":
+		s.verifySdk(c)
+	case c.Param("id") == "families" && c.Param("action") == "reload":
+		s.reloadSdkFamilies(c)
+	default:
+		common.APIError(c, "Invalid command")
+	}
+}
+
+// reloadSdkFamilies Detect new or removed SDKs families
+func (s *APIService) reloadSdkFamilies(c *gin.Context) {
+	res, err := s.sdks.ReloadFamilies(true)
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
 	}
+	c.JSON(http.StatusOK, res)
+}
 
+// verifySdk Check integrity of an installed Sdk
+func (s *APIService) verifySdk(c *gin.Context) {
+	id, err := s.sdks.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	// Arguments are optional
+	var args xsapiv1.SDKVerifyArgs
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&args); err != nil {
+			common.APIError(c, "Invalid arguments")
+			return
+		}
+	}
+
+	sdk, err := s.sdks.Verify(id, args.CreateManifest)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
 	c.JSON(http.StatusOK, sdk)
 }
 
@@ -97,6 +233,10 @@ func (s *APIService) abortInstallSdk(c *gin.Context) {
 		return
 	}
 
+	if !s.sdkOwner(c, id) {
+		return
+	}
+
 	sdk, err := s.sdks.AbortInstall(id, args.Timeout)
 	if err != nil {
 		common.APIError(c, err.Error())
@@ -121,12 +261,51 @@ func (s *APIService) removeSdk(c *gin.Context) {
 		return
 	}
 
+	if !s.sdkOwner(c, id) {
+		return
+	}
+
 	s.Log.Debugln("Remove SDK id ", id)
 
+	// Removing a SDK may require a confirmation
+	if s.approvals.IsRequired(xsapiv1.ApprovalOpSdkRemove) {
+		desc := "Remove SDK " + id
+		pOp, err := s.approvals.Add(xsapiv1.ApprovalOpSdkRemove, id, desc, sess.ID, func() (interface{}, error) {
+			return s.sdks.Remove(id, -1, sess)
+		})
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		s.auditPending(c, xsapiv1.AuditActionSdkRemove, id, pOp)
+		c.JSON(http.StatusAccepted, pOp)
+		return
+	}
+
 	delEntry, err := s.sdks.Remove(id, -1, sess)
+	s.auditRecord(c, xsapiv1.AuditActionSdkRemove, id, "Remove SDK "+id, err)
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
 	}
 	c.JSON(http.StatusOK, delEntry)
 }
+
+// sdkOwner returns false (and replies an error) when client is not allowed
+// to manage a SDK installed by another session (see sessionOwns)
+func (s *APIService) sdkOwner(c *gin.Context, id string) bool {
+	sdk := s.sdks.Get(id)
+	if sdk == nil {
+		// let handler report the error
+		return true
+	}
+	sid := ""
+	if sess := s.sessions.Get(c); sess != nil {
+		sid = sess.ID
+	}
+	if !s.sessionOwns(sid, sdk.Owner, sdk.OwnerUser) {
+		common.APIError(c, "Permission denied (SDK installed by another session)")
+		return false
+	}
+	return true
+}
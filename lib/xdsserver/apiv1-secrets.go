@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getSecrets returns definition of all secrets (values are never returned)
+func (s *APIService) getSecrets(c *gin.Context) {
+	c.JSON(http.StatusOK, s.secrets.GetAll())
+}
+
+// getSecret returns definition of a secret
+func (s *APIService) getSecret(c *gin.Context) {
+	sec, err := s.secrets.GetInfo(c.Param("name"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sec)
+}
+
+// setSecret creates or updates a secret of encrypted store
+func (s *APIService) setSecret(c *gin.Context) {
+	var args xsapiv1.SecretSetArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	user := ""
+	if sess := s.sessions.Get(c); sess != nil {
+		if user = s.sessionAuthUser(sess.ID); user == "" {
+			user = sess.User
+		}
+	}
+	sec, err := s.secrets.Set(c.Param("name"), args, user)
+	s.auditRecord(c, xsapiv1.AuditActionSecretSet, c.Param("name"), "Set secret "+c.Param("name"), err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sec)
+}
+
+// delSecret removes a secret of encrypted store
+func (s *APIService) delSecret(c *gin.Context) {
+	sec, err := s.secrets.Delete(c.Param("name"))
+	s.auditRecord(c, xsapiv1.AuditActionSecretDelete, c.Param("name"), "Remove secret "+c.Param("name"), err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sec)
+}
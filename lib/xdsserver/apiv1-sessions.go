@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getSession returns lifetime of client session
+func (s *APIService) getSession(c *gin.Context) {
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	info, err := s.sessions.Info(sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// setSession sets max age and idle timeout of client session
+func (s *APIService) setSession(c *gin.Context) {
+	var args xsapiv1.SessionSetArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+	if err := s.sessions.SetLifetime(sess.ID, args.MaxAge, args.IdleTimeout); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	info, err := s.sessions.Info(sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// getSessions returns details of active sessions (admin only)
+func (s *APIService) getSessions(c *gin.Context) {
+	res := s.sessions.GetAll()
+	folders := s.mfolders.GetConfigArr()
+	running := s.execHistory.Running()
+	for i := range res {
+		r := &res[i].Resources
+		sid := res[i].ID
+		r.Folders = []string{}
+		for _, fc := range folders {
+			if fc.Owner == sid {
+				r.Folders = append(r.Folders, fc.ID)
+			}
+		}
+		r.UnlockedFolders = s.folderCrypt.SessionFolders(sid)
+		r.RunningCmds = []string{}
+		for _, e := range running {
+			if e.SessionID == sid {
+				r.RunningCmds = append(r.RunningCmds, e.CmdID)
+			}
+		}
+		r.DebugSessions = []string{}
+		for _, ds := range s.debugs.GetAll(sid) {
+			r.DebugSessions = append(r.DebugSessions, ds.ID)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// delSession forces logout of a session and releases its locks (admin only)
+func (s *APIService) delSession(c *gin.Context) {
+	sid := c.Param("id")
+	err := s.sessions.Close(sid)
+	s.auditRecord(c, xsapiv1.AuditActionSessionClose, sid, "Close session "+sid, err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
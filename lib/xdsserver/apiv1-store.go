@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+)
+
+// getStoreStats returns usage statistics of logs and artifacts store
+func (s *APIService) getStoreStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.store.Stats())
+}
+
+// serveStoreBlob sends a stored content as a file download
+// (compressed content is sent as-is when client supports gzip encoding)
+func (s *APIService) serveStoreBlob(c *gin.Context, digest, filename string) {
+	blob := s.store.Get(digest)
+	if blob == nil {
+		common.APIError(c, "unknown content")
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	c.Header("ETag", "\""+digest+"\"")
+	if c.Request.Header.Get("If-None-Match") == "\""+digest+"\"" {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	var rd io.ReadCloser
+	var err error
+	if strings.Contains(c.Request.Header.Get("Accept-Encoding"), "gzip") {
+		rd, err = s.store.OpenRaw(digest)
+		c.Header("Content-Encoding", "gzip")
+		c.Header("Content-Length", strconv.FormatInt(blob.StoredSize, 10))
+	} else {
+		rd, err = s.store.Open(digest)
+		c.Header("Content-Length", strconv.FormatInt(blob.Size, 10))
+	}
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	defer rd.Close()
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, rd); err != nil {
+		s.Log.Errorf("Error while sending content %s: %v", digest, err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getAPITokens returns API tokens (without secrets), only admins get tokens
+// of other users
+func (s *APIService) getAPITokens(c *gin.Context) {
+	res := []xsapiv1.APIToken{}
+	for _, tok := range s.apiTokens.GetAll() {
+		if s.tokenAccess(c, tok.User) {
+			res = append(res, tok)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// createAPIToken creates an API token (secret only returned in this reply)
+func (s *APIService) createAPIToken(c *gin.Context) {
+	var args xsapiv1.APITokenCreateArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	if sess := s.sessions.Get(c); sess != nil && args.User == "" {
+		args.User = sess.User
+	}
+	if !s.tokenAccess(c, args.User) {
+		common.APIError(c, "Permission denied (cannot create token of another user)")
+		return
+	}
+
+	tok, err := s.apiTokens.Create(args)
+	if err != nil {
+		s.auditRecord(c, xsapiv1.AuditActionTokenCreate, "", "Create API token "+args.Name, err)
+		common.APIError(c, err.Error())
+		return
+	}
+	s.auditRecord(c, xsapiv1.AuditActionTokenCreate, tok.ID, "Create API token "+args.Name, nil)
+	c.JSON(http.StatusOK, tok)
+}
+
+// revokeAPIToken deletes an API token
+func (s *APIService) revokeAPIToken(c *gin.Context) {
+	for _, tok := range s.apiTokens.GetAll() {
+		if (tok.ID == c.Param("id") || tok.Name == c.Param("id")) && !s.tokenAccess(c, tok.User) {
+			common.APIError(c, "Permission denied (token of another user)")
+			return
+		}
+	}
+	tok, err := s.apiTokens.Revoke(c.Param("id"))
+	s.auditRecord(c, xsapiv1.AuditActionTokenRevoke, c.Param("id"), "Revoke API token", err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	// Session bound to token must not be used anymore
+	if err := s.sessions.CloseBound(apiTokenSubject + tok.ID); err != nil {
+		s.Log.Warningf("Cannot close session of API token %s: %v", tok.ID, err)
+	}
+	c.JSON(http.StatusOK, tok)
+}
+
+// tokenAccess returns true when client can manage tokens of a user
+func (s *APIService) tokenAccess(c *gin.Context, user string) bool {
+	if !s.roles.Enabled() || s.hasRole(c, xsapiv1.RoleAdmin) {
+		return true
+	}
+	return user != "" && user == s.roleUser(s.sessions.Get(c))
+}
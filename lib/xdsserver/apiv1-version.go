@@ -31,6 +31,7 @@ func (s *APIService) getVersion(c *gin.Context) {
 		Version:       s.Config.Version,
 		APIVersion:    s.Config.APIVersion,
 		VersionGitTag: s.Config.VersionGitTag,
+		EventVersions: xsapiv1.EventVersionsSupported,
 	}
 
 	c.JSON(http.StatusOK, response)
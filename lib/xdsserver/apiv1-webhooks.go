@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getWebhooks returns registered webhooks and their deliveries status
+func (s *APIService) getWebhooks(c *gin.Context) {
+	c.JSON(http.StatusOK, s.webhooks.GetAll())
+}
+
+// setWebhook registers or replaces a webhook
+func (s *APIService) setWebhook(c *gin.Context) {
+	var hook xsapiv1.Webhook
+	if c.BindJSON(&hook) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	hook.Name = c.Param("name")
+
+	res, err := s.webhooks.Set(hook)
+	s.auditRecord(c, xsapiv1.AuditActionWebhookSet, hook.Name, "Set webhook "+hook.Name+" ("+hook.URL+")", err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// delWebhook removes a webhook
+func (s *APIService) delWebhook(c *gin.Context) {
+	err := s.webhooks.Delete(c.Param("name"))
+	s.auditRecord(c, xsapiv1.AuditActionWebhookDelete, c.Param("name"), "Remove webhook "+c.Param("name"), err)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
+
+// getWebhookDeliveries returns last deliveries of a webhook
+func (s *APIService) getWebhookDeliveries(c *gin.Context) {
+	res, err := s.webhooks.Deliveries(c.Param("name"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -19,6 +19,7 @@ package xdsserver
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
 // APIService .
@@ -34,34 +35,181 @@ func NewAPIV1(ctx *Context) *APIService {
 		apiRouter: ctx.WWWServer.router.Group("/api/v1"),
 	}
 
+	// Rate limiting, authentication (agents certificates, OpenID Connect
+	// login) and roles enforcement
+	admin := s.roleRequired(xsapiv1.RoleAdmin)
+	s.apiRouter.Use(s.rateLimitMiddleware())
+	s.apiRouter.Use(s.agentsMiddleware())
+	s.apiRouter.Use(s.authMiddleware())
+	s.apiRouter.Use(s.rolesMiddleware())
+	s.apiRouter.GET("/auth/user", s.getAuthUser)
+	s.apiRouter.GET("/auth/login", s.authLogin)
+	s.apiRouter.GET("/auth/callback", s.authCallback)
+	s.apiRouter.POST("/auth/ldap/login", s.authLDAPLogin)
+	s.apiRouter.POST("/auth/logout", s.authLogout)
+
 	s.apiRouter.GET("/version", s.getVersion)
 
 	s.apiRouter.GET("/config", s.getConfig)
-	s.apiRouter.POST("/config", s.setConfig)
+	s.apiRouter.POST("/config", admin, s.setConfig)
+	s.apiRouter.GET("/config/sync", s.getSyncConfig)
+	s.apiRouter.PUT("/config/sync", admin, s.setSyncConfig)
+
+	// Access to folders shared between clients
+	fRead := s.folderAccess(xsapiv1.FolderAccessRead)
+	fWrite := s.folderAccess(xsapiv1.FolderAccessReadWrite)
+	fOwner := s.folderAccess(xsapiv1.FolderAccessOwner)
 
 	s.apiRouter.GET("/folders", s.getFolders)
-	s.apiRouter.GET("/folders/:id", s.getFolder)
-	s.apiRouter.PUT("/folders/:id", s.updateFolder)
+	s.apiRouter.GET("/folders/:id", fRead, s.getFolder)
+	s.apiRouter.PUT("/folders/:id", fWrite, s.updateFolder)
 	s.apiRouter.POST("/folders", s.addFolder)
-	s.apiRouter.POST("/folders/sync/:id", s.syncFolder)
-	s.apiRouter.DELETE("/folders/:id", s.delFolder)
+	s.apiRouter.POST("/folders/:id/:action", fWrite, s.postFolderAction) // /folders/sync/:id, /folders/:id/{conflicts,versions,rescan,pause,resume,snapshots,restore,devices,unlock,lock}
+	s.apiRouter.DELETE("/folders/:id", fOwner, s.delFolder)
+	s.apiRouter.GET("/folders/:id/ignores", fRead, s.getFolderIgnores)
+	s.apiRouter.PUT("/folders/:id/ignores", fWrite, s.setFolderIgnores)
+	s.apiRouter.GET("/folders/:id/conflicts", fRead, s.getFolderConflicts)
+	s.apiRouter.GET("/folders/:id/versions", fRead, s.getFileVersions)
+	s.apiRouter.GET("/folders/:id/stats", fRead, s.getFolderStats)
+	s.apiRouter.GET("/folders/:id/build-stats", fRead, s.getFolderBuildStats)
+	s.apiRouter.GET("/folders/:id/snapshots", fRead, s.getFolderSnapshots)
+	s.apiRouter.GET("/folders/:id/archive", fRead, s.getFolderArchive)
+	s.apiRouter.GET("/folders/:id/fs", fRead, s.getFolderFS)
+	s.apiRouter.PUT("/folders/:id/fs", fWrite, s.putFolderFS)
+	s.apiRouter.DELETE("/folders/:id/snapshots/:name", fWrite, s.delFolderSnapshot)
+	s.apiRouter.PUT("/folders/:id/shares", fOwner, s.setFolderShares)
+	s.apiRouter.DELETE("/folders/:id/devices/:devid", fWrite, s.delFolderDevice)
+
+	s.apiRouter.GET("/templates", s.getTemplates)
 
 	s.apiRouter.GET("/sdks", s.getSdks)
 	s.apiRouter.GET("/sdks/:id", s.getSdk)
-	s.apiRouter.POST("/sdks", s.installSdk)
-	s.apiRouter.POST("/sdks/abortinstall", s.abortInstallSdk)
-	s.apiRouter.DELETE("/sdks/:id", s.removeSdk)
+	s.apiRouter.POST("/sdks", admin, s.installSdk)
+	s.apiRouter.POST("/sdks/:id", admin, s.postSdkAction)           // /sdks/abortinstall
+	s.apiRouter.POST("/sdks/:id/:action", admin, s.postSdkIDAction) // /sdks/:id/verify, /sdks/families/reload
+	s.apiRouter.DELETE("/sdks/:id", admin, s.removeSdk)
 
 	s.apiRouter.POST("/make", s.buildMake)
 	s.apiRouter.POST("/make/:id", s.buildMake)
 
+	s.apiRouter.GET("/builds", s.getBuilds)
+	s.apiRouter.GET("/builds/:id", s.getBuild)
+	s.apiRouter.POST("/builds", s.startBuild)
+
+	s.apiRouter.GET("/matrix", s.getMatrices)
+	s.apiRouter.GET("/matrix/:id", s.getMatrix)
+	s.apiRouter.POST("/matrix", s.startMatrix)
+
+	s.apiRouter.GET("/targets", s.getDeployTargets)
+	s.apiRouter.PUT("/targets/:name", admin, s.setDeployTarget)
+	s.apiRouter.DELETE("/targets/:name", admin, s.delDeployTarget)
+
+	s.apiRouter.GET("/deploy", s.getDeploys)
+	s.apiRouter.GET("/deploy/:id", s.getDeploy)
+	s.apiRouter.POST("/deploy", s.startDeploy)
+
+	s.apiRouter.GET("/schedules", s.getSchedules)
+	s.apiRouter.GET("/schedules/:id", s.getSchedule)
+	s.apiRouter.POST("/schedules", s.addSchedule)
+	s.apiRouter.PUT("/schedules/:id", s.updateSchedule)
+	s.apiRouter.DELETE("/schedules/:id", s.delSchedule)
+	s.apiRouter.POST("/schedules/:id/run", s.runSchedule)
+
+	s.apiRouter.GET("/nodes", s.getNodes)
+	s.apiRouter.POST("/nodes", s.registerNode)
+	s.apiRouter.DELETE("/nodes/:name", admin, s.delNode)
+	s.apiRouter.POST("/executor/exec", s.executorExec)
+	s.apiRouter.POST("/executor/signal", s.executorSignal)
+
+	s.apiRouter.GET("/exec", s.getExecRunning)
 	s.apiRouter.POST("/exec", s.execCmd)
 	s.apiRouter.POST("/exec/:id", s.execCmd)
+	s.apiRouter.POST("/exec/:id/:name", s.postExecAction) // /exec/preset/:name
 	s.apiRouter.POST("/signal", s.execSignalCmd)
+	s.apiRouter.POST("/cancel", s.execCancelCmd)
+	s.apiRouter.POST("/renice", s.execReniceCmd)
+	s.apiRouter.POST("/input", s.execInputCmd)
+	s.apiRouter.POST("/resize", s.execResizeCmd)
+	s.apiRouter.GET("/exec/:id", s.getExec) // /exec/history or /exec/:cmdID
+	s.apiRouter.GET("/exec/:id/artifacts", s.getExecArtifacts)
+	s.apiRouter.GET("/exec/:id/output", s.getExecOutput)
+	s.apiRouter.GET("/exec/:id/log", s.getExecLog)
+
+	s.apiRouter.GET("/debug", s.getDebugSessions)
+	s.apiRouter.GET("/debug/:id", s.getDebugSession)
+	s.apiRouter.GET("/debug/:id/output", s.getDebugOutput)
+	s.apiRouter.POST("/debug", s.startDebugSession)
+	s.apiRouter.POST("/debug/:id/mi", s.debugMICmd)
+	s.apiRouter.DELETE("/debug/:id", s.delDebugSession)
+
+	s.apiRouter.GET("/ccache", s.getCcaches)
+	s.apiRouter.GET("/ccache/:scope/:id", s.getCcache)
+	s.apiRouter.PUT("/ccache/:scope/:id", s.setCcache)
+	s.apiRouter.DELETE("/ccache/:scope/:id", s.clearCcache)
+
+	s.apiRouter.GET("/presets", s.getExecPresets)
+	s.apiRouter.PUT("/presets/:name", s.setExecPreset)
+	s.apiRouter.DELETE("/presets/:name", s.delExecPreset)
 
 	s.apiRouter.GET("/events", s.eventsList)
+	s.apiRouter.GET("/events/history", s.eventsHistory)
+	s.apiRouter.GET("/events/stream", s.eventsStream)
 	s.apiRouter.POST("/events/register", s.eventsRegister)
 	s.apiRouter.POST("/events/unregister", s.eventsUnRegister)
 
+	s.apiRouter.GET("/admin/pending", s.getPendingOps)
+	s.apiRouter.POST("/admin/pending/:id/confirm", s.confirmPendingOp)
+	s.apiRouter.POST("/admin/pending/:id/approve", admin, s.approvePendingOp)
+	s.apiRouter.DELETE("/admin/pending/:id", s.cancelPendingOp)
+
+	s.apiRouter.GET("/admin/demo", s.getDemo)
+	s.apiRouter.POST("/admin/demo/seed", admin, s.seedDemo)
+
+	s.apiRouter.GET("/admin/inotify", admin, s.getInotifyStatus)
+	s.apiRouter.POST("/admin/inotify/check", admin, s.checkInotifyStatus)
+
+	s.apiRouter.GET("/admin/store", admin, s.getStoreStats)
+
+	s.apiRouter.GET("/admin/syncthing/apikey", admin, s.getSyncAPIKey)
+	s.apiRouter.POST("/admin/syncthing/apikey/rotate", admin, s.rotateSyncAPIKey)
+
+	s.apiRouter.GET("/admin/audit", admin, s.getAudit)
+
+	s.apiRouter.GET("/admin/secrets", admin, s.getSecrets)
+	s.apiRouter.GET("/admin/secrets/:name", admin, s.getSecret)
+	s.apiRouter.PUT("/admin/secrets/:name", admin, s.setSecret)
+	s.apiRouter.DELETE("/admin/secrets/:name", admin, s.delSecret)
+
+	s.apiRouter.GET("/admin/mqtt", admin, s.getMQTTStatus)
+
+	s.apiRouter.GET("/admin/webhooks", admin, s.getWebhooks)
+	s.apiRouter.PUT("/admin/webhooks/:name", admin, s.setWebhook)
+	s.apiRouter.DELETE("/admin/webhooks/:name", admin, s.delWebhook)
+	s.apiRouter.GET("/admin/webhooks/:name/deliveries", admin, s.getWebhookDeliveries)
+
+	s.apiRouter.GET("/admin/roles", admin, s.getRoles)
+	s.apiRouter.PUT("/admin/roles/:user", admin, s.setRole)
+	s.apiRouter.DELETE("/admin/roles/:user", admin, s.delRole)
+
+	s.apiRouter.GET("/tokens", s.getAPITokens)
+	s.apiRouter.POST("/tokens", s.createAPIToken)
+	s.apiRouter.DELETE("/tokens/:id", s.revokeAPIToken)
+
+	s.apiRouter.GET("/sessions", admin, s.getSessions)
+	s.apiRouter.GET("/sessions/current", s.getSession)
+	s.apiRouter.PUT("/sessions/current", s.setSession)
+	s.apiRouter.DELETE("/sessions/:id", admin, s.delSession)
+
+	s.apiRouter.GET("/agents", admin, s.getAgents)
+	s.apiRouter.POST("/agents/pairing", admin, s.createAgentPairing)
+	s.apiRouter.POST("/agents/pair", s.pairAgent)
+	s.apiRouter.DELETE("/agents/:id", admin, s.revokeAgent)
+
+	s.apiRouter.GET("/admin/queue", admin, s.getExecQueue)
+	s.apiRouter.PUT("/admin/queue/:id", admin, s.moveExecQueueJob)
+
+	// Fault injection routes (only registered when built with chaos tag)
+	s.chaosRoutes()
+
 	return s
 }
@@ -0,0 +1,304 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const approvalMonitorTime = 10    // Time (in seconds) to schedule cleanup of expired operations
+const approvalDefaultDelay = 30   // Default delay (in seconds) before confirmation is accepted
+const approvalDefaultExpire = 600 // Default lifetime (in seconds) of a pending operation
+
+// PendingOpFunc Function executed once a pending operation is confirmed or approved
+type PendingOpFunc func() (interface{}, error)
+
+// pendingOp Hold a pending operation
+type pendingOp struct {
+	op           xsapiv1.PendingOperation
+	user         string // authenticated user of requester (see sessionOwns)
+	token        string
+	confirmAfter time.Time
+	expireAt     time.Time
+	run          PendingOpFunc
+}
+
+// Approvals Hold dangerous operations waiting for confirmation or approval
+type Approvals struct {
+	*Context
+	operations map[string]bool
+	mode       string
+	delay      time.Duration
+	expire     time.Duration
+	pending    map[string]*pendingOp
+	mutex      sync.Mutex
+	stop       chan struct{} // signals intentional stop
+}
+
+// NewApprovals creates a new instance of Approvals
+func NewApprovals(ctx *Context) *Approvals {
+	a := Approvals{
+		Context:    ctx,
+		operations: make(map[string]bool),
+		mode:       xsapiv1.ApprovalModeDelay,
+		delay:      approvalDefaultDelay * time.Second,
+		expire:     approvalDefaultExpire * time.Second,
+		pending:    make(map[string]*pendingOp),
+		mutex:      sync.NewMutex(),
+		stop:       make(chan struct{}),
+	}
+
+	if cfg := ctx.Config.FileConf.ApprovalConf; cfg != nil {
+		for _, op := range cfg.Operations {
+			a.operations[op] = true
+		}
+		if cfg.Mode == xsapiv1.ApprovalModeApproval {
+			a.mode = cfg.Mode
+		} else if cfg.Mode != "" && cfg.Mode != xsapiv1.ApprovalModeDelay {
+			a.Log.Warningf("Invalid approval mode '%s', use '%s'", cfg.Mode, a.mode)
+		}
+		if cfg.DelayS > 0 {
+			a.delay = time.Duration(cfg.DelayS) * time.Second
+		}
+		if cfg.ExpireS > 0 {
+			a.expire = time.Duration(cfg.ExpireS) * time.Second
+		}
+		a.Log.Infof("Operations requiring approval (mode %s): %v", a.mode, cfg.Operations)
+	}
+
+	// Start monitoring of pending operations (use to manage expiration)
+	go a.monitorPending()
+
+	return &a
+}
+
+// Stop approvals management
+func (a *Approvals) Stop() {
+	close(a.stop)
+}
+
+// IsRequired returns true when an operation must be confirmed or approved
+func (a *Approvals) IsRequired(opName string) bool {
+	return a.operations[opName]
+}
+
+// Add registers a new pending operation and returns its definition
+// (including the confirmation token that is only returned once)
+func (a *Approvals) Add(opName, targetID, desc, sid string, run PendingOpFunc) (*xsapiv1.PendingOperation, error) {
+	token, err := a.newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := pendingOp{
+		op: xsapiv1.PendingOperation{
+			ID:          uuid.NewV1().String(),
+			Operation:   opName,
+			TargetID:    targetID,
+			Description: desc,
+			Mode:        a.mode,
+			Status:      xsapiv1.PendingOpStatusWaiting,
+			RequestedBy: sid,
+			CreatedAt:   now.Format(time.RFC3339),
+		},
+		user:     a.sessionAuthUser(sid),
+		token:    token,
+		expireAt: now.Add(a.expire),
+		run:      run,
+	}
+	if a.mode == xsapiv1.ApprovalModeDelay {
+		p.confirmAfter = now.Add(a.delay)
+		p.op.ConfirmAfter = p.confirmAfter.Format(time.RFC3339)
+	}
+	p.op.ExpireAt = p.expireAt.Format(time.RFC3339)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Only one pending operation per target
+	for _, pp := range a.pending {
+		if pp.op.Operation == opName && pp.op.TargetID == targetID {
+			return nil, fmt.Errorf("operation %s already pending for %s (id %s)", opName, targetID, pp.op.ID)
+		}
+	}
+	a.pending[p.op.ID] = &p
+
+	a.Log.Infof("New pending operation %s: %s (%s)", p.op.ID, desc, opName)
+
+	res := p.op
+	res.Token = token
+	return &res, nil
+}
+
+// GetAll returns pending operations of a session (see sessionOwns), when
+// session can approve operations, those of other sessions waiting for an
+// approval are also returned (without sessions IDs)
+func (a *Approvals) GetAll(sid string, approver bool) []xsapiv1.PendingOperation {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	res := []xsapiv1.PendingOperation{}
+	for _, p := range a.pending {
+		if a.sessionOwns(sid, p.op.RequestedBy, p.user) {
+			res = append(res, p.op)
+		} else if approver && p.op.Mode == xsapiv1.ApprovalModeApproval {
+			op := p.op
+			op.RequestedBy = ""
+			op.ApprovedBy = ""
+			res = append(res, op)
+		}
+	}
+	return res
+}
+
+// Confirm executes a pending operation (delay mode) using the token returned on creation
+func (a *Approvals) Confirm(id, token, sid string) (*xsapiv1.PendingOpResult, error) {
+	p, err := a.take(id, func(p *pendingOp) error {
+		if p.op.Mode != xsapiv1.ApprovalModeDelay {
+			return fmt.Errorf("operation must be approved by another user")
+		}
+		if token == "" || token != p.token {
+			return fmt.Errorf("invalid token")
+		}
+		if time.Now().Before(p.confirmAfter) {
+			return fmt.Errorf("operation cannot be confirmed before %v", p.op.ConfirmAfter)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.op.ApprovedBy = sid
+	return a.execute(p), nil
+}
+
+// Approve executes a pending operation (approval mode), approver must be an
+// authenticated user that differs from requester
+func (a *Approvals) Approve(id, sid string) (*xsapiv1.PendingOpResult, error) {
+	p, err := a.take(id, func(p *pendingOp) error {
+		if p.op.Mode != xsapiv1.ApprovalModeApproval {
+			return fmt.Errorf("operation must be confirmed using token")
+		}
+		// Approver role is checked by API (see roleRequired)
+		user := a.sessionAuthUser(sid)
+		if user == "" {
+			return fmt.Errorf("operation can only be approved by an authenticated user")
+		}
+		if sid == p.op.RequestedBy || user == p.user {
+			return fmt.Errorf("operation cannot be approved by the requester")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.op.ApprovedBy = sid
+	return a.execute(p), nil
+}
+
+// Cancel cancels a pending operation (only requester session and admins
+// can cancel an operation, see sessionOwns)
+func (a *Approvals) Cancel(id, sid string) (*xsapiv1.PendingOperation, error) {
+	p, err := a.take(id, func(p *pendingOp) error {
+		if !a.sessionOwns(sid, p.op.RequestedBy, p.user) {
+			return fmt.Errorf("permission denied (operation of another session)")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.op.Status = xsapiv1.PendingOpStatusCancelled
+	a.Log.Infof("Pending operation %s cancelled", id)
+	return &p.op, nil
+}
+
+/*** Private functions ***/
+
+// take removes a pending operation from list when check function succeed
+func (a *Approvals) take(id string, check func(p *pendingOp) error) (*pendingOp, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	p, exist := a.pending[id]
+	if !exist {
+		return nil, fmt.Errorf("unknown id")
+	}
+	// Expired operations may not have been purged yet (see monitor)
+	if time.Now().After(p.expireAt) {
+		delete(a.pending, id)
+		return nil, fmt.Errorf("operation expired")
+	}
+	if check != nil {
+		if err := check(p); err != nil {
+			return nil, err
+		}
+	}
+	delete(a.pending, id)
+	return p, nil
+}
+
+// execute runs the operation
+func (a *Approvals) execute(p *pendingOp) *xsapiv1.PendingOpResult {
+	a.Log.Infof("Execute pending operation %s: %s", p.op.ID, p.op.Description)
+
+	res, err := p.run()
+	if err != nil {
+		p.op.Status = xsapiv1.PendingOpStatusFailed
+		p.op.Error = err.Error()
+	} else {
+		p.op.Status = xsapiv1.PendingOpStatusDone
+	}
+	return &xsapiv1.PendingOpResult{Operation: p.op, Result: res}
+}
+
+// newToken generates a random confirmation token
+func (a *Approvals) newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Cannot generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (a *Approvals) monitorPending() {
+	for {
+		select {
+		case <-a.stop:
+			a.Log.Debugln("Stop monitorPending")
+			return
+		case <-time.After(approvalMonitorTime * time.Second):
+			a.mutex.Lock()
+			for id, p := range a.pending {
+				if p.expireAt.Sub(time.Now()) < 0 {
+					a.Log.Infof("Pending operation %s expired: %s", id, p.op.Description)
+					delete(a.pending, id)
+				}
+			}
+			a.mutex.Unlock()
+		}
+	}
+}
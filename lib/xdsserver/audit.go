@@ -0,0 +1,258 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const auditDefaultSyslogTag = "xds-server"
+
+// Audit Append-only trail of operations requested by clients
+// Entries are never rewritten, file is only opened in append mode.
+type Audit struct {
+	*Context
+	disabled bool
+	file     string
+	seq      int64
+	lastHash string
+	syslog   io.WriteCloser
+	mutex    sync.Mutex
+}
+
+// AuditFilter Criteria used to select audit entries (empty fields match all)
+type AuditFilter struct {
+	Action    string
+	Target    string
+	SessionID string
+	User      string
+	From      time.Time
+	To        time.Time
+}
+
+// NewAudit creates a new instance of Audit
+func NewAudit(ctx *Context) (*Audit, error) {
+	a := Audit{
+		Context: ctx,
+		mutex:   sync.NewMutex(),
+	}
+	cfg := ctx.Config.FileConf.AuditConf
+	if cfg != nil && cfg.Disabled {
+		a.disabled = true
+		return &a, nil
+	}
+
+	var err error
+	if a.file, err = xdsconfig.AuditFilenameGet(); err != nil {
+		return &a, err
+	}
+	if err := a.load(); err != nil {
+		return &a, err
+	}
+
+	if cfg != nil && cfg.Syslog {
+		tag := cfg.SyslogTag
+		if tag == "" {
+			tag = auditDefaultSyslogTag
+		}
+		a.syslog, err = auditSyslogDial(cfg.SyslogNetwork, cfg.SyslogAddr, tag)
+		if err != nil {
+			return &a, fmt.Errorf("Cannot connect to syslog: %v", err)
+		}
+	}
+
+	a.Log.Infof("Audit trail: %s (%d entries)", a.file, a.seq)
+	return &a, nil
+}
+
+// Stop closes syslog connection
+func (a *Audit) Stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.syslog != nil {
+		a.syslog.Close()
+		a.syslog = nil
+	}
+	a.disabled = true
+}
+
+// Add appends an entry to audit trail (sequence, date and hashes are set)
+func (a *Audit) Add(entry xsapiv1.AuditEntry) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.disabled {
+		return
+	}
+
+	entry.Seq = a.seq + 1
+	entry.Date = time.Now().Format(time.RFC3339)
+	entry.PrevHash = a.lastHash
+	entry.Hash = auditHash(entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		a.Log.Errorf("Cannot encode audit entry: %v", err)
+		return
+	}
+
+	if err := a.write(line); err != nil {
+		a.Log.Errorf("Cannot write audit entry %s %s: %v", entry.Action, entry.Target, err)
+		return
+	}
+	a.seq = entry.Seq
+	a.lastHash = entry.Hash
+
+	if a.syslog != nil {
+		if _, err := a.syslog.Write(line); err != nil {
+			a.Log.Warningf("Cannot forward audit entry to syslog: %v", err)
+		}
+	}
+}
+
+// Query returns a page of audit entries (most recent first) matching filter
+func (a *Audit) Query(filter AuditFilter, offset, limit int) (*xsapiv1.AuditLog, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.disabled {
+		return nil, fmt.Errorf("audit trail disabled")
+	}
+
+	matching := []xsapiv1.AuditEntry{}
+	err := a.read(func(e xsapiv1.AuditEntry) {
+		if filter.match(e) {
+			matching = append(matching, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := xsapiv1.AuditLog{
+		Total:   len(matching),
+		Offset:  offset,
+		Limit:   limit,
+		Entries: []xsapiv1.AuditEntry{},
+	}
+	for i := len(matching) - 1 - offset; i >= 0 && len(res.Entries) < limit; i-- {
+		res.Entries = append(res.Entries, matching[i])
+	}
+	return &res, nil
+}
+
+/*** Private functions ***/
+
+// match returns true when entry is accepted by filter
+func (f AuditFilter) match(e xsapiv1.AuditEntry) bool {
+	if (f.Action != "" && e.Action != f.Action) ||
+		(f.Target != "" && e.Target != f.Target) ||
+		(f.SessionID != "" && e.SessionID != f.SessionID) ||
+		(f.User != "" && e.User != f.User) {
+		return false
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		date, err := time.Parse(time.RFC3339, e.Date)
+		if err != nil || (!f.From.IsZero() && date.Before(f.From)) || (!f.To.IsZero() && date.After(f.To)) {
+			return false
+		}
+	}
+	return true
+}
+
+// auditHash returns the hash of an entry (computed without its Hash field)
+func auditHash(e xsapiv1.AuditEntry) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// load checks entries chain and retrieves last sequence and hash
+func (a *Audit) load() error {
+	if !common.Exists(a.file) {
+		return nil
+	}
+	broken := 0
+	err := a.read(func(e xsapiv1.AuditEntry) {
+		if e.PrevHash != a.lastHash || e.Hash != auditHash(e) {
+			broken++
+		}
+		a.seq = e.Seq
+		a.lastHash = e.Hash
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot read audit trail: %v", err)
+	}
+	if broken > 0 {
+		a.Log.Errorf("Audit trail %s has been modified: %d invalid entries", a.file, broken)
+	}
+	return nil
+}
+
+// read calls fn for each entry of audit file (oldest first)
+func (a *Audit) read(fn func(e xsapiv1.AuditEntry)) error {
+	fd, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scan := bufio.NewScanner(fd)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		e := xsapiv1.AuditEntry{}
+		if err := json.Unmarshal(scan.Bytes(), &e); err != nil {
+			return fmt.Errorf("invalid entry after seq %d: %v", a.seq, err)
+		}
+		fn(e)
+	}
+	return scan.Err()
+}
+
+// write appends a line to audit file (mutex must be locked)
+func (a *Audit) write(line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(a.file), 0755); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(a.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(append(line, '\n')); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
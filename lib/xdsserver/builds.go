@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const buildsMaxHistory = 20 // Number of finished builds kept in memory
+
+// Builds Orchestrates builds of folders and of their dependencies
+type Builds struct {
+	*Context
+	builds []*xsapiv1.Build // oldest first
+	mutex  sync.Mutex
+}
+
+// NewBuilds creates a new instance of Builds
+func NewBuilds(ctx *Context) *Builds {
+	return &Builds{
+		Context: ctx,
+		builds:  []*xsapiv1.Build{},
+		mutex:   sync.NewMutex(),
+	}
+}
+
+// Start starts the build of a folder, its dependencies are built first in
+// dependency order and staging directories are passed using env variables
+func (b *Builds) Start(args xsapiv1.BuildArgs, sid string) (*xsapiv1.Build, error) {
+	if args.TimeoutS < 0 {
+		return nil, fmt.Errorf("invalid timeout")
+	}
+	order, err := b.mfolders.BuildOrder(args.FolderID)
+	if err != nil {
+		return nil, err
+	}
+
+	build := xsapiv1.Build{
+		ID:        uuid.NewV1().String(),
+		FolderID:  args.FolderID,
+		Status:    xsapiv1.BuildStatusRunning,
+		Steps:     []xsapiv1.BuildStep{},
+		StartedBy: sid,
+		StartedAt: time.Now().String(),
+	}
+	for i, fc := range order {
+		if !b.mfolders.HasAccess(fc.ID, sid, xsapiv1.FolderAccessReadWrite) {
+			return nil, fmt.Errorf("permission denied on folder %s", fc.ID)
+		}
+		if fc.Dependencies == nil || fc.Dependencies.BuildCmd == "" {
+			return nil, fmt.Errorf("build command of folder %s not set", fc.ID)
+		}
+		build.Steps = append(build.Steps, xsapiv1.BuildStep{
+			FolderID: fc.ID,
+			Label:    fc.Label,
+			CmdID:    "build_" + build.ID[:8] + "_" + strconv.Itoa(i),
+			Cmd:      fc.Dependencies.BuildCmd,
+			Status:   xsapiv1.BuildStatusPending,
+		})
+	}
+
+	b.mutex.Lock()
+	for _, bb := range b.builds {
+		if bb.FolderID == args.FolderID && bb.Status == xsapiv1.BuildStatusRunning {
+			b.mutex.Unlock()
+			return nil, fmt.Errorf("build of folder already running (id %s)", bb.ID)
+		}
+	}
+	b.builds = append(b.builds, &build)
+	b.cleanupUnsafe()
+	res := copyBuild(&build)
+	b.mutex.Unlock()
+
+	b.Log.Infof("Start build %s of folder %s (%d steps)", build.ID, build.FolderID, len(order))
+	go b.run(&build, order, args, sid)
+
+	return res, nil
+}
+
+// Get returns a build
+func (b *Builds) Get(id string) (*xsapiv1.Build, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, bb := range b.builds {
+		if bb.ID == id {
+			return copyBuild(bb), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown id")
+}
+
+// GetAll returns running and last finished builds
+func (b *Builds) GetAll() []xsapiv1.Build {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	res := []xsapiv1.Build{}
+	for _, bb := range b.builds {
+		res = append(res, *copyBuild(bb))
+	}
+	return res
+}
+
+/*** Private functions ***/
+
+// run executes build steps, steps following a failed one are skipped
+func (b *Builds) run(build *xsapiv1.Build, order []xsapiv1.FolderConfig, args xsapiv1.BuildArgs, sid string) {
+	failed := false
+	for i, fc := range order {
+		if failed {
+			b.setStep(build, i, xsapiv1.BuildStatusSkipped, 0, nil)
+			continue
+		}
+		code, err := b.runStep(build, i, fc, args, sid)
+		status := xsapiv1.BuildStatusDone
+		if err != nil {
+			b.Log.Infof("Build %s of folder %s failed: %v", build.ID, fc.ID, err)
+			status = xsapiv1.BuildStatusFailed
+			failed = true
+		}
+		b.setStep(build, i, status, code, err)
+	}
+
+	status := xsapiv1.BuildStatusDone
+	if failed {
+		status = xsapiv1.BuildStatusFailed
+	}
+	b.mutex.Lock()
+	build.Status = status
+	build.EndedAt = time.Now().String()
+	b.mutex.Unlock()
+
+	b.Log.Infof("Build %s of folder %s %s", build.ID, build.FolderID, status)
+	b.notify(build)
+}
+
+// runStep builds one folder
+func (b *Builds) runStep(build *xsapiv1.Build, idx int, fc xsapiv1.FolderConfig, args xsapiv1.BuildArgs, sid string) (int, error) {
+	fld := b.mfolders.Get(fc.ID)
+	if fld == nil {
+		return -1, fmt.Errorf("unknown folder %s", fc.ID)
+	}
+	if b.folderWatch.IsQuotaExceeded(fc.ID) {
+		return -1, fmt.Errorf("folder disk quota exceeded")
+	}
+	if b.folderCrypt.IsLocked(fc) {
+		return -1, fmt.Errorf("folder is locked")
+	}
+	root := (*fld).GetFullPath("")
+	cmdLine, err := b.autoBuild.folderCommand(fc, root, args.SdkID, fc.Dependencies.RPath, fc.Dependencies.BuildCmd)
+	if err != nil {
+		return -1, err
+	}
+
+	cmdID := build.Steps[idx].CmdID
+	if err := b.mfolders.ExecAcquire(fc.ID, sid, cmdID); err != nil {
+		return -1, err
+	}
+	defer b.mfolders.ExecRelease(fc.ID, cmdID)
+
+	b.setStep(build, idx, xsapiv1.BuildStatusRunning, 0, nil)
+
+	env := append([]string{"XDS_BUILD_ID=" + build.ID}, b.mfolders.DependenciesEnv(fc.ID)...)
+	env = append(env, b.ccache.Env(fc.ID, args.SdkID)...)
+	return b.autoBuild.runCommand(fc, cmdID, "", cmdLine, env, args.TimeoutS)
+}
+
+// setStep updates status of a build step and notifies it
+func (b *Builds) setStep(build *xsapiv1.Build, idx int, status string, code int, err error) {
+	b.mutex.Lock()
+	st := &build.Steps[idx]
+	st.Status = status
+	st.ExitCode = code
+	if err != nil {
+		st.Error = err.Error()
+	}
+	b.mutex.Unlock()
+	b.notify(build)
+}
+
+// notify emits build status event
+func (b *Builds) notify(build *xsapiv1.Build) {
+	b.mutex.Lock()
+	msg := *copyBuild(build)
+	b.mutex.Unlock()
+	if err := b.events.Emit(xsapiv1.EVTBuild, msg, ""); err != nil {
+		b.LogSillyf("Cannot notify build %s: %v", build.ID, err)
+	}
+}
+
+// cleanupUnsafe forgets oldest finished builds (mutex must be locked)
+func (b *Builds) cleanupUnsafe() {
+	for i := 0; len(b.builds) > buildsMaxHistory && i < len(b.builds); {
+		if b.builds[i].Status == xsapiv1.BuildStatusRunning {
+			i++
+			continue
+		}
+		b.builds = append(b.builds[:i], b.builds[i+1:]...)
+	}
+}
+
+// copyBuild returns a deep copy of a build
+func copyBuild(build *xsapiv1.Build) *xsapiv1.Build {
+	res := *build
+	res.Steps = append([]xsapiv1.BuildStep{}, build.Steps...)
+	return &res
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Configuration file of a cache directory (read by ccache)
+const ccacheConfFile = "ccache.conf"
+
+var ccacheSizeRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([kMGT]i?)?$`)
+var ccacheIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Ccache Provision and manage ccache directories of folders or SDKs
+type Ccache struct {
+	*Context
+	enabled bool
+	dir     string
+	scope   string
+	maxSize string
+	mutex   sync.Mutex
+}
+
+// NewCcache creates a new instance of Ccache
+func NewCcache(ctx *Context) *Ccache {
+	cc := Ccache{
+		Context: ctx,
+		enabled: true,
+		scope:   xsapiv1.CcacheScopeFolder,
+		mutex:   sync.NewMutex(),
+	}
+	if dir, err := common.ResolveEnvVar(xdsconfig.DefaultCcacheDir); err == nil {
+		cc.dir = dir
+	}
+	if cfg := ctx.Config.FileConf.CcacheConf; cfg != nil {
+		cc.enabled = !cfg.Disabled
+		if cfg.Dir != "" {
+			cc.dir = cfg.Dir
+		}
+		if cfg.Scope == xsapiv1.CcacheScopeSdk {
+			cc.scope = cfg.Scope
+		} else if cfg.Scope != "" && cfg.Scope != xsapiv1.CcacheScopeFolder {
+			cc.Log.Warningf("Invalid ccache scope '%s', use '%s'", cfg.Scope, cc.scope)
+		}
+		if cfg.MaxSize != "" {
+			if ccacheSizeRe.MatchString(cfg.MaxSize) {
+				cc.maxSize = cfg.MaxSize
+			} else {
+				cc.Log.Warningf("Invalid ccache size limit '%s' ignored", cfg.MaxSize)
+			}
+		}
+	}
+	if cc.dir == "" {
+		cc.enabled = false
+	}
+	return &cc
+}
+
+// Env returns environment variables that set cache directory of a command
+// executed in a folder with an SDK (default SDK of folder when sdkID is empty)
+func (cc *Ccache) Env(folderID, sdkID string) []string {
+	if !cc.enabled {
+		return []string{}
+	}
+
+	scope, id := xsapiv1.CcacheScopeFolder, folderID
+	if cc.scope == xsapiv1.CcacheScopeSdk {
+		if sdkID == "" {
+			if f := cc.mfolders.Get(folderID); f != nil {
+				sdkID = (*f).GetConfig().DefaultSdk
+			}
+		}
+		// Commands without SDK use cache of folder
+		if iid, err := cc.sdks.ResolveID(sdkID); err == nil && iid != "" {
+			scope, id = xsapiv1.CcacheScopeSdk, iid
+		}
+	}
+
+	dir, err := cc.provision(scope, id)
+	if err != nil {
+		cc.Log.Errorf("Cannot provision ccache directory of %s %s: %v", scope, id, err)
+		return []string{}
+	}
+	return []string{"CCACHE_DIR=" + dir}
+}
+
+// List returns statistics of all provisioned caches
+func (cc *Ccache) List() []xsapiv1.CcacheInfo {
+	res := []xsapiv1.CcacheInfo{}
+	for _, scope := range []string{xsapiv1.CcacheScopeFolder, xsapiv1.CcacheScopeSdk} {
+		dirs, _ := ioutil.ReadDir(filepath.Join(cc.dir, scope))
+		for _, d := range dirs {
+			if !d.IsDir() {
+				continue
+			}
+			if info, err := cc.Get(scope, d.Name()); err == nil {
+				res = append(res, *info)
+			}
+		}
+	}
+	return res
+}
+
+// Get returns statistics (size, hit rate) of a cache
+func (cc *Ccache) Get(scope, id string) (*xsapiv1.CcacheInfo, error) {
+	dir, err := cc.cacheDir(scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if !common.Exists(dir) {
+		return nil, fmt.Errorf("unknown cache")
+	}
+
+	info := xsapiv1.CcacheInfo{Scope: scope, ID: id, Dir: dir, MaxSize: ccacheConfGet(dir, "max_size")}
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fi.Name() != ccacheConfFile {
+			info.Files++
+			info.Size += fi.Size()
+		}
+		return nil
+	})
+
+	// Hit statistics are only available using ccache command
+	stats, err := ccacheStats(dir)
+	if err != nil {
+		info.Error = err.Error()
+		return &info, nil
+	}
+	info.Hits = stats["direct_cache_hit"] + stats["preprocessed_cache_hit"] +
+		stats["cache_hit_direct"] + stats["cache_hit_preprocessed"]
+	info.Misses = stats["cache_miss"]
+	if total := info.Hits + info.Misses; total > 0 {
+		info.HitRate = float64(info.Hits) * 100 / float64(total)
+	}
+	return &info, nil
+}
+
+// SetMaxSize sets size limit of a cache (cache is provisioned when needed)
+func (cc *Ccache) SetMaxSize(scope, id, size string) (*xsapiv1.CcacheInfo, error) {
+	if !ccacheSizeRe.MatchString(size) {
+		return nil, fmt.Errorf("invalid size (eg. 500M, 5G or 0 for no limit)")
+	}
+	if _, err := cc.cacheDir(scope, id); err != nil {
+		return nil, err
+	}
+	dir, err := cc.provision(scope, id)
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mutex.Lock()
+	err = ccacheConfSet(dir, "max_size", size)
+	cc.mutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot set cache size: %v", err)
+	}
+	return cc.Get(scope, id)
+}
+
+// Clear removes all files of a cache (configuration is kept)
+func (cc *Ccache) Clear(scope, id string) (*xsapiv1.CcacheInfo, error) {
+	dir, err := cc.cacheDir(scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if !common.Exists(dir) {
+		return nil, fmt.Errorf("unknown cache")
+	}
+
+	cc.mutex.Lock()
+	entries, err := ioutil.ReadDir(dir)
+	if err == nil {
+		for _, e := range entries {
+			if e.Name() == ccacheConfFile {
+				continue
+			}
+			if err = os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				break
+			}
+		}
+	}
+	cc.mutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot clear cache: %v", err)
+	}
+
+	cc.Log.Infof("ccache of %s %s cleared", scope, id)
+	return cc.Get(scope, id)
+}
+
+/*** Private functions ***/
+
+// cacheDir returns directory of a cache
+func (cc *Ccache) cacheDir(scope, id string) (string, error) {
+	if !cc.enabled {
+		return "", fmt.Errorf("ccache support disabled")
+	}
+	if scope != xsapiv1.CcacheScopeFolder && scope != xsapiv1.CcacheScopeSdk {
+		return "", fmt.Errorf("invalid scope")
+	}
+	if !ccacheIDRe.MatchString(id) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid id")
+	}
+	return filepath.Join(cc.dir, scope, id), nil
+}
+
+// provision creates a cache directory (with default size limit)
+func (cc *Ccache) provision(scope, id string) (string, error) {
+	dir, err := cc.cacheDir(scope, id)
+	if err != nil {
+		return "", err
+	}
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if common.Exists(dir) {
+		return dir, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if cc.maxSize != "" {
+		if err := ccacheConfSet(dir, "max_size", cc.maxSize); err != nil {
+			return "", err
+		}
+	}
+	cc.Log.Infof("ccache directory of %s %s created: %s", scope, id, dir)
+	return dir, nil
+}
+
+// ccacheStats returns counters of a cache (ccache >= 3.7 is required)
+func ccacheStats(dir string) (map[string]int64, error) {
+	bin, err := exec.LookPath("ccache")
+	if err != nil {
+		return nil, fmt.Errorf("ccache not installed on server")
+	}
+	cmd := exec.Command(bin, "--print-stats")
+	cmd.Env = append(os.Environ(), "CCACHE_DIR="+dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get ccache statistics: %v", err)
+	}
+
+	stats := make(map[string]int64)
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+			stats[f[0]] = v
+		}
+	}
+	return stats, nil
+}
+
+// ccacheConfGet returns value of an option set in configuration of a cache
+func ccacheConfGet(dir, key string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ccacheConfFile))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// ccacheConfSet sets an option in configuration of a cache (other options
+// are kept)
+func ccacheConfSet(dir, key, value string) error {
+	file := filepath.Join(dir, ccacheConfFile)
+	lines := []string{}
+	if b, err := ioutil.ReadFile(file); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			kv := strings.SplitN(line, "=", 2)
+			if line == "" || (len(kv) == 2 && strings.TrimSpace(kv[0]) == key) {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, key+" = "+value)
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
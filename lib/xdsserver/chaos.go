@@ -0,0 +1,188 @@
+//go:build chaos
+// +build chaos
+
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-common/golib/eows"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// chaosHooks Fault injection facility used to verify resilience of
+// reconnect, replay and abort logic
+type chaosHooks struct {
+	*Context
+	status xsapiv1.ChaosStatus
+	mutex  sync.Mutex
+}
+
+func (h *chaosHooks) init(ctx *Context) {
+	h.Context = ctx
+	h.mutex = sync.NewMutex()
+	ctx.Log.Warningf("Fault injection (chaos) hooks enabled: DON'T USE IN PRODUCTION")
+
+	if ctx.SThg != nil {
+		ctx.SThg.RequestHook = h.delaySyncthing
+	}
+}
+
+// dropEvent returns true when an event must be dropped
+func (h *chaosHooks) dropEvent(evName string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.status.DropEvents <= 0 {
+		return false
+	}
+	h.status.DropEvents--
+	h.status.DroppedEvents++
+	h.Log.Infof("CHAOS: event %s dropped (%d remaining)", evName, h.status.DropEvents)
+	return true
+}
+
+// delaySyncthing delays Syncthing REST requests
+func (h *chaosHooks) delaySyncthing(url string) {
+	h.mutex.Lock()
+	delay := h.status.SyncthingDelay
+	if delay > 0 && h.status.SyncthingDelayN > 0 {
+		h.status.SyncthingDelayN--
+		if h.status.SyncthingDelayN == 0 {
+			h.status.SyncthingDelay = 0
+		}
+	}
+	h.mutex.Unlock()
+
+	if delay > 0 {
+		h.Log.Infof("CHAOS: delay Syncthing request %s of %d ms", url, delay)
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+}
+
+func (h *chaosHooks) getStatus() xsapiv1.ChaosStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.status
+}
+
+// kill kills a child process
+func (h *chaosHooks) kill(args xsapiv1.ChaosKillArgs) error {
+	switch args.Target {
+	case xsapiv1.ChaosKillSyncthing, xsapiv1.ChaosKillSyncthingInotify:
+		cmd := h.SThgCmd
+		if args.Target == xsapiv1.ChaosKillSyncthingInotify {
+			cmd = h.SThgInotCmd
+		}
+		if cmd == nil || cmd.Process == nil {
+			return fmt.Errorf("%s not started", args.Target)
+		}
+		h.Log.Infof("CHAOS: kill %s (PID %d)", args.Target, cmd.Process.Pid)
+		return cmd.Process.Kill()
+
+	case xsapiv1.ChaosKillCommand:
+		e := eows.GetEows(args.CmdID)
+		if e == nil {
+			return fmt.Errorf("unknown cmdID")
+		}
+		h.Log.Infof("CHAOS: kill command %s", args.CmdID)
+		return e.Signal("SIGKILL")
+	}
+	return fmt.Errorf("invalid target")
+}
+
+/*** API ***/
+
+// chaosRoutes registers fault injection routes
+func (s *APIService) chaosRoutes() {
+	r := s.apiRouter.Group("/admin/chaos", s.chaosLocalOnly, s.roleRequired(xsapiv1.RoleAdmin))
+	r.GET("", s.getChaos)
+	r.DELETE("", s.resetChaos)
+	r.POST("/events/drop", s.chaosDropEvents)
+	r.POST("/syncthing/delay", s.chaosSyncthingDelay)
+	r.POST("/kill", s.chaosKill)
+}
+
+// chaosLocalOnly restricts fault injection to local clients (address of peer
+// is used, forwarded headers can be set by anyone)
+func (s *APIService) chaosLocalOnly(c *gin.Context) {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		common.APIError(c, "fault injection only allowed from localhost")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func (s *APIService) getChaos(c *gin.Context) {
+	c.JSON(http.StatusOK, s.chaos.getStatus())
+}
+
+func (s *APIService) resetChaos(c *gin.Context) {
+	s.chaos.mutex.Lock()
+	s.chaos.status = xsapiv1.ChaosStatus{}
+	s.chaos.mutex.Unlock()
+	c.JSON(http.StatusOK, s.chaos.getStatus())
+}
+
+func (s *APIService) chaosDropEvents(c *gin.Context) {
+	var args xsapiv1.ChaosDropEventsArgs
+	if c.BindJSON(&args) != nil || args.Count < 0 {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	s.chaos.mutex.Lock()
+	s.chaos.status.DropEvents = args.Count
+	s.chaos.mutex.Unlock()
+	c.JSON(http.StatusOK, s.chaos.getStatus())
+}
+
+func (s *APIService) chaosSyncthingDelay(c *gin.Context) {
+	var args xsapiv1.ChaosSyncthingDelayArgs
+	if c.BindJSON(&args) != nil || args.DelayMs < 0 || args.Count < 0 {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	s.chaos.mutex.Lock()
+	s.chaos.status.SyncthingDelay = args.DelayMs
+	s.chaos.status.SyncthingDelayN = args.Count
+	s.chaos.mutex.Unlock()
+	c.JSON(http.StatusOK, s.chaos.getStatus())
+}
+
+func (s *APIService) chaosKill(c *gin.Context) {
+	var args xsapiv1.ChaosKillArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+	if err := s.chaos.kill(args); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, s.chaos.getStatus())
+}
@@ -0,0 +1,441 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const debugMaxPerSession = 10 // Maximum number of debug sessions of a client session
+const debugOutputLines = 2000 // Number of gdb output lines kept (replayed on reconnection)
+const debugMaxLineSize = 1 << 20
+
+// DebugSessions gdb processes controlled by clients using GDB/MI
+type DebugSessions struct {
+	*Context
+	debugs map[string]*debugSession
+	mutex  sync.Mutex
+}
+
+// debugSession Hold a gdb process
+type debugSession struct {
+	info   xsapiv1.DebugSession
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output []xsapiv1.DebugMIOutMsg // last lines (oldest first)
+	bkpts  map[string]xsapiv1.DebugBreakpoint
+}
+
+// NewDebugSessions creates a new instance of DebugSessions
+func NewDebugSessions(ctx *Context) *DebugSessions {
+	return &DebugSessions{
+		Context: ctx,
+		debugs:  make(map[string]*debugSession),
+		mutex:   sync.NewMutex(),
+	}
+}
+
+// Start starts gdb (cmdLine) in the environment of a folder
+func (d *DebugSessions) Start(info xsapiv1.DebugSession, cmdLine string, env []string) (*xsapiv1.DebugSession, error) {
+	info.ID = uuid.NewV1().String()
+	info.Status = xsapiv1.DebugStatusRunning
+	info.StartedAt = time.Now().String()
+	info.Breakpoints = []xsapiv1.DebugBreakpoint{}
+
+	// Output and errors of gdb (and of local inferior) are merged
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pw.Close()
+
+	cmd := exec.Command("/bin/bash", "-c", cmdLine)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	cmd.SysProcAttr = groupSysProcAttr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	ds := &debugSession{info: info, cmd: cmd, stdin: stdin, bkpts: make(map[string]xsapiv1.DebugBreakpoint)}
+
+	d.mutex.Lock()
+	if err := d.cleanupUnsafe(info.SessionID); err != nil {
+		d.mutex.Unlock()
+		pr.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		d.mutex.Unlock()
+		pr.Close()
+		return nil, fmt.Errorf("Cannot start gdb: %v", err)
+	}
+	d.debugs[info.ID] = ds
+	res := ds.copyInfo()
+	d.mutex.Unlock()
+
+	d.Log.Infof("Debug session %s of folder %s started: %s", info.ID, info.FolderID, cmdLine)
+	go d.run(ds, pr)
+
+	return res, nil
+}
+
+// Get returns a debug session (including tracked breakpoints)
+func (d *DebugSessions) Get(id, sid string) (*xsapiv1.DebugSession, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ds, err := d.getUnsafe(id, sid)
+	if err != nil {
+		return nil, err
+	}
+	return ds.copyInfo(), nil
+}
+
+// GetAll returns debug sessions of a client session
+func (d *DebugSessions) GetAll(sid string) []xsapiv1.DebugSession {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := []xsapiv1.DebugSession{}
+	for _, ds := range d.debugs {
+		if ds.info.SessionID == sid {
+			res = append(res, *ds.copyInfo())
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].StartedAt < res[j].StartedAt })
+	return res
+}
+
+// Output returns lines received from gdb after sequence number since (used
+// by clients to resynchronize after a reconnection)
+func (d *DebugSessions) Output(id, sid string, since uint64) ([]xsapiv1.DebugMIOutMsg, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ds, err := d.getUnsafe(id, sid)
+	if err != nil {
+		return nil, err
+	}
+	res := []xsapiv1.DebugMIOutMsg{}
+	for _, l := range ds.output {
+		if l.Seq > since {
+			res = append(res, l)
+		}
+	}
+	return res, nil
+}
+
+// Write sends a GDB/MI command to gdb
+func (d *DebugSessions) Write(id, sid, line string) error {
+	d.mutex.Lock()
+	ds, err := d.getUnsafe(id, sid)
+	if err == nil && ds.info.Status != xsapiv1.DebugStatusRunning {
+		err = fmt.Errorf("debug session exited")
+	}
+	d.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Translate paths from client to server
+	if f := d.mfolders.Get(ds.info.FolderID); f != nil {
+		line = (*f).ConvPathCli2Svr(line)
+	}
+	_, err = io.WriteString(ds.stdin, strings.TrimRight(line, "\r\n")+"\n")
+	return err
+}
+
+// Kill kills gdb (and debugged program) and forgets debug session
+func (d *DebugSessions) Kill(id, sid string) error {
+	d.mutex.Lock()
+	ds, err := d.getUnsafe(id, sid)
+	if err == nil {
+		delete(d.debugs, id)
+	}
+	d.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	d.kill(ds)
+	return nil
+}
+
+// SessionClosed kills debug sessions of a closed client session
+func (d *DebugSessions) SessionClosed(sid string) {
+	d.mutex.Lock()
+	killed := []*debugSession{}
+	for id, ds := range d.debugs {
+		if ds.info.SessionID == sid {
+			delete(d.debugs, id)
+			killed = append(killed, ds)
+		}
+	}
+	d.mutex.Unlock()
+	for _, ds := range killed {
+		d.Log.Infof("Kill debug session %s (client session %s closed)", ds.info.ID, sid)
+		d.kill(ds)
+	}
+}
+
+// Stop kills all debug sessions
+func (d *DebugSessions) Stop() {
+	d.mutex.Lock()
+	all := d.debugs
+	d.debugs = make(map[string]*debugSession)
+	d.mutex.Unlock()
+	for _, ds := range all {
+		d.kill(ds)
+	}
+}
+
+/*** Private functions ***/
+
+// getUnsafe returns a debug session owned by sid (mutex must be locked)
+func (d *DebugSessions) getUnsafe(id, sid string) (*debugSession, error) {
+	ds, exist := d.debugs[id]
+	if !exist || ds.info.SessionID != sid {
+		return nil, fmt.Errorf("unknown debug session")
+	}
+	return ds, nil
+}
+
+// cleanupUnsafe forgets oldest exited debug sessions of a client session when
+// limit is reached (mutex must be locked)
+func (d *DebugSessions) cleanupUnsafe(sid string) error {
+	owned := []*debugSession{}
+	for _, ds := range d.debugs {
+		if ds.info.SessionID == sid {
+			owned = append(owned, ds)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].info.StartedAt < owned[j].info.StartedAt })
+	cnt := len(owned)
+	for _, ds := range owned {
+		if cnt < debugMaxPerSession {
+			return nil
+		}
+		if ds.info.Status == xsapiv1.DebugStatusExited {
+			delete(d.debugs, ds.info.ID)
+			cnt--
+		}
+	}
+	if cnt >= debugMaxPerSession {
+		return fmt.Errorf("too many debug sessions (max %d)", debugMaxPerSession)
+	}
+	return nil
+}
+
+// kill kills process group of gdb
+func (d *DebugSessions) kill(ds *debugSession) {
+	ds.stdin.Close()
+	if ds.cmd.Process != nil {
+		processGroupKill(ds.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// run reads gdb output until it exited
+func (d *DebugSessions) run(ds *debugSession, r *os.File) {
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), debugMaxLineSize)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if f := d.mfolders.Get(ds.info.FolderID); f != nil {
+			line = (*f).ConvPathSvr2Cli(line)
+		}
+
+		d.mutex.Lock()
+		ds.info.OutputSeq++
+		msg := xsapiv1.DebugMIOutMsg{ID: ds.info.ID, Seq: ds.info.OutputSeq, Timestamp: time.Now().String(), Line: line}
+		ds.output = append(ds.output, msg)
+		if len(ds.output) > debugOutputLines {
+			ds.output = ds.output[len(ds.output)-debugOutputLines:]
+		}
+		debugTrackBreakpoints(ds.bkpts, line)
+		sid := ds.info.SessionID
+		d.mutex.Unlock()
+
+		d.emit(sid, xsapiv1.DebugMIOutEvent, msg)
+	}
+
+	err := ds.cmd.Wait()
+	code := 0
+	if err != nil {
+		code = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(interface{ ExitStatus() int }); ok {
+				code = ws.ExitStatus()
+			}
+		}
+	}
+
+	d.mutex.Lock()
+	ds.info.Status = xsapiv1.DebugStatusExited
+	ds.info.ExitCode = code
+	d.mutex.Unlock()
+
+	d.Log.Infof("Debug session %s exited: code %d", ds.info.ID, code)
+	msg := xsapiv1.DebugExitMsg{ID: ds.info.ID, Timestamp: time.Now().String(), Code: code}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	d.emit(ds.info.SessionID, xsapiv1.DebugExitEvent, msg)
+}
+
+// emit sends an event to the owner of a debug session
+func (d *DebugSessions) emit(sid, evName string, data interface{}) {
+	// IO socket can be nil when disconnected (lines can be retrieved later)
+	so := d.sessions.IOSocketGet(sid)
+	if so == nil {
+		return
+	}
+	if err := (*so).Emit(evName, data); err != nil {
+		d.Log.Errorf("WS Emit : %v", err)
+	}
+}
+
+// copyInfo returns debug session definition (mutex must be locked)
+func (ds *debugSession) copyInfo() *xsapiv1.DebugSession {
+	res := ds.info
+	res.Breakpoints = []xsapiv1.DebugBreakpoint{}
+	for _, b := range ds.bkpts {
+		res.Breakpoints = append(res.Breakpoints, b)
+	}
+	sort.Slice(res.Breakpoints, func(i, j int) bool {
+		ni, _ := strconv.ParseFloat(res.Breakpoints[i].Number, 64)
+		nj, _ := strconv.ParseFloat(res.Breakpoints[j].Number, 64)
+		return ni < nj
+	})
+	return &res
+}
+
+// debugTrackBreakpoints updates breakpoints list using a GDB/MI record
+// (^done,bkpt= result or =breakpoint-created/modified/deleted notifications)
+func debugTrackBreakpoints(bkpts map[string]xsapiv1.DebugBreakpoint, line string) {
+	if strings.HasPrefix(line, "=breakpoint-deleted,") {
+		if id := miParseTuple(strings.TrimPrefix(line, "=breakpoint-deleted,"))["id"]; id != "" {
+			delete(bkpts, id)
+		}
+		return
+	}
+	idx := strings.Index(line, "bkpt={")
+	if idx < 0 || !(strings.HasPrefix(line, "^done,") || strings.HasPrefix(line, "=breakpoint-created,") ||
+		strings.HasPrefix(line, "=breakpoint-modified,")) {
+		return
+	}
+	f := miParseTuple(line[idx+len("bkpt={"):])
+	if f["number"] == "" {
+		return
+	}
+	file := f["fullname"]
+	if file == "" {
+		file = f["file"]
+	}
+	bkpts[f["number"]] = xsapiv1.DebugBreakpoint{
+		Number:    f["number"],
+		Type:      f["type"],
+		Enabled:   f["enabled"] == "y",
+		File:      file,
+		Line:      f["line"],
+		Func:      f["func"],
+		Cond:      f["cond"],
+		Location:  f["original-location"],
+		HitsCount: f["times"],
+	}
+}
+
+// miParseTuple returns string fields (key="value") of a GDB/MI tuple content,
+// nested tuples and lists are skipped and parsing stops at end of tuple
+func miParseTuple(s string) map[string]string {
+	res := make(map[string]string)
+	depth := 0
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == '{' || c == '[':
+			depth++
+			i++
+		case c == '}' || c == ']':
+			if depth == 0 {
+				return res
+			}
+			depth--
+			i++
+		case c == ',':
+			i++
+		default:
+			// key="value"
+			eq := strings.IndexByte(s[i:], '=')
+			if eq < 0 {
+				return res
+			}
+			key := s[i : i+eq]
+			i += eq + 1
+			if i >= len(s) || s[i] != '"' {
+				continue
+			}
+			val, n := miParseString(s[i:])
+			if depth == 0 {
+				res[key] = val
+			}
+			i += n
+		}
+	}
+	return res
+}
+
+// miParseString decodes a C string and returns its value and length
+func miParseString(s string) (string, int) {
+	var b bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(s[i])
+				}
+			}
+		case '"':
+			return b.String(), i + 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), len(s)
+}
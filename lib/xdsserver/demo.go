@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Demo data are created under this directory of shareRootDir
+const demoDirName = "xds-demo"
+
+// demoProject Definition of a demo project
+type demoProject struct {
+	name  string
+	files map[string]string
+	jobs  map[string]string // job name -> command
+}
+
+var demoProjects = []demoProject{
+	{
+		name: "helloworld-native",
+		files: map[string]string{
+			"main.c": "#include <stdio.h>\n\nint main(void)\n{\n\tprintf(\"Hello XDS world !\\n\");\n\treturn 0;\n}\n",
+			"Makefile": "CC ?= gcc\n\nhelloworld: main.c\n\t$(CC) $(CFLAGS) -o $@ $<\n\n" +
+				"clean:\n\trm -f helloworld\n\n.PHONY: clean\n",
+		},
+		jobs: map[string]string{
+			"build": "make",
+			"clean": "make clean",
+			"run":   "make && ./helloworld",
+		},
+	},
+	{
+		name: "helloworld-cmake",
+		files: map[string]string{
+			"main.c": "#include <stdio.h>\n\nint main(void)\n{\n\tprintf(\"Hello XDS cmake world !\\n\");\n\treturn 0;\n}\n",
+			"CMakeLists.txt": "cmake_minimum_required(VERSION 2.8)\nproject(helloworld-cmake C)\n" +
+				"add_executable(helloworld main.c)\n",
+		},
+		jobs: map[string]string{
+			"build": "mkdir -p build && cd build && cmake .. && make",
+			"clean": "rm -rf build",
+		},
+	},
+}
+
+// demoSdkSetup Environment setup file of the fake demo SDK (use native toolchain)
+const demoSdkSetup = `# XDS demo SDK: fake cross SDK that uses native toolchain
+export SDKTARGETSYSROOT=/
+export CC=gcc
+export CXX=g++
+export XDS_DEMO_SDK=1
+`
+
+// SeedDemo creates demo folders, a fake SDK and build jobs that can be
+// replayed to explore XDS without installing real SDKs
+func (ctx *Context) SeedDemo() (*xsapiv1.DemoData, error) {
+	demoDir := filepath.Join(ctx.Config.FileConf.ShareRootDir, demoDirName)
+	ctx.Log.Infof("Seeding demo data in %s", demoDir)
+
+	// Fake SDK
+	sdk, err := ctx.sdks.addDemoSDK(filepath.Join(demoDir, "sdk"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Folders (don't re-create them when already existing)
+	existing := make(map[string]xsapiv1.FolderConfig)
+	for _, fc := range ctx.mfolders.GetConfigArr() {
+		if fc.Type == xsapiv1.TypePathMap {
+			existing[fc.DataPathMap.ServerPath] = fc
+		}
+	}
+
+	for _, prj := range demoProjects {
+		prjDir := filepath.Join(demoDir, prj.name)
+		if err := os.MkdirAll(prjDir, 0755); err != nil {
+			return nil, fmt.Errorf("Cannot create demo directory: %v", err)
+		}
+		for name, content := range prj.files {
+			fn := filepath.Join(prjDir, name)
+			if common.Exists(fn) {
+				continue
+			}
+			if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+				return nil, fmt.Errorf("Cannot create demo file: %v", err)
+			}
+		}
+
+		if _, exist := existing[prjDir]; exist {
+			continue
+		}
+		_, err := ctx.mfolders.Add(xsapiv1.FolderConfig{
+			Label:       "demo-" + prj.name,
+			ClientPath:  prjDir,
+			Type:        xsapiv1.TypePathMap,
+			DefaultSdk:  sdk.ID,
+			ClientData:  "xds-demo",
+			DataPathMap: xsapiv1.PathMapConfig{ServerPath: prjDir},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create demo folder %s: %v", prj.name, err)
+		}
+	}
+
+	return ctx.GetDemo(), nil
+}
+
+// GetDemo returns demo data (folders, SDK and replayable jobs)
+func (ctx *Context) GetDemo() *xsapiv1.DemoData {
+	demoDir := filepath.Join(ctx.Config.FileConf.ShareRootDir, demoDirName)
+	data := xsapiv1.DemoData{
+		Folders: []xsapiv1.FolderConfig{},
+		Sdks:    []xsapiv1.SDK{},
+		Jobs:    []xsapiv1.DemoJob{},
+	}
+
+	sdkID := ""
+	if sdk := ctx.sdks.Get(demoSdkID()); sdk != nil {
+		data.Sdks = append(data.Sdks, *sdk)
+		sdkID = sdk.ID
+	}
+
+	for _, fc := range ctx.mfolders.GetConfigArr() {
+		for _, prj := range demoProjects {
+			if fc.Type != xsapiv1.TypePathMap || fc.DataPathMap.ServerPath != filepath.Join(demoDir, prj.name) {
+				continue
+			}
+			data.Folders = append(data.Folders, fc)
+
+			names := []string{}
+			for name := range prj.jobs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				cmd := prj.jobs[name]
+				data.Jobs = append(data.Jobs, xsapiv1.DemoJob{
+					Name: prj.name + "/" + name,
+					Exec: xsapiv1.ExecArgs{
+						ID:    fc.ID,
+						SdkID: sdkID,
+						Cmd:   cmd,
+					},
+				})
+			}
+		}
+	}
+	return &data
+}
+
+/*** Private functions ***/
+
+// demoSdkID returns the (constant) ID of the demo SDK
+func demoSdkID() string {
+	return uuid.NewV3(uuid.FromStringOrNil("sdks"), "xds-demo-sdk").String()
+}
+
+// addDemoSDK registers a fake SDK that uses native toolchain
+func (s *SDKs) addDemoSDK(sdkDir string) (*xsapiv1.SDK, error) {
+	id := demoSdkID()
+	if sdk := s.Get(id); sdk != nil {
+		return sdk, nil
+	}
+
+	setupFile := filepath.Join(sdkDir, "environment-setup-xds-demo")
+	if err := os.MkdirAll(sdkDir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create demo SDK directory: %v", err)
+	}
+	if err := ioutil.WriteFile(setupFile, []byte(demoSdkSetup), 0644); err != nil {
+		return nil, fmt.Errorf("Cannot create demo SDK setup file: %v", err)
+	}
+
+	cSdk := &CrossSDK{
+		Context: s.Context,
+		scripts: make(map[string]string),
+		sdk: xsapiv1.SDK{
+			ID:          id,
+			Name:        "xds-demo-sdk",
+			Description: "Demo SDK (use native toolchain)",
+			Profile:     "demo",
+			Version:     "1.0",
+			Arch:        runtime.GOARCH,
+			Path:        sdkDir,
+			Status:      xsapiv1.SdkStatusInstalled,
+			Date:        time.Now().Format("2006-01-02 15:04"),
+			SetupFile:   setupFile,
+			Health:      xsapiv1.SDKHealth{Status: xsapiv1.SdkHealthUnknown},
+			FamilyConf: xsapiv1.SDKFamilyConfig{
+				FamilyName:   "demo",
+				Description:  "XDS demo SDK",
+				RootDir:      sdkDir,
+				EnvSetupFile: "environment-setup-*",
+			},
+		},
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s._addCrossSDK(cSdk, false, true); err != nil {
+		return nil, err
+	}
+
+	return &cSdk.sdk, nil
+}
@@ -0,0 +1,579 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const deployMaxHistory = 20 // Number of finished deployments kept in memory
+const deployMaxFiles = 1000 // Maximum number of files copied by a deployment
+const deployDefaultDir = "/tmp"
+
+var deployTargetNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+var deployHostRe = regexp.MustCompile(`^[A-Za-z0-9_.:\[\]-]+$`)
+
+var errDeployTooMany = errors.New("too many files")
+
+// Deployments Copy of built files on registered targets (archive extracted
+// using ssh, file attributes follow server policy) and execution of install
+// commands using ssh
+type Deployments struct {
+	*Context
+	targets []xsapiv1.DeployTarget
+	deploys []*xsapiv1.Deploy // oldest first
+	mutex   sync.Mutex
+}
+
+// xmlDeployTargets On disk format of registered targets
+type xmlDeployTargets struct {
+	XMLName xml.Name               `xml:"DeployTargets"`
+	Version string                 `xml:"version,attr"`
+	Targets []xsapiv1.DeployTarget `xml:"target"`
+}
+
+// NewDeployments creates a new instance of Deployments
+func NewDeployments(ctx *Context) *Deployments {
+	d := Deployments{
+		Context: ctx,
+		targets: []xsapiv1.DeployTarget{},
+		deploys: []*xsapiv1.Deploy{},
+		mutex:   sync.NewMutex(),
+	}
+	d.load()
+	return &d
+}
+
+// GetTargets returns registered targets
+func (d *Deployments) GetTargets() []xsapiv1.DeployTarget {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := append([]xsapiv1.DeployTarget{}, d.targets...)
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// SetTarget registers (or replaces) a target
+func (d *Deployments) SetTarget(t xsapiv1.DeployTarget) (*xsapiv1.DeployTarget, error) {
+	if !deployTargetNameRe.MatchString(t.Name) {
+		return nil, fmt.Errorf("invalid target name")
+	}
+	if !deployHostRe.MatchString(t.Host) || strings.HasPrefix(t.Host, "-") {
+		return nil, fmt.Errorf("invalid target host")
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		return nil, fmt.Errorf("invalid target port")
+	}
+	if t.User == "" {
+		t.User = "root"
+	}
+	if !deployTargetNameRe.MatchString(t.User) {
+		return nil, fmt.Errorf("invalid target user")
+	}
+	if t.Secret != "" && !d.secrets.Exists(t.Secret) {
+		return nil, fmt.Errorf("unknown secret %s", t.Secret)
+	}
+	if t.Dir != "" && !filepath.IsAbs(t.Dir) {
+		return nil, fmt.Errorf("target directory must be absolute")
+	}
+	if t.InstallCmds == nil {
+		t.InstallCmds = []string{}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	replaced := false
+	for i := range d.targets {
+		if d.targets[i].Name == t.Name {
+			d.targets[i] = t
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		d.targets = append(d.targets, t)
+	}
+	if err := d.save(); err != nil {
+		return nil, fmt.Errorf("Cannot save deployment targets: %v", err)
+	}
+	return &t, nil
+}
+
+// DeleteTarget removes a registered target
+func (d *Deployments) DeleteTarget(name string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, t := range d.targets {
+		if t.Name == name {
+			d.targets = append(d.targets[:i], d.targets[i+1:]...)
+			return d.save()
+		}
+	}
+	return fmt.Errorf("unknown target %s", name)
+}
+
+// Start copies files of a folder on a target then executes install commands
+func (d *Deployments) Start(args xsapiv1.DeployArgs, sid string) (*xsapiv1.Deploy, error) {
+	if args.TimeoutS < 0 {
+		return nil, fmt.Errorf("invalid timeout")
+	}
+	if len(args.Files) == 0 {
+		return nil, fmt.Errorf("no file to deploy")
+	}
+	if err := d.artifacts.CheckPatterns(args.Files); err != nil {
+		return nil, err
+	}
+	if !d.mfolders.HasAccess(args.FolderID, sid, xsapiv1.FolderAccessRead) {
+		return nil, fmt.Errorf("permission denied on folder %s", args.FolderID)
+	}
+	fld := d.mfolders.Get(args.FolderID)
+	if fld == nil {
+		return nil, fmt.Errorf("unknown folder %s", args.FolderID)
+	}
+	if d.folderCrypt.IsLocked((*fld).GetConfig()) {
+		return nil, fmt.Errorf("folder is locked")
+	}
+
+	target, err := d.getTarget(args.Target)
+	if err != nil {
+		return nil, err
+	}
+	remoteDir := args.RemoteDir
+	if remoteDir == "" {
+		remoteDir = target.Dir
+	}
+	if remoteDir == "" {
+		remoteDir = deployDefaultDir
+	}
+	if !filepath.IsAbs(remoteDir) {
+		return nil, fmt.Errorf("remote directory must be absolute")
+	}
+	installCmds := args.InstallCmds
+	if installCmds == nil {
+		installCmds = target.InstallCmds
+	}
+
+	files, err := deployFiles((*fld).GetFullPath(""), args.Files)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file matching %v", args.Files)
+	}
+
+	dep := xsapiv1.Deploy{
+		ID:        uuid.NewV1().String(),
+		FolderID:  args.FolderID,
+		Target:    target.Name,
+		RemoteDir: remoteDir,
+		Files:     files,
+		Status:    xsapiv1.DeployStatusRunning,
+		Steps:     []xsapiv1.DeployStep{},
+		StartedBy: sid,
+		StartedAt: time.Now().Format(time.RFC3339),
+	}
+	dep.Steps = append(dep.Steps, xsapiv1.DeployStep{
+		Name:   "copy",
+		CmdID:  "deploy_" + dep.ID[:8] + "_0",
+		Status: xsapiv1.DeployStatusPending,
+	})
+	for i, c := range installCmds {
+		dep.Steps = append(dep.Steps, xsapiv1.DeployStep{
+			Name:   "install",
+			CmdID:  "deploy_" + dep.ID[:8] + "_" + strconv.Itoa(i+1),
+			Cmd:    c,
+			Status: xsapiv1.DeployStatusPending,
+		})
+	}
+
+	d.mutex.Lock()
+	for _, dd := range d.deploys {
+		if dd.Target == target.Name && dd.Status == xsapiv1.DeployStatusRunning {
+			d.mutex.Unlock()
+			return nil, fmt.Errorf("deployment on target %s already running (id %s)", target.Name, dd.ID)
+		}
+	}
+	d.deploys = append(d.deploys, &dep)
+	d.cleanupUnsafe()
+	res := copyDeploy(&dep)
+	d.mutex.Unlock()
+
+	d.Log.Infof("Start deployment %s of folder %s on target %s (%d files)", dep.ID, dep.FolderID, target.Name, len(files))
+	go d.run(&dep, *target, args.TimeoutS)
+
+	return res, nil
+}
+
+// Get returns a deployment
+func (d *Deployments) Get(id string) (*xsapiv1.Deploy, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, dd := range d.deploys {
+		if dd.ID == id {
+			return copyDeploy(dd), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown id")
+}
+
+// GetAll returns running and last finished deployments
+func (d *Deployments) GetAll() []xsapiv1.Deploy {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := []xsapiv1.Deploy{}
+	for _, dd := range d.deploys {
+		res = append(res, *copyDeploy(dd))
+	}
+	return res
+}
+
+/*** Private functions ***/
+
+// getTarget returns a registered target
+func (d *Deployments) getTarget(name string) (*xsapiv1.DeployTarget, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, t := range d.targets {
+		if t.Name == name {
+			res := t
+			return &res, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown target %s", name)
+}
+
+// run executes deployment steps, steps following a failed one are skipped
+func (d *Deployments) run(dep *xsapiv1.Deploy, target xsapiv1.DeployTarget, timeoutS int) {
+	failed := false
+	ssh, env, cleanup, err := d.sshCommands(target)
+	if err != nil {
+		d.Log.Errorf("Deployment %s: %v", dep.ID, err)
+		d.setStep(dep, 0, xsapiv1.DeployStatusFailed, -1, err)
+		failed = true
+	}
+	defer cleanup()
+
+	for i := range dep.Steps {
+		if failed {
+			if dep.Steps[i].Status == xsapiv1.DeployStatusPending {
+				d.setStep(dep, i, xsapiv1.DeployStatusSkipped, 0, nil)
+			}
+			continue
+		}
+		code, err := d.runStep(dep, i, ssh, env, timeoutS)
+		status := xsapiv1.DeployStatusDone
+		if err == nil && code != 0 {
+			err = fmt.Errorf("exit code %d", code)
+		}
+		if err != nil {
+			d.Log.Infof("Deployment %s step %d failed: %v", dep.ID, i, err)
+			status = xsapiv1.DeployStatusFailed
+			failed = true
+		}
+		d.setStep(dep, i, status, code, err)
+	}
+
+	status := xsapiv1.DeployStatusDone
+	if failed {
+		status = xsapiv1.DeployStatusFailed
+	}
+	d.mutex.Lock()
+	dep.Status = status
+	dep.EndedAt = time.Now().Format(time.RFC3339)
+	d.mutex.Unlock()
+
+	d.Log.Infof("Deployment %s on target %s %s", dep.ID, dep.Target, status)
+	d.notify(dep)
+}
+
+// runStep copies files (first step) or executes an install command on target
+func (d *Deployments) runStep(dep *xsapiv1.Deploy, idx int, ssh string, env []string, timeoutS int) (int, error) {
+	fld := d.mfolders.Get(dep.FolderID)
+	if fld == nil {
+		return -1, fmt.Errorf("unknown folder %s", dep.FolderID)
+	}
+	fc := (*fld).GetConfig()
+
+	st := dep.Steps[idx]
+	var cmdLine string
+	if idx == 0 {
+		archive, err := d.writeArchive((*fld).GetFullPath(""), dep.Files)
+		if err != nil {
+			return -1, err
+		}
+		defer os.Remove(archive)
+		extract := append([]string{"tar", "-xf", "-", "-C", dep.RemoteDir}, d.fileAttrs.TarExtractArgs()...)
+		for i := range extract {
+			extract[i] = shellQuote(extract[i])
+		}
+		cmdLine = fmt.Sprintf("%s %s < %s", ssh,
+			shellQuote("mkdir -p "+shellQuote(dep.RemoteDir)+" && "+strings.Join(extract, " ")),
+			shellQuote(archive))
+	} else {
+		cmdLine = ssh + " " + shellQuote("cd "+shellQuote(dep.RemoteDir)+" && "+st.Cmd)
+	}
+
+	d.setStep(dep, idx, xsapiv1.DeployStatusRunning, 0, nil)
+
+	env = append([]string{"XDS_DEPLOY_ID=" + dep.ID}, env...)
+	return d.autoBuild.runCommand(fc, st.CmdID, "", cmdLine, env, timeoutS)
+}
+
+// writeArchive writes files to deploy in a temporary archive (files keep their
+// path relative to folder, attributes are set according to server policy)
+func (d *Deployments) writeArchive(root string, files []string) (string, error) {
+	fd, err := ioutil.TempFile("", "xds-deploy-")
+	if err != nil {
+		return "", err
+	}
+	tw := tar.NewWriter(fd)
+	for _, f := range files {
+		if err = d.tarWriteFile(tw, root, f); err != nil {
+			break
+		}
+	}
+	if errC := tw.Close(); err == nil {
+		err = errC
+	}
+	if errC := fd.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	return fd.Name(), nil
+}
+
+// tarWriteFile writes a file (path relative to root) into deployment archive
+func (d *Deployments) tarWriteFile(tw *tar.Writer, root, rel string) error {
+	file := filepath.Join(root, filepath.FromSlash(rel))
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if err := d.fileAttrs.TarHeader(file, fi, hdr); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	rd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = io.CopyN(tw, rd, hdr.Size)
+	return err
+}
+
+// sshCommands returns ssh command line (including destination) used to
+// access a target, credentials are never passed on command line
+func (d *Deployments) sshCommands(t xsapiv1.DeployTarget) (string, []string, func(), error) {
+	nop := func() {}
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	opts := rsyncSSHOptions
+	prefix := ""
+	env := []string{}
+	cleanup := nop
+
+	if t.Secret != "" {
+		secret, err := d.secrets.Get(t.Secret)
+		if err != nil {
+			return "", nil, nop, err
+		}
+		if strings.HasPrefix(secret, "-----BEGIN") {
+			// SSH private key
+			fd, err := ioutil.TempFile("", "xds-deploy-key-")
+			if err != nil {
+				return "", nil, nop, err
+			}
+			keyFile := fd.Name()
+			cleanup = func() { os.Remove(keyFile) }
+			_, err = fd.WriteString(secret + "\n")
+			fd.Close()
+			if err == nil {
+				err = os.Chmod(keyFile, 0600)
+			}
+			if err != nil {
+				cleanup()
+				return "", nil, nop, err
+			}
+			opts = "-i " + shellQuote(keyFile) + " -o IdentitiesOnly=yes " + opts
+		} else {
+			// Password (passed to sshpass using environment)
+			prefix = "sshpass -e "
+			opts = "-o StrictHostKeyChecking=accept-new"
+			env = append(env, "SSHPASS="+secret)
+		}
+	}
+
+	ssh := fmt.Sprintf("%sssh -p %d %s %s", prefix, port, opts, shellQuote(t.User+"@"+t.Host))
+	return ssh, env, cleanup, nil
+}
+
+// setStep updates status of a deployment step and notifies it
+func (d *Deployments) setStep(dep *xsapiv1.Deploy, idx int, status string, code int, err error) {
+	d.mutex.Lock()
+	st := &dep.Steps[idx]
+	st.Status = status
+	st.ExitCode = code
+	if err != nil {
+		st.Error = err.Error()
+	}
+	d.mutex.Unlock()
+	d.notify(dep)
+}
+
+// notify emits deployment status event
+func (d *Deployments) notify(dep *xsapiv1.Deploy) {
+	d.mutex.Lock()
+	msg := *copyDeploy(dep)
+	d.mutex.Unlock()
+	if err := d.events.Emit(xsapiv1.EVTDeploy, msg, ""); err != nil {
+		d.LogSillyf("Cannot notify deployment %s: %v", dep.ID, err)
+	}
+}
+
+// cleanupUnsafe forgets oldest finished deployments (mutex must be locked)
+func (d *Deployments) cleanupUnsafe() {
+	for i := 0; len(d.deploys) > deployMaxHistory && i < len(d.deploys); {
+		if d.deploys[i].Status == xsapiv1.DeployStatusRunning {
+			i++
+			continue
+		}
+		d.deploys = append(d.deploys[:i], d.deploys[i+1:]...)
+	}
+}
+
+// load reads registered targets from disk
+func (d *Deployments) load() {
+	file, err := xdsconfig.DeployTargetsConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		d.Log.Errorf("Cannot read deployment targets: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlDeployTargets{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		d.Log.Errorf("Cannot decode deployment targets: %v", err)
+		return
+	}
+	d.targets = data.Targets
+}
+
+// save writes registered targets on disk (mutex must be locked)
+func (d *Deployments) save() error {
+	file, err := xdsconfig.DeployTargetsConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlDeployTargets{Version: "1", Targets: d.targets})
+}
+
+// deployFiles returns files of a folder (relative paths) matching patterns
+func deployFiles(root string, patterns []string) ([]string, error) {
+	pats := [][]string{}
+	for _, p := range patterns {
+		pats = append(pats, artifactsPatternSegs(p))
+	}
+	files := []string{}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && tarSkipNames[fi.Name()] {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		segs := strings.Split(filepath.ToSlash(rel), "/")
+		for _, pat := range pats {
+			if globSegs(pat, segs) {
+				if len(files) >= deployMaxFiles {
+					return errDeployTooMany
+				}
+				files = append(files, filepath.ToSlash(rel))
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// copyDeploy returns a deep copy of a deployment
+func copyDeploy(dep *xsapiv1.Deploy) *xsapiv1.Deploy {
+	res := *dep
+	res.Files = append([]string{}, dep.Files...)
+	res.Steps = append([]xsapiv1.DeployStep{}, dep.Steps...)
+	return &res
+}
@@ -19,33 +19,111 @@ package xdsserver
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/googollee/go-socket.io"
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
 )
 
+const eventHistorySize = 100     // Maximum number of events kept per event type
+const eventStreamQueueSize = 256 // Maximum number of events waiting to be sent to a subscriber
+const eventCmdSeqMax = 1000      // Maximum number of commands which events sequence is kept
+
 // EventDef Definition on one event
 type EventDef struct {
-	sids map[string]int
+	sids    map[string]int
+	filters map[string]*EventFilter
+}
+
+// EventFilter Restricts events sent to a session (each criteria only applies
+// to events that refer to a folder, a SDK or a command)
+type EventFilter struct {
+	OwnFolders bool            // only folders owned by session (not only shared)
+	FolderIDs  map[string]bool // only these folders (all when empty)
+	SdkIDs     map[string]bool // only these SDKs (all when empty)
+	CmdIDs     map[string]bool // only these commands (all when empty)
 }
 
 // Events Hold registered events per context
 type Events struct {
 	*Context
-	eventsMap map[string]*EventDef
+	eventsMap   map[string]*EventDef
+	history     map[string]*eventHistory // last emitted events (per event type)
+	seq         uint64                   // sequence number of last emitted event
+	cmdSeqs     map[string]uint64        // sequence number of last event of commands
+	cmdSeqOrder []string                 // commands of cmdSeqs, oldest first
+	histMutex   sync.Mutex
+	subscribers map[*EventSubscriber]bool
+	subMutex    sync.Mutex
+	clients     map[string]*eventClient // WebSocket streams of sessions
+	cliMutex    sync.Mutex
+}
+
+// eventClient Events sent to a session over WebSocket
+type eventClient struct {
+	version int    // negotiated payload version
+	seq     uint64 // sequence number of last event sent
+	mutex   sync.Mutex
+}
+
+// EventSubscriber Receives events emitted while subscribed (see GET
+// /events/stream), Lost is closed when events have been dropped because
+// subscriber didn't read them fast enough
+type EventSubscriber struct {
+	C      chan xsapiv1.EventMsg
+	Lost   chan struct{}
+	sid    string
+	types  map[string]bool // all types when empty
+	filter *EventFilter
+	seq    uint64 // sequence number of last event sent
+	lost   bool
+}
+
+// eventHistory Last emitted events of a type
+type eventHistory struct {
+	entries   []eventHistoryEntry // oldest first
+	dropped   uint64              // sequence number of last event removed from history
+	droppedAt time.Time
+}
+
+// eventHistoryEntry Emitted event kept in history
+type eventHistoryEntry struct {
+	msg  xsapiv1.EventMsg
+	time time.Time
+	sid  string // only returned to this session (empty: all sessions)
+}
+
+// EventHistoryFilter Selects events returned from history
+type EventHistoryFilter struct {
+	Types     []string  // event types (all when empty)
+	Since     uint64    // only events following this sequence number
+	CmdID     string    // only events of this command (ignored when empty)
+	SinceTime time.Time // only events emitted after this date (ignored when zero)
 }
 
 // NewEvents creates an instance of Events
 func NewEvents(ctx *Context) *Events {
 	evMap := make(map[string]*EventDef)
+	history := make(map[string]*eventHistory)
 	for _, ev := range xsapiv1.EVTAllList {
 		evMap[ev] = &EventDef{
-			sids: make(map[string]int),
+			sids:    make(map[string]int),
+			filters: make(map[string]*EventFilter),
 		}
+		history[ev] = &eventHistory{}
 	}
 	return &Events{
-		Context:   ctx,
-		eventsMap: evMap,
+		Context:     ctx,
+		eventsMap:   evMap,
+		history:     history,
+		cmdSeqs:     make(map[string]uint64),
+		histMutex:   sync.NewMutex(),
+		subscribers: make(map[*EventSubscriber]bool),
+		subMutex:    sync.NewMutex(),
+		clients:     make(map[string]*eventClient),
+		cliMutex:    sync.NewMutex(),
 	}
 }
 
@@ -55,7 +133,8 @@ func (e *Events) GetList() []string {
 }
 
 // Register Used by a client/session to register to a specific (or all) event(s)
-func (e *Events) Register(evName, sessionID string) error {
+// (filter, that may be nil, replaces the one set by a previous registration)
+func (e *Events) Register(evName, sessionID string, filter *EventFilter) error {
 	evs := xsapiv1.EVTAllList
 	if evName != xsapiv1.EVTAll {
 		if _, ok := e.eventsMap[evName]; !ok {
@@ -65,10 +144,48 @@ func (e *Events) Register(evName, sessionID string) error {
 	}
 	for _, ev := range evs {
 		e.eventsMap[ev].sids[sessionID]++
+		if filter != nil {
+			e.eventsMap[ev].filters[sessionID] = filter
+		} else {
+			delete(e.eventsMap[ev].filters, sessionID)
+		}
 	}
 	return nil
 }
 
+// Negotiate sets payload version of events sent to a session: highest
+// version supported by both client (versions) and server
+func (e *Events) Negotiate(sessionID string, versions []int) (int, error) {
+	version := 0
+	if len(versions) == 0 {
+		// Clients that don't announce versions only support initial format
+		version = xsapiv1.EventVersion1
+	}
+	for _, v := range versions {
+		for _, sv := range xsapiv1.EventVersionsSupported {
+			if v == sv && v > version {
+				version = v
+			}
+		}
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("Unsupported event versions %v (server supports %v)", versions, xsapiv1.EventVersionsSupported)
+	}
+
+	cl := e.client(sessionID)
+	cl.mutex.Lock()
+	cl.version = version
+	cl.mutex.Unlock()
+	return version, nil
+}
+
+// SessionClosed releases events stream of a closed session
+func (e *Events) SessionClosed(sid string) {
+	e.cliMutex.Lock()
+	delete(e.clients, sid)
+	e.cliMutex.Unlock()
+}
+
 // UnRegister Used by a client/session to un-register event(s)
 func (e *Events) UnRegister(evName, sessionID string) error {
 	evs := xsapiv1.EVTAllList
@@ -81,6 +198,7 @@ func (e *Events) UnRegister(evName, sessionID string) error {
 	for _, ev := range evs {
 		if _, exist := e.eventsMap[ev].sids[sessionID]; exist {
 			delete(e.eventsMap[ev].sids, sessionID)
+			delete(e.eventsMap[ev].filters, sessionID)
 			break
 		}
 	}
@@ -95,10 +213,30 @@ func (e *Events) Emit(evName string, data interface{}, fromSid string) error {
 		return fmt.Errorf("Unsupported event type")
 	}
 
+	// Kept in history even when not delivered
+	msg := e.record(evName, data, fromSid, "")
+
+	if e.chaos.dropEvent(evName) {
+		return nil
+	}
+
+	// Also notified to webhooks, MQTT broker and event streams (even when no
+	// session registered)
+	if e.webhooks != nil {
+		e.webhooks.Notify(msg)
+	}
+	if e.mqtt != nil {
+		e.mqtt.Publish(msg)
+	}
+	e.publish(msg, "")
+
 	firstErr = nil
 	evm := e.eventsMap[evName]
 	e.LogSillyf("Emit Event %s: len(sids)=%d, data=%v", evName, len(evm.sids), data)
 	for sid := range evm.sids {
+		if !e.accepted(evm.filters[sid], sid, data) {
+			continue
+		}
 		so := e.sessions.IOSocketGet(sid)
 		if so == nil {
 			if firstErr == nil {
@@ -106,14 +244,8 @@ func (e *Events) Emit(evName string, data interface{}, fromSid string) error {
 			}
 			continue
 		}
-		msg := xsapiv1.EventMsg{
-			Time:          time.Now().String(),
-			FromSessionID: fromSid,
-			Type:          evName,
-			Data:          data,
-		}
 		e.Log.Debugf("Emit Event %s: %v", evName, sid)
-		if err := (*so).Emit(evName, msg); err != nil {
+		if err := e.emitSocket(sid, so, msg); err != nil {
 			e.Log.Errorf("WS Emit %v error : %v", evName, err)
 			if firstErr == nil {
 				firstErr = err
@@ -123,3 +255,394 @@ func (e *Events) Emit(evName string, data interface{}, fromSid string) error {
 
 	return firstErr
 }
+
+// EmitSession emits an event only to one session (when registered to it)
+func (e *Events) EmitSession(evName string, data interface{}, sid string) error {
+	evm, ok := e.eventsMap[evName]
+	if !ok {
+		return fmt.Errorf("Unsupported event type")
+	}
+	msg := e.record(evName, data, sid, sid)
+	e.publish(msg, sid)
+	if _, registered := evm.sids[sid]; !registered {
+		return nil
+	}
+	so := e.sessions.IOSocketGet(sid)
+	if so == nil {
+		return fmt.Errorf("IOSocketGet return nil (SID=%v)", sid)
+	}
+	e.Log.Debugf("Emit Event %s: %v", evName, sid)
+	return e.emitSocket(sid, so, msg)
+}
+
+// History returns events emitted after filter.Since that a session can see
+// (events are filtered using filter set on registration)
+func (e *Events) History(sid string, filter EventHistoryFilter) (*xsapiv1.EventHistory, error) {
+	return e.historyGet(sid, filter, func(evName string) *EventFilter {
+		return e.eventsMap[evName].filters[sid]
+	})
+}
+
+// Subscribe returns a subscriber that receives events of types (all when
+// empty) that pass filter (may be nil), Unsubscribe must be called once done
+func (e *Events) Subscribe(sid string, types []string, filter *EventFilter) (*EventSubscriber, error) {
+	sub := EventSubscriber{
+		C:      make(chan xsapiv1.EventMsg, eventStreamQueueSize),
+		Lost:   make(chan struct{}),
+		sid:    sid,
+		types:  make(map[string]bool),
+		filter: filter,
+	}
+	for _, evName := range types {
+		if _, ok := e.eventsMap[evName]; !ok {
+			return nil, fmt.Errorf("Unsupported event type name '%s'", evName)
+		}
+		sub.types[evName] = true
+	}
+
+	e.subMutex.Lock()
+	e.subscribers[&sub] = true
+	e.subMutex.Unlock()
+	return &sub, nil
+}
+
+// Unsubscribe stops sending events to a subscriber
+func (e *Events) Unsubscribe(sub *EventSubscriber) {
+	e.subMutex.Lock()
+	delete(e.subscribers, sub)
+	e.subMutex.Unlock()
+}
+
+// Replay returns events of history following since that a subscriber would
+// have received
+func (e *Events) Replay(sub *EventSubscriber, since uint64) (*xsapiv1.EventHistory, error) {
+	filter := EventHistoryFilter{Since: since}
+	for evName := range sub.types {
+		filter.Types = append(filter.Types, evName)
+	}
+	return e.historyGet(sub.sid, filter, func(evName string) *EventFilter {
+		return sub.filter
+	})
+}
+
+/*** Private functions ***/
+
+// historyGet returns events of history matching filter, flt returns filter
+// of session for an event type
+func (e *Events) historyGet(sid string, filter EventHistoryFilter, flt func(evName string) *EventFilter) (*xsapiv1.EventHistory, error) {
+	types := filter.Types
+	if len(types) == 0 {
+		types = xsapiv1.EVTAllList
+	}
+	for _, evName := range types {
+		if _, ok := e.eventsMap[evName]; !ok {
+			return nil, fmt.Errorf("Unsupported event type name '%s'", evName)
+		}
+	}
+
+	e.histMutex.Lock()
+	entries := []eventHistoryEntry{}
+	res := xsapiv1.EventHistory{LastSeq: e.seq, Events: []xsapiv1.EventMsg{}}
+	for _, evName := range types {
+		h := e.history[evName]
+		if h.dropped > filter.Since && (filter.SinceTime.IsZero() || h.droppedAt.After(filter.SinceTime)) {
+			res.Truncated = true
+		}
+		for _, ent := range h.entries {
+			if ent.msg.Seq <= filter.Since || (!filter.SinceTime.IsZero() && !ent.time.After(filter.SinceTime)) {
+				continue
+			}
+			if ent.sid != "" && ent.sid != sid {
+				continue
+			}
+			if filter.CmdID != "" && ent.msg.CmdID != filter.CmdID {
+				continue
+			}
+			entries = append(entries, ent)
+		}
+	}
+	e.histMutex.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].msg.Seq < entries[j].msg.Seq })
+	for _, ent := range entries {
+		if !e.accepted(flt(ent.msg.Type), sid, ent.msg.Data) {
+			continue
+		}
+		res.Events = append(res.Events, ent.msg)
+	}
+	return &res, nil
+}
+
+// client returns WebSocket events stream of a session
+func (e *Events) client(sid string) *eventClient {
+	e.cliMutex.Lock()
+	defer e.cliMutex.Unlock()
+	cl, exist := e.clients[sid]
+	if !exist {
+		cl = &eventClient{version: xsapiv1.EventVersion1, mutex: sync.NewMutex()}
+		e.clients[sid] = cl
+	}
+	return cl
+}
+
+// emitSocket numbers and sends an event over WebSocket of a session (events
+// of a session are sent in stream sequence order)
+func (e *Events) emitSocket(sid string, so *socketio.Socket, msg xsapiv1.EventMsg) error {
+	cl := e.client(sid)
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.seq++
+	msg.StreamSeq = cl.seq
+	return (*so).Emit(msg.Type, msg.Format(cl.version))
+}
+
+// publish sends an event to subscribers (only to subscribers of session
+// onlySid when set)
+func (e *Events) publish(msg xsapiv1.EventMsg, onlySid string) {
+	e.subMutex.Lock()
+	defer e.subMutex.Unlock()
+
+	for sub := range e.subscribers {
+		if sub.lost || (onlySid != "" && sub.sid != onlySid) {
+			continue
+		}
+		if len(sub.types) > 0 && !sub.types[msg.Type] {
+			continue
+		}
+		if !e.accepted(sub.filter, sub.sid, msg.Data) {
+			continue
+		}
+		sub.seq++
+		msg.StreamSeq = sub.seq
+		select {
+		case sub.C <- msg:
+		default:
+			e.Log.Warningf("Events stream of session %s too slow, events dropped", sub.sid)
+			sub.lost = true
+			close(sub.Lost)
+		}
+	}
+}
+
+// record numbers an event and keeps it in history of its type (only returned
+// to session onlySid when set)
+func (e *Events) record(evName string, data interface{}, fromSid, onlySid string) xsapiv1.EventMsg {
+	e.histMutex.Lock()
+	defer e.histMutex.Unlock()
+
+	e.seq++
+	now := time.Now()
+	msg := xsapiv1.EventMsg{
+		Version:       xsapiv1.EventVersionLatest,
+		Time:          now.String(),
+		Seq:           e.seq,
+		FromSessionID: fromSid,
+		Type:          evName,
+		Data:          data,
+	}
+	if ids := eventCmdIDs(data); len(ids) == 1 && ids[0] != "" {
+		msg.CmdID = ids[0]
+		msg.CmdSeq = e.cmdSeqNextUnsafe(ids[0])
+	}
+	h := e.history[evName]
+	h.entries = append(h.entries, eventHistoryEntry{msg: msg, time: now, sid: onlySid})
+	if len(h.entries) > eventHistorySize {
+		h.dropped, h.droppedAt = h.entries[0].msg.Seq, h.entries[0].time
+		h.entries = h.entries[1:]
+	}
+	return msg
+}
+
+// accepted returns true when an event passes session filter (events of
+// folders and commands are only accepted for sessions that can see them)
+func (e *Events) accepted(flt *EventFilter, sid string, data interface{}) bool {
+	if !e.cmdVisible(sid, data) {
+		return false
+	}
+	if fldID := eventFolderID(data); fldID != "" && !e.folderAccepted(flt, sid, fldID, data) {
+		return false
+	}
+	if flt == nil {
+		return true
+	}
+	if len(flt.SdkIDs) > 0 && !eventIDsAccepted(flt.SdkIDs, eventSdkIDs(data)) {
+		return false
+	}
+	if len(flt.CmdIDs) > 0 && !eventIDsAccepted(flt.CmdIDs, eventCmdIDs(data)) {
+		return false
+	}
+	return true
+}
+
+// cmdVisible returns false when an event of a command (exit, problem) cannot
+// be seen by a session (see execVisible)
+func (e *Events) cmdVisible(sid string, data interface{}) bool {
+	cmdID := ""
+	switch d := data.(type) {
+	case xsapiv1.ExecExitMsg:
+		cmdID = d.CmdID
+	case xsapiv1.ExecProblem:
+		cmdID = d.CmdID
+	default:
+		return true
+	}
+	return e.execHistory != nil && e.execCmdVisible(cmdID, sid)
+}
+
+// eventIDsAccepted returns true when event doesn't refer to any ID or when
+// one of them is part of filter
+func eventIDsAccepted(flt map[string]bool, ids []string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		if flt[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdSeqNextUnsafe returns sequence number of next event of a command (history
+// mutex must be locked)
+func (e *Events) cmdSeqNextUnsafe(cmdID string) uint64 {
+	if _, exist := e.cmdSeqs[cmdID]; !exist {
+		e.cmdSeqOrder = append(e.cmdSeqOrder, cmdID)
+		if len(e.cmdSeqOrder) > eventCmdSeqMax {
+			delete(e.cmdSeqs, e.cmdSeqOrder[0])
+			e.cmdSeqOrder = e.cmdSeqOrder[1:]
+		}
+	}
+	e.cmdSeqs[cmdID]++
+	return e.cmdSeqs[cmdID]
+}
+
+// folderAccepted returns true when an event of a folder can be seen by a
+// session (folder is accessible) and passes session filter (may be nil)
+func (e *Events) folderAccepted(flt *EventFilter, sid, fldID string, data interface{}) bool {
+	if flt != nil && len(flt.FolderIDs) > 0 && !flt.FolderIDs[fldID] {
+		return false
+	}
+
+	// Use event data when possible (IOW folder may have been deleted)
+	var fc xsapiv1.FolderConfig
+	switch d := data.(type) {
+	case xsapiv1.FolderConfig:
+		fc = d
+	case *xsapiv1.FolderConfig:
+		fc = *d
+	default:
+		if e.mfolders == nil {
+			return false
+		}
+		f := e.mfolders.Get(fldID)
+		if f == nil {
+			return false
+		}
+		fc = (*f).GetConfig()
+	}
+	access := e.clientFolderAccess(fc, sid)
+	if access == "" {
+		return false
+	}
+	if flt != nil && flt.OwnFolders {
+		return access == xsapiv1.FolderAccessOwner
+	}
+	return true
+}
+
+// eventFolderID returns the ID of folder an event data refers to
+// (empty string when not a folder event)
+func eventFolderID(data interface{}) string {
+	switch d := data.(type) {
+	case xsapiv1.FolderConfig:
+		return d.ID
+	case *xsapiv1.FolderConfig:
+		return d.ID
+	case xsapiv1.FolderConflict:
+		return d.FolderID
+	case xsapiv1.FolderSyncProgress:
+		return d.FolderID
+	case xsapiv1.FolderFileChanges:
+		return d.FolderID
+	case xsapiv1.FolderDiskUsage:
+		return d.FolderID
+	case xsapiv1.FolderAutoBuildMsg:
+		return d.FolderID
+	case xsapiv1.Build:
+		return d.FolderID
+	case xsapiv1.ExecJob:
+		return d.FolderID
+	case xsapiv1.Matrix:
+		return d.FolderID
+	case xsapiv1.Deploy:
+		return d.FolderID
+	case xsapiv1.CmdSchedule:
+		return d.FolderID
+	case xsapiv1.ExecHookMsg:
+		return d.FolderID
+	case xsapiv1.ExecProblem:
+		return d.FolderID
+	case xsapiv1.ExecExitMsg:
+		return d.FolderID
+	}
+	return ""
+}
+
+// eventSdkIDs returns the IDs of SDKs an event data refers to
+func eventSdkIDs(data interface{}) []string {
+	switch d := data.(type) {
+	case xsapiv1.SDK:
+		return []string{d.ID}
+	case *xsapiv1.SDK:
+		return []string{d.ID}
+	case xsapiv1.SDKManagementMsg:
+		return []string{d.Sdk.ID}
+	case xsapiv1.CmdSchedule:
+		if d.SdkID != "" {
+			return []string{d.SdkID}
+		}
+	case xsapiv1.Matrix:
+		ids := []string{}
+		for _, r := range d.Runs {
+			ids = append(ids, r.SdkID)
+		}
+		return ids
+	}
+	return nil
+}
+
+// eventCmdIDs returns the IDs of commands an event data refers to
+func eventCmdIDs(data interface{}) []string {
+	switch d := data.(type) {
+	case xsapiv1.SDKManagementMsg:
+		return []string{d.CmdID}
+	case xsapiv1.ExecJob:
+		return []string{d.CmdID}
+	case xsapiv1.ExecHookMsg:
+		return []string{d.CmdID}
+	case xsapiv1.ExecProblem:
+		return []string{d.CmdID}
+	case xsapiv1.ExecExitMsg:
+		return []string{d.CmdID}
+	case xsapiv1.FolderAutoBuildMsg:
+		return []string{d.CmdID}
+	case xsapiv1.Build:
+		ids := []string{}
+		for _, st := range d.Steps {
+			if st.CmdID != "" {
+				ids = append(ids, st.CmdID)
+			}
+		}
+		return ids
+	case xsapiv1.Matrix:
+		ids := []string{}
+		for _, r := range d.Runs {
+			if r.CmdID != "" {
+				ids = append(ids, r.CmdID)
+			}
+		}
+		return ids
+	}
+	return nil
+}
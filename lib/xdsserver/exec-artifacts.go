@@ -0,0 +1,353 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const artifactsMaxCommands = 100 // Number of commands whose artifacts are kept (oldest are released)
+const artifactsMaxFiles = 5000   // Maximum number of files collected for a command
+
+var errArtifactsTooMany = fmt.Errorf("too many artifacts (limit %d files)", artifactsMaxFiles)
+
+// Artifacts Files collected after commands exit, contents are saved in store
+type Artifacts struct {
+	*Context
+	cmds  []*xsapiv1.ExecArtifacts // oldest first
+	mutex sync.Mutex
+}
+
+type xmlArtifacts struct {
+	XMLName  xml.Name                 `xml:"exec-artifacts"`
+	Version  string                   `xml:"version,attr"`
+	Commands []*xsapiv1.ExecArtifacts `xml:"command"`
+}
+
+// NewArtifacts creates a new instance of Artifacts
+func NewArtifacts(ctx *Context) *Artifacts {
+	a := Artifacts{
+		Context: ctx,
+		cmds:    []*xsapiv1.ExecArtifacts{},
+		mutex:   sync.NewMutex(),
+	}
+	a.load()
+	return &a
+}
+
+// CheckPatterns returns an error when an artifact pattern is invalid
+func (a *Artifacts) CheckPatterns(patterns []string) error {
+	for _, p := range patterns {
+		segs := artifactsPatternSegs(p)
+		if filepath.IsAbs(p) || len(segs) == 0 {
+			return fmt.Errorf("invalid artifact pattern '%s': must be relative to project", p)
+		}
+		for _, s := range segs {
+			if s == ".." {
+				return fmt.Errorf("invalid artifact pattern '%s': must not lead outside of project", p)
+			}
+			if _, err := filepath.Match(s, ""); err != nil {
+				return fmt.Errorf("invalid artifact pattern '%s': %v", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Collect saves files of a folder matching patterns
+func (a *Artifacts) Collect(cmdID, folderID, root string, patterns []string) *xsapiv1.ExecArtifacts {
+	arts := &xsapiv1.ExecArtifacts{
+		CmdID:     cmdID,
+		FolderID:  folderID,
+		Patterns:  patterns,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Files:     []xsapiv1.ExecArtifact{},
+	}
+	pats := [][]string{}
+	for _, p := range patterns {
+		pats = append(pats, artifactsPatternSegs(p))
+	}
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && tarSkipNames[fi.Name()] {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		segs := strings.Split(rel, "/")
+		for _, pat := range pats {
+			if !globSegs(pat, segs) {
+				continue
+			}
+			if len(arts.Files) >= artifactsMaxFiles {
+				return errArtifactsTooMany
+			}
+			// Attributes saved according to server policy (see FileAttrs)
+			hdr := tar.Header{}
+			if err := a.fileAttrs.TarHeader(path, fi, &hdr); err != nil {
+				return err
+			}
+			blob, err := a.store.PutFile(path)
+			if err != nil {
+				return err
+			}
+			art := xsapiv1.ExecArtifact{
+				Path:    rel,
+				Size:    fi.Size(),
+				Mode:    uint32(a.fileAttrs.Mode(fi).Perm()),
+				ModTime: fi.ModTime().Format(time.RFC3339),
+				Digest:  blob.Digest,
+				UID:     hdr.Uid,
+				GID:     hdr.Gid,
+			}
+			names := []string{}
+			for name := range hdr.Xattrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				art.Xattrs = append(art.Xattrs, xsapiv1.ExecArtifactXattr{
+					Name:  name,
+					Value: base64.StdEncoding.EncodeToString([]byte(hdr.Xattrs[name])),
+				})
+			}
+			arts.Files = append(arts.Files, art)
+			break
+		}
+		return nil
+	})
+	if err != nil {
+		a.Log.Errorf("Error while collecting artifacts of command %s: %v", cmdID, err)
+		arts.Error = err.Error()
+	}
+	a.Log.Infof("%d artifact(s) collected for command %s", len(arts.Files), cmdID)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.cmds = append(a.cmds, arts)
+	for len(a.cmds) > artifactsMaxCommands {
+		a.releaseUnsafe(a.cmds[0])
+		a.cmds = a.cmds[1:]
+	}
+	if err := a.save(); err != nil {
+		a.Log.Errorf("Cannot save artifacts index: %v", err)
+	}
+	return arts
+}
+
+// Get returns artifacts of a command
+func (a *Artifacts) Get(cmdID string) *xsapiv1.ExecArtifacts {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, arts := range a.cmds {
+		if arts.CmdID == cmdID {
+			return arts
+		}
+	}
+	return nil
+}
+
+// WriteArchive writes an archive of all artifacts of a command
+func (a *Artifacts) WriteArchive(w io.Writer, format string, arts *xsapiv1.ExecArtifacts) error {
+	switch format {
+	case xsapiv1.ArchiveFormatTar:
+		tw := tar.NewWriter(w)
+		err := a.tarWrite(tw, arts)
+		if errC := tw.Close(); err == nil {
+			err = errC
+		}
+		return err
+
+	case xsapiv1.ArchiveFormatTarGz:
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		err := a.tarWrite(tw, arts)
+		if errC := tw.Close(); err == nil {
+			err = errC
+		}
+		if errC := gz.Close(); err == nil {
+			err = errC
+		}
+		return err
+
+	case xsapiv1.ArchiveFormatZip:
+		zw := zip.NewWriter(w)
+		err := a.zipWrite(zw, arts)
+		if errC := zw.Close(); err == nil {
+			err = errC
+		}
+		return err
+	}
+	return fmt.Errorf("unsupported archive format '%s'", format)
+}
+
+/*** Private functions ***/
+
+// artifactsPatternSegs splits a pattern into path segments
+func artifactsPatternSegs(pattern string) []string {
+	p := strings.Trim(filepath.ToSlash(strings.TrimSpace(pattern)), "/")
+	if p == "" {
+		return []string{}
+	}
+	segs := []string{}
+	for _, s := range strings.Split(p, "/") {
+		if s != "" && s != "." {
+			segs = append(segs, s)
+		}
+	}
+	return segs
+}
+
+func (a *Artifacts) tarWrite(tw *tar.Writer, arts *xsapiv1.ExecArtifacts) error {
+	for _, f := range arts.Files {
+		mt, _ := time.Parse(time.RFC3339, f.ModTime)
+		hdr := &tar.Header{
+			Name:     f.Path,
+			Mode:     int64(f.Mode),
+			Uid:      f.UID,
+			Gid:      f.GID,
+			Size:     f.Size,
+			ModTime:  mt,
+			Typeflag: tar.TypeReg,
+		}
+		if len(f.Xattrs) > 0 {
+			hdr.Xattrs = make(map[string]string)
+			for _, xa := range f.Xattrs {
+				if val, err := base64.StdEncoding.DecodeString(xa.Value); err == nil {
+					hdr.Xattrs[xa.Name] = string(val)
+				}
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := a.copyBlob(tw, f.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Artifacts) zipWrite(zw *zip.Writer, arts *xsapiv1.ExecArtifacts) error {
+	for _, f := range arts.Files {
+		hdr := &zip.FileHeader{Name: f.Path, Method: zip.Deflate}
+		if mt, err := time.Parse(time.RFC3339, f.ModTime); err == nil {
+			hdr.SetModTime(mt)
+		}
+		hdr.SetMode(os.FileMode(f.Mode))
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := a.copyBlob(zf, f.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Artifacts) copyBlob(w io.Writer, digest string) error {
+	rd, err := a.store.Open(digest)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = io.Copy(w, rd)
+	return err
+}
+
+// releaseUnsafe releases store contents of artifacts (mutex must be locked)
+func (a *Artifacts) releaseUnsafe(arts *xsapiv1.ExecArtifacts) {
+	for _, f := range arts.Files {
+		if err := a.store.Release(f.Digest); err != nil {
+			a.Log.Warningf("Cannot release artifact %s of command %s: %v", f.Path, arts.CmdID, err)
+		}
+	}
+}
+
+// load reads artifacts index from disk
+func (a *Artifacts) load() {
+	file, err := xdsconfig.ExecArtifactsFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		a.Log.Errorf("Cannot read artifacts index: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlArtifacts{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		a.Log.Errorf("Cannot decode artifacts index: %v", err)
+		return
+	}
+	for _, arts := range data.Commands {
+		if arts.Files == nil {
+			arts.Files = []xsapiv1.ExecArtifact{}
+		}
+	}
+	a.cmds = data.Commands
+}
+
+// save writes artifacts index on disk (mutex must be locked)
+func (a *Artifacts) save() error {
+	file, err := xdsconfig.ExecArtifactsFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlArtifacts{Version: "1", Commands: a.cmds})
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iotbzh/xds-common/golib/eows"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Environment variable set for every command (inherited by all processes the
+// command spawned, so they can be found even when they changed their group)
+const execCmdIDEnv = "XDS_CMD_ID"
+
+const execCancelDefaultGrace = 10 // Default delay (in seconds) between SIGTERM and SIGKILL
+const execCancelPollTime = 200 * time.Millisecond
+
+// ExecCancels Graceful cancellation of running commands: SIGTERM is sent
+// first, then all remaining processes of command are killed once grace
+// period is elapsed
+type ExecCancels struct {
+	*Context
+	grace      int
+	cancelling map[string]bool
+	mutex      sync.Mutex
+}
+
+// NewExecCancels creates a new instance of ExecCancels
+func NewExecCancels(ctx *Context) *ExecCancels {
+	c := ExecCancels{
+		Context:    ctx,
+		grace:      execCancelDefaultGrace,
+		cancelling: make(map[string]bool),
+		mutex:      sync.NewMutex(),
+	}
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil && cfg.CancelGraceS > 0 {
+		c.grace = cfg.CancelGraceS
+	}
+	return &c
+}
+
+// EnvMarker returns the environment variable that identifies processes of a command
+func (c *ExecCancels) EnvMarker(cmdID string) string {
+	return execCmdIDEnv + "=" + cmdID
+}
+
+// Cancel stops a command (queued commands are removed from scheduler queue),
+// graceS is the delay before processes are killed (0: default delay)
+func (c *ExecCancels) Cancel(cmdID string, graceS int) error {
+	if c.scheduler.IsQueued(cmdID) {
+		_, err := c.scheduler.Cancel(cmdID)
+		return err
+	}
+
+	signal := c.signalFunc(cmdID)
+	if signal == nil && len(execProcesses(cmdID)) == 0 {
+		return fmt.Errorf("unknown cmdID")
+	}
+	if graceS <= 0 {
+		graceS = c.grace
+	}
+
+	c.mutex.Lock()
+	if c.cancelling[cmdID] {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.cancelling[cmdID] = true
+	c.mutex.Unlock()
+
+	c.Log.Infof("Cancel command %s (grace period %d seconds)", cmdID, graceS)
+	if signal != nil {
+		if err := signal("SIGTERM"); err != nil {
+			c.Log.Debugf("Cannot send SIGTERM to command %s: %v", cmdID, err)
+		}
+	}
+	execKill(cmdID, syscall.SIGTERM)
+
+	go c.escalate(cmdID, graceS)
+	return nil
+}
+
+/*** Private functions ***/
+
+// signalFunc returns the function used to signal a running command
+func (c *ExecCancels) signalFunc(cmdID string) func(sig string) error {
+	if c.execPtys.Exists(cmdID) {
+		return func(sig string) error { return c.execPtys.Signal(cmdID, sig, true) }
+	}
+	if e := eows.GetEows(cmdID); e != nil {
+		return e.Signal
+	}
+	if c.nodes.IsRemote(cmdID) {
+		return func(sig string) error { return c.nodes.Signal(cmdID, sig, true) }
+	}
+	return nil
+}
+
+// escalate kills remaining processes of a command once grace period is elapsed
+func (c *ExecCancels) escalate(cmdID string, graceS int) {
+	defer func() {
+		c.mutex.Lock()
+		delete(c.cancelling, cmdID)
+		c.mutex.Unlock()
+	}()
+
+	deadline := time.Now().Add(time.Duration(graceS) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(execCancelPollTime)
+		if c.signalFunc(cmdID) == nil && len(execProcesses(cmdID)) == 0 {
+			c.Log.Debugf("Command %s terminated", cmdID)
+			return
+		}
+	}
+
+	c.Log.Warningf("Command %s still running after %d seconds, kill it", cmdID, graceS)
+	if signal := c.signalFunc(cmdID); signal != nil {
+		if err := signal("SIGKILL"); err != nil {
+			c.Log.Debugf("Cannot send SIGKILL to command %s: %v", cmdID, err)
+		}
+	}
+	execKill(cmdID, syscall.SIGKILL)
+}
+
+// execKill sends a signal to all processes (and their process group) of a command
+func execKill(cmdID string, sig syscall.Signal) {
+	for _, pid := range execProcesses(cmdID) {
+		if pgid, ok := processGroup(pid); ok {
+			processGroupKill(pgid, sig)
+		}
+		processKill(pid, sig)
+	}
+}
+
+// execSignal sends a signal to the main process of a command (shell that
+// executes it) or to all its processes when group is set
+func execSignal(cmdID string, sig syscall.Signal, group bool) error {
+	pids := execProcesses(cmdID)
+	if len(pids) == 0 {
+		return fmt.Errorf("unknown cmdID")
+	}
+	if group {
+		execKill(cmdID, sig)
+		return nil
+	}
+
+	// Main process is the one whose parent is not a process of command
+	isCmd := make(map[int]bool)
+	for _, pid := range pids {
+		isCmd[pid] = true
+	}
+	root := 0
+	for _, pid := range pids {
+		if !isCmd[execParentPid(pid)] && (root == 0 || pid < root) {
+			root = pid
+		}
+	}
+	if root == 0 {
+		return fmt.Errorf("cannot find main process of command %s", cmdID)
+	}
+	return processKill(root, sig)
+}
+
+// execParentPid returns the parent pid of a process (0 on error)
+func execParentPid(pid int) int {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0
+	}
+	// Format: pid (comm) state ppid ..., comm may contain spaces
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
+
+// execProcesses returns pid of processes started by a command (identified
+// using environment variable set for command)
+func execProcesses(cmdID string) []int {
+	marker := []byte(execCmdIDEnv + "=" + cmdID)
+	pids := []int{}
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(d))
+		if err != nil {
+			continue
+		}
+		env, err := ioutil.ReadFile(filepath.Join(d, "environ"))
+		if err != nil {
+			continue
+		}
+		for _, kv := range bytes.Split(env, []byte{0}) {
+			if bytes.Equal(kv, marker) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// ContainerRuntime Container engine used to execute commands in an image
+type ContainerRuntime interface {
+	Name() string
+	Bin() string
+	RunArgs() []string // engine specific options of run command
+}
+
+// dockerRuntime Docker engine (files are created using server uid/gid)
+type dockerRuntime struct {
+	bin string
+}
+
+func (r *dockerRuntime) Name() string { return "docker" }
+func (r *dockerRuntime) Bin() string  { return r.bin }
+func (r *dockerRuntime) RunArgs() []string {
+	return []string{"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+}
+
+// podmanRuntime Podman engine (rootless, server user is mapped in container)
+type podmanRuntime struct {
+	bin string
+}
+
+func (r *podmanRuntime) Name() string      { return "podman" }
+func (r *podmanRuntime) Bin() string       { return r.bin }
+func (r *podmanRuntime) RunArgs() []string { return []string{"--userns=keep-id"} }
+
+// Supported container engines (in order of preference)
+var containerRuntimes = []struct {
+	name   string
+	create func(bin string) ContainerRuntime
+}{
+	{"podman", func(bin string) ContainerRuntime { return &podmanRuntime{bin: bin} }},
+	{"docker", func(bin string) ContainerRuntime { return &dockerRuntime{bin: bin} }},
+}
+
+// containerMount Directory bind mounted in container (at the same path)
+type containerMount struct {
+	dir      string
+	readOnly bool
+}
+
+// containerRun Definition of a command executed in a container
+type containerRun struct {
+	cmdID   string
+	image   string
+	mounts  []containerMount
+	env     []string // NAME=value, only names are passed on command line
+	tty     bool     // allocate a terminal (command executed in a pty)
+	user    string   // uid:gid of command (default: image user)
+	command string   // shell command line
+}
+
+// Containers Execution of commands in container images
+type Containers struct {
+	*Context
+}
+
+// NewContainers creates a new instance of Containers
+func NewContainers(ctx *Context) *Containers {
+	return &Containers{Context: ctx}
+}
+
+// Image returns the image used to execute a command: requested one, default
+// image of SDK or server default image
+func (c *Containers) Image(requested string, sdk *xsapiv1.SDK) (string, error) {
+	cfg := c.Config.FileConf.ContainerConf
+	if requested != "" {
+		if err := c.checkImage(requested); err != nil {
+			return "", err
+		}
+		return requested, nil
+	}
+	if cfg == nil {
+		return "", fmt.Errorf("no container image defined")
+	}
+	if sdk != nil {
+		for _, key := range []string{sdk.ID, sdk.Name, sdk.FamilyConf.FamilyName} {
+			if img, exist := cfg.SdkImages[key]; exist && key != "" {
+				return img, nil
+			}
+		}
+	}
+	if cfg.DefaultImage == "" {
+		return "", fmt.Errorf("no container image defined")
+	}
+	return cfg.DefaultImage, nil
+}
+
+// reImage reference of an image: [registry[:port]/]name[:tag][@digest]
+var reImage = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*(:[0-9]+)?(/[a-z0-9]+([._-][a-z0-9]+)*)*(:[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127})?(@[a-z0-9]+:[a-fA-F0-9]{32,})?$`)
+
+// checkImage checks that an image requested by a client is a valid reference
+// allowed by server config (allowedImages patterns, or else images defined
+// in config)
+func (c *Containers) checkImage(image string) error {
+	if strings.HasPrefix(image, "-") || !reImage.MatchString(image) {
+		return fmt.Errorf("invalid container image '%s'", image)
+	}
+	cfg := c.Config.FileConf.ContainerConf
+	if cfg == nil {
+		return fmt.Errorf("container image '%s' not allowed", image)
+	}
+	if len(cfg.AllowedImages) > 0 {
+		for _, pattern := range cfg.AllowedImages {
+			if ok, _ := path.Match(pattern, image); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("container image '%s' not allowed", image)
+	}
+	if image == cfg.DefaultImage {
+		return nil
+	}
+	for _, img := range cfg.SdkImages {
+		if image == img {
+			return nil
+		}
+	}
+	return fmt.Errorf("container image '%s' not allowed", image)
+}
+
+// Runtime returns the container engine to use
+func (c *Containers) Runtime() (ContainerRuntime, error) {
+	name := ""
+	if cfg := c.Config.FileConf.ContainerConf; cfg != nil {
+		name = cfg.Runtime
+	}
+	for _, r := range containerRuntimes {
+		if name != "" && r.name != name {
+			continue
+		}
+		bin, err := exec.LookPath(r.name)
+		if err == nil {
+			return r.create(bin), nil
+		}
+		if name != "" {
+			return nil, fmt.Errorf("container runtime %s not installed", name)
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("unsupported container runtime '%s'", name)
+	}
+	return nil, fmt.Errorf("commands cannot be executed in a container: docker or podman not installed")
+}
+
+// command wraps a shell command line so that it is executed in a container
+func (c *Containers) command(run containerRun) (string, error) {
+	rt, err := c.Runtime()
+	if err != nil {
+		return "", err
+	}
+
+	name := "xds-" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, run.cmdID)
+
+	args := []string{rt.Bin(), "run", "--rm", "-i", "--init", "--name", name}
+	if run.tty {
+		args = append(args, "-t")
+	}
+	if run.user != "" {
+		args = append(args, "--user", run.user)
+	}
+	args = append(args, rt.RunArgs()...)
+	if cfg := c.Config.FileConf.ContainerConf; cfg != nil {
+		args = append(args, cfg.RunArgs...)
+	}
+	for _, m := range run.mounts {
+		opt := m.dir + ":" + m.dir
+		if m.readOnly {
+			opt += ":ro"
+		}
+		args = append(args, "-v", opt)
+	}
+	// Values are inherited from engine client environment
+	for _, kv := range run.env {
+		if n := strings.SplitN(kv, "=", 2)[0]; n != "" {
+			args = append(args, "-e", n)
+		}
+	}
+	args = append(args, run.image, "/bin/bash", "-c", run.command)
+	c.Log.Debugf("Command %s executed by %s in image %s", run.cmdID, rt.Name(), run.image)
+
+	for i := range args {
+		args[i] = shellQuote(args[i])
+	}
+	return "exec " + strings.Join(args, " "), nil
+}
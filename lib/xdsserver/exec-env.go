@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// execClientEnv returns client environment variables allowed by server
+// config and by request whitelist
+func (ctx *Context) execClientEnv(clientEnv []string, reqPassThrough []string) []string {
+	var srvPassThrough []string
+	mandatory := ctx.mandatoryEnv()
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil {
+		srvPassThrough = cfg.EnvPassThrough
+	}
+
+	env := []string{}
+	for _, kv := range clientEnv {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if name == "" {
+			continue
+		}
+		if _, exist := mandatory[name]; exist {
+			ctx.Log.Debugf("Client env variable %s overridden by server", name)
+			continue
+		}
+		if srvPassThrough != nil && !envNameMatch(name, srvPassThrough) {
+			ctx.Log.Infof("Client env variable %s not allowed by server, ignored", name)
+			continue
+		}
+		if reqPassThrough != nil && !envNameMatch(name, reqPassThrough) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// execServerEnv returns variables set by server for every command (must be
+// appended last to override other definitions)
+func (ctx *Context) execServerEnv() []string {
+	vars := ctx.mandatoryEnv()
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := []string{}
+	for _, name := range names {
+		res = append(res, name+"="+vars[name])
+	}
+	return res
+}
+
+// mandatoryEnv returns variables defined in server config
+func (ctx *Context) mandatoryEnv() map[string]string {
+	res := make(map[string]string)
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil {
+		for name, val := range cfg.Env {
+			res[name] = os.ExpandEnv(val)
+		}
+	}
+	return res
+}
+
+// envNameMatch returns true when a variable name matches one of patterns
+func envNameMatch(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const execHistoryMaxEntries = 1000 // Maximum number of recorded commands (oldest are dropped)
+const execHistoryRecentBuilds = 10 // Number of last executions returned in build statistics
+
+// ExecHistory Persistent history of executed commands
+type ExecHistory struct {
+	*Context
+	entries  []xsapiv1.ExecHistoryEntry // oldest first
+	running  map[string]*execHistoryRun
+	reserved map[string]bool // IDs of commands being prepared (see Reserve)
+	mutex    sync.Mutex
+}
+
+// execHistoryRun Hold a command being executed
+type execHistoryRun struct {
+	entry   xsapiv1.ExecHistoryEntry
+	started time.Time
+}
+
+type xmlExecHistory struct {
+	XMLName xml.Name                   `xml:"exec-history"`
+	Version string                     `xml:"version,attr"`
+	Entries []xsapiv1.ExecHistoryEntry `xml:"command"`
+}
+
+// NewExecHistory creates a new instance of ExecHistory
+func NewExecHistory(ctx *Context) *ExecHistory {
+	h := ExecHistory{
+		Context:  ctx,
+		entries:  []xsapiv1.ExecHistoryEntry{},
+		running:  make(map[string]*execHistoryRun),
+		reserved: make(map[string]bool),
+		mutex:    sync.NewMutex(),
+	}
+	h.load()
+	return &h
+}
+
+// Reserve reserves the ID of a command being prepared, false is returned when
+// ID is already used by a recorded, running or reserved command
+// (reservation ends when command is started or on Release)
+func (h *ExecHistory) Reserve(cmdID string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, exist := h.running[cmdID]; exist || h.reserved[cmdID] {
+		return false
+	}
+	for _, e := range h.entries {
+		if e.CmdID == cmdID {
+			return false
+		}
+	}
+	h.reserved[cmdID] = true
+	return true
+}
+
+// Release cancels reservation of a command ID (no-op once command started)
+func (h *ExecHistory) Release(cmdID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.reserved, cmdID)
+}
+
+// Start records the start of a command
+func (h *ExecHistory) Start(entry xsapiv1.ExecHistoryEntry) {
+	now := time.Now()
+	entry.StartedAt = now.Format(time.RFC3339)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.reserved, entry.CmdID)
+	h.running[entry.CmdID] = &execHistoryRun{entry: entry, started: now}
+}
+
+// End records the exit code and metrics (nil when command has not been
+// started) of a command and saves history
+func (h *ExecHistory) End(cmdID string, code int, metrics *xsapiv1.ExecMetrics) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	run, exist := h.running[cmdID]
+	if !exist {
+		return
+	}
+	delete(h.running, cmdID)
+
+	now := time.Now()
+	run.entry.EndedAt = now.Format(time.RFC3339)
+	run.entry.ExitCode = code
+	run.entry.DurationMs = int64(now.Sub(run.started) / time.Millisecond)
+	run.entry.Metrics = metrics
+
+	h.entries = append(h.entries, run.entry)
+	if len(h.entries) > execHistoryMaxEntries {
+		h.entries = h.entries[len(h.entries)-execHistoryMaxEntries:]
+	}
+
+	if err := h.save(); err != nil {
+		h.Log.Errorf("Cannot save exec history: %v", err)
+	}
+
+	// Hooks of folder are not triggered for commands that have not been started
+	if metrics != nil || code != -1 {
+		h.execHooks.Trigger(run.entry)
+	}
+}
+
+// Running returns commands being executed (or queued)
+func (h *ExecHistory) Running() []xsapiv1.ExecHistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	res := []xsapiv1.ExecHistoryEntry{}
+	for _, run := range h.running {
+		res = append(res, run.entry)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].StartedAt < res[j].StartedAt })
+	return res
+}
+
+// GetRunning returns a command being executed (or queued)
+func (h *ExecHistory) GetRunning(cmdID string) (xsapiv1.ExecHistoryEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	run, exist := h.running[cmdID]
+	if !exist {
+		return xsapiv1.ExecHistoryEntry{}, false
+	}
+	return run.entry, true
+}
+
+// Lookup returns a command being executed or recorded in history
+func (h *ExecHistory) Lookup(cmdID string) (xsapiv1.ExecHistoryEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if run, exist := h.running[cmdID]; exist {
+		return run.entry, true
+	}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].CmdID == cmdID {
+			return h.entries[i], true
+		}
+	}
+	return xsapiv1.ExecHistoryEntry{}, false
+}
+
+// Get returns a page of history (most recent first) of commands accepted by
+// filter function
+func (h *ExecHistory) Get(accept func(e *xsapiv1.ExecHistoryEntry) bool, offset, limit int) xsapiv1.ExecHistory {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	res := xsapiv1.ExecHistory{
+		Offset:  offset,
+		Limit:   limit,
+		Entries: []xsapiv1.ExecHistoryEntry{},
+	}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if !accept(&h.entries[i]) {
+			continue
+		}
+		if res.Total >= offset && len(res.Entries) < limit {
+			res.Entries = append(res.Entries, h.entries[i])
+		}
+		res.Total++
+	}
+	return res
+}
+
+// BuildStats returns metrics of commands executed in a folder aggregated by
+// command line
+func (h *ExecHistory) BuildStats(folderID string) xsapiv1.ExecBuildStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	res := xsapiv1.ExecBuildStats{FolderID: folderID, Commands: []xsapiv1.ExecCmdStats{}}
+	byCmd := make(map[string]int)
+	walls := make(map[string][]int64)
+	usages := make(map[string][4]int64) // user, sys, output, number of executions with metrics
+
+	// Walk most recent first so that Commands is ordered by last execution
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := &h.entries[i]
+		if e.FolderID != folderID {
+			continue
+		}
+		idx, exist := byCmd[e.Cmd]
+		if !exist {
+			idx = len(res.Commands)
+			byCmd[e.Cmd] = idx
+			res.Commands = append(res.Commands, xsapiv1.ExecCmdStats{Cmd: e.Cmd, LastAt: e.EndedAt, Recent: []int64{}})
+		}
+		st := &res.Commands[idx]
+		st.Count++
+		if e.ExitCode != 0 {
+			st.Failed++
+			continue
+		}
+
+		wall := e.DurationMs
+		if e.Metrics != nil {
+			wall = e.Metrics.WallTimeMs
+			u := usages[e.Cmd]
+			usages[e.Cmd] = [4]int64{u[0] + e.Metrics.UserTimeMs, u[1] + e.Metrics.SysTimeMs, u[2] + e.Metrics.OutputBytes, u[3] + 1}
+			if e.Metrics.MaxRSSKb > st.MaxRSSKb {
+				st.MaxRSSKb = e.Metrics.MaxRSSKb
+			}
+		}
+		walls[e.Cmd] = append(walls[e.Cmd], wall)
+	}
+
+	for i := range res.Commands {
+		st := &res.Commands[i]
+		w := walls[st.Cmd] // most recent first
+		n := int64(len(w))
+		if n == 0 {
+			continue
+		}
+		st.LastWallMs = w[0]
+		for j := len(w) - 1; j >= 0; j-- {
+			if len(w)-j <= execHistoryRecentBuilds {
+				st.Recent = append(st.Recent, w[j])
+			}
+		}
+
+		sorted := append([]int64{}, w...)
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		sum := int64(0)
+		for _, v := range sorted {
+			sum += v
+		}
+		st.MinWallMs = sorted[0]
+		st.MaxWallMs = sorted[n-1]
+		st.MedianWallMs = sorted[n/2]
+		st.AvgWallMs = sum / n
+		if u := usages[st.Cmd]; u[3] > 0 {
+			st.AvgUserMs = u[0] / u[3]
+			st.AvgSysMs = u[1] / u[3]
+			st.AvgOutputBytes = u[2] / u[3]
+		}
+		if st.MedianWallMs > 0 {
+			st.TrendPct = float64(st.LastWallMs-st.MedianWallMs) * 100 / float64(st.MedianWallMs)
+		}
+	}
+	return res
+}
+
+/*** Private functions ***/
+
+// load reads history from disk
+func (h *ExecHistory) load() {
+	file, err := xdsconfig.ExecHistoryFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		h.Log.Errorf("Cannot read exec history: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlExecHistory{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		h.Log.Errorf("Cannot decode exec history: %v", err)
+		return
+	}
+	h.entries = data.Entries
+}
+
+// save writes history on disk (mutex must be locked)
+func (h *ExecHistory) save() error {
+	file, err := xdsconfig.ExecHistoryFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlExecHistory{Version: "1", Entries: h.entries})
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const hookDefaultTimeout = 60 // Default maximum duration (in seconds) of a hook
+const hookOutputMax = 1024    // Maximum size of script output reported on failure
+const hookSignatureHeader = "X-XDS-Signature"
+
+// ExecHooks Actions (script, webhook, email) triggered when commands
+// executed in a folder exited (see FolderConfig hooks)
+type ExecHooks struct {
+	*Context
+	disabled bool
+	timeout  time.Duration
+	cfg      *xdsconfig.HooksConf
+	smtp     *xdsconfig.SMTPConf
+	client   *http.Client
+}
+
+// NewExecHooks creates a new instance of ExecHooks
+func NewExecHooks(ctx *Context) *ExecHooks {
+	h := ExecHooks{
+		Context: ctx,
+		timeout: hookDefaultTimeout * time.Second,
+	}
+	h.cfg = ctx.Config.FileConf.HooksConf
+	if cfg := h.cfg; cfg != nil {
+		h.disabled = cfg.Disabled
+		if cfg.TimeoutS > 0 {
+			h.timeout = time.Duration(cfg.TimeoutS) * time.Second
+		}
+		h.smtp = cfg.SMTP
+	}
+	h.client = &http.Client{Timeout: h.timeout}
+	return &h
+}
+
+// Trigger executes (in background) hooks of folder that match exit status
+// of a command
+func (h *ExecHooks) Trigger(entry xsapiv1.ExecHistoryEntry) {
+	if h.disabled {
+		return
+	}
+	f := h.mfolders.Get(entry.FolderID)
+	if f == nil {
+		return
+	}
+	fc := (*f).GetConfig()
+	if len(fc.Hooks) == 0 {
+		return
+	}
+
+	p := xsapiv1.ExecHookPayload{
+		Status:      xsapiv1.HookOnSuccess,
+		FolderID:    fc.ID,
+		FolderLabel: fc.Label,
+		CmdID:       entry.CmdID,
+		Cmd:         entry.Cmd,
+		RPath:       entry.RPath,
+		SdkID:       entry.SdkID,
+		SdkName:     entry.SdkName,
+		SessionID:   entry.SessionID,
+		Node:        entry.Node,
+		StartedAt:   entry.StartedAt,
+		EndedAt:     entry.EndedAt,
+		ExitCode:    entry.ExitCode,
+		DurationMs:  entry.DurationMs,
+	}
+	if entry.ExitCode != 0 {
+		p.Status = xsapiv1.HookOnFailure
+	}
+
+	for _, hook := range fc.Hooks {
+		if hook.On == "" || hook.On == xsapiv1.HookOnAlways || hook.On == p.Status {
+			go h.run(fc, (*f).GetFullPath(""), hook, p)
+		}
+	}
+}
+
+// checkHooksConfig Sanity check of hooks of a folder
+func (f *Folders) checkHooksConfig(cfg *xsapiv1.FolderConfig) error {
+	hc := f.Config.FileConf.HooksConf
+	for i, hook := range cfg.Hooks {
+		name := hook.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+		switch hook.On {
+		case "", xsapiv1.HookOnAlways, xsapiv1.HookOnSuccess, xsapiv1.HookOnFailure:
+		default:
+			return fmt.Errorf("hook %s: invalid trigger '%s'", name, hook.On)
+		}
+		switch hook.Type {
+		case xsapiv1.HookTypeScript:
+			if strings.TrimSpace(hook.Script) == "" {
+				return fmt.Errorf("hook %s: script must be set", name)
+			}
+		case xsapiv1.HookTypeWebhook:
+			u, err := url.Parse(hook.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("hook %s: invalid url", name)
+			}
+			if hook.Secret != "" && !reSecretName.MatchString(hook.Secret) {
+				return fmt.Errorf("hook %s: invalid secret name", name)
+			}
+			if err := hookCheckSecret(hc, hook); err != nil {
+				return fmt.Errorf("hook %s: %v", name, err)
+			}
+		case xsapiv1.HookTypeEmail:
+			if len(hook.To) == 0 {
+				return fmt.Errorf("hook %s: recipients must be set", name)
+			}
+			for _, to := range hook.To {
+				if _, err := mail.ParseAddress(to); err != nil {
+					return fmt.Errorf("hook %s: invalid recipient '%s'", name, to)
+				}
+				if err := hookCheckRecipient(hc, to); err != nil {
+					return fmt.Errorf("hook %s: %v", name, err)
+				}
+			}
+		default:
+			return fmt.Errorf("hook %s: invalid type '%s'", name, hook.Type)
+		}
+	}
+	return nil
+}
+
+/*** Private functions ***/
+
+// hookCheckSecret checks that secret of a webhook is bound to host of its
+// URL (see webhookSecrets of hooks config)
+func hookCheckSecret(cfg *xdsconfig.HooksConf, hook xsapiv1.ExecHook) error {
+	if hook.Secret == "" {
+		return nil
+	}
+	host := ""
+	if u, err := url.Parse(hook.URL); err == nil {
+		host = strings.ToLower(u.Hostname())
+	}
+	if cfg != nil && host != "" {
+		for pattern, name := range cfg.WebhookSecrets {
+			if ok, _ := path.Match(strings.ToLower(pattern), host); ok && name == hook.Secret {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("secret '%s' cannot be used to sign webhooks sent to '%s'", hook.Secret, host)
+}
+
+// hookCheckRecipient checks that address of an email hook recipient is
+// allowed (see emailRecipients of hooks config)
+func hookCheckRecipient(cfg *xdsconfig.HooksConf, to string) error {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient '%s'", to)
+	}
+	if cfg != nil {
+		for _, pattern := range cfg.EmailRecipients {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(addr.Address)); ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("recipient '%s' not allowed", addr.Address)
+}
+
+// run executes a hook and notifies its result
+func (h *ExecHooks) run(fc xsapiv1.FolderConfig, root string, hook xsapiv1.ExecHook, p xsapiv1.ExecHookPayload) {
+	var err error
+	switch hook.Type {
+	case xsapiv1.HookTypeScript:
+		err = h.runScript(fc, root, hook, p)
+	case xsapiv1.HookTypeWebhook:
+		err = h.postWebhook(hook, p)
+	case xsapiv1.HookTypeEmail:
+		err = h.sendEmail(hook, p)
+	default:
+		err = fmt.Errorf("invalid type '%s'", hook.Type)
+	}
+
+	msg := xsapiv1.ExecHookMsg{
+		FolderID:  p.FolderID,
+		CmdID:     p.CmdID,
+		Hook:      hook.Name,
+		Type:      hook.Type,
+		Status:    xsapiv1.HookStatusDone,
+		Timestamp: time.Now().String(),
+	}
+	if err != nil {
+		msg.Status = xsapiv1.HookStatusFailed
+		msg.Error = err.Error()
+		h.Log.Warningf("Hook %s (%s) of command %s failed: %v", hook.Name, hook.Type, p.CmdID, err)
+	} else {
+		h.Log.Debugf("Hook %s (%s) of command %s done", hook.Name, hook.Type, p.CmdID)
+	}
+	if err := h.events.Emit(xsapiv1.EVTExecHook, msg, ""); err != nil {
+		h.Log.Warningf("Cannot notify hook result: %v", err)
+	}
+}
+
+// runScript executes a shell command in folder, metadata of command are set
+// in XDS_HOOK_* variables
+func (h *ExecHooks) runScript(fc xsapiv1.FolderConfig, root string, hook xsapiv1.ExecHook, p xsapiv1.ExecHookPayload) error {
+	cmdLine, err := h.autoBuild.folderCommand(fc, root, "", "", hook.Script)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("/bin/bash", "-c", cmdLine)
+	cmd.Env = append(os.Environ(),
+		"XDS_HOOK_STATUS="+p.Status,
+		"XDS_HOOK_FOLDER_ID="+p.FolderID,
+		"XDS_HOOK_FOLDER_LABEL="+p.FolderLabel,
+		"XDS_HOOK_CMD_ID="+p.CmdID,
+		"XDS_HOOK_CMD="+p.Cmd,
+		"XDS_HOOK_RPATH="+p.RPath,
+		"XDS_HOOK_SDK_ID="+p.SdkID,
+		"XDS_HOOK_EXIT_CODE="+strconv.Itoa(p.ExitCode),
+		"XDS_HOOK_DURATION_MS="+strconv.FormatInt(p.DurationMs, 10),
+		"CLIENT_PROJECT_DIR="+fc.ClientPath,
+	)
+	cmd.Env = append(cmd.Env, h.execServerEnv()...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(h.timeout, func() {
+		h.Log.Warningf("Hook %s of command %s timeout, kill it", hook.Name, p.CmdID)
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		o := out.String()
+		if len(o) > hookOutputMax {
+			o = o[len(o)-hookOutputMax:]
+		}
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(o))
+	}
+	return nil
+}
+
+// postWebhook posts command metadata, payload is signed (HMAC-SHA256) when
+// a secret is set
+func (h *ExecHooks) postWebhook(hook xsapiv1.ExecHook, p xsapiv1.ExecHookPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		// Config may have changed since folder creation
+		if err := hookCheckSecret(h.cfg, hook); err != nil {
+			return err
+		}
+		secret, err := h.secrets.Get(hook.Secret)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(hookSignatureHeader, hookSignature(secret, body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// hookSignature returns value of signature header of a payload
+func hookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendEmail sends a mail that describes command result to recipients
+func (h *ExecHooks) sendEmail(hook xsapiv1.ExecHook, p xsapiv1.ExecHookPayload) error {
+	if h.smtp == nil || h.smtp.Host == "" {
+		return fmt.Errorf("SMTP server not configured")
+	}
+	for _, to := range hook.To {
+		if err := hookCheckRecipient(h.cfg, to); err != nil {
+			return err
+		}
+	}
+	port := h.smtp.Port
+	if port == 0 {
+		port = 25
+	}
+	from := h.smtp.From
+	if from == "" {
+		from = "xds-server@" + h.smtp.Host
+	}
+
+	var auth smtp.Auth
+	if h.smtp.User != "" {
+		passwd, err := h.secrets.Get(h.smtp.Secret)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", h.smtp.User, passwd, h.smtp.Host)
+	}
+
+	result := "succeeded"
+	if p.Status == xsapiv1.HookOnFailure {
+		result = "failed"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(hook.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [XDS] %s: command %s (exit code %d)\r\n", p.FolderLabel, result, p.ExitCode)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Folder:    %s (%s)\r\n", p.FolderLabel, p.FolderID)
+	fmt.Fprintf(&msg, "Command:   %s\r\n", p.Cmd)
+	fmt.Fprintf(&msg, "Directory: %s\r\n", p.RPath)
+	fmt.Fprintf(&msg, "SDK:       %s\r\n", p.SdkName)
+	fmt.Fprintf(&msg, "Command ID: %s\r\n", p.CmdID)
+	fmt.Fprintf(&msg, "Started:   %s\r\n", p.StartedAt)
+	fmt.Fprintf(&msg, "Ended:     %s\r\n", p.EndedAt)
+	fmt.Fprintf(&msg, "Duration:  %d ms\r\n", p.DurationMs)
+	fmt.Fprintf(&msg, "Exit code: %d\r\n", p.ExitCode)
+
+	addr := net.JoinHostPort(h.smtp.Host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, from, hook.To, msg.Bytes())
+}
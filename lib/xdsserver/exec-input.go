@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const execInputQueueLen = 256 // Maximum number of pending writes on command stdin
+
+// ExecInputs Input channels used to send data on stdin of running commands
+// (stdin of command is redirected to a named pipe fed by server)
+type ExecInputs struct {
+	*Context
+	inputs map[string]*execInput
+	mutex  sync.Mutex
+}
+
+// execInput Hold input channel of a command
+type execInput struct {
+	folderID string
+	sid      string // session that started command
+	dir      string
+	fifo     string
+	data     chan string   // closed once EOF has been sent
+	eof      bool          // EOF sent
+	aborted  bool          // command exited
+	done     chan struct{} // closed when feeder ended
+}
+
+// NewExecInputs creates a new instance of ExecInputs
+func NewExecInputs(ctx *Context) *ExecInputs {
+	return &ExecInputs{
+		Context: ctx,
+		inputs:  make(map[string]*execInput),
+		mutex:   sync.NewMutex(),
+	}
+}
+
+// Open creates the input channel of a command and returns the shell prefix
+// that must be added to command line to redirect its stdin
+func (e *ExecInputs) Open(cmdID, sid, folderID string) (string, error) {
+	dir, err := ioutil.TempDir("", "xds-stdin-")
+	if err != nil {
+		return "", err
+	}
+	fifo := filepath.Join(dir, "stdin")
+	if err := mkfifo(fifo); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Cannot create stdin pipe: %v", err)
+	}
+
+	in := &execInput{
+		folderID: folderID,
+		sid:      sid,
+		dir:      dir,
+		fifo:     fifo,
+		data:     make(chan string, execInputQueueLen),
+		done:     make(chan struct{}),
+	}
+
+	e.mutex.Lock()
+	if _, exist := e.inputs[cmdID]; exist {
+		e.mutex.Unlock()
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("command %s already exists", cmdID)
+	}
+	e.inputs[cmdID] = in
+	e.mutex.Unlock()
+
+	go e.feed(cmdID, in)
+
+	return "exec 0<" + shellQuote(fifo) + " && ", nil
+}
+
+// Exists returns true when a command has an input channel
+func (e *ExecInputs) Exists(cmdID string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, exist := e.inputs[cmdID]
+	return exist
+}
+
+// Write sends data on stdin of a command and closes it when eof is set
+func (e *ExecInputs) Write(cmdID, sid, data string, eof bool) error {
+	if data != "" {
+		// Translate paths from client to server
+		if f := e.mfolders.Get(e.folderOf(cmdID)); f != nil {
+			data = (*f).ConvPathCli2Svr(data)
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	in, exist := e.inputs[cmdID]
+	if !exist {
+		return fmt.Errorf("unknown cmdID or command without input channel")
+	}
+	if in.sid != sid {
+		return fmt.Errorf("permission denied on command")
+	}
+	if in.eof {
+		return fmt.Errorf("stdin already closed")
+	}
+	if data != "" {
+		select {
+		case in.data <- data:
+		default:
+			return fmt.Errorf("too much pending data, command doesn't read its stdin")
+		}
+	}
+	if eof {
+		in.eof = true
+		close(in.data)
+	}
+	return nil
+}
+
+// Close releases the input channel of a command (called when command exited)
+func (e *ExecInputs) Close(cmdID string) {
+	e.mutex.Lock()
+	in, exist := e.inputs[cmdID]
+	if exist {
+		delete(e.inputs, cmdID)
+		in.aborted = true
+		if !in.eof {
+			in.eof = true
+			close(in.data)
+		}
+	}
+	e.mutex.Unlock()
+	if !exist {
+		return
+	}
+
+	// Unblock feeder when command never opened its stdin
+	if r, err := os.OpenFile(in.fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+		select {
+		case <-in.done:
+		case <-time.After(time.Second):
+		}
+		r.Close()
+	}
+	os.RemoveAll(in.dir)
+}
+
+/*** Private functions ***/
+
+// folderOf returns the folder ID of a command
+func (e *ExecInputs) folderOf(cmdID string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if in, exist := e.inputs[cmdID]; exist {
+		return in.folderID
+	}
+	return ""
+}
+
+// feed writes queued data on command stdin (pipe is opened for writing once
+// command opened it, so EOF is only sent when command is ready)
+func (e *ExecInputs) feed(cmdID string, in *execInput) {
+	defer close(in.done)
+
+	w, err := os.OpenFile(in.fifo, os.O_WRONLY, 0)
+	if err != nil {
+		e.Log.Errorf("Cannot open stdin of command %s: %v", cmdID, err)
+		return
+	}
+	defer w.Close()
+
+	for data := range in.data {
+		e.mutex.Lock()
+		aborted := in.aborted
+		e.mutex.Unlock()
+		if aborted {
+			continue
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			e.Log.Debugf("Cannot write stdin of command %s: %v", cmdID, err)
+		}
+	}
+}
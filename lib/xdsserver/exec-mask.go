@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Replacement of masked values
+const execMaskText = "***"
+
+// Values shorter than this length are not masked (would garble output)
+const execMaskMinLen = 4
+
+// execMasker Replace secrets (values of sensitive variables and matches of
+// patterns) in command output and history
+type execMasker struct {
+	values   []string
+	patterns []*regexp.Regexp
+}
+
+// execMaskerGet returns the masker of a command executed with env (nil when
+// masking is not configured)
+func (ctx *Context) execMaskerGet(env []string) *execMasker {
+	cfg := ctx.Config.FileConf.ExecConf
+	if cfg == nil || (len(cfg.MaskEnv) == 0 && len(cfg.MaskPatterns) == 0) {
+		return nil
+	}
+
+	m := execMasker{}
+	seen := make(map[string]bool)
+	// Commands inherit server environment
+	for _, kv := range append(os.Environ(), env...) {
+		nv := strings.SplitN(kv, "=", 2)
+		if len(nv) != 2 || len(nv[1]) < execMaskMinLen || seen[nv[1]] {
+			continue
+		}
+		if envNameMatch(nv[0], cfg.MaskEnv) {
+			seen[nv[1]] = true
+			m.values = append(m.values, nv[1])
+		}
+	}
+	// Longest first, so that a value containing another one is fully masked
+	sort.Slice(m.values, func(i, j int) bool { return len(m.values[i]) > len(m.values[j]) })
+
+	for _, p := range cfg.MaskPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			ctx.Log.Warningf("Invalid mask pattern '%s' ignored: %v", p, err)
+			continue
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return &m
+}
+
+// apply returns data with secrets replaced (secrets split across several
+// output chunks are not detected, see applyStream)
+func (m *execMasker) apply(data string) string {
+	if m == nil || data == "" {
+		return data
+	}
+	for _, v := range m.values {
+		data = strings.Replace(data, v, execMaskText, -1)
+	}
+	for _, re := range m.patterns {
+		data = re.ReplaceAllString(data, execMaskText)
+	}
+	return data
+}
+
+// applyStream returns a chunk of a stream with secrets replaced, end of data
+// that may be the beginning of a secret value is held back in tail until
+// next chunk (or flush, IOW apply on tail) so that values split across
+// chunks are also masked
+func (m *execMasker) applyStream(tail *string, data string) string {
+	if m == nil || len(m.values) == 0 {
+		return m.apply(data)
+	}
+	data = m.apply(*tail + data)
+	// Values are sorted longest first
+	cut := len(data) - (len(m.values[0]) - 1)
+	if cut <= 0 {
+		*tail = data
+		return ""
+	}
+	// Don't split a multi-byte character
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	*tail = data[cut:]
+	return data[:cut]
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const execMetricsSampleTime = time.Second // Interval between two samplings of commands processes
+const execMetricsClockTicks = 100         // Kernel clock ticks per second (USER_HZ) used in /proc/<pid>/stat
+
+// ExecMetrics Measure resources (time, CPU, memory, output) used by commands
+type ExecMetrics struct {
+	*Context
+	running map[string]*execMetricsRun
+	mutex   sync.Mutex
+	stop    chan struct{} // signals intentional stop
+}
+
+// execMetricsRun Hold metrics of a running command
+type execMetricsRun struct {
+	started     time.Time
+	outputBytes int64
+	userTicks   int64
+	sysTicks    int64
+	maxRSSKb    int64
+	usage       *execUsage // exact usage, when process has been waited by server
+}
+
+// execUsage Resource usage of a process waited by server
+type execUsage struct {
+	userTimeMs int64
+	sysTimeMs  int64
+	maxRSSKb   int64
+}
+
+// NewExecMetrics creates a new instance of ExecMetrics
+func NewExecMetrics(ctx *Context) *ExecMetrics {
+	m := ExecMetrics{
+		Context: ctx,
+		running: make(map[string]*execMetricsRun),
+		mutex:   sync.NewMutex(),
+		stop:    make(chan struct{}),
+	}
+	go m.sampleLoop()
+	return &m
+}
+
+// Stop stops processes sampling
+func (m *ExecMetrics) Stop() {
+	close(m.stop)
+}
+
+// Start starts measuring a command (wall time starts now)
+func (m *ExecMetrics) Start(cmdID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.running[cmdID] = &execMetricsRun{started: time.Now()}
+}
+
+// AddOutput accounts bytes of output produced by a command
+func (m *ExecMetrics) AddOutput(cmdID string, n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if run, exist := m.running[cmdID]; exist {
+		run.outputBytes += int64(n)
+	}
+}
+
+// SetUsage sets resource usage of a command process waited by server
+// (replaces sampled values)
+func (m *ExecMetrics) SetUsage(cmdID string, usage interface{}) {
+	ru, ok := processUsage(usage)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if run, exist := m.running[cmdID]; exist {
+		run.usage = ru
+	}
+}
+
+// End stops measuring a command and returns its metrics (nil when command
+// has never been started)
+func (m *ExecMetrics) End(cmdID string) *xsapiv1.ExecMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	run, exist := m.running[cmdID]
+	if !exist {
+		return nil
+	}
+	delete(m.running, cmdID)
+
+	return run.metrics()
+}
+
+// Get returns current metrics of a running command (nil when not running)
+func (m *ExecMetrics) Get(cmdID string) *xsapiv1.ExecMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	run, exist := m.running[cmdID]
+	if !exist {
+		return nil
+	}
+	return run.metrics()
+}
+
+/*** Private functions ***/
+
+func (m *ExecMetrics) sampleLoop() {
+	for {
+		select {
+		case <-m.stop:
+			m.Log.Debugln("Stop exec metrics sampleLoop")
+			return
+		case <-time.After(execMetricsSampleTime):
+			m.mutex.Lock()
+			n := len(m.running)
+			m.mutex.Unlock()
+			if n > 0 {
+				m.sample()
+			}
+		}
+	}
+}
+
+// sample updates CPU time and peak memory of running commands using /proc
+// (CPU time of an exited process is accounted in its parent once waited, so
+// the sum of self and children times of living processes never decreases)
+func (m *ExecMetrics) sample() {
+	type procUsage struct {
+		user, sys, rssKb int64
+	}
+	usages := make(map[string]*procUsage)
+	for cmdID, pids := range execProcessesAll() {
+		u := &procUsage{}
+		for _, pid := range pids {
+			user, sys, err := procCPUTicks(pid)
+			if err != nil {
+				continue
+			}
+			u.user += user
+			u.sys += sys
+			if rss := procPeakRSS(pid); rss > u.rssKb {
+				u.rssKb = rss
+			}
+		}
+		usages[cmdID] = u
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for cmdID, run := range m.running {
+		u, exist := usages[cmdID]
+		if !exist {
+			continue
+		}
+		if u.user > run.userTicks {
+			run.userTicks = u.user
+		}
+		if u.sys > run.sysTicks {
+			run.sysTicks = u.sys
+		}
+		if u.rssKb > run.maxRSSKb {
+			run.maxRSSKb = u.rssKb
+		}
+	}
+}
+
+// execProcessesAll returns pid of processes of every command (see execProcesses)
+func execProcessesAll() map[string][]int {
+	prefix := []byte(execCmdIDEnv + "=")
+	res := make(map[string][]int)
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(d))
+		if err != nil {
+			continue
+		}
+		env, err := ioutil.ReadFile(filepath.Join(d, "environ"))
+		if err != nil {
+			continue
+		}
+		for _, kv := range bytes.Split(env, []byte{0}) {
+			if bytes.HasPrefix(kv, prefix) {
+				cmdID := string(kv[len(prefix):])
+				res[cmdID] = append(res[cmdID], pid)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// procCPUTicks returns user and system CPU time (in clock ticks) of a process
+// including its waited children
+func procCPUTicks(pid int) (int64, int64, error) {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	// Skip command name (may contain spaces), next field is state (field 3)
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 15 {
+		return 0, 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	ticks := [4]int64{}
+	for i := range ticks {
+		// utime, stime, cutime and cstime are fields 14 to 17
+		if ticks[i], err = strconv.ParseInt(fields[11+i], 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return ticks[0] + ticks[2], ticks[1] + ticks[3], nil
+}
+
+// procPeakRSS returns peak resident memory (in kB) of a process
+func procPeakRSS(pid int) int64 {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "VmHWM:") {
+			f := strings.Fields(line)
+			if len(f) >= 2 {
+				v, _ := strconv.ParseInt(f[1], 10, 64)
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+// metrics returns metrics measured so far (mutex must be locked)
+func (run *execMetricsRun) metrics() *xsapiv1.ExecMetrics {
+	res := xsapiv1.ExecMetrics{
+		WallTimeMs:  int64(time.Since(run.started) / time.Millisecond),
+		OutputBytes: run.outputBytes,
+	}
+	if run.usage != nil {
+		res.UserTimeMs = run.usage.userTimeMs
+		res.SysTimeMs = run.usage.sysTimeMs
+		res.MaxRSSKb = run.usage.maxRSSKb
+	} else {
+		res.UserTimeMs = run.userTicks * 1000 / execMetricsClockTicks
+		res.SysTimeMs = run.sysTicks * 1000 / execMetricsClockTicks
+		res.MaxRSSKb = run.maxRSSKb
+		res.Sampled = true
+	}
+	return &res
+}
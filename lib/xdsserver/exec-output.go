@@ -0,0 +1,623 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const execOutputBufferSize = 256 * 1024               // Maximum size of output kept per command (oldest chunks are dropped)
+const execOutputRetention = 10 * time.Minute          // Time during which output of exited commands can be replayed
+const execOutputMaxClosed = 100                       // Maximum number of exited commands kept for replay
+const execOutputMaxLogs = 100                         // Maximum number of logs kept in store (spill policy)
+const execOutputLogPrefix = "running-"                // Prefix of log files of running commands
+const execOutputProgressTime = 250 * time.Millisecond // Minimum delay between two progress updates (terminal mode)
+
+// Variables set for commands executed in terminal output mode (tools emit
+// colors even if output is not a tty)
+var execOutTerminalEnv = []string{"TERM=xterm-256color", "CLICOLOR_FORCE=1", "FORCE_COLOR=1"}
+
+// ExecOutputs Numbers output chunks of commands so that clients can
+// reconstruct logs in order (one sequence per command, shared by all streams)
+// and keeps last chunks so that reconnecting clients can request a replay
+type ExecOutputs struct {
+	*Context
+	streams map[string]*execOutStream
+	logsDir string       // log files of running commands (saved in store on exit)
+	logs    []execOutLog // logs saved in store (oldest first)
+	mutex   sync.Mutex
+}
+
+// execOutLog Complete output of a command saved in store (spill policy)
+type execOutLog struct {
+	CmdID     string `xml:"id,attr"`
+	FolderID  string `xml:"folderID"`
+	Digest    string `xml:"digest"`
+	CreatedAt string `xml:"createdAt"`
+}
+
+type xmlExecOutLogs struct {
+	XMLName xml.Name     `xml:"exec-logs"`
+	Version string       `xml:"version,attr"`
+	Logs    []execOutLog `xml:"log"`
+}
+
+// execOutOptions Options of a command output
+type execOutOptions struct {
+	mask   *execMasker // secrets replaced in output (may be nil)
+	limit  int64       // maximum size of sent output (0: unlimited)
+	policy string      // applied when limit is reached (see ExecOutputPolicy*)
+	// Progress lines rewritten using \r are coalesced (terminal output mode)
+	coalesce bool
+	// Client directory of command when compiler diagnostics are parsed
+	// (empty: not parsed)
+	problemsDir string
+}
+
+// execOutStream Hold sequence and replay buffer of a command output
+type execOutStream struct {
+	folderID string
+	seq      uint64
+	last     time.Time            // time of last chunk
+	chunks   []xsapiv1.ExecOutMsg // replay buffer (oldest first)
+	size     int                  // size of data in replay buffer
+	closedAt time.Time            // zero while command is running
+	opts     execOutOptions
+	sent     int64                // size of data sent
+	held     []xsapiv1.ExecOutMsg // last chunks sent on exit (truncate-head policy)
+	heldSize int64
+	trunc    bool     // output limit reached
+	log      *os.File // complete output (spill policy)
+	emit     ExecOutEmitFunc
+	channel  string            // channel of last chunk
+	pending  map[string]string // progress line waiting next update (key: stream)
+	tails    map[string]string // end of output held back to mask secrets split across chunks (key: stream)
+	progress time.Time         // time of last progress update sent
+	flush    *time.Timer       // sends pending progress lines
+	problems *execProblemParser
+	mutex    sync.Mutex // held while chunks are emitted (sequence order is emission order)
+}
+
+// ExecOutEmitFunc Function used to send output events (ExecOutEvent with
+// an ExecOutMsg or ExecOutTruncatedEvent with an ExecOutTruncatedMsg)
+type ExecOutEmitFunc func(evName string, data interface{})
+
+// NewExecOutputs creates a new instance of ExecOutputs
+func NewExecOutputs(ctx *Context) *ExecOutputs {
+	o := ExecOutputs{
+		Context: ctx,
+		streams: make(map[string]*execOutStream),
+		mutex:   sync.NewMutex(),
+	}
+	if dir, err := common.ResolveEnvVar(xdsconfig.DefaultExecLogsDir); err == nil {
+		o.logsDir = dir
+		// Logs of commands running when server stopped are incomplete
+		files, _ := filepath.Glob(filepath.Join(dir, execOutputLogPrefix+"*"))
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+	o.loadLogs()
+	return &o
+}
+
+// execOutOptionsGet returns output options of a command executed with env,
+// limit and policy of request (limit cannot exceed server one) override
+// server defaults
+func (ctx *Context) execOutOptionsGet(env []string, limit int64, policy string) (execOutOptions, error) {
+	opts := execOutOptions{mask: ctx.execMaskerGet(env), policy: xsapiv1.ExecOutputPolicyTruncateTail}
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil {
+		opts.limit = cfg.OutputLimit
+		if cfg.OutputPolicy != "" {
+			opts.policy = cfg.OutputPolicy
+		}
+	}
+	if limit < 0 {
+		return opts, fmt.Errorf("invalid output limit")
+	}
+	if limit > 0 && (opts.limit == 0 || limit < opts.limit) {
+		opts.limit = limit
+	}
+	if policy != "" {
+		opts.policy = policy
+	}
+	switch opts.policy {
+	case xsapiv1.ExecOutputPolicyTruncateTail, xsapiv1.ExecOutputPolicyTruncateHead, xsapiv1.ExecOutputPolicySpill:
+	default:
+		return opts, fmt.Errorf("invalid output policy '%s'", opts.policy)
+	}
+	return opts, nil
+}
+
+// Open starts a new output sequence of a command executed in a folder (used
+// to check access on replay)
+func (o *ExecOutputs) Open(cmdID, folderID string, opts execOutOptions) {
+	st := &execOutStream{folderID: folderID, opts: opts, mutex: sync.NewMutex()}
+	if opts.limit > 0 && opts.policy == xsapiv1.ExecOutputPolicySpill {
+		st.log = o.createLog(cmdID)
+	}
+	if opts.problemsDir != "" {
+		st.problems = newExecProblemParser(cmdID, folderID, opts.problemsDir)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.purgeUnsafe()
+	o.streams[cmdID] = st
+}
+
+// Known returns true when output of a command is still kept
+func (o *ExecOutputs) Known(cmdID string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	_, exist := o.streams[cmdID]
+	return exist
+}
+
+// Mask returns data with secrets of a command masked (used for output that is
+// not sent using Emit)
+func (o *ExecOutputs) Mask(cmdID, data string) string {
+	o.mutex.Lock()
+	st, exist := o.streams[cmdID]
+	o.mutex.Unlock()
+	if !exist {
+		return data
+	}
+	return st.opts.mask.apply(data)
+}
+
+// Emit sends stdout then stderr data of a command as separate chunks (empty
+// data are not sent), chunks are numbered and kept even when emit function
+// cannot deliver them (client disconnected)
+func (o *ExecOutputs) Emit(cmdID, channel, stdout, stderr string, emit ExecOutEmitFunc) {
+	o.mutex.Lock()
+	st, exist := o.streams[cmdID]
+	if !exist || !st.closedAt.IsZero() {
+		st = &execOutStream{mutex: sync.NewMutex()}
+		o.streams[cmdID] = st
+	}
+	o.mutex.Unlock()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, chunk := range []struct{ stream, data string }{
+		{xsapiv1.ExecStreamStdout, stdout},
+		{xsapiv1.ExecStreamStderr, stderr},
+	} {
+		if chunk.data == "" {
+			continue
+		}
+		st.emit = emit
+		st.channel = channel
+		if st.tails == nil {
+			st.tails = make(map[string]string)
+		}
+		tail := st.tails[chunk.stream]
+		chunk.data = st.opts.mask.applyStream(&tail, chunk.data)
+		st.tails[chunk.stream] = tail
+		if chunk.data == "" {
+			continue
+		}
+		o.writeUnsafe(st, cmdID, chunk.stream, chunk.data)
+	}
+}
+
+// writeUnsafe logs, parses and sends a masked chunk of a stream (stream
+// mutex must be locked)
+func (o *ExecOutputs) writeUnsafe(st *execOutStream, cmdID, stream, data string) {
+	if st.log != nil {
+		if _, err := st.log.WriteString(data); err != nil {
+			o.Log.Errorf("Cannot write output log of command %s: %v", cmdID, err)
+			st.log.Close()
+			st.log = nil
+		}
+	}
+
+	// Problems are reported even when output limit is reached
+	if st.problems != nil {
+		st.problems.scan(stream, data, o.emitProblem)
+	}
+
+	if st.opts.coalesce {
+		data = st.coalesceUnsafe(cmdID, stream, data)
+		if data == "" {
+			return
+		}
+	}
+	st.outputUnsafe(cmdID, st.channel, stream, data)
+}
+
+// Last returns sequence number and time of last chunk sent by a command
+// (zero time when no output has been sent)
+func (o *ExecOutputs) Last(cmdID string) (uint64, time.Time) {
+	o.mutex.Lock()
+	st, exist := o.streams[cmdID]
+	o.mutex.Unlock()
+	if !exist {
+		return 0, time.Time{}
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.seq, st.last
+}
+
+// Replay returns kept chunks of a command following sequence number since
+func (o *ExecOutputs) Replay(cmdID string, since uint64) (*xsapiv1.ExecOutReplay, string, error) {
+	o.mutex.Lock()
+	st, exist := o.streams[cmdID]
+	o.mutex.Unlock()
+	if !exist {
+		return nil, "", fmt.Errorf("unknown cmdID or output not available anymore")
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	res := xsapiv1.ExecOutReplay{
+		CmdID:   cmdID,
+		LastSeq: st.seq,
+		Exited:  !st.closedAt.IsZero(),
+		Chunks:  []xsapiv1.ExecOutMsg{},
+	}
+	res.FirstSeq = st.seq + 1
+	if len(st.chunks) > 0 {
+		res.FirstSeq = st.chunks[0].Seq
+	}
+	res.Truncated = since+1 < res.FirstSeq
+	for _, msg := range st.chunks {
+		if msg.Seq > since {
+			res.Chunks = append(res.Chunks, msg)
+		}
+	}
+	return &res, st.folderID, nil
+}
+
+// Close ends output sequence of a command and returns the number of chunks
+// sent (output is kept for replay during execOutputRetention)
+func (o *ExecOutputs) Close(cmdID string) uint64 {
+	o.mutex.Lock()
+	st, exist := o.streams[cmdID]
+	o.mutex.Unlock()
+	if !exist {
+		return 0
+	}
+
+	// Wait chunks being emitted
+	st.mutex.Lock()
+	for _, stream := range []string{xsapiv1.ExecStreamStdout, xsapiv1.ExecStreamStderr} {
+		if tail := st.tails[stream]; tail != "" {
+			delete(st.tails, stream)
+			o.writeUnsafe(st, cmdID, stream, tail)
+		}
+	}
+	st.flushUnsafe(cmdID)
+	if st.problems != nil {
+		st.problems.flush(o.emitProblem)
+	}
+	for _, msg := range st.held {
+		st.sendUnsafe(msg)
+	}
+	st.held = nil
+	logFile := ""
+	if st.log != nil {
+		logFile = st.log.Name()
+		st.log.Close()
+		st.log = nil
+	}
+	st.closedAt = time.Now()
+	seq := st.seq
+	st.mutex.Unlock()
+
+	if logFile != "" {
+		o.saveLog(cmdID, st.folderID, logFile)
+	}
+
+	o.mutex.Lock()
+	o.purgeUnsafe()
+	o.mutex.Unlock()
+	return seq
+}
+
+// LogDigest returns the store digest of complete output of a command (spill
+// policy, available once command exited) and the folder in which command has
+// been executed
+func (o *ExecOutputs) LogDigest(cmdID string) (string, string, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, l := range o.logs {
+		if l.CmdID == cmdID {
+			return l.Digest, l.FolderID, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown cmdID or log not available")
+}
+
+/*** Private functions ***/
+
+// emitProblem notifies a compiler diagnostic found in output of a command
+// (only delivered to sessions that can see command, see Events.accepted)
+func (o *ExecOutputs) emitProblem(pb xsapiv1.ExecProblem) {
+	if err := o.events.Emit(xsapiv1.EVTExecProblem, pb, ""); err != nil {
+		o.Log.Debugf("Cannot notify problem of command %s: %v", pb.CmdID, err)
+	}
+}
+
+// outputUnsafe sends a chunk of a stream, output policy is applied once
+// limit is reached (stream mutex must be locked)
+func (st *execOutStream) outputUnsafe(cmdID, channel, stream, data string) {
+	st.last = time.Now()
+	msg := xsapiv1.ExecOutMsg{
+		CmdID:     cmdID,
+		Timestamp: st.last.String(),
+		Stream:    stream,
+		Channel:   channel,
+	}
+	if stream == xsapiv1.ExecStreamStdout {
+		msg.Stdout = data
+	} else {
+		msg.Stderr = data
+	}
+
+	size := int64(len(data))
+	if st.opts.limit > 0 && st.sent+size > st.opts.limit {
+		st.truncateUnsafe(msg)
+		return
+	}
+	st.sent += size
+	st.sendUnsafe(msg)
+}
+
+// coalesceUnsafe returns data of a stream to send: only last update of lines
+// rewritten using \r is kept and progress updates of current line are sent
+// at most every execOutputProgressTime (stream mutex must be locked)
+func (st *execOutStream) coalesceUnsafe(cmdID, stream, data string) string {
+	data = st.pending[stream] + data
+	delete(st.pending, stream)
+
+	out, tail := "", data
+	if i := strings.LastIndex(data, "\n"); i >= 0 {
+		lines := strings.SplitAfter(data[:i+1], "\n")
+		for j := range lines {
+			lines[j] = execOutLastUpdate(lines[j])
+		}
+		out, tail = strings.Join(lines, ""), data[i+1:]
+	}
+	if !strings.Contains(tail, "\r") {
+		return out + tail
+	}
+
+	tail = execOutLastUpdate(tail)
+	if out == "" && time.Since(st.progress) < execOutputProgressTime {
+		// Wait next update (or flush timer)
+		if st.pending == nil {
+			st.pending = make(map[string]string)
+		}
+		st.pending[stream] = tail
+		if st.flush == nil {
+			st.flush = time.AfterFunc(execOutputProgressTime, func() {
+				st.mutex.Lock()
+				defer st.mutex.Unlock()
+				if st.flush != nil && st.closedAt.IsZero() {
+					st.progress = time.Now()
+					st.flushUnsafe(cmdID)
+				}
+			})
+		}
+		return ""
+	}
+	st.progress = time.Now()
+	return out + tail
+}
+
+// flushUnsafe sends pending progress lines (stream mutex must be locked)
+func (st *execOutStream) flushUnsafe(cmdID string) {
+	if st.flush != nil {
+		st.flush.Stop()
+		st.flush = nil
+	}
+	for _, s := range []string{xsapiv1.ExecStreamStdout, xsapiv1.ExecStreamStderr} {
+		if d := st.pending[s]; d != "" {
+			delete(st.pending, s)
+			st.outputUnsafe(cmdID, st.channel, s, d)
+		}
+	}
+}
+
+// execOutLastUpdate returns the last update of a line rewritten using \r
+// (eg. "\r10%\r20%\n" -> "\r20%\n"), line ending is kept
+func execOutLastUpdate(line string) string {
+	end := ""
+	if strings.HasSuffix(line, "\n") {
+		line, end = line[:len(line)-1], "\n"
+	}
+	trimmed := strings.TrimRight(line, "\r")
+	end = line[len(trimmed):] + end
+	if i := strings.LastIndex(trimmed, "\r"); i >= 0 {
+		trimmed = trimmed[i:]
+	}
+	return trimmed + end
+}
+
+// sendUnsafe numbers a chunk, keeps it for replay and emits it (stream mutex
+// must be locked)
+func (st *execOutStream) sendUnsafe(msg xsapiv1.ExecOutMsg) {
+	st.seq++
+	msg.Seq = st.seq
+	st.chunks = append(st.chunks, msg)
+	st.size += len(msg.Stdout) + len(msg.Stderr)
+	for len(st.chunks) > 1 && st.size > execOutputBufferSize {
+		st.size -= len(st.chunks[0].Stdout) + len(st.chunks[0].Stderr)
+		st.chunks = st.chunks[1:]
+	}
+	st.emit(xsapiv1.ExecOutEvent, msg)
+}
+
+// truncateUnsafe applies output policy to a chunk exceeding output limit
+// (stream mutex must be locked)
+func (st *execOutStream) truncateUnsafe(msg xsapiv1.ExecOutMsg) {
+	if !st.trunc {
+		st.trunc = true
+		st.emit(xsapiv1.ExecOutTruncatedEvent, xsapiv1.ExecOutTruncatedMsg{
+			CmdID:     msg.CmdID,
+			Timestamp: time.Now().String(),
+			Policy:    st.opts.policy,
+			Limit:     st.opts.limit,
+			Seq:       st.seq,
+			LogFile:   st.log != nil,
+		})
+	}
+	if st.opts.policy != xsapiv1.ExecOutputPolicyTruncateHead {
+		return
+	}
+	st.held = append(st.held, msg)
+	st.heldSize += int64(len(msg.Stdout) + len(msg.Stderr))
+	for len(st.held) > 1 && st.heldSize > st.opts.limit {
+		st.heldSize -= int64(len(st.held[0].Stdout) + len(st.held[0].Stderr))
+		st.held = st.held[1:]
+	}
+}
+
+// createLog creates the log file of a running command (nil on error)
+func (o *ExecOutputs) createLog(cmdID string) *os.File {
+	if o.logsDir == "" {
+		o.Log.Warningf("Output of command %s cannot be logged", cmdID)
+		return nil
+	}
+	if err := os.MkdirAll(o.logsDir, 0700); err != nil {
+		o.Log.Errorf("Cannot create output logs directory: %v", err)
+		return nil
+	}
+	fd, err := ioutil.TempFile(o.logsDir, execOutputLogPrefix)
+	if err != nil {
+		o.Log.Errorf("Cannot create output log of command %s: %v", cmdID, err)
+		return nil
+	}
+	return fd
+}
+
+// saveLog moves log file of an exited command into store (oldest logs are
+// released)
+func (o *ExecOutputs) saveLog(cmdID, folderID, file string) {
+	defer os.Remove(file)
+	blob, err := o.store.PutFile(file)
+	if err != nil {
+		o.Log.Errorf("Cannot save output log of command %s: %v", cmdID, err)
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.logs = append(o.logs, execOutLog{
+		CmdID:     cmdID,
+		FolderID:  folderID,
+		Digest:    blob.Digest,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	})
+	for len(o.logs) > execOutputMaxLogs {
+		if err := o.store.Release(o.logs[0].Digest); err != nil {
+			o.Log.Warningf("Cannot release output log of command %s: %v", o.logs[0].CmdID, err)
+		}
+		o.logs = o.logs[1:]
+	}
+	if err := o.saveLogsUnsafe(); err != nil {
+		o.Log.Errorf("Cannot save output logs index: %v", err)
+	}
+}
+
+// loadLogs reads index of logs saved in store
+func (o *ExecOutputs) loadLogs() {
+	file, err := xdsconfig.ExecLogsFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		o.Log.Errorf("Cannot read output logs index: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlExecOutLogs{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		o.Log.Errorf("Cannot decode output logs index: %v", err)
+		return
+	}
+	o.logs = data.Logs
+}
+
+// saveLogsUnsafe writes index of logs saved in store (mutex must be locked)
+func (o *ExecOutputs) saveLogsUnsafe() error {
+	file, err := xdsconfig.ExecLogsFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlExecOutLogs{Version: "1", Logs: o.logs})
+}
+
+// purgeUnsafe forgets output of commands exited for too long (mutex must be locked)
+func (o *ExecOutputs) purgeUnsafe() {
+	type closedStream struct {
+		id       string
+		closedAt time.Time
+	}
+	closed := []closedStream{}
+	for id, st := range o.streams {
+		st.mutex.Lock()
+		closedAt := st.closedAt
+		st.mutex.Unlock()
+		if closedAt.IsZero() {
+			continue
+		}
+		if time.Since(closedAt) > execOutputRetention {
+			delete(o.streams, id)
+			continue
+		}
+		closed = append(closed, closedStream{id: id, closedAt: closedAt})
+	}
+
+	// Too many exited commands: forget oldest ones
+	if len(closed) > execOutputMaxClosed {
+		sort.Slice(closed, func(i, j int) bool { return closed[i].closedAt.Before(closed[j].closedAt) })
+		for _, cs := range closed[:len(closed)-execOutputMaxClosed] {
+			delete(o.streams, cs.id)
+		}
+	}
+}
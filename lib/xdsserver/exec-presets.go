@@ -0,0 +1,294 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Default number of parallel jobs of built-in presets (number of CPUs of
+// machine executing command)
+const execPresetJobs = "$(getconf _NPROCESSORS_ONLN 2>/dev/null || echo 1)"
+
+var execPresetNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+var execPresetParamRe = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// execPresetsBuiltIn Presets always defined by server
+var execPresetsBuiltIn = []xsapiv1.ExecPreset{
+	{
+		Name:        "make",
+		Description: "Build using make (jobs number set to number of CPUs)",
+		Command:     "make -j{{jobs}} {{target}}",
+		Params: []xsapiv1.ExecPresetParam{
+			{Name: "jobs", Description: "number of parallel jobs", Default: execPresetJobs},
+			{Name: "target", Description: "make targets"},
+		},
+	},
+	{
+		Name:        "cmake",
+		Description: "Configure using cmake in build directory then build",
+		Command: "mkdir -p {{buildDir}} && cd {{buildDir}} && " +
+			"cmake -DCMAKE_BUILD_TYPE={{buildType}} {{cmakeArgs}} \"$OLDPWD\" && make -j{{jobs}} {{target}}",
+		Params: []xsapiv1.ExecPresetParam{
+			{Name: "buildDir", Description: "build directory (relative to command directory)", Default: "build", Required: true},
+			{Name: "buildType", Description: "CMAKE_BUILD_TYPE value", Default: "Debug"},
+			{Name: "cmakeArgs", Description: "additional cmake options"},
+			{Name: "jobs", Description: "number of parallel jobs", Default: execPresetJobs},
+			{Name: "target", Description: "make targets"},
+		},
+	},
+	{
+		Name:        "autotools",
+		Description: "Generate configure script (when missing), configure in build directory then build",
+		Command: "([ -x ./configure ] || autoreconf -fi) && mkdir -p {{buildDir}} && cd {{buildDir}} && " +
+			"\"$OLDPWD/configure\" $CONFIGURE_FLAGS {{configureArgs}} && make -j{{jobs}} {{target}}",
+		Params: []xsapiv1.ExecPresetParam{
+			{Name: "buildDir", Description: "build directory (relative to command directory)", Default: "build", Required: true},
+			{Name: "configureArgs", Description: "additional configure options (SDK CONFIGURE_FLAGS are used)"},
+			{Name: "jobs", Description: "number of parallel jobs", Default: execPresetJobs},
+			{Name: "target", Description: "make targets"},
+		},
+	},
+}
+
+// ExecPresets Named command templates, global or defined per folder
+type ExecPresets struct {
+	*Context
+	presets []xsapiv1.ExecPreset // presets defined using REST API
+	mutex   sync.Mutex
+}
+
+type xmlExecPresets struct {
+	XMLName xml.Name             `xml:"exec-presets"`
+	Version string               `xml:"version,attr"`
+	Presets []xsapiv1.ExecPreset `xml:"preset"`
+}
+
+// NewExecPresets creates a new instance of ExecPresets
+func NewExecPresets(ctx *Context) *ExecPresets {
+	p := ExecPresets{
+		Context: ctx,
+		presets: []xsapiv1.ExecPreset{},
+		mutex:   sync.NewMutex(),
+	}
+	p.load()
+	return &p
+}
+
+// List returns presets available in a folder (all global presets when
+// folderID is empty), a folder preset hides global and built-in presets of
+// same name
+func (p *ExecPresets) List(folderID string) []xsapiv1.ExecPreset {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	byName := make(map[string]xsapiv1.ExecPreset)
+	for _, ps := range execPresetsBuiltIn {
+		ps.Scope = xsapiv1.ExecPresetScopeBuiltIn
+		byName[ps.Name] = ps
+	}
+	for _, ps := range p.presets {
+		if ps.FolderID == "" {
+			ps.Scope = xsapiv1.ExecPresetScopeGlobal
+			byName[ps.Name] = ps
+		}
+	}
+	for _, ps := range p.presets {
+		if folderID != "" && ps.FolderID == folderID {
+			ps.Scope = xsapiv1.ExecPresetScopeFolder
+			byName[ps.Name] = ps
+		}
+	}
+
+	res := []xsapiv1.ExecPreset{}
+	for _, ps := range byName {
+		res = append(res, ps)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Get returns the preset used in a folder
+func (p *ExecPresets) Get(name, folderID string) (*xsapiv1.ExecPreset, error) {
+	for _, ps := range p.List(folderID) {
+		if ps.Name == name {
+			return &ps, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown preset %s", name)
+}
+
+// Set creates or replaces a preset (global or of a folder)
+func (p *ExecPresets) Set(ps xsapiv1.ExecPreset) (*xsapiv1.ExecPreset, error) {
+	if err := p.check(ps); err != nil {
+		return nil, err
+	}
+	ps.Scope = ""
+	if ps.Params == nil {
+		ps.Params = []xsapiv1.ExecPresetParam{}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	replaced := false
+	for i := range p.presets {
+		if p.presets[i].Name == ps.Name && p.presets[i].FolderID == ps.FolderID {
+			p.presets[i] = ps
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		p.presets = append(p.presets, ps)
+	}
+	if err := p.save(); err != nil {
+		return nil, fmt.Errorf("Cannot save presets: %v", err)
+	}
+
+	ps.Scope = xsapiv1.ExecPresetScopeGlobal
+	if ps.FolderID != "" {
+		ps.Scope = xsapiv1.ExecPresetScopeFolder
+	}
+	return &ps, nil
+}
+
+// Delete removes a preset (global or of a folder)
+func (p *ExecPresets) Delete(name, folderID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, ps := range p.presets {
+		if ps.Name == name && ps.FolderID == folderID {
+			p.presets = append(p.presets[:i], p.presets[i+1:]...)
+			return p.save()
+		}
+	}
+	for _, ps := range execPresetsBuiltIn {
+		if ps.Name == name {
+			return fmt.Errorf("built-in preset cannot be removed")
+		}
+	}
+	return fmt.Errorf("unknown preset %s", name)
+}
+
+// Render returns command line of a preset using parameters values
+func (p *ExecPresets) Render(ps *xsapiv1.ExecPreset, params map[string]string) (string, error) {
+	values := make(map[string]string)
+	for _, prm := range ps.Params {
+		v, set := params[prm.Name]
+		if !set {
+			v = prm.Default
+		}
+		if prm.Required && strings.TrimSpace(v) == "" {
+			return "", fmt.Errorf("parameter %s of preset %s is required", prm.Name, ps.Name)
+		}
+		values[prm.Name] = v
+	}
+	for name := range params {
+		if _, exist := values[name]; !exist {
+			return "", fmt.Errorf("unknown parameter %s of preset %s", name, ps.Name)
+		}
+	}
+
+	cmd := execPresetParamRe.ReplaceAllStringFunc(ps.Command, func(ref string) string {
+		return values[execPresetParamRe.FindStringSubmatch(ref)[1]]
+	})
+	return strings.TrimSpace(cmd), nil
+}
+
+/*** Private functions ***/
+
+// check validates definition of a preset
+func (p *ExecPresets) check(ps xsapiv1.ExecPreset) error {
+	if !execPresetNameRe.MatchString(ps.Name) {
+		return fmt.Errorf("invalid preset name")
+	}
+	if strings.TrimSpace(ps.Command) == "" {
+		return fmt.Errorf("preset command not set")
+	}
+	declared := make(map[string]bool)
+	for _, prm := range ps.Params {
+		if !execPresetParamRe.MatchString("{{" + prm.Name + "}}") {
+			return fmt.Errorf("invalid parameter name '%s'", prm.Name)
+		}
+		if declared[prm.Name] {
+			return fmt.Errorf("parameter %s declared twice", prm.Name)
+		}
+		declared[prm.Name] = true
+	}
+	for _, m := range execPresetParamRe.FindAllStringSubmatch(ps.Command, -1) {
+		if !declared[m[1]] {
+			return fmt.Errorf("parameter %s used in command is not declared", m[1])
+		}
+	}
+	return nil
+}
+
+// load reads presets from disk
+func (p *ExecPresets) load() {
+	file, err := xdsconfig.ExecPresetsConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		p.Log.Errorf("Cannot read exec presets: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlExecPresets{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		p.Log.Errorf("Cannot decode exec presets: %v", err)
+		return
+	}
+	p.presets = data.Presets
+}
+
+// save writes presets on disk (mutex must be locked)
+func (p *ExecPresets) save() error {
+	file, err := xdsconfig.ExecPresetsConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlExecPresets{Version: "1", Presets: p.presets})
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import "syscall"
+
+// setNice changes CPU priority of a process (exited processes are ignored)
+func setNice(pid, nice int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// setIOPriority changes I/O priority of a process (exited processes are
+// ignored)
+func setIOPriority(pid, class, level int) error {
+	prio := uintptr(class<<ioprioClassShift | level)
+	_, _, e := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), prio)
+	if e != 0 && e != syscall.ESRCH {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes (see ioprio_set(2))
+const (
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+// execPriority CPU and I/O priorities of a command
+type execPriority struct {
+	nice    int
+	ioClass int // 0: unchanged
+	ioLevel int
+}
+
+// execPriorityGet returns priorities of a command (server defaults are used
+// for unset values)
+func (ctx *Context) execPriorityGet(nice *int, ionice string) (execPriority, error) {
+	prio := execPriority{}
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil {
+		prio.nice = cfg.Nice
+		if ionice == "" {
+			ionice = cfg.IONice
+		}
+	}
+	if nice != nil {
+		prio.nice = *nice
+	}
+	if prio.nice < 0 || prio.nice > 19 {
+		return prio, fmt.Errorf("invalid nice value %d (must be between 0 and 19)", prio.nice)
+	}
+	var err error
+	prio.ioClass, prio.ioLevel, err = parseIONice(ionice)
+	return prio, err
+}
+
+// shellPrefix returns shell commands that set priorities of the shell that
+// executes command (inherited by all its processes)
+func (p execPriority) shellPrefix() string {
+	prefix := ""
+	if p.nice != 0 {
+		prefix += "renice -n " + strconv.Itoa(p.nice) + " -p $$ >/dev/null 2>&1; "
+	}
+	if p.ioClass != 0 {
+		prefix += "ionice -c " + strconv.Itoa(p.ioClass) + " -n " + strconv.Itoa(p.ioLevel) + " -p $$ >/dev/null 2>&1; "
+	}
+	return prefix
+}
+
+// execRenice changes priorities of all processes of a running command and
+// returns number of updated processes
+func execRenice(cmdID string, nice *int, ionice string) (int, error) {
+	if nice != nil && (*nice < 0 || *nice > 19) {
+		return 0, fmt.Errorf("invalid nice value %d (must be between 0 and 19)", *nice)
+	}
+	ioClass, ioLevel, err := parseIONice(ionice)
+	if err != nil {
+		return 0, err
+	}
+	pids := execProcesses(cmdID)
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("unknown cmdID or command not running")
+	}
+
+	for _, pid := range pids {
+		if nice != nil {
+			if err := setNice(pid, *nice); err != nil {
+				return 0, fmt.Errorf("cannot set nice of process %d: %v", pid, err)
+			}
+		}
+		if ioClass != 0 {
+			if err := setIOPriority(pid, ioClass, ioLevel); err != nil {
+				return 0, fmt.Errorf("cannot set I/O priority of process %d: %v", pid, err)
+			}
+		}
+	}
+	return len(pids), nil
+}
+
+// parseIONice decodes an I/O priority: idle or best-effort[:level]
+// (realtime class is reserved to root), class is 0 when not set
+func parseIONice(s string) (int, int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+	f := strings.SplitN(s, ":", 2)
+	switch f[0] {
+	case "idle":
+		if len(f) > 1 {
+			return 0, 0, fmt.Errorf("invalid ionice '%s': idle class has no level", s)
+		}
+		return ioprioClassIdle, 0, nil
+	case "best-effort":
+		level := 4
+		if len(f) > 1 {
+			var err error
+			if level, err = strconv.Atoi(f[1]); err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("invalid ionice '%s': level must be between 0 and 7", s)
+			}
+		}
+		return ioprioClassBE, level, nil
+	}
+	return 0, 0, fmt.Errorf("invalid ionice '%s' (must be idle or best-effort[:0-7])", s)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const execProblemsMax = 1000          // Maximum number of problems reported per command
+const execProblemsLineMax = 64 * 1024 // Longer lines are not parsed
+
+// gcc/clang diagnostic: file:line[:column]: [fatal ]error|warning|note: message
+var reExecProblem = regexp.MustCompile(`^(\S[^:]*):(\d+):(?:(\d+):)?\s*(fatal error|error|warning|note):\s*(.*)$`)
+
+// ANSI escape sequences (colored diagnostics)
+var reANSIEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// execProblemParser Scans output of a command for compiler diagnostics
+type execProblemParser struct {
+	cmdID    string
+	folderID string
+	dir      string            // client directory used to resolve relative paths
+	partial  map[string]string // incomplete last line (key: stream)
+	count    int
+}
+
+// newExecProblemParser creates a parser of a command executed in client
+// directory dir
+func newExecProblemParser(cmdID, folderID, dir string) *execProblemParser {
+	return &execProblemParser{
+		cmdID:    cmdID,
+		folderID: folderID,
+		dir:      dir,
+		partial:  make(map[string]string),
+	}
+}
+
+// scan parses complete lines of a stream chunk, found problems are sent
+// using emit function
+func (p *execProblemParser) scan(stream, data string, emit func(pb xsapiv1.ExecProblem)) {
+	data = p.partial[stream] + data
+	i := strings.LastIndex(data, "\n")
+	if i < 0 {
+		if len(data) <= execProblemsLineMax {
+			p.partial[stream] = data
+		} else {
+			delete(p.partial, stream)
+		}
+		return
+	}
+	p.partial[stream] = data[i+1:]
+	for _, line := range strings.Split(data[:i], "\n") {
+		p.parseLine(line, emit)
+	}
+}
+
+// flush parses incomplete last lines (command exited)
+func (p *execProblemParser) flush(emit func(pb xsapiv1.ExecProblem)) {
+	for stream, line := range p.partial {
+		p.parseLine(line, emit)
+		delete(p.partial, stream)
+	}
+}
+
+/*** Private functions ***/
+
+// parseLine emits the problem described by a line (if any)
+func (p *execProblemParser) parseLine(line string, emit func(pb xsapiv1.ExecProblem)) {
+	if p.count >= execProblemsMax || len(line) > execProblemsLineMax {
+		return
+	}
+	line = strings.TrimRight(reANSIEscape.ReplaceAllString(line, ""), "\r")
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	m := reExecProblem.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	pb := xsapiv1.ExecProblem{
+		CmdID:     p.cmdID,
+		FolderID:  p.folderID,
+		Timestamp: time.Now().String(),
+		File:      m[1],
+		Severity:  m[4],
+		Message:   m[5],
+	}
+	pb.Line, _ = strconv.Atoi(m[2])
+	pb.Column, _ = strconv.Atoi(m[3])
+	if pb.Severity == "fatal error" {
+		pb.Severity = xsapiv1.ProblemSeverityError
+	}
+	if !path.IsAbs(pb.File) && p.dir != "" {
+		pb.File = path.Join(p.dir, pb.File)
+	}
+
+	p.count++
+	emit(pb)
+}
@@ -0,0 +1,77 @@
+//go:build windows
+// +build windows
+
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Signals that can be sent to commands (see parseSignal), only KILL is
+// supported on Windows
+var signalNames = map[string]syscall.Signal{
+	"KILL": syscall.SIGKILL,
+}
+
+// ptySysProcAttr returns attributes of commands started in a pty
+func ptySysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
+
+// groupSysProcAttr returns attributes of commands started in their own
+// process group (not supported on Windows)
+func groupSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
+
+// processKill kills a process (other signals are not supported)
+func processKill(pid int, sig syscall.Signal) error {
+	if sig != syscall.SIGKILL {
+		return fmt.Errorf("signal %v not supported on this platform", sig)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// processGroup is not supported on Windows
+func processGroup(pid int) (int, bool) {
+	return 0, false
+}
+
+// processGroupKill kills leader of a process group (process groups are not
+// supported)
+func processGroupKill(pgid int, sig syscall.Signal) error {
+	return processKill(pgid, sig)
+}
+
+// ptySetSize is not supported on Windows
+func ptySetSize(t *os.File, rows, cols int) error {
+	return fmt.Errorf("Cannot set terminal size: not supported on this platform")
+}
+
+// processUsage is not supported on Windows
+func processUsage(usage interface{}) (*execUsage, bool) {
+	return nil, false
+}
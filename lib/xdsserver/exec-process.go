@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Signals that can be sent to commands (see parseSignal)
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"ABRT":  syscall.SIGABRT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// ptySysProcAttr returns attributes of commands started in a pty (session
+// leader with pty as controlling terminal)
+func ptySysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
+
+// groupSysProcAttr returns attributes of commands started in their own
+// process group (see processGroupKill)
+func groupSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// processKill sends a signal to a process
+func processKill(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
+
+// processGroup returns process group of a process (false when process
+// belongs to server group)
+func processGroup(pid int) (int, bool) {
+	pgid, err := syscall.Getpgid(pid)
+	return pgid, err == nil && pgid != syscall.Getpgrp()
+}
+
+// processGroupKill sends a signal to all processes of a process group
+func processGroupKill(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
+
+// ptySetSize sets terminal window size
+func ptySetSize(t *os.File, rows, cols int) error {
+	if rows <= 0 {
+		rows = execPtyDefaultRows
+	}
+	if cols <= 0 {
+		cols = execPtyDefaultCols
+	}
+	ws := struct {
+		row, col, xpixel, ypixel uint16
+	}{uint16(rows), uint16(cols), 0, 0}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, t.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return fmt.Errorf("Cannot set terminal size: %v", errno)
+	}
+	return nil
+}
+
+// processUsage decodes resource usage of a waited process (see
+// os.ProcessState.SysUsage)
+func processUsage(usage interface{}) (*execUsage, bool) {
+	ru, ok := usage.(*syscall.Rusage)
+	if !ok || ru == nil {
+		return nil, false
+	}
+	maxRSS := int64(ru.Maxrss)
+	if runtime.GOOS == "darwin" {
+		maxRSS /= 1024 // bytes on darwin
+	}
+	return &execUsage{
+		userTimeMs: int64(time.Duration(ru.Utime.Nano()) / time.Millisecond),
+		sysTimeMs:  int64(time.Duration(ru.Stime.Nano()) / time.Millisecond),
+		maxRSSKb:   maxRSS,
+	}, true
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kr/pty"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const execPtyDefaultRows = 24
+const execPtyDefaultCols = 80
+const execPtyReadSize = 4096
+
+// ExecPtys Commands running in a pseudo-terminal (output is streamed raw
+// to the client, so curses based tools can be used)
+type ExecPtys struct {
+	*Context
+	ptys  map[string]*execPty
+	mutex sync.Mutex
+}
+
+// execPty Hold a command running in a pseudo-terminal
+type execPty struct {
+	sid    string // session that started command
+	cmd    *exec.Cmd
+	master *os.File
+}
+
+// ExecPtyExitCB Function called once a pty command exited
+type ExecPtyExitCB func(cmdID string, code int, err error)
+
+// NewExecPtys creates a new instance of ExecPtys
+func NewExecPtys(ctx *Context) *ExecPtys {
+	return &ExecPtys{
+		Context: ctx,
+		ptys:    make(map[string]*execPty),
+		mutex:   sync.NewMutex(),
+	}
+}
+
+// Start runs a command line in a new pseudo-terminal
+func (p *ExecPtys) Start(cmdID, sid, cmdLine string, env []string, rows, cols, timeoutS int, exitCB ExecPtyExitCB) error {
+	master, tty, err := pty.Open()
+	if err != nil {
+		return fmt.Errorf("Cannot allocate pty: %v", err)
+	}
+	defer tty.Close()
+
+	if err := ptySetSize(tty, rows, cols); err != nil {
+		master.Close()
+		return err
+	}
+
+	cmd := exec.Command("/bin/bash", "-c", cmdLine)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.SysProcAttr = ptySysProcAttr()
+
+	ep := &execPty{sid: sid, cmd: cmd, master: master}
+
+	p.mutex.Lock()
+	if _, exist := p.ptys[cmdID]; exist {
+		p.mutex.Unlock()
+		master.Close()
+		return fmt.Errorf("command %s already exists", cmdID)
+	}
+	if err := cmd.Start(); err != nil {
+		p.mutex.Unlock()
+		master.Close()
+		return err
+	}
+	p.ptys[cmdID] = ep
+	p.mutex.Unlock()
+
+	go p.run(cmdID, ep, timeoutS, exitCB)
+	return nil
+}
+
+// Exists returns true when a command runs in a pty
+func (p *ExecPtys) Exists(cmdID string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, exist := p.ptys[cmdID]
+	return exist
+}
+
+// Write sends data (raw keystrokes) to a command
+func (p *ExecPtys) Write(cmdID, sid, data string) error {
+	ep, err := p.get(cmdID, sid)
+	if err != nil {
+		return err
+	}
+	_, err = ep.master.Write([]byte(data))
+	return err
+}
+
+// Resize changes terminal size of a command
+func (p *ExecPtys) Resize(cmdID, sid string, rows, cols int) error {
+	ep, err := p.get(cmdID, sid)
+	if err != nil {
+		return err
+	}
+	return ptySetSize(ep.master, rows, cols)
+}
+
+// Signal sends a signal to a command (to all its processes when group is set)
+func (p *ExecPtys) Signal(cmdID, sigName string, group bool) error {
+	p.mutex.Lock()
+	ep, exist := p.ptys[cmdID]
+	p.mutex.Unlock()
+	if !exist {
+		return fmt.Errorf("unknown cmdID")
+	}
+	sig, err := parseSignal(sigName)
+	if err != nil {
+		return err
+	}
+	if !group {
+		return processKill(ep.cmd.Process.Pid, sig)
+	}
+	// Command is session leader, so signal its whole process group
+	return processGroupKill(ep.cmd.Process.Pid, sig)
+}
+
+// Stop kills all running commands
+func (p *ExecPtys) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, ep := range p.ptys {
+		processGroupKill(ep.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+/*** Private functions ***/
+
+func (p *ExecPtys) get(cmdID, sid string) (*execPty, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ep, exist := p.ptys[cmdID]
+	if !exist {
+		return nil, fmt.Errorf("unknown cmdID or command not running in a pty")
+	}
+	if ep.sid != sid {
+		return nil, fmt.Errorf("permission denied on command")
+	}
+	return ep, nil
+}
+
+func (p *ExecPtys) remove(cmdID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.ptys, cmdID)
+}
+
+// run streams terminal output and waits command end
+func (p *ExecPtys) run(cmdID string, ep *execPty, timeoutS int, exitCB ExecPtyExitCB) {
+	timer := time.AfterFunc(time.Duration(timeoutS)*time.Second, func() {
+		p.Log.Warningf("Command %s timeout, kill it", cmdID)
+		processGroupKill(ep.cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	// Read returns an error (EIO) once all processes closed the terminal
+	buf := make([]byte, execPtyReadSize)
+	pending := []byte{}
+	for {
+		n, err := ep.master.Read(buf)
+		if n > 0 {
+			p.execMetrics.AddOutput(cmdID, n)
+			pending = append(pending, buf[:n]...)
+			// Don't split multi-byte characters between two messages
+			cut := utf8ValidPrefix(pending)
+			if cut > 0 {
+				p.emitOutput(cmdID, ep.sid, string(pending[:cut]))
+				pending = append([]byte{}, pending[cut:]...)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(pending) > 0 {
+		p.emitOutput(cmdID, ep.sid, string(pending))
+	}
+
+	err := ep.cmd.Wait()
+	timer.Stop()
+	ep.master.Close()
+	p.remove(cmdID)
+
+	code := 0
+	if err != nil {
+		code = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(interface{ ExitStatus() int }); ok {
+				code = ws.ExitStatus()
+			}
+		}
+	}
+	p.Log.Debugf("Pty command [Cmd ID %s] exited: code %d, error: %v", cmdID, code, err)
+	if ep.cmd.ProcessState != nil {
+		p.execMetrics.SetUsage(cmdID, ep.cmd.ProcessState.SysUsage())
+	}
+
+	if exitCB != nil {
+		exitCB(cmdID, code, err)
+	}
+}
+
+func (p *ExecPtys) emitOutput(cmdID, sid, out string) {
+	p.execOutputs.Emit(cmdID, "", out, "", func(evName string, msg interface{}) {
+		// IO socket can be nil when disconnected (output is kept for replay)
+		so := p.sessions.IOSocketGet(sid)
+		if so == nil {
+			p.Log.Infof("%s not emitted: WS closed (sid:%s, msgid:%s)", evName, sid, cmdID)
+			return
+		}
+		if err := (*so).Emit(evName, msg); err != nil {
+			p.Log.Errorf("WS Emit : %v", err)
+		}
+	})
+}
+
+// utf8ValidPrefix returns the length of buffer without its trailing
+// incomplete UTF-8 sequence (if any)
+func utf8ValidPrefix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if !utf8.FullRune(b[i:]) {
+			return i
+		}
+		break
+	}
+	return len(b)
+}
+
+// parseSignal converts a signal name (eg. SIGINT, INT) or number into a signal
+func parseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return syscall.Signal(n), nil
+	}
+	if sig, exist := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; exist {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", name)
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// execShell Shell that interprets a command and its options
+type execShell struct {
+	name    string   // see ExecShell*
+	options []string // see ExecShellOpt*
+}
+
+// execShellGet returns the shell of a command (server defaults are used for
+// unset values), check is false when shell is not executed on server (eg. in
+// a container)
+func (ctx *Context) execShellGet(name string, options []string, check bool) (execShell, error) {
+	sh := execShell{name: xsapiv1.ExecShellBash, options: []string{}}
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil {
+		if cfg.Shell != "" {
+			sh.name = cfg.Shell
+		}
+		if cfg.ShellOptions != nil {
+			sh.options = cfg.ShellOptions
+		}
+	}
+	if name != "" {
+		sh.name = name
+	}
+	if options != nil {
+		sh.options = options
+	}
+
+	switch sh.name {
+	case xsapiv1.ExecShellBash, xsapiv1.ExecShellSh, xsapiv1.ExecShellZsh:
+		if check {
+			if _, err := exec.LookPath(sh.name); err != nil {
+				return sh, fmt.Errorf("shell %s not installed", sh.name)
+			}
+		}
+	case xsapiv1.ExecShellNone:
+		if len(sh.options) > 0 {
+			return sh, fmt.Errorf("shell options cannot be used without shell")
+		}
+	default:
+		return sh, fmt.Errorf("invalid shell '%s'", sh.name)
+	}
+	for _, opt := range sh.options {
+		switch opt {
+		case xsapiv1.ExecShellOptPipefail, xsapiv1.ExecShellOptErrexit,
+			xsapiv1.ExecShellOptNounset, xsapiv1.ExecShellOptXtrace:
+		default:
+			return sh, fmt.Errorf("invalid shell option '%s'", opt)
+		}
+	}
+	return sh, nil
+}
+
+// isDefault returns true when command is executed as is (by bash without
+// options)
+func (sh execShell) isDefault() bool {
+	return sh.name == xsapiv1.ExecShellBash && len(sh.options) == 0
+}
+
+// command returns the shell command line that executes a command with its
+// arguments using shell (arguments are quoted when there is no shell)
+func (sh execShell) command(cmd string, args []string) string {
+	line := []string{cmd}
+	if sh.name == xsapiv1.ExecShellNone {
+		line[0] = "exec " + shellQuote(cmd)
+	}
+	for _, a := range args {
+		if a == "" {
+			continue
+		}
+		if sh.name == xsapiv1.ExecShellNone {
+			a = shellQuote(a)
+		}
+		line = append(line, a)
+	}
+	if sh.isDefault() || sh.name == xsapiv1.ExecShellNone {
+		return strings.Join(line, " ")
+	}
+
+	shCmd := []string{"exec", sh.name}
+	for _, opt := range sh.options {
+		shCmd = append(shCmd, "-o", opt)
+	}
+	return strings.Join(append(shCmd, "-c", shellQuote(strings.Join(line, " "))), " ")
+}
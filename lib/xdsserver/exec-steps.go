@@ -0,0 +1,269 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Environment variable that holds the path of the pipe used by pipeline
+// script to report step boundaries
+const execStepsFifoEnv = "XDS_STEPS_FIFO"
+
+const execStepsMax = 64 // Maximum number of steps of a pipeline
+
+var execStepEnvRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// ExecSteps Multi-step commands (pipelines): steps are executed sequentially
+// by a shell script that reports step boundaries on a named pipe read by
+// server, so that step events can be sent to client
+type ExecSteps struct {
+	*Context
+	pipelines map[string]*execPipeline
+	mutex     sync.Mutex
+}
+
+// execPipeline Hold steps state of a command
+type execPipeline struct {
+	sid     string // session that started command
+	dir     string
+	fifo    string
+	steps   []xsapiv1.ExecStepMsg
+	started []time.Time
+	done    chan struct{} // closed when reader ended
+}
+
+// NewExecSteps creates a new instance of ExecSteps
+func NewExecSteps(ctx *Context) *ExecSteps {
+	return &ExecSteps{
+		Context:   ctx,
+		pipelines: make(map[string]*execPipeline),
+		mutex:     sync.NewMutex(),
+	}
+}
+
+// Check returns an error when steps definition is invalid
+func (e *ExecSteps) Check(steps []xsapiv1.ExecStep) error {
+	if len(steps) > execStepsMax {
+		return fmt.Errorf("too many steps (max %d)", execStepsMax)
+	}
+	for i, st := range steps {
+		if strings.TrimSpace(st.Cmd) == "" {
+			return fmt.Errorf("command of step %d not set", i)
+		}
+		for _, kv := range st.Env {
+			if !execStepEnvRe.MatchString(kv) {
+				return fmt.Errorf("invalid env variable '%s' of step %d", kv, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Script returns the shell script that executes steps, its exit code is the
+// exit code of the last failed step (0 when all steps succeeded)
+func (e *ExecSteps) Script(steps []xsapiv1.ExecStep) string {
+	lines := []string{"{ exec 9>\"$" + execStepsFifoEnv + "\"; __xds_rc=0; __xds_stop=0"}
+	for i, st := range steps {
+		idx := strconv.Itoa(i)
+		exports := ""
+		for _, kv := range st.Env {
+			nv := strings.SplitN(kv, "=", 2)
+			exports += "export " + nv[0] + "=" + shellQuote(nv[1]) + "\n"
+		}
+		onError := "__xds_stop=1"
+		if st.ContinueOnError {
+			onError = ":"
+		}
+		lines = append(lines,
+			"if [ $__xds_stop = 0 ]; then echo 'start "+idx+"' >&9",
+			"(\n"+exports+st.Cmd+"\n) 9>&-",
+			"__xds_c=$?; echo \"end "+idx+" $__xds_c\" >&9",
+			"if [ $__xds_c != 0 ]; then __xds_rc=$__xds_c; "+onError+"; fi",
+			"else echo 'skip "+idx+"' >&9; fi")
+	}
+	lines = append(lines, "exec 9>&-; exit $__xds_rc; }")
+	return strings.Join(lines, "\n")
+}
+
+// Open creates the pipe used to report step boundaries of a command (owned
+// by user of command when set) and returns the environment variable that
+// must be set for pipeline script
+func (e *ExecSteps) Open(cmdID, sid string, steps []xsapiv1.ExecStep, user *execUser) (string, error) {
+	dir, err := ioutil.TempDir("", "xds-steps-")
+	if err != nil {
+		return "", err
+	}
+	fifo := filepath.Join(dir, "steps")
+	if err := mkfifo(fifo); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Cannot create steps pipe: %v", err)
+	}
+	if user != nil {
+		if err := user.chown(dir, fifo); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	pl := &execPipeline{
+		sid:     sid,
+		dir:     dir,
+		fifo:    fifo,
+		steps:   []xsapiv1.ExecStepMsg{},
+		started: make([]time.Time, len(steps)),
+		done:    make(chan struct{}),
+	}
+	for i, st := range steps {
+		name := st.Name
+		if name == "" {
+			name = "step" + strconv.Itoa(i+1)
+		}
+		pl.steps = append(pl.steps, xsapiv1.ExecStepMsg{
+			CmdID:  cmdID,
+			Index:  i,
+			Name:   name,
+			Status: xsapiv1.BuildStatusPending,
+		})
+	}
+
+	e.mutex.Lock()
+	if _, exist := e.pipelines[cmdID]; exist {
+		e.mutex.Unlock()
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("command %s already exists", cmdID)
+	}
+	e.pipelines[cmdID] = pl
+	e.mutex.Unlock()
+
+	go e.read(cmdID, pl)
+
+	return execStepsFifoEnv + "=" + fifo, nil
+}
+
+// Get returns steps state of a command (nil when command has no steps)
+func (e *ExecSteps) Get(cmdID string) []xsapiv1.ExecStepMsg {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	pl, exist := e.pipelines[cmdID]
+	if !exist {
+		return nil
+	}
+	return append([]xsapiv1.ExecStepMsg{}, pl.steps...)
+}
+
+// Close releases the pipe of a command (called when command exited), step
+// events still being read are sent before returning
+func (e *ExecSteps) Close(cmdID string) {
+	e.mutex.Lock()
+	pl, exist := e.pipelines[cmdID]
+	e.mutex.Unlock()
+	if !exist {
+		return
+	}
+
+	// Unblock reader when command never opened pipe
+	if w, err := os.OpenFile(pl.fifo, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+		w.Close()
+	}
+	select {
+	case <-pl.done:
+	case <-time.After(time.Second):
+	}
+
+	e.mutex.Lock()
+	delete(e.pipelines, cmdID)
+	e.mutex.Unlock()
+	os.RemoveAll(pl.dir)
+}
+
+/*** Private functions ***/
+
+// read decodes step boundaries reported by pipeline script (start <idx>,
+// end <idx> <code> or skip <idx>) and sends step events
+func (e *ExecSteps) read(cmdID string, pl *execPipeline) {
+	defer close(pl.done)
+
+	r, err := os.OpenFile(pl.fifo, os.O_RDONLY, 0)
+	if err != nil {
+		e.Log.Errorf("Cannot open steps pipe of command %s: %v", cmdID, err)
+		return
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(f[1])
+		if err != nil || idx < 0 || idx >= len(pl.steps) {
+			continue
+		}
+
+		e.mutex.Lock()
+		st := &pl.steps[idx]
+		switch f[0] {
+		case "start":
+			st.Status = xsapiv1.BuildStatusRunning
+			pl.started[idx] = time.Now()
+		case "end":
+			st.Status = xsapiv1.BuildStatusDone
+			if len(f) > 2 {
+				st.ExitCode, _ = strconv.Atoi(f[2])
+			}
+			if st.ExitCode != 0 {
+				st.Status = xsapiv1.BuildStatusFailed
+			}
+			st.DurationMs = int64(time.Since(pl.started[idx]) / time.Millisecond)
+		case "skip":
+			st.Status = xsapiv1.BuildStatusSkipped
+		}
+		st.Timestamp = time.Now().String()
+		msg := *st
+		e.mutex.Unlock()
+
+		e.emit(pl.sid, msg)
+	}
+}
+
+// emit sends a step event to the session that started command
+func (e *ExecSteps) emit(sid string, msg xsapiv1.ExecStepMsg) {
+	// IO socket can be nil when disconnected (state can be retrieved using GET /exec/:id)
+	so := e.sessions.IOSocketGet(sid)
+	if so == nil {
+		e.Log.Infof("%s not emitted: WS closed (sid:%s, msgid:%s)", xsapiv1.ExecStepEvent, sid, msg.CmdID)
+		return
+	}
+	if err := (*so).Emit(xsapiv1.ExecStepEvent, msg); err != nil {
+		e.Log.Errorf("WS Emit : %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Tool used to switch to user of commands (util-linux)
+const execUserSwitchCmd = "setpriv"
+
+// execUser Local user that executes commands
+type execUser struct {
+	name string
+	home string
+	uid  int
+	gid  int
+}
+
+// execUserGet returns local user that executes commands of a client user
+// (nil when commands are executed as server user)
+func (ctx *Context) execUserGet(clientUser string) (*execUser, error) {
+	cfg := ctx.Config.FileConf.ExecConf
+	if cfg == nil {
+		return nil, nil
+	}
+	name := cfg.User
+	if local, exist := cfg.UserMap[clientUser]; clientUser != "" && exist {
+		name = local
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("Unknown user '%s' of commands", name)
+		}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if uid == os.Geteuid() {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("commands cannot be executed as user %s: server must be started as root", u.Username)
+	}
+	return &execUser{name: u.Username, home: u.HomeDir, uid: uid, gid: gid}, nil
+}
+
+// execUserRoots returns directories under which trees can be chowned to
+// users of commands
+func (ctx *Context) execUserRoots() []string {
+	roots := []string{ctx.Config.FileConf.ShareRootDir}
+	if ctx.ccache != nil && ctx.ccache.dir != "" {
+		roots = append(roots, ctx.ccache.dir)
+	}
+	if cfg := ctx.Config.FileConf.ExecConf; cfg != nil {
+		for _, r := range cfg.UserRoots {
+			if r, err := common.ResolveEnvVar(r); err == nil && r != "" {
+				roots = append(roots, r)
+			}
+		}
+	}
+	return roots
+}
+
+// pathUnder returns true when path is root or is located under root (symbolic
+// links are resolved)
+func pathUnder(path, root string) bool {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// execUserSetup gives ownership of folder (only output directory of
+// read-only folders) and of other directories written by command to user,
+// directories must be located under shareRootDir, ccache directory or one of
+// userRoots of exec config
+func (ctx *Context) execUserSetup(u *execUser, fc xsapiv1.FolderConfig, root string, dirs ...string) error {
+	if !fc.ReadOnly {
+		dirs = append(dirs, root)
+	} else if fc.OutputPath != "" {
+		out := filepath.Join(root, filepath.FromSlash(fc.OutputPath))
+		if err := os.MkdirAll(out, 0755); err != nil {
+			return fmt.Errorf("Cannot create output directory: %v", err)
+		}
+		dirs = append(dirs, out)
+	}
+	roots := ctx.execUserRoots()
+	for _, dir := range dirs {
+		allowed := false
+		for _, r := range roots {
+			if pathUnder(dir, r) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("commands cannot be executed as user %s: %s is located outside of shareRootDir and userRoots", u.name, dir)
+		}
+		if err := u.chownTree(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// command returns the shell command that executes shCmd as user (user
+// variables of environment are also set)
+func (u *execUser) command(shCmd string) (string, error) {
+	bin, err := exec.LookPath(execUserSwitchCmd)
+	if err != nil {
+		return "", fmt.Errorf("commands cannot be executed as user %s: %s not installed", u.name, execUserSwitchCmd)
+	}
+	args := []string{bin, "--reuid=" + strconv.Itoa(u.uid), "--regid=" + strconv.Itoa(u.gid),
+		"--init-groups", "--", "env", "HOME=" + u.home, "USER=" + u.name, "LOGNAME=" + u.name,
+		"/bin/bash", "-c", shCmd}
+	for i := range args {
+		args[i] = shellQuote(args[i])
+	}
+	return "exec " + strings.Join(args, " "), nil
+}
+
+// chown changes owner of files (not recursive)
+func (u *execUser) chown(paths ...string) error {
+	for _, p := range paths {
+		if err := os.Lchown(p, u.uid, u.gid); err != nil {
+			return fmt.Errorf("Cannot change owner of %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// chownTree gives ownership of a directory tree to user, tree is only walked
+// when its root is not already owned by user
+func (u *execUser) chownTree(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if uid, gid, ok := fileOwner(info); ok && uid == u.uid && gid == u.gid {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		return u.chown(path)
+	})
+}
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// listXattrs returns all extended attributes of a file
+func listXattrs(file string) (map[string]string, error) {
+	res := make(map[string]string)
+
+	sz, err := syscall.Listxattr(file, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return res, nil
+		}
+		return res, fmt.Errorf("Cannot list xattrs of %s: %v", file, err)
+	}
+	if sz == 0 {
+		return res, nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(file, buf); err != nil {
+		return res, fmt.Errorf("Cannot list xattrs of %s: %v", file, err)
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsz, err := syscall.Getxattr(file, name, nil)
+		if err != nil {
+			continue
+		}
+		val := make([]byte, vsz)
+		if vsz, err = syscall.Getxattr(file, name, val); err != nil {
+			continue
+		}
+		res[name] = string(val[:vsz])
+	}
+	return res, nil
+}
+
+// setXattr sets an extended attribute of a file
+func setXattr(file, name, val string) error {
+	return syscall.Setxattr(file, name, []byte(val), 0)
+}
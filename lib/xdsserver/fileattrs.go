@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+// Ownership rules definition
+const (
+	FileOwnerNone = "none" // files belong to server user
+	FileOwnerKeep = "keep" // keep original uid/gid
+	FileOwnerMap  = "map"  // translate uid/gid using ownerMap
+)
+
+// FileAttrs Apply the policy used to preserve file attributes (permissions,
+// ownership and extended attributes) in archive, artifact and deploy operations
+type FileAttrs struct {
+	conf   xdsconfig.FileAttrsConf
+	idsMap map[int]int
+}
+
+// NewFileAttrs creates a new instance of FileAttrs
+func NewFileAttrs(conf *xdsconfig.FileAttrsConf) (*FileAttrs, error) {
+	fa := FileAttrs{
+		conf:   xdsconfig.FileAttrsConf{Owner: FileOwnerNone},
+		idsMap: make(map[int]int),
+	}
+	if conf == nil {
+		return &fa, nil
+	}
+
+	fa.conf = *conf
+	switch fa.conf.Owner {
+	case "":
+		fa.conf.Owner = FileOwnerNone
+	case FileOwnerNone, FileOwnerKeep, FileOwnerMap:
+	default:
+		return &fa, fmt.Errorf("invalid fileAttributes owner rule '%s'", fa.conf.Owner)
+	}
+
+	for from, to := range fa.conf.OwnerMap {
+		f, err1 := strconv.Atoi(from)
+		t, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil {
+			return &fa, fmt.Errorf("invalid fileAttributes ownerMap entry %s:%s (must be numeric ids)", from, to)
+		}
+		fa.idsMap[f] = t
+	}
+	return &fa, nil
+}
+
+// Mode returns the mode that must be applied according to permissions policy
+func (fa *FileAttrs) Mode(fi os.FileInfo) os.FileMode {
+	if !fa.conf.IgnorePerms {
+		return fi.Mode()
+	}
+	if fi.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return fi.Mode()&os.ModeType | 0644
+}
+
+// TarHeader fills attributes of an archive entry from a file
+func (fa *FileAttrs) TarHeader(file string, fi os.FileInfo, hdr *tar.Header) error {
+	m := fa.Mode(fi)
+	hdr.Mode = int64(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		hdr.Mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		hdr.Mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		hdr.Mode |= 01000
+	}
+
+	hdr.Uid, hdr.Gid = 0, 0
+	if uid, gid, ok := fileOwner(fi); ok && fa.conf.Owner != FileOwnerNone {
+		hdr.Uid = fa.mapID(uid)
+		hdr.Gid = fa.mapID(gid)
+	}
+
+	// Xattrs syscalls follow symlinks (would be read from link target)
+	if fa.conf.Xattrs && fi.Mode()&os.ModeSymlink == 0 {
+		xa, err := listXattrs(file)
+		if err != nil {
+			return err
+		}
+		if len(xa) > 0 {
+			hdr.Xattrs = xa
+		}
+	}
+	return nil
+}
+
+// Restore applies attributes of an archive entry on an extracted file
+func (fa *FileAttrs) Restore(file string, hdr *tar.Header) error {
+	fi := hdr.FileInfo()
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(file, fa.Mode(fi)); err != nil {
+			return err
+		}
+	}
+	if fa.conf.Owner != FileOwnerNone {
+		if err := os.Lchown(file, fa.mapID(hdr.Uid), fa.mapID(hdr.Gid)); err != nil {
+			return fmt.Errorf("Cannot restore ownership of %s: %v", file, err)
+		}
+	}
+	// Xattrs syscalls follow symlinks (would be set on link target, which
+	// may be outside of folder)
+	if fa.conf.Xattrs && hdr.Typeflag != tar.TypeSymlink {
+		for name, val := range hdr.Xattrs {
+			if err := setXattr(file, name, val); err != nil {
+				return fmt.Errorf("Cannot restore xattr %s of %s: %v", name, file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Copy applies attributes of src file on dst file
+func (fa *FileAttrs) Copy(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	th, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	if err := fa.TarHeader(src, fi, th); err != nil {
+		return err
+	}
+	return fa.Restore(dst, th)
+}
+
+// TarExtractArgs returns options of tar command used to extract an archive
+// written using TarHeader (eg. on deployment targets)
+func (fa *FileAttrs) TarExtractArgs() []string {
+	args := []string{}
+	if !fa.conf.IgnorePerms {
+		args = append(args, "--preserve-permissions")
+	}
+	if fa.conf.Owner != FileOwnerNone {
+		args = append(args, "--same-owner", "--numeric-owner")
+	} else {
+		args = append(args, "--no-same-owner")
+	}
+	if fa.conf.Xattrs {
+		args = append(args, "--xattrs")
+	}
+	return args
+}
+
+/*** Private functions ***/
+
+func (fa *FileAttrs) mapID(id int) int {
+	if fa.conf.Owner != FileOwnerMap {
+		return id
+	}
+	if n, exist := fa.idsMap[id]; exist {
+		return n
+	}
+	return id
+}
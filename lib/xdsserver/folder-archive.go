@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// ArchiveDir returns the directory of a folder sub-tree to archive and the
+// function used to exclude ignored files
+func (f *Folders) ArchiveDir(id, subPath string) (string, func(rel string, fi os.FileInfo) bool, error) {
+	fc := f.Get(id)
+	if fc == nil {
+		return "", nil, fmt.Errorf("Unknown id")
+	}
+	root := (*fc).GetFullPath("")
+	if root == "" {
+		return "", nil, fmt.Errorf("folder directory not available")
+	}
+
+	// Never go outside of folder
+	sub := strings.TrimPrefix(filepath.Clean("/"+filepath.FromSlash(subPath)), string(filepath.Separator))
+	dir := filepath.Join(root, sub)
+	if !common.IsDir(dir) {
+		return "", nil, fmt.Errorf("directory %s not found in folder", subPath)
+	}
+
+	// Ignore patterns are relative to folder root
+	patterns := []string{}
+	cfg := (*fc).GetConfig()
+	switch cfg.Type {
+	case xsapiv1.TypeCloudSync:
+		if ign, err := f.GetIgnores(id); err == nil {
+			patterns = ign.Expanded
+		} else {
+			f.Log.Warningf("Cannot get ignore patterns of folder %s: %v", id, err)
+		}
+	case xsapiv1.TypeRsync:
+		patterns = cfg.DataRsync.Excludes
+	}
+	ign := newIgnoreMatcher(patterns)
+	skip := func(rel string, fi os.FileInfo) bool {
+		return ign.match(filepath.ToSlash(filepath.Join(sub, rel)))
+	}
+	return dir, skip, nil
+}
+
+// writeArchive writes an archive of a directory using the requested format
+func writeArchive(w io.Writer, format string, fa *FileAttrs, dir string, skip func(rel string, fi os.FileInfo) bool) error {
+	switch format {
+	case xsapiv1.ArchiveFormatTar:
+		tw := tar.NewWriter(w)
+		err := tarWriteTree(tw, fa, dir, skip)
+		if errC := tw.Close(); err == nil {
+			err = errC
+		}
+		return err
+
+	case xsapiv1.ArchiveFormatTarGz:
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		err := tarWriteTree(tw, fa, dir, skip)
+		if errC := tw.Close(); err == nil {
+			err = errC
+		}
+		if errC := gz.Close(); err == nil {
+			err = errC
+		}
+		return err
+
+	case xsapiv1.ArchiveFormatZip:
+		zw := zip.NewWriter(w)
+		err := zipWriteTree(zw, fa, dir, skip)
+		if errC := zw.Close(); err == nil {
+			err = errC
+		}
+		return err
+	}
+	return fmt.Errorf("unsupported archive format '%s'", format)
+}
+
+/*** Private functions ***/
+
+// zipWriteTree writes files of a tree into a zip archive (see tarWriteTree)
+func zipWriteTree(zw *zip.Writer, fa *FileAttrs, root string, skip func(rel string, fi os.FileInfo) bool) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if tarSkipNames[fi.Name()] || (skip != nil && skip(rel, fi)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// zip format only supports directories and regular files
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.SetMode(fa.Mode(fi))
+		if fi.IsDir() {
+			hdr.Name += "/"
+			_, err = zw.CreateHeader(hdr)
+			return err
+		}
+		hdr.Method = zip.Deflate
+
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		_, err = io.Copy(zf, fd)
+		return err
+	})
+}
+
+// ignoreRule Syncthing like ignore pattern
+type ignoreRule struct {
+	segs     []string
+	negate   bool
+	fold     bool
+	anchored bool // pattern starting with '/' only matches from folder root
+}
+
+// ignoreMatcher Match paths against ignore patterns (first matching pattern wins)
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+func newIgnoreMatcher(patterns []string) *ignoreMatcher {
+	m := ignoreMatcher{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "#include") {
+			continue
+		}
+		r := ignoreRule{}
+		for {
+			if strings.HasPrefix(p, "!") {
+				r.negate = true
+				p = p[1:]
+			} else if strings.HasPrefix(p, "(?i)") {
+				r.fold = true
+				p = p[4:]
+			} else if strings.HasPrefix(p, "(?d)") {
+				p = p[4:]
+			} else {
+				break
+			}
+		}
+		if strings.HasPrefix(p, "/") {
+			r.anchored = true
+		}
+		p = strings.Trim(p, "/")
+		if p == "" {
+			continue
+		}
+		if r.fold {
+			p = strings.ToLower(p)
+		}
+		r.segs = strings.Split(p, "/")
+		m.rules = append(m.rules, r)
+	}
+	return &m
+}
+
+// match returns true when a path (relative to folder, '/' separated) is ignored
+func (m *ignoreMatcher) match(rel string) bool {
+	segs := strings.Split(rel, "/")
+	lower := strings.Split(strings.ToLower(rel), "/")
+	for _, r := range m.rules {
+		path := segs
+		if r.fold {
+			path = lower
+		}
+		matched := false
+		if r.anchored {
+			matched = globSegs(r.segs, path)
+		} else {
+			for i := range path {
+				if globSegs(r.segs, path[i:]) {
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// globSegs matches path segments against pattern segments ('**' matches any
+// number of segments)
+func globSegs(pat, path []string) bool {
+	if len(pat) == 0 {
+		return len(path) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if globSegs(pat[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, err := filepath.Match(pat[0], path[0]); err != nil || !ok {
+		return false
+	}
+	return globSegs(pat[1:], path[1:])
+}
@@ -0,0 +1,438 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const autoBuildCheckTime = 2         // Time (in seconds) between two checks of folders state
+const autoBuildPollTime = 10         // Time (in seconds) between two changes checks of not synchronized folders
+const autoBuildDefaultDebounce = 5   // Default delay (in seconds) without changes before a build starts
+const autoBuildDefaultTimeout = 3600 // Default maximum duration (in seconds) of a build
+
+// AutoBuilder Automatically executes folder build command when folder files
+// changed and synchronization is completed
+type AutoBuilder struct {
+	*Context
+	states map[string]*autoBuildState
+	count  int
+	mutex  sync.Mutex
+	stop   chan struct{} // signals intentional stop
+}
+
+// autoBuildState Hold auto build state of a folder
+type autoBuildState struct {
+	inSync      bool
+	fingerprint string    // fingerprint of (matching) files at last check
+	checkedAt   time.Time // date of last fingerprint computation
+	pendingAt   time.Time // date when pending build can start (zero: no pending build)
+	running     bool
+}
+
+// NewAutoBuilder creates a new instance of AutoBuilder
+func NewAutoBuilder(ctx *Context) *AutoBuilder {
+	return &AutoBuilder{
+		Context: ctx,
+		states:  make(map[string]*autoBuildState),
+		mutex:   sync.NewMutex(),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start starts monitoring loop
+func (b *AutoBuilder) Start() {
+	go b.monitorLoop()
+}
+
+// Stop stops monitoring loop
+func (b *AutoBuilder) Stop() {
+	close(b.stop)
+}
+
+/*** Private functions ***/
+
+// checkAutoBuildConfig validates auto build settings of a folder
+func checkAutoBuildConfig(cfg *xsapiv1.FolderConfig) error {
+	ab := cfg.AutoBuild
+	if ab == nil {
+		return nil
+	}
+	if ab.Enabled && strings.TrimSpace(ab.Cmd) == "" {
+		return fmt.Errorf("autoBuild command must be set")
+	}
+	if ab.DebounceS < 0 || ab.TimeoutS < 0 {
+		return fmt.Errorf("invalid autoBuild delays (must be positive)")
+	}
+	if ab.RPath != "" {
+		if _, err := versionRelPath(ab.RPath); err != nil {
+			return fmt.Errorf("autoBuild rpath must be relative to folder")
+		}
+	}
+	return nil
+}
+
+func (b *AutoBuilder) monitorLoop() {
+	for {
+		select {
+		case <-b.stop:
+			b.Log.Debugln("Stop auto build monitorLoop")
+			return
+		case <-time.After(autoBuildCheckTime * time.Second):
+			b.checkAll()
+		}
+	}
+}
+
+// checkAll detects changes of folders with auto build enabled and starts
+// builds once debounce delay is elapsed
+func (b *AutoBuilder) checkAll() {
+	enabled := make(map[string]bool)
+	for _, fc := range b.mfolders.GetConfigArr() {
+		if fc.AutoBuild == nil || !fc.AutoBuild.Enabled {
+			continue
+		}
+		enabled[fc.ID] = true
+		f := b.mfolders.Get(fc.ID)
+		if f == nil {
+			continue
+		}
+		root := (*f).GetFullPath("")
+		now := time.Now()
+
+		b.mutex.Lock()
+		st, exist := b.states[fc.ID]
+		if !exist {
+			// Files present when auto build is enabled are not considered as changes
+			st = &autoBuildState{inSync: fc.IsInSync, fingerprint: filesFingerprint(root, fc.AutoBuild.Paths), checkedAt: now}
+			b.states[fc.ID] = st
+		}
+		if st.running {
+			b.mutex.Unlock()
+			continue
+		}
+
+		// Files are checked when synchronization completes or periodically
+		// for folders that are not synchronized (eg. PathMap)
+		inSync := fc.IsInSync && fc.Status != xsapiv1.StatusPause && fc.Status != xsapiv1.StatusErrorConfig
+		check := inSync && !st.inSync
+		if fc.Type != xsapiv1.TypeCloudSync && fc.Type != xsapiv1.TypeRsync {
+			check = now.Sub(st.checkedAt) >= autoBuildPollTime*time.Second
+		}
+		st.inSync = inSync
+
+		if check {
+			st.checkedAt = now
+			if fp := filesFingerprint(root, fc.AutoBuild.Paths); fp != st.fingerprint {
+				st.fingerprint = fp
+				debounce := fc.AutoBuild.DebounceS
+				if debounce == 0 {
+					debounce = autoBuildDefaultDebounce
+				}
+				st.pendingAt = now.Add(time.Duration(debounce) * time.Second)
+				b.LogSillyf("Auto build of folder %s scheduled at %v", fc.ID, st.pendingAt)
+			}
+		}
+
+		start := inSync && !st.pendingAt.IsZero() && now.After(st.pendingAt)
+		if start {
+			st.pendingAt = time.Time{}
+			st.running = true
+			b.count++
+		}
+		cmdID := "autobuild_" + fc.ID + "_" + strconv.Itoa(b.count)
+		b.mutex.Unlock()
+
+		if start {
+			go b.build(fc, root, cmdID)
+		}
+	}
+
+	// Forget folders with auto build disabled
+	b.mutex.Lock()
+	for id := range b.states {
+		if !enabled[id] {
+			delete(b.states, id)
+		}
+	}
+	b.mutex.Unlock()
+}
+
+// build executes auto build command of a folder
+func (b *AutoBuilder) build(fc xsapiv1.FolderConfig, root, cmdID string) {
+	ab := *fc.AutoBuild
+	retry := false
+	defer func() {
+		b.mutex.Lock()
+		if st, exist := b.states[fc.ID]; exist {
+			st.running = false
+			// Files written by build are not considered as changes
+			st.fingerprint = filesFingerprint(root, ab.Paths)
+			st.checkedAt = time.Now()
+			if retry {
+				st.pendingAt = time.Now().Add(autoBuildDefaultDebounce * time.Second)
+			}
+		}
+		b.mutex.Unlock()
+	}()
+
+	msg := xsapiv1.FolderAutoBuildMsg{FolderID: fc.ID, CmdID: cmdID, Cmd: ab.Cmd}
+
+	cmdLine, err := b.buildCommand(fc, root)
+	if err == nil && b.folderWatch.IsQuotaExceeded(fc.ID) {
+		err = fmt.Errorf("folder disk quota exceeded")
+	}
+	if err != nil {
+		b.Log.Errorf("Auto build of folder %s not started: %v", fc.ID, err)
+		msg.Status = xsapiv1.AutoBuildStatusFailed
+		msg.Error = err.Error()
+		b.notify(msg)
+		return
+	}
+
+	// Don't run concurrently with commands of other clients
+	if err := b.mfolders.ExecAcquire(fc.ID, fc.Owner, cmdID); err != nil {
+		b.Log.Infof("Auto build of folder %s delayed: %v", fc.ID, err)
+		retry = true
+		return
+	}
+	defer b.mfolders.ExecRelease(fc.ID, cmdID)
+
+	b.Log.Infof("Auto build of folder %s [Cmd ID %s]: %s", fc.ID, cmdID, ab.Cmd)
+	msg.Status = xsapiv1.AutoBuildStatusStarted
+	b.notify(msg)
+
+	env := append([]string{"XDS_AUTO_BUILD=1"}, b.mfolders.DependenciesEnv(fc.ID)...)
+	env = append(env, b.ccache.Env(fc.ID, ab.SdkID)...)
+	code, err := b.runCommand(fc, cmdID, "", cmdLine, env, ab.TimeoutS)
+	msg.Status = xsapiv1.AutoBuildStatusDone
+	msg.ExitCode = code
+	if err != nil {
+		msg.Status = xsapiv1.AutoBuildStatusFailed
+		msg.Error = err.Error()
+	}
+	b.notify(msg)
+}
+
+// runCommand executes a shell command of a folder and returns its exit code
+// (output and exit status are sent to clients using exec events, tagged with
+// channel when set)
+func (b *AutoBuilder) runCommand(fc xsapiv1.FolderConfig, cmdID, channel, cmdLine string, env []string, timeoutS int) (int, error) {
+	prio, err := b.execPriorityGet(nil, "")
+	if err != nil {
+		b.Log.Warningf("Invalid default priority of commands: %v", err)
+	}
+	cmd := exec.Command("/bin/bash", "-c", prio.shellPrefix()+cmdLine)
+	cmd.Env = append(os.Environ(), "CLIENT_PROJECT_DIR="+fc.ClientPath)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Env = append(cmd.Env, b.execServerEnv()...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return -1, err
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	b.execMetrics.Start(cmdID)
+	outOpts, err := b.execOutOptionsGet(cmd.Env, 0, "")
+	if err != nil {
+		b.Log.Warningf("Command %s: %v", cmdID, err)
+	}
+	b.execOutputs.Open(cmdID, fc.ID, outOpts)
+
+	timeout := timeoutS
+	if timeout == 0 {
+		timeout = autoBuildDefaultTimeout
+	}
+	timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		b.Log.Warningf("Command %s of folder %s timeout, kill it", cmdID, fc.ID)
+		cmd.Process.Kill()
+	})
+
+	done := make(chan struct{}, 2)
+	go b.streamOutput(fc.ID, cmdID, channel, stdout, false, done)
+	go b.streamOutput(fc.ID, cmdID, channel, stderr, true, done)
+	<-done
+	<-done
+	err = cmd.Wait()
+	timer.Stop()
+
+	code := 0
+	if err != nil {
+		code = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(interface{ ExitStatus() int }); ok {
+				code = ws.ExitStatus()
+			}
+		}
+	}
+	if cmd.ProcessState != nil {
+		b.execMetrics.SetUsage(cmdID, cmd.ProcessState.SysUsage())
+	}
+	b.folderStats.RecordBuild(fc.ID)
+	b.emitExec(fc.ID, xsapiv1.ExecExitEvent, xsapiv1.ExecExitMsg{
+		CmdID:     cmdID,
+		Timestamp: time.Now().String(),
+		Code:      code,
+		Error:     err,
+		Metrics:   b.execMetrics.End(cmdID),
+		Channel:   channel,
+		OutputSeq: b.execOutputs.Close(cmdID),
+	})
+	return code, err
+}
+
+// buildCommand returns the shell command line of a folder auto build
+func (b *AutoBuilder) buildCommand(fc xsapiv1.FolderConfig, root string) (string, error) {
+	ab := fc.AutoBuild
+	return b.folderCommand(fc, root, ab.SdkID, ab.RPath, ab.Cmd)
+}
+
+// folderCommand returns the shell command line that executes a command in a
+// folder sub-directory using sdk environment
+func (b *AutoBuilder) folderCommand(fc xsapiv1.FolderConfig, root, sdkID, rpath, command string) (string, error) {
+	cmd := []string{}
+	envCmd, err := b.sdks.GetEnvCmd(sdkID, fc.DefaultSdk)
+	if err != nil {
+		return "", err
+	}
+	if len(envCmd) > 0 {
+		cmd = append(cmd, envCmd...)
+		cmd = append(cmd, "&&")
+	}
+	workDir, err := b.mfolders.WorkDir(fc.ID, rpath)
+	if err != nil {
+		return "", err
+	}
+	cmd = append(cmd, "cd", shellQuote(workDir), "&&", command)
+
+	cmdLine := strings.Join(cmd, " ")
+
+	// Local user that executes command (see user of exec config)
+	eu, err := b.execUserGet("")
+	if err != nil {
+		return "", err
+	}
+	if eu != nil {
+		if err := b.execUserSetup(eu, fc, root); err != nil {
+			return "", err
+		}
+		if cmdLine, err = eu.command(cmdLine); err != nil {
+			return "", err
+		}
+	}
+
+	if fc.ReadOnly {
+		return readOnlyCommand(root, fc.OutputPath, cmdLine)
+	}
+	return cmdLine, nil
+}
+
+// streamOutput sends command output using exec output event
+func (b *AutoBuilder) streamOutput(id, cmdID, channel string, r io.Reader, isStderr bool, done chan struct{}) {
+	defer func() { done <- struct{}{} }()
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			b.execMetrics.AddOutput(cmdID, n)
+			out := string(buf[:n])
+			if f := b.mfolders.Get(id); f != nil {
+				out = (*f).ConvPathSvr2Cli(out)
+			}
+			stdout, stderr := out, ""
+			if isStderr {
+				stdout, stderr = "", out
+			}
+			b.execOutputs.Emit(cmdID, channel, stdout, stderr, func(evName string, msg interface{}) {
+				b.emitExec(id, evName, msg)
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// emitExec sends an exec event to all connected clients that can access folder
+func (b *AutoBuilder) emitExec(id, evName string, data interface{}) {
+	for sid, so := range b.sessions.IOSocketsGet() {
+		if !b.mfolders.HasAccess(id, sid, xsapiv1.FolderAccessRead) {
+			continue
+		}
+		if err := (*so).Emit(evName, data); err != nil {
+			b.Log.Errorf("WS Emit : %v", err)
+		}
+	}
+}
+
+// notify emits auto build status event
+func (b *AutoBuilder) notify(msg xsapiv1.FolderAutoBuildMsg) {
+	msg.Timestamp = time.Now().String()
+	if err := b.events.Emit(xsapiv1.EVTFolderAutoBuild, msg, ""); err != nil {
+		b.Log.Warningf("Cannot notify auto build of folder %s: %v", msg.FolderID, err)
+	}
+}
+
+// filesFingerprint returns a hash of path, size and modification date of
+// folder files (only files matching patterns when set)
+func filesFingerprint(root string, patterns []string) string {
+	var m *ignoreMatcher
+	if len(patterns) > 0 {
+		m = newIgnoreMatcher(patterns)
+	}
+	h := sha1.New()
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if stInternalDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if m != nil && !m.match(rel) {
+			return nil
+		}
+		fmt.Fprintf(h, "%s|%d|%d\n", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
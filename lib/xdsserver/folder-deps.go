@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// checkDependencies Sanity check of build dependencies of a folder
+// (dependencies existence is not checked while loading config)
+func (f *Folders) checkDependencies(cfg *xsapiv1.FolderConfig, initial bool) error {
+	deps := cfg.Dependencies
+	if deps == nil {
+		return nil
+	}
+	if deps.RPath != "" {
+		if _, err := versionRelPath(deps.RPath); err != nil {
+			return fmt.Errorf("dependencies rpath must be relative to folder")
+		}
+	}
+	if deps.StagingDir != "" {
+		if _, err := versionRelPath(deps.StagingDir); err != nil {
+			return fmt.Errorf("staging directory must be relative to folder")
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, id := range deps.DependsOn {
+		if id == cfg.ID {
+			return fmt.Errorf("folder cannot depend on itself")
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicated dependency %s", id)
+		}
+		seen[id] = true
+		if _, exist := f.folders[id]; !exist && !initial {
+			return fmt.Errorf("unknown dependency %s", id)
+		}
+	}
+	if initial || cfg.ID == "" {
+		return nil
+	}
+
+	// Reject cycles (IOW a dependency that depends on this folder)
+	configs := f.depsConfigsUnsafe()
+	configs[cfg.ID] = *cfg
+	if _, err := depsOrder(cfg.ID, configs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// BuildOrder returns a folder and all its dependencies in build order
+// (dependencies first, folder last)
+func (f *Folders) BuildOrder(id string) ([]xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	configs := f.depsConfigsUnsafe()
+	fcMutex.Unlock()
+
+	if _, exist := configs[id]; !exist {
+		return nil, fmt.Errorf("unknown id")
+	}
+	return depsOrder(id, configs)
+}
+
+// DependenciesEnv returns env variables that define staging directories of
+// folder dependencies (XDS_STAGING_DIRS and XDS_STAGING_<LABEL>)
+func (f *Folders) DependenciesEnv(id string) []string {
+	order, err := f.BuildOrder(id)
+	if err != nil || len(order) < 2 {
+		return []string{}
+	}
+
+	env := []string{}
+	dirs := []string{}
+	for _, fc := range order[:len(order)-1] {
+		fld := f.Get(fc.ID)
+		if fld == nil {
+			continue
+		}
+		dir := (*fld).GetFullPath("")
+		if fc.Dependencies != nil && fc.Dependencies.StagingDir != "" {
+			dir = (*fld).GetFullPath(fc.Dependencies.StagingDir)
+		}
+		dirs = append(dirs, dir)
+		env = append(env, "XDS_STAGING_"+depsEnvName(fc.Label)+"="+dir)
+	}
+	return append(env, "XDS_STAGING_DIRS="+strings.Join(dirs, ":"))
+}
+
+/*** Private functions ***/
+
+// depsConfigsUnsafe returns config of all folders indexed by ID (fcMutex must be locked)
+func (f *Folders) depsConfigsUnsafe() map[string]xsapiv1.FolderConfig {
+	configs := make(map[string]xsapiv1.FolderConfig)
+	for id, fld := range f.folders {
+		configs[id] = (*fld).GetConfig()
+	}
+	return configs
+}
+
+// depsOrder sorts a folder and its dependencies in topological order
+func depsOrder(id string, configs map[string]xsapiv1.FolderConfig) ([]xsapiv1.FolderConfig, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	order := []xsapiv1.FolderConfig{}
+
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle detected: %s", strings.Join(append(path, id), " -> "))
+		}
+		fc, exist := configs[id]
+		if !exist {
+			return fmt.Errorf("unknown dependency %s (required by %s)", id, path[len(path)-1])
+		}
+		state[id] = visiting
+		if fc.Dependencies != nil {
+			for _, dep := range fc.Dependencies.DependsOn {
+				if err := visit(dep, append(path, id)); err != nil {
+					return err
+				}
+			}
+		}
+		state[id] = visited
+		order = append(order, fc)
+		return nil
+	}
+
+	if err := visit(id, []string{}); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// depsEnvName converts a folder label into an env variable name suffix
+func depsEnvName(label string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, label)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// FolderDriver Creates a new (not yet setup) folder object of a given type,
+// a driver handles one folder type and implements IFOLDER interface
+type FolderDriver func(ctx *Context) IFOLDER
+
+var folderDrivers = make(map[xsapiv1.FolderType]FolderDriver)
+var folderDriversMutex = sync.NewMutex()
+
+// RegisterFolderDriver registers the driver of a folder type (replaces driver
+// previously registered for this type)
+func RegisterFolderDriver(fType xsapiv1.FolderType, driver FolderDriver) {
+	folderDriversMutex.Lock()
+	defer folderDriversMutex.Unlock()
+	folderDrivers[fType] = driver
+}
+
+// FolderDriverTypes returns the list of folder types that have a driver
+func FolderDriverTypes() []string {
+	folderDriversMutex.Lock()
+	defer folderDriversMutex.Unlock()
+
+	res := []string{}
+	for t := range folderDrivers {
+		res = append(res, string(t))
+	}
+	sort.Strings(res)
+	return res
+}
+
+/*** Private functions ***/
+
+// newFolderFromDriver creates a folder object using driver of folder type
+func newFolderFromDriver(ctx *Context, fType xsapiv1.FolderType) (IFOLDER, error) {
+	folderDriversMutex.Lock()
+	driver, exist := folderDrivers[fType]
+	folderDriversMutex.Unlock()
+
+	if !exist {
+		return nil, fmt.Errorf("Unsupported folder type")
+	}
+	return driver(ctx), nil
+}
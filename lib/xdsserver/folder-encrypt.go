@@ -0,0 +1,352 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const cryptMinPassphraseLen = 8
+
+// FolderCrypt Manages at rest encryption of CloudSync folders: encrypted files
+// are stored in EncryptDir and decrypted view is mounted (using gocryptfs) on
+// folder directory while at least one client session unlocked it
+type FolderCrypt struct {
+	*Context
+	dir      string
+	unlocked map[string]*cryptState
+	mutex    sync.Mutex
+}
+
+// cryptState Hold state of an unlocked folder
+type cryptState struct {
+	plainDir string
+	verifier []byte          // used to check passphrase of next unlocks
+	sids     map[string]bool // sessions that unlocked folder
+}
+
+// NewFolderCrypt creates a new instance of FolderCrypt
+func NewFolderCrypt(ctx *Context) *FolderCrypt {
+	return &FolderCrypt{
+		Context:  ctx,
+		dir:      ctx.Config.FileConf.EncryptDir,
+		unlocked: make(map[string]*cryptState),
+		mutex:    sync.NewMutex(),
+	}
+}
+
+// IsEncrypted returns true when folder files are encrypted
+func IsEncrypted(fc xsapiv1.FolderConfig) bool {
+	return fc.Encryption != nil && fc.Encryption.Enabled
+}
+
+// IsLocked returns true when files of an encrypted folder are not accessible
+func (c *FolderCrypt) IsLocked(fc xsapiv1.FolderConfig) bool {
+	if !IsEncrypted(fc) {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, unlocked := c.unlocked[fc.ID]
+	return !unlocked
+}
+
+// Init initializes encryption of a new folder and unlocks it for a session
+func (c *FolderCrypt) Init(id, plainDir, passphrase, sid string) error {
+	if len(passphrase) < cryptMinPassphraseLen {
+		return fmt.Errorf("encryption passphrase must contain at least %d characters", cryptMinPassphraseLen)
+	}
+	if err := checkCryptTools(); err != nil {
+		return err
+	}
+
+	cipherDir := c.cipherDir(id)
+	if common.Exists(cipherDir) {
+		return fmt.Errorf("encrypted directory already exists: %s", cipherDir)
+	}
+	if entries, err := ioutil.ReadDir(plainDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("directory of encrypted folder must be empty: %s", plainDir)
+	}
+	if err := os.MkdirAll(cipherDir, 0700); err != nil {
+		return fmt.Errorf("Cannot create encrypted directory: %v", err)
+	}
+	if out, err := runWithPassphrase(passphrase, "gocryptfs", "-init", "-q", cipherDir); err != nil {
+		os.RemoveAll(cipherDir)
+		return fmt.Errorf("Cannot initialize encryption: %v (%s)", err, out)
+	}
+
+	c.Log.Infof("Encryption of folder %s initialized in %s", id, cipherDir)
+	_, err := c.Unlock(id, plainDir, passphrase, sid)
+	return err
+}
+
+// Unlock mounts decrypted view of folder files, returns true when view has
+// been mounted (IOW folder was locked before)
+func (c *FolderCrypt) Unlock(id, plainDir, passphrase, sid string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	verifier := cryptVerifier(id, passphrase)
+	if st, exist := c.unlocked[id]; exist {
+		// Already mounted, passphrase cannot be checked by gocryptfs
+		if subtle.ConstantTimeCompare(st.verifier, verifier) != 1 {
+			return false, fmt.Errorf("invalid passphrase")
+		}
+		st.sids[sid] = true
+		return false, nil
+	}
+
+	if err := checkCryptTools(); err != nil {
+		return false, err
+	}
+	if isMounted(plainDir) {
+		if err := cryptUnmount(plainDir); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(plainDir, 0755); err != nil {
+		return false, err
+	}
+	if out, err := runWithPassphrase(passphrase, "gocryptfs", "-q", c.cipherDir(id), plainDir); err != nil {
+		return false, fmt.Errorf("Cannot unlock folder (invalid passphrase ?): %v (%s)", err, out)
+	}
+
+	c.unlocked[id] = &cryptState{
+		plainDir: plainDir,
+		verifier: verifier,
+		sids:     map[string]bool{sid: true},
+	}
+	c.Log.Infof("Folder %s unlocked", id)
+	return true, nil
+}
+
+// Release removes a session from the ones that unlocked a folder, returns
+// true when folder must be locked (no more session, or force set)
+func (c *FolderCrypt) Release(id, sid string, force bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	st, exist := c.unlocked[id]
+	if !exist {
+		return true
+	}
+	delete(st.sids, sid)
+	return force || len(st.sids) == 0
+}
+
+// Unmount unmounts decrypted view of folder files
+func (c *FolderCrypt) Unmount(id, plainDir string) error {
+	c.mutex.Lock()
+	delete(c.unlocked, id)
+	c.mutex.Unlock()
+
+	if !isMounted(plainDir) {
+		return nil
+	}
+	if err := cryptUnmount(plainDir); err != nil {
+		return err
+	}
+	c.Log.Infof("Folder %s locked", id)
+	return nil
+}
+
+// SessionFolders returns folders unlocked by a session
+func (c *FolderCrypt) SessionFolders(sid string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ids := []string{}
+	for id, st := range c.unlocked {
+		if st.sids[sid] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Remove deletes encrypted files of a folder
+func (c *FolderCrypt) Remove(id, plainDir string) error {
+	if err := c.Unmount(id, plainDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.cipherDir(id))
+}
+
+// Stop locks all folders
+func (c *FolderCrypt) Stop() {
+	c.mutex.Lock()
+	unlocked := make(map[string]string)
+	for id, st := range c.unlocked {
+		unlocked[id] = st.plainDir
+	}
+	c.mutex.Unlock()
+
+	for id, dir := range unlocked {
+		if err := c.Unmount(id, dir); err != nil {
+			c.Log.Errorf("Cannot lock folder %s: %v", id, err)
+		}
+	}
+}
+
+/*** Private functions ***/
+
+// cipherDir returns the directory of encrypted files of a folder
+func (c *FolderCrypt) cipherDir(id string) string {
+	return filepath.Join(c.dir, id)
+}
+
+// checkCryptTools returns an error when encryption tools are not installed
+func checkCryptTools() error {
+	for _, tool := range []string{"gocryptfs", "fusermount"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("folder encryption not supported: %s not installed", tool)
+		}
+	}
+	return nil
+}
+
+// cryptVerifier returns the hash used to check passphrase of an unlocked folder
+func cryptVerifier(id, passphrase string) []byte {
+	h := sha256.Sum256([]byte(id + ":" + passphrase))
+	return h[:]
+}
+
+// runWithPassphrase executes a command that reads passphrase on stdin
+func runWithPassphrase(passphrase, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(passphrase + "\n")
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+// cryptUnmount unmounts a decrypted view
+func cryptUnmount(dir string) error {
+	if out, err := exec.Command("fusermount", "-u", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("Cannot unmount %s: %v (%s)", dir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isMounted returns true when a directory is a mount point
+func isMounted(dir string) bool {
+	fsType, err := findMount(dir)
+	return err == nil && fsType != ""
+}
+
+// checkEncryptionConfig Sanity check of folder encryption settings
+func checkEncryptionConfig(cfg *xsapiv1.FolderConfig) error {
+	if cfg.Encryption == nil {
+		return nil
+	}
+	if !cfg.Encryption.Enabled {
+		cfg.Encryption = nil
+		return nil
+	}
+	if cfg.Type != xsapiv1.TypeCloudSync {
+		return fmt.Errorf("encryption only supported by %s folders", xsapiv1.TypeCloudSync)
+	}
+	return nil
+}
+
+// Unlock unlocks an encrypted folder for a client session
+func (f *Folders) Unlock(id, passphrase, sid string) (*xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(stf.GetConfig()) {
+		return nil, fmt.Errorf("folder is not encrypted")
+	}
+	if err := stf.unlock(passphrase, sid); err != nil {
+		return nil, err
+	}
+	fld := f.withRuntime(stf.GetConfig())
+	return &fld, nil
+}
+
+// Lock locks an encrypted folder for a client session (files stay accessible
+// while other sessions unlocked it, except when requested by folder owner)
+func (f *Folders) Lock(id, sid string) (*xsapiv1.FolderConfig, error) {
+	return f.lockFolder(id, sid, true)
+}
+
+// SessionClosed locks folders unlocked by a closed (or expired) session
+func (f *Folders) SessionClosed(sid string) {
+	for _, id := range f.folderCrypt.SessionFolders(sid) {
+		if _, err := f.lockFolder(id, sid, false); err != nil {
+			f.Log.Errorf("Cannot lock folder %s: %v", id, err)
+		}
+	}
+}
+
+// lockFolder releases folder unlocked by a session (ownerForce: lock folder
+// for all sessions when session is the folder owner)
+func (f *Folders) lockFolder(id, sid string, ownerForce bool) (*xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	fc := stf.GetConfig()
+	if !IsEncrypted(fc) {
+		return nil, fmt.Errorf("folder is not encrypted")
+	}
+	force := ownerForce && f.sessionOwns(sid, fc.Owner, fc.OwnerUser)
+	if err := stf.lock(sid, force); err != nil {
+		return nil, err
+	}
+	fld := f.withRuntime(stf.GetConfig())
+	return &fld, nil
+}
+
+// unlock Mounts decrypted view of folder files and resumes synchronization
+func (f *STFolder) unlock(passphrase, sid string) error {
+	mounted, err := f.folderCrypt.Unlock(f.fConfig.ID, f.GetFullPath(""), passphrase, sid)
+	if err != nil || !mounted {
+		return err
+	}
+	return f.SetPaused(false)
+}
+
+// lock Pauses synchronization (IOW before files disappear) and unmounts
+// decrypted view of folder files when no other session uses it
+func (f *STFolder) lock(sid string, force bool) error {
+	if !f.folderCrypt.Release(f.fConfig.ID, sid, force) {
+		return nil
+	}
+	if err := f.SetPaused(true); err != nil {
+		return err
+	}
+	return f.folderCrypt.Unmount(f.fConfig.ID, f.GetFullPath(""))
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+/*** Private functions ***/
+
+// checkFileAttrsConfig validates file attributes settings of a folder
+func checkFileAttrsConfig(cfg *xsapiv1.FolderConfig) error {
+	switch cfg.FileAttrs.Symlinks {
+	case "":
+		cfg.FileAttrs.Symlinks = xsapiv1.SymlinkModeKeep
+	case xsapiv1.SymlinkModeKeep:
+	case xsapiv1.SymlinkModeFollow, xsapiv1.SymlinkModeIgnore:
+		// Syncthing always synchronizes symlinks as symlinks
+		if cfg.Type == xsapiv1.TypeCloudSync {
+			return fmt.Errorf("symlinks mode '%s' not supported by %s folders", cfg.FileAttrs.Symlinks, cfg.Type)
+		}
+	default:
+		return fmt.Errorf("invalid symlinks mode '%s'", cfg.FileAttrs.Symlinks)
+	}
+	return nil
+}
+
+// rsyncAttrsArgs returns rsync options used to copy files according to
+// file attributes settings (equivalent to -a by default)
+func rsyncAttrsArgs(fa xsapiv1.FolderFileAttrs) []string {
+	args := []string{"-rt"}
+	switch fa.Symlinks {
+	case xsapiv1.SymlinkModeFollow:
+		args = append(args, "--copy-links")
+	case xsapiv1.SymlinkModeIgnore:
+		args = append(args, "--no-links")
+	default:
+		args = append(args, "--links")
+	}
+	if !fa.IgnorePerms {
+		args = append(args, "--perms")
+	}
+	if !fa.IgnoreOwner {
+		args = append(args, "--owner", "--group", "--devices", "--specials")
+	}
+	return args
+}
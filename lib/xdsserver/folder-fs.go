@@ -0,0 +1,260 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const folderFSMaxFileSize = 1024 * 1024 // Maximum size (in bytes) of files read or written using REST API
+
+// FSStat Returns information about a file or a directory of a folder
+// (including directory entries or file content when withContent is set)
+func (f *Folders) FSStat(id, path string, withContent bool) (*xsapiv1.FolderFSEntry, error) {
+	root, rel, err := f.fsPath(id, path)
+	if err != nil {
+		return nil, err
+	}
+	full := filepath.Join(root, rel)
+	fi, err := os.Lstat(full)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found in folder", path)
+	}
+	entry := fsEntry(full, rel, fi)
+
+	// Symlinks are followed when target is inside folder
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if err := fsCheckInside(root, full); err != nil {
+			return &entry, nil
+		}
+		if fi, err = os.Stat(full); err != nil {
+			return &entry, nil
+		}
+	}
+
+	if fi.IsDir() {
+		infos, err := ioutil.ReadDir(full)
+		if err != nil {
+			return nil, err
+		}
+		entry.Entries = []xsapiv1.FolderFSEntry{}
+		for _, info := range infos {
+			if stInternalDirs[info.Name()] {
+				continue
+			}
+			entry.Entries = append(entry.Entries, fsEntry(filepath.Join(full, info.Name()), filepath.Join(rel, info.Name()), info))
+		}
+		sort.Slice(entry.Entries, func(i, j int) bool { return entry.Entries[i].Name < entry.Entries[j].Name })
+		return &entry, nil
+	}
+
+	if withContent {
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("not a regular file")
+		}
+		if fi.Size() > folderFSMaxFileSize {
+			return nil, fmt.Errorf("file too large (maximum %d bytes)", folderFSMaxFileSize)
+		}
+		data, err := ioutil.ReadFile(full)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.IndexByte(data, 0) != -1 {
+			return nil, fmt.Errorf("not a text file")
+		}
+		content := string(data)
+		entry.Content = &content
+	}
+	return &entry, nil
+}
+
+// FSWrite Creates or replaces a (small) text file of a folder
+func (f *Folders) FSWrite(id, path, content string) (*xsapiv1.FolderFSEntry, error) {
+	if len(content) > folderFSMaxFileSize {
+		return nil, fmt.Errorf("file too large (maximum %d bytes)", folderFSMaxFileSize)
+	}
+	root, rel, err := f.fsPath(id, path)
+	if err != nil {
+		return nil, err
+	}
+	if rel == "." {
+		return nil, fmt.Errorf("file path must be set")
+	}
+	if stInternalDirs[strings.Split(filepath.ToSlash(rel), "/")[0]] {
+		return nil, fmt.Errorf("cannot write into internal directory")
+	}
+	if (*f.Get(id)).GetConfig().ReadOnly {
+		return nil, fmt.Errorf("cannot write into a read-only folder")
+	}
+	if f.folderWatch.IsQuotaExceeded(id) {
+		return nil, fmt.Errorf("folder disk quota exceeded")
+	}
+
+	full := filepath.Join(root, rel)
+	mode := os.FileMode(0644)
+	if fi, err := os.Lstat(full); err == nil {
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("not a regular file")
+		}
+		mode = fi.Mode()
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(full), ".xds-write-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.WriteString(content)
+	if errC := tmp.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode.Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), full)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("Cannot write file: %v", err)
+	}
+
+	// Propagate change without waiting next scan
+	if err := f.Rescan(id); err != nil {
+		f.Log.Warningf("Cannot rescan folder %s: %v", id, err)
+	}
+
+	fi, err := os.Lstat(full)
+	if err != nil {
+		return nil, err
+	}
+	entry := fsEntry(full, rel, fi)
+	return &entry, nil
+}
+
+// WorkDir returns the directory used to execute a command in a folder,
+// rpath must be relative to folder and must not lead outside of it
+func (f *Folders) WorkDir(id, rpath string) (string, error) {
+	fc := f.Get(id)
+	if fc == nil {
+		return "", fmt.Errorf("Unknown id")
+	}
+	root := (*fc).GetFullPath("")
+	if root == "" {
+		return "", fmt.Errorf("folder directory not available")
+	}
+	if rpath == "" || filepath.Clean(filepath.FromSlash(rpath)) == "." {
+		return root, nil
+	}
+
+	rel, err := versionRelPath(rpath)
+	if err != nil {
+		return "", fmt.Errorf("invalid working directory '%s': path must be relative to folder", rpath)
+	}
+	dir := filepath.Join(root, rel)
+	if err := fsCheckInside(root, dir); err != nil {
+		return "", fmt.Errorf("invalid working directory '%s': %v", rpath, err)
+	}
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("working directory '%s' doesn't exist in folder", rpath)
+	} else if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("working directory '%s' is not a directory", rpath)
+	}
+	return dir, nil
+}
+
+/*** Private functions ***/
+
+// fsPath returns the root directory of a folder and a path relative to it
+// (path never goes outside of folder)
+func (f *Folders) fsPath(id, path string) (string, string, error) {
+	fc := f.Get(id)
+	if fc == nil {
+		return "", "", fmt.Errorf("Unknown id")
+	}
+	if f.folderCrypt.IsLocked((*fc).GetConfig()) {
+		return "", "", fmt.Errorf("folder is locked")
+	}
+	root := (*fc).GetFullPath("")
+	if root == "" {
+		return "", "", fmt.Errorf("folder directory not available")
+	}
+	rel := strings.TrimPrefix(filepath.Clean("/"+filepath.FromSlash(path)), string(filepath.Separator))
+	if rel == "" {
+		rel = "."
+	}
+	if rel != "." {
+		// Intermediate symlinks must not lead outside of folder
+		if err := fsCheckInside(root, filepath.Dir(filepath.Join(root, rel))); err != nil {
+			return "", "", err
+		}
+	}
+	return root, rel, nil
+}
+
+// fsCheckInside returns an error when path (symlinks resolved) is outside of root
+func fsCheckInside(root, path string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	// Check nearest existing parent of not existing paths
+	realPath, err := filepath.EvalSymlinks(path)
+	for os.IsNotExist(err) && filepath.Dir(path) != path {
+		path = filepath.Dir(path)
+		realPath, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return err
+	}
+	if realPath != realRoot && !strings.HasPrefix(realPath, realRoot+string(filepath.Separator)) {
+		return fmt.Errorf("path is outside of folder")
+	}
+	return nil
+}
+
+// fsEntry converts file information
+func fsEntry(full, rel string, fi os.FileInfo) xsapiv1.FolderFSEntry {
+	e := xsapiv1.FolderFSEntry{
+		Path:    filepath.ToSlash(rel),
+		Name:    fi.Name(),
+		IsDir:   fi.IsDir(),
+		Size:    fi.Size(),
+		Mode:    fi.Mode().String(),
+		ModTime: fi.ModTime().Format(time.RFC3339),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		e.LinkTarget, _ = os.Readlink(full)
+	}
+	return e
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const gitCloneTimeout = 60 * 60 // Maximum duration (in seconds) of a clone
+
+// Supported Git URLs (IOW no local or "ext::" transports)
+var reGitURL = regexp.MustCompile(`^((https?|ssh|git)://[^\s]+|[A-Za-z0-9_.-]+@[A-Za-z0-9_.-]+:[^\s]+)$`)
+
+/*** Private functions ***/
+
+// checkGitClone validates Git clone parameters of a new folder
+func (f *Folders) checkGitClone(cfg *xsapiv1.GitCloneConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git not found on server")
+	}
+	if !reGitURL.MatchString(cfg.URL) {
+		return fmt.Errorf("invalid or unsupported Git URL")
+	}
+	if strings.HasPrefix(cfg.Branch, "-") || strings.ContainsAny(cfg.Branch, " \t\n") {
+		return fmt.Errorf("invalid branch name")
+	}
+	if cfg.Depth < 0 {
+		return fmt.Errorf("invalid depth")
+	}
+	if cfg.Secret != "" {
+		if err := f.gitCloneCheckSecret(*cfg); err != nil {
+			return err
+		}
+		if _, err := f.secrets.Get(cfg.Secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitCloneCheckSecret checks that secret of a clone is bound to host of its
+// URL (see credentials of gitClone config)
+func (f *Folders) gitCloneCheckSecret(cfg xsapiv1.GitCloneConfig) error {
+	host := gitURLHost(cfg.URL)
+	if gc := f.Config.FileConf.GitCloneConf; gc != nil && host != "" {
+		for pattern, name := range gc.Credentials {
+			if ok, _ := path.Match(strings.ToLower(pattern), host); ok && name == cfg.Secret {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("secret '%s' cannot be used to clone from '%s'", cfg.Secret, host)
+}
+
+// gitURLHost returns host name (lower case) of a Git URL
+func gitURLHost(gitURL string) string {
+	if u, err := url.Parse(gitURL); err == nil && u.Scheme != "" {
+		return strings.ToLower(u.Hostname())
+	}
+	// scp-like syntax: [user@]host:path
+	host := strings.SplitN(gitURL, ":", 2)[0]
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	return strings.ToLower(host)
+}
+
+// gitClone clones repository into folder directory (run in background)
+func (f *Folders) gitClone(id string) {
+	fc := f.Get(id)
+	if fc == nil {
+		return
+	}
+	cfg := (*fc).GetConfig()
+	dir := (*fc).GetFullPath("")
+
+	f.gitCloneSetStatus(id, xsapiv1.GitCloneStatusCloning, "")
+	f.Log.Infof("Clone %s into folder %s", cfg.GitClone.URL, id)
+
+	err := f.gitCloneRun(*cfg.GitClone, dir)
+	if err != nil {
+		f.Log.Errorf("Clone of folder %s failed: %v", id, err)
+		f.gitCloneSetStatus(id, xsapiv1.GitCloneStatusFailed, err.Error())
+		return
+	}
+	f.gitCloneSetStatus(id, xsapiv1.GitCloneStatusDone, "")
+
+	// Cloned files must be taken into account immediately
+	if err := f.Rescan(id); err != nil {
+		f.Log.Warningf("Cannot rescan folder %s: %v", id, err)
+	}
+}
+
+// gitCloneRun clones in a temporary directory then moves files into
+// folder directory (that may already contain files, eg. .stfolder)
+func (f *Folders) gitCloneRun(cfg xsapiv1.GitCloneConfig, dir string) error {
+	if dir == "" {
+		return fmt.Errorf("folder path not available")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".clone-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	env, cleanup, err := f.gitCloneEnv(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	args := []string{"clone", "--quiet"}
+	if cfg.Branch != "" {
+		args = append(args, "--branch", cfg.Branch)
+	}
+	if cfg.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(cfg.Depth))
+	}
+	args = append(args, "--", cfg.URL, filepath.Join(tmpDir, "repo"))
+
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	timer := time.AfterFunc(gitCloneTimeout*time.Second, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git clone failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// Move cloned files into folder
+	repoDir := filepath.Join(tmpDir, "repo")
+	entries, err := ioutil.ReadDir(repoDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		dst := filepath.Join(dir, e.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("%s already exists in folder", e.Name())
+		}
+		if err := os.Rename(filepath.Join(repoDir, e.Name()), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitCloneEnv returns environment variables used to pass credentials to git
+// (never on command line), cleanup function must be called after clone
+func (f *Folders) gitCloneEnv(cfg xsapiv1.GitCloneConfig) ([]string, func(), error) {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	nop := func() {}
+	if cfg.Secret == "" {
+		return env, nop, nil
+	}
+	// Config may have changed since folder creation
+	if err := f.gitCloneCheckSecret(cfg); err != nil {
+		return nil, nop, err
+	}
+	secret, err := f.secrets.Get(cfg.Secret)
+	if err != nil {
+		return nil, nop, err
+	}
+
+	// SSH private key
+	if strings.HasPrefix(secret, "-----BEGIN") {
+		fd, err := ioutil.TempFile("", "xds-git-key-")
+		if err != nil {
+			return nil, nop, err
+		}
+		keyFile := fd.Name()
+		cleanup := func() { os.Remove(keyFile) }
+		_, err = fd.WriteString(secret + "\n")
+		fd.Close()
+		if err == nil {
+			err = os.Chmod(keyFile, 0600)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nop, err
+		}
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+keyFile+" -o IdentitiesOnly=yes "+rsyncSSHOptions)
+		return env, cleanup, nil
+	}
+
+	// HTTP credentials (user:token)
+	auth := base64.StdEncoding.EncodeToString([]byte(secret))
+	env = append(env,
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	return env, nop, nil
+}
+
+// gitCloneSetStatus updates clone status of a folder and notifies it
+func (f *Folders) gitCloneSetStatus(id, status, errMsg string) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	fc, exist := f.folders[id]
+	if !exist {
+		return
+	}
+	cfg := (*fc).GetConfig()
+	if cfg.GitClone == nil {
+		return
+	}
+	gc := *cfg.GitClone
+	gc.Status = status
+	gc.Error = errMsg
+	cfg.GitClone = &gc
+	if _, err := (*fc).Update(cfg); err != nil {
+		f.Log.Errorf("Cannot update folder %s: %v", id, err)
+		return
+	}
+	if err := f.events.Emit(xsapiv1.EVTFolderChange, &cfg, ""); err != nil {
+		f.Log.Warningf("Cannot notify folder change: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const healthCheckTime = 60             // Time (in seconds) between two health checks
+const healthDeviceStaleTime = 10 * 60  // Time (in seconds) after which a disconnected device is stale
+const healthSTRestartMinTime = 30 * 60 // Minimum time (in seconds) between two Syncthing restarts
+
+// Auto-repair actions, tried in order until folder is healthy
+const (
+	repairMkdir   = "create directory"
+	repairRescan  = "rescan"
+	repairReAdd   = "re-add Syncthing folder"
+	repairRestart = "restart Syncthing"
+)
+
+// FolderHealthMonitor Periodically checks folders health and tries to
+// repair them before flagging an error
+type FolderHealthMonitor struct {
+	*Context
+	health       map[string]*xsapiv1.FolderHealth
+	disconnected map[string]time.Time // device ID -> date of disconnection detection
+	lastRestart  time.Time
+	mutex        sync.Mutex
+	stop         chan struct{} // signals intentional stop
+}
+
+// NewFolderHealthMonitor creates a new instance of FolderHealthMonitor
+func NewFolderHealthMonitor(ctx *Context) *FolderHealthMonitor {
+	return &FolderHealthMonitor{
+		Context:      ctx,
+		health:       make(map[string]*xsapiv1.FolderHealth),
+		disconnected: make(map[string]time.Time),
+		mutex:        sync.NewMutex(),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start starts monitoring loop
+func (m *FolderHealthMonitor) Start() {
+	go m.monitorLoop()
+}
+
+// Stop stops monitoring loop
+func (m *FolderHealthMonitor) Stop() {
+	close(m.stop)
+}
+
+// GetHealth returns the last health check result of a folder (nil if not checked yet)
+func (m *FolderHealthMonitor) GetHealth(id string) *xsapiv1.FolderHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, exist := m.health[id]
+	if !exist {
+		return nil
+	}
+	res := *h
+	res.Issues = append([]string{}, h.Issues...)
+	return &res
+}
+
+/*** Private functions ***/
+
+func (m *FolderHealthMonitor) monitorLoop() {
+	for {
+		select {
+		case <-m.stop:
+			m.Log.Debugln("Stop folder health monitorLoop")
+			return
+		case <-time.After(healthCheckTime * time.Second):
+			m.checkAll()
+		}
+	}
+}
+
+// checkAll checks health of all folders and tries to repair unhealthy ones
+func (m *FolderHealthMonitor) checkAll() {
+	known := make(map[string]bool)
+	for _, fc := range m.mfolders.GetConfigArr() {
+		known[fc.ID] = true
+		if fc.Status == xsapiv1.StatusPause {
+			continue
+		}
+
+		issues, actions := m.check(fc)
+
+		m.mutex.Lock()
+		h, exist := m.health[fc.ID]
+		if !exist {
+			h = &xsapiv1.FolderHealth{Status: xsapiv1.FolderHealthOK, Issues: []string{}}
+			m.health[fc.ID] = h
+		}
+		prev := *h
+		h.Issues = issues
+		h.CheckedAt = time.Now().String()
+		m.mutex.Unlock()
+
+		switch {
+		case len(issues) == 0:
+			m.setStatus(fc.ID, xsapiv1.FolderHealthOK, 0, "")
+		case prev.RepairAttempts < len(actions):
+			action := actions[prev.RepairAttempts]
+			m.Log.Warningf("Folder %s unhealthy (%s), try to repair: %s", fc.ID, strings.Join(issues, ", "), action)
+			m.setStatus(fc.ID, xsapiv1.FolderHealthRepairing, prev.RepairAttempts+1, action)
+			if err := m.repair(fc, action); err != nil {
+				m.Log.Errorf("Repair of folder %s (%s) failed: %v", fc.ID, action, err)
+			}
+		default:
+			if prev.Status != xsapiv1.FolderHealthError {
+				m.Log.Errorf("Folder %s unhealthy and cannot be repaired: %s", fc.ID, strings.Join(issues, ", "))
+			}
+			m.setStatus(fc.ID, xsapiv1.FolderHealthError, prev.RepairAttempts, prev.LastRepair)
+		}
+
+		if cur := m.GetHealth(fc.ID); cur.Status != prev.Status || len(cur.Issues) != len(prev.Issues) {
+			m.notify(fc.ID)
+		}
+	}
+
+	// Forget deleted folders
+	m.mutex.Lock()
+	for id := range m.health {
+		if !known[id] {
+			delete(m.health, id)
+		}
+	}
+	m.mutex.Unlock()
+}
+
+// check returns folder issues and the repair actions to try
+func (m *FolderHealthMonitor) check(fc xsapiv1.FolderConfig) ([]string, []string) {
+	issues := []string{}
+	actions := []string{}
+
+	f := m.mfolders.Get(fc.ID)
+	if f == nil {
+		return issues, actions
+	}
+	dir := (*f).GetFullPath("")
+	if dir == "" || !common.IsDir(dir) {
+		issues = append(issues, "server path missing: "+dir)
+		if fc.Type == xsapiv1.TypeCloudSync && dir != "" {
+			actions = append(actions, repairMkdir)
+		}
+	}
+
+	if fc.Type != xsapiv1.TypeCloudSync || m.SThg == nil {
+		return issues, actions
+	}
+
+	// Syncthing folder errors
+	stIssue := ""
+	if sts, err := m.SThg.FolderStatus(fc.ID); err != nil {
+		stIssue = fmt.Sprintf("Syncthing folder unavailable: %v", err)
+	} else if sts.State == "error" {
+		stIssue = "Syncthing folder in error state"
+	} else if errs, err := m.SThg.FolderErrors(fc.ID); err == nil && len(errs) > 0 {
+		stIssue = fmt.Sprintf("%d file(s) cannot be synchronized (eg. %s: %s)", len(errs), errs[0].Path, errs[0].Error)
+	}
+	if stIssue != "" {
+		issues = append(issues, stIssue)
+		actions = append(actions, repairRescan, repairReAdd, repairRestart)
+	}
+
+	// Stale device connection
+	devID := fc.DataCloudSync.SyncThingID
+	if connected, err := m.SThg.DeviceConnected(devID); err == nil {
+		m.mutex.Lock()
+		since, exist := m.disconnected[devID]
+		if connected {
+			delete(m.disconnected, devID)
+		} else if !exist {
+			m.disconnected[devID] = time.Now()
+		} else if time.Since(since) > healthDeviceStaleTime*time.Second {
+			issues = append(issues, "device "+shortDeviceID(devID)+" not connected since "+since.Format(time.RFC3339))
+			if stIssue == "" {
+				actions = append(actions, repairRestart)
+			}
+		}
+		m.mutex.Unlock()
+	}
+
+	return issues, actions
+}
+
+// repair executes a repair action
+func (m *FolderHealthMonitor) repair(fc xsapiv1.FolderConfig, action string) error {
+	switch action {
+	case repairMkdir:
+		f := m.mfolders.Get(fc.ID)
+		if f == nil {
+			return fmt.Errorf("unknown id")
+		}
+		dir := (*f).GetFullPath("")
+		// Syncthing also requires folder marker
+		if err := os.MkdirAll(filepath.Join(dir, ".stfolder"), 0755); err != nil {
+			return err
+		}
+		return m.mfolders.Rescan(fc.ID)
+
+	case repairRescan:
+		return m.mfolders.Rescan(fc.ID)
+
+	case repairReAdd:
+		_, err := m.SThg.FolderChange(fc)
+		return err
+
+	case repairRestart:
+		m.mutex.Lock()
+		if time.Since(m.lastRestart) < healthSTRestartMinTime*time.Second {
+			m.mutex.Unlock()
+			return fmt.Errorf("Syncthing already restarted at %v", m.lastRestart)
+		}
+		m.lastRestart = time.Now()
+		m.mutex.Unlock()
+		return m.SThg.Restart()
+	}
+	return fmt.Errorf("unknown repair action '%s'", action)
+}
+
+func (m *FolderHealthMonitor) setStatus(id, status string, attempts int, lastRepair string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if h, exist := m.health[id]; exist {
+		h.Status = status
+		h.RepairAttempts = attempts
+		h.LastRepair = lastRepair
+	}
+}
+
+// notify emits a folder state change including health
+func (m *FolderHealthMonitor) notify(id string) {
+	f := m.mfolders.Get(id)
+	if f == nil {
+		return
+	}
+	fc := m.mfolders.withRuntime((*f).GetConfig())
+	if err := m.events.Emit(xsapiv1.EVTFolderStateChange, &fc, ""); err != nil {
+		m.Log.Warningf("Cannot notify folder %s health: %v", id, err)
+	}
+}
+
+// shortDeviceID returns the first group of a Syncthing device ID
+func shortDeviceID(devID string) string {
+	if i := strings.Index(devID, "-"); i > 0 {
+		return devID[:i]
+	}
+	return devID
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+)
+
+// IFOLDER interface implementation for existing server-side directories
+// (eg. a BSP already checked out on build machine) that are registered
+// without being wiped or resynchronized, and that can optionally be
+// exported one-way to a client using a Syncthing send-only folder
+
+func init() {
+	RegisterFolderDriver(xsapiv1.TypeImport, func(ctx *Context) IFOLDER { return NewFolderImport(ctx) })
+}
+
+// ImportFolder .
+type ImportFolder struct {
+	*Context
+	fConfig xsapiv1.FolderConfig
+}
+
+// NewFolderImport Create a new instance of ImportFolder
+func NewFolderImport(ctx *Context) *ImportFolder {
+	f := ImportFolder{
+		Context: ctx,
+		fConfig: xsapiv1.FolderConfig{
+			Status: xsapiv1.StatusDisable,
+		},
+	}
+	return &f
+}
+
+// NewUID Get a UUID
+func (f *ImportFolder) NewUID(suffix string) string {
+	uuid := uuid.NewV1().String()
+	if len(suffix) > 0 {
+		uuid += "_" + suffix
+	}
+	return uuid
+}
+
+// Add a new folder
+func (f *ImportFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if cfg.GitClone != nil || cfg.Template != "" {
+		return nil, fmt.Errorf("Imported folder cannot be initialized from a git repository or a template")
+	}
+
+	fc, err := f.Setup(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Syncthing folder config is persistent, so only created when folder is added
+	if fc.DataImport.ExportSyncThingID != "" {
+		if f.SThg == nil {
+			return nil, fmt.Errorf("Cannot export folder: CloudSync not supported")
+		}
+		if err := f.SThg.FolderExport(fc.ID, fc.Label, fc.RootPath, fc.DataImport.ExportSyncThingID); err != nil {
+			return nil, fmt.Errorf("Cannot export folder: %v", err)
+		}
+	}
+	return fc, nil
+}
+
+// Setup Setup local project config
+func (f *ImportFolder) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	dir := cfg.DataImport.ServerPath
+	if dir == "" {
+		return nil, fmt.Errorf("ServerPath must be set")
+	}
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("ServerPath must be an absolute path")
+	}
+	dir = filepath.Clean(dir)
+
+	// Directory must already exist (never created, content is used as is)
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ServerPath directory is not accessible: %v", err)
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("ServerPath is not a directory: %s", dir)
+	}
+
+	f.fConfig = cfg
+	f.fConfig.RootPath = dir
+	f.fConfig.DataImport.ServerPath = dir
+	f.fConfig.IsInSync = true
+	f.fConfig.Status = xsapiv1.StatusEnable
+
+	return &f.fConfig, nil
+}
+
+// GetConfig Get public part of folder config
+func (f *ImportFolder) GetConfig() xsapiv1.FolderConfig {
+	return f.fConfig
+}
+
+// GetFullPath returns the full path of a directory (from server POV)
+func (f *ImportFolder) GetFullPath(dir string) string {
+	return filepath.Join(f.fConfig.DataImport.ServerPath, dir)
+}
+
+// ConvPathCli2Svr Convert path from Client to Server
+func (f *ImportFolder) ConvPathCli2Svr(s string) string {
+	if f.fConfig.ClientPath != "" && f.fConfig.DataImport.ServerPath != "" {
+		return strings.Replace(s,
+			f.fConfig.ClientPath,
+			f.fConfig.DataImport.ServerPath,
+			-1)
+	}
+	return s
+}
+
+// ConvPathSvr2Cli Convert path from Server to Client
+func (f *ImportFolder) ConvPathSvr2Cli(s string) string {
+	if f.fConfig.ClientPath != "" && f.fConfig.DataImport.ServerPath != "" {
+		return strings.Replace(s,
+			f.fConfig.DataImport.ServerPath,
+			f.fConfig.ClientPath,
+			-1)
+	}
+	return s
+}
+
+// Remove a folder (server files are always kept)
+func (f *ImportFolder) Remove() error {
+	if !f.isExported() {
+		return nil
+	}
+	return f.SThg.FolderDelete(f.fConfig.ID)
+}
+
+// Update update some fields of a folder
+func (f *ImportFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if f.fConfig.ID != cfg.ID {
+		return nil, fmt.Errorf("Invalid id")
+	}
+	if cfg.Label != f.fConfig.Label && f.isExported() {
+		if err := f.SThg.FolderExport(cfg.ID, cfg.Label, cfg.RootPath, cfg.DataImport.ExportSyncThingID); err != nil {
+			return nil, err
+		}
+	}
+	f.fConfig = cfg
+	return &f.fConfig, nil
+}
+
+// Sync Force folder files synchronization (IOW send server files to client)
+func (f *ImportFolder) Sync() error {
+	if !f.isExported() {
+		return nil
+	}
+	return f.SThg.FolderScan(f.fConfig.ID, "")
+}
+
+// IsInSync Check if folder files are in-sync
+func (f *ImportFolder) IsInSync() (bool, error) {
+	return true, nil
+}
+
+// Rescan Walk folder files to refresh their status (run in background)
+func (f *ImportFolder) Rescan() error {
+	dir := f.fConfig.DataImport.ServerPath
+	if !common.IsDir(dir) {
+		return fmt.Errorf("ServerPath directory is not accessible: %s", dir)
+	}
+	if f.isExported() {
+		return f.SThg.FolderScan(f.fConfig.ID, "")
+	}
+	go func() {
+		n, err := statWalk(dir)
+		f.Log.Debugf("Rescan of folder %s done: %d entries (err=%v)", f.fConfig.ID, n, err)
+	}()
+	return nil
+}
+
+/*** Private functions ***/
+
+// isExported returns true when folder files are sent to a client device
+func (f *ImportFolder) isExported() bool {
+	return f.fConfig.DataImport.ExportSyncThingID != "" && f.SThg != nil
+}
@@ -34,5 +34,6 @@ type IFOLDER interface {
 	Remove() error                                                  // Remove a folder
 	Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) // Update a new folder
 	Sync() error                                                    // Force folder files synchronization
+	Rescan() error                                                  // Queue an immediate rescan of folder files
 	IsInSync() (bool, error)                                        // Check if folder files are in-sync
 }
@@ -0,0 +1,410 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+)
+
+// IFOLDER interface implementation for network mounted folders (NFS or CIFS)
+
+const netMountsFile = "/proc/mounts"
+const netMountDefaultCheck = 30  // Time (in seconds) between two health checks
+const netMountAccessTimeout = 5  // Time (in seconds) after which mount is declared unhealthy
+const netMountHelperTimeout = 60 // Maximum duration (in seconds) of mount helpers
+
+// Filesystem types accepted for each folder type
+var netMountFsTypes = map[xsapiv1.FolderType][]string{
+	xsapiv1.TypeNfs:     {"nfs", "nfs4"},
+	xsapiv1.TypeCifsSmb: {"cifs", "smb3"},
+}
+
+func init() {
+	for _, t := range []xsapiv1.FolderType{xsapiv1.TypeNfs, xsapiv1.TypeCifsSmb} {
+		RegisterFolderDriver(t, func(ctx *Context) IFOLDER { return NewFolderNetMount(ctx) })
+	}
+}
+
+// NetMountFolder .
+type NetMountFolder struct {
+	*Context
+	fConfig xsapiv1.FolderConfig
+	stop    chan struct{} // signals intentional stop
+}
+
+// NewFolderNetMount Create a new instance of NetMountFolder
+func NewFolderNetMount(ctx *Context) *NetMountFolder {
+	f := NetMountFolder{
+		Context: ctx,
+		fConfig: xsapiv1.FolderConfig{
+			Status: xsapiv1.StatusDisable,
+		},
+	}
+	return &f
+}
+
+// NewUID Get a UUID
+func (f *NetMountFolder) NewUID(suffix string) string {
+	uuid := uuid.NewV1().String()
+	if len(suffix) > 0 {
+		uuid += "_" + suffix
+	}
+	return uuid
+}
+
+// Add a new folder
+func (f *NetMountFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	fld, err := f.Setup(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// New folder must be usable
+	if fld.DataNetMount.MountState != xsapiv1.MountStateMounted {
+		f.stopMonitoring()
+		return nil, fmt.Errorf("%s is not usable (%s): %s", fld.DataNetMount.ServerPath,
+			fld.DataNetMount.MountState, fld.DataNetMount.LastError)
+	}
+	return fld, nil
+}
+
+// Setup Setup local project config
+func (f *NetMountFolder) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+
+	if cfg.DataNetMount.ServerPath == "" {
+		return nil, fmt.Errorf("ServerPath must be set")
+	}
+	if cfg.DataNetMount.AutoMount {
+		if cfg.DataNetMount.Source == "" {
+			return nil, fmt.Errorf("Source must be set to mount folder")
+		}
+		if f.mountHelpers() == nil || f.mountHelpers().MountHelper == "" {
+			return nil, fmt.Errorf("mount helper not set in server config (netMount.mountHelper)")
+		}
+	}
+
+	// Use shareRootDir if ServerPath is a relative path
+	dir := cfg.DataNetMount.ServerPath
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(f.Config.FileConf.ShareRootDir, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create mount point directory: %s", dir)
+	}
+
+	f.stopMonitoring()
+
+	f.fConfig = cfg
+	f.fConfig.RootPath = dir
+	f.fConfig.DataNetMount.ServerPath = dir
+
+	// Mount folder when managed by server
+	if cfg.DataNetMount.AutoMount {
+		if st, _, _ := f.mountState(); st == xsapiv1.MountStateNotMounted {
+			if err := f.mount(); err != nil {
+				f.Log.Errorf("Cannot mount folder %s: %v", cfg.ID, err)
+			}
+		}
+	}
+
+	// Don't return an error when mount is not healthy (eg. on server startup),
+	// state is reported in folder status and periodically updated
+	f.checkMount()
+
+	f.stop = make(chan struct{})
+	go f.monitorMount(f.stop)
+
+	return &f.fConfig, nil
+}
+
+// GetConfig Get public part of folder config
+func (f *NetMountFolder) GetConfig() xsapiv1.FolderConfig {
+	return f.fConfig
+}
+
+// GetFullPath returns the full path of a directory (from server POV)
+func (f *NetMountFolder) GetFullPath(dir string) string {
+	return filepath.Join(f.fConfig.DataNetMount.ServerPath, dir)
+}
+
+// ConvPathCli2Svr Convert path from Client to Server
+func (f *NetMountFolder) ConvPathCli2Svr(s string) string {
+	if f.fConfig.ClientPath != "" && f.fConfig.DataNetMount.ServerPath != "" {
+		return strings.Replace(s,
+			f.fConfig.ClientPath,
+			f.fConfig.DataNetMount.ServerPath,
+			-1)
+	}
+	return s
+}
+
+// ConvPathSvr2Cli Convert path from Server to Client
+func (f *NetMountFolder) ConvPathSvr2Cli(s string) string {
+	if f.fConfig.ClientPath != "" && f.fConfig.DataNetMount.ServerPath != "" {
+		return strings.Replace(s,
+			f.fConfig.DataNetMount.ServerPath,
+			f.fConfig.ClientPath,
+			-1)
+	}
+	return s
+}
+
+// Remove a folder (files are never deleted, only umount when managed by server)
+func (f *NetMountFolder) Remove() error {
+	f.stopMonitoring()
+	if !f.fConfig.DataNetMount.AutoMount {
+		return nil
+	}
+	if st, _, _ := f.mountState(); st == xsapiv1.MountStateNotMounted {
+		return nil
+	}
+	return f.umount()
+}
+
+// Update update some fields of a folder
+func (f *NetMountFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if f.fConfig.ID != cfg.ID {
+		return nil, fmt.Errorf("Invalid id")
+	}
+	f.fConfig = cfg
+	return &f.fConfig, nil
+}
+
+// Sync Force folder files synchronization (IOW refresh mount state)
+func (f *NetMountFolder) Sync() error {
+	if f.checkMount() != xsapiv1.MountStateMounted {
+		return fmt.Errorf("folder not usable: %s", f.fConfig.DataNetMount.LastError)
+	}
+	return nil
+}
+
+// Rescan Refresh mount state and walk folder files (run in background)
+func (f *NetMountFolder) Rescan() error {
+	go func() {
+		if f.checkMount() != xsapiv1.MountStateMounted {
+			f.Log.Errorf("Rescan of folder %s failed: %s", f.fConfig.ID, f.fConfig.DataNetMount.LastError)
+			return
+		}
+		n, err := statWalk(f.fConfig.DataNetMount.ServerPath)
+		f.Log.Debugf("Rescan of folder %s done: %d entries (err=%v)", f.fConfig.ID, n, err)
+	}()
+	return nil
+}
+
+// IsInSync Check if folder files are in-sync
+func (f *NetMountFolder) IsInSync() (bool, error) {
+	return f.fConfig.DataNetMount.MountState == xsapiv1.MountStateMounted, nil
+}
+
+/*** Private functions ***/
+
+func (f *NetMountFolder) mountHelpers() *xdsconfig.NetMountConf {
+	return f.Config.FileConf.NetMountConf
+}
+
+// checkMount updates mount state and folder status, returns new mount state
+func (f *NetMountFolder) checkMount() string {
+	prevSync := f.fConfig.IsInSync
+	prevStatus := f.fConfig.Status
+	prevState := f.fConfig.DataNetMount.MountState
+
+	state, fsType, err := f.mountState()
+	f.fConfig.DataNetMount.MountState = state
+	f.fConfig.DataNetMount.FsType = fsType
+	f.fConfig.DataNetMount.LastError = ""
+	if err != nil {
+		f.fConfig.DataNetMount.LastError = err.Error()
+	}
+
+	if state == xsapiv1.MountStateMounted {
+		f.fConfig.Status = xsapiv1.StatusEnable
+		f.fConfig.IsInSync = true
+	} else {
+		f.fConfig.Status = xsapiv1.StatusErrorConfig
+		f.fConfig.IsInSync = false
+	}
+
+	if prevState != state && prevState != "" {
+		f.Log.Warningf("Mount state of folder %s changed: %s -> %s %s", f.fConfig.ID, prevState, state, f.fConfig.DataNetMount.LastError)
+	}
+	if prevSync != f.fConfig.IsInSync || prevStatus != f.fConfig.Status || prevState != state {
+		// Emit Folder state change event
+		if err := f.events.Emit(xsapiv1.EVTFolderStateChange, &f.fConfig, ""); err != nil {
+			f.Log.Warningf("Cannot notify folder change: %v", err)
+		}
+	}
+	return state
+}
+
+// mountState returns mount state and filesystem type of folder ServerPath
+func (f *NetMountFolder) mountState() (string, string, error) {
+	dir := f.fConfig.DataNetMount.ServerPath
+
+	fsType, err := findMount(dir)
+	if err != nil {
+		return xsapiv1.MountStateNotMounted, "", err
+	}
+	if fsType == "" {
+		return xsapiv1.MountStateNotMounted, "", fmt.Errorf("%s is not a mount point", dir)
+	}
+
+	valid := false
+	for _, t := range netMountFsTypes[f.fConfig.Type] {
+		if strings.HasPrefix(fsType, t) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return xsapiv1.MountStateUnhealthy, fsType, fmt.Errorf("unexpected filesystem type %s", fsType)
+	}
+
+	// Access may hang on stale mounts
+	errCh := make(chan error, 1)
+	go func() {
+		fd, err := os.Open(dir)
+		if err == nil {
+			_, err = fd.Readdirnames(1)
+			fd.Close()
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return xsapiv1.MountStateUnhealthy, fsType, err
+		}
+	case <-time.After(netMountAccessTimeout * time.Second):
+		return xsapiv1.MountStateUnhealthy, fsType, fmt.Errorf("access timeout")
+	}
+
+	return xsapiv1.MountStateMounted, fsType, nil
+}
+
+// mount mounts folder using mount helper
+func (f *NetMountFolder) mount() error {
+	cfg := f.fConfig.DataNetMount
+	typ := strings.ToLower(string(f.fConfig.Type))
+	return runNetMountHelper(f.mountHelpers().MountHelper, typ, cfg.Source, cfg.ServerPath, cfg.Options)
+}
+
+// umount umounts folder using umount helper
+func (f *NetMountFolder) umount() error {
+	h := f.mountHelpers()
+	if h == nil || h.UmountHelper == "" {
+		return fmt.Errorf("umount helper not set in server config (netMount.umountHelper)")
+	}
+	return runNetMountHelper(h.UmountHelper, f.fConfig.DataNetMount.ServerPath)
+}
+
+// stopMonitoring stops periodic health checks
+func (f *NetMountFolder) stopMonitoring() {
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+func (f *NetMountFolder) monitorMount(stop chan struct{}) {
+	interval := time.Duration(netMountDefaultCheck)
+	if h := f.mountHelpers(); h != nil && h.CheckS > 0 {
+		interval = time.Duration(h.CheckS)
+	}
+	for {
+		select {
+		case <-stop:
+			f.Log.Debugf("Stop mount monitoring of folder %s", f.fConfig.ID)
+			return
+		case <-time.After(interval * time.Second):
+			f.checkMount()
+		}
+	}
+}
+
+// findMount returns filesystem type of a mount point (empty when not mounted)
+func findMount(dir string) (string, error) {
+	fd, err := os.Open(netMountsFile)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	dir = filepath.Clean(dir)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		// format: <source> <mount point> <type> <options> <dump> <pass>
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		if unescapeMountPath(fields[1]) == dir {
+			return fields[2], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// unescapeMountPath decodes octal escapes (eg. \040 for space) of /proc/mounts
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	res := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				res = append(res, byte(v))
+				i += 3
+				continue
+			}
+		}
+		res = append(res, s[i])
+	}
+	return string(res)
+}
+
+// runNetMountHelper executes a mount/umount helper
+func runNetMountHelper(helper string, args ...string) error {
+	cmd := exec.Command(helper, args...)
+	timer := time.AfterFunc(netMountHelperTimeout*time.Second, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", filepath.Base(helper), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+const pathMapDefaultDirMode = 0755
+
+/*** Private functions ***/
+
+// checkServerPath validates (and creates when allowed) ServerPath of a
+// PathMap folder, so that errors are reported on folder creation and not
+// later at exec time
+func checkServerPath(dir string, conf *xdsconfig.PathMapConf) error {
+	if conf == nil {
+		conf = &xdsconfig.PathMapConf{}
+	}
+
+	if !common.Exists(dir) {
+		if conf.NoAutoCreate {
+			return fmt.Errorf("ServerPath directory doesn't exist: %s", dir)
+		}
+		if err := createServerPath(dir, conf); err != nil {
+			return err
+		}
+	}
+	if !common.IsDir(dir) {
+		return fmt.Errorf("ServerPath is not a directory: %s", dir)
+	}
+
+	// Writable by server user
+	fd, err := ioutil.TempFile(dir, ".xds-write-check-")
+	if err != nil {
+		return fmt.Errorf("ServerPath directory is not writable: %s (%v)", dir, err)
+	}
+	fd.Close()
+	os.Remove(fd.Name())
+
+	// Located on expected mount (eg. volume shared with XDS agent)
+	if conf.MountPoint != "" {
+		if err := checkMountPoint(dir, conf.MountPoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createServerPath creates directory (and missing parents) using
+// configured permissions and ownership
+func createServerPath(dir string, conf *xdsconfig.PathMapConf) error {
+	mode := os.FileMode(pathMapDefaultDirMode)
+	if conf.DirMode != "" {
+		m, err := strconv.ParseUint(conf.DirMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid pathMap dirMode '%s'", conf.DirMode)
+		}
+		mode = os.FileMode(m)
+	}
+	uid, gid := -1, -1
+	if conf.Owner != "" {
+		var err error
+		if uid, gid, err = lookupOwner(conf.Owner); err != nil {
+			return err
+		}
+	}
+
+	// Find first missing parent, all directories from it will be created
+	top := dir
+	for !common.Exists(filepath.Dir(top)) && filepath.Dir(top) != top {
+		top = filepath.Dir(top)
+	}
+
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("Cannot create ServerPath directory: %s (%v)", dir, err)
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		// Explicitly set mode to not depend on umask
+		if err := os.Chmod(d, mode); err != nil {
+			return fmt.Errorf("Cannot set ServerPath permissions: %s (%v)", d, err)
+		}
+		if uid != -1 || gid != -1 {
+			if err := os.Chown(d, uid, gid); err != nil {
+				return fmt.Errorf("Cannot set ServerPath ownership: %s (%v)", d, err)
+			}
+		}
+		if d == top {
+			break
+		}
+	}
+	return nil
+}
+
+// checkMountPoint verifies that dir is located under mountPoint and that
+// mountPoint is really mounted (IOW not a plain directory of parent filesystem)
+func checkMountPoint(dir, mountPoint string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	realMnt, err := filepath.EvalSymlinks(mountPoint)
+	if err != nil {
+		return fmt.Errorf("pathMap mountPoint not accessible: %s (%v)", mountPoint, err)
+	}
+	if realDir != realMnt && !strings.HasPrefix(realDir, strings.TrimSuffix(realMnt, "/")+"/") {
+		return fmt.Errorf("ServerPath %s is not located under mount point %s", dir, mountPoint)
+	}
+
+	mntDev, err := fileDevice(realMnt)
+	if err != nil {
+		return err
+	}
+	if realMnt != "/" {
+		parentDev, err := fileDevice(filepath.Dir(realMnt))
+		if err != nil {
+			return err
+		}
+		if parentDev == mntDev {
+			return fmt.Errorf("%s is not a mount point (volume not mounted ?)", mountPoint)
+		}
+	}
+	dirDev, err := fileDevice(realDir)
+	if err != nil {
+		return err
+	}
+	if dirDev != mntDev {
+		return fmt.Errorf("ServerPath %s is not located on filesystem mounted on %s", dir, mountPoint)
+	}
+	return nil
+}
+
+// lookupOwner converts a "user[:group]" string (names or numeric ids) to uid/gid
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			u, err := user.Lookup(parts[0])
+			if err != nil {
+				return -1, -1, fmt.Errorf("invalid pathMap owner '%s': %v", owner, err)
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return -1, -1, fmt.Errorf("invalid pathMap owner '%s': %v", owner, err)
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
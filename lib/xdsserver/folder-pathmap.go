@@ -31,6 +31,10 @@ import (
 
 // IFOLDER interface implementation for native/path mapping folders
 
+func init() {
+	RegisterFolderDriver(xsapiv1.TypePathMap, func(ctx *Context) IFOLDER { return NewFolderPathMap(ctx) })
+}
+
 // PathMap .
 type PathMap struct {
 	*Context
@@ -75,15 +79,9 @@ func (f *PathMap) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error)
 		dir = filepath.Join(f.Config.FileConf.ShareRootDir, dir)
 	}
 
-	// Sanity check
-	if !common.Exists(dir) {
-		// try to create if not existing
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, fmt.Errorf("Cannot create ServerPath directory: %s", dir)
-		}
-	}
-	if !common.Exists(dir) {
-		return nil, fmt.Errorf("ServerPath directory is not accessible: %s", dir)
+	// Sanity check (and create directory if not existing)
+	if err := checkServerPath(dir, f.Config.FileConf.PathMapConf); err != nil {
+		return nil, err
 	}
 
 	f.fConfig = cfg
@@ -186,3 +184,28 @@ func (f *PathMap) Sync() error {
 func (f *PathMap) IsInSync() (bool, error) {
 	return true, nil
 }
+
+// Rescan Walk folder files to refresh their status (run in background)
+func (f *PathMap) Rescan() error {
+	dir := f.fConfig.DataPathMap.ServerPath
+	if !common.IsDir(dir) {
+		return fmt.Errorf("ServerPath directory is not accessible: %s", dir)
+	}
+	go func() {
+		n, err := statWalk(dir)
+		f.Log.Debugf("Rescan of folder %s done: %d entries (err=%v)", f.fConfig.ID, n, err)
+	}()
+	return nil
+}
+
+// statWalk stats all entries of a tree and returns their number
+func statWalk(root string) (int, error) {
+	cnt := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			cnt++
+		}
+		return nil
+	})
+	return cnt, err
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const quotaDefaultCheckTime = 60 // Time (in seconds) between two usage computations
+const quotaDefaultWarning = 90   // Usage percent above which a warning is emitted
+
+// GetUsage returns the last computed disk usage of a folder (nil when folder has no quota)
+func (w *FolderWatcher) GetUsage(id string) *xsapiv1.FolderDiskUsage {
+	w.usageMutex.Lock()
+	defer w.usageMutex.Unlock()
+	u, exist := w.usage[id]
+	if !exist {
+		return nil
+	}
+	res := *u
+	return &res
+}
+
+// IsQuotaExceeded returns true when a folder uses more than its quota
+func (w *FolderWatcher) IsQuotaExceeded(id string) bool {
+	u := w.GetUsage(id)
+	return u != nil && u.State == xsapiv1.QuotaStateExceeded
+}
+
+/*** Private functions ***/
+
+func (w *FolderWatcher) quotaLoop() {
+	for {
+		select {
+		case <-w.stop:
+			w.Log.Debugln("Stop folder quotaLoop")
+			return
+		case <-time.After(time.Duration(w.quota.CheckS) * time.Second):
+			w.checkQuotas()
+		}
+	}
+}
+
+// checkQuotas computes disk usage of folders with a quota and applies quota state
+func (w *FolderWatcher) checkQuotas() {
+	known := make(map[string]bool)
+	for _, fc := range w.mfolders.GetConfigArr() {
+		quotaMB := fc.QuotaMB
+		if quotaMB == 0 {
+			quotaMB = w.quota.DefaultMB
+		}
+		f := w.mfolders.Get(fc.ID)
+		if quotaMB <= 0 || f == nil {
+			continue
+		}
+		dir := (*f).GetFullPath("")
+		if dir == "" {
+			continue
+		}
+		known[fc.ID] = true
+
+		u := xsapiv1.FolderDiskUsage{
+			FolderID:   fc.ID,
+			UsedBytes:  diskUsage(dir),
+			QuotaBytes: quotaMB * 1024 * 1024,
+			CheckedAt:  time.Now().String(),
+		}
+		u.Percent = int(u.UsedBytes * 100 / u.QuotaBytes)
+		switch {
+		case u.UsedBytes > u.QuotaBytes:
+			u.State = xsapiv1.QuotaStateExceeded
+		case u.Percent >= w.quota.WarningPercent:
+			u.State = xsapiv1.QuotaStateWarning
+		default:
+			u.State = xsapiv1.QuotaStateOk
+		}
+
+		w.usageMutex.Lock()
+		prevState := xsapiv1.QuotaStateOk
+		if prev, exist := w.usage[fc.ID]; exist {
+			prevState = prev.State
+		}
+		w.usage[fc.ID] = &u
+		w.usageMutex.Unlock()
+
+		if u.State != prevState {
+			w.quotaStateChanged(fc, u)
+		}
+	}
+
+	// Forget folders that have been deleted or have no more quota
+	w.usageMutex.Lock()
+	released := []string{}
+	for id := range w.usage {
+		if !known[id] {
+			delete(w.usage, id)
+			if w.quotaPaused[id] {
+				released = append(released, id)
+			}
+		}
+	}
+	w.usageMutex.Unlock()
+	for _, id := range released {
+		w.quotaResume(id)
+	}
+}
+
+// quotaStateChanged notifies new quota state and pauses or resumes sync
+func (w *FolderWatcher) quotaStateChanged(fc xsapiv1.FolderConfig, u xsapiv1.FolderDiskUsage) {
+	if u.State == xsapiv1.QuotaStateOk {
+		w.Log.Infof("Folder %s disk usage back under quota (%d%%)", fc.ID, u.Percent)
+	} else {
+		w.Log.Warningf("Folder %s disk usage %s quota: %d/%d bytes", fc.ID, u.State, u.UsedBytes, u.QuotaBytes)
+	}
+	if err := w.events.Emit(xsapiv1.EVTFolderQuota, u, ""); err != nil {
+		w.Log.Warningf("Cannot notify folder quota: %v", err)
+	}
+
+	// Only CloudSync folders can be paused, don't resume a folder paused by user
+	if fc.Type != xsapiv1.TypeCloudSync {
+		return
+	}
+	if u.State == xsapiv1.QuotaStateExceeded && fc.Status != xsapiv1.StatusPause {
+		if _, err := w.mfolders.SetPaused(fc.ID, true); err != nil {
+			w.Log.Errorf("Cannot pause folder %s: %v", fc.ID, err)
+			return
+		}
+		w.usageMutex.Lock()
+		w.quotaPaused[fc.ID] = true
+		w.usageMutex.Unlock()
+	} else if u.State != xsapiv1.QuotaStateExceeded {
+		w.quotaResume(fc.ID)
+	}
+}
+
+// quotaResume resumes sync of a folder previously paused because of quota
+func (w *FolderWatcher) quotaResume(id string) {
+	w.usageMutex.Lock()
+	paused := w.quotaPaused[id]
+	delete(w.quotaPaused, id)
+	w.usageMutex.Unlock()
+
+	if !paused || w.mfolders.Get(id) == nil {
+		return
+	}
+	if _, err := w.mfolders.SetPaused(id, false); err != nil {
+		w.Log.Errorf("Cannot resume folder %s: %v", id, err)
+	}
+}
+
+// diskUsage returns the size in bytes of all files of a tree
+func diskUsage(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
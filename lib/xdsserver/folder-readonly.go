@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Commands executed in read-only folders run in a mount namespace created by
+// bubblewrap where folder directory is bind mounted read-only
+const readOnlySandboxCmd = "bwrap"
+
+// checkReadOnlyConfig validates read-only settings of a folder
+func checkReadOnlyConfig(cfg *xsapiv1.FolderConfig) error {
+	if cfg.OutputPath == "" {
+		return nil
+	}
+	out := filepath.Clean(filepath.FromSlash(cfg.OutputPath))
+	if filepath.IsAbs(out) || out == "." || out == ".." || strings.HasPrefix(out, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("outputPath must be a sub-directory of folder")
+	}
+	cfg.OutputPath = filepath.ToSlash(out)
+	return nil
+}
+
+// readOnlyCommand wraps a shell command line so that it cannot modify files
+// of a folder except in folder output directory
+func readOnlyCommand(root, outputPath, shCmd string) (string, error) {
+	bwrap, err := exec.LookPath(readOnlySandboxCmd)
+	if err != nil {
+		return "", fmt.Errorf("commands cannot be executed in read-only folder: %s not installed", readOnlySandboxCmd)
+	}
+
+	args := []string{bwrap, "--dev-bind", "/", "/", "--ro-bind", root, root}
+	if outputPath != "" {
+		out := filepath.Join(root, filepath.FromSlash(outputPath))
+		if err := os.MkdirAll(out, 0755); err != nil {
+			return "", fmt.Errorf("Cannot create output directory: %v", err)
+		}
+		args = append(args, "--bind", out, out)
+	}
+	args = append(args, "--die-with-parent", "--", "/bin/bash", "-c", shCmd)
+
+	for i := range args {
+		args[i] = shellQuote(args[i])
+	}
+	return "exec " + strings.Join(args, " "), nil
+}
+
+// shellQuote quotes a string to be used as a single shell argument
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
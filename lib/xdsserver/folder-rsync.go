@@ -0,0 +1,350 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// IFOLDER interface implementation for rsync over SSH folders
+// (used when Syncthing cannot be used)
+
+const rsyncDefaultInterval = 60     // Time (in seconds) between two periodic syncs
+const rsyncDefaultTimeout = 30 * 60 // Maximum duration (in seconds) of one sync
+const rsyncSSHOptions = "-o BatchMode=yes -o StrictHostKeyChecking=accept-new"
+
+// Supported remote hosts ([user@]host) and characters forbidden in remote
+// paths (interpreted by remote shell)
+var reRsyncHost = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9_.-]*@)?[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+const rsyncPathForbidden = " \t\n\r;&|`$<>*?'\"\\(){}[]!#"
+
+func init() {
+	RegisterFolderDriver(xsapiv1.TypeRsync, func(ctx *Context) IFOLDER { return NewFolderRsync(ctx) })
+}
+
+// RsyncFolder .
+type RsyncFolder struct {
+	*Context
+	fConfig xsapiv1.FolderConfig
+	mutex   sync.Mutex    // only one rsync at a time
+	stop    chan struct{} // signals intentional stop
+}
+
+// NewFolderRsync Create a new instance of RsyncFolder
+func NewFolderRsync(ctx *Context) *RsyncFolder {
+	f := RsyncFolder{
+		Context: ctx,
+		fConfig: xsapiv1.FolderConfig{
+			Status: xsapiv1.StatusDisable,
+		},
+		mutex: sync.NewMutex(),
+	}
+	return &f
+}
+
+// NewUID Get a UUID
+func (f *RsyncFolder) NewUID(suffix string) string {
+	uuid := uuid.NewV1().String()
+	if len(suffix) > 0 {
+		uuid += "_" + suffix
+	}
+	return uuid
+}
+
+// Add a new folder
+func (f *RsyncFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	return f.Setup(cfg)
+}
+
+// Setup Setup local project config
+func (f *RsyncFolder) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+
+	if _, err := exec.LookPath("rsync"); err != nil {
+		return nil, fmt.Errorf("rsync not found on server")
+	}
+	if cfg.DataRsync.RemoteHost == "" {
+		return nil, fmt.Errorf("RemoteHost must be set")
+	}
+	if !reRsyncHost.MatchString(cfg.DataRsync.RemoteHost) {
+		return nil, fmt.Errorf("Invalid RemoteHost '%s'", cfg.DataRsync.RemoteHost)
+	}
+	if cfg.DataRsync.RemotePath == "" {
+		return nil, fmt.Errorf("RemotePath must be set")
+	}
+	if strings.HasPrefix(cfg.DataRsync.RemotePath, "-") || strings.ContainsAny(cfg.DataRsync.RemotePath, rsyncPathForbidden) {
+		return nil, fmt.Errorf("Invalid RemotePath '%s'", cfg.DataRsync.RemotePath)
+	}
+	switch cfg.DataRsync.Direction {
+	case "":
+		cfg.DataRsync.Direction = xsapiv1.RsyncDirectionPull
+	case xsapiv1.RsyncDirectionPull, xsapiv1.RsyncDirectionPush:
+	default:
+		return nil, fmt.Errorf("Invalid direction '%s'", cfg.DataRsync.Direction)
+	}
+	if cfg.DataRsync.SSHKey != "" {
+		key, err := f.secrets.Get(cfg.DataRsync.SSHKey)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(key, "-----BEGIN") {
+			return nil, fmt.Errorf("Secret '%s' is not a SSH private key", cfg.DataRsync.SSHKey)
+		}
+	}
+
+	// ServerPath is relative to shareRootDir when not set or not absolute,
+	// it must be located under shareRootDir (content is deleted by sync)
+	dir := cfg.DataRsync.ServerPath
+	if dir == "" {
+		dir = cfg.ID
+	}
+	root := filepath.Clean(f.Config.FileConf.ShareRootDir)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+	if dir == root || !pathUnder(dir, root) {
+		return nil, fmt.Errorf("ServerPath must be located under shareRootDir")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create ServerPath directory: %s", dir)
+	}
+
+	f.stopMonitoring()
+
+	f.fConfig = cfg
+	f.fConfig.RootPath = dir
+	f.fConfig.DataRsync.ServerPath = dir
+	f.fConfig.IsInSync = false // will be updated after first sync
+	f.fConfig.Status = xsapiv1.StatusEnable
+
+	// Start periodic synchronization
+	if f.fConfig.DataRsync.IntervalS >= 0 {
+		f.stop = make(chan struct{})
+		go f.monitorSync(f.stop)
+	}
+
+	return &f.fConfig, nil
+}
+
+// GetConfig Get public part of folder config
+func (f *RsyncFolder) GetConfig() xsapiv1.FolderConfig {
+	return f.fConfig
+}
+
+// GetFullPath returns the full path of a directory (from server POV)
+func (f *RsyncFolder) GetFullPath(dir string) string {
+	return filepath.Join(f.fConfig.DataRsync.ServerPath, dir)
+}
+
+// ConvPathCli2Svr Convert path from Client to Server
+func (f *RsyncFolder) ConvPathCli2Svr(s string) string {
+	if f.fConfig.ClientPath != "" && f.fConfig.DataRsync.ServerPath != "" {
+		return strings.Replace(s,
+			f.fConfig.ClientPath,
+			f.fConfig.DataRsync.ServerPath,
+			-1)
+	}
+	return s
+}
+
+// ConvPathSvr2Cli Convert path from Server to Client
+func (f *RsyncFolder) ConvPathSvr2Cli(s string) string {
+	if f.fConfig.ClientPath != "" && f.fConfig.DataRsync.ServerPath != "" {
+		return strings.Replace(s,
+			f.fConfig.DataRsync.ServerPath,
+			f.fConfig.ClientPath,
+			-1)
+	}
+	return s
+}
+
+// Remove a folder
+func (f *RsyncFolder) Remove() error {
+	f.stopMonitoring()
+	return nil
+}
+
+// Update update some fields of a folder
+func (f *RsyncFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if f.fConfig.ID != cfg.ID {
+		return nil, fmt.Errorf("Invalid id")
+	}
+	f.fConfig = cfg
+	return &f.fConfig, nil
+}
+
+// Sync Force folder files synchronization
+func (f *RsyncFolder) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.setState(xsapiv1.StatusSyncing, false)
+
+	out, err := f.rsync()
+
+	f.fConfig.DataRsync.LastSync = time.Now().String()
+	if err != nil {
+		f.fConfig.DataRsync.LastError = strings.TrimSpace(err.Error() + ": " + string(out))
+		f.Log.Errorf("rsync of folder %s failed: %s", f.fConfig.ID, f.fConfig.DataRsync.LastError)
+		f.setState(xsapiv1.StatusEnable, false)
+		return fmt.Errorf("rsync failed: %v", err)
+	}
+	f.fConfig.DataRsync.LastError = ""
+	f.setState(xsapiv1.StatusEnable, true)
+	return nil
+}
+
+// Rescan Queue an immediate synchronization
+func (f *RsyncFolder) Rescan() error {
+	go func() {
+		if err := f.Sync(); err != nil {
+			f.Log.Errorf("Rescan of folder %s failed: %v", f.fConfig.ID, err)
+		}
+	}()
+	return nil
+}
+
+// IsInSync Check if folder files are in-sync
+func (f *RsyncFolder) IsInSync() (bool, error) {
+	return f.fConfig.IsInSync, nil
+}
+
+/*** Private functions ***/
+
+// rsync executes rsync command and returns its output
+func (f *RsyncFolder) rsync() ([]byte, error) {
+	cfg := f.fConfig.DataRsync
+
+	ssh := "ssh " + rsyncSSHOptions
+	if cfg.SSHPort > 0 {
+		ssh += " -p " + strconv.Itoa(cfg.SSHPort)
+	}
+	if cfg.SSHKey != "" {
+		keyFile, err := f.sshKeyFile(cfg.SSHKey)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(keyFile)
+		ssh += " -i " + shellQuote(keyFile) + " -o IdentitiesOnly=yes"
+	}
+
+	args := append(rsyncAttrsArgs(f.fConfig.FileAttrs), "-z", "--delete", "-e", ssh)
+	for _, ex := range cfg.Excludes {
+		args = append(args, "--exclude", ex)
+	}
+
+	// Trailing slash to synchronize directories content
+	local := strings.TrimSuffix(cfg.ServerPath, "/") + "/"
+	remote := cfg.RemoteHost + ":" + strings.TrimSuffix(cfg.RemotePath, "/") + "/"
+	if cfg.Direction == xsapiv1.RsyncDirectionPush {
+		args = append(args, local, remote)
+	} else {
+		args = append(args, remote, local)
+	}
+
+	f.LogSillyf("rsync folder %s: args %v", f.fConfig.ID, args)
+
+	cmd := exec.Command("rsync", args...)
+	timer := time.AfterFunc(rsyncDefaultTimeout*time.Second, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+
+	return cmd.CombinedOutput()
+}
+
+// sshKeyFile writes SSH private key of a secret in a temporary file (must be
+// removed by caller)
+func (f *RsyncFolder) sshKeyFile(name string) (string, error) {
+	key, err := f.secrets.Get(name)
+	if err != nil {
+		return "", err
+	}
+	fd, err := ioutil.TempFile("", "xds-rsync-key-")
+	if err != nil {
+		return "", err
+	}
+	keyFile := fd.Name()
+	_, err = fd.WriteString(key + "\n")
+	fd.Close()
+	if err == nil {
+		err = os.Chmod(keyFile, 0600)
+	}
+	if err != nil {
+		os.Remove(keyFile)
+		return "", err
+	}
+	return keyFile, nil
+}
+
+// setState updates folder status and notifies changes
+func (f *RsyncFolder) setState(status string, inSync bool) {
+	prevSync := f.fConfig.IsInSync
+	prevStatus := f.fConfig.Status
+
+	f.fConfig.Status = status
+	f.fConfig.IsInSync = inSync
+
+	if prevSync != f.fConfig.IsInSync || prevStatus != f.fConfig.Status {
+		// Emit Folder state change event
+		if err := f.events.Emit(xsapiv1.EVTFolderStateChange, &f.fConfig, ""); err != nil {
+			f.Log.Warningf("Cannot notify folder change: %v", err)
+		}
+	}
+}
+
+// stopMonitoring stops periodic synchronization
+func (f *RsyncFolder) stopMonitoring() {
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+func (f *RsyncFolder) monitorSync(stop chan struct{}) {
+	interval := time.Duration(rsyncDefaultInterval)
+	if f.fConfig.DataRsync.IntervalS > 0 {
+		interval = time.Duration(f.fConfig.DataRsync.IntervalS)
+	}
+	for {
+		select {
+		case <-stop:
+			f.Log.Debugf("Stop rsync monitoring of folder %s", f.fConfig.ID)
+			return
+		case <-time.After(interval * time.Second):
+			if err := f.Sync(); err != nil {
+				f.Log.Debugf("Periodic sync of folder %s: %v", f.fConfig.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+
+	"github.com/franciscocpg/reflectme"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Access rights ordered from the lowest to the highest
+var folderAccessLevel = map[string]int{
+	xsapiv1.FolderAccessRead:      1,
+	xsapiv1.FolderAccessReadWrite: 2,
+	xsapiv1.FolderAccessOwner:     3,
+}
+
+// Commands running in shared folders (folder ID -> command ID -> session ID)
+var folderExecs = make(map[string]map[string]string)
+var folderExecsMutex = sync.NewMutex()
+
+// Access returns the access right of a client on a folder (empty when none)
+func (f *Folders) Access(id, clientID string) string {
+	fc := f.Get(id)
+	if fc == nil {
+		return ""
+	}
+	return f.clientFolderAccess((*fc).GetConfig(), clientID)
+}
+
+// HasAccess returns true when a client has at least the requested access on a folder
+func (f *Folders) HasAccess(id, clientID, need string) bool {
+	return folderAccessLevel[f.Access(id, clientID)] >= folderAccessLevel[need]
+}
+
+// GetConfigArrFor returns the config of folders accessible by a client
+func (f *Folders) GetConfigArrFor(clientID string) []xsapiv1.FolderConfig {
+	res := []xsapiv1.FolderConfig{}
+	for _, fc := range f.GetConfigArr() {
+		if fc.Access = f.clientFolderAccess(fc, clientID); fc.Access != "" {
+			res = append(res, fc)
+		}
+	}
+	return res
+}
+
+// SetShares Replaces the list of clients a folder is shared with
+func (f *Folders) SetShares(id string, shares []xsapiv1.FolderShare) (*xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	fc, exist := f.folders[id]
+	if !exist {
+		return nil, fmt.Errorf("unknown id")
+	}
+
+	newCfg := xsapiv1.FolderConfig{}
+	reflectme.Copy((*fc).GetConfig(), &newCfg)
+	if newCfg.Owner == "" {
+		return nil, fmt.Errorf("folder without owner is already accessible by all clients")
+	}
+
+	seen := make(map[string]bool)
+	newCfg.Shares = []xsapiv1.FolderShare{}
+	for _, sh := range shares {
+		if sh.ClientID == "" || sh.ClientID == newCfg.Owner {
+			return nil, fmt.Errorf("invalid client id '%s'", sh.ClientID)
+		}
+		if sh.Access != xsapiv1.FolderAccessRead && sh.Access != xsapiv1.FolderAccessReadWrite {
+			return nil, fmt.Errorf("invalid access '%s' (must be read or readwrite)", sh.Access)
+		}
+		if seen[sh.ClientID] {
+			return nil, fmt.Errorf("client %s defined twice", sh.ClientID)
+		}
+		seen[sh.ClientID] = true
+		newCfg.Shares = append(newCfg.Shares, sh)
+	}
+
+	fld, err := (*fc).Update(newCfg)
+	if err != nil {
+		return fld, err
+	}
+
+	// Save config on disk
+	err = f.SaveConfig()
+
+	return fld, err
+}
+
+// ExecAcquire Registers a command running in a folder, commands of other
+// clients are rejected while a command is running in a shared folder
+func (f *Folders) ExecAcquire(id, clientID, cmdID string) error {
+	fc := f.Get(id)
+	if fc == nil {
+		return fmt.Errorf("Unknown id")
+	}
+	if len((*fc).GetConfig().Shares) == 0 {
+		return nil
+	}
+
+	folderExecsMutex.Lock()
+	defer folderExecsMutex.Unlock()
+	for cid, sid := range folderExecs[id] {
+		if sid != clientID {
+			return fmt.Errorf("folder busy: command %s of another client is running", cid)
+		}
+	}
+	if folderExecs[id] == nil {
+		folderExecs[id] = make(map[string]string)
+	}
+	folderExecs[id][cmdID] = clientID
+	return nil
+}
+
+// isExecRunning returns true when commands are running in a folder
+func (f *Folders) isExecRunning(id string) bool {
+	folderExecsMutex.Lock()
+	defer folderExecsMutex.Unlock()
+	return len(folderExecs[id]) > 0
+}
+
+// ExecRelease Unregisters a command registered by ExecAcquire
+func (f *Folders) ExecRelease(id, cmdID string) {
+	folderExecsMutex.Lock()
+	defer folderExecsMutex.Unlock()
+	delete(folderExecs[id], cmdID)
+	if len(folderExecs[id]) == 0 {
+		delete(folderExecs, id)
+	}
+}
@@ -0,0 +1,371 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// btrfs snapshots are created in this directory of folder parent directory
+// (must be on the same filesystem)
+const snapshotsBtrfsDir = ".xds-snapshots"
+
+var reSnapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// FolderSnapshots Manage snapshots of server-side folders content
+type FolderSnapshots struct {
+	*Context
+	snapshots map[string][]*xsapiv1.FolderSnapshot // folder ID -> snapshots
+	busy      map[string]bool                      // folders with a running operation
+	mutex     sync.Mutex
+}
+
+// Use XML format to be consistent with other files saved by server
+type xmlFolderSnapshots struct {
+	XMLName   xml.Name                 `xml:"snapshots"`
+	Version   string                   `xml:"version,attr"`
+	Snapshots []xsapiv1.FolderSnapshot `xml:"snapshot"`
+}
+
+// NewFolderSnapshots creates a new instance of FolderSnapshots
+func NewFolderSnapshots(ctx *Context) *FolderSnapshots {
+	fs := FolderSnapshots{
+		Context:   ctx,
+		snapshots: make(map[string][]*xsapiv1.FolderSnapshot),
+		busy:      make(map[string]bool),
+		mutex:     sync.NewMutex(),
+	}
+	if err := fs.load(); err != nil {
+		fs.Log.Errorf("Cannot load folders snapshots: %v", err)
+	}
+	return &fs
+}
+
+// List returns snapshots of a folder
+func (fs *FolderSnapshots) List(id string) []xsapiv1.FolderSnapshot {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	res := []xsapiv1.FolderSnapshot{}
+	for _, sn := range fs.snapshots[id] {
+		res = append(res, *sn)
+	}
+	return res
+}
+
+// Create saves current content of a folder
+func (fs *FolderSnapshots) Create(id string, args xsapiv1.FolderSnapshotArgs) (*xsapiv1.FolderSnapshot, error) {
+	root, err := fs.folderRoot(id)
+	if err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		args.Name = time.Now().Format("20060102-150405")
+	}
+	if !reSnapshotName.MatchString(args.Name) {
+		return nil, fmt.Errorf("invalid snapshot name (only letters, digits, '.', '_' and '-' allowed)")
+	}
+	switch args.Method {
+	case "":
+		args.Method = xsapiv1.SnapshotMethodTar
+		if isBtrfsSubvolume(root) {
+			args.Method = xsapiv1.SnapshotMethodBtrfs
+		}
+	case xsapiv1.SnapshotMethodTar:
+	case xsapiv1.SnapshotMethodBtrfs:
+		if !isBtrfsSubvolume(root) {
+			return nil, fmt.Errorf("folder directory is not a btrfs subvolume")
+		}
+	default:
+		return nil, fmt.Errorf("invalid snapshot method '%s'", args.Method)
+	}
+
+	if err := fs.lock(id); err != nil {
+		return nil, err
+	}
+	defer fs.unlock(id)
+	if fs.find(id, args.Name) != nil {
+		return nil, fmt.Errorf("snapshot %s already exists", args.Name)
+	}
+
+	sn := xsapiv1.FolderSnapshot{
+		FolderID:    id,
+		Name:        args.Name,
+		Description: args.Description,
+		Method:      args.Method,
+		Size:        diskUsage(root),
+		CreatedAt:   time.Now().String(),
+	}
+
+	fs.Log.Infof("Create %s snapshot %s of folder %s", sn.Method, sn.Name, id)
+	if sn.Method == xsapiv1.SnapshotMethodBtrfs {
+		sn.Path = filepath.Join(filepath.Dir(root), snapshotsBtrfsDir, id+"_"+sn.Name)
+		if err := os.MkdirAll(filepath.Dir(sn.Path), 0755); err != nil {
+			return nil, err
+		}
+		if out, err := exec.Command("btrfs", "subvolume", "snapshot", "-r", root, sn.Path).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("Cannot create btrfs snapshot: %v (%s)", err, out)
+		}
+	} else {
+		blob, err := fs.tarFolder(root)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create snapshot archive: %v", err)
+		}
+		sn.Digest = blob.Digest
+	}
+
+	fs.mutex.Lock()
+	fs.snapshots[id] = append(fs.snapshots[id], &sn)
+	err = fs.save()
+	fs.mutex.Unlock()
+
+	return &sn, err
+}
+
+// Delete removes a snapshot
+func (fs *FolderSnapshots) Delete(id, name string) (*xsapiv1.FolderSnapshot, error) {
+	if err := fs.lock(id); err != nil {
+		return nil, err
+	}
+	defer fs.unlock(id)
+
+	sn := fs.find(id, name)
+	if sn == nil {
+		return nil, fmt.Errorf("unknown snapshot")
+	}
+	if err := fs.release(sn); err != nil {
+		return nil, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	list := []*xsapiv1.FolderSnapshot{}
+	for _, s := range fs.snapshots[id] {
+		if s != sn {
+			list = append(list, s)
+		}
+	}
+	fs.snapshots[id] = list
+	if len(list) == 0 {
+		delete(fs.snapshots, id)
+	}
+	return sn, fs.save()
+}
+
+// DeleteAll removes all snapshots of a folder (used when folder is deleted)
+func (fs *FolderSnapshots) DeleteAll(id string) {
+	for _, sn := range fs.List(id) {
+		if _, err := fs.Delete(id, sn.Name); err != nil {
+			fs.Log.Errorf("Cannot delete snapshot %s of folder %s: %v", sn.Name, id, err)
+		}
+	}
+}
+
+// Restore replaces content of a folder by a snapshot
+func (fs *FolderSnapshots) Restore(id, name string) (*xsapiv1.FolderSnapshot, error) {
+	root, err := fs.folderRoot(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.lock(id); err != nil {
+		return nil, err
+	}
+	defer fs.unlock(id)
+
+	sn := fs.find(id, name)
+	if sn == nil {
+		return nil, fmt.Errorf("unknown snapshot")
+	}
+	if f := fs.mfolders.Get(id); f != nil && (*f).GetConfig().ReadOnly {
+		return nil, fmt.Errorf("folder is read-only")
+	}
+
+	fs.Log.Infof("Restore snapshot %s of folder %s", name, id)
+	if err := clearTree(root); err != nil {
+		return nil, fmt.Errorf("Cannot clear folder content: %v", err)
+	}
+	if sn.Method == xsapiv1.SnapshotMethodBtrfs {
+		if out, err := exec.Command("cp", "-a", "--reflink=auto", sn.Path+"/.", root).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("Cannot copy snapshot: %v (%s)", err, out)
+		}
+	} else {
+		rd, err := fs.store.Open(sn.Digest)
+		if err != nil {
+			return nil, err
+		}
+		defer rd.Close()
+		if err := tarExtractTree(tar.NewReader(rd), fs.fileAttrs, root); err != nil {
+			return nil, fmt.Errorf("Cannot extract snapshot: %v", err)
+		}
+	}
+
+	// Let synchronization tool detect changes
+	if err := fs.mfolders.Rescan(id); err != nil {
+		fs.Log.Debugf("Cannot rescan folder %s after restore: %v", id, err)
+	}
+
+	res := *sn
+	return &res, nil
+}
+
+/*** Private functions ***/
+
+// folderRoot returns server-side directory of a folder
+func (fs *FolderSnapshots) folderRoot(id string) (string, error) {
+	f := fs.mfolders.Get(id)
+	if f == nil {
+		return "", fmt.Errorf("unknown id")
+	}
+	root := (*f).GetFullPath("")
+	if root == "" || !common.IsDir(root) {
+		return "", fmt.Errorf("folder directory not available")
+	}
+	return root, nil
+}
+
+// lock prevents concurrent operations on snapshots of a folder
+func (fs *FolderSnapshots) lock(id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.busy[id] {
+		return fmt.Errorf("another snapshot operation is in progress on this folder")
+	}
+	fs.busy[id] = true
+	return nil
+}
+
+func (fs *FolderSnapshots) unlock(id string) {
+	fs.mutex.Lock()
+	delete(fs.busy, id)
+	fs.mutex.Unlock()
+}
+
+func (fs *FolderSnapshots) find(id, name string) *xsapiv1.FolderSnapshot {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for _, sn := range fs.snapshots[id] {
+		if sn.Name == name {
+			return sn
+		}
+	}
+	return nil
+}
+
+// tarFolder saves an archive of folder files in store
+func (fs *FolderSnapshots) tarFolder(root string) (*xsapiv1.StoreBlob, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tarWriteTree(tw, fs.fileAttrs, root, nil)
+		if errC := tw.Close(); err == nil {
+			err = errC
+		}
+		pw.CloseWithError(err)
+	}()
+	blob, err := fs.store.Put(pr)
+	pr.Close()
+	return blob, err
+}
+
+// release frees resources used by a snapshot
+func (fs *FolderSnapshots) release(sn *xsapiv1.FolderSnapshot) error {
+	if sn.Method == xsapiv1.SnapshotMethodBtrfs {
+		if out, err := exec.Command("btrfs", "subvolume", "delete", sn.Path).CombinedOutput(); err != nil && common.Exists(sn.Path) {
+			return fmt.Errorf("Cannot delete btrfs snapshot: %v (%s)", err, out)
+		}
+		return nil
+	}
+	if err := fs.store.Release(sn.Digest); err != nil {
+		fs.Log.Warningf("Cannot release snapshot %s content: %v", sn.Name, err)
+	}
+	return nil
+}
+
+// load reads snapshots definition from disk
+func (fs *FolderSnapshots) load() error {
+	file, err := xdsconfig.FolderSnapshotsFilenameGet()
+	if err != nil {
+		return err
+	}
+	if !common.Exists(file) {
+		return nil
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	data := xmlFolderSnapshots{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		return err
+	}
+	for i, sn := range data.Snapshots {
+		fs.snapshots[sn.FolderID] = append(fs.snapshots[sn.FolderID], &data.Snapshots[i])
+	}
+	return nil
+}
+
+// save writes snapshots definition on disk (mutex must be locked)
+func (fs *FolderSnapshots) save() error {
+	file, err := xdsconfig.FolderSnapshotsFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	data := xmlFolderSnapshots{Version: "1", Snapshots: []xsapiv1.FolderSnapshot{}}
+	for _, list := range fs.snapshots {
+		for _, sn := range list {
+			data.Snapshots = append(data.Snapshots, *sn)
+		}
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&data)
+}
+
+// isBtrfsSubvolume returns true when a directory is a btrfs subvolume
+func isBtrfsSubvolume(dir string) bool {
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		return false
+	}
+	return exec.Command("btrfs", "subvolume", "show", dir).Run() == nil
+}
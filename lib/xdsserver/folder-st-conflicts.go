@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const conflictMonitorTime = 60 // Time (in seconds) between two conflicts detection
+
+// Syncthing conflict copy name: <base>.sync-conflict-<YYYYMMDD-HHMMSS>[-<device ID>]<ext>
+var reSyncConflict = regexp.MustCompile(`^(.*)\.sync-conflict-(\d{8}-\d{6})(?:-([A-Z0-9]{7}))?(\.[^.]*)?$`)
+
+// Syncthing internal directories that never contain conflicts
+var stInternalDirs = map[string]bool{".stfolder": true, ".stversions": true}
+
+// GetConflicts Returns sync conflicts of folder
+func (f *STFolder) GetConflicts() ([]xsapiv1.FolderConflict, error) {
+	root := f.GetFullPath("")
+	res := []xsapiv1.FolderConflict{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if stInternalDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if c := f.parseConflict(rel); c != nil {
+			c.Size = info.Size()
+			res = append(res, *c)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// ResolveConflict Resolves a sync conflict by keeping local, remote or both versions
+func (f *STFolder) ResolveConflict(path, keep string) (*xsapiv1.FolderConflict, error) {
+	rel := filepath.Clean(path)
+	if filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("path must be relative to folder")
+	}
+	c := f.parseConflict(rel)
+	if c == nil {
+		return nil, fmt.Errorf("not a conflict file")
+	}
+	conflictFile := f.GetFullPath(c.Path)
+	origFile := f.GetFullPath(c.Original)
+	fi, err := os.Stat(conflictFile)
+	if err != nil {
+		return nil, fmt.Errorf("conflict file not found")
+	}
+	c.Size = fi.Size()
+
+	switch keep {
+	case xsapiv1.ConflictKeepLocal:
+		err = os.Remove(conflictFile)
+	case xsapiv1.ConflictKeepRemote:
+		err = os.Rename(conflictFile, origFile)
+	case xsapiv1.ConflictKeepBoth:
+		ext := filepath.Ext(c.Original)
+		both := strings.TrimSuffix(origFile, ext) + ".conflict-" + c.Date + ext
+		err = os.Rename(conflictFile, both)
+	default:
+		return nil, fmt.Errorf("invalid keep value (must be %s, %s or %s)",
+			xsapiv1.ConflictKeepLocal, xsapiv1.ConflictKeepRemote, xsapiv1.ConflictKeepBoth)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f.Log.Infof("Conflict %s of folder %s resolved (keep %s)", c.Path, f.fConfig.ID, keep)
+
+	// Propagate change without waiting next scan
+	if err := f.st.FolderScan(f.stfConfig.ID, ""); err != nil {
+		f.Log.Warningf("Cannot rescan folder %s: %v", f.fConfig.ID, err)
+	}
+	return c, nil
+}
+
+// parseConflict decodes a conflict copy name (relative path), returns nil
+// when file is not a conflict copy
+func (f *STFolder) parseConflict(rel string) *xsapiv1.FolderConflict {
+	m := reSyncConflict.FindStringSubmatch(filepath.Base(rel))
+	if m == nil {
+		return nil
+	}
+	orig := filepath.Join(filepath.Dir(rel), m[1]+m[4])
+	c := xsapiv1.FolderConflict{
+		FolderID:     f.fConfig.ID,
+		Path:         rel,
+		Original:     orig,
+		DeviceID:     m[3],
+		OriginalSize: -1,
+	}
+	if t, err := time.ParseInLocation("20060102-150405", m[2], time.Local); err == nil {
+		c.Date = t.Format("2006-01-02 15:04:05")
+	}
+	if fi, err := os.Stat(f.GetFullPath(orig)); err == nil {
+		c.OriginalSize = fi.Size()
+	}
+	return &c
+}
+
+// ConflictMonitor Periodically detect new sync conflicts of CloudSync folders
+type ConflictMonitor struct {
+	*Context
+	known map[string]bool // known conflicts (folder ID + path)
+	stop  chan struct{}   // signals intentional stop
+}
+
+// NewConflictMonitor creates a new instance of ConflictMonitor
+func NewConflictMonitor(ctx *Context) *ConflictMonitor {
+	return &ConflictMonitor{
+		Context: ctx,
+		known:   make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start starts monitoring loop
+func (m *ConflictMonitor) Start() {
+	go m.monitorLoop()
+}
+
+// Stop stops monitoring loop
+func (m *ConflictMonitor) Stop() {
+	close(m.stop)
+}
+
+func (m *ConflictMonitor) monitorLoop() {
+	for {
+		select {
+		case <-m.stop:
+			m.Log.Debugln("Stop conflict monitorLoop")
+			return
+		case <-time.After(conflictMonitorTime * time.Second):
+			m.detect()
+		}
+	}
+}
+
+// detect notifies conflicts that appeared since last detection
+func (m *ConflictMonitor) detect() {
+	current := make(map[string]bool)
+	for _, fc := range m.mfolders.GetConfigArr() {
+		if fc.Type != xsapiv1.TypeCloudSync || fc.Status == xsapiv1.StatusErrorConfig {
+			continue
+		}
+		stf, err := m.mfolders.getSTFolder(fc.ID)
+		if err != nil {
+			continue
+		}
+		conflicts, err := stf.GetConflicts()
+		if err != nil {
+			m.LogSillyf("Cannot detect conflicts of folder %s: %v", fc.ID, err)
+			continue
+		}
+		for _, c := range conflicts {
+			key := c.FolderID + "/" + c.Path
+			current[key] = true
+			if m.known[key] {
+				continue
+			}
+			m.Log.Infof("New sync conflict in folder %s: %s", c.FolderID, c.Path)
+			if err := m.events.Emit(xsapiv1.EVTFolderConflict, c, ""); err != nil {
+				m.LogSillyf("Cannot notify conflict: %v", err)
+			}
+		}
+	}
+	m.known = current
+}
@@ -18,6 +18,8 @@
 package xdsserver
 
 import (
+	"fmt"
+
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
 	uuid "github.com/satori/go.uuid"
 )
@@ -97,6 +99,11 @@ func (f *STFolderDisable) Sync() error {
 	return nil
 }
 
+// Rescan Force rescan of folder files
+func (f *STFolderDisable) Rescan() error {
+	return fmt.Errorf("Syncthing not running")
+}
+
 // IsInSync Check if folder files are in-sync
 func (f *STFolderDisable) IsInSync() (bool, error) {
 	return false, nil
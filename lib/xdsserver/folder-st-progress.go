@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+const syncProgressMonitorTime = 2 // Time (in seconds) between two progress updates
+
+// SyncProgressMonitor Periodically notify synchronization progress of
+// CloudSync folders (computed from Syncthing folder status)
+type SyncProgressMonitor struct {
+	*Context
+	last map[string]xsapiv1.FolderSyncProgress // last notified progress per folder
+	stop chan struct{}                         // signals intentional stop
+}
+
+// NewSyncProgressMonitor creates a new instance of SyncProgressMonitor
+func NewSyncProgressMonitor(ctx *Context) *SyncProgressMonitor {
+	return &SyncProgressMonitor{
+		Context: ctx,
+		last:    make(map[string]xsapiv1.FolderSyncProgress),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start starts monitoring loop
+func (m *SyncProgressMonitor) Start() {
+	go m.monitorLoop()
+}
+
+// Stop stops monitoring loop
+func (m *SyncProgressMonitor) Stop() {
+	close(m.stop)
+}
+
+/*** Private functions ***/
+
+func (m *SyncProgressMonitor) monitorLoop() {
+	for {
+		select {
+		case <-m.stop:
+			m.Log.Debugln("Stop sync progress monitorLoop")
+			return
+		case <-time.After(syncProgressMonitorTime * time.Second):
+			m.update()
+		}
+	}
+}
+
+// update notifies progress of folders being synchronized
+func (m *SyncProgressMonitor) update() {
+	seen := make(map[string]bool)
+	for _, fc := range m.mfolders.GetConfigArr() {
+		if fc.Type != xsapiv1.TypeCloudSync || fc.Status == xsapiv1.StatusErrorConfig {
+			continue
+		}
+		seen[fc.ID] = true
+
+		// Don't query Syncthing for folders already in sync
+		prev, exist := m.last[fc.ID]
+		if exist && prev.Percent == 100 && fc.Status != xsapiv1.StatusSyncing {
+			continue
+		}
+
+		sts, err := m.SThg.FolderStatus(fc.ID)
+		if err != nil {
+			m.LogSillyf("Cannot get status of folder %s: %v", fc.ID, err)
+			continue
+		}
+
+		prog := xsapiv1.FolderSyncProgress{
+			FolderID:       fc.ID,
+			State:          sts.State,
+			BytesTotal:     sts.GlobalBytes,
+			BytesRemaining: sts.NeedBytes,
+			ItemsTotal:     sts.GlobalFiles + sts.GlobalDirectories + sts.GlobalSymlinks,
+			ItemsRemaining: sts.NeedFiles + sts.NeedDirectories + sts.NeedSymlinks + sts.NeedDeletes,
+			Percent:        100,
+		}
+		if prog.BytesTotal > 0 {
+			prog.Percent = int((prog.BytesTotal - prog.BytesRemaining) * 100 / prog.BytesTotal)
+		} else if prog.ItemsTotal > 0 {
+			prog.Percent = (prog.ItemsTotal - prog.ItemsRemaining) * 100 / prog.ItemsTotal
+		}
+		// Only report complete when Syncthing is idle
+		if prog.Percent == 100 && (prog.ItemsRemaining > 0 || prog.State != "idle") {
+			prog.Percent = 99
+		}
+		if prog.Percent < 0 {
+			prog.Percent = 0
+		}
+
+		if exist && prev == prog {
+			continue
+		}
+		m.last[fc.ID] = prog
+
+		if err := m.events.Emit(xsapiv1.EVTFolderSyncProgress, prog, ""); err != nil {
+			m.LogSillyf("Cannot notify sync progress of folder %s: %v", fc.ID, err)
+		}
+	}
+
+	// Cleanup deleted folders
+	for id := range m.last {
+		if !seen[id] {
+			delete(m.last, id)
+		}
+	}
+}
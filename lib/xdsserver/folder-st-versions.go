@@ -0,0 +1,202 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Directory where Syncthing keeps previous versions of files
+const stVersionsDir = ".stversions"
+
+// Syncthing version name: <base>~<YYYYMMDD-HHMMSS><ext> (trashcan keeps original name)
+var reSyncVersion = regexp.MustCompile(`^(.*)~(\d{8}-\d{6})(\.[^.]*)?$`)
+
+// GetFileVersions Returns previous versions of a file (all files when path is empty)
+func (f *STFolder) GetFileVersions(path string) ([]xsapiv1.FileVersion, error) {
+	res := []xsapiv1.FileVersion{}
+
+	verRoot := f.GetFullPath(stVersionsDir)
+	walkDir := verRoot
+	rel := ""
+	if path != "" {
+		var err error
+		if rel, err = versionRelPath(path); err != nil {
+			return nil, err
+		}
+		walkDir = filepath.Join(verRoot, filepath.Dir(rel))
+	}
+	if !common.IsDir(walkDir) {
+		return res, nil
+	}
+
+	err := filepath.Walk(walkDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Only check directory of file when path is set
+		if info.IsDir() {
+			if rel != "" && p != walkDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		version, err := filepath.Rel(verRoot, p)
+		if err != nil {
+			return nil
+		}
+		v := parseVersion(version, info)
+		if rel == "" || v.Path == rel {
+			res = append(res, v)
+		}
+		return nil
+	})
+
+	// Most recent versions first
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Path != res[j].Path {
+			return res[i].Path < res[j].Path
+		}
+		return res[i].VersionTime > res[j].VersionTime
+	})
+	return res, err
+}
+
+// RestoreFileVersion Replaces a file by one of its previous versions
+func (f *STFolder) RestoreFileVersion(path, version string) (*xsapiv1.FileVersion, error) {
+	rel, err := versionRelPath(path)
+	if err != nil {
+		return nil, err
+	}
+	version, err = versionRelPath(version)
+	if err != nil {
+		return nil, err
+	}
+	verFile := filepath.Join(f.GetFullPath(stVersionsDir), version)
+	fi, err := os.Stat(verFile)
+	if err != nil || fi.IsDir() {
+		return nil, fmt.Errorf("unknown version")
+	}
+	v := parseVersion(version, fi)
+	if v.Path != rel {
+		return nil, fmt.Errorf("version %s is not a version of %s", version, path)
+	}
+
+	if err := copyFileAtomic(verFile, f.GetFullPath(rel), fi.Mode()); err != nil {
+		return nil, err
+	}
+
+	f.Log.Infof("File %s of folder %s restored from version %s", rel, f.fConfig.ID, v.VersionTime)
+
+	// Propagate change without waiting next scan
+	if err := f.st.FolderScan(f.stfConfig.ID, filepath.ToSlash(rel)); err != nil {
+		f.Log.Warningf("Cannot rescan folder %s: %v", f.fConfig.ID, err)
+	}
+	return &v, nil
+}
+
+/*** Private functions ***/
+
+// checkVersioningConfig validates file versioning settings of a folder
+func checkVersioningConfig(cfg *xsapiv1.FolderConfig) error {
+	v := cfg.Versioning
+	switch v.Type {
+	case xsapiv1.VersioningNone:
+		return nil
+	case xsapiv1.VersioningSimple, xsapiv1.VersioningTrashcan, xsapiv1.VersioningStaggered:
+	default:
+		return fmt.Errorf("invalid versioning type '%s'", v.Type)
+	}
+	if cfg.Type != xsapiv1.TypeCloudSync {
+		return fmt.Errorf("versioning not supported by %s folders", cfg.Type)
+	}
+	if v.Keep < 0 || v.CleanoutDays < 0 || v.MaxAgeDays < 0 {
+		return fmt.Errorf("invalid versioning parameters (must be positive)")
+	}
+	return nil
+}
+
+// versionRelPath checks that a path is relative to folder
+func versionRelPath(path string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path must be relative to folder")
+	}
+	return rel, nil
+}
+
+// parseVersion decodes a version name (relative to versions directory)
+func parseVersion(version string, fi os.FileInfo) xsapiv1.FileVersion {
+	v := xsapiv1.FileVersion{
+		Path:        version,
+		Version:     filepath.ToSlash(version),
+		VersionTime: fi.ModTime().Format(time.RFC3339),
+		Size:        fi.Size(),
+	}
+	if m := reSyncVersion.FindStringSubmatch(filepath.Base(version)); m != nil {
+		v.Path = filepath.Join(filepath.Dir(version), m[1]+m[3])
+		if t, err := time.ParseInLocation("20060102-150405", m[2], time.Local); err == nil {
+			v.VersionTime = t.Format(time.RFC3339)
+		}
+	}
+	return v
+}
+
+// copyFileAtomic copies a file using a temporary file renamed at the end
+// (IOW destination file is never partially written)
+func copyFileAtomic(src, dst string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".xds-restore-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if errC := tmp.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode.Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Cannot restore file: %v", err)
+	}
+	return nil
+}
@@ -31,6 +31,15 @@ import (
 
 // IFOLDER interface implementation for syncthing
 
+func init() {
+	RegisterFolderDriver(xsapiv1.TypeCloudSync, func(ctx *Context) IFOLDER {
+		if ctx.SThg == nil {
+			return NewFolderSTDisable(ctx)
+		}
+		return NewFolderST(ctx, ctx.SThg)
+	})
+}
+
 // STFolder .
 type STFolder struct {
 	*Context
@@ -78,11 +87,27 @@ func (f *STFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error)
 
 	f.fConfig = cfg
 
+	// Decrypted view must be mounted before Syncthing uses folder directory
+	if IsEncrypted(cfg) {
+		f.fConfig.Encryption = &xsapiv1.FolderEncryption{Enabled: true}
+		if err := f.folderCrypt.Init(cfg.ID, f.GetFullPath(""), cfg.Encryption.Passphrase, cfg.Owner); err != nil {
+			return nil, err
+		}
+	}
+
 	// Update Syncthing folder
 	_, err := f.st.FolderChange(f.fConfig)
 	if err != nil {
+		if IsEncrypted(f.fConfig) {
+			f.folderCrypt.Remove(f.fConfig.ID, f.GetFullPath(""))
+		}
 		return nil, err
 	}
+	if len(f.fConfig.DataCloudSync.ExtraDevices) > 0 {
+		if err := f.SetDevices(f.fConfig.DataCloudSync.ExtraDevices); err != nil {
+			return nil, err
+		}
+	}
 
 	// Use Setup function to setup remains fields
 	return f.Setup(f.fConfig)
@@ -112,8 +137,25 @@ func (f *STFolder) Setup(fld xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error
 		f.eventIDs = append(f.eventIDs, evID)
 	}
 
+	// Receive-only type is not kept by Syncthing config (see FolderReceiveOnlySet)
+	if f.fConfig.ReadOnly {
+		if err := f.st.FolderReceiveOnlySet(f.fConfig.ID, true); err != nil {
+			f.Log.Errorf("Cannot set receive-only type of folder %s: %v", f.fConfig.ID, err)
+		}
+	}
+
 	f.fConfig.IsInSync = false // will be updated later by events
 	f.fConfig.Status = xsapiv1.StatusEnable
+	if f.stfConfig.Paused {
+		f.fConfig.Status = xsapiv1.StatusPause
+	}
+
+	// Files of encrypted folder are not accessible until a client unlocks it
+	if f.folderCrypt.IsLocked(f.fConfig) {
+		if err := f.lock("", true); err != nil {
+			f.Log.Errorf("Cannot lock folder %s: %v", f.fConfig.ID, err)
+		}
+	}
 
 	return &f.fConfig, nil
 }
@@ -170,6 +212,12 @@ func (f *STFolder) Remove() error {
 	// Delete in Syncthing
 	err2 := f.st.FolderDelete(f.stfConfig.ID)
 
+	// Delete encrypted files (decrypted view is unmounted first)
+	var err4 error
+	if IsEncrypted(f.fConfig) {
+		err4 = f.folderCrypt.Remove(f.fConfig.ID, f.GetFullPath(""))
+	}
+
 	// Delete folder on server side
 	err3 := os.RemoveAll(f.GetFullPath(""))
 
@@ -177,6 +225,8 @@ func (f *STFolder) Remove() error {
 		return err1
 	} else if err2 != nil {
 		return err2
+	} else if err4 != nil {
+		return err4
 	}
 	return err3
 }
@@ -186,15 +236,84 @@ func (f *STFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, erro
 	if f.fConfig.ID != cfg.ID {
 		return nil, fmt.Errorf("Invalid id")
 	}
+	if cfg.ClientPath != f.fConfig.ClientPath || cfg.Label != f.fConfig.Label {
+		if err := f.move(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ReadOnly != f.fConfig.ReadOnly {
+		if err := f.st.FolderReceiveOnlySet(cfg.ID, cfg.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Versioning != f.fConfig.Versioning {
+		if err := f.st.FolderVersioningSet(cfg.ID, cfg.Versioning); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.FileAttrs.IgnorePerms != f.fConfig.FileAttrs.IgnorePerms {
+		ignore := cfg.FileAttrs.IgnorePerms ||
+			(f.Config.FileConf.FileAttrsConf != nil && f.Config.FileConf.FileAttrsConf.IgnorePerms)
+		if err := f.st.FolderIgnorePermsSet(cfg.ID, ignore); err != nil {
+			return nil, err
+		}
+	}
 	f.fConfig = cfg
 	return &f.fConfig, nil
 }
 
+// move renames folder directory and updates Syncthing config accordingly
+// (directory is moved back when Syncthing config cannot be updated)
+func (f *STFolder) move(cfg xsapiv1.FolderConfig) error {
+	oldDir := f.GetFullPath("")
+	newDir := filepath.Join(cfg.RootPath, cfg.ClientPath)
+
+	if newDir != oldDir {
+		if _, err := os.Lstat(newDir); err == nil {
+			return fmt.Errorf("directory already exists: %s", newDir)
+		}
+		if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(oldDir, newDir); err != nil {
+			return fmt.Errorf("cannot move folder directory: %v", err)
+		}
+	}
+
+	if err := f.st.FolderMove(cfg.ID, cfg.Label, newDir); err != nil {
+		if newDir != oldDir {
+			if err := os.Rename(newDir, oldDir); err != nil {
+				f.Log.Errorf("Cannot move back folder %s directory: %v", cfg.ID, err)
+			}
+		}
+		return err
+	}
+	f.stfConfig.Label = cfg.Label
+	f.stfConfig.Path = newDir
+
+	f.Log.Infof("Folder %s moved to %s", cfg.ID, newDir)
+	return nil
+}
+
 // Sync Force folder files synchronization
 func (f *STFolder) Sync() error {
 	return f.st.FolderScan(f.stfConfig.ID, "")
 }
 
+// Rescan Requests an immediate rescan of Syncthing database
+// (don't wait for the end of scan)
+func (f *STFolder) Rescan() error {
+	if _, err := f.st.FolderStatus(f.stfConfig.ID); err != nil {
+		return err
+	}
+	go func() {
+		if err := f.st.FolderScan(f.stfConfig.ID, ""); err != nil {
+			f.Log.Errorf("Rescan of folder %s failed: %v", f.fConfig.ID, err)
+		}
+	}()
+	return nil
+}
+
 // IsInSync Check if folder files are in-sync
 func (f *STFolder) IsInSync() (bool, error) {
 	sts, err := f.st.IsFolderInSync(f.stfConfig.ID)
@@ -205,6 +324,75 @@ func (f *STFolder) IsInSync() (bool, error) {
 	return sts, nil
 }
 
+// SetPaused Pauses or resumes folder synchronization
+func (f *STFolder) SetPaused(paused bool) error {
+	if err := f.st.FolderPausedSet(f.stfConfig.ID, paused); err != nil {
+		return err
+	}
+	f.stfConfig.Paused = paused
+
+	prevStatus := f.fConfig.Status
+	if paused {
+		f.fConfig.Status = xsapiv1.StatusPause
+		f.fConfig.IsInSync = false
+	} else if f.fConfig.Status == xsapiv1.StatusPause {
+		f.fConfig.Status = xsapiv1.StatusEnable // will be updated later by events
+	}
+
+	if prevStatus != f.fConfig.Status {
+		if err := f.events.Emit(xsapiv1.EVTFolderStateChange, &f.fConfig, ""); err != nil {
+			f.Log.Warningf("Cannot notify folder change: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetDevices Sets the devices synchronized with folder in addition to the
+// device that registered it
+func (f *STFolder) SetDevices(extra []string) error {
+	devIDs := []string{f.fConfig.DataCloudSync.SyncThingID}
+	for _, id := range extra {
+		if id == f.fConfig.DataCloudSync.SyncThingID {
+			return fmt.Errorf("device %s already synchronized with folder", id)
+		}
+		devIDs = append(devIDs, id)
+	}
+	if err := f.st.FolderDevicesSet(f.fConfig.ID, devIDs); err != nil {
+		return err
+	}
+	f.fConfig.DataCloudSync.ExtraDevices = extra
+	return nil
+}
+
+// GetIgnores Returns ignore patterns of folder
+func (f *STFolder) GetIgnores() (*xsapiv1.FolderIgnores, error) {
+	ign, exp, err := f.st.FolderIgnoresGet(f.stfConfig.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := xsapiv1.FolderIgnores{Ignore: ign, Expanded: exp}
+	if res.Ignore == nil {
+		res.Ignore = []string{}
+	}
+	if res.Expanded == nil {
+		res.Expanded = []string{}
+	}
+	return &res, nil
+}
+
+// SetIgnores Writes ignore patterns of folder and triggers an immediate rescan
+func (f *STFolder) SetIgnores(ignore []string) error {
+	for i, p := range ignore {
+		if err := validateIgnorePattern(p); err != nil {
+			return fmt.Errorf("invalid pattern line %d (%s): %v", i+1, p, err)
+		}
+	}
+	if err := f.st.FolderIgnoresSet(f.stfConfig.ID, ignore); err != nil {
+		return err
+	}
+	return f.st.FolderScan(f.stfConfig.ID, "")
+}
+
 // callback use to update IsInSync status
 func (f *STFolder) cbEventState(ev st.Event, data *st.EventsCBData) {
 	prevSync := f.fConfig.IsInSync
@@ -236,3 +424,44 @@ func (f *STFolder) cbEventState(ev st.Event, data *st.EventsCBData) {
 		}
 	}
 }
+
+// validateIgnorePattern checks syntax of a Syncthing ignore pattern
+func validateIgnorePattern(p string) error {
+	p = strings.TrimSpace(p)
+	if p == "" || strings.HasPrefix(p, "//") {
+		return nil
+	}
+	if strings.ContainsAny(p, "\x00\n\r") {
+		return fmt.Errorf("invalid character")
+	}
+
+	// Included files must be part of folder
+	if strings.HasPrefix(p, "#include") {
+		inc := strings.TrimSpace(strings.TrimPrefix(p, "#include"))
+		if inc == "" {
+			return fmt.Errorf("missing file name")
+		}
+		if filepath.IsAbs(inc) || strings.HasPrefix(filepath.Clean(inc), "..") {
+			return fmt.Errorf("included file must be inside folder")
+		}
+		return nil
+	}
+
+	// Strip prefixes: negation, case insensitive and deletable flags
+	for {
+		if strings.HasPrefix(p, "!") {
+			p = p[1:]
+		} else if strings.HasPrefix(p, "(?i)") || strings.HasPrefix(p, "(?d)") {
+			p = p[4:]
+		} else {
+			break
+		}
+	}
+	if strings.TrimSpace(p) == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	if _, err := filepath.Match(p, ""); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const folderStatsCacheTime = 5 * 60 // Time (in seconds) during which statistics are cached
+const folderStatsLargestFiles = 10  // Number of largest files returned
+const folderStatsBrokenLinks = 50   // Maximum number of broken symlinks returned
+
+// FolderStats Compute (in background) and cache statistics of folders files
+type FolderStats struct {
+	*Context
+	stats map[string]*xsapiv1.FolderStats
+	mutex sync.Mutex
+}
+
+// NewFolderStats creates a new instance of FolderStats
+func NewFolderStats(ctx *Context) *FolderStats {
+	return &FolderStats{
+		Context: ctx,
+		stats:   make(map[string]*xsapiv1.FolderStats),
+		mutex:   sync.NewMutex(),
+	}
+}
+
+// Get returns cached statistics of a folder and starts a new computation
+// when they are outdated (or when refresh is set)
+func (fs *FolderStats) Get(id string, refresh bool) (xsapiv1.FolderStats, error) {
+	fc := fs.mfolders.Get(id)
+	if fc == nil {
+		return xsapiv1.FolderStats{}, fmt.Errorf("Unknown id")
+	}
+	fld := *fc
+
+	fs.mutex.Lock()
+	st := fs.getUnsafe(id)
+	if !st.Computing {
+		outdated := true
+		if t, err := time.Parse(time.RFC3339, st.ComputedAt); err == nil {
+			outdated = time.Since(t) > folderStatsCacheTime*time.Second
+		}
+		if refresh || outdated {
+			st.Computing = true
+			go fs.compute(fld)
+		}
+	}
+
+	res := *st
+	fs.mutex.Unlock()
+
+	res.LastSync = fs.lastSync(fld)
+	return res, nil
+}
+
+// RecordBuild records the end time of a command executed in a folder
+func (fs *FolderStats) RecordBuild(id string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.getUnsafe(id).LastBuild = time.Now().Format(time.RFC3339)
+}
+
+/*** Private functions ***/
+
+// getUnsafe returns statistics entry of a folder (mutex must be locked)
+func (fs *FolderStats) getUnsafe(id string) *xsapiv1.FolderStats {
+	st, exist := fs.stats[id]
+	if !exist {
+		st = &xsapiv1.FolderStats{FolderID: id, LargestFiles: []xsapiv1.FolderFileSize{}, BrokenLinks: []string{}}
+		fs.stats[id] = st
+	}
+	return st
+}
+
+// compute walks folder files and updates statistics
+func (fs *FolderStats) compute(fld IFOLDER) {
+	id := fld.GetConfig().ID
+	res := xsapiv1.FolderStats{LargestFiles: []xsapiv1.FolderFileSize{}, BrokenLinks: []string{}}
+
+	root := fld.GetFullPath("")
+	if root == "" {
+		res.Error = "folder path not available"
+	} else {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				if path != root {
+					res.DirCount++
+				}
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if _, err := os.Stat(path); err != nil && len(res.BrokenLinks) < folderStatsBrokenLinks {
+					rel, _ := filepath.Rel(root, path)
+					res.BrokenLinks = append(res.BrokenLinks, rel)
+				}
+			}
+			res.FileCount++
+			res.TotalSize += info.Size()
+
+			// Only keep the largest files
+			n := len(res.LargestFiles)
+			if n < folderStatsLargestFiles || info.Size() > res.LargestFiles[n-1].Size {
+				rel, _ := filepath.Rel(root, path)
+				res.LargestFiles = append(res.LargestFiles, xsapiv1.FolderFileSize{Path: rel, Size: info.Size()})
+				sort.Slice(res.LargestFiles, func(i, j int) bool {
+					return res.LargestFiles[i].Size > res.LargestFiles[j].Size
+				})
+				if len(res.LargestFiles) > folderStatsLargestFiles {
+					res.LargestFiles = res.LargestFiles[:folderStatsLargestFiles]
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	st := fs.getUnsafe(id)
+	res.FolderID = id
+	res.LastBuild = st.LastBuild
+	res.ComputedAt = time.Now().Format(time.RFC3339)
+	*st = res
+
+	fs.LogSillyf("Statistics of folder %s: %d files, %d bytes", id, res.FileCount, res.TotalSize)
+	if len(res.BrokenLinks) > 0 {
+		fs.Log.Warningf("Folder %s contains broken symlinks (may cause build failures): %v", id, res.BrokenLinks)
+	}
+}
+
+// lastSync returns date of last files synchronization (empty when unknown)
+func (fs *FolderStats) lastSync(fld IFOLDER) string {
+	cfg := fld.GetConfig()
+	switch cfg.Type {
+	case xsapiv1.TypeCloudSync:
+		if fs.SThg == nil {
+			return ""
+		}
+		sts, err := fs.SThg.FolderStatus(cfg.ID)
+		if err != nil || sts.State != "idle" || sts.StateChanged.IsZero() {
+			return ""
+		}
+		return sts.StateChanged.Format(time.RFC3339)
+	case xsapiv1.TypeRsync:
+		return cfg.DataRsync.LastSync
+	}
+	return ""
+}
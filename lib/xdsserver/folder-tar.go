@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Folder entries never saved in archives (Syncthing internal data)
+var tarSkipNames = map[string]bool{".stfolder": true, ".stversions": true}
+
+// tarWriteTree writes files of a tree into an archive (names are relative to
+// root), skip function may be used to exclude some files or directories
+func tarWriteTree(tw *tar.Writer, fa *FileAttrs, root string, skip func(rel string, fi os.FileInfo) bool) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if tarSkipNames[fi.Name()] || (skip != nil && skip(rel, fi)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			// Sockets, pipes and devices are not saved
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := fa.TarHeader(path, fi, hdr); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		_, err = io.Copy(tw, fd)
+		return err
+	})
+}
+
+// tarExtractTree extracts an archive into root directory
+func tarExtractTree(tr *tar.Reader, fa *FileAttrs, root string) error {
+	dirs := []*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Never write outside of root directory
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid archive entry %s", hdr.Name)
+		}
+		file := filepath.Join(root, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(file, 0755); err != nil {
+				return err
+			}
+			// Apply attributes at the end (directory may be read-only)
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeSymlink:
+			os.Remove(file)
+			if err := os.Symlink(hdr.Linkname, file); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return err
+			}
+			fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fd, tr)
+			if errC := fd.Close(); err == nil {
+				err = errC
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := fa.Restore(file, hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			os.Chtimes(file, hdr.ModTime, hdr.ModTime)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		file := filepath.Join(root, filepath.Clean(filepath.FromSlash(dirs[i].Name)))
+		if err := fa.Restore(file, dirs[i]); err != nil {
+			return err
+		}
+		os.Chtimes(file, dirs[i].ModTime, dirs[i].ModTime)
+	}
+	return nil
+}
+
+// clearTree removes all entries of a directory (except Syncthing internal data)
+func clearTree(root string) error {
+	fd, err := os.Open(root)
+	if err != nil {
+		return err
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if tarSkipNames[n] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// inotify based implementation of startFileWatch
+
+const fileWatchMaxDirs = 8192 // Maximum number of watched directories per folder
+
+const fileWatchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF
+
+// Directories never watched
+var fileWatchSkipDirs = map[string]bool{".git": true, ".stfolder": true, ".stversions": true}
+
+type inotifyWatch struct {
+	fd       *os.File
+	root     string
+	dirs     map[int32]string // watch descriptor -> dir path (relative to root)
+	mutex    sync.Mutex
+	cb       func(path, op string)
+	overflow func()
+}
+
+// startFileWatch watches recursively a directory, calls cb for each change
+// and returns the function to call to stop watching
+func startFileWatch(root string, cb func(path, op string), overflow func()) (func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %v", err)
+	}
+
+	w := &inotifyWatch{
+		fd:       os.NewFile(uintptr(fd), "inotify"),
+		root:     root,
+		dirs:     make(map[int32]string),
+		mutex:    sync.NewMutex(),
+		cb:       cb,
+		overflow: overflow,
+	}
+	if err := w.addTree(""); err != nil {
+		w.fd.Close()
+		return nil, err
+	}
+
+	go w.readLoop()
+
+	return func() { w.fd.Close() }, nil
+}
+
+// addTree adds watches on a directory and its sub-directories
+func (w *inotifyWatch) addTree(rel string) error {
+	return filepath.Walk(filepath.Join(w.root, rel), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if fileWatchSkipDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		w.mutex.Lock()
+		nb := len(w.dirs)
+		w.mutex.Unlock()
+		if nb >= fileWatchMaxDirs {
+			w.overflow()
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(int(w.fd.Fd()), path, fileWatchMask)
+		if err != nil {
+			if err == syscall.ENOSPC {
+				return fmt.Errorf("inotify watches limit reached")
+			}
+			return nil
+		}
+		r, _ := filepath.Rel(w.root, path)
+		if r == "." {
+			r = ""
+		}
+		w.mutex.Lock()
+		w.dirs[int32(wd)] = r
+		w.mutex.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatch) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.fd.Read(buf)
+		if err != nil {
+			// file closed when watch is stopped
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := ""
+			if ev.Len > 0 {
+				end := off + syscall.SizeofInotifyEvent + int(ev.Len)
+				if end > n {
+					break
+				}
+				name = strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:end]), "\x00")
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+// handle converts an inotify event into a file change
+func (w *inotifyWatch) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.overflow()
+		return
+	}
+
+	w.mutex.Lock()
+	dir, exist := w.dirs[wd]
+	if mask&(syscall.IN_DELETE_SELF|syscall.IN_IGNORED) != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mutex.Unlock()
+	if !exist || name == "" {
+		return
+	}
+
+	rel := filepath.Join(dir, name)
+	var op string
+	switch {
+	case mask&syscall.IN_CREATE != 0:
+		op = xsapiv1.FileChangeCreate
+	case mask&syscall.IN_MOVED_TO != 0:
+		op = xsapiv1.FileChangeCreate
+	case mask&syscall.IN_CLOSE_WRITE != 0:
+		op = xsapiv1.FileChangeWrite
+	case mask&syscall.IN_DELETE != 0:
+		op = xsapiv1.FileChangeRemove
+	case mask&syscall.IN_MOVED_FROM != 0:
+		op = xsapiv1.FileChangeRename
+	case mask&syscall.IN_ATTRIB != 0:
+		op = xsapiv1.FileChangeChmod
+	default:
+		return
+	}
+
+	// Watch new directories
+	if mask&syscall.IN_ISDIR != 0 && op == xsapiv1.FileChangeCreate && !fileWatchSkipDirs[name] {
+		if err := w.addTree(rel); err != nil {
+			w.overflow()
+		}
+	}
+
+	w.cb(rel, op)
+}
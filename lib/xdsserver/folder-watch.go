@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const folderWatchReconcileTime = 5 // Time (in seconds) between two checks of folders to watch
+const folderWatchThrottleTime = 1  // Minimum time (in seconds) between two events of a folder
+const folderWatchMaxChanges = 200  // Maximum number of changes reported in one event
+
+// FolderWatcher Watch files of folders (with WatchFiles set) and emit
+// throttled file change events, also track disk usage of folders with a quota
+type FolderWatcher struct {
+	*Context
+	watches map[string]*folderWatch
+	stop    chan struct{} // signals intentional stop
+
+	// Disk quota (see folder-quota.go)
+	quota       xdsconfig.QuotaConf
+	usage       map[string]*xsapiv1.FolderDiskUsage
+	quotaPaused map[string]bool // folders paused because quota is exceeded
+	usageMutex  sync.Mutex
+}
+
+// folderWatch Hold changes of a watched folder
+type folderWatch struct {
+	root    string
+	changes []xsapiv1.FolderFileChange
+	seen    map[string]bool // path+op already reported in current period
+	dropped int
+	mutex   sync.Mutex
+	stopFn  func()
+	stop    chan struct{}
+}
+
+// NewFolderWatcher creates a new instance of FolderWatcher
+func NewFolderWatcher(ctx *Context) *FolderWatcher {
+	w := FolderWatcher{
+		Context:     ctx,
+		watches:     make(map[string]*folderWatch),
+		stop:        make(chan struct{}),
+		quota:       xdsconfig.QuotaConf{WarningPercent: quotaDefaultWarning, CheckS: quotaDefaultCheckTime},
+		usage:       make(map[string]*xsapiv1.FolderDiskUsage),
+		quotaPaused: make(map[string]bool),
+		usageMutex:  sync.NewMutex(),
+	}
+	if cfg := ctx.Config.FileConf.QuotaConf; cfg != nil {
+		w.quota.DefaultMB = cfg.DefaultMB
+		if cfg.WarningPercent > 0 && cfg.WarningPercent <= 100 {
+			w.quota.WarningPercent = cfg.WarningPercent
+		}
+		if cfg.CheckS > 0 {
+			w.quota.CheckS = cfg.CheckS
+		}
+	}
+	return &w
+}
+
+// Start starts watching folders
+func (w *FolderWatcher) Start() {
+	go w.reconcileLoop()
+	go w.quotaLoop()
+}
+
+// Stop stops all watches
+func (w *FolderWatcher) Stop() {
+	close(w.stop)
+}
+
+/*** Private functions ***/
+
+func (w *FolderWatcher) reconcileLoop() {
+	for {
+		select {
+		case <-w.stop:
+			w.Log.Debugln("Stop folder watcher reconcileLoop")
+			for id := range w.watches {
+				w.unwatch(id)
+			}
+			return
+		case <-time.After(folderWatchReconcileTime * time.Second):
+			w.reconcile()
+		}
+	}
+}
+
+// reconcile starts or stops watches according to folders config
+func (w *FolderWatcher) reconcile() {
+	wanted := make(map[string]string)
+	for _, fc := range w.mfolders.GetConfigArr() {
+		if !fc.WatchFiles || fc.Status == xsapiv1.StatusErrorConfig {
+			continue
+		}
+		if f := w.mfolders.Get(fc.ID); f != nil {
+			if dir := (*f).GetFullPath(""); dir != "" {
+				wanted[fc.ID] = dir
+			}
+		}
+	}
+
+	for id, fw := range w.watches {
+		if dir, exist := wanted[id]; !exist || dir != fw.root {
+			w.unwatch(id)
+		}
+	}
+	for id, dir := range wanted {
+		if _, exist := w.watches[id]; !exist {
+			if err := w.watch(id, dir); err != nil {
+				w.Log.Errorf("Cannot watch files of folder %s: %v", id, err)
+				// Don't retry till folder config changes
+				w.watches[id] = &folderWatch{root: dir}
+			}
+		}
+	}
+}
+
+// watch starts watching a folder
+func (w *FolderWatcher) watch(id, dir string) error {
+	fw := &folderWatch{
+		root:    dir,
+		changes: []xsapiv1.FolderFileChange{},
+		seen:    make(map[string]bool),
+		mutex:   sync.NewMutex(),
+		stop:    make(chan struct{}),
+	}
+
+	stopFn, err := startFileWatch(dir, fw.add, fw.overflow)
+	if err != nil {
+		return err
+	}
+	fw.stopFn = stopFn
+	w.watches[id] = fw
+
+	w.Log.Infof("Watch files of folder %s (%s)", id, dir)
+	go w.flushLoop(id, fw)
+	return nil
+}
+
+// unwatch stops watching a folder
+func (w *FolderWatcher) unwatch(id string) {
+	fw, exist := w.watches[id]
+	if !exist {
+		return
+	}
+	delete(w.watches, id)
+	if fw.stopFn != nil {
+		fw.stopFn()
+		close(fw.stop)
+		w.Log.Infof("Stop watching files of folder %s", id)
+	}
+}
+
+// flushLoop emits changes of a folder once per throttling period
+func (w *FolderWatcher) flushLoop(id string, fw *folderWatch) {
+	for {
+		select {
+		case <-fw.stop:
+			return
+		case <-time.After(folderWatchThrottleTime * time.Second):
+			fw.mutex.Lock()
+			if len(fw.changes) == 0 && fw.dropped == 0 {
+				fw.mutex.Unlock()
+				continue
+			}
+			ev := xsapiv1.FolderFileChanges{
+				FolderID: id,
+				Changes:  fw.changes,
+				Dropped:  fw.dropped,
+			}
+			fw.changes = []xsapiv1.FolderFileChange{}
+			fw.seen = make(map[string]bool)
+			fw.dropped = 0
+			fw.mutex.Unlock()
+
+			if err := w.events.Emit(xsapiv1.EVTFolderFileChange, ev, ""); err != nil {
+				w.LogSillyf("Cannot notify file changes of folder %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// add records a file change (called by platform watcher)
+func (fw *folderWatch) add(path, op string) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	key := op + ":" + path
+	if fw.seen[key] {
+		return
+	}
+	if len(fw.changes) >= folderWatchMaxChanges {
+		fw.dropped++
+		return
+	}
+	fw.seen[key] = true
+	fw.changes = append(fw.changes, xsapiv1.FolderFileChange{
+		Path:      path,
+		Op:        op,
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+	})
+}
+
+// overflow records that some changes have been lost by platform watcher
+func (fw *folderWatch) overflow() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.dropped++
+}
@@ -204,11 +204,28 @@ func (f *Folders) GetConfigArr() []xsapiv1.FolderConfig {
 func (f *Folders) getConfigArrUnsafe() []xsapiv1.FolderConfig {
 	conf := []xsapiv1.FolderConfig{}
 	for _, v := range f.folders {
-		conf = append(conf, (*v).GetConfig())
+		conf = append(conf, f.withRuntime((*v).GetConfig()))
 	}
 	return conf
 }
 
+// withRuntime returns folder config including runtime information
+// (disk usage when folder has a quota, health and encryption lock state)
+func (f *Folders) withRuntime(fc xsapiv1.FolderConfig) xsapiv1.FolderConfig {
+	if f.folderWatch != nil {
+		fc.DiskUsage = f.folderWatch.GetUsage(fc.ID)
+	}
+	if f.folderHealth != nil {
+		fc.Health = f.folderHealth.GetHealth(fc.ID)
+	}
+	if IsEncrypted(fc) && f.folderCrypt != nil {
+		enc := *fc.Encryption
+		enc.Locked = f.folderCrypt.IsLocked(fc)
+		fc.Encryption = &enc
+	}
+	return fc
+}
+
 // Add adds a new folder
 func (f *Folders) Add(newF xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
 	return f.createUpdate(newF, true, false)
@@ -228,29 +245,47 @@ func (f *Folders) createUpdate(newF xsapiv1.FolderConfig, create bool, initial b
 	if newF.ClientPath == "" {
 		return nil, fmt.Errorf("ClientPath must be set")
 	}
+	if err := checkReadOnlyConfig(&newF); err != nil {
+		return nil, err
+	}
+	if err := checkFileAttrsConfig(&newF); err != nil {
+		return nil, err
+	}
+	if err := checkVersioningConfig(&newF); err != nil {
+		return nil, err
+	}
+	if err := checkAutoBuildConfig(&newF); err != nil {
+		return nil, err
+	}
+	if err := f.checkHooksConfig(&newF); err != nil {
+		return nil, err
+	}
+	if err := f.checkDependencies(&newF, initial); err != nil {
+		return nil, err
+	}
+	if err := checkEncryptionConfig(&newF); err != nil {
+		return nil, err
+	}
 
-	// Create a new folder object
-	var fld IFOLDER
-	switch newF.Type {
-	// SYNCTHING
-	case xsapiv1.TypeCloudSync:
-		if f.SThg != nil {
-			fld = NewFolderST(f.Context, f.SThg)
-		} else {
-			f.Log.Debugf("Disable project %v (syncthing not initialized)", newF.ID)
-			fld = NewFolderSTDisable(f.Context)
-		}
-
-	// PATH MAP
-	case xsapiv1.TypePathMap:
-		fld = NewFolderPathMap(f.Context)
-	default:
-		return nil, fmt.Errorf("Unsupported folder type")
+	// Create a new folder object using driver of folder type
+	fld, err := newFolderFromDriver(f.Context, newF.Type)
+	if err != nil {
+		return nil, err
+	}
+	if _, disabled := fld.(*STFolderDisable); disabled {
+		f.Log.Debugf("Disable project %v (syncthing not initialized)", newF.ID)
 	}
 
 	// Allocate a new UUID
 	if create {
 		newF.ID = fld.NewUID("")
+
+		if err := f.checkGitClone(newF.GitClone); err != nil {
+			return nil, err
+		}
+		if err := checkTemplate(&newF); err != nil {
+			return nil, err
+		}
 	}
 	if !create && newF.ID == "" {
 		return nil, fmt.Errorf("Cannot update folder with null ID")
@@ -278,6 +313,14 @@ func (f *Folders) createUpdate(newF xsapiv1.FolderConfig, create bool, initial b
 			log.Printf("ERROR Adding folder: %v\n", err)
 			return newFolder, err
 		}
+
+		// Pre-populate folder before first sync
+		if newF.Template != "" {
+			if err := applyTemplate(newF.Template, newFolder.Label, fld.GetFullPath("")); err != nil {
+				fld.Remove()
+				return nil, err
+			}
+		}
 	} else {
 		// Just update project config
 		if newFolder, err = fld.Setup(newF); err != nil {
@@ -299,8 +342,12 @@ func (f *Folders) createUpdate(newF xsapiv1.FolderConfig, create bool, initial b
 
 	// Force sync after creation
 	// (need to defer to be sure that WS events will arrive after HTTP creation reply)
+	cloneRepo := create && newF.GitClone != nil
 	go func() {
 		time.Sleep(time.Millisecond * 500)
+		if cloneRepo {
+			f.gitClone(newF.ID)
+		}
 		fld.Sync()
 	}()
 
@@ -328,6 +375,11 @@ func (f *Folders) Delete(id string) (xsapiv1.FolderConfig, error) {
 
 	delete(f.folders, id)
 
+	// Snapshots are useless without folder
+	if f.snapshots != nil {
+		f.snapshots.DeleteAll(id)
+	}
+
 	// Save config on disk
 	err = f.SaveConfig()
 
@@ -367,6 +419,36 @@ func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig) (*xsapiv1.FolderCo
 	if !dirty {
 		return &newCfg, nil
 	}
+	if err := checkReadOnlyConfig(&newCfg); err != nil {
+		return nil, err
+	}
+	if err := checkFileAttrsConfig(&newCfg); err != nil {
+		return nil, err
+	}
+	if err := checkVersioningConfig(&newCfg); err != nil {
+		return nil, err
+	}
+	if err := checkAutoBuildConfig(&newCfg); err != nil {
+		return nil, err
+	}
+	if err := f.checkHooksConfig(&newCfg); err != nil {
+		return nil, err
+	}
+	if err := f.checkDependencies(&newCfg, false); err != nil {
+		return nil, err
+	}
+	if newCfg.ClientPath != (*fc).GetConfig().ClientPath {
+		if newCfg.ClientPath == "" {
+			return nil, fmt.Errorf("ClientPath must be set")
+		}
+		if f.isExecRunning(id) {
+			return nil, fmt.Errorf("cannot move folder while commands are running")
+		}
+		if IsEncrypted(newCfg) {
+			return nil, fmt.Errorf("cannot move encrypted folder")
+		}
+		newCfg.ClientPath = common.PathNormalize(newCfg.ClientPath)
+	}
 
 	fld, err := (*fc).Update(newCfg)
 	if err != nil {
@@ -382,6 +464,30 @@ func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig) (*xsapiv1.FolderCo
 	return fld, err
 }
 
+// IsDeleteDestructive Returns true when deleting a folder also deletes
+// files on server side (IOW CloudSync folder with a not empty directory)
+func (f *Folders) IsDeleteDestructive(id string) bool {
+	fc := f.Get(id)
+	if fc == nil || (*fc).GetConfig().Type != xsapiv1.TypeCloudSync {
+		return false
+	}
+	if IsEncrypted((*fc).GetConfig()) {
+		// Encrypted files are also deleted (even when folder is locked)
+		return true
+	}
+	dir := (*fc).GetFullPath("")
+	if dir == "" {
+		return false
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	names, _ := fd.Readdirnames(1)
+	return len(names) > 0
+}
+
 // ForceSync Force the synchronization of a folder
 func (f *Folders) ForceSync(id string) error {
 	fc := f.Get(id)
@@ -391,6 +497,15 @@ func (f *Folders) ForceSync(id string) error {
 	return (*fc).Sync()
 }
 
+// Rescan Queue an immediate rescan of folder files
+func (f *Folders) Rescan(id string) error {
+	fc := f.Get(id)
+	if fc == nil {
+		return fmt.Errorf("Unknown id")
+	}
+	return (*fc).Rescan()
+}
+
 // IsFolderInSync Returns true when folder is in sync
 func (f *Folders) IsFolderInSync(id string) (bool, error) {
 	fc := f.Get(id)
@@ -400,8 +515,163 @@ func (f *Folders) IsFolderInSync(id string) (bool, error) {
 	return (*fc).IsInSync()
 }
 
+// SetPaused Pauses or resumes synchronization of a CloudSync folder
+func (f *Folders) SetPaused(id string, paused bool) (*xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	if !paused && f.folderCrypt.IsLocked(stf.GetConfig()) {
+		return nil, fmt.Errorf("folder is locked, unlock it to resume synchronization")
+	}
+	if err := stf.SetPaused(paused); err != nil {
+		return nil, err
+	}
+
+	// Save config on disk
+	fld := stf.GetConfig()
+	err = f.SaveConfig()
+
+	return &fld, err
+}
+
+// AddDevice Synchronizes a CloudSync folder with an additional device
+func (f *Folders) AddDevice(id, devID string) (*xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	extra := stf.GetConfig().DataCloudSync.ExtraDevices
+	for _, d := range extra {
+		if d == devID {
+			return nil, fmt.Errorf("device %s already synchronized with folder", devID)
+		}
+	}
+	if err := stf.SetDevices(append(append([]string{}, extra...), devID)); err != nil {
+		return nil, err
+	}
+
+	// Save config on disk
+	fld := stf.GetConfig()
+	err = f.SaveConfig()
+
+	return &fld, err
+}
+
+// RemoveDevice Stops synchronization of a CloudSync folder with an additional device
+func (f *Folders) RemoveDevice(id, devID string) (*xsapiv1.FolderConfig, error) {
+	fcMutex.Lock()
+	defer fcMutex.Unlock()
+
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	cfg := stf.GetConfig()
+	if devID == cfg.DataCloudSync.SyncThingID {
+		return nil, fmt.Errorf("device that registered folder cannot be removed")
+	}
+	extra := []string{}
+	for _, d := range cfg.DataCloudSync.ExtraDevices {
+		if d != devID {
+			extra = append(extra, d)
+		}
+	}
+	if len(extra) == len(cfg.DataCloudSync.ExtraDevices) {
+		return nil, fmt.Errorf("unknown device")
+	}
+	if err := stf.SetDevices(extra); err != nil {
+		return nil, err
+	}
+
+	// Save config on disk
+	fld := stf.GetConfig()
+	err = f.SaveConfig()
+
+	return &fld, err
+}
+
+// GetIgnores Returns ignore patterns of a CloudSync folder
+func (f *Folders) GetIgnores(id string) (*xsapiv1.FolderIgnores, error) {
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	return stf.GetIgnores()
+}
+
+// SetIgnores Updates ignore patterns of a CloudSync folder and rescan it
+func (f *Folders) SetIgnores(id string, ignore []string) (*xsapiv1.FolderIgnores, error) {
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := stf.SetIgnores(ignore); err != nil {
+		return nil, err
+	}
+	return stf.GetIgnores()
+}
+
 //*** Private functions ***
 
+// GetConflicts Returns sync conflicts of a CloudSync folder
+func (f *Folders) GetConflicts(id string) ([]xsapiv1.FolderConflict, error) {
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	return stf.GetConflicts()
+}
+
+// ResolveConflict Resolves a sync conflict of a CloudSync folder
+func (f *Folders) ResolveConflict(id string, args xsapiv1.FolderConflictResolveArgs) (*xsapiv1.FolderConflict, error) {
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	return stf.ResolveConflict(args.Path, args.Keep)
+}
+
+// GetFileVersions Returns previous versions of a file of a CloudSync folder
+func (f *Folders) GetFileVersions(id, path string) ([]xsapiv1.FileVersion, error) {
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	return stf.GetFileVersions(path)
+}
+
+// RestoreFileVersion Restores a previous version of a file of a CloudSync folder
+func (f *Folders) RestoreFileVersion(id string, args xsapiv1.FileVersionRestoreArgs) (*xsapiv1.FileVersion, error) {
+	stf, err := f.getSTFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	if stf.GetConfig().ReadOnly {
+		return nil, fmt.Errorf("cannot restore file of a read-only folder")
+	}
+	return stf.RestoreFileVersion(args.Path, args.Version)
+}
+
+// getSTFolder returns a folder handled by Syncthing
+func (f *Folders) getSTFolder(id string) (*STFolder, error) {
+	fc := f.Get(id)
+	if fc == nil {
+		return nil, fmt.Errorf("Unknown id")
+	}
+	stf, ok := (*fc).(*STFolder)
+	if !ok {
+		return nil, fmt.Errorf("only supported by %s folders", xsapiv1.TypeCloudSync)
+	}
+	return stf, nil
+}
+
 // Use XML format and not json to be able to save/load all fields including
 // ones that are masked in json (IOW defined with `json:"-"`)
 type xmlFolders struct {
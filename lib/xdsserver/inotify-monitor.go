@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Kernel file that defines the maximum number of inotify watches per user
+const inotifyMaxWatchesFile = "/proc/sys/fs/inotify/max_user_watches"
+
+const inotifyMonitorTime = 10 * 60 // Time (in seconds) between two checks
+const inotifyFirstCheckTime = 30   // Time (in seconds) before first check
+const inotifyDefaultFallbackRescan = 30
+const inotifyDefaultRescan = 60 // Syncthing default rescan interval
+
+var errInotifyStopWalk = errors.New("stop walk")
+
+// InotifyMonitor Detect when inotify watches limit is reached and fallback
+// to periodic scanning for folders that cannot be watched
+type InotifyMonitor struct {
+	*Context
+	status         xsapiv1.InotifyStatus
+	fallbackRescan int
+	normalRescan   int
+	mutex          sync.Mutex
+	stop           chan struct{} // signals intentional stop
+}
+
+// NewInotifyMonitor creates a new instance of InotifyMonitor
+func NewInotifyMonitor(ctx *Context) *InotifyMonitor {
+	m := InotifyMonitor{
+		Context:        ctx,
+		status:         xsapiv1.InotifyStatus{FallbackFolders: []string{}},
+		fallbackRescan: inotifyDefaultFallbackRescan,
+		normalRescan:   inotifyDefaultRescan,
+		mutex:          sync.NewMutex(),
+		stop:           make(chan struct{}),
+	}
+	if stCfg := ctx.Config.FileConf.SThgConf; stCfg != nil {
+		if stCfg.FallbackRescanIntervalS > 0 {
+			m.fallbackRescan = stCfg.FallbackRescanIntervalS
+		}
+		if stCfg.RescanIntervalS > 0 {
+			m.normalRescan = stCfg.RescanIntervalS
+		}
+	}
+	return &m
+}
+
+// Start starts monitoring loop
+func (m *InotifyMonitor) Start() error {
+	if _, err := readInotifyMaxWatches(); err != nil {
+		return fmt.Errorf("inotify watches monitoring disabled: %v", err)
+	}
+	go m.monitorLoop()
+	return nil
+}
+
+// Stop stops monitoring loop
+func (m *InotifyMonitor) Stop() {
+	close(m.stop)
+}
+
+// GetStatus returns the last computed inotify status
+func (m *InotifyMonitor) GetStatus() xsapiv1.InotifyStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+// Check computes the number of watches required by CloudSync folders and
+// enables periodic scanning on folders that don't fit in kernel limit
+func (m *InotifyMonitor) Check() (xsapiv1.InotifyStatus, error) {
+	maxWatches, err := readInotifyMaxWatches()
+	if err != nil {
+		return m.GetStatus(), err
+	}
+
+	// inotify uses one watch per directory
+	type fldCount struct {
+		id    string
+		count int
+	}
+	counts := []fldCount{}
+	required := 0
+	for _, fc := range m.mfolders.GetConfigArr() {
+		if fc.Type != xsapiv1.TypeCloudSync {
+			continue
+		}
+		f := m.mfolders.Get(fc.ID)
+		if f == nil {
+			continue
+		}
+		dir := (*f).GetFullPath("")
+		if dir == "" {
+			continue
+		}
+		n := countDirs(dir, maxWatches+1)
+		counts = append(counts, fldCount{id: fc.ID, count: n})
+		required += n
+	}
+
+	// Smallest folders are watched first, others fallback to periodic scanning
+	sort.Slice(counts, func(i, j int) bool { return counts[i].count < counts[j].count })
+	fallback := []string{}
+	used := 0
+	for _, fc := range counts {
+		used += fc.count
+		if used > maxWatches {
+			fallback = append(fallback, fc.id)
+		}
+	}
+
+	st := xsapiv1.InotifyStatus{
+		MaxUserWatches:  maxWatches,
+		RequiredWatches: required,
+		LimitReached:    required > maxWatches,
+		FallbackFolders: fallback,
+	}
+	if st.LimitReached {
+		// Suggest a limit with some margin
+		st.SysctlHint = fmt.Sprintf("sysctl -w fs.inotify.max_user_watches=%d", nextPowerOf2(required*2))
+	}
+
+	m.mutex.Lock()
+	prev := m.status
+	m.status = st
+	m.mutex.Unlock()
+
+	// Update rescan interval of folders
+	isFallback := make(map[string]bool)
+	for _, id := range fallback {
+		isFallback[id] = true
+		if err := m.SThg.FolderRescanIntervalSet(id, m.fallbackRescan); err != nil {
+			m.Log.Errorf("Cannot set rescan interval of folder %s: %v", id, err)
+		}
+	}
+	for _, id := range prev.FallbackFolders {
+		if !isFallback[id] {
+			if err := m.SThg.FolderRescanIntervalSet(id, m.normalRescan); err != nil {
+				m.Log.Errorf("Cannot restore rescan interval of folder %s: %v", id, err)
+			}
+		}
+	}
+
+	if st.LimitReached {
+		m.Log.Warningf("inotify watches limit reached (%d required, limit %d): %d folder(s) use periodic scanning, run '%s' to fix it",
+			required, maxWatches, len(fallback), st.SysctlHint)
+	}
+	if st.LimitReached != prev.LimitReached || len(st.FallbackFolders) != len(prev.FallbackFolders) {
+		if err := m.events.Emit(xsapiv1.EVTInotifyLimit, st, ""); err != nil {
+			m.Log.Warningf("Cannot notify inotify limit: %v", err)
+		}
+	}
+
+	return st, nil
+}
+
+/*** Private functions ***/
+
+func (m *InotifyMonitor) monitorLoop() {
+	wait := time.Duration(inotifyFirstCheckTime)
+	for {
+		select {
+		case <-m.stop:
+			m.Log.Debugln("Stop inotify monitorLoop")
+			return
+		case <-time.After(wait * time.Second):
+			wait = inotifyMonitorTime
+			if _, err := m.Check(); err != nil {
+				m.Log.Errorf("inotify watches check error: %v", err)
+			}
+		}
+	}
+}
+
+// readInotifyMaxWatches returns the inotify watches kernel limit
+func readInotifyMaxWatches() (int, error) {
+	b, err := ioutil.ReadFile(inotifyMaxWatchesFile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// countDirs returns the number of directories of a tree (stop counting at max)
+func countDirs(root string, max int) int {
+	cnt := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			cnt++
+			if cnt >= max {
+				return errInotifyStopWalk
+			}
+		}
+		return nil
+	})
+	return cnt
+}
+
+func nextPowerOf2(v int) int {
+	p := 8192
+	for p < v {
+		p *= 2
+	}
+	return p
+}
@@ -0,0 +1,584 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Minimal LDAP v3 client (RFC 4511): simple bind, search and StartTLS
+
+// BER universal tags
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+)
+
+// LDAP protocol operations tags
+const (
+	ldapOpBindRequest      = 0x60
+	ldapOpBindResponse     = 0x61
+	ldapOpUnbindRequest    = 0x42
+	ldapOpSearchRequest    = 0x63
+	ldapOpSearchEntry      = 0x64
+	ldapOpSearchDone       = 0x65
+	ldapOpSearchReference  = 0x73
+	ldapOpExtendedRequest  = 0x77
+	ldapOpExtendedResponse = 0x78
+)
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+const ldapMaxMessageSize = 4 * 1024 * 1024
+
+// LDAP result codes
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+)
+
+// ldapError Error returned by LDAP server
+type ldapError struct {
+	code int
+	msg  string
+}
+
+func (e *ldapError) Error() string {
+	return fmt.Sprintf("LDAP error %d: %s", e.code, e.msg)
+}
+
+// ldapEntry Entry returned by a search (attribute names in lower case)
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// first returns the first value of an attribute
+func (e *ldapEntry) first(attr string) string {
+	if v := e.attrs[strings.ToLower(attr)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// ldapConn Connection to a LDAP server
+type ldapConn struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	msgID   int
+	timeout time.Duration
+}
+
+// berPacket Decoded BER element
+type berPacket struct {
+	tag      byte
+	data     []byte
+	children []*berPacket // elements of constructed types
+}
+
+// ldapDial connects to a LDAP server (ldap:// or ldaps:// URL)
+func ldapDial(rawURL string, tlsCfg *tls.Config, startTLS bool, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %v", err)
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if u.Scheme == "ldaps" {
+			host = net.JoinHostPort(host, "636")
+		} else {
+			host = net.JoinHostPort(host, "389")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsCfg)
+	case "ldap":
+		conn, err = dialer.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("invalid LDAP URL scheme '%s'", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ldapConn{conn: conn, rd: bufio.NewReader(conn), timeout: timeout}
+	if startTLS && u.Scheme == "ldap" {
+		if err := l.startTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// close unbinds and closes connection
+func (l *ldapConn) close() {
+	l.request(berEncode(ldapOpUnbindRequest))
+	l.conn.Close()
+}
+
+// bind authenticates using a DN and password (simple bind)
+func (l *ldapConn) bind(dn, password string) error {
+	id, err := l.request(berEncode(ldapOpBindRequest,
+		berInt(berTagInteger, 3),
+		berString(berTagOctetString, dn),
+		berString(0x80, password)))
+	if err != nil {
+		return err
+	}
+	op, err := l.response(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapOpBindResponse {
+		return fmt.Errorf("unexpected LDAP bind response")
+	}
+	return ldapResult(op)
+}
+
+// startTLS upgrades connection to TLS
+func (l *ldapConn) startTLS(tlsCfg *tls.Config) error {
+	id, err := l.request(berEncode(ldapOpExtendedRequest, berString(0x80, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := l.response(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapOpExtendedResponse {
+		return fmt.Errorf("unexpected LDAP StartTLS response")
+	}
+	if err := ldapResult(op); err != nil {
+		return fmt.Errorf("StartTLS rejected: %v", err)
+	}
+
+	tc := tls.Client(l.conn, tlsCfg)
+	tc.SetDeadline(time.Now().Add(l.timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	l.conn = tc
+	l.rd = bufio.NewReader(tc)
+	return nil
+}
+
+// search returns entries matching a filter in the subtree of baseDN
+func (l *ldapConn) search(baseDN, filter string, attrs []string, sizeLimit int) ([]ldapEntry, error) {
+	f, err := ldapCompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := [][]byte{}
+	for _, a := range attrs {
+		if a != "" {
+			attrList = append(attrList, berString(berTagOctetString, a))
+		}
+	}
+	id, err := l.request(berEncode(ldapOpSearchRequest,
+		berString(berTagOctetString, baseDN),
+		berInt(berTagEnumerated, 2), // whole subtree
+		berInt(berTagEnumerated, 0), // never deref aliases
+		berInt(berTagInteger, sizeLimit),
+		berInt(berTagInteger, int(l.timeout/time.Second)),
+		berBool(false),
+		f,
+		berEncode(berTagSequence, attrList...)))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []ldapEntry{}
+	for {
+		op, err := l.response(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapOpSearchEntry:
+			if len(op.children) < 2 {
+				return nil, fmt.Errorf("invalid LDAP search entry")
+			}
+			e := ldapEntry{dn: string(op.children[0].data), attrs: make(map[string][]string)}
+			for _, a := range op.children[1].children {
+				if len(a.children) < 2 {
+					continue
+				}
+				name := strings.ToLower(string(a.children[0].data))
+				for _, v := range a.children[1].children {
+					e.attrs[name] = append(e.attrs[name], string(v.data))
+				}
+			}
+			entries = append(entries, e)
+		case ldapOpSearchReference:
+			// Referrals are not followed
+		case ldapOpSearchDone:
+			return entries, ldapResult(op)
+		default:
+			return nil, fmt.Errorf("unexpected LDAP search response")
+		}
+	}
+}
+
+/*** Private functions ***/
+
+// request sends a LDAP message and returns its ID
+func (l *ldapConn) request(op []byte) (int, error) {
+	l.msgID++
+	msg := berEncode(berTagSequence, berInt(berTagInteger, l.msgID), op)
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+	if _, err := l.conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return l.msgID, nil
+}
+
+// response reads the next message replied to a request, returns its
+// protocol operation
+func (l *ldapConn) response(id int) (*berPacket, error) {
+	for {
+		l.conn.SetDeadline(time.Now().Add(l.timeout))
+		raw, err := berRead(l.rd)
+		if err != nil {
+			return nil, err
+		}
+		p, _, err := berParse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if p.tag != berTagSequence || len(p.children) < 2 {
+			return nil, fmt.Errorf("invalid LDAP message")
+		}
+		msgID := p.children[0].int()
+		if msgID == 0 {
+			// Unsolicited notification (eg. notice of disconnection)
+			return nil, fmt.Errorf("connection closed by LDAP server")
+		}
+		if msgID == id {
+			return p.children[1], nil
+		}
+	}
+}
+
+// ldapResult returns the error of a LDAPResult (nil on success)
+func ldapResult(op *berPacket) error {
+	if len(op.children) < 3 {
+		return fmt.Errorf("invalid LDAP result")
+	}
+	if code := op.children[0].int(); code != ldapResultSuccess {
+		return &ldapError{code: code, msg: string(op.children[2].data)}
+	}
+	return nil
+}
+
+// ldapCompileFilter encodes a filter (RFC 4515 string representation, only
+// and, or, not, equality, presence and substrings are supported)
+func ldapCompileFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	b, rest, err := ldapParseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid LDAP filter %s", filter)
+	}
+	return b, nil
+}
+
+func ldapParseFilter(f string) ([]byte, string, error) {
+	if len(f) < 3 || f[0] != '(' {
+		return nil, "", fmt.Errorf("invalid LDAP filter %s", f)
+	}
+	f = f[1:]
+
+	switch f[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if f[0] == '|' {
+			tag = 0xa1
+		}
+		f = f[1:]
+		items := [][]byte{}
+		for len(f) > 0 && f[0] == '(' {
+			item, rest, err := ldapParseFilter(f)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item)
+			f = rest
+		}
+		if len(f) == 0 || f[0] != ')' {
+			return nil, "", fmt.Errorf("invalid LDAP filter, missing ')'")
+		}
+		return berEncode(tag, items...), f[1:], nil
+	case '!':
+		item, rest, err := ldapParseFilter(f[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", fmt.Errorf("invalid LDAP filter, missing ')'")
+		}
+		return berEncode(0xa2, item), rest[1:], nil
+	}
+
+	// Escaped parenthesis are written \28 and \29
+	end := strings.IndexByte(f, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("invalid LDAP filter, missing ')'")
+	}
+	item, rest := f[:end], f[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("invalid LDAP filter item %s", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if strings.ContainsAny(attr, "<>~:") {
+		return nil, "", fmt.Errorf("unsupported LDAP filter item %s", item)
+	}
+
+	if value == "*" {
+		return berString(0x87, attr), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		subs := [][]byte{}
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+			v, err := ldapUnescape(p)
+			if err != nil {
+				return nil, "", err
+			}
+			tag := byte(0x81) // any
+			if i == 0 {
+				tag = 0x80 // initial
+			} else if i == len(parts)-1 {
+				tag = 0x82 // final
+			}
+			subs = append(subs, berString(tag, v))
+		}
+		return berEncode(0xa4, berString(berTagOctetString, attr), berEncode(berTagSequence, subs...)), rest, nil
+	}
+	v, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berEncode(0xa3, berString(berTagOctetString, attr), berString(berTagOctetString, v)), rest, nil
+}
+
+// ldapEscape escapes a value inserted in a filter
+func ldapEscape(s string) string {
+	res := ""
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			res += fmt.Sprintf("\\%02x", c)
+		default:
+			res += string(c)
+		}
+	}
+	return res
+}
+
+// ldapEscapeDN escapes a value inserted in a DN (RFC 4514)
+func ldapEscapeDN(s string) string {
+	res := ""
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			res += "\\" + string(c)
+		case c == 0:
+			res += "\\00"
+		default:
+			res += string(c)
+		}
+	}
+	return res
+}
+
+// ldapUnescape decodes \XX sequences of a filter value
+func ldapUnescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	res := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			res = append(res, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid LDAP filter escape sequence")
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid LDAP filter escape sequence")
+		}
+		res = append(res, b[0])
+		i += 2
+	}
+	return string(res), nil
+}
+
+// berEncode encodes an element (content is concatenation of parts)
+func berEncode(tag byte, parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	b := append([]byte{tag}, berLength(n)...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	l := []byte{}
+	for ; n > 0; n >>= 8 {
+		l = append([]byte{byte(n)}, l...)
+	}
+	return append([]byte{0x80 | byte(len(l))}, l...)
+}
+
+// berInt encodes a (non negative) integer
+func berInt(tag byte, v int) []byte {
+	b := []byte{}
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if v >>= 8; v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berTagBoolean, []byte{0xff})
+	}
+	return berEncode(berTagBoolean, []byte{0})
+}
+
+// berRead reads a complete element from a stream
+func berRead(r *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	length := int(hdr[1])
+	if hdr[1]&0x80 != 0 {
+		nb := int(hdr[1] & 0x7f)
+		if nb == 0 || nb > 4 {
+			return nil, fmt.Errorf("invalid BER length")
+		}
+		lb := make([]byte, nb)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, lb...)
+		length = 0
+		for _, c := range lb {
+			length = length<<8 | int(c)
+		}
+	}
+	if length < 0 || length > ldapMaxMessageSize {
+		return nil, fmt.Errorf("LDAP message too large")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return append(hdr, content...), nil
+}
+
+// berParse decodes an element, returns remaining bytes
+func berParse(b []byte) (*berPacket, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("invalid BER element")
+	}
+	length, i := int(b[1]), 2
+	if b[1]&0x80 != 0 {
+		nb := int(b[1] & 0x7f)
+		if nb == 0 || nb > 4 || len(b) < 2+nb {
+			return nil, nil, fmt.Errorf("invalid BER length")
+		}
+		length = 0
+		for _, c := range b[2 : 2+nb] {
+			length = length<<8 | int(c)
+		}
+		i += nb
+	}
+	if length < 0 || len(b)-i < length {
+		return nil, nil, fmt.Errorf("truncated BER element")
+	}
+
+	p := &berPacket{tag: b[0], data: b[i : i+length]}
+	if p.tag&0x20 != 0 {
+		for rest := p.data; len(rest) > 0; {
+			child, r, err := berParse(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			p.children = append(p.children, child)
+			rest = r
+		}
+	}
+	return p, b[i+length:], nil
+}
+
+// int returns value of an integer or enumerated element
+func (p *berPacket) int() int {
+	v := 0
+	for _, c := range p.data {
+		v = v<<8 | int(c)
+	}
+	return v
+}
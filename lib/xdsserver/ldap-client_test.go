@@ -0,0 +1,354 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLdapCompileFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string // hex encoding, empty when an error is expected
+	}{
+		// equality
+		{"(uid=john)", "a30b040375696404046a6f686e"},
+		{"uid=john", "a30b040375696404046a6f686e"},
+		{"  (uid=john)  ", "a30b040375696404046a6f686e"},
+		// escaped value
+		{`(cn=a\2ab)`, "a3090402636e0403612a62"},
+		// presence
+		{"(mail=*)", "87046d61696c"},
+		// substrings: initial, any, final
+		{"(cn=a*b*c)", "a40f0402636e3009800161810162820163"},
+		{"(cn=*b)", "a4090402636e3003820162"},
+		{"(cn=a*)", "a4090402636e3003800161"},
+		// and, or, not
+		{"(&(a=1)(b=2))", "a010a306040161040131a306040162040132"},
+		{"(|(a=1)(!(b=2)))", "a112a306040161040131a208a306040162040132"},
+		{"(&)", "a000"},
+
+		// errors
+		{"", ""},
+		{"()", ""},
+		{"(uid=john", ""},
+		{"(uid=john))", ""},
+		{"(uid=john)(cn=x)", ""},
+		{"(=john)", ""},
+		{"(uidjohn)", ""},
+		{"(uid>=1)", ""},
+		{"(uid~=john)", ""},
+		{"(uid:dn:=john)", ""},
+		{"(&(a=1)", ""},
+		{"(&(a=1)x)", ""},
+		{"(!(a=1)", ""},
+		{"(!a=1)", ""},
+		{`(cn=a\2)`, ""},
+		{`(cn=a\zz)`, ""},
+		{`(cn=a*\4*b)`, ""},
+	}
+	for _, tt := range tests {
+		b, err := ldapCompileFilter(tt.filter)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("filter %q: expected error, got %x", tt.filter, b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("filter %q: unexpected error: %v", tt.filter, err)
+			continue
+		}
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("filter %q: got %s, want %s", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestLdapParseFilterRest(t *testing.T) {
+	_, rest, err := ldapParseFilter("(a=1)(b=2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest != "(b=2)" {
+		t.Errorf("got rest %q, want %q", rest, "(b=2)")
+	}
+}
+
+func TestLdapEscape(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"john", "john"},
+		{"a*b", `a\2ab`},
+		{"(x)", `\28x\29`},
+		{`a\b`, `a\5cb`},
+		{"a\x00b", `a\00b`},
+		{"*)(uid=*", `\2a\29\28uid=\2a`},
+	}
+	for _, tt := range tests {
+		got := ldapEscape(tt.value)
+		if got != tt.want {
+			t.Errorf("ldapEscape(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+		back, err := ldapUnescape(got)
+		if err != nil || back != tt.value {
+			t.Errorf("ldapUnescape(%q) = %q, %v, want %q", got, back, err, tt.value)
+		}
+		// An escaped value never changes the structure of a filter
+		b, err := ldapCompileFilter("(uid=" + got + ")")
+		if err != nil {
+			t.Errorf("filter with %q: unexpected error: %v", got, err)
+			continue
+		}
+		want := berEncode(0xa3, berString(berTagOctetString, "uid"), berString(berTagOctetString, tt.value))
+		if !bytes.Equal(b, want) {
+			t.Errorf("filter with %q: got %x, want %x", got, b, want)
+		}
+	}
+}
+
+func TestLdapEscapeDN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"john", "john"},
+		{"a,b", `a\,b`},
+		{"a+b=c", `a\+b\=c`},
+		{`"x"`, `\"x\"`},
+		{"<a>;", `\<a\>\;`},
+		{" john ", `\ john\ `},
+		{"#john", `\#john`},
+		{"jo#hn", "jo#hn"},
+		{"a\x00", `a\00`},
+	}
+	for _, tt := range tests {
+		if got := ldapEscapeDN(tt.value); got != tt.want {
+			t.Errorf("ldapEscapeDN(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBerLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "00"},
+		{0x7f, "7f"},
+		{0x80, "8180"},
+		{0xff, "81ff"},
+		{0x100, "820100"},
+		{0x123456, "83123456"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(berLength(tt.n)); got != tt.want {
+			t.Errorf("berLength(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBerInt(t *testing.T) {
+	tests := []struct {
+		v    int
+		want string
+	}{
+		{0, "020100"},
+		{1, "020101"},
+		{0x7f, "02017f"},
+		{0x80, "02020080"},
+		{0x1234, "02021234"},
+	}
+	for _, tt := range tests {
+		b := berInt(berTagInteger, tt.v)
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("berInt(%d) = %s, want %s", tt.v, got, tt.want)
+		}
+		p, rest, err := berParse(b)
+		if err != nil || len(rest) != 0 || p.int() != tt.v {
+			t.Errorf("berParse(%x) = %v, %x, %v", b, p, rest, err)
+		}
+	}
+}
+
+func TestBerParse(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name     string
+		data     string // hex
+		children int    // -1 when an error is expected
+		rest     string // hex
+	}{
+		{"octet string", "040361626300", 0, "00"},
+		{"empty sequence", "3000", 0, ""},
+		{"sequence", "30060201010401610a", 2, "0a"},
+		{"nested", "30083006020101040161", 1, ""},
+		{"long form", "0482012c" + hex.EncodeToString([]byte(long)), 0, ""},
+
+		{"empty", "", -1, ""},
+		{"tag only", "04", -1, ""},
+		{"truncated content", "040561", -1, ""},
+		{"truncated long length", "0482", -1, ""},
+		{"truncated long content", "0482010061", -1, ""},
+		{"indefinite length", "3080", -1, ""},
+		{"length too long", "048500000000ff", -1, ""},
+		{"length overflow", "0484ffffffff", -1, ""},
+		{"truncated child", "3003040261", -1, ""},
+		{"child overflows parent", "3004040361626364", -1, ""},
+		{"invalid child length", "30020480", -1, ""},
+	}
+	for _, tt := range tests {
+		b, err := hex.DecodeString(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p, rest, err := berParse(b)
+		if tt.children < 0 {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if len(p.children) != tt.children {
+			t.Errorf("%s: got %d children, want %d", tt.name, len(p.children), tt.children)
+		}
+		if got := hex.EncodeToString(rest); got != tt.rest {
+			t.Errorf("%s: got rest %s, want %s", tt.name, got, tt.rest)
+		}
+	}
+}
+
+func TestBerRead(t *testing.T) {
+	tests := []struct {
+		name string
+		data string // hex
+		want string // hex, empty when an error is expected
+	}{
+		{"short form", "0403616263ff", "0403616263"},
+		{"long form", "04810161ff", "04810161"},
+
+		{"empty", "", ""},
+		{"truncated header", "04", ""},
+		{"truncated content", "040361", ""},
+		{"truncated long length", "048201", ""},
+		{"indefinite length", "3080", ""},
+		{"length too long", "048500000000ff", ""},
+		{"message too large", "04847fffffff", ""},
+	}
+	for _, tt := range tests {
+		b, err := hex.DecodeString(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := berRead(bufio.NewReader(bytes.NewReader(b)))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %x", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s: got %x, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// ldapTestConn returns a client connected to a fake server replying data
+// to the first request
+func ldapTestConn(data []byte) *ldapConn {
+	cli, srv := net.Pipe()
+	go func() {
+		defer srv.Close()
+		buf := make([]byte, 4096)
+		if _, err := srv.Read(buf); err != nil || len(data) == 0 {
+			return
+		}
+		srv.Write(data)
+	}()
+	return &ldapConn{conn: cli, rd: bufio.NewReader(cli), timeout: 5 * time.Second}
+}
+
+func TestLdapMalformedReplies(t *testing.T) {
+	msg := func(id int, op []byte) []byte {
+		return berEncode(berTagSequence, berInt(berTagInteger, id), op)
+	}
+	result := func(tag byte, code int, text string) []byte {
+		return berEncode(tag, berInt(berTagEnumerated, code), berString(berTagOctetString, ""), berString(berTagOctetString, text))
+	}
+	entry := berEncode(ldapOpSearchEntry, berString(berTagOctetString, "uid=john,dc=example"),
+		berEncode(berTagSequence, berEncode(berTagSequence, berString(berTagOctetString, "mail"),
+			berEncode(0x31, berString(berTagOctetString, "john@example.com")))))
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		entries int // -1 when an error is expected
+	}{
+		{"success", append(msg(1, entry), msg(1, result(ldapOpSearchDone, ldapResultSuccess, ""))...), 1},
+		{"other message ignored", append(msg(7, entry), msg(1, result(ldapOpSearchDone, ldapResultSuccess, ""))...), 0},
+		{"reference ignored", append(msg(1, berEncode(ldapOpSearchReference, berString(berTagOctetString, "ldap://x"))), msg(1, result(ldapOpSearchDone, ldapResultSuccess, ""))...), 0},
+
+		{"no reply", nil, -1},
+		{"truncated reply", msg(1, entry)[:10], -1},
+		{"not a sequence", berEncode(berTagOctetString, []byte("abc")), -1},
+		{"missing operation", berEncode(berTagSequence, berInt(berTagInteger, 1)), -1},
+		{"notice of disconnection", msg(0, result(ldapOpExtendedResponse, 52, "")), -1},
+		{"invalid entry", msg(1, berEncode(ldapOpSearchEntry, berString(berTagOctetString, "uid=john"))), -1},
+		{"invalid result", msg(1, berEncode(ldapOpSearchDone, berInt(berTagEnumerated, 0))), -1},
+		{"error result", msg(1, result(ldapOpSearchDone, 32, "no such object")), -1},
+		{"unexpected operation", msg(1, result(ldapOpBindResponse, ldapResultSuccess, "")), -1},
+	}
+	for _, tt := range tests {
+		l := ldapTestConn(tt.reply)
+		entries, err := l.search("dc=example", "(uid=john)", []string{"mail"}, 10)
+		l.conn.Close()
+		if tt.entries < 0 {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if len(entries) != tt.entries {
+			t.Errorf("%s: got %d entries, want %d", tt.name, len(entries), tt.entries)
+			continue
+		}
+		if tt.entries > 0 && entries[0].first("mail") != "john@example.com" {
+			t.Errorf("%s: got mail %q", tt.name, entries[0].first("mail"))
+		}
+	}
+}
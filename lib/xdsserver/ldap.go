@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+const ldapDefaultTimeout = 10 // Default timeout (in seconds) of LDAP requests
+const ldapDefaultUserFilter = "(uid=%s)"
+const ldapDefaultGroupAttr = "memberOf"
+
+// LDAP LDAP/Active Directory authentication (password checked by binding
+// as user, roles granted according to groups of user)
+type LDAP struct {
+	*Context
+	conf       xdsconfig.LDAPConf
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	groupRoles map[string]string // group DN or name (lower case) -> role
+}
+
+// NewLDAP creates a new instance of LDAP (nil when not configured)
+func NewLDAP(ctx *Context) (*LDAP, error) {
+	cfg := ctx.Config.FileConf.LDAPConf
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.URL == "" || (cfg.BaseDN == "" && cfg.UserDN == "") {
+		return nil, fmt.Errorf("LDAP: url and baseDN (or userDN) must be set")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("LDAP: invalid url %s", cfg.URL)
+	}
+	if cfg.BindDN != "" && cfg.BindSecret == "" {
+		return nil, fmt.Errorf("LDAP: bindSecret must be set with bindDN")
+	}
+	if cfg.BindSecret != "" && !ctx.secrets.Exists(cfg.BindSecret) {
+		return nil, fmt.Errorf("LDAP: unknown secret %s", cfg.BindSecret)
+	}
+
+	l := LDAP{
+		Context:    ctx,
+		conf:       *cfg,
+		timeout:    ldapDefaultTimeout * time.Second,
+		groupRoles: make(map[string]string),
+	}
+	if l.conf.UserFilter == "" {
+		l.conf.UserFilter = ldapDefaultUserFilter
+	}
+	if l.conf.GroupAttr == "" {
+		l.conf.GroupAttr = ldapDefaultGroupAttr
+	}
+	if l.conf.GroupBaseDN == "" {
+		l.conf.GroupBaseDN = l.conf.BaseDN
+	}
+	if cfg.TimeoutS > 0 {
+		l.timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	for group, role := range cfg.GroupRoles {
+		if _, valid := roleLevels[role]; !valid {
+			return nil, fmt.Errorf("LDAP: invalid role '%s' of group %s", role, group)
+		}
+		l.groupRoles[strings.ToLower(group)] = role
+	}
+
+	l.tlsConfig = &tls.Config{
+		ServerName:         u.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP: cannot read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("LDAP: no certificate found in %s", cfg.CAFile)
+		}
+		l.tlsConfig.RootCAs = pool
+	}
+
+	ctx.Log.Infof("LDAP authentication using %s (required %v)", cfg.URL, cfg.Required)
+	return &l, nil
+}
+
+// Required returns true when API requests must be authenticated
+func (l *LDAP) Required() bool {
+	return l.conf.Required
+}
+
+// Authenticate checks password of a user and returns its identity (role is
+// the highest one granted by groups of user)
+func (l *LDAP) Authenticate(login, password string) (*authIdentity, error) {
+	// Empty password would be an anonymous bind on most servers
+	if login == "" || password == "" {
+		return nil, fmt.Errorf("user and password must be set")
+	}
+
+	conn, err := ldapDial(l.conf.URL, l.tlsConfig, l.conf.StartTLS, l.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to LDAP server: %v", err)
+	}
+	defer conn.close()
+
+	var entry *ldapEntry
+	if l.conf.UserDN != "" && l.conf.BindDN == "" {
+		// Direct bind (eg. user principal name of Active Directory)
+		dn := strings.Replace(l.conf.UserDN, "%s", ldapEscapeDN(login), -1)
+		if err := l.bindUser(conn, dn, password); err != nil {
+			return nil, err
+		}
+		if l.conf.BaseDN != "" {
+			if entry, err = l.searchUser(conn, login); err != nil {
+				return nil, err
+			}
+		} else {
+			entry = &ldapEntry{dn: dn, attrs: make(map[string][]string)}
+		}
+	} else {
+		// Search user (using service account or anonymously) then bind as user
+		if l.conf.BindDN != "" {
+			secret, err := l.secrets.Get(l.conf.BindSecret)
+			if err != nil {
+				return nil, fmt.Errorf("LDAP: password of %s not available: %v", l.conf.BindDN, err)
+			}
+			if err := conn.bind(l.conf.BindDN, secret); err != nil {
+				return nil, fmt.Errorf("LDAP: cannot bind as %s: %v", l.conf.BindDN, err)
+			}
+		}
+		if entry, err = l.searchUser(conn, login); err != nil {
+			return nil, err
+		}
+		if err := l.bindUser(conn, entry.dn, password); err != nil {
+			return nil, err
+		}
+	}
+
+	// Map groups to xds role
+	groups := entry.attrs[strings.ToLower(l.conf.GroupAttr)]
+	if l.conf.GroupFilter != "" {
+		filter := strings.Replace(l.conf.GroupFilter, "%s", ldapEscape(entry.dn), -1)
+		res, err := conn.search(l.conf.GroupBaseDN, filter, []string{"cn"}, 0)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP: cannot search groups: %v", err)
+		}
+		for _, g := range res {
+			groups = append(groups, g.dn)
+		}
+	}
+	role := l.groupsRole(groups)
+	if role == "" && l.conf.GroupRequired {
+		return nil, fmt.Errorf("user %s is not member of an authorized group", login)
+	}
+
+	user := login
+	if l.conf.UserAttr != "" {
+		if u := entry.first(l.conf.UserAttr); u != "" {
+			user = u
+		}
+	}
+	ident := authIdentity{
+		user:    user,
+		subject: "ldap:" + entry.dn,
+		email:   entry.first("mail"),
+		name:    entry.first("displayName"),
+		role:    role,
+	}
+	if ident.name == "" {
+		ident.name = entry.first("cn")
+	}
+	return &ident, nil
+}
+
+/*** Private functions ***/
+
+// bindUser checks password of user
+func (l *LDAP) bindUser(conn *ldapConn, dn, password string) error {
+	if err := conn.bind(dn, password); err != nil {
+		if e, ok := err.(*ldapError); ok && e.code == ldapResultInvalidCredentials {
+			return fmt.Errorf("invalid user or password")
+		}
+		return fmt.Errorf("LDAP: cannot bind as user: %v", err)
+	}
+	return nil
+}
+
+// searchUser returns the (unique) entry of a user
+func (l *LDAP) searchUser(conn *ldapConn, login string) (*ldapEntry, error) {
+	filter := strings.Replace(l.conf.UserFilter, "%s", ldapEscape(login), -1)
+	attrs := []string{l.conf.GroupAttr, "mail", "displayName", "cn", l.conf.UserAttr}
+	res, err := conn.search(l.conf.BaseDN, filter, attrs, 2)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP: cannot search user: %v", err)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("invalid user or password")
+	}
+	if len(res) > 1 {
+		return nil, fmt.Errorf("LDAP: several entries match user %s", login)
+	}
+	return &res[0], nil
+}
+
+// groupsRole returns the highest role granted by groups (DN or name of
+// group, ie. value of first RDN)
+func (l *LDAP) groupsRole(groups []string) string {
+	role := ""
+	for _, g := range groups {
+		g = strings.ToLower(g)
+		r, exist := l.groupRoles[g]
+		if !exist {
+			rdn := strings.SplitN(g, ",", 2)[0]
+			if eq := strings.IndexByte(rdn, '='); eq >= 0 {
+				r, exist = l.groupRoles[strings.TrimSpace(rdn[eq+1:])]
+			}
+		}
+		if exist && roleLevels[r] > roleLevels[role] {
+			role = r
+		}
+	}
+	return role
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const matrixMaxHistory = 20  // Number of finished matrix builds kept in memory
+const matrixMaxParallel = 16 // Maximum number of concurrent runs of a matrix
+
+// Matrices Execute a command against several SDKs and consolidate results
+type Matrices struct {
+	*Context
+	matrices []*xsapiv1.Matrix // oldest first
+	mutex    sync.Mutex
+}
+
+// NewMatrices creates a new instance of Matrices
+func NewMatrices(ctx *Context) *Matrices {
+	return &Matrices{
+		Context:  ctx,
+		matrices: []*xsapiv1.Matrix{},
+		mutex:    sync.NewMutex(),
+	}
+}
+
+// Start starts the execution of a command with every SDK, output of each run
+// is sent using exec events tagged with the run channel
+func (m *Matrices) Start(args xsapiv1.MatrixArgs, sid string) (*xsapiv1.Matrix, error) {
+	if strings.TrimSpace(args.Cmd) == "" {
+		return nil, fmt.Errorf("command not set")
+	}
+	if len(args.SdkIDs) == 0 {
+		return nil, fmt.Errorf("no sdk set")
+	}
+	if args.TimeoutS < 0 || args.Parallel < 0 || args.Parallel > matrixMaxParallel {
+		return nil, fmt.Errorf("invalid timeout or parallel value (max %d)", matrixMaxParallel)
+	}
+	f := m.mfolders.Get(args.FolderID)
+	if f == nil {
+		return nil, fmt.Errorf("unknown folder")
+	}
+	if !m.mfolders.HasAccess(args.FolderID, sid, xsapiv1.FolderAccessReadWrite) {
+		return nil, fmt.Errorf("permission denied on folder")
+	}
+
+	mx := xsapiv1.Matrix{
+		ID:        uuid.NewV1().String(),
+		FolderID:  args.FolderID,
+		Cmd:       args.Cmd,
+		Status:    xsapiv1.BuildStatusRunning,
+		Runs:      []xsapiv1.MatrixRun{},
+		StartedBy: sid,
+		StartedAt: time.Now().String(),
+	}
+	channels := make(map[string]bool)
+	for i, sdkArg := range args.SdkIDs {
+		id, err := m.sdks.ResolveID(sdkArg)
+		if err != nil {
+			return nil, err
+		}
+		sdk := m.sdks.Get(id)
+		if sdk == nil || sdk.Status != xsapiv1.SdkStatusInstalled {
+			return nil, fmt.Errorf("sdk %s not installed", sdkArg)
+		}
+		// Channel is the SDK name, unless several SDKs have the same name
+		channel := sdk.Name
+		if channels[channel] {
+			channel += "@" + sdk.ID[:8]
+		}
+		if channels[channel] {
+			return nil, fmt.Errorf("sdk %s set twice", sdkArg)
+		}
+		channels[channel] = true
+
+		mx.Runs = append(mx.Runs, xsapiv1.MatrixRun{
+			SdkID:   sdk.ID,
+			SdkName: sdk.Name,
+			Channel: channel,
+			CmdID:   "matrix_" + mx.ID[:8] + "_" + strconv.Itoa(i),
+			Status:  xsapiv1.BuildStatusPending,
+		})
+	}
+
+	m.mutex.Lock()
+	m.matrices = append(m.matrices, &mx)
+	m.cleanupUnsafe()
+	res := copyMatrix(&mx)
+	m.mutex.Unlock()
+
+	m.Log.Infof("Start matrix %s of folder %s (%d sdks): %s", mx.ID, mx.FolderID, len(mx.Runs), mx.Cmd)
+	go m.run(&mx, args, sid)
+
+	return res, nil
+}
+
+// Get returns a matrix
+func (m *Matrices) Get(id string) (*xsapiv1.Matrix, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, mx := range m.matrices {
+		if mx.ID == id {
+			return copyMatrix(mx), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown id")
+}
+
+// GetAll returns running and last finished matrices
+func (m *Matrices) GetAll() []xsapiv1.Matrix {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	res := []xsapiv1.Matrix{}
+	for _, mx := range m.matrices {
+		res = append(res, *copyMatrix(mx))
+	}
+	return res
+}
+
+/*** Private functions ***/
+
+// run executes runs (at most args.Parallel at the same time) and
+// consolidates results
+func (m *Matrices) run(mx *xsapiv1.Matrix, args xsapiv1.MatrixArgs, sid string) {
+	parallel := args.Parallel
+	if parallel == 0 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+	done := make(chan struct{}, len(mx.Runs))
+
+	for i := range mx.Runs {
+		slots <- struct{}{}
+		if args.FailFast && m.hasFailed(mx) {
+			<-slots
+			m.setRun(mx, i, xsapiv1.BuildStatusSkipped, 0, nil, 0)
+			done <- struct{}{}
+			continue
+		}
+		go func(idx int) {
+			defer func() {
+				<-slots
+				done <- struct{}{}
+			}()
+			start := time.Now()
+			m.setRun(mx, idx, xsapiv1.BuildStatusRunning, 0, nil, 0)
+			code, err := m.runOne(mx, idx, args, sid)
+			status := xsapiv1.BuildStatusDone
+			if err == nil && code != 0 {
+				err = fmt.Errorf("exit code %d", code)
+			}
+			if err != nil {
+				status = xsapiv1.BuildStatusFailed
+			}
+			m.setRun(mx, idx, status, code, err, time.Since(start))
+		}(i)
+	}
+	for range mx.Runs {
+		<-done
+	}
+
+	m.mutex.Lock()
+	mx.Status = xsapiv1.BuildStatusDone
+	if mx.Failed > 0 {
+		mx.Status = xsapiv1.BuildStatusFailed
+	}
+	mx.EndedAt = time.Now().String()
+	m.mutex.Unlock()
+
+	m.Log.Infof("Matrix %s of folder %s %s: %d passed, %d failed, %d skipped",
+		mx.ID, mx.FolderID, mx.Status, mx.Passed, mx.Failed, mx.Skipped)
+	m.notify(mx)
+}
+
+// runOne executes the command with one SDK
+func (m *Matrices) runOne(mx *xsapiv1.Matrix, idx int, args xsapiv1.MatrixArgs, sid string) (int, error) {
+	fld := m.mfolders.Get(mx.FolderID)
+	if fld == nil {
+		return -1, fmt.Errorf("unknown folder %s", mx.FolderID)
+	}
+	fc := (*fld).GetConfig()
+	if m.folderWatch.IsQuotaExceeded(fc.ID) {
+		return -1, fmt.Errorf("folder disk quota exceeded")
+	}
+	if m.folderCrypt.IsLocked(fc) {
+		return -1, fmt.Errorf("folder is locked")
+	}
+
+	m.mutex.Lock()
+	run := mx.Runs[idx]
+	m.mutex.Unlock()
+
+	cmdLine, err := m.autoBuild.folderCommand(fc, (*fld).GetFullPath(""), run.SdkID, args.RPath, args.Cmd)
+	if err != nil {
+		return -1, err
+	}
+	if err := m.mfolders.ExecAcquire(fc.ID, sid, run.CmdID); err != nil {
+		return -1, err
+	}
+	defer m.mfolders.ExecRelease(fc.ID, run.CmdID)
+
+	// SDK is exported so that concurrent runs can use different build directories
+	env := []string{"XDS_MATRIX_ID=" + mx.ID, "XDS_SDK_ID=" + run.SdkID, "XDS_SDK_NAME=" + run.SdkName}
+	env = append(env, m.mfolders.DependenciesEnv(fc.ID)...)
+	env = append(env, m.ccache.Env(fc.ID, run.SdkID)...)
+	return m.autoBuild.runCommand(fc, run.CmdID, run.Channel, cmdLine, env, args.TimeoutS)
+}
+
+// hasFailed returns true when a run of matrix failed
+func (m *Matrices) hasFailed(mx *xsapiv1.Matrix) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return mx.Failed > 0
+}
+
+// setRun updates status of a run and notifies it
+func (m *Matrices) setRun(mx *xsapiv1.Matrix, idx int, status string, code int, err error, duration time.Duration) {
+	m.mutex.Lock()
+	r := &mx.Runs[idx]
+	r.Status = status
+	r.ExitCode = code
+	r.DurationMs = int64(duration / time.Millisecond)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	switch status {
+	case xsapiv1.BuildStatusDone:
+		mx.Passed++
+	case xsapiv1.BuildStatusFailed:
+		mx.Failed++
+	case xsapiv1.BuildStatusSkipped:
+		mx.Skipped++
+	}
+	m.mutex.Unlock()
+	m.notify(mx)
+}
+
+// notify emits matrix status event
+func (m *Matrices) notify(mx *xsapiv1.Matrix) {
+	m.mutex.Lock()
+	msg := *copyMatrix(mx)
+	m.mutex.Unlock()
+	if err := m.events.Emit(xsapiv1.EVTMatrix, msg, ""); err != nil {
+		m.LogSillyf("Cannot notify matrix %s: %v", mx.ID, err)
+	}
+}
+
+// cleanupUnsafe forgets oldest finished matrices (mutex must be locked)
+func (m *Matrices) cleanupUnsafe() {
+	for i := 0; len(m.matrices) > matrixMaxHistory && i < len(m.matrices); {
+		if m.matrices[i].Status == xsapiv1.BuildStatusRunning {
+			i++
+			continue
+		}
+		m.matrices = append(m.matrices[:i], m.matrices[i+1:]...)
+	}
+}
+
+// copyMatrix returns a deep copy of a matrix
+func copyMatrix(mx *xsapiv1.Matrix) *xsapiv1.Matrix {
+	res := *mx
+	res.Runs = append([]xsapiv1.MatrixRun{}, mx.Runs...)
+	return &res
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Minimal MQTT 3.1.1 client: connection and publication (QoS 0 or 1) only
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+const mqttMaxPacketSize = 256 * 1024
+
+// mqttConnackErrors Reason of connection refusal (CONNACK return code)
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttConn Connection to a MQTT broker
+type mqttConn struct {
+	conn     net.Conn
+	rd       *bufio.Reader
+	packetID uint16
+	timeout  time.Duration
+}
+
+// mqttDial connects to a MQTT broker (tcp:// or ssl:// URL) and sends
+// CONNECT packet
+func mqttDial(rawURL string, tlsCfg *tls.Config, timeout time.Duration, clientID, user, password string, keepAlive time.Duration) (*mqttConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT URL: %v", err)
+	}
+	secure := false
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		secure = true
+	default:
+		return nil, fmt.Errorf("invalid MQTT URL scheme '%s'", u.Scheme)
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host = net.JoinHostPort(host, "8883")
+		} else {
+			host = net.JoinHostPort(host, "1883")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsCfg)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mqttConn{conn: conn, rd: bufio.NewReader(conn), timeout: timeout}
+	if err := m.connect(clientID, user, password, keepAlive); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// close sends DISCONNECT packet and closes connection
+func (m *mqttConn) close() {
+	m.write(mqttDisconnect<<4, nil)
+	m.conn.Close()
+}
+
+// publish sends a message, waits for acknowledgment when qos is 1
+func (m *mqttConn) publish(topic string, payload []byte, qos int, retain bool) error {
+	flags := byte(qos<<1) & 0x06
+	if retain {
+		flags |= 0x01
+	}
+	body := mqttString(topic)
+	var id uint16
+	if qos > 0 {
+		m.packetID++
+		if m.packetID == 0 {
+			m.packetID = 1
+		}
+		id = m.packetID
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+	if err := m.write(mqttPublish<<4|flags, body); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+
+	for {
+		typ, data, err := m.read()
+		if err != nil {
+			return err
+		}
+		if typ == mqttPuback && len(data) >= 2 && binary.BigEndian.Uint16(data) == id {
+			return nil
+		}
+	}
+}
+
+// ping sends PINGREQ packet and waits for response
+func (m *mqttConn) ping() error {
+	if err := m.write(mqttPingreq<<4, nil); err != nil {
+		return err
+	}
+	for {
+		typ, _, err := m.read()
+		if err != nil {
+			return err
+		}
+		if typ == mqttPingresp {
+			return nil
+		}
+	}
+}
+
+/*** Private functions ***/
+
+// connect sends CONNECT packet (clean session) and checks CONNACK
+func (m *mqttConn) connect(clientID, user, password string, keepAlive time.Duration) error {
+	flags := byte(0x02) // clean session
+	payload := mqttString(clientID)
+	if user != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(user)...)
+		if password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(password)...)
+		}
+	}
+	ka := uint16(keepAlive / time.Second)
+	body := append(mqttString("MQTT"), 4, flags, byte(ka>>8), byte(ka))
+	body = append(body, payload...)
+	if err := m.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	typ, data, err := m.read()
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(data) < 2 {
+		return fmt.Errorf("unexpected MQTT connect response")
+	}
+	if data[1] != 0 {
+		if msg, ok := mqttConnackErrors[data[1]]; ok {
+			return fmt.Errorf("MQTT connection refused: %s", msg)
+		}
+		return fmt.Errorf("MQTT connection refused (code %d)", data[1])
+	}
+	return nil
+}
+
+// write sends a control packet
+func (m *mqttConn) write(header byte, body []byte) error {
+	pkt := []byte{header}
+	l := len(body)
+	for {
+		b := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if l == 0 {
+			break
+		}
+	}
+	pkt = append(pkt, body...)
+	m.conn.SetDeadline(time.Now().Add(m.timeout))
+	_, err := m.conn.Write(pkt)
+	return err
+}
+
+// read returns type and content of next control packet
+func (m *mqttConn) read() (byte, []byte, error) {
+	m.conn.SetDeadline(time.Now().Add(m.timeout))
+	header, err := m.rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := m.rd.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		l += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i >= 3 {
+			return 0, nil, fmt.Errorf("invalid MQTT packet length")
+		}
+		mult *= 128
+	}
+	if l > mqttMaxPacketSize {
+		return 0, nil, fmt.Errorf("MQTT packet too large (%d bytes)", l)
+	}
+	data := make([]byte, l)
+	if _, err := io.ReadFull(m.rd, data); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, data, nil
+}
+
+// mqttString encodes an UTF-8 string (length prefixed)
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mqttTestConn returns a client reading data as broker replies, the returned
+// function closes connection and returns what client sent
+func mqttTestConn(data []byte) (*mqttConn, func() []byte) {
+	cli, srv := net.Pipe()
+	sent := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		sent <- b
+	}()
+	m := &mqttConn{conn: cli, rd: bufio.NewReader(bytes.NewReader(data)), timeout: 5 * time.Second}
+	return m, func() []byte {
+		cli.Close()
+		return <-sent
+	}
+}
+
+func mqttHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestMqttWrite(t *testing.T) {
+	tests := []struct {
+		size   int
+		header string // hex of fixed header
+	}{
+		{0, "3000"},
+		{1, "3001"},
+		{127, "307f"},
+		{128, "308001"},
+		{16383, "30ff7f"},
+		{16384, "30808001"},
+		{2097152, "3080808001"},
+	}
+	for _, tt := range tests {
+		m, done := mqttTestConn(nil)
+		body := bytes.Repeat([]byte{'x'}, tt.size)
+		if err := m.write(mqttPublish<<4, body); err != nil {
+			t.Errorf("size %d: unexpected error: %v", tt.size, err)
+		}
+		sent := done()
+		want := append(mqttHex(tt.header), body...)
+		if !bytes.Equal(sent, want) {
+			t.Errorf("size %d: got header %x, want %s", tt.size, sent[:len(sent)-tt.size], tt.header)
+		}
+	}
+}
+
+func TestMqttRead(t *testing.T) {
+	tests := []struct {
+		name string
+		data string // hex
+		typ  byte
+		size int // -1 when an error is expected
+	}{
+		{"empty packet", "d000", mqttPingresp, 0},
+		{"short length", "20020000", mqttConnack, 2},
+		{"long length", "30800100" + strings.Repeat("00", 127), mqttPublish, 128},
+		{"ignore trailing data", "d000d000", mqttPingresp, 0},
+
+		{"no packet", "", 0, -1},
+		{"missing length", "20", 0, -1},
+		{"truncated length", "2080", 0, -1},
+		{"length too long", "20ffffffff7f", 0, -1},
+		{"packet too large", "30ffff7f", 0, -1},
+		{"truncated content", "200200", 0, -1},
+	}
+	for _, tt := range tests {
+		m, done := mqttTestConn(mqttHex(tt.data))
+		typ, data, err := m.read()
+		done()
+		if tt.size < 0 {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if typ != tt.typ || len(data) != tt.size {
+			t.Errorf("%s: got type %d size %d, want type %d size %d", tt.name, typ, len(data), tt.typ, tt.size)
+		}
+	}
+}
+
+func TestMqttConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		reply    string // hex
+		sent     string // hex of sent CONNECT packet
+		err      string // expected error, empty on success
+	}{
+		{"anonymous", "", "", "20020000",
+			"10100004" + hex.EncodeToString([]byte("MQTT")) + "0402003c" + "0004" + hex.EncodeToString([]byte("xds1")), ""},
+		{"user", "u", "", "20020000",
+			"10130004" + hex.EncodeToString([]byte("MQTT")) + "0482003c" + "0004" + hex.EncodeToString([]byte("xds1")) + "000175", ""},
+		{"user and password", "u", "p", "20020000",
+			"10160004" + hex.EncodeToString([]byte("MQTT")) + "04c2003c" + "0004" + hex.EncodeToString([]byte("xds1")) + "000175" + "000170", ""},
+
+		{"refused", "u", "p", "20020004", "", "bad user name or password"},
+		{"refused unknown code", "", "", "20020009", "", "code 9"},
+		{"not a connack", "", "", "d000", "", "unexpected MQTT connect response"},
+		{"short connack", "", "", "200100", "", "unexpected MQTT connect response"},
+		{"no reply", "", "", "", "", "EOF"},
+	}
+	for _, tt := range tests {
+		m, done := mqttTestConn(mqttHex(tt.reply))
+		err := m.connect("xds1", tt.user, tt.password, 60*time.Second)
+		sent := done()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got := hex.EncodeToString(sent); got != tt.sent {
+			t.Errorf("%s: sent %s, want %s", tt.name, got, tt.sent)
+		}
+	}
+}
+
+func TestMqttPublish(t *testing.T) {
+	topic := "0003" + hex.EncodeToString([]byte("x/y"))
+	tests := []struct {
+		name   string
+		qos    int
+		retain bool
+		reply  string // hex
+		sent   string // hex of sent PUBLISH packet, empty when an error is expected
+	}{
+		{"qos 0", 0, false, "", "3007" + topic + "6869"},
+		{"qos 0 retained", 0, true, "", "3107" + topic + "6869"},
+		{"qos 1", 1, false, "40020001", "3209" + topic + "0001" + "6869"},
+		{"qos 1 retained", 1, true, "40020001", "3309" + topic + "0001" + "6869"},
+		{"qos 1 other packets ignored", 1, false, "d000" + "40020002" + "400100" + "40020001", "3209" + topic + "0001" + "6869"},
+
+		{"qos 1 no acknowledgment", 1, false, "", ""},
+		{"qos 1 wrong acknowledgment", 1, false, "40020002", ""},
+		{"qos 1 truncated acknowledgment", 1, false, "400200", ""},
+	}
+	for _, tt := range tests {
+		m, done := mqttTestConn(mqttHex(tt.reply))
+		err := m.publish("x/y", []byte("hi"), tt.qos, tt.retain)
+		sent := done()
+		if tt.sent == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got := hex.EncodeToString(sent); got != tt.sent {
+			t.Errorf("%s: sent %s, want %s", tt.name, got, tt.sent)
+		}
+	}
+}
+
+func TestMqttPacketID(t *testing.T) {
+	m, done := mqttTestConn(mqttHex("40020001"))
+	defer done()
+	m.packetID = 0xffff
+	if err := m.publish("x/y", nil, 1, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.packetID != 1 {
+		t.Errorf("got packet ID %d, want 1 (0 is reserved)", m.packetID)
+	}
+}
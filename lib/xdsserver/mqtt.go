@@ -0,0 +1,306 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const mqttDefaultTimeout = 10   // Default timeout (in seconds) of broker requests
+const mqttDefaultKeepAlive = 60 // Default keep alive (in seconds) of connection
+const mqttDefaultTopicPrefix = "xds"
+const mqttQueueSize = 1000   // Maximum number of events waiting for publication
+const mqttMaxRetryDelay = 60 // Maximum delay (in seconds) between connection attempts
+
+// Events published when not set in config
+var mqttDefaultEvents = []string{
+	xsapiv1.EVTSDKInstall,
+	xsapiv1.EVTSDKRemove,
+	xsapiv1.EVTSDKStateChange,
+	xsapiv1.EVTFolderStateChange,
+	xsapiv1.EVTExecExit,
+}
+
+var mqttTopicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// MQTTBridge Publication of events on a MQTT broker
+type MQTTBridge struct {
+	*Context
+	cfg       *xdsconfig.MQTTConf
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	keepAlive time.Duration
+	clientID  string
+	prefix    string
+	events    map[string]bool
+	queue     chan mqttMessage
+	retry     *mqttMessage // message which publication failed (sent on reconnection)
+	status    xsapiv1.MQTTStatus
+	mutex     sync.Mutex
+	stop      chan struct{} // signals intentional stop
+}
+
+// mqttMessage Event waiting for publication
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// NewMQTTBridge creates a new instance of MQTTBridge (nil when no broker is
+// configured)
+func NewMQTTBridge(ctx *Context) (*MQTTBridge, error) {
+	cfg := ctx.Config.FileConf.MQTTConf
+	if cfg == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || cfg.URL == "" {
+		return nil, fmt.Errorf("MQTT: invalid url")
+	}
+	if cfg.QoS < 0 || cfg.QoS > 1 {
+		return nil, fmt.Errorf("MQTT: unsupported QoS %d (0 or 1 expected)", cfg.QoS)
+	}
+
+	b := MQTTBridge{
+		Context:   ctx,
+		cfg:       cfg,
+		timeout:   mqttDefaultTimeout * time.Second,
+		keepAlive: mqttDefaultKeepAlive * time.Second,
+		clientID:  cfg.ClientID,
+		prefix:    strings.TrimSuffix(cfg.TopicPrefix, "/"),
+		events:    make(map[string]bool),
+		queue:     make(chan mqttMessage, mqttQueueSize),
+		status:    xsapiv1.MQTTStatus{Enabled: true, Broker: u.Host},
+		mutex:     sync.NewMutex(),
+		stop:      make(chan struct{}),
+	}
+	if cfg.TimeoutS > 0 {
+		b.timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	if cfg.KeepAliveS > 0 {
+		b.keepAlive = time.Duration(cfg.KeepAliveS) * time.Second
+	}
+	if b.clientID == "" {
+		host, _ := os.Hostname()
+		b.clientID = "xds-server-" + host
+	}
+	if b.prefix == "" {
+		b.prefix = mqttDefaultTopicPrefix
+	}
+
+	evs := cfg.Events
+	if len(evs) == 0 {
+		evs = mqttDefaultEvents
+	}
+	for _, ev := range evs {
+		if _, ok := ctx.events.eventsMap[ev]; !ok {
+			return nil, fmt.Errorf("MQTT: unsupported event type name '%s'", ev)
+		}
+		b.events[ev] = true
+	}
+	for ev := range cfg.Topics {
+		if _, ok := ctx.events.eventsMap[ev]; !ok {
+			return nil, fmt.Errorf("MQTT: topic of unsupported event type name '%s'", ev)
+		}
+	}
+
+	b.tlsConfig = &tls.Config{
+		ServerName:         u.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("MQTT: cannot read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("MQTT: no certificate found in %s", cfg.CAFile)
+		}
+		b.tlsConfig.RootCAs = pool
+	}
+
+	ctx.Log.Infof("MQTT: publish events on %s (topic prefix %s)", u.Host, b.prefix)
+	return &b, nil
+}
+
+// Start connection to broker and publication of events
+func (b *MQTTBridge) Start() {
+	go b.run()
+}
+
+// Stop publication of events
+func (b *MQTTBridge) Stop() {
+	close(b.stop)
+}
+
+// GetStatus returns state of connection to broker
+func (b *MQTTBridge) GetStatus() xsapiv1.MQTTStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.status
+}
+
+// Publish queues publication of an event (dropped when queue is full)
+func (b *MQTTBridge) Publish(msg xsapiv1.EventMsg) {
+	if !b.events[msg.Type] {
+		return
+	}
+	payload, err := json.Marshal(msg.External())
+	if err != nil {
+		b.Log.Errorf("MQTT: cannot encode event %s: %v", msg.Type, err)
+		return
+	}
+	select {
+	case b.queue <- mqttMessage{topic: b.topic(msg), payload: payload}:
+	default:
+		b.mutex.Lock()
+		b.status.Dropped++
+		b.mutex.Unlock()
+	}
+}
+
+/*** Private functions ***/
+
+// topic returns topic of an event, {folderID}, {sdkID} and {cmdID} of topic
+// set in config are replaced by IDs the event refers to
+func (b *MQTTBridge) topic(msg xsapiv1.EventMsg) string {
+	t, exist := b.cfg.Topics[msg.Type]
+	if !exist || t == "" {
+		return b.prefix + "/" + strings.TrimPrefix(msg.Type, xsapiv1.EventTypePrefix)
+	}
+	if strings.Contains(t, "{folderID}") {
+		t = strings.Replace(t, "{folderID}", mqttTopicLevel(eventFolderID(msg.Data)), -1)
+	}
+	if strings.Contains(t, "{sdkID}") {
+		ids := eventSdkIDs(msg.Data)
+		t = strings.Replace(t, "{sdkID}", mqttTopicLevel(append(ids, "")[0]), -1)
+	}
+	if strings.Contains(t, "{cmdID}") {
+		ids := eventCmdIDs(msg.Data)
+		t = strings.Replace(t, "{cmdID}", mqttTopicLevel(append(ids, "")[0]), -1)
+	}
+	return t
+}
+
+// mqttTopicLevel returns an ID usable as topic level (no separator or wildcard)
+func mqttTopicLevel(id string) string {
+	if id == "" {
+		return "none"
+	}
+	return mqttTopicReplacer.Replace(id)
+}
+
+// run connects to broker (reconnects on error) and publishes queued events
+func (b *MQTTBridge) run() {
+	delay := time.Second
+	for {
+		conn, err := b.connect()
+		if err == nil {
+			delay = time.Second
+			b.setState(true, nil)
+			b.Log.Infof("MQTT: connected to %s", b.status.Broker)
+			err = b.publishLoop(conn)
+			conn.close()
+			if err == nil {
+				// Stopped
+				return
+			}
+		}
+		b.setState(false, err)
+		b.Log.Warningf("Cannot publish events on MQTT broker %s: %v (retry in %v)", b.status.Broker, err, delay)
+
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > mqttMaxRetryDelay*time.Second {
+			delay = mqttMaxRetryDelay * time.Second
+		}
+	}
+}
+
+// connect opens connection to broker
+func (b *MQTTBridge) connect() (*mqttConn, error) {
+	password := ""
+	if b.cfg.Secret != "" {
+		var err error
+		if password, err = b.secrets.Get(b.cfg.Secret); err != nil {
+			return nil, err
+		}
+	}
+	return mqttDial(b.cfg.URL, b.tlsConfig, b.timeout, b.clientID, b.cfg.User, password, b.keepAlive)
+}
+
+// publishLoop publishes events until stop (nil returned) or an error
+func (b *MQTTBridge) publishLoop(conn *mqttConn) error {
+	ping := time.NewTicker(b.keepAlive / 2)
+	defer ping.Stop()
+
+	for {
+		msg := b.retry
+		if msg == nil {
+			select {
+			case <-b.stop:
+				return nil
+			case <-ping.C:
+				if err := conn.ping(); err != nil {
+					return err
+				}
+				continue
+			case m := <-b.queue:
+				msg = &m
+			}
+		}
+		if err := conn.publish(msg.topic, msg.payload, b.cfg.QoS, b.cfg.Retain); err != nil {
+			b.retry = msg
+			return err
+		}
+		b.retry = nil
+		b.mutex.Lock()
+		b.status.Published++
+		b.mutex.Unlock()
+	}
+}
+
+// setState updates state of connection
+func (b *MQTTBridge) setState(connected bool, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.status.Connected = connected
+	if connected {
+		b.status.ConnectedAt = time.Now().String()
+	}
+	if err != nil {
+		b.status.LastError = err.Error()
+	}
+}
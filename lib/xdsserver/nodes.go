@@ -0,0 +1,611 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const nodeTokenHeaderName = "XDS-Node-Token"
+
+const nodesHeartbeatTime = 30        // Time (in seconds) between two registrations of a node
+const nodesExpireTime = 90           // Node is offline when no heartbeat has been received during this time
+const nodesDialTimeout = 10          // Timeout (in seconds) of connections between primary and nodes
+const nodeExecDefaultTimeout = 86400 // Default timeout (in seconds) of dispatched commands
+const nodeExecReadSize = 4096
+
+// builderNode Hold a node registered on primary server
+type builderNode struct {
+	node     xsapiv1.BuilderNode
+	lastSeen time.Time
+	inflight int // commands dispatched by this server and not exited
+}
+
+// nodeCmd Hold a command dispatched on a node (response stream of node)
+type nodeCmd struct {
+	node string
+	body io.Closer
+}
+
+// NodeOutputCB Function called when a dispatched command sent output
+type NodeOutputCB func(stdout, stderr string)
+
+// NodeExitCB Function called when a dispatched command exited
+type NodeExitCB func(code int, err error)
+
+// Nodes Builder nodes: registry and dispatch of commands (primary server),
+// registration and execution of dispatched commands (node)
+type Nodes struct {
+	*Context
+	conf     xdsconfig.NodesConf
+	client   *http.Client
+	nodes    map[string]*builderNode
+	remote   map[string]*nodeCmd // commands dispatched on nodes (key: cmdID)
+	executed map[string]bool     // commands executed for primary (key: cmdID)
+	mutex    sync.Mutex
+	stop     chan struct{} // signals intentional stop
+}
+
+// NewNodes creates a new instance of Nodes
+func NewNodes(ctx *Context) *Nodes {
+	n := Nodes{
+		Context: ctx,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  (&net.Dialer{Timeout: nodesDialTimeout * time.Second}).Dial,
+				ResponseHeaderTimeout: nodesDialTimeout * time.Second,
+			},
+		},
+		nodes:    make(map[string]*builderNode),
+		remote:   make(map[string]*nodeCmd),
+		executed: make(map[string]bool),
+		mutex:    sync.NewMutex(),
+		stop:     make(chan struct{}),
+	}
+	if cfg := ctx.Config.FileConf.NodesConf; cfg != nil {
+		n.conf = *cfg
+	}
+	if n.conf.Capacity <= 0 {
+		n.conf.Capacity = runtime.NumCPU()
+	}
+	return &n
+}
+
+// Start starts registration loop when server is a node of a primary server
+func (n *Nodes) Start() error {
+	if n.conf.Primary == "" {
+		return nil
+	}
+	if n.conf.Token == "" {
+		return fmt.Errorf("builder node disabled: token not set")
+	}
+	if n.conf.Name == "" {
+		n.conf.Name, _ = os.Hostname()
+	}
+	if n.conf.URL == "" {
+		n.conf.URL = "http://" + n.conf.Name + ":" + n.Config.FileConf.HTTPPort + "/api/v1"
+	}
+	n.Log.Infof("Register as builder node %s (%s) on %s", n.conf.Name, n.conf.URL, n.conf.Primary)
+	go n.registerLoop()
+	return nil
+}
+
+// Stop stops registration loop and closes streams of dispatched commands
+func (n *Nodes) Stop() {
+	close(n.stop)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, rc := range n.remote {
+		rc.body.Close()
+	}
+}
+
+// CheckToken checks token sent by a node or by primary server
+func (n *Nodes) CheckToken(token string) error {
+	if n.conf.Token == "" {
+		return fmt.Errorf("builder nodes not enabled")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(n.conf.Token)) != 1 {
+		return fmt.Errorf("invalid node token")
+	}
+	return nil
+}
+
+// Register adds or refreshes a node (called on node heartbeat)
+func (n *Nodes) Register(args xsapiv1.NodeRegisterArgs) xsapiv1.BuilderNode {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	bn, exist := n.nodes[args.Name]
+	if !exist {
+		n.Log.Infof("New builder node %s (%s)", args.Name, args.URL)
+		bn = &builderNode{}
+		n.nodes[args.Name] = bn
+	}
+	bn.lastSeen = time.Now()
+	bn.node = xsapiv1.BuilderNode{
+		Name:      args.Name,
+		URL:       strings.TrimSuffix(args.URL, "/"),
+		SdkIDs:    args.SdkIDs,
+		FolderIDs: args.FolderIDs,
+		Capacity:  args.Capacity,
+		Running:   args.Running,
+	}
+	if bn.node.Capacity <= 0 {
+		bn.node.Capacity = 1
+	}
+	return n.nodeGet(bn)
+}
+
+// GetAll returns all registered nodes
+func (n *Nodes) GetAll() []xsapiv1.BuilderNode {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	res := []xsapiv1.BuilderNode{}
+	for _, bn := range n.nodes {
+		res = append(res, n.nodeGet(bn))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Delete removes a node (it is added again on next heartbeat)
+func (n *Nodes) Delete(name string) (xsapiv1.BuilderNode, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	bn, exist := n.nodes[name]
+	if !exist {
+		return xsapiv1.BuilderNode{}, fmt.Errorf("unknown node")
+	}
+	delete(n.nodes, name)
+	return n.nodeGet(bn), nil
+}
+
+// Select returns the node that executes a command of a folder using an SDK
+// (nil: local execution): least loaded online node that has the SDK and a
+// synchronized copy of the folder, unless a node name is requested.
+// dispatchable is false when command options require a local execution
+func (n *Nodes) Select(name, folderID, sdkID string, dispatchable bool) (*xsapiv1.BuilderNode, error) {
+	if name == xsapiv1.ExecNodeLocal {
+		return nil, nil
+	}
+	if name == xsapiv1.ExecNodeAuto && (n.conf.Disabled || !dispatchable) {
+		return nil, nil
+	}
+	if !dispatchable {
+		return nil, fmt.Errorf("stdin, pty, tty, container, steps and artifacts options cannot be used on builder nodes")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if name != xsapiv1.ExecNodeAuto {
+		bn, exist := n.nodes[name]
+		if !exist {
+			return nil, fmt.Errorf("unknown node")
+		}
+		if err := n.fits(bn, folderID, sdkID); err != nil {
+			return nil, fmt.Errorf("node %s: %v", name, err)
+		}
+		res := n.nodeGet(bn)
+		return &res, nil
+	}
+
+	var best *builderNode
+	for _, bn := range n.nodes {
+		if n.fits(bn, folderID, sdkID) != nil || n.load(bn) >= bn.node.Capacity {
+			continue
+		}
+		if best == nil || n.load(bn)*best.node.Capacity < n.load(best)*bn.node.Capacity {
+			best = bn
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	res := n.nodeGet(best)
+	return &res, nil
+}
+
+// Exec dispatches a command on a node, output is sent using outCB and
+// exitCB is called once command exited (or connection with node is lost)
+func (n *Nodes) Exec(nodeName string, args xsapiv1.NodeExecArgs, outCB NodeOutputCB, exitCB NodeExitCB) error {
+	n.mutex.Lock()
+	bn, exist := n.nodes[nodeName]
+	if !exist {
+		n.mutex.Unlock()
+		return fmt.Errorf("unknown node %s", nodeName)
+	}
+	url := bn.node.URL
+	n.mutex.Unlock()
+
+	resp, err := n.post(url+"/executor/exec", args)
+	if err != nil {
+		return fmt.Errorf("node %s: %v", nodeName, err)
+	}
+
+	n.mutex.Lock()
+	if bn, exist := n.nodes[nodeName]; exist {
+		bn.inflight++
+	}
+	n.remote[args.CmdID] = &nodeCmd{node: nodeName, body: resp.Body}
+	n.mutex.Unlock()
+
+	n.Log.Infof("Command %s dispatched on node %s", args.CmdID, nodeName)
+	go n.readStream(nodeName, args.CmdID, resp.Body, outCB, exitCB)
+	return nil
+}
+
+// IsRemote returns true when a command is executed on a node
+func (n *Nodes) IsRemote(cmdID string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, exist := n.remote[cmdID]
+	return exist
+}
+
+// Signal sends a signal to a command executed on a node (to all its
+// processes when group is set)
+func (n *Nodes) Signal(cmdID, sigName string, group bool) error {
+	n.mutex.Lock()
+	rc, exist := n.remote[cmdID]
+	url := ""
+	if exist {
+		if bn, ok := n.nodes[rc.node]; ok {
+			url = bn.node.URL
+		}
+	}
+	n.mutex.Unlock()
+
+	if !exist {
+		return fmt.Errorf("unknown cmdID")
+	}
+	if url == "" {
+		return fmt.Errorf("unknown node %s", rc.node)
+	}
+	resp, err := n.post(url+"/executor/signal", xsapiv1.NodeSignalArgs{CmdID: cmdID, Signal: sigName, Group: group})
+	if err != nil {
+		return fmt.Errorf("node %s: %v", rc.node, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Execute runs a command dispatched by primary server (node side), messages
+// are sent on out channel (closed once command exited), command is cancelled
+// when cancel channel is closed
+func (n *Nodes) Execute(args xsapiv1.NodeExecArgs, out chan<- xsapiv1.NodeExecMsg, cancel <-chan bool) {
+	defer close(out)
+
+	code, err := n.execute(args, out, cancel)
+	msg := xsapiv1.NodeExecMsg{Exited: true, Code: code}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	out <- msg
+}
+
+// SignalLocal sends a signal to a command executed for primary server (node side)
+func (n *Nodes) SignalLocal(cmdID, sigName string, group bool) error {
+	n.mutex.Lock()
+	exist := n.executed[cmdID]
+	n.mutex.Unlock()
+	if !exist {
+		return fmt.Errorf("unknown cmdID")
+	}
+	sig, err := parseSignal(sigName)
+	if err != nil {
+		return err
+	}
+	return execSignal(cmdID, sig, group)
+}
+
+/*** Private functions ***/
+
+// nodeGet returns node definition with its current status (mutex must be locked)
+func (n *Nodes) nodeGet(bn *builderNode) xsapiv1.BuilderNode {
+	res := bn.node
+	res.Running = n.load(bn)
+	res.LastSeen = bn.lastSeen.String()
+	res.Status = xsapiv1.NodeStatusOnline
+	if time.Since(bn.lastSeen) > nodesExpireTime*time.Second {
+		res.Status = xsapiv1.NodeStatusOffline
+	}
+	return res
+}
+
+// load returns the number of commands running on a node: commands dispatched
+// since last heartbeat are not yet counted by node
+func (n *Nodes) load(bn *builderNode) int {
+	if bn.inflight > bn.node.Running {
+		return bn.inflight
+	}
+	return bn.node.Running
+}
+
+// fits checks that a node can execute a command (mutex must be locked)
+func (n *Nodes) fits(bn *builderNode, folderID, sdkID string) error {
+	if time.Since(bn.lastSeen) > nodesExpireTime*time.Second {
+		return fmt.Errorf("offline")
+	}
+	if !stringInList(folderID, bn.node.FolderIDs) {
+		return fmt.Errorf("folder not synchronized")
+	}
+	if sdkID != "" && !stringInList(sdkID, bn.node.SdkIDs) {
+		return fmt.Errorf("SDK not installed")
+	}
+	return nil
+}
+
+// post sends a JSON request (authenticated using token) to primary or to a node
+func (n *Nodes) post(url string, data interface{}) (*http.Response, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(nodeTokenHeaderName, n.conf.Token)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s", apiErr.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+// readStream reads messages sent by a node for a dispatched command
+func (n *Nodes) readStream(nodeName, cmdID string, body io.ReadCloser, outCB NodeOutputCB, exitCB NodeExitCB) {
+	defer body.Close()
+
+	code := -1
+	err := fmt.Errorf("connection lost with node %s", nodeName)
+	dec := json.NewDecoder(body)
+	for {
+		var msg xsapiv1.NodeExecMsg
+		if e := dec.Decode(&msg); e != nil {
+			n.Log.Errorf("Command %s: stream of node %s closed: %v", cmdID, nodeName, e)
+			break
+		}
+		if msg.Exited {
+			code, err = msg.Code, nil
+			if msg.Error != "" {
+				err = fmt.Errorf("%s", msg.Error)
+			}
+			break
+		}
+		outCB(msg.Stdout, msg.Stderr)
+	}
+
+	n.mutex.Lock()
+	delete(n.remote, cmdID)
+	if bn, exist := n.nodes[nodeName]; exist && bn.inflight > 0 {
+		bn.inflight--
+	}
+	n.mutex.Unlock()
+
+	exitCB(code, err)
+}
+
+// execute runs a dispatched command and returns its exit code (node side)
+func (n *Nodes) execute(args xsapiv1.NodeExecArgs, out chan<- xsapiv1.NodeExecMsg, cancel <-chan bool) (int, error) {
+	f := n.mfolders.Get(args.FolderID)
+	if f == nil {
+		return -1, fmt.Errorf("unknown folder %s", args.FolderID)
+	}
+	fld := *f
+	fc := fld.GetConfig()
+	if args.NoSdkEnv {
+		fc.DefaultSdk = ""
+	}
+
+	// Translate paths from client to server
+	cmdArgs := []string{}
+	for _, aa := range args.Args {
+		if strings.Contains(aa, fc.ClientPath) {
+			aa = fld.ConvPathCli2Svr(aa)
+		}
+		cmdArgs = append(cmdArgs, aa)
+	}
+	sh, err := n.execShellGet(args.Shell, args.ShellOptions, true)
+	if err != nil {
+		return -1, err
+	}
+	cmdLine, err := n.autoBuild.folderCommand(fc, fld.GetFullPath(""), args.SdkID, args.RPath,
+		sh.command(args.Cmd, cmdArgs))
+	if err != nil {
+		return -1, err
+	}
+	prio, err := n.execPriorityGet(args.Nice, args.IONice)
+	if err != nil {
+		return -1, err
+	}
+
+	cmd := exec.Command("/bin/bash", "-c", prio.shellPrefix()+cmdLine)
+	cmd.Env = append(os.Environ(), args.Env...)
+	cmd.Env = append(cmd.Env, n.mfolders.DependenciesEnv(fc.ID)...)
+	cmd.Env = append(cmd.Env, n.ccache.Env(fc.ID, args.SdkID)...)
+	cmd.Env = append(cmd.Env, n.execServerEnv()...)
+	cmd.Env = append(cmd.Env, n.cancels.EnvMarker(args.CmdID))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return -1, err
+	}
+
+	n.Log.Infof("Execute for primary [Cmd ID %s]: %v", args.CmdID, cmdLine)
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	n.mutex.Lock()
+	n.executed[args.CmdID] = true
+	n.mutex.Unlock()
+	defer func() {
+		n.mutex.Lock()
+		delete(n.executed, args.CmdID)
+		n.mutex.Unlock()
+	}()
+
+	timeout := args.TimeoutS
+	if timeout <= 0 {
+		timeout = nodeExecDefaultTimeout
+	}
+	timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		n.Log.Warningf("Command %s timeout, kill it", args.CmdID)
+		execKill(args.CmdID, syscall.SIGKILL)
+	})
+	defer timer.Stop()
+
+	// Primary closed connection (server stopped or command lost): cancel command
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-cancel:
+			n.Log.Infof("Primary disconnected, cancel command %s", args.CmdID)
+			if err := n.cancels.Cancel(args.CmdID, 0); err != nil {
+				n.Log.Debugf("Cannot cancel command %s: %v", args.CmdID, err)
+			}
+		case <-done:
+		}
+	}()
+
+	outDone := make(chan struct{}, 2)
+	go n.streamOutput(fld, stdout, false, out, outDone)
+	go n.streamOutput(fld, stderr, true, out, outDone)
+	<-outDone
+	<-outDone
+	err = cmd.Wait()
+
+	code := 0
+	if err != nil {
+		code = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(interface{ ExitStatus() int }); ok {
+				code, err = ws.ExitStatus(), nil
+			}
+		}
+	}
+	return code, err
+}
+
+// streamOutput sends output of a dispatched command (node side)
+func (n *Nodes) streamOutput(fld IFOLDER, r io.Reader, isStderr bool, out chan<- xsapiv1.NodeExecMsg, done chan struct{}) {
+	defer func() { done <- struct{}{} }()
+	buf := make([]byte, nodeExecReadSize)
+	for {
+		cnt, err := r.Read(buf)
+		if cnt > 0 {
+			// Translate paths from server to client
+			data := fld.ConvPathSvr2Cli(string(buf[:cnt]))
+			if isStderr {
+				out <- xsapiv1.NodeExecMsg{Stderr: data}
+			} else {
+				out <- xsapiv1.NodeExecMsg{Stdout: data}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// registerLoop registers periodically this server on primary server (node side)
+func (n *Nodes) registerLoop() {
+	for {
+		if err := n.register(); err != nil {
+			n.Log.Warningf("Cannot register node on %s: %v", n.conf.Primary, err)
+		}
+		select {
+		case <-n.stop:
+			n.Log.Debugln("Stop nodes registerLoop")
+			return
+		case <-time.After(nodesHeartbeatTime * time.Second):
+		}
+	}
+}
+
+// register sends SDKs and folders available on this node to primary server
+func (n *Nodes) register() error {
+	args := xsapiv1.NodeRegisterArgs{
+		Name:      n.conf.Name,
+		URL:       n.conf.URL,
+		SdkIDs:    []string{},
+		FolderIDs: []string{},
+		Capacity:  n.conf.Capacity,
+	}
+	for _, sdk := range n.sdks.GetAll() {
+		if sdk.Status == xsapiv1.SdkStatusInstalled {
+			args.SdkIDs = append(args.SdkIDs, sdk.ID)
+		}
+	}
+	for _, fc := range n.mfolders.GetConfigArr() {
+		if fc.Status == xsapiv1.StatusEnable && fc.IsInSync {
+			args.FolderIDs = append(args.FolderIDs, fc.ID)
+		}
+	}
+	n.mutex.Lock()
+	args.Running = len(n.executed)
+	n.mutex.Unlock()
+
+	resp, err := n.post(strings.TrimSuffix(n.conf.Primary, "/")+"/nodes", args)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const oidcStateLifetime = 10 * time.Minute  // Maximum duration of a login
+const oidcJwksRefreshTime = 1 * time.Minute // Minimum time between two refreshes of provider keys
+const oidcClockSkew = 1 * time.Minute       // Tolerated clock difference with provider
+const oidcDefaultUserClaim = "preferred_username"
+
+var oidcDefaultScopes = []string{"openid", "profile", "email"}
+
+// OIDC OpenID Connect authentication (authorization code flow and
+// validation of ID tokens sent as bearer tokens)
+type OIDC struct {
+	*Context
+	conf     xdsconfig.OIDCConf
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey // provider keys indexed by kid
+	keysAt   time.Time
+	states   map[string]oidcState
+	client   *http.Client
+	mutex    sync.Mutex
+}
+
+// oidcProvider Provider metadata (see OpenID Connect Discovery)
+type oidcProvider struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JwksURI       string `json:"jwks_uri"`
+}
+
+// oidcState Login in progress
+type oidcState struct {
+	sid      string
+	nonce    string
+	redirect string
+	expireAt time.Time
+}
+
+// NewOIDC creates a new instance of OIDC (nil when not configured)
+func NewOIDC(ctx *Context) (*OIDC, error) {
+	cfg := ctx.Config.FileConf.OIDCConf
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OpenID Connect: issuer, clientID and redirectURL must be set")
+	}
+	if cfg.ClientSecret != "" && !ctx.secrets.Exists(cfg.ClientSecret) {
+		return nil, fmt.Errorf("OpenID Connect: unknown secret %s", cfg.ClientSecret)
+	}
+
+	o := OIDC{
+		Context: ctx,
+		conf:    *cfg,
+		keys:    make(map[string]*rsa.PublicKey),
+		states:  make(map[string]oidcState),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		mutex:   sync.NewMutex(),
+	}
+	o.conf.Issuer = strings.TrimRight(o.conf.Issuer, "/")
+	if len(o.conf.Scopes) == 0 {
+		o.conf.Scopes = oidcDefaultScopes
+	}
+	if o.conf.UserClaim == "" {
+		o.conf.UserClaim = oidcDefaultUserClaim
+	}
+	ctx.Log.Infof("OpenID Connect authentication using %s (required %v)", o.conf.Issuer, o.conf.Required)
+	return &o, nil
+}
+
+// Required returns true when API requests must be authenticated
+func (o *OIDC) Required() bool {
+	return o.conf.Required
+}
+
+// LoginURL returns the provider URL where client must be redirected to login
+// (redirect is the web app path used once login is completed)
+func (o *OIDC) LoginURL(sid, redirect string) (string, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	p, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	state, err := oidcRandom()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := oidcRandom()
+	if err != nil {
+		return "", err
+	}
+
+	// Cleanup logins that have not been completed
+	now := time.Now()
+	for k, st := range o.states {
+		if now.After(st.expireAt) {
+			delete(o.states, k)
+		}
+	}
+	o.states[state] = oidcState{sid: sid, nonce: nonce, redirect: redirect, expireAt: now.Add(oidcStateLifetime)}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.conf.ClientID)
+	q.Set("redirect_uri", o.conf.RedirectURL)
+	q.Set("scope", strings.Join(o.conf.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(p.AuthEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthEndpoint + sep + q.Encode(), nil
+}
+
+// Callback completes a login: authorization code is exchanged for an ID
+// token, returns the session and web app path passed to LoginURL
+func (o *OIDC) Callback(state, code string) (string, string, *authIdentity, error) {
+	o.mutex.Lock()
+	st, exist := o.states[state]
+	delete(o.states, state)
+	p := o.provider
+	o.mutex.Unlock()
+	if !exist || time.Now().After(st.expireAt) || p == nil {
+		return "", "", nil, fmt.Errorf("invalid or expired login state")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.conf.RedirectURL)
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	secret := ""
+	if o.conf.ClientSecret != "" {
+		if secret, err = o.secrets.Get(o.conf.ClientSecret); err != nil {
+			return "", "", nil, err
+		}
+	}
+	req.SetBasicAuth(url.QueryEscape(o.conf.ClientID), url.QueryEscape(secret))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Cannot retrieve token: %v", err)
+	}
+	defer resp.Body.Close()
+	tok := struct {
+		IDToken   string `json:"id_token"`
+		Error     string `json:"error"`
+		ErrorDesc string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", "", nil, fmt.Errorf("Cannot decode token response: %v", err)
+	}
+	if tok.Error != "" {
+		return "", "", nil, fmt.Errorf("token request rejected: %s %s", tok.Error, tok.ErrorDesc)
+	}
+	if tok.IDToken == "" {
+		return "", "", nil, fmt.Errorf("no ID token returned by provider")
+	}
+
+	ident, err := o.Validate(tok.IDToken, st.nonce)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return st.sid, st.redirect, ident, nil
+}
+
+// Validate checks signature and claims of an ID token and returns identity
+// of user (nonce is only checked when set)
+func (o *OIDC) Validate(raw, nonce string) (*authIdentity, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token format")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := oidcDecodePart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %s", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	o.mutex.Lock()
+	key, err := o.key(header.Kid)
+	issuer := ""
+	if o.provider != nil {
+		issuer = o.provider.Issuer
+	}
+	o.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	claims := make(map[string]interface{})
+	if err := oidcDecodePart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return nil, fmt.Errorf("invalid token issuer")
+	}
+	if !oidcAudience(claims["aud"], o.conf.ClientID) {
+		return nil, fmt.Errorf("invalid token audience")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if n, _ := claims["nonce"].(string); nonce != "" && n != nonce {
+		return nil, fmt.Errorf("invalid token nonce")
+	}
+
+	// Map identity claim to xds user
+	user, _ := claims[o.conf.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("claim %s not set in token", o.conf.UserClaim)
+	}
+	if o.conf.UserMap != nil {
+		if u, exist := o.conf.UserMap[user]; exist {
+			user = u
+		}
+	}
+	ident := authIdentity{
+		user:     user,
+		expireAt: time.Unix(int64(exp), 0),
+	}
+	ident.subject, _ = claims["sub"].(string)
+	ident.email, _ = claims["email"].(string)
+	ident.name, _ = claims["name"].(string)
+	if ident.subject == "" {
+		return nil, fmt.Errorf("claim sub not set in token")
+	}
+	return &ident, nil
+}
+
+/*** Private functions ***/
+
+// discover retrieves provider metadata (mutex must be locked)
+func (o *OIDC) discover() (*oidcProvider, error) {
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	p := oidcProvider{}
+	if err := o.getJSON(o.conf.Issuer+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("Cannot retrieve OpenID Connect provider configuration: %v", err)
+	}
+	if p.Issuer != o.conf.Issuer || p.AuthEndpoint == "" || p.TokenEndpoint == "" || p.JwksURI == "" {
+		return nil, fmt.Errorf("invalid OpenID Connect provider configuration (issuer %s)", p.Issuer)
+	}
+	o.provider = &p
+	return o.provider, nil
+}
+
+// key returns the provider key used to sign tokens, keys are refreshed when
+// unknown (mutex must be locked)
+func (o *OIDC) key(kid string) (*rsa.PublicKey, error) {
+	if k, exist := o.keys[kid]; exist {
+		return k, nil
+	}
+	if time.Since(o.keysAt) < oidcJwksRefreshTime {
+		return nil, fmt.Errorf("unknown token key")
+	}
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	o.keysAt = time.Now()
+
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := o.getJSON(p.JwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("Cannot retrieve provider keys: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		e, errE := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if errN != nil || errE != nil || len(e) > 4 {
+			o.Log.Warningf("Invalid OpenID Connect provider key %s", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	o.keys = keys
+
+	if k, exist := o.keys[kid]; exist {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown token key")
+}
+
+// getJSON decodes JSON returned by a GET request
+func (o *OIDC) getJSON(url string, data interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// oidcDecodePart decodes a (base64url JSON) part of a token
+func oidcDecodePart(part string, data interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("invalid token format")
+	}
+	if err := json.Unmarshal(b, data); err != nil {
+		return fmt.Errorf("invalid token format")
+	}
+	return nil
+}
+
+// oidcAudience returns true when audience claim (string or array) contains
+// client ID
+func oidcAudience(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, _ := v.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oidcRandom returns a random value used as state or nonce
+func oidcRandom() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Cannot generate random value: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
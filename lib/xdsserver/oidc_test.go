@@ -0,0 +1,240 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const oidcTestIssuer = "https://idp.example.com"
+const oidcTestClientID = "xds"
+
+// oidcTestKeys Provider key and another key unknown to provider
+var oidcTestKeys struct {
+	provider *rsa.PrivateKey
+	other    *rsa.PrivateKey
+}
+
+func oidcTestKey(t *testing.T, other bool) *rsa.PrivateKey {
+	var err error
+	if oidcTestKeys.provider == nil {
+		if oidcTestKeys.provider, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+		if oidcTestKeys.other, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if other {
+		return oidcTestKeys.other
+	}
+	return oidcTestKeys.provider
+}
+
+// oidcTestNew returns an instance using already retrieved provider metadata
+// and keys (no request is sent to provider)
+func oidcTestNew(t *testing.T) *OIDC {
+	return &OIDC{
+		conf: xdsconfig.OIDCConf{
+			Issuer:    oidcTestIssuer,
+			ClientID:  oidcTestClientID,
+			UserClaim: oidcDefaultUserClaim,
+			UserMap:   map[string]string{"jdoe": "john"},
+		},
+		provider: &oidcProvider{Issuer: oidcTestIssuer},
+		keys:     map[string]*rsa.PublicKey{"k1": &oidcTestKey(t, false).PublicKey},
+		keysAt:   time.Now(),
+		states:   make(map[string]oidcState),
+		mutex:    sync.NewMutex(),
+	}
+}
+
+// oidcTestToken returns a token signed with RS256 (or HS256 when alg is
+// HS256, none when alg is none)
+func oidcTestToken(t *testing.T, alg, kid string, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	var sig []byte
+	switch alg {
+	case "none":
+	case "HS256":
+		// Public key used as HMAC secret (algorithm confusion)
+		mac := hmac.New(sha256.New, key.PublicKey.N.Bytes())
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	default:
+		hash := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func oidcTestClaims(change map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                oidcTestIssuer,
+		"aud":                oidcTestClientID,
+		"sub":                "248289761001",
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              "n-0S6_WzA2Mj",
+		"preferred_username": "jane",
+		"email":              "jane@example.com",
+		"name":               "Jane Doe",
+	}
+	for k, v := range change {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestOIDCValidate(t *testing.T) {
+	now := time.Now()
+	key := oidcTestKey(t, false)
+	other := oidcTestKey(t, true)
+	valid := oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		user  string // expected xds user
+		err   string // expected error, empty on success
+	}{
+		{"valid", valid, "n-0S6_WzA2Mj", "jane", ""},
+		{"nonce not checked", valid, "", "jane", ""},
+		{"audience array", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"aud": []string{"other", oidcTestClientID}})), "", "jane", ""},
+		{"expired within clock skew", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"exp": now.Add(-oidcClockSkew / 2).Unix()})), "", "jane", ""},
+		{"mapped user", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"preferred_username": "jdoe"})), "", "john", ""},
+
+		// format
+		{"empty", "", "", "", "invalid token format"},
+		{"two parts", parts[0] + "." + parts[1], "", "", "invalid token format"},
+		{"four parts", valid + ".x", "", "", "invalid token format"},
+		{"invalid header", "e30x." + parts[1] + "." + parts[2], "", "", "invalid token format"},
+		{"header not JSON", base64.RawURLEncoding.EncodeToString([]byte("alg")) + "." + parts[1] + "." + parts[2], "", "", "invalid token format"},
+		{"invalid signature encoding", parts[0] + "." + parts[1] + ".!!!", "", "", "invalid token signature"},
+
+		// algorithm and signature
+		{"alg none", oidcTestToken(t, "none", "k1", key, oidcTestClaims(nil)), "", "", "unsupported token algorithm"},
+		{"alg HS256", oidcTestToken(t, "HS256", "k1", key, oidcTestClaims(nil)), "", "", "unsupported token algorithm"},
+		{"alg RS512", oidcTestToken(t, "RS512", "k1", key, oidcTestClaims(nil)), "", "", "unsupported token algorithm"},
+		{"unknown key", oidcTestToken(t, "RS256", "k2", key, oidcTestClaims(nil)), "", "", "unknown token key"},
+		{"signed by other key", oidcTestToken(t, "RS256", "k1", other, oidcTestClaims(nil)), "", "", "invalid token signature"},
+		{"missing signature", parts[0] + "." + parts[1] + ".", "", "", "invalid token signature"},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+oidcTestIssuer+`","sub":"admin"}`)) + "." + parts[2], "", "", "invalid token signature"},
+
+		// claims
+		{"wrong issuer", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"iss": "https://evil.example.com"})), "", "", "invalid token issuer"},
+		{"issuer with trailing slash", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"iss": oidcTestIssuer + "/"})), "", "", "invalid token issuer"},
+		{"missing issuer", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"iss": nil})), "", "", "invalid token issuer"},
+		{"wrong audience", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"aud": "other"})), "", "", "invalid token audience"},
+		{"wrong audience array", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"aud": []string{"a", "b"}})), "", "", "invalid token audience"},
+		{"missing audience", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"aud": nil})), "", "", "invalid token audience"},
+		{"expired", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"exp": now.Add(-2 * oidcClockSkew).Unix()})), "", "", "token expired"},
+		{"missing expiration", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"exp": nil})), "", "", "token expired"},
+		{"expiration not a number", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"exp": "never"})), "", "", "token expired"},
+		{"not yet valid", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"nbf": now.Add(2 * oidcClockSkew).Unix()})), "", "", "token not yet valid"},
+		{"wrong nonce", valid, "other", "", "invalid token nonce"},
+		{"missing nonce", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"nonce": nil})), "n-0S6_WzA2Mj", "", "invalid token nonce"},
+		{"missing user claim", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"preferred_username": nil})), "", "", "claim preferred_username not set"},
+		{"missing subject", oidcTestToken(t, "RS256", "k1", key, oidcTestClaims(map[string]interface{}{
+			"sub": nil})), "", "", "claim sub not set"},
+	}
+
+	o := oidcTestNew(t)
+	for _, tt := range tests {
+		ident, err := o.Validate(tt.token, tt.nonce)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if ident.user != tt.user || ident.subject != "248289761001" || ident.email != "jane@example.com" {
+			t.Errorf("%s: got identity %+v", tt.name, ident)
+		}
+	}
+}
+
+func TestOIDCAudience(t *testing.T) {
+	tests := []struct {
+		aud  interface{}
+		want bool
+	}{
+		{"xds", true},
+		{"xds2", false},
+		{"", false},
+		{nil, false},
+		{42.0, false},
+		{[]interface{}{"a", "xds"}, true},
+		{[]interface{}{"a", 42.0}, false},
+		{[]interface{}{}, false},
+	}
+	for _, tt := range tests {
+		if got := oidcAudience(tt.aud, "xds"); got != tt.want {
+			t.Errorf("oidcAudience(%v) = %v, want %v", tt.aud, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const outStreamBatchDelay = 100 * time.Millisecond // Default maximum delay before batched output is sent
+const outStreamBatchSize = 4 * 1024                // Default size from which batched output is sent without delay
+const outStreamMaxFactor = 16                      // Maximum increase of batch delay and size on congested connections
+const outStreamMaxPending = 1024 * 1024            // Default maximum size of output waiting to be sent to a connection
+const outStreamMaxSpill = 64 * 1024 * 1024         // Default maximum size of output written on disk per connection
+const outStreamSlowEmit = 200 * time.Millisecond   // Emit slower than this means that connection is congested
+const outStreamIdleTime = time.Minute              // Sender of a connection exits after this idle time
+
+// OutputStreams Sends output events to client connections: output is batched
+// (adaptively to connection speed) and events of a connection are sent in
+// order by a dedicated goroutine so that a slow client doesn't block
+// commands, policy is applied when too many events are waiting
+type OutputStreams struct {
+	*Context
+	batchDelay time.Duration
+	batchSize  int
+	maxPending int
+	maxSpill   int64
+	policy     string
+	conns      map[string]*outConn
+	mutex      sync.Mutex
+	stop       chan struct{} // signals intentional stop
+}
+
+// outConn Events waiting to be sent to a client connection
+type outConn struct {
+	sid       string
+	queue     []outEvent
+	pending   int           // size of output in queue
+	spillW    *os.File      // spilled events (one JSON event per line)
+	spillR    *bufio.Reader // read side of spill file
+	spillFd   *os.File      // file of spillR
+	spillN    int           // number of spilled events not sent yet
+	spillSize int64         // size of output written in spill file
+	slow      bool          // last emit was slow
+	congested bool          // too many events waiting or slow client
+	dropped   int           // events dropped since last notification
+	droppedB  int           // size of dropped output
+	wake      chan struct{}
+}
+
+// outEvent Event waiting to be sent
+type outEvent struct {
+	name string
+	data interface{}
+	size int // size of output data (0: event is never dropped)
+}
+
+// outSpilledEvent Event written in spill file
+type outSpilledEvent struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+// outBatcher Batches output of a command: data are sent once batch size is
+// reached or after batch delay, both increased while connection is congested
+type outBatcher struct {
+	streams *OutputStreams
+	sid     string
+	flushCB func(stdout, stderr string)
+	stdout  string
+	stderr  string
+	factor  int
+	timer   *time.Timer
+	mutex   sync.Mutex
+}
+
+// NewOutputStreams creates a new instance of OutputStreams
+func NewOutputStreams(ctx *Context) *OutputStreams {
+	o := OutputStreams{
+		Context:    ctx,
+		batchDelay: outStreamBatchDelay,
+		batchSize:  outStreamBatchSize,
+		maxPending: outStreamMaxPending,
+		maxSpill:   outStreamMaxSpill,
+		policy:     xsapiv1.OutputStreamPolicySpill,
+		conns:      make(map[string]*outConn),
+		mutex:      sync.NewMutex(),
+		stop:       make(chan struct{}),
+	}
+
+	if cfg := ctx.Config.FileConf.StreamConf; cfg != nil {
+		if cfg.BatchDelayMs > 0 {
+			o.batchDelay = time.Duration(cfg.BatchDelayMs) * time.Millisecond
+		}
+		if cfg.BatchSize > 0 {
+			o.batchSize = cfg.BatchSize
+		}
+		if cfg.MaxPending > 0 {
+			o.maxPending = cfg.MaxPending
+		}
+		if cfg.MaxSpill > 0 {
+			o.maxSpill = cfg.MaxSpill
+		}
+		if cfg.Policy == xsapiv1.OutputStreamPolicyDrop {
+			o.policy = cfg.Policy
+		} else if cfg.Policy != "" && cfg.Policy != xsapiv1.OutputStreamPolicySpill {
+			o.Log.Warningf("Invalid output stream policy '%s', use '%s'", cfg.Policy, o.policy)
+		}
+	}
+	o.Log.Debugf("Output streams: batch %v/%d bytes, max pending %d bytes, policy %s",
+		o.batchDelay, o.batchSize, o.maxPending, o.policy)
+
+	return &o
+}
+
+// Stop output streams (waiting events are dropped)
+func (o *OutputStreams) Stop() {
+	close(o.stop)
+}
+
+// Emit queues an event sent to a session, size is the size of output data
+// carried by event (0 for events that must never be dropped)
+func (o *OutputStreams) Emit(sid, evName string, data interface{}, size int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	c, exist := o.conns[sid]
+	if !exist {
+		c = &outConn{sid: sid, wake: make(chan struct{}, 1)}
+		o.conns[sid] = c
+		go o.sendLoop(c)
+	}
+	o.enqueueUnsafe(c, outEvent{name: evName, data: data, size: size})
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// execEmitFunc returns the function used to send output events of a command
+// executed by a session
+func (o *OutputStreams) execEmitFunc(sid string) ExecOutEmitFunc {
+	return func(evName string, data interface{}) {
+		size := 0
+		if msg, ok := data.(xsapiv1.ExecOutMsg); ok {
+			size = len(msg.Stdout) + len(msg.Stderr)
+		}
+		o.Emit(sid, evName, data, size)
+	}
+}
+
+// newBatcher creates a batcher of output sent to a session, flushCB is
+// called with batched data
+func (o *OutputStreams) newBatcher(sid string, flushCB func(stdout, stderr string)) *outBatcher {
+	return &outBatcher{streams: o, sid: sid, flushCB: flushCB, factor: 1, mutex: sync.NewMutex()}
+}
+
+// Write adds output to batch
+func (b *outBatcher) Write(stdout, stderr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.stdout += stdout
+	b.stderr += stderr
+	if b.stdout == "" && b.stderr == "" {
+		return
+	}
+	if len(b.stdout)+len(b.stderr) >= b.streams.batchSize*b.factor {
+		b.flushUnsafe()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.streams.batchDelay*time.Duration(b.factor), func() { b.Flush() })
+	}
+}
+
+// Flush sends batched output now, returns false when there was no output
+func (b *outBatcher) Flush() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.flushUnsafe()
+}
+
+/*** Private functions ***/
+
+// flushUnsafe sends batched output and adapts batching to connection state
+// (mutex must be locked)
+func (b *outBatcher) flushUnsafe() bool {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if b.stdout == "" && b.stderr == "" {
+		return false
+	}
+	stdout, stderr := b.stdout, b.stderr
+	b.stdout, b.stderr = "", ""
+	b.flushCB(stdout, stderr)
+
+	if !b.streams.congested(b.sid) {
+		b.factor = 1
+	} else if b.factor < outStreamMaxFactor {
+		b.factor *= 2
+	}
+	return true
+}
+
+// congested returns true when events sent to a session are waiting
+func (o *OutputStreams) congested(sid string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	c, exist := o.conns[sid]
+	return exist && c.congested
+}
+
+// enqueueUnsafe adds an event to connection queue, policy is applied when too
+// many output is waiting (mutex must be locked)
+func (o *OutputStreams) enqueueUnsafe(c *outConn, ev outEvent) {
+	// Once spilled, events are spilled until spill file is sent (keep order)
+	if c.spillN > 0 || (ev.size > 0 && c.pending > 0 && c.pending+ev.size > o.maxPending) {
+		c.congested = true
+		if o.policy == xsapiv1.OutputStreamPolicySpill && (ev.size == 0 || c.spillSize+int64(ev.size) <= o.maxSpill) {
+			if o.spillUnsafe(c, ev) {
+				return
+			}
+		}
+		if ev.size > 0 {
+			if c.dropped == 0 {
+				o.Log.Warningf("Connection %s too slow, output dropped", c.sid)
+			}
+			c.dropped++
+			c.droppedB += ev.size
+			return
+		}
+	}
+	c.queue = append(c.queue, ev)
+	c.pending += ev.size
+}
+
+// spillUnsafe writes an event in spill file of a connection, returns false
+// on error (mutex must be locked)
+func (o *OutputStreams) spillUnsafe(c *outConn, ev outEvent) bool {
+	if c.spillW == nil {
+		w, err := ioutil.TempFile("", "xds-output-")
+		if err != nil {
+			o.Log.Errorf("Cannot create output spill file: %v", err)
+			return false
+		}
+		r, err := os.Open(w.Name())
+		// Removed now, file is kept as long as it is open
+		os.Remove(w.Name())
+		if err != nil {
+			w.Close()
+			o.Log.Errorf("Cannot open output spill file: %v", err)
+			return false
+		}
+		c.spillW, c.spillFd, c.spillR = w, r, bufio.NewReader(r)
+		o.Log.Infof("Connection %s too slow, output spilled on disk", c.sid)
+	}
+
+	data, err := json.Marshal(ev.data)
+	if err == nil {
+		var line []byte
+		if line, err = json.Marshal(outSpilledEvent{Name: ev.name, Data: data}); err == nil {
+			_, err = c.spillW.Write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		o.Log.Errorf("Cannot write output spill file: %v", err)
+		if c.spillN == 0 {
+			o.closeSpillUnsafe(c)
+		}
+		return false
+	}
+	c.spillN++
+	c.spillSize += int64(ev.size)
+	return true
+}
+
+// closeSpillUnsafe closes spill file of a connection (mutex must be locked)
+func (o *OutputStreams) closeSpillUnsafe(c *outConn) {
+	if c.spillW != nil {
+		c.spillW.Close()
+		c.spillFd.Close()
+	}
+	c.spillW, c.spillFd, c.spillR = nil, nil, nil
+	c.spillN, c.spillSize = 0, 0
+}
+
+// nextUnsafe returns the next event to send to a connection (mutex must be
+// locked)
+func (o *OutputStreams) nextUnsafe(c *outConn) (outEvent, bool) {
+	defer func() {
+		c.congested = c.slow || c.pending > o.maxPending/4 || c.spillN > 0
+	}()
+
+	if len(c.queue) > 0 {
+		ev := c.queue[0]
+		c.queue = c.queue[1:]
+		c.pending -= ev.size
+		return ev, true
+	}
+
+	for c.spillN > 0 {
+		line, err := c.spillR.ReadBytes('\n')
+		if err != nil {
+			o.Log.Errorf("Cannot read output spill file: %v", err)
+			o.closeSpillUnsafe(c)
+			break
+		}
+		c.spillN--
+		if c.spillN == 0 {
+			o.closeSpillUnsafe(c)
+		}
+		ev := outSpilledEvent{}
+		if err := json.Unmarshal(line, &ev); err == nil {
+			return outEvent{name: ev.Name, data: ev.Data}, true
+		}
+	}
+
+	// Notify dropped output once connection recovered
+	if c.dropped > 0 {
+		msg := xsapiv1.OutputDroppedMsg{Timestamp: time.Now().String(), Events: c.dropped, Bytes: c.droppedB}
+		o.Log.Warningf("Connection %s recovered, %d output events dropped (%d bytes)", c.sid, c.dropped, c.droppedB)
+		c.dropped, c.droppedB = 0, 0
+		return outEvent{name: xsapiv1.OutputDroppedEvent, data: msg}, true
+	}
+	return outEvent{}, false
+}
+
+// sendLoop sends events of a connection in order (exits when idle)
+func (o *OutputStreams) sendLoop(c *outConn) {
+	for {
+		select {
+		case <-o.stop:
+			o.mutex.Lock()
+			o.closeSpillUnsafe(c)
+			o.mutex.Unlock()
+			return
+		default:
+		}
+
+		o.mutex.Lock()
+		ev, ok := o.nextUnsafe(c)
+		o.mutex.Unlock()
+
+		if !ok {
+			select {
+			case <-o.stop:
+				continue
+			case <-c.wake:
+			case <-time.After(outStreamIdleTime):
+				o.mutex.Lock()
+				if len(c.queue) == 0 && c.spillN == 0 && c.dropped == 0 {
+					delete(o.conns, c.sid)
+					o.mutex.Unlock()
+					return
+				}
+				o.mutex.Unlock()
+			}
+			continue
+		}
+
+		// IO socket can be nil when disconnected
+		so := o.sessions.IOSocketGet(c.sid)
+		if so == nil {
+			o.Log.Infof("%s not emitted: WS closed (sid:%s)", ev.name, c.sid)
+			continue
+		}
+		start := time.Now()
+		if err := (*so).Emit(ev.name, ev.data); err != nil {
+			o.Log.Errorf("WS Emit : %v", err)
+		}
+		slow := time.Since(start) > outStreamSlowEmit
+
+		o.mutex.Lock()
+		c.slow = slow
+		o.mutex.Unlock()
+	}
+}
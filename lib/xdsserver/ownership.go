@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// sessionAuthUser returns the authenticated user of a session (empty when
+// session is not authenticated, XDS-User header is never trusted here)
+func (ctx *Context) sessionAuthUser(sid string) string {
+	if ctx.sessions == nil || sid == "" {
+		return ""
+	}
+	sess := ctx.sessions.GetByID(sid)
+	if sess == nil || !sess.IsAuthenticated() {
+		return ""
+	}
+	return sess.identity.user
+}
+
+// sessionIsAdmin returns true when roles are enforced and session is admin
+func (ctx *Context) sessionIsAdmin(sid string) bool {
+	if ctx.roles == nil || !ctx.roles.Enabled() || ctx.sessions == nil || sid == "" {
+		return false
+	}
+	return ctx.roles.Allowed(ctx.roleUser(ctx.sessions.GetByID(sid)), xsapiv1.RoleAdmin)
+}
+
+// sessionOwns returns true when a session owns a resource (folder, command
+// or SDK) recorded with an owner session and user: resources without owner
+// are owned by all, sessions of the same authenticated user share ownership
+// and admins own everything
+func (ctx *Context) sessionOwns(sid, ownerSid, ownerUser string) bool {
+	if ownerSid == "" && ownerUser == "" {
+		return true
+	}
+	if sid != "" && sid == ownerSid {
+		return true
+	}
+	if user := ctx.sessionAuthUser(sid); user != "" && user == ownerUser {
+		return true
+	}
+	return ctx.sessionIsAdmin(sid)
+}
+
+// clientFolderAccess returns the access right of a client on a folder
+func (ctx *Context) clientFolderAccess(fc xsapiv1.FolderConfig, clientID string) string {
+	if ctx.sessionOwns(clientID, fc.Owner, fc.OwnerUser) {
+		return xsapiv1.FolderAccessOwner
+	}
+	for _, sh := range fc.Shares {
+		if sh.ClientID == clientID {
+			return sh.Access
+		}
+	}
+	return ""
+}
+
+// execVisible returns true when a client can see a command: its own commands
+// and all commands of folders it owns
+func (ctx *Context) execVisible(e *xsapiv1.ExecHistoryEntry, clientID string) bool {
+	if ctx.sessionOwns(clientID, e.SessionID, e.User) {
+		return true
+	}
+	return ctx.mfolders.HasAccess(e.FolderID, clientID, xsapiv1.FolderAccessOwner)
+}
+
+// execCmdVisible returns true when a client can see a command executed or
+// recorded in history (see execVisible)
+func (ctx *Context) execCmdVisible(cmdID, clientID string) bool {
+	e, exist := ctx.execHistory.Lookup(cmdID)
+	return exist && ctx.execVisible(&e, clientID)
+}
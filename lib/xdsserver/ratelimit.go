@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"math"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const rateLimitMonitorTime = 60  // Time (in seconds) to schedule cleanup of idle buckets
+const rateLimitDefaultBurst = 20 // Default number of requests accepted in a burst
+const rateLimitDefaultEventsBurst = 10
+
+// rateBucket Token bucket of one client
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimit Token buckets sharing the same rate definition
+type rateLimit struct {
+	rate    float64 // tokens per second (0 when disabled)
+	burst   float64
+	buckets map[string]*rateBucket
+}
+
+// RateLimiter Protect server from clients sending too many requests
+type RateLimiter struct {
+	*Context
+	api    rateLimit
+	token  rateLimit
+	events rateLimit
+	exempt map[string]bool
+	proxy  bool // addresses set by a reverse proxy are used
+	mutex  sync.Mutex
+	stop   chan struct{} // signals intentional stop
+}
+
+// NewRateLimiter creates a new instance of RateLimiter (nil when not configured)
+func NewRateLimiter(ctx *Context) *RateLimiter {
+	cfg := ctx.Config.FileConf.RateLimitConf
+	if cfg == nil {
+		return nil
+	}
+
+	r := RateLimiter{
+		Context: ctx,
+		api:     newRateLimit(cfg.RequestsPerS, cfg.Burst, rateLimitDefaultBurst),
+		events:  newRateLimit(cfg.EventsPerMin/60, cfg.EventsBurst, rateLimitDefaultEventsBurst),
+		exempt:  make(map[string]bool),
+		mutex:   sync.NewMutex(),
+		stop:    make(chan struct{}),
+	}
+	tokenRate, tokenBurst := cfg.TokenRequestsPerS, cfg.TokenBurst
+	if tokenRate <= 0 {
+		tokenRate = cfg.RequestsPerS
+	}
+	if tokenBurst <= 0 {
+		tokenBurst = cfg.Burst
+	}
+	r.token = newRateLimit(tokenRate, tokenBurst, rateLimitDefaultBurst)
+	r.proxy = cfg.TrustProxy
+	for _, ip := range cfg.Exempt {
+		r.exempt[ip] = true
+	}
+
+	ctx.Log.Infof("Rate limiting enabled: %v req/s per IP, %v req/s per token, %v events registrations/min",
+		r.api.rate, r.token.rate, cfg.EventsPerMin)
+
+	// Start cleanup of idle buckets
+	go r.monitorBuckets()
+
+	return &r
+}
+
+// Stop rate limiting management
+func (r *RateLimiter) Stop() {
+	close(r.stop)
+}
+
+// Allow returns true when a request of a client (and of a token when not
+// empty) is accepted, or the delay after which it will be
+func (r *RateLimiter) Allow(ip, token string, isEvent bool) (bool, time.Duration) {
+	if r.exempt[ip] {
+		return true, 0
+	}
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if isEvent {
+		if ok, wait := r.events.take("ip:"+ip, now); !ok {
+			return false, wait
+		}
+	}
+	if token != "" {
+		return r.token.take(token, now)
+	}
+	return r.api.take(ip, now)
+}
+
+/*** Private functions ***/
+
+func newRateLimit(rate float64, burst, defBurst int) rateLimit {
+	if burst <= 0 {
+		burst = defBurst
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	return rateLimit{rate: rate, burst: float64(burst), buckets: make(map[string]*rateBucket)}
+}
+
+// take consumes one token of a bucket (mutex must be locked)
+func (l *rateLimit) take(key string, now time.Time) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+	b, exist := l.buckets[key]
+	if !exist {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup removes buckets that are full again (mutex must be locked)
+func (l *rateLimit) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (r *RateLimiter) monitorBuckets() {
+	for {
+		select {
+		case <-r.stop:
+			r.Log.Debugln("Stop monitorBuckets")
+			return
+		case <-time.After(rateLimitMonitorTime * time.Second):
+			now := time.Now()
+			r.mutex.Lock()
+			r.api.cleanup(now)
+			r.token.cleanup(now)
+			r.events.cleanup(now)
+			r.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// roleLevels Roles ordered by privileges
+var roleLevels = map[string]int{
+	xsapiv1.RoleReadOnly:  1,
+	xsapiv1.RoleDeveloper: 2,
+	xsapiv1.RoleAdmin:     3,
+}
+
+// Roles Role-based access control (roles of users)
+type Roles struct {
+	*Context
+	enabled     bool
+	defaultRole string
+	admins      map[string]bool
+	assigned    map[string]string // user -> role
+	directory   map[string]string // user -> role granted by directory groups (see LDAP)
+	mutex       sync.Mutex
+}
+
+type xmlRoles struct {
+	XMLName xml.Name           `xml:"roles"`
+	Version string             `xml:"version,attr"`
+	Users   []xsapiv1.UserRole `xml:"user"`
+}
+
+// NewRoles creates a new instance of Roles
+func NewRoles(ctx *Context) (*Roles, error) {
+	r := Roles{
+		Context:     ctx,
+		defaultRole: xsapiv1.RoleDeveloper,
+		admins:      make(map[string]bool),
+		assigned:    make(map[string]string),
+		directory:   make(map[string]string),
+		mutex:       sync.NewMutex(),
+	}
+	if cfg := ctx.Config.FileConf.RBACConf; cfg != nil {
+		r.enabled = cfg.Enabled
+		if cfg.DefaultRole != "" {
+			if _, valid := roleLevels[cfg.DefaultRole]; !valid {
+				return nil, fmt.Errorf("invalid RBAC default role '%s'", cfg.DefaultRole)
+			}
+			r.defaultRole = cfg.DefaultRole
+		}
+		for _, u := range cfg.Admins {
+			r.admins[u] = true
+		}
+	}
+	r.load()
+	if r.enabled {
+		r.Log.Infof("Role-based access control enabled (default role %s)", r.defaultRole)
+		if !ctx.authEnabled() {
+			r.Log.Warningf("RBAC: no authentication configured, only clients using API tokens get a role other than %s", r.defaultRole)
+		}
+	}
+	return &r, nil
+}
+
+// Enabled returns true when roles are enforced
+func (r *Roles) Enabled() bool {
+	return r.enabled
+}
+
+// Get returns the role of a user
+func (r *Roles) Get(user string) string {
+	if r.admins[user] && user != "" {
+		return xsapiv1.RoleAdmin
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if role, exist := r.assigned[user]; exist && user != "" {
+		return role
+	}
+	if role, exist := r.directory[user]; exist && user != "" {
+		return role
+	}
+	return r.defaultRole
+}
+
+// SetDirectoryRole sets the role granted to a user by directory groups on
+// login (role assigned using REST API has precedence)
+func (r *Roles) SetDirectoryRole(user, role string) {
+	if _, valid := roleLevels[role]; user == "" || (role != "" && !valid) {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if role == "" {
+		delete(r.directory, user)
+	} else {
+		r.directory[user] = role
+	}
+}
+
+// Allowed returns true when a user has (at least) the privileges of a role
+func (r *Roles) Allowed(user, role string) bool {
+	if !r.enabled {
+		return true
+	}
+	return roleLevels[r.Get(user)] >= roleLevels[role]
+}
+
+// GetAll returns roles of users (static admins and assigned roles)
+func (r *Roles) GetAll() []xsapiv1.UserRole {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := []xsapiv1.UserRole{}
+	for u := range r.admins {
+		res = append(res, xsapiv1.UserRole{User: u, Role: xsapiv1.RoleAdmin, Static: true})
+	}
+	for u, role := range r.assigned {
+		if !r.admins[u] {
+			res = append(res, xsapiv1.UserRole{User: u, Role: role})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].User < res[j].User })
+	return res
+}
+
+// Set assigns a role to a user
+func (r *Roles) Set(user, role string) (*xsapiv1.UserRole, error) {
+	if user == "" {
+		return nil, fmt.Errorf("invalid user")
+	}
+	if _, valid := roleLevels[role]; !valid {
+		return nil, fmt.Errorf("invalid role '%s'", role)
+	}
+	if r.admins[user] {
+		return nil, fmt.Errorf("role of %s is set in server configuration", user)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.assigned[user] = role
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+	r.Log.Infof("Role %s assigned to user %s", role, user)
+	return &xsapiv1.UserRole{User: user, Role: role}, nil
+}
+
+// Delete removes the role assigned to a user (default role is used)
+func (r *Roles) Delete(user string) (*xsapiv1.UserRole, error) {
+	if r.admins[user] {
+		return nil, fmt.Errorf("role of %s is set in server configuration", user)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	role, exist := r.assigned[user]
+	if !exist {
+		return nil, fmt.Errorf("no role assigned to %s", user)
+	}
+	delete(r.assigned, user)
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+	r.Log.Infof("Role %s of user %s removed", role, user)
+	return &xsapiv1.UserRole{User: user, Role: r.defaultRole}, nil
+}
+
+/*** Private functions ***/
+
+// load reads assigned roles from disk
+func (r *Roles) load() {
+	file, err := xdsconfig.RolesConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		r.Log.Errorf("Cannot read roles: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlRoles{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		r.Log.Errorf("Cannot decode roles: %v", err)
+		return
+	}
+	for _, ur := range data.Users {
+		if _, valid := roleLevels[ur.Role]; !valid {
+			r.Log.Warningf("Ignore invalid role %s of user %s", ur.Role, ur.User)
+			continue
+		}
+		r.assigned[ur.User] = ur.Role
+	}
+}
+
+// save writes assigned roles on disk (mutex must be locked)
+func (r *Roles) save() error {
+	file, err := xdsconfig.RolesConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	data := xmlRoles{Version: "1", Users: []xsapiv1.UserRole{}}
+	for u, role := range r.assigned {
+		data.Users = append(data.Users, xsapiv1.UserRole{User: u, Role: role})
+	}
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&data)
+}
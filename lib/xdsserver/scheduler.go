@@ -0,0 +1,312 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// ExecStartFunc Function that starts a scheduled command
+type ExecStartFunc func() error
+
+// ExecAbortFunc Function called when a queued command is cancelled or
+// cannot be started
+type ExecAbortFunc func(err error)
+
+// schedJob Hold a command managed by scheduler
+type schedJob struct {
+	job   xsapiv1.ExecJob
+	start ExecStartFunc
+	abort ExecAbortFunc
+}
+
+// ExecScheduler Limit the number of concurrent exec commands (per server
+// and per session), excess commands are queued by priority then FIFO
+type ExecScheduler struct {
+	*Context
+	maxJobs       int
+	maxPerSession int
+	running       map[string]*schedJob
+	queue         []*schedJob
+	mutex         sync.Mutex
+}
+
+// NewExecScheduler creates a new instance of ExecScheduler
+func NewExecScheduler(ctx *Context) *ExecScheduler {
+	s := ExecScheduler{
+		Context: ctx,
+		running: make(map[string]*schedJob),
+		queue:   []*schedJob{},
+		mutex:   sync.NewMutex(),
+	}
+	if cfg := ctx.Config.FileConf.SchedulerConf; cfg != nil {
+		s.maxJobs = cfg.MaxJobs
+		s.maxPerSession = cfg.MaxJobsPerSession
+		s.Log.Infof("Exec scheduler limits: %d jobs, %d jobs per session", s.maxJobs, s.maxPerSession)
+	}
+	return &s
+}
+
+// Submit starts a command immediately when limits allow it, otherwise
+// command is queued and started later
+func (s *ExecScheduler) Submit(job xsapiv1.ExecJob, start ExecStartFunc, abort ExecAbortFunc) (xsapiv1.ExecJob, error) {
+	sj := &schedJob{job: job, start: start, abort: abort}
+	sj.job.QueuedAt = time.Now().String()
+
+	s.mutex.Lock()
+	if _, exist := s.running[job.CmdID]; exist || s.queuedIndexUnsafe(job.CmdID) >= 0 {
+		s.mutex.Unlock()
+		return job, fmt.Errorf("command %s already exists", job.CmdID)
+	}
+
+	if s.canRunUnsafe(job.SessionID) {
+		s.setRunningUnsafe(sj)
+		s.mutex.Unlock()
+
+		if err := start(); err != nil {
+			s.Done(job.CmdID)
+			return job, err
+		}
+		s.notify([]xsapiv1.ExecJob{sj.job})
+		return sj.job, nil
+	}
+
+	// Insert after jobs of same or higher priority
+	idx := len(s.queue)
+	for i, q := range s.queue {
+		if q.job.Priority < job.Priority {
+			idx = i
+			break
+		}
+	}
+	sj.job.Status = xsapiv1.ExecJobStatusQueued
+	s.queue = append(s.queue, nil)
+	copy(s.queue[idx+1:], s.queue[idx:])
+	s.queue[idx] = sj
+	changed := s.positionsUnsafe()
+	res := sj.job
+	s.mutex.Unlock()
+
+	s.Log.Infof("Command %s queued at position %d", job.CmdID, res.Position)
+	s.notify(changed)
+	return res, nil
+}
+
+// Done must be called once a command exited, next queued commands are started
+func (s *ExecScheduler) Done(cmdID string) {
+	s.mutex.Lock()
+	delete(s.running, cmdID)
+	s.mutex.Unlock()
+	s.dispatch()
+}
+
+// IsQueued returns true when a command is waiting to be started
+func (s *ExecScheduler) IsQueued(cmdID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queuedIndexUnsafe(cmdID) >= 0
+}
+
+// Job returns a queued or running command
+func (s *ExecScheduler) Job(cmdID string) (xsapiv1.ExecJob, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sj, exist := s.running[cmdID]; exist {
+		return sj.job, true
+	}
+	if idx := s.queuedIndexUnsafe(cmdID); idx >= 0 {
+		return s.queue[idx].job, true
+	}
+	return xsapiv1.ExecJob{}, false
+}
+
+// Cancel removes a command from queue
+func (s *ExecScheduler) Cancel(cmdID string) (xsapiv1.ExecJob, error) {
+	s.mutex.Lock()
+	idx := s.queuedIndexUnsafe(cmdID)
+	if idx < 0 {
+		s.mutex.Unlock()
+		return xsapiv1.ExecJob{}, fmt.Errorf("command %s not queued", cmdID)
+	}
+	sj := s.queue[idx]
+	s.queue = append(s.queue[:idx], s.queue[idx+1:]...)
+	changed := s.positionsUnsafe()
+	s.mutex.Unlock()
+
+	sj.job.Status = xsapiv1.ExecJobStatusCancelled
+	sj.job.Position = 0
+	s.Log.Infof("Queued command %s cancelled", cmdID)
+	s.notify(append([]xsapiv1.ExecJob{sj.job}, changed...))
+	if sj.abort != nil {
+		sj.abort(fmt.Errorf("command cancelled"))
+	}
+	return sj.job, nil
+}
+
+// Move changes position of a queued command (positions start at 1)
+func (s *ExecScheduler) Move(cmdID string, position int) (xsapiv1.ExecQueue, error) {
+	s.mutex.Lock()
+	idx := s.queuedIndexUnsafe(cmdID)
+	if idx < 0 {
+		s.mutex.Unlock()
+		return xsapiv1.ExecQueue{}, fmt.Errorf("command %s not queued", cmdID)
+	}
+	if position < 1 || position > len(s.queue) {
+		s.mutex.Unlock()
+		return xsapiv1.ExecQueue{}, fmt.Errorf("invalid position (must be between 1 and %d)", len(s.queue))
+	}
+	sj := s.queue[idx]
+	s.queue = append(s.queue[:idx], s.queue[idx+1:]...)
+	idx = position - 1
+	s.queue = append(s.queue, nil)
+	copy(s.queue[idx+1:], s.queue[idx:])
+	s.queue[idx] = sj
+	changed := s.positionsUnsafe()
+	s.mutex.Unlock()
+
+	s.notify(changed)
+	return s.GetQueue(), nil
+}
+
+// GetQueue returns running and queued commands
+func (s *ExecScheduler) GetQueue() xsapiv1.ExecQueue {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	q := xsapiv1.ExecQueue{
+		MaxJobs:           s.maxJobs,
+		MaxJobsPerSession: s.maxPerSession,
+		Running:           []xsapiv1.ExecJob{},
+		Queued:            []xsapiv1.ExecJob{},
+	}
+	for _, sj := range s.running {
+		q.Running = append(q.Running, sj.job)
+	}
+	for _, sj := range s.queue {
+		q.Queued = append(q.Queued, sj.job)
+	}
+	return q
+}
+
+/*** Private functions ***/
+
+// dispatch starts queued commands allowed by limits
+func (s *ExecScheduler) dispatch() {
+	s.mutex.Lock()
+	started := []*schedJob{}
+	for i := 0; i < len(s.queue); {
+		sj := s.queue[i]
+		if !s.canRunUnsafe(sj.job.SessionID) {
+			i++
+			continue
+		}
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		s.setRunningUnsafe(sj)
+		started = append(started, sj)
+	}
+	changed := s.positionsUnsafe()
+	s.mutex.Unlock()
+
+	if len(started) == 0 {
+		s.notify(changed)
+		return
+	}
+
+	failed := false
+	for _, sj := range started {
+		s.Log.Infof("Start queued command %s", sj.job.CmdID)
+		if err := sj.start(); err != nil {
+			s.Log.Errorf("Cannot start queued command %s: %v", sj.job.CmdID, err)
+			s.mutex.Lock()
+			delete(s.running, sj.job.CmdID)
+			s.mutex.Unlock()
+			if sj.abort != nil {
+				sj.abort(err)
+			}
+			failed = true
+			continue
+		}
+		changed = append(changed, sj.job)
+	}
+	s.notify(changed)
+
+	// Released slots can be used by other queued commands
+	if failed {
+		s.dispatch()
+	}
+}
+
+func (s *ExecScheduler) canRunUnsafe(sid string) bool {
+	if s.maxJobs > 0 && len(s.running) >= s.maxJobs {
+		return false
+	}
+	if s.maxPerSession > 0 {
+		cnt := 0
+		for _, sj := range s.running {
+			if sj.job.SessionID == sid {
+				cnt++
+			}
+		}
+		if cnt >= s.maxPerSession {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ExecScheduler) setRunningUnsafe(sj *schedJob) {
+	sj.job.Status = xsapiv1.ExecJobStatusRunning
+	sj.job.Position = 0
+	sj.job.StartedAt = time.Now().String()
+	s.running[sj.job.CmdID] = sj
+}
+
+func (s *ExecScheduler) queuedIndexUnsafe(cmdID string) int {
+	for i, sj := range s.queue {
+		if sj.job.CmdID == cmdID {
+			return i
+		}
+	}
+	return -1
+}
+
+// positionsUnsafe updates position of queued commands and returns the ones
+// that moved
+func (s *ExecScheduler) positionsUnsafe() []xsapiv1.ExecJob {
+	changed := []xsapiv1.ExecJob{}
+	for i, sj := range s.queue {
+		if sj.job.Position != i+1 {
+			sj.job.Position = i + 1
+			changed = append(changed, sj.job)
+		}
+	}
+	return changed
+}
+
+// notify emits queue position of commands
+func (s *ExecScheduler) notify(jobs []xsapiv1.ExecJob) {
+	for _, job := range jobs {
+		if err := s.events.Emit(xsapiv1.EVTExecQueue, job, ""); err != nil {
+			s.Log.Warningf("Cannot notify exec queue change: %v", err)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const scheduleMonitorTime = 20 // Time (in seconds) between two checks of schedules
+
+var errScheduleBusy = errors.New("folder busy")
+
+// Shortcuts of cron expressions
+var scheduleCronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+}
+
+// Schedules Commands executed periodically in folders (cron expressions)
+type Schedules struct {
+	*Context
+	schedules []xsapiv1.CmdSchedule
+	next      map[string]time.Time // next run of enabled schedules
+	running   map[string]bool
+	mutex     sync.Mutex
+	stop      chan struct{} // signals intentional stop
+}
+
+type xmlSchedules struct {
+	XMLName   xml.Name              `xml:"schedules"`
+	Version   string                `xml:"version,attr"`
+	Schedules []xsapiv1.CmdSchedule `xml:"schedule"`
+}
+
+// cronSpec Parsed cron expression
+type cronSpec struct {
+	minute, hour, dom, month, dow []bool
+	domAny, dowAny                bool
+}
+
+// NewSchedules creates a new instance of Schedules
+func NewSchedules(ctx *Context) *Schedules {
+	s := Schedules{
+		Context:   ctx,
+		schedules: []xsapiv1.CmdSchedule{},
+		next:      make(map[string]time.Time),
+		running:   make(map[string]bool),
+		mutex:     sync.NewMutex(),
+		stop:      make(chan struct{}),
+	}
+	s.load()
+	return &s
+}
+
+// Start starts execution of scheduled commands
+func (s *Schedules) Start() {
+	s.mutex.Lock()
+	for _, sc := range s.schedules {
+		s.planUnsafe(sc)
+	}
+	s.mutex.Unlock()
+	go s.monitorLoop()
+}
+
+// Stop stops execution of scheduled commands
+func (s *Schedules) Stop() {
+	close(s.stop)
+}
+
+// GetAll returns scheduled commands (of all folders when folderID is empty)
+func (s *Schedules) GetAll(folderID string) []xsapiv1.CmdSchedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := []xsapiv1.CmdSchedule{}
+	for _, sc := range s.schedules {
+		if folderID == "" || sc.FolderID == folderID {
+			res = append(res, s.copyUnsafe(sc))
+		}
+	}
+	return res
+}
+
+// Get returns a scheduled command
+func (s *Schedules) Get(id string) (*xsapiv1.CmdSchedule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if i := s.indexUnsafe(id); i >= 0 {
+		res := s.copyUnsafe(s.schedules[i])
+		return &res, nil
+	}
+	return nil, fmt.Errorf("unknown id")
+}
+
+// Add registers a new scheduled command
+func (s *Schedules) Add(sc xsapiv1.CmdSchedule, sid string) (*xsapiv1.CmdSchedule, error) {
+	if err := s.check(&sc); err != nil {
+		return nil, err
+	}
+	sc.ID = uuid.NewV1().String()
+	sc.CreatedBy = sid
+	sc.LastRun = nil
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.schedules = append(s.schedules, sc)
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	s.planUnsafe(sc)
+	s.Log.Infof("New scheduled command %s of folder %s (%s): %s", sc.ID, sc.FolderID, sc.Cron, sc.Cmd)
+	res := s.copyUnsafe(sc)
+	return &res, nil
+}
+
+// Update replaces definition of a scheduled command
+func (s *Schedules) Update(id string, sc xsapiv1.CmdSchedule) (*xsapiv1.CmdSchedule, error) {
+	if err := s.check(&sc); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := s.indexUnsafe(id)
+	if i < 0 {
+		return nil, fmt.Errorf("unknown id")
+	}
+	prev := s.schedules[i]
+	if sc.FolderID != prev.FolderID {
+		return nil, fmt.Errorf("folder of a scheduled command cannot be changed")
+	}
+	sc.ID = prev.ID
+	sc.CreatedBy = prev.CreatedBy
+	sc.LastRun = prev.LastRun
+	s.schedules[i] = sc
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	s.planUnsafe(sc)
+	res := s.copyUnsafe(sc)
+	return &res, nil
+}
+
+// Delete removes a scheduled command
+func (s *Schedules) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := s.indexUnsafe(id)
+	if i < 0 {
+		return fmt.Errorf("unknown id")
+	}
+	s.schedules = append(s.schedules[:i], s.schedules[i+1:]...)
+	delete(s.next, id)
+	return s.save()
+}
+
+// Run executes immediately a scheduled command
+func (s *Schedules) Run(id string) (*xsapiv1.CmdSchedule, error) {
+	if err := s.start(id); err != nil {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+/*** Private functions ***/
+
+// check validates definition of a scheduled command
+func (s *Schedules) check(sc *xsapiv1.CmdSchedule) error {
+	if s.mfolders.Get(sc.FolderID) == nil {
+		return fmt.Errorf("unknown folder %s", sc.FolderID)
+	}
+	sc.Cron = strings.TrimSpace(sc.Cron)
+	spec, err := parseCron(sc.Cron)
+	if err != nil {
+		return err
+	}
+	if spec.next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression '%s' never matches", sc.Cron)
+	}
+	if strings.TrimSpace(sc.Cmd) == "" {
+		return fmt.Errorf("command not set")
+	}
+	if sc.TimeoutS < 0 {
+		return fmt.Errorf("invalid timeout")
+	}
+	return nil
+}
+
+// planUnsafe computes next run of a scheduled command (mutex must be locked)
+func (s *Schedules) planUnsafe(sc xsapiv1.CmdSchedule) {
+	delete(s.next, sc.ID)
+	if sc.Disabled {
+		return
+	}
+	spec, err := parseCron(sc.Cron)
+	if err != nil {
+		s.Log.Errorf("Invalid cron expression of scheduled command %s: %v", sc.ID, err)
+		return
+	}
+	if next := spec.next(time.Now()); !next.IsZero() {
+		s.next[sc.ID] = next
+	}
+}
+
+func (s *Schedules) monitorLoop() {
+	for {
+		select {
+		case <-s.stop:
+			s.Log.Debugln("Stop schedules monitorLoop")
+			return
+		case <-time.After(scheduleMonitorTime * time.Second):
+			now := time.Now()
+			due := []string{}
+			s.mutex.Lock()
+			for _, sc := range s.schedules {
+				if next, exist := s.next[sc.ID]; exist && !now.Before(next) {
+					s.planUnsafe(sc)
+					due = append(due, sc.ID)
+				}
+			}
+			s.mutex.Unlock()
+			for _, id := range due {
+				if err := s.start(id); err != nil {
+					s.Log.Infof("Scheduled command %s skipped: %v", id, err)
+				}
+			}
+		}
+	}
+}
+
+// start starts execution of a scheduled command
+func (s *Schedules) start(id string) error {
+	s.mutex.Lock()
+	i := s.indexUnsafe(id)
+	if i < 0 {
+		s.mutex.Unlock()
+		return fmt.Errorf("unknown id")
+	}
+	if s.running[id] {
+		s.mutex.Unlock()
+		return fmt.Errorf("previous run still running")
+	}
+	s.running[id] = true
+	sc := s.schedules[i]
+	s.mutex.Unlock()
+
+	run := xsapiv1.CmdScheduleRun{
+		CmdID:     "sched_" + id[:8] + "_" + strconv.FormatInt(time.Now().Unix(), 10),
+		Status:    xsapiv1.ScheduleRunStatusRunning,
+		StartedAt: time.Now().String(),
+	}
+	s.setLastRun(id, run)
+	s.Log.Infof("Run scheduled command %s of folder %s [Cmd ID %s]: %s", id, sc.FolderID, run.CmdID, sc.Cmd)
+
+	go s.run(sc, run)
+	return nil
+}
+
+// run executes a scheduled command and records its result
+func (s *Schedules) run(sc xsapiv1.CmdSchedule, run xsapiv1.CmdScheduleRun) {
+	code, err := s.execute(sc, run.CmdID)
+	run.ExitCode = code
+	run.EndedAt = time.Now().String()
+	run.Status = xsapiv1.ScheduleRunStatusDone
+	if err == errScheduleBusy {
+		run.Status = xsapiv1.ScheduleRunStatusSkipped
+		run.Error = err.Error()
+	} else if err != nil {
+		run.Status = xsapiv1.ScheduleRunStatusFailed
+		run.Error = err.Error()
+		s.Log.Infof("Scheduled command %s of folder %s failed: %v", sc.ID, sc.FolderID, err)
+	}
+
+	s.mutex.Lock()
+	delete(s.running, sc.ID)
+	s.mutex.Unlock()
+	s.setLastRun(sc.ID, run)
+}
+
+// execute runs command of a schedule in its folder
+func (s *Schedules) execute(sc xsapiv1.CmdSchedule, cmdID string) (int, error) {
+	fld := s.mfolders.Get(sc.FolderID)
+	if fld == nil {
+		return -1, fmt.Errorf("unknown folder %s", sc.FolderID)
+	}
+	fc := (*fld).GetConfig()
+	if s.folderWatch.IsQuotaExceeded(fc.ID) {
+		return -1, fmt.Errorf("folder disk quota exceeded")
+	}
+	if s.folderCrypt.IsLocked(fc) {
+		return -1, fmt.Errorf("folder is locked")
+	}
+	cmdLine, err := s.autoBuild.folderCommand(fc, (*fld).GetFullPath(""), sc.SdkID, sc.RPath, sc.Cmd)
+	if err != nil {
+		return -1, err
+	}
+
+	// Don't run concurrently with commands of clients
+	if err := s.mfolders.ExecAcquire(fc.ID, fc.Owner, cmdID); err != nil {
+		s.Log.Infof("Scheduled command %s skipped: %v", sc.ID, err)
+		return -1, errScheduleBusy
+	}
+	defer s.mfolders.ExecRelease(fc.ID, cmdID)
+
+	hist := xsapiv1.ExecHistoryEntry{
+		CmdID:    cmdID,
+		FolderID: fc.ID,
+		Cmd:      sc.Cmd,
+		RPath:    sc.RPath,
+		SdkID:    sc.SdkID,
+	}
+	if sc.SdkID == "" {
+		hist.SdkID = fc.DefaultSdk
+	}
+	if sdk := s.sdks.Get(hist.SdkID); sdk != nil {
+		hist.SdkName = sdk.Name
+	}
+	s.execHistory.Start(hist)
+
+	env := append([]string{"XDS_SCHEDULE_ID=" + sc.ID}, s.mfolders.DependenciesEnv(fc.ID)...)
+	env = append(env, s.ccache.Env(fc.ID, sc.SdkID)...)
+	code, err := s.autoBuild.runCommand(fc, cmdID, "", cmdLine, env, sc.TimeoutS)
+	s.execHistory.End(cmdID, code, nil)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exit code %d", code)
+	}
+	return code, err
+}
+
+// setLastRun records result of last run and notifies it
+func (s *Schedules) setLastRun(id string, run xsapiv1.CmdScheduleRun) {
+	s.mutex.Lock()
+	i := s.indexUnsafe(id)
+	if i < 0 {
+		s.mutex.Unlock()
+		return
+	}
+	s.schedules[i].LastRun = &run
+	sc := s.schedules[i]
+	if run.Status != xsapiv1.ScheduleRunStatusRunning {
+		if err := s.save(); err != nil {
+			s.Log.Errorf("Cannot save scheduled commands: %v", err)
+		}
+	}
+	s.mutex.Unlock()
+	s.notify(sc, run)
+}
+
+// notify sends state of a scheduled command (including its last run)
+func (s *Schedules) notify(sc xsapiv1.CmdSchedule, run xsapiv1.CmdScheduleRun) {
+	s.mutex.Lock()
+	msg := s.copyUnsafe(sc)
+	s.mutex.Unlock()
+	msg.LastRun = &run
+	if err := s.events.Emit(xsapiv1.EVTSchedule, msg, ""); err != nil {
+		s.LogSillyf("Cannot notify scheduled command %s: %v", sc.ID, err)
+	}
+}
+
+// indexUnsafe returns index of a schedule or -1 (mutex must be locked)
+func (s *Schedules) indexUnsafe(id string) int {
+	for i, sc := range s.schedules {
+		if sc.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyUnsafe returns a copy of a schedule with its next run (mutex must be locked)
+func (s *Schedules) copyUnsafe(sc xsapiv1.CmdSchedule) xsapiv1.CmdSchedule {
+	res := sc
+	if next, exist := s.next[sc.ID]; exist {
+		res.NextRunAt = next.String()
+	}
+	if sc.LastRun != nil {
+		run := *sc.LastRun
+		res.LastRun = &run
+	}
+	return res
+}
+
+// load reads scheduled commands saved on disk
+func (s *Schedules) load() {
+	file, err := xdsconfig.SchedulesConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		s.Log.Errorf("Cannot read scheduled commands: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlSchedules{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		s.Log.Errorf("Cannot decode scheduled commands: %v", err)
+		return
+	}
+	s.schedules = data.Schedules
+}
+
+// save writes scheduled commands on disk (mutex must be locked)
+func (s *Schedules) save() error {
+	file, err := xdsconfig.SchedulesConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlSchedules{Version: "1", Schedules: s.schedules})
+}
+
+// parseCron parses a cron expression: minute hour day-of-month month
+// day-of-week, fields support *, lists (1,5), ranges (1-5) and steps (*/10)
+func parseCron(expr string) (*cronSpec, error) {
+	if m, exist := scheduleCronMacros[expr]; exist {
+		expr = m
+	}
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s' (5 fields expected)", expr)
+	}
+	c := cronSpec{}
+	var err error
+	if c.minute, _, err = parseCronField(f[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, _, err = parseCronField(f[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, c.domAny, err = parseCronField(f[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, _, err = parseCronField(f[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, c.dowAny, err = parseCronField(f[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Sunday is 0 or 7
+	c.dow[0] = c.dow[0] || c.dow[7]
+	return &c, nil
+}
+
+// parseCronField returns values (indexed by value) of a cron field and true
+// when field is *
+func parseCronField(field string, min, max int) ([]bool, bool, error) {
+	vals := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, false, fmt.Errorf("invalid step in cron field '%s'", field)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, false, fmt.Errorf("invalid cron field '%s'", field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, false, fmt.Errorf("invalid cron field '%s'", field)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, false, fmt.Errorf("out of range value in cron field '%s'", field)
+		}
+		for v := lo; v <= hi; v += step {
+			vals[v] = true
+		}
+	}
+	return vals, field == "*", nil
+}
+
+// match returns true when cron expression matches a time (minute precision)
+func (c *cronSpec) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	// Standard cron behavior: when both days are restricted, either one matches
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching time after a time (zero time when
+// expression never matches, eg. February 30)
+func (c *cronSpec) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < 366*24*60; i++ {
+		if c.match(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
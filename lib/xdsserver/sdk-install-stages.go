@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Marker that add scripts can print on stdout to explicitly notify a new
+// stage, format: "XDS-STAGE: <stage> [<progress>]"
+const sdkInstallStageMarker = "XDS-STAGE:"
+
+// sdkInstallStageRange Part of global progress covered by each stage
+var sdkInstallStageRange = map[string][2]int{
+	xsapiv1.SdkInstallStageQueued:      {0, 0},
+	xsapiv1.SdkInstallStageDownloading: {0, 40},
+	xsapiv1.SdkInstallStageVerifying:   {40, 50},
+	xsapiv1.SdkInstallStageExtracting:  {50, 80},
+	xsapiv1.SdkInstallStageRelocating:  {80, 99},
+	xsapiv1.SdkInstallStageDone:        {100, 100},
+}
+
+// Output of tools used by scripts from which stages are guessed when
+// scripts don't print markers (eg. Yocto SDK installer)
+var sdkInstallStageHints = []struct {
+	match string
+	stage string
+}{
+	{"Downloading ", xsapiv1.SdkInstallStageDownloading},
+	{"Extracting SDK", xsapiv1.SdkInstallStageExtracting},
+	{"Setting it up", xsapiv1.SdkInstallStageRelocating},
+}
+
+// wget (dot progress) and most tools print percentage at end of line
+var reStagePercent = regexp.MustCompile(`(\d{1,3})%`)
+
+// sdkInstallStages Track installation stage from script output
+type sdkInstallStages struct {
+	stage         string
+	stageProgress int
+	pendingLine   string // incomplete stdout line (marker detection)
+}
+
+// newSdkInstallStages creates a new tracker in queued stage
+func newSdkInstallStages() *sdkInstallStages {
+	return &sdkInstallStages{
+		stage:         xsapiv1.SdkInstallStageQueued,
+		stageProgress: -1,
+	}
+}
+
+// Parse updates stage from a chunk of script output and returns stdout
+// without stage markers and whether stage changed
+func (st *sdkInstallStages) Parse(stdout, stderr string) (string, bool) {
+	changed := false
+
+	// Only complete lines are parsed, last one is kept till next call
+	out := []string{}
+	lines := strings.Split(st.pendingLine+stdout, "\n")
+	st.pendingLine = lines[len(lines)-1]
+	for _, l := range lines[:len(lines)-1] {
+		if st.parseLine(l) {
+			changed = true
+		}
+		if !strings.HasPrefix(strings.TrimSpace(l), sdkInstallStageMarker) {
+			out = append(out, l+"\n")
+		}
+	}
+
+	for _, l := range strings.Split(stderr, "\n") {
+		if st.parseLine(l) {
+			changed = true
+		}
+	}
+
+	return strings.Join(out, ""), changed
+}
+
+// Flush returns remaining (incomplete) stdout line
+func (st *sdkInstallStages) Flush() string {
+	l := st.pendingLine
+	st.pendingLine = ""
+	if strings.HasPrefix(strings.TrimSpace(l), sdkInstallStageMarker) {
+		st.parseLine(l)
+		return ""
+	}
+	return l
+}
+
+// Set forces current stage
+func (st *sdkInstallStages) Set(stage string, progress int) {
+	st.stage = stage
+	st.stageProgress = progress
+}
+
+// Stage returns current stage and its progress
+func (st *sdkInstallStages) Stage() (string, int) {
+	return st.stage, st.stageProgress
+}
+
+// Progress returns global installation progress (0 to 100)
+func (st *sdkInstallStages) Progress() int {
+	r, exist := sdkInstallStageRange[st.stage]
+	if !exist {
+		return 0
+	}
+	if st.stageProgress <= 0 {
+		return r[0]
+	}
+	return r[0] + (r[1]-r[0])*st.stageProgress/100
+}
+
+/*** Private functions ***/
+
+// parseLine updates stage from an output line, returns true when stage changed
+func (st *sdkInstallStages) parseLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false
+	}
+
+	// Explicit marker printed by script
+	if strings.HasPrefix(line, sdkInstallStageMarker) {
+		fields := strings.Fields(strings.TrimPrefix(line, sdkInstallStageMarker))
+		if len(fields) == 0 {
+			return false
+		}
+		if _, exist := sdkInstallStageRange[fields[0]]; !exist {
+			return false
+		}
+		progress := -1
+		if len(fields) > 1 {
+			if p, err := strconv.Atoi(strings.TrimSuffix(fields[1], "%")); err == nil {
+				progress = p
+			}
+		}
+		return st.update(fields[0], progress)
+	}
+
+	for _, h := range sdkInstallStageHints {
+		if strings.Contains(line, h.match) {
+			return st.update(h.stage, -1)
+		}
+	}
+
+	// Progress of current stage
+	if m := reStagePercent.FindAllStringSubmatch(line, -1); len(m) > 0 {
+		if p, err := strconv.Atoi(m[len(m)-1][1]); err == nil && p <= 100 {
+			st.stageProgress = p
+		}
+	}
+	return false
+}
+
+// update changes current stage (stages never go backward)
+func (st *sdkInstallStages) update(stage string, progress int) bool {
+	if stage == st.stage {
+		if progress >= 0 {
+			st.stageProgress = progress
+		}
+		return false
+	}
+	if sdkInstallStageRange[stage][1] < sdkInstallStageRange[st.stage][1] {
+		return false
+	}
+	st.stage = stage
+	st.stageProgress = progress
+	return true
+}
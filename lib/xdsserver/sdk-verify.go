@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Files checksums manifest (sha256sum format) saved in SDK directory
+const sdkManifestFilename = ".xds-manifest.sha256"
+
+// Verify checks integrity of an installed SDK and returns its health
+func (s *CrossSDK) Verify(createManifest bool) xsapiv1.SDKHealth {
+	sdk := s.sdk
+	h := xsapiv1.SDKHealth{
+		Status: xsapiv1.SdkHealthOK,
+		Date:   time.Now().Format("2006-01-02 15:04:05"),
+		Checks: []xsapiv1.SDKHealthCheck{},
+	}
+	add := func(c xsapiv1.SDKHealthCheck) {
+		if !c.OK && !c.Skipped {
+			h.Status = xsapiv1.SdkHealthFailed
+		}
+		h.Checks = append(h.Checks, c)
+	}
+
+	// Setup file sourcing
+	env, err := sourceSetupFile(sdk.SetupFile)
+	if err != nil {
+		add(xsapiv1.SDKHealthCheck{Name: "setup", Message: err.Error()})
+		return h
+	}
+	add(xsapiv1.SDKHealthCheck{Name: "setup", OK: true, Message: sdk.SetupFile})
+
+	// Sysroot paths
+	chk := xsapiv1.SDKHealthCheck{Name: "sysroot", OK: true}
+	paths := []string{}
+	for _, v := range []string{"SDKTARGETSYSROOT", "OECORE_NATIVE_SYSROOT"} {
+		if p := env[v]; p != "" {
+			paths = append(paths, p)
+			if !common.IsDir(p) {
+				chk.OK = false
+				chk.Message = fmt.Sprintf("%s not accessible (%s)", v, p)
+				break
+			}
+		}
+	}
+	if len(paths) == 0 {
+		chk.OK = false
+		chk.Message = "SDKTARGETSYSROOT not set"
+	} else if chk.OK {
+		chk.Message = strings.Join(paths, ", ")
+	}
+	add(chk)
+
+	// Key binaries
+	for _, v := range []string{"CC", "CXX", "CLANGCC"} {
+		if env[v] == "" {
+			if v == "CC" {
+				add(xsapiv1.SDKHealthCheck{Name: "compiler", Skipped: true, Message: "CC not set"})
+			}
+			continue
+		}
+		chk := xsapiv1.SDKHealthCheck{Name: "compiler", OK: true}
+		out, err := exec.Command("bash", "-c", `source "$0" >/dev/null && eval "$`+v+` --version"`, sdk.SetupFile).CombinedOutput()
+		firstLine := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+		if err != nil {
+			chk.OK = false
+			chk.Message = fmt.Sprintf("%s (%s) failed: %v %s", v, env[v], err, firstLine)
+		} else {
+			chk.Message = v + ": " + firstLine
+		}
+		add(chk)
+	}
+
+	// Files checksums
+	manifest := filepath.Join(sdk.Path, sdkManifestFilename)
+	if createManifest {
+		nb, err := createSdkManifest(sdk.Path, manifest)
+		if err != nil {
+			add(xsapiv1.SDKHealthCheck{Name: "manifest", Message: err.Error()})
+		} else {
+			add(xsapiv1.SDKHealthCheck{Name: "manifest", OK: true, Message: fmt.Sprintf("manifest created (%d files)", nb)})
+		}
+	} else if !common.Exists(manifest) {
+		add(xsapiv1.SDKHealthCheck{Name: "manifest", Skipped: true, Message: "no manifest (use createManifest to create it)"})
+	} else {
+		nb, err := checkSdkManifest(sdk.Path, manifest)
+		if err != nil {
+			add(xsapiv1.SDKHealthCheck{Name: "manifest", Message: err.Error()})
+		} else {
+			add(xsapiv1.SDKHealthCheck{Name: "manifest", OK: true, Message: fmt.Sprintf("%d files checked", nb)})
+		}
+	}
+
+	return h
+}
+
+/*** Private functions ***/
+
+// sourceSetupFile sources an environment setup file and returns resulting env
+func sourceSetupFile(setupFile string) (map[string]string, error) {
+	if setupFile == "" || !common.Exists(setupFile) {
+		return nil, fmt.Errorf("setup file not accessible (%s)", setupFile)
+	}
+	out, err := exec.Command("bash", "-c", `source "$0" >/dev/null && env`, setupFile).Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot source setup file %s: %v", setupFile, err)
+	}
+	env := make(map[string]string)
+	for _, l := range strings.Split(string(out), "\n") {
+		if kv := strings.SplitN(l, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env, nil
+}
+
+func fileSha256(file string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// createSdkManifest computes checksums of all regular files of a SDK
+func createSdkManifest(dir, manifest string) (int, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && p != manifest {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot list SDK files: %v", err)
+	}
+	sort.Strings(files)
+
+	fd, err := os.OpenFile(manifest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create manifest: %v", err)
+	}
+	defer fd.Close()
+
+	w := bufio.NewWriter(fd)
+	for _, f := range files {
+		sum, err := fileSha256(f)
+		if err != nil {
+			return 0, fmt.Errorf("cannot compute checksum of %s: %v", f, err)
+		}
+		rel, _ := filepath.Rel(dir, f)
+		fmt.Fprintf(w, "%s  %s\n", sum, rel)
+	}
+	return len(files), w.Flush()
+}
+
+// checkSdkManifest checks that files checksums match manifest
+func checkSdkManifest(dir, manifest string) (int, error) {
+	fd, err := os.Open(manifest)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	nb := 0
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		sum, err := fileSha256(filepath.Join(dir, fields[1]))
+		if err != nil {
+			return nb, fmt.Errorf("file %s: %v", fields[1], err)
+		}
+		if sum != fields[0] {
+			return nb, fmt.Errorf("checksum mismatch: %s", fields[1])
+		}
+		nb++
+	}
+	return nb, scanner.Err()
+}
@@ -20,7 +20,6 @@ package xdsserver
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"os/exec"
 	"path"
 	"strconv"
@@ -42,6 +41,9 @@ const (
 	scriptGetFamConfig = "get-family-config"
 	scriptGetSdkInfo   = "get-sdk-info"
 	scriptRemove       = "remove"
+
+	// Optional scripts
+	scriptCheckPrereq = "check-prereq"
 )
 
 var scriptsAll = []string{
@@ -62,9 +64,10 @@ type CrossSDK struct {
 	scripts    map[string]string
 	installCmd *eows.ExecOverWS
 	removeCmd  *eows.ExecOverWS
+	localDir   bool // registered from an already extracted directory (see InstallFromDir)
 
-	bufStdout string
-	bufStderr string
+	installOut *outBatcher
+	stages     *sdkInstallStages
 }
 
 // ListCrossSDK List all available and installed SDK  (call "db-dump" script)
@@ -115,31 +118,85 @@ func GetSDKInfo(scriptDir, url, filename, md5sum string, log *logrus.Logger) (xs
 	return sdk, nil
 }
 
-// NewCrossSDK creates a new instance of CrossSDK
-func NewCrossSDK(ctx *Context, sdk xsapiv1.SDK, scriptDir string) (*CrossSDK, error) {
-	s := CrossSDK{
-		Context: ctx,
-		sdk:     sdk,
-		scripts: make(map[string]string),
-	}
+// GetSDKFamilyConfig Used get-family-config script to retrieve SDK family configuration
+func GetSDKFamilyConfig(scriptDir string, log *logrus.Logger) (xsapiv1.SDKFamilyConfig, error) {
+	famConf := xsapiv1.SDKFamilyConfig{}
 
 	// Execute get-config script to retrieve SDK configuration
 	getConfFile := path.Join(scriptDir, scriptGetFamConfig)
 	if !common.Exists(getConfFile) {
-		return &s, fmt.Errorf("'%s' script file not found in %s", scriptGetFamConfig, scriptDir)
+		return famConf, fmt.Errorf("'%s' script file not found in %s", scriptGetFamConfig, scriptDir)
 	}
 
 	cmd := exec.Command(getConfFile)
 	stdout, err := cmd.CombinedOutput()
 	if err != nil {
-		return &s, fmt.Errorf("Cannot get sdk config using %s: %v", getConfFile, err)
+		return famConf, fmt.Errorf("Cannot get sdk config using %s: %v", getConfFile, err)
+	}
+
+	err = json.Unmarshal(stdout, &famConf)
+	if err != nil {
+		log.Errorf("SDK config script output:\n%v\n", string(stdout))
+		return famConf, fmt.Errorf("Cannot decode sdk config %v", err)
+	}
+	return famConf, nil
+}
+
+// CheckSDKFamilyPrerequisites Check that host tools needed to install SDKs of
+// a family are present (declared binaries and optional check-prereq script)
+func CheckSDKFamilyPrerequisites(famConf xsapiv1.SDKFamilyConfig, log *logrus.Logger) xsapiv1.SDKPrerequisites {
+	res := xsapiv1.SDKPrerequisites{
+		FamilyName: famConf.FamilyName,
+		Required:   famConf.Prerequisites,
+		Missing:    []string{},
 	}
+	if res.Required == nil {
+		res.Required = []string{}
+	}
+
+	for _, bin := range famConf.Prerequisites {
+		if _, err := exec.LookPath(bin); err != nil {
+			res.Missing = append(res.Missing, bin)
+		}
+	}
+
+	// Script returns list of missing items (eg. packages) using JSON format
+	script := path.Join(famConf.ScriptsDir, scriptCheckPrereq)
+	if famConf.ScriptsDir != "" && common.Exists(script) {
+		missing := []string{}
+		stdout, err := exec.Command(script).Output()
+		if err != nil {
+			res.Error = fmt.Sprintf("%s script error: %v", scriptCheckPrereq, err)
+		} else if err := json.Unmarshal(stdout, &missing); err != nil {
+			log.Errorf("SDK %s script output:\n%v\n", scriptCheckPrereq, string(stdout))
+			res.Error = fmt.Sprintf("Cannot decode %s output: %v", scriptCheckPrereq, err)
+		} else {
+			res.Missing = append(res.Missing, missing...)
+		}
+	}
+
+	res.OK = len(res.Missing) == 0 && res.Error == ""
+	return res
+}
 
-	err = json.Unmarshal(stdout, &s.sdk.FamilyConf)
+// NewCrossSDK creates a new instance of CrossSDK
+func NewCrossSDK(ctx *Context, sdk xsapiv1.SDK, scriptDir string) (*CrossSDK, error) {
+	famConf, err := GetSDKFamilyConfig(scriptDir, ctx.Log)
 	if err != nil {
-		s.Log.Errorf("SDK config script output:\n%v\n", string(stdout))
-		return &s, fmt.Errorf("Cannot decode sdk config %v", err)
+		return &CrossSDK{Context: ctx, sdk: sdk, scripts: make(map[string]string)}, err
+	}
+	return newCrossSDKFromFamily(ctx, sdk, scriptDir, famConf)
+}
+
+// newCrossSDKFromFamily creates a new instance of CrossSDK using an already
+// retrieved family configuration
+func newCrossSDKFromFamily(ctx *Context, sdk xsapiv1.SDK, scriptDir string, famConf xsapiv1.SDKFamilyConfig) (*CrossSDK, error) {
+	s := CrossSDK{
+		Context: ctx,
+		sdk:     sdk,
+		scripts: make(map[string]string),
 	}
+	s.sdk.FamilyConf = famConf
 	famName := s.sdk.FamilyConf.FamilyName
 
 	// Sanity check
@@ -188,6 +245,10 @@ func NewCrossSDK(ctx *Context, sdk xsapiv1.SDK, scriptDir string) (*CrossSDK, er
 		}
 	}
 
+	if s.sdk.Health.Status == "" {
+		s.sdk.Health.Status = xsapiv1.SdkHealthUnknown
+	}
+
 	// Use V3 to ensure that we get same uuid on restart
 	nm := s.sdk.Name
 	if nm == "" {
@@ -233,27 +294,18 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 	// Create new instance to execute command and sent output over WS
 	s.installCmd = eows.New(s.scripts[scriptAdd], cmdArgs, sess.IOSocket, sess.ID, cmdID)
 	s.installCmd.Log = s.Log
+	s.installCmd.Env = append(s.installCmd.Env, s.cancels.EnvMarker(cmdID))
 	if timeout > 0 {
 		s.installCmd.CmdExecTimeout = timeout
 	} else {
 		s.installCmd.CmdExecTimeout = 30 * 60 // default 30min
 	}
 
-	// FIXME: temporary hack
-	s.bufStdout = ""
-	s.bufStderr = ""
-	SizeBufStdout := 10
-	SizeBufStderr := 2000
-	if valS, ok := os.LookupEnv("XDS_SDK_BUF_STDOUT"); ok {
-		if valI, err := strconv.Atoi(valS); err == nil {
-			SizeBufStdout = valI
-		}
-	}
-	if valS, ok := os.LookupEnv("XDS_SDK_BUF_STDERR"); ok {
-		if valI, err := strconv.Atoi(valS); err == nil {
-			SizeBufStderr = valI
-		}
-	}
+	// Output is batched to avoid freeze in web Browser (see OutputStreams)
+	s.stages = newSdkInstallStages()
+	s.installOut = s.outStreams.newBatcher(sess.ID, func(stdout, stderr string) {
+		s.emitInstallOutput(sess.ID, cmdID, stdout, stderr)
+	})
 
 	// Define callback for output (stdout+stderr)
 	s.installCmd.OutputCB = func(e *eows.ExecOverWS, stdout, stderr string) {
@@ -264,13 +316,6 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 			s.Log.Errorln("BUG: sdk ID differs: %v != %v", sdkID, s.sdk.ID)
 		}
 
-		// IO socket can be nil when disconnected
-		so := s.sessions.IOSocketGet(e.Sid)
-		if so == nil {
-			s.Log.Infof("%s not emitted: WS closed (sid:%s, msgid:%s)", xsapiv1.EVTSDKInstall, e.Sid, e.CmdID)
-			return
-		}
-
 		if s.LogLevelSilly {
 			s.Log.Debugf("%s emitted - WS sid[4:] %s - id:%s - SDK ID:%s:", xsapiv1.EVTSDKInstall, e.Sid[4:], e.CmdID, sdkID[:16])
 			if stdout != "" {
@@ -281,26 +326,12 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 			}
 		}
 
-		// Temporary "Hack": Buffered sent data to avoid freeze in web Browser
-		// FIXME: remove bufStdout & bufStderr and implement better algorithm
-		s.bufStdout += stdout
-		s.bufStderr += stderr
-		if len(s.bufStdout) > SizeBufStdout || len(s.bufStderr) > SizeBufStderr {
-			// Emit event
-			err := (*so).Emit(xsapiv1.EVTSDKInstall, xsapiv1.SDKManagementMsg{
-				CmdID:     e.CmdID,
-				Timestamp: time.Now().String(),
-				Sdk:       s.sdk,
-				Progress:  0, // TODO add progress
-				Exited:    false,
-				Stdout:    s.bufStdout,
-				Stderr:    s.bufStderr,
-			})
-			if err != nil {
-				s.Log.Errorf("WS Emit : %v", err)
-			}
-			s.bufStdout = ""
-			s.bufStderr = ""
+		stdout, stageChanged := s.stages.Parse(stdout, stderr)
+
+		// New stage is sent immediately
+		s.installOut.Write(stdout, stderr)
+		if stageChanged && !s.installOut.Flush() {
+			s.emitInstallOutput(e.Sid, e.CmdID, "", "")
 		}
 	}
 
@@ -315,30 +346,9 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 
 		s.Log.Infof("Command SDK ID %s [Cmd ID %s]  exited: code %d, exitError: %v", sdkID[:16], e.CmdID, code, exitError)
 
-		// IO socket can be nil when disconnected
-		so := s.sessions.IOSocketGet(e.Sid)
-		if so == nil {
-			s.Log.Infof("%s (exit) not emitted - WS closed (id:%s)", xsapiv1.EVTSDKInstall, e.CmdID)
-			return
-		}
-
-		// Emit event remaining data in bufStdout/err
-		if len(s.bufStderr) > 0 || len(s.bufStdout) > 0 {
-			err := (*so).Emit(xsapiv1.EVTSDKInstall, xsapiv1.SDKManagementMsg{
-				CmdID:     e.CmdID,
-				Timestamp: time.Now().String(),
-				Sdk:       s.sdk,
-				Progress:  50, // TODO add progress
-				Exited:    false,
-				Stdout:    s.bufStdout,
-				Stderr:    s.bufStderr,
-			})
-			if err != nil {
-				s.Log.Errorf("WS Emit : %v", err)
-			}
-			s.bufStdout = ""
-			s.bufStderr = ""
-		}
+		// Emit remaining output
+		s.installOut.Write(s.stages.Flush(), "")
+		s.installOut.Flush()
 
 		// Update SDK status
 		if code == 0 && exitError == nil {
@@ -368,6 +378,12 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 			s.sdk.Status = xsapiv1.SdkStatusNotInstalled
 		}
 
+		// Failed installation keeps the stage in which error occurred
+		if s.sdk.Status == xsapiv1.SdkStatusInstalled {
+			s.stages.Set(xsapiv1.SdkInstallStageDone, 100)
+		}
+		stage, stageProgress := s.stages.Stage()
+
 		emitErr := ""
 		if exitError != nil {
 			emitErr = exitError.Error()
@@ -376,8 +392,8 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 			emitErr = s.sdk.LastError
 		}
 
-		// Emit event
-		errSoEmit := (*so).Emit(xsapiv1.EVTSDKInstall, xsapiv1.SDKManagementMsg{
+		// Emit event (sent after queued output)
+		s.outStreams.Emit(e.Sid, xsapiv1.EVTSDKInstall, xsapiv1.SDKManagementMsg{
 			CmdID:     e.CmdID,
 			Timestamp: time.Now().String(),
 			Sdk:       s.sdk,
@@ -385,10 +401,10 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 			Exited:    true,
 			Code:      code,
 			Error:     emitErr,
-		})
-		if errSoEmit != nil {
-			s.Log.Errorf("WS Emit : %v", errSoEmit)
-		}
+
+			Stage:         stage,
+			StageProgress: stageProgress,
+		}, 0)
 
 		// Cleanup command for the next time
 		s.installCmd = nil
@@ -405,11 +421,31 @@ func (s *CrossSDK) Install(file string, force bool, timeout int, args []string,
 	s.sdk.Status = xsapiv1.SdkStatusInstalling
 	s.sdk.LastError = ""
 
+	// Notify that installation is queued
+	s.emitInstallOutput(sess.ID, cmdID, "", "")
+
 	err := s.installCmd.Start()
 
 	return err
 }
 
+// emitInstallOutput sends batched output and current stage of installation
+func (s *CrossSDK) emitInstallOutput(sid, cmdID, stdout, stderr string) {
+	stage, stageProgress := s.stages.Stage()
+	s.outStreams.Emit(sid, xsapiv1.EVTSDKInstall, xsapiv1.SDKManagementMsg{
+		CmdID:     cmdID,
+		Timestamp: time.Now().String(),
+		Sdk:       s.sdk,
+		Progress:  s.stages.Progress(),
+		Exited:    false,
+		Stdout:    stdout,
+		Stderr:    stderr,
+
+		Stage:         stage,
+		StageProgress: stageProgress,
+	}, len(stdout)+len(stderr))
+}
+
 // AbortInstallRemove abort an install or remove command
 func (s *CrossSDK) AbortInstallRemove(timeout int) error {
 
@@ -418,7 +454,7 @@ func (s *CrossSDK) AbortInstallRemove(timeout int) error {
 	}
 
 	s.sdk.Status = xsapiv1.SdkStatusNotInstalled
-	return s.installCmd.Signal("SIGKILL")
+	return s.cancels.Cancel(s.installCmd.CmdID, timeout)
 }
 
 // Remove Used to remove/uninstall a SDK
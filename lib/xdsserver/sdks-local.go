@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Use XML format and not json to be able to save/load all fields including
+// ones that are masked in json (IOW defined with `json:"-"`)
+type xmlLocalSdks struct {
+	XMLName xml.Name      `xml:"sdks"`
+	Version string        `xml:"version,attr"`
+	Sdks    []xsapiv1.SDK `xml:"sdks"`
+}
+
+var reEnvExport = regexp.MustCompile(`^\s*export\s+([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// InstallFromDir Register an already extracted SDK (no download nor extract)
+func (s *SDKs) InstallFromDir(dir string, force bool) (*xsapiv1.SDK, error) {
+	dir = filepath.Clean(dir)
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("invalid parameter, dir must be an absolute path")
+	}
+	if !common.IsDir(dir) {
+		return nil, fmt.Errorf("SDK directory not accessible (%s)", dir)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	famConf, setupFile, err := s.findFamilyFromDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sdk, err := sdkFromSetupFile(dir, setupFile, famConf)
+	if err != nil {
+		return nil, err
+	}
+
+	cSdk, err := newCrossSDKFromFamily(s.Context, sdk, famConf.ScriptsDir, famConf)
+	if err != nil {
+		return nil, err
+	}
+	cSdk.localDir = true
+
+	if err := s._addCrossSDK(cSdk, false, force); err != nil {
+		return nil, err
+	}
+
+	if err := s.saveLocalSDKs(); err != nil {
+		s.Log.Errorf("Cannot save local SDKs list: %v", err)
+	}
+
+	s.Log.Infof("SDK %s registered from directory %s", cSdk.sdk.Name, dir)
+
+	evData := xsapiv1.SDKManagementMsg{
+		Timestamp: time.Now().String(),
+		Sdk:       cSdk.sdk,
+		Progress:  100,
+		Exited:    true,
+	}
+	if err := s.events.Emit(xsapiv1.EVTSDKInstall, evData, ""); err != nil {
+		s.Log.Warningf("Cannot notify SDK install: %v", err)
+	}
+
+	return &cSdk.sdk, nil
+}
+
+/*** Private functions ***/
+
+// findFamilyFromDir returns the family whose environment setup file is
+// present in dir (mutex must be locked)
+func (s *SDKs) findFamilyFromDir(dir string) (xsapiv1.SDKFamilyConfig, string, error) {
+	names := []string{}
+	for name := range s.SdksFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	patterns := []string{}
+	for _, name := range names {
+		sf := s.SdksFamilies[name]
+		matches, err := filepath.Glob(filepath.Join(dir, sf.EnvSetupFile))
+		if err == nil && len(matches) > 0 {
+			if len(matches) > 1 {
+				return *sf, "", fmt.Errorf("several environment setup files found in %s: %v", dir, matches)
+			}
+			return *sf, matches[0], nil
+		}
+		patterns = append(patterns, sf.EnvSetupFile)
+	}
+	if len(patterns) == 0 {
+		return xsapiv1.SDKFamilyConfig{}, "", fmt.Errorf("no SDK family defined")
+	}
+	return xsapiv1.SDKFamilyConfig{}, "", fmt.Errorf("no environment setup file found in %s (expected %s)", dir, strings.Join(patterns, " or "))
+}
+
+// sdkFromSetupFile builds a SDK definition by parsing its environment setup file
+func sdkFromSetupFile(dir, setupFile string, famConf xsapiv1.SDKFamilyConfig) (xsapiv1.SDK, error) {
+	sdk := xsapiv1.SDK{}
+
+	fi, err := os.Stat(setupFile)
+	if err != nil || !fi.Mode().IsRegular() {
+		return sdk, fmt.Errorf("invalid environment setup file %s", setupFile)
+	}
+
+	fd, err := os.Open(setupFile)
+	if err != nil {
+		return sdk, err
+	}
+	defer fd.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		m := reEnvExport.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		env[m[1]] = strings.Trim(strings.TrimSpace(m[2]), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return sdk, fmt.Errorf("cannot read environment setup file: %v", err)
+	}
+
+	// Sanity check
+	sysroot, exist := env["SDKTARGETSYSROOT"]
+	if !exist {
+		return sdk, fmt.Errorf("invalid environment setup file %s (SDKTARGETSYSROOT not set)", setupFile)
+	}
+	if !strings.Contains(sysroot, "$") && !common.IsDir(sysroot) {
+		return sdk, fmt.Errorf("SDK sysroot not accessible (%s)", sysroot)
+	}
+
+	// Arch is encoded in setup filename (eg. environment-setup-aarch64-agl-linux)
+	arch := env["OECORE_TARGET_ARCH"]
+	if arch == "" {
+		prefix := strings.TrimSuffix(famConf.EnvSetupFile, "*")
+		arch = strings.SplitN(strings.TrimPrefix(filepath.Base(setupFile), prefix), "-", 2)[0]
+	}
+	version := env["OECORE_SDK_VERSION"]
+	if version == "" {
+		version = env["OECORE_DISTRO_VERSION"]
+	}
+	if arch == "" || version == "" {
+		return sdk, fmt.Errorf("cannot retrieve SDK arch or version from %s", setupFile)
+	}
+
+	sdk = xsapiv1.SDK{
+		Name:        famConf.FamilyName + "-" + arch + "-" + version,
+		Description: famConf.Description + " " + arch + " (version " + version + ", local directory)",
+		Profile:     famConf.FamilyName,
+		Version:     version,
+		Arch:        arch,
+		Path:        dir,
+		Status:      xsapiv1.SdkStatusInstalled,
+		Date:        fi.ModTime().Format("2006-01-02 15:04"),
+		SetupFile:   setupFile,
+	}
+	return sdk, nil
+}
+
+// loadLocalSDKs adds SDKs registered from a local directory (mutex must be locked)
+func (s *SDKs) loadLocalSDKs() int {
+	file, err := xdsconfig.LocalSdksConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return 0
+	}
+
+	fd, err := os.Open(file)
+	if err != nil {
+		s.Log.Errorf("Cannot read local SDKs list: %v", err)
+		return 0
+	}
+	defer fd.Close()
+
+	data := xmlLocalSdks{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		s.Log.Errorf("Cannot decode local SDKs list: %v", err)
+		return 0
+	}
+
+	nb := 0
+	for _, sdk := range data.Sdks {
+		famConf, exist := s.SdksFamilies[sdk.FamilyConf.FamilyName]
+		if !exist {
+			s.Log.Warningf("Local SDK %s ignored: unknown family '%s'", sdk.Name, sdk.FamilyConf.FamilyName)
+			continue
+		}
+		cSdk, err := newCrossSDKFromFamily(s.Context, sdk, famConf.ScriptsDir, *famConf)
+		if err != nil {
+			s.Log.Warningf("Local SDK %s ignored: %v", sdk.Name, err)
+			continue
+		}
+		cSdk.localDir = true
+		if err := s._addCrossSDK(cSdk, false, true); err != nil {
+			s.Log.Warningf("Local SDK %s ignored: %v", sdk.Name, err)
+			continue
+		}
+		nb++
+	}
+	return nb
+}
+
+// saveLocalSDKs writes SDKs registered from a local directory on disk (mutex must be locked)
+func (s *SDKs) saveLocalSDKs() error {
+	file, err := xdsconfig.LocalSdksConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	data := &xmlLocalSdks{
+		Version: "1",
+		Sdks:    []xsapiv1.SDK{},
+	}
+	for _, cSdk := range s.Sdks {
+		if cSdk.localDir {
+			data.Sdks = append(data.Sdks, cSdk.sdk)
+		}
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(data)
+}
+
+// unregisterLocalSDK removes a SDK registered from a local directory (mutex must be locked)
+func (s *SDKs) unregisterLocalSDK(cSdk *CrossSDK) (*xsapiv1.SDK, error) {
+	delete(s.Sdks, cSdk.sdk.ID)
+	if err := s.saveLocalSDKs(); err != nil {
+		s.Log.Errorf("Cannot save local SDKs list: %v", err)
+	}
+
+	sdk := cSdk.sdk
+	sdk.Status = xsapiv1.SdkStatusNotInstalled
+	s.Log.Infof("SDK %s unregistered (directory %s kept)", sdk.Name, sdk.Path)
+
+	evData := xsapiv1.SDKManagementMsg{
+		Timestamp: time.Now().String(),
+		Sdk:       sdk,
+		Progress:  100,
+		Exited:    true,
+	}
+	if err := s.events.Emit(xsapiv1.EVTSDKRemove, evData, ""); err != nil {
+		s.Log.Warningf("Cannot notify SDK remove: %v", err)
+	}
+	return &sdk, nil
+}
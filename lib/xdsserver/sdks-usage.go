@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+// sdkUsage Usage statistics and owner of a SDK
+type sdkUsage struct {
+	ID        string `xml:"id,attr"`
+	LastUsed  string `xml:"lastUsed"`
+	Count     int    `xml:"count"`
+	Owner     string `xml:"owner,omitempty"`
+	OwnerUser string `xml:"ownerUser,omitempty"`
+}
+
+type xmlSdksUsage struct {
+	XMLName xml.Name   `xml:"sdks-usage"`
+	Version string     `xml:"version,attr"`
+	Sdks    []sdkUsage `xml:"sdk"`
+}
+
+// SetOwner records the session (and its authenticated user) that installed a SDK
+func (s *SDKs) SetOwner(id, sid, user string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cSdk, exist := s.Sdks[id]
+	if !exist {
+		return
+	}
+	u, exist := s.usage[id]
+	if !exist {
+		u = &sdkUsage{ID: id}
+		s.usage[id] = u
+	}
+	u.Owner = sid
+	u.OwnerUser = user
+	cSdk.sdk.Owner = sid
+	cSdk.sdk.OwnerUser = user
+
+	if err := s.saveUsage(); err != nil {
+		s.Log.Errorf("Cannot save SDKs usage: %v", err)
+	}
+}
+
+/*** Private functions ***/
+
+// recordUsage updates usage statistics of a SDK (mutex must be locked)
+func (s *SDKs) recordUsage(cSdk *CrossSDK) {
+	u, exist := s.usage[cSdk.sdk.ID]
+	if !exist {
+		u = &sdkUsage{ID: cSdk.sdk.ID}
+		s.usage[cSdk.sdk.ID] = u
+	}
+	u.Count++
+	u.LastUsed = time.Now().Format(time.RFC3339)
+
+	cSdk.sdk.UsageCount = u.Count
+	cSdk.sdk.LastUsed = u.LastUsed
+
+	if err := s.saveUsage(); err != nil {
+		s.Log.Errorf("Cannot save SDKs usage: %v", err)
+	}
+}
+
+// loadUsage reads usage statistics from disk (mutex must be locked)
+func (s *SDKs) loadUsage() {
+	file, err := xdsconfig.SdksUsageFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		s.Log.Errorf("Cannot read SDKs usage: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlSdksUsage{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		s.Log.Errorf("Cannot decode SDKs usage: %v", err)
+		return
+	}
+	for i, u := range data.Sdks {
+		s.usage[u.ID] = &data.Sdks[i]
+	}
+}
+
+// saveUsage writes usage statistics on disk (mutex must be locked)
+func (s *SDKs) saveUsage() error {
+	file, err := xdsconfig.SdksUsageFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	data := &xmlSdksUsage{Version: "1", Sdks: []sdkUsage{}}
+	for _, u := range s.usage {
+		data.Sdks = append(data.Sdks, *u)
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(data)
+}
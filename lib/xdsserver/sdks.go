@@ -18,24 +18,48 @@
 package xdsserver
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	common "github.com/iotbzh/xds-common/golib"
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
+// Maximum number of SDK families discovered concurrently
+const maxSdkDiscoveryWorkers = 4
+
+// Time (in seconds) between two checks of new or removed SDK families
+const sdkFamiliesMonitorTime = 30
+
 // SDKs List of installed SDK
 type SDKs struct {
 	*Context
 	Sdks         map[string]*CrossSDK
 	SdksFamilies map[string]*xsapiv1.SDKFamilyConfig
 
-	mutex sync.Mutex
-	stop  chan struct{} // signals intentional stop
+	changes    map[string]*sdkChange // used to detect SDKs changes (see GetAllChangedSince)
+	scriptsDir string
+	badFamDirs map[string]bool // family directories with an invalid config
+	usage      map[string]*sdkUsage
+	mutex      sync.Mutex
+	stop       chan struct{} // signals intentional stop
+}
+
+// sdkChange Hold content hash and last modification date of a SDK
+// (removed SDKs are kept as tombstones to report their removal)
+type sdkChange struct {
+	hash    string
+	date    time.Time
+	removed bool
 }
 
 // NewSDKs creates a new instance of SDKs
@@ -44,6 +68,9 @@ func NewSDKs(ctx *Context) (*SDKs, error) {
 		Context:      ctx,
 		Sdks:         make(map[string]*CrossSDK),
 		SdksFamilies: make(map[string]*xsapiv1.SDKFamilyConfig),
+		changes:      make(map[string]*sdkChange),
+		badFamDirs:   make(map[string]bool),
+		usage:        make(map[string]*sdkUsage),
 		stop:         make(chan struct{}),
 	}
 
@@ -56,44 +83,26 @@ func NewSDKs(ctx *Context) (*SDKs, error) {
 		}
 	}
 	s.Log.Infof("SDK scripts dir: %s", scriptsDir)
+	s.scriptsDir = scriptsDir
 
-	dirs, err := filepath.Glob(path.Join(scriptsDir, "*"))
+	famDirs, err := s.listFamilyDirs()
 	if err != nil {
-		s.Log.Errorf("Error while retrieving SDK scripts: dir=%s, error=%s", scriptsDir, err.Error())
 		return &s, err
 	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Foreach directories in scripts/sdk
-	nbInstalled := 0
-	for _, d := range dirs {
-		if !common.IsDir(d) {
-			continue
-		}
-
-		sdksList, err := ListCrossSDK(d, s.Log)
-		if err != nil {
-			// allow to use XDS even if error on list
-			s.Log.Errorf("Cannot retrieve SDK list: %v", err)
-		}
-		s.LogSillyf("'%s' SDKs list: %v", d, sdksList)
-
-		for _, sdk := range sdksList {
-			cSdk, err := s._createNewCrossSDK(sdk, d, false, false)
-			if err != nil {
-				s.Log.Debugf("Error while processing SDK sdk=%v\n err=%s", sdk, err.Error())
-				continue
-			}
+	// Usage statistics must be loaded before SDKs are added
+	s.loadUsage()
 
-			if cSdk.sdk.Status == xsapiv1.SdkStatusInstalled {
-				nbInstalled++
-			}
+	// Foreach directories in scripts/sdk, retrieve family config and SDKs
+	// list concurrently (scripts may be slow)
+	results := s.discoverFamilies(famDirs)
+	nbInstalled := s._addFamilies(results)
 
-			s.SdksFamilies[cSdk.sdk.FamilyConf.FamilyName] = &cSdk.sdk.FamilyConf
-		}
-	}
+	// Add SDKs registered from a local directory
+	nbInstalled += s.loadLocalSDKs()
 
 	ctx.Log.Debugf("Cross SDKs: %d defined, %d installed", len(s.Sdks), nbInstalled)
 
@@ -111,9 +120,232 @@ func NewSDKs(ctx *Context) (*SDKs, error) {
 		*/
 	}
 
+	// Detect new or removed families at runtime
+	go s.monitorFamilies()
+
 	return &s, nil
 }
 
+// sdkFamilyResult Result of the discovery of one SDK family
+type sdkFamilyResult struct {
+	dir     string
+	famConf *xsapiv1.SDKFamilyConfig
+	sdks    []*CrossSDK
+	errs    []error
+}
+
+// discoverFamilies retrieves family config and SDKs list of each scripts
+// directory using a bounded pool of workers
+func (s *SDKs) discoverFamilies(famDirs []string) []*sdkFamilyResult {
+	results := make([]*sdkFamilyResult, len(famDirs))
+
+	nbWorkers := runtime.NumCPU()
+	if nbWorkers > maxSdkDiscoveryWorkers {
+		nbWorkers = maxSdkDiscoveryWorkers
+	}
+
+	jobs := make(chan int, len(famDirs))
+	for i := range famDirs {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < nbWorkers && w < len(famDirs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = s.discoverFamily(famDirs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// discoverFamily retrieves family config and SDKs list of one scripts directory
+func (s *SDKs) discoverFamily(d string) *sdkFamilyResult {
+	res := &sdkFamilyResult{dir: d, sdks: []*CrossSDK{}, errs: []error{}}
+
+	famConf, err := GetSDKFamilyConfig(d, s.Log)
+	if err != nil {
+		res.errs = append(res.errs, err)
+		return res
+	}
+	res.famConf = &famConf
+
+	sdksList, err := ListCrossSDK(d, s.Log)
+	if err != nil {
+		// allow to use XDS even if error on list
+		s.Log.Errorf("Cannot retrieve SDK list: %v", err)
+		res.errs = append(res.errs, err)
+	}
+	s.LogSillyf("'%s' SDKs list: %v", d, sdksList)
+
+	for _, sdk := range sdksList {
+		cSdk, err := newCrossSDKFromFamily(s.Context, sdk, d, famConf)
+		if err != nil {
+			s.Log.Debugf("Error while processing SDK sdk=%v\n err=%s", sdk, err.Error())
+			res.errs = append(res.errs, err)
+			continue
+		}
+		res.sdks = append(res.sdks, cSdk)
+	}
+	return res
+}
+
+// _addFamilies Private function to add discovered families and their SDKs
+// (mutex must be locked), returns the number of installed SDKs
+func (s *SDKs) _addFamilies(results []*sdkFamilyResult) int {
+	nbInstalled := 0
+	for _, res := range results {
+		if res.famConf != nil && res.famConf.FamilyName != "" {
+			if res.famConf.ScriptsDir == "" {
+				res.famConf.ScriptsDir = res.dir
+			}
+			s.SdksFamilies[res.famConf.FamilyName] = res.famConf
+			delete(s.badFamDirs, filepath.Clean(res.dir))
+		} else {
+			s.badFamDirs[filepath.Clean(res.dir)] = true
+		}
+
+		for _, cSdk := range res.sdks {
+			if err := s._addCrossSDK(cSdk, false, false); err != nil {
+				res.errs = append(res.errs, err)
+				continue
+			}
+
+			if cSdk.sdk.Status == xsapiv1.SdkStatusInstalled {
+				nbInstalled++
+			}
+		}
+
+		if len(res.errs) > 0 {
+			s.Log.Warningf("SDK family '%s': %d error(s) while processing SDKs", filepath.Base(res.dir), len(res.errs))
+			for _, err := range res.errs {
+				s.Log.Debugf("  - %v", err)
+			}
+		}
+	}
+	return nbInstalled
+}
+
+// listFamilyDirs returns directories of scripts directory (one per family)
+func (s *SDKs) listFamilyDirs() ([]string, error) {
+	dirs, err := filepath.Glob(path.Join(s.scriptsDir, "*"))
+	if err != nil {
+		s.Log.Errorf("Error while retrieving SDK scripts: dir=%s, error=%s", s.scriptsDir, err.Error())
+		return nil, err
+	}
+	famDirs := []string{}
+	for _, d := range dirs {
+		if common.IsDir(d) {
+			famDirs = append(famDirs, d)
+		}
+	}
+	return famDirs, nil
+}
+
+// ReloadFamilies Detect new and removed family directories and update
+// families and SDKs lists accordingly (directories with an invalid config
+// are only retried when retryFailed is set)
+func (s *SDKs) ReloadFamilies(retryFailed bool) (*xsapiv1.SDKFamiliesReload, error) {
+	famDirs, err := s.listFamilyDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	res := xsapiv1.SDKFamiliesReload{Added: []string{}, Removed: []string{}}
+	exist := make(map[string]bool)
+	for _, d := range famDirs {
+		exist[filepath.Clean(d)] = true
+	}
+
+	s.mutex.Lock()
+
+	// Removed families (and their SDKs)
+	known := make(map[string]bool)
+	for name, sf := range s.SdksFamilies {
+		if exist[filepath.Clean(sf.ScriptsDir)] {
+			known[filepath.Clean(sf.ScriptsDir)] = true
+			continue
+		}
+		delete(s.SdksFamilies, name)
+		for id, cSdk := range s.Sdks {
+			if cSdk.sdk.FamilyConf.FamilyName == name {
+				delete(s.Sdks, id)
+			}
+		}
+		res.Removed = append(res.Removed, name)
+	}
+
+	newDirs := []string{}
+	for _, d := range famDirs {
+		if known[filepath.Clean(d)] || (!retryFailed && s.badFamDirs[filepath.Clean(d)]) {
+			continue
+		}
+		newDirs = append(newDirs, d)
+	}
+
+	s.mutex.Unlock()
+
+	// New families (don't lock while scripts are executed)
+	if len(newDirs) > 0 {
+		results := s.discoverFamilies(newDirs)
+		s.mutex.Lock()
+		s._addFamilies(results)
+		s.mutex.Unlock()
+		for _, r := range results {
+			if r.famConf != nil && r.famConf.FamilyName != "" {
+				res.Added = append(res.Added, r.famConf.FamilyName)
+			}
+		}
+	}
+
+	if len(res.Added) > 0 || len(res.Removed) > 0 {
+		s.Log.Infof("SDK families changed: added %v, removed %v", res.Added, res.Removed)
+		if err := s.events.Emit(xsapiv1.EVTSDKFamilyChange, res, ""); err != nil {
+			s.Log.Warningf("Cannot notify SDK families change: %v", err)
+		}
+	}
+
+	return &res, nil
+}
+
+// GetFamilies returns all families configuration
+func (s *SDKs) GetFamilies() []xsapiv1.SDKFamilyConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := []string{}
+	for name := range s.SdksFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := []xsapiv1.SDKFamilyConfig{}
+	for _, name := range names {
+		res = append(res, *s.SdksFamilies[name])
+	}
+	return res
+}
+
+// monitorFamilies periodically checks scripts directory to detect families changes
+func (s *SDKs) monitorFamilies() {
+	for {
+		select {
+		case <-s.stop:
+			s.Log.Debugln("Stop monitorFamilies")
+			return
+		case <-time.After(sdkFamiliesMonitorTime * time.Second):
+			if _, err := s.ReloadFamilies(false); err != nil {
+				s.Log.Errorf("Cannot reload SDK families: %v", err)
+			}
+		}
+	}
+}
+
 // _createNewCrossSDK Private function to create a new Cross SDK
 func (s *SDKs) _createNewCrossSDK(sdk xsapiv1.SDK, scriptDir string, installing bool, force bool) (*CrossSDK, error) {
 
@@ -122,29 +354,43 @@ func (s *SDKs) _createNewCrossSDK(sdk xsapiv1.SDK, scriptDir string, installing
 		return cSdk, err
 	}
 
+	return cSdk, s._addCrossSDK(cSdk, installing, force)
+}
+
+// _addCrossSDK Private function to add a Cross SDK in SDKs list
+func (s *SDKs) _addCrossSDK(cSdk *CrossSDK, installing bool, force bool) error {
+
 	// Allow to overwrite not installed SDK or when force is set
 	if _, exist := s.Sdks[cSdk.sdk.ID]; exist {
 		if !force && cSdk.sdk.Path != "" && common.Exists(cSdk.sdk.Path) {
-			return cSdk, fmt.Errorf("SDK ID %s already installed in %s", cSdk.sdk.ID, cSdk.sdk.Path)
+			return fmt.Errorf("SDK ID %s already installed in %s", cSdk.sdk.ID, cSdk.sdk.Path)
 		}
 		if !force && cSdk.sdk.Status != xsapiv1.SdkStatusNotInstalled {
-			return cSdk, fmt.Errorf("Duplicate SDK ID %s (use force to overwrite)", cSdk.sdk.ID)
+			return fmt.Errorf("Duplicate SDK ID %s (use force to overwrite)", cSdk.sdk.ID)
 		}
 	}
 
 	// Sanity check
 	errMsg := "Invalid SDK definition "
 	if installing && cSdk.sdk.Path == "" {
-		return cSdk, fmt.Errorf(errMsg + "(path not set)")
+		return fmt.Errorf(errMsg + "(path not set)")
 	}
 	if installing && cSdk.sdk.URL == "" {
-		return cSdk, fmt.Errorf(errMsg + "(url not set)")
+		return fmt.Errorf(errMsg + "(url not set)")
+	}
+
+	// Restore usage statistics and owner
+	if u, exist := s.usage[cSdk.sdk.ID]; exist {
+		cSdk.sdk.LastUsed = u.LastUsed
+		cSdk.sdk.UsageCount = u.Count
+		cSdk.sdk.Owner = u.Owner
+		cSdk.sdk.OwnerUser = u.OwnerUser
 	}
 
 	// Add to list
 	s.Sdks[cSdk.sdk.ID] = cSdk
 
-	return cSdk, err
+	return nil
 }
 
 // Stop SDKs management
@@ -283,34 +529,114 @@ func (s *SDKs) GetAll() []xsapiv1.SDK {
 	return res
 }
 
+// GetAllChangedSince returns SDKs modified after since date (all SDKs when
+// since is zero), the content hash (etag) of the whole SDKs collection and
+// the date of the last modification.
+// SDKs removed after since date are returned with SdkStatusRemoved status.
+// Note that changes are detected lazily (IOW when this function is called)
+func (s *SDKs) GetAllChangedSince(since time.Time) ([]xsapiv1.SDK, string, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := []string{}
+	for id := range s.Sdks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	lastMod := time.Time{}
+	res := []xsapiv1.SDK{}
+	hAll := sha1.New()
+	for _, id := range ids {
+		sdk := *s.Sdks[id].Get()
+		b, _ := json.Marshal(sdk)
+		h := sha1.Sum(b)
+		hStr := hex.EncodeToString(h[:])
+		hAll.Write(h[:])
+
+		ch, exist := s.changes[id]
+		if !exist || ch.hash != hStr || ch.removed {
+			ch = &sdkChange{hash: hStr, date: now}
+			s.changes[id] = ch
+		}
+		if ch.date.After(lastMod) {
+			lastMod = ch.date
+		}
+		if since.IsZero() || ch.date.After(since) {
+			res = append(res, sdk)
+		}
+	}
+
+	// Removal of SDKs
+	removed := []string{}
+	for id, ch := range s.changes {
+		if _, exist := s.Sdks[id]; exist {
+			continue
+		}
+		if !ch.removed {
+			ch.removed = true
+			ch.date = now
+		}
+		removed = append(removed, id)
+	}
+	sort.Strings(removed)
+	for _, id := range removed {
+		ch := s.changes[id]
+		hAll.Write([]byte("removed:" + id + ch.date.String()))
+		if ch.date.After(lastMod) {
+			lastMod = ch.date
+		}
+		if !since.IsZero() && ch.date.After(since) {
+			res = append(res, xsapiv1.SDK{ID: id, Status: xsapiv1.SdkStatusRemoved})
+		}
+	}
+
+	return res, "\"" + hex.EncodeToString(hAll.Sum(nil)) + "\"", lastMod
+}
+
 // GetEnvCmd returns the command used to initialized the environment for an SDK
-func (s *SDKs) GetEnvCmd(id string, defaultID string) []string {
+// (SDK bound to project, defaultID, is used when id is not set)
+func (s *SDKs) GetEnvCmd(id string, defaultID string) ([]string, error) {
 	if id == "" && defaultID == "" {
 		// no env cmd
-		return []string{}
+		return []string{}, nil
 	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if iid, err := s.ResolveID(id); err == nil {
-		if sdk, exist := s.Sdks[iid]; exist {
-			return sdk.GetEnvCmd()
+	var sdk *CrossSDK
+	if id != "" {
+		iid, err := s.ResolveID(id)
+		if err != nil {
+			return []string{}, fmt.Errorf("Unknown sdkid")
+		}
+		sdk = s.Sdks[iid]
+	} else {
+		var exist bool
+		if sdk, exist = s.Sdks[defaultID]; !exist {
+			return []string{}, fmt.Errorf("SDK bound to project (%s) not found", defaultID)
 		}
 	}
+	if sdk == nil {
+		return []string{}, fmt.Errorf("Unknown sdkid")
+	}
 
-	if sdk, exist := s.Sdks[defaultID]; defaultID != "" && exist {
-		return sdk.GetEnvCmd()
+	// Setup file can be removed when SDK has been uninstalled outside of XDS
+	if sdk.sdk.SetupFile == "" || !common.Exists(sdk.sdk.SetupFile) {
+		return []string{}, fmt.Errorf("environment setup file of SDK %s not found (%s)", sdk.sdk.Name, sdk.sdk.SetupFile)
 	}
 
-	// Return default env that may be empty
-	return []string{}
+	s.recordUsage(sdk)
+	return sdk.GetEnvCmd(), nil
 }
 
 // Install Used to install a new SDK
 func (s *SDKs) Install(id, filepath string, force bool, timeout int, args []string, sess *ClientSession) (*xsapiv1.SDK, error) {
 
 	var sdk *xsapiv1.SDK
+	var famConf xsapiv1.SDKFamilyConfig
 	var err error
 	scriptDir := ""
 	sdkFilename := ""
@@ -330,6 +656,7 @@ func (s *SDKs) Install(id, filepath string, force bool, timeout int, args []stri
 
 		sdk = &curSdk.sdk
 		scriptDir = sdk.FamilyConf.ScriptsDir
+		famConf = sdk.FamilyConf
 
 		// Update path when not set
 		if sdk.Path == "" {
@@ -354,6 +681,7 @@ func (s *SDKs) Install(id, filepath string, force bool, timeout int, args []stri
 				// OK, sdk found
 				sdk = &sdkDef
 				scriptDir = sf.ScriptsDir
+				famConf = *sf
 				break
 			}
 
@@ -367,6 +695,14 @@ func (s *SDKs) Install(id, filepath string, force bool, timeout int, args []stri
 		return nil, fmt.Errorf("invalid parameter, id or filepath must be set")
 	}
 
+	// Check host prerequisites before downloading and installing
+	if prq := CheckSDKFamilyPrerequisites(famConf, s.Log); !prq.OK {
+		if prq.Error != "" {
+			return nil, fmt.Errorf("Cannot check host prerequisites: %s", prq.Error)
+		}
+		return nil, fmt.Errorf("Missing host prerequisites to install SDK: %s", strings.Join(prq.Missing, ", "))
+	}
+
 	cSdk, err := s._createNewCrossSDK(*sdk, scriptDir, true, force)
 	if err != nil {
 		return nil, err
@@ -381,6 +717,48 @@ func (s *SDKs) Install(id, filepath string, force bool, timeout int, args []stri
 	return &cSdk.sdk, nil
 }
 
+// Verify Used to check integrity of an installed SDK
+func (s *SDKs) Verify(id string, createManifest bool) (*xsapiv1.SDK, error) {
+	s.mutex.Lock()
+	cSdk, exist := s.Sdks[id]
+	s.mutex.Unlock()
+	if !exist {
+		return nil, fmt.Errorf("unknown id")
+	}
+	if cSdk.sdk.Status != xsapiv1.SdkStatusInstalled {
+		return nil, fmt.Errorf("this sdk is not installed")
+	}
+
+	// Verification may be long (checksums), so don't lock SDKs list
+	health := cSdk.Verify(createManifest)
+
+	s.mutex.Lock()
+	cSdk.sdk.Health = health
+	sdk := cSdk.sdk
+	if cSdk.localDir {
+		if err := s.saveLocalSDKs(); err != nil {
+			s.Log.Errorf("Cannot save local SDKs list: %v", err)
+		}
+	}
+	s.mutex.Unlock()
+
+	s.Log.Infof("SDK %s verified: %s", sdk.Name, health.Status)
+	if err := s.events.Emit(xsapiv1.EVTSDKHealth, sdk, ""); err != nil {
+		s.Log.Warningf("Cannot notify SDK health: %v", err)
+	}
+
+	return &sdk, nil
+}
+
+// CheckPrerequisites Check host prerequisites of all SDKs families
+func (s *SDKs) CheckPrerequisites() []xsapiv1.SDKPrerequisites {
+	res := []xsapiv1.SDKPrerequisites{}
+	for _, fc := range s.GetFamilies() {
+		res = append(res, CheckSDKFamilyPrerequisites(fc, s.Log))
+	}
+	return res
+}
+
 // AbortInstall Used to abort SDK installation
 func (s *SDKs) AbortInstall(id string, timeout int) (*xsapiv1.SDK, error) {
 
@@ -411,6 +789,12 @@ func (s *SDKs) Remove(id string, timeout int, sess *ClientSession) (*xsapiv1.SDK
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	// SDKs registered from a local directory are only unregistered
+	// (never delete files that are not managed by XDS)
+	if cSdk.localDir {
+		return s.unregisterLocalSDK(cSdk)
+	}
+
 	// Launch script to remove/uninstall
 	// (note that remove event will be generated by monitoring thread)
 	if err := cSdk.Remove(timeout, sess); err != nil {
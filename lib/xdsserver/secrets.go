@@ -0,0 +1,364 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Valid secret name (also used as file name)
+var reSecretName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Environment variable used to set master key of secrets store
+const secretsMasterKeyEnv = "XDS_SECRETS_KEY"
+
+// Known value encrypted in store, used to detect a wrong master key
+const secretsCheckValue = "xds-secrets-store"
+
+// Secrets Server-side credentials used to access external resources
+// Secrets are either set using REST API (saved encrypted using master key),
+// or one file per secret in SecretsDir, only readable by server user.
+type Secrets struct {
+	*Context
+	dir    string
+	key    []byte // nil when master key is not set
+	locked bool   // master key doesn't match the one used to encrypt store
+	store  map[string]xsapiv1.Secret
+	mutex  sync.Mutex
+}
+
+type xmlSecrets struct {
+	XMLName xml.Name         `xml:"secrets"`
+	Version string           `xml:"version,attr"`
+	Check   string           `xml:"check"`
+	Secrets []xsapiv1.Secret `xml:"secret"`
+}
+
+// NewSecrets creates a new instance of Secrets
+func NewSecrets(ctx *Context) *Secrets {
+	s := Secrets{
+		Context: ctx,
+		dir:     ctx.Config.FileConf.SecretsDir,
+		store:   make(map[string]xsapiv1.Secret),
+		mutex:   sync.NewMutex(),
+	}
+
+	masterKey := os.Getenv(secretsMasterKeyEnv)
+	if cfg := ctx.Config.FileConf.SecretsConf; cfg != nil && cfg.MasterKey != "" {
+		masterKey = cfg.MasterKey
+	}
+	if masterKey != "" {
+		sum := sha256.Sum256([]byte(masterKey))
+		s.key = sum[:]
+	}
+	s.load()
+	return &s
+}
+
+// Exists returns true when a secret is defined
+func (s *Secrets) Exists(name string) bool {
+	_, err := s.Get(name)
+	return err == nil
+}
+
+// Get returns the value of a secret
+func (s *Secrets) Get(name string) (string, error) {
+	if !reSecretName.MatchString(name) {
+		return "", fmt.Errorf("invalid secret name")
+	}
+
+	s.mutex.Lock()
+	sec, exist := s.store[name]
+	s.mutex.Unlock()
+	if exist {
+		if s.locked {
+			return "", fmt.Errorf("secrets store is locked (invalid master key)")
+		}
+		return s.decrypt(sec.Value)
+	}
+
+	file := filepath.Join(s.dir, name)
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("unknown secret %s", name)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("secret %s must only be readable by owner (chmod 600 %s)", name, file)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\n"), nil
+}
+
+// GetAll returns definition of all secrets (values excluded)
+func (s *Secrets) GetAll() []xsapiv1.Secret {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res := []xsapiv1.Secret{}
+	for _, sec := range s.store {
+		sec.Value = ""
+		res = append(res, sec)
+	}
+	if files, err := ioutil.ReadDir(s.dir); err == nil {
+		for _, fi := range files {
+			if _, exist := s.store[fi.Name()]; exist || fi.IsDir() || !reSecretName.MatchString(fi.Name()) {
+				continue
+			}
+			res = append(res, xsapiv1.Secret{
+				Name:      fi.Name(),
+				Type:      xsapiv1.SecretTypeOther,
+				Source:    xsapiv1.SecretSourceFile,
+				UpdatedAt: fi.ModTime().String(),
+			})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// GetInfo returns definition of a secret (value excluded)
+func (s *Secrets) GetInfo(name string) (*xsapiv1.Secret, error) {
+	for _, sec := range s.GetAll() {
+		if sec.Name == name {
+			return &sec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown secret %s", name)
+}
+
+// Set creates or updates a secret of encrypted store
+func (s *Secrets) Set(name string, args xsapiv1.SecretSetArgs, user string) (*xsapiv1.Secret, error) {
+	if !reSecretName.MatchString(name) {
+		return nil, fmt.Errorf("invalid secret name")
+	}
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	switch args.Type {
+	case "":
+		args.Type = xsapiv1.SecretTypeOther
+	case xsapiv1.SecretTypeRegistry, xsapiv1.SecretTypeGit, xsapiv1.SecretTypeDevice,
+		xsapiv1.SecretTypeWebhook, xsapiv1.SecretTypeOther:
+	default:
+		return nil, fmt.Errorf("invalid secret type '%s'", args.Type)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().String()
+	sec, exist := s.store[name]
+	if !exist {
+		if args.Value == "" {
+			return nil, fmt.Errorf("secret value must be set")
+		}
+		sec = xsapiv1.Secret{
+			Name:      name,
+			Source:    xsapiv1.SecretSourceStore,
+			CreatedAt: now,
+		}
+	}
+	sec.Type = args.Type
+	sec.Description = args.Description
+	sec.UpdatedAt = now
+	if args.Value != "" {
+		val, err := s.encrypt(args.Value)
+		if err != nil {
+			return nil, err
+		}
+		sec.Value = val
+		sec.UpdatedBy = user
+	}
+
+	prev, hadPrev := s.store[name]
+	s.store[name] = sec
+	if err := s.save(); err != nil {
+		if hadPrev {
+			s.store[name] = prev
+		} else {
+			delete(s.store, name)
+		}
+		return nil, fmt.Errorf("Cannot save secrets: %v", err)
+	}
+
+	s.Log.Infof("Secret %s set by '%s'", name, user)
+	sec.Value = ""
+	return &sec, nil
+}
+
+// Delete removes a secret of encrypted store
+func (s *Secrets) Delete(name string) (*xsapiv1.Secret, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sec, exist := s.store[name]
+	if !exist {
+		if reSecretName.MatchString(name) && common.Exists(filepath.Join(s.dir, name)) {
+			return nil, fmt.Errorf("secret %s is a file of %s and cannot be removed using API", name, s.dir)
+		}
+		return nil, fmt.Errorf("unknown secret %s", name)
+	}
+	delete(s.store, name)
+	if err := s.save(); err != nil {
+		s.store[name] = sec
+		return nil, fmt.Errorf("Cannot save secrets: %v", err)
+	}
+
+	s.Log.Infof("Secret %s removed", name)
+	sec.Value = ""
+	return &sec, nil
+}
+
+/*** Private functions ***/
+
+// checkWritable returns an error when encrypted store cannot be modified
+func (s *Secrets) checkWritable() error {
+	if s.key == nil {
+		return fmt.Errorf("secrets store master key not set (see %s or secrets.masterKey setting)", secretsMasterKeyEnv)
+	}
+	if s.locked {
+		return fmt.Errorf("secrets store is locked (invalid master key)")
+	}
+	return nil
+}
+
+// encrypt encrypts a value using master key (AES-GCM, random nonce prepended)
+func (s *Secrets) encrypt(value string) (string, error) {
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// decrypt decrypts a value encrypted using encrypt
+func (s *Secrets) decrypt(value string) (string, error) {
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted secret")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret")
+	}
+	return string(plain), nil
+}
+
+func (s *Secrets) cipher() (cipher.AEAD, error) {
+	if s.key == nil {
+		return nil, fmt.Errorf("secrets store master key not set")
+	}
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load reads encrypted store (values are only decrypted when used)
+func (s *Secrets) load() {
+	file, err := xdsconfig.SecretsFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		s.Log.Errorf("Cannot read secrets: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlSecrets{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		s.Log.Errorf("Cannot decode secrets: %v", err)
+		return
+	}
+	for _, sec := range data.Secrets {
+		s.store[sec.Name] = sec
+	}
+
+	if val, err := s.decrypt(data.Check); err != nil || val != secretsCheckValue {
+		s.locked = true
+		s.Log.Errorf("Secrets store is locked: master key not set or invalid (%d secrets not usable)", len(s.store))
+	}
+}
+
+// save writes encrypted store on disk (mutex must be locked)
+func (s *Secrets) save() error {
+	file, err := xdsconfig.SecretsFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	check, err := s.encrypt(secretsCheckValue)
+	if err != nil {
+		return err
+	}
+
+	data := xmlSecrets{Version: "1", Check: check, Secrets: []xsapiv1.Secret{}}
+	for _, sec := range s.store {
+		data.Secrets = append(data.Secrets, sec)
+	}
+	sort.Slice(data.Secrets, func(i, j int) bool { return data.Secrets[i].Name < data.Secrets[j].Name })
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&data)
+}
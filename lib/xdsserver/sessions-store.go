@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+// xmlSessions Sessions saved on disk to be restored on server restart
+type xmlSessions struct {
+	XMLName  xml.Name     `xml:"sessions"`
+	Version  string       `xml:"version,attr"`
+	Sessions []xmlSession `xml:"session"`
+}
+
+type xmlSession struct {
+	ID           string       `xml:"id,attr"`
+	User         string       `xml:"user"`
+	MaxAge       int64        `xml:"maxAge"`
+	IdleTimeoutS int64        `xml:"idleTimeoutS"`
+	LifetimeSet  bool         `xml:"lifetimeSet"`
+	CreatedAt    string       `xml:"createdAt"`
+	LastUsedAt   string       `xml:"lastUsedAt"`
+	ExpireAt     string       `xml:"expireAt"`
+	Identity     *xmlIdentity `xml:"identity,omitempty"`
+	Bound        bool         `xml:"bound,omitempty"`
+}
+
+type xmlIdentity struct {
+	User     string `xml:"user"`
+	Subject  string `xml:"subject"`
+	Email    string `xml:"email"`
+	Name     string `xml:"name"`
+	ExpireAt string `xml:"expireAt,omitempty"`
+	Role     string `xml:"role,omitempty"`
+}
+
+// load restores sessions saved by a previous run (expired ones are dropped)
+func (s *Sessions) load() {
+	file, err := xdsconfig.SessionsFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		s.Log.Errorf("Cannot read sessions: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlSessions{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		s.Log.Errorf("Cannot decode sessions: %v", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for _, xs := range data.Sessions {
+		expireAt, err := time.Parse(time.RFC3339, xs.ExpireAt)
+		if err != nil || expireAt.Before(now) {
+			continue
+		}
+		createdAt, _ := time.Parse(time.RFC3339, xs.CreatedAt)
+		lastUsedAt, err := time.Parse(time.RFC3339, xs.LastUsedAt)
+		if err != nil {
+			lastUsedAt = now
+		}
+		se := ClientSession{
+			ID:          xs.ID,
+			MaxAge:      xs.MaxAge,
+			User:        xs.User,
+			createdAt:   createdAt,
+			expireAt:    expireAt,
+			lastUsedAt:  lastUsedAt,
+			idleTimeout: time.Duration(xs.IdleTimeoutS) * time.Second,
+			lifetimeSet: xs.LifetimeSet,
+			useCount:    1,
+		}
+		if deadline, _ := se.deadline(); deadline.Before(now) {
+			continue
+		}
+		// Drop sessions bound with a predictable ID by previous versions
+		if raw, _ := base64.URLEncoding.DecodeString(se.ID); strings.HasPrefix(string(raw), "bound-") {
+			continue
+		}
+		if xi := xs.Identity; xi != nil {
+			se.identity = &authIdentity{user: xi.User, subject: xi.Subject, email: xi.Email, name: xi.Name, role: xi.Role}
+			if xi.ExpireAt != "" {
+				se.identity.expireAt, _ = time.Parse(time.RFC3339, xi.ExpireAt)
+			}
+			if xi.Role != "" && s.roles != nil {
+				s.roles.SetDirectoryRole(xi.User, xi.Role)
+			}
+			if xs.Bound {
+				se.bound = true
+				s.bound[xi.Subject] = se.ID
+			}
+		}
+		s.sessMap[se.ID] = se
+	}
+	s.Log.Infof("%d session(s) restored", len(s.sessMap))
+}
+
+// save writes sessions on disk (mutex must be locked)
+func (s *Sessions) save() error {
+	file, err := xdsconfig.SessionsFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	data := xmlSessions{Version: "1", Sessions: []xmlSession{}}
+	now := time.Now()
+	for _, se := range s.sessMap {
+		// Skip expired sessions and sessions not used yet by client (see refresh)
+		if se.expireAt.Before(now) || (se.MaxAge <= initSessionMaxAge && se.identity == nil) {
+			continue
+		}
+		xs := xmlSession{
+			ID:           se.ID,
+			User:         se.User,
+			MaxAge:       se.MaxAge,
+			IdleTimeoutS: int64(se.idleTimeout / time.Second),
+			LifetimeSet:  se.lifetimeSet,
+			Bound:        se.bound,
+			CreatedAt:    se.createdAt.Format(time.RFC3339),
+			LastUsedAt:   se.lastUsedAt.Format(time.RFC3339),
+			ExpireAt:     se.expireAt.Format(time.RFC3339),
+		}
+		if id := se.identity; id != nil {
+			xs.Identity = &xmlIdentity{User: id.user, Subject: id.subject, Email: id.email, Name: id.name, Role: id.role}
+			if !id.expireAt.IsZero() {
+				xs.Identity.ExpireAt = id.expireAt.Format(time.RFC3339)
+			}
+		}
+		data.Sessions = append(data.Sessions, xs)
+	}
+
+	// Only owner can read sessions IDs (used as credentials by clients)
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&data); err != nil {
+		return err
+	}
+	s.changed = false
+	return nil
+}
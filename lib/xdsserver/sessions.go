@@ -19,19 +19,27 @@ package xdsserver
 
 import (
 	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/googollee/go-socket.io"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 	uuid "github.com/satori/go.uuid"
 	"github.com/syncthing/syncthing/lib/sync"
 )
 
 const sessionCookieName = "xds-sid"
 const sessionHeaderName = "XDS-SID"
+const sessionUserHeaderName = "XDS-User"
+const sessionAuthScheme = "Bearer " // scheme of Authorization header
 
-const sessionMonitorTime = 10 // Time (in seconds) to schedule monitoring session tasks
+const sessionMonitorTime = 10       // Time (in seconds) to schedule monitoring session tasks
+const sessionDefaultWarnBefore = 60 // Time (in seconds) of expiring warning before forced logout
 
 const initSessionMaxAge = 10 // Initial session max age in seconds
 const maxSessions = 100000   // Maximum number of sessions in sessMap map
@@ -44,17 +52,41 @@ type ClientSession struct {
 	WSID     string // only one WebSocket per client/session
 	MaxAge   int64
 	IOSocket *socketio.Socket
+	User     string // client user name (see XDS-User header)
 
 	// private
-	expireAt time.Time
-	useCount int64
+	createdAt   time.Time
+	expireAt    time.Time
+	lastUsedAt  time.Time
+	idleTimeout time.Duration // zero when disabled
+	lifetimeSet bool          // lifetime set by client (see SetLifetime)
+	warnedAt    time.Time     // deadline of last expiring warning
+	useCount    int64
+	identity    *authIdentity // authenticated user (see OIDC and APITokens)
+	bound       bool          // bound to a bearer token (see boundSession), never accepted from cookie
+	clientIP    string        // address of last request
+	userAgent   string        // user agent of last request
+}
+
+// authIdentity Identity of an authenticated user
+type authIdentity struct {
+	user     string // xds user
+	subject  string
+	email    string
+	name     string
+	expireAt time.Time // zero when identity never expires
+	role     string    // role granted by directory groups (see LDAP)
 }
 
 // Sessions holds client sessions
 type Sessions struct {
 	*Context
 	cookieMaxAge int64
+	idleTimeout  time.Duration
+	warnBefore   time.Duration
 	sessMap      map[string]ClientSession
+	bound        map[string]string // subject -> ID of session bound to a bearer token identity
+	changed      bool              // sessions not saved yet
 	mutex        sync.Mutex
 	stop         chan struct{} // signals intentional stop
 }
@@ -68,12 +100,29 @@ func NewClientSessions(ctx *Context, cookieMaxAge string) *Sessions {
 	s := Sessions{
 		Context:      ctx,
 		cookieMaxAge: ckMaxAge,
+		warnBefore:   sessionDefaultWarnBefore * time.Second,
 		sessMap:      make(map[string]ClientSession),
+		bound:        make(map[string]string),
 		mutex:        sync.NewMutex(),
 		stop:         make(chan struct{}),
 	}
+	if cfg := ctx.Config.FileConf.SessionConf; cfg != nil {
+		if cfg.MaxAgeS > 0 {
+			s.cookieMaxAge = int64(cfg.MaxAgeS)
+		}
+		if cfg.IdleTimeoutS > 0 {
+			s.idleTimeout = time.Duration(cfg.IdleTimeoutS) * time.Second
+		}
+		if cfg.WarnBeforeS > 0 {
+			s.warnBefore = time.Duration(cfg.WarnBeforeS) * time.Second
+		}
+		s.Log.Infof("Sessions max age %ds, idle timeout %v", s.cookieMaxAge, s.idleTimeout)
+	}
 	s.WWWServer.router.Use(s.Middleware())
 
+	// Restore sessions of previous run (clients don't need to login again)
+	s.load()
+
 	// Start monitoring of sessions Map (use to manage expiration and cleanup)
 	go s.monitorSessMap()
 
@@ -83,6 +132,12 @@ func NewClientSessions(ctx *Context, cookieMaxAge string) *Sessions {
 // Stop sessions management
 func (s *Sessions) Stop() {
 	close(s.stop)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.save(); err != nil {
+		s.Log.Errorf("Cannot save sessions: %v", err)
+	}
 }
 
 // Middleware is used to managed session
@@ -90,6 +145,24 @@ func (s *Sessions) Middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// FIXME Add CSRF management
 
+		// Bearer tokens (API tokens or OpenID Connect ID tokens) are an
+		// alternative to session cookie (all requests using the same token
+		// share the same session)
+		if auth := c.Request.Header.Get("Authorization"); strings.HasPrefix(auth, sessionAuthScheme) {
+			ident, err := s.bearerIdentity(strings.TrimSpace(strings.TrimPrefix(auth, sessionAuthScheme)))
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": err.Error()})
+				c.Abort()
+				return
+			}
+			sess := s.boundSession(ident, c.Request.Header.Get(sessionUserHeaderName))
+			s.setClient(sess.ID, c.ClientIP(), c.Request.UserAgent())
+			c.Header(sessionHeaderName, sess.ID)
+			c.Set(sessionCookieName, sess.ID)
+			c.Next()
+			return
+		}
+
 		// Get session
 		sess := s.Get(c)
 		if sess == nil {
@@ -98,11 +171,20 @@ func (s *Sessions) Middleware() gin.HandlerFunc {
 		} else {
 			s.refresh(sess.ID)
 		}
+		s.setClient(sess.ID, c.ClientIP(), c.Request.UserAgent())
 
-		// Set session in cookie and in header
+		// Client user is set once (used to select local user of commands)
+		if user := c.Request.Header.Get(sessionUserHeaderName); user != "" && sess.User == "" {
+			s.setUser(sess.ID, user)
+		}
+
+		// Set session in cookie and in header (bound sessions are only
+		// accepted from header)
 		// Do not set Domain to localhost (http://stackoverflow.com/questions/1134290/cookies-on-localhost-with-explicit-domain)
-		c.SetCookie(sessionCookieName, sess.ID, int(sess.MaxAge), "/", "",
-			secureCookie, false)
+		if !sess.bound {
+			c.SetCookie(sessionCookieName, sess.ID, int(sess.MaxAge), "/", "",
+				secureCookie || c.Request.TLS != nil, false)
+		}
 		c.Header(sessionHeaderName, sess.ID)
 
 		// Save session id in gin metadata
@@ -122,26 +204,64 @@ func (s *Sessions) Get(c *gin.Context) *ClientSession {
 		sid = v.(string)
 	}
 
-	// Then look in cookie
-	if !exist || sid == "" {
-		sid, _ = c.Cookie(sessionCookieName)
+	if exist && sid != "" {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if key, ok := s.sessMap[sid]; ok {
+			// TODO: return a copy ???
+			return &key
+		}
+		return nil
+	}
+	return s.GetRequest(c.Request)
+}
+
+// GetRequest returns the client session of a HTTP request (eg. handshake of
+// a websocket), sessions bound to a bearer token are only returned when
+// token is valid
+func (s *Sessions) GetRequest(r *http.Request) *ClientSession {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, sessionAuthScheme) {
+		ident, err := s.bearerIdentity(strings.TrimSpace(strings.TrimPrefix(auth, sessionAuthScheme)))
+		if err != nil {
+			return nil
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if sess, ok := s.sessMap[s.bound[ident.subject]]; ok {
+			return &sess
+		}
+		return nil
 	}
 
-	// Then look in Header
-	if sid == "" {
-		sid = c.Request.Header.Get(sessionCookieName)
+	// Look in cookie then in header
+	sid := ""
+	fromCookie := false
+	if ck, err := r.Cookie(sessionCookieName); err == nil && ck.Value != "" {
+		sid = ck.Value
+		fromCookie = true
+	} else {
+		sid = r.Header.Get(sessionCookieName)
 	}
 	if sid != "" {
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
-		if key, ok := s.sessMap[sid]; ok {
-			// TODO: return a copy ???
+		if key, ok := s.sessMap[sid]; ok && !(fromCookie && key.bound) {
 			return &key
 		}
 	}
 	return nil
 }
 
+// GetByID returns the client session of an ID (nil when unknown)
+func (s *Sessions) GetByID(sid string) *ClientSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessMap[sid]; ok {
+		return &sess
+	}
+	return nil
+}
+
 // IOSocketGet Get socketio definition from sid
 func (s *Sessions) IOSocketGet(sid string) *socketio.Socket {
 	s.mutex.Lock()
@@ -153,6 +273,19 @@ func (s *Sessions) IOSocketGet(sid string) *socketio.Socket {
 	return nil
 }
 
+// IOSocketsGet Get socketio definition of all connected sessions (indexed by sid)
+func (s *Sessions) IOSocketsGet() map[string]*socketio.Socket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make(map[string]*socketio.Socket)
+	for sid, sess := range s.sessMap {
+		if sess.IOSocket != nil {
+			res[sid] = sess.IOSocket
+		}
+	}
+	return res
+}
+
 // UpdateIOSocket updates the IO Socket definition for of a session
 func (s *Sessions) UpdateIOSocket(sid string, so *socketio.Socket) error {
 	s.mutex.Lock()
@@ -171,17 +304,42 @@ func (s *Sessions) UpdateIOSocket(sid string, so *socketio.Socket) error {
 	return nil
 }
 
+// setUser sets client user name of a session
+func (s *Sessions) setUser(sid, user string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessMap[sid]; ok {
+		sess.User = user
+		s.sessMap[sid] = sess
+		s.changed = true
+	}
+}
+
+// setClient sets address and user agent of last request of a session
+func (s *Sessions) setClient(sid, ip, userAgent string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessMap[sid]; ok && (sess.clientIP != ip || sess.userAgent != userAgent) {
+		sess.clientIP = ip
+		sess.userAgent = userAgent
+		s.sessMap[sid] = sess
+	}
+}
+
 // nesSession Allocate a new client session
 func (s *Sessions) newSession(prefix string) *ClientSession {
 	uuid := prefix + uuid.NewV4().String()
 	id := base64.URLEncoding.EncodeToString([]byte(uuid))
 	se := ClientSession{
-		ID:       id,
-		WSID:     "",
-		MaxAge:   initSessionMaxAge,
-		IOSocket: nil,
-		expireAt: time.Now().Add(time.Duration(initSessionMaxAge) * time.Second),
-		useCount: 0,
+		ID:          id,
+		WSID:        "",
+		MaxAge:      initSessionMaxAge,
+		IOSocket:    nil,
+		createdAt:   time.Now(),
+		expireAt:    time.Now().Add(time.Duration(initSessionMaxAge) * time.Second),
+		lastUsedAt:  time.Now(),
+		idleTimeout: s.idleTimeout,
+		useCount:    0,
 	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -192,6 +350,213 @@ func (s *Sessions) newSession(prefix string) *ClientSession {
 	return &se
 }
 
+// bearerIdentity returns the identity of a bearer token
+func (s *Sessions) bearerIdentity(token string) (*authIdentity, error) {
+	if strings.HasPrefix(token, apiTokenPrefix) && s.apiTokens != nil {
+		tok, err := s.apiTokens.Check(token)
+		if err != nil {
+			return nil, err
+		}
+		return &authIdentity{user: tok.User, subject: apiTokenSubject + tok.ID, name: tok.Name}, nil
+	}
+	if s.oidc != nil {
+		return s.oidc.Validate(token, "")
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+// boundSession returns the session bound to an identity (created with a
+// random ID when needed), user is only used when identity has no user
+func (s *Sessions) boundSession(ident *authIdentity, user string) *ClientSession {
+	maxAge := s.cookieMaxAge
+	if maxAge < initSessionMaxAge {
+		maxAge = initSessionMaxAge
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := s.bound[ident.subject]
+	se, exist := s.sessMap[id]
+	if !exist || !se.bound {
+		id = base64.URLEncoding.EncodeToString([]byte(uuid.NewV4().String()))
+		se = ClientSession{ID: id, User: user, createdAt: time.Now(), idleTimeout: s.idleTimeout, bound: true}
+		s.bound[ident.subject] = id
+		s.Log.Debugf("NEW bound session (%d): %s for %s", len(s.sessMap)+1, id, ident.subject)
+	}
+	if ident.user != "" {
+		se.User = ident.user
+	}
+	se.identity = ident
+	if !se.lifetimeSet {
+		se.MaxAge = maxAge
+		se.expireAt = time.Now().Add(time.Duration(maxAge) * time.Second)
+	}
+	se.lastUsedAt = time.Now()
+	se.useCount++
+	s.sessMap[id] = se
+	s.changed = true
+	return &se
+}
+
+// SetIdentity sets (or clears when nil) the authenticated identity of a
+// session, user of session is replaced by the one of identity
+func (s *Sessions) SetIdentity(sid string, ident *authIdentity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessMap[sid]; ok {
+		sess.identity = ident
+		if ident != nil {
+			sess.User = ident.user
+		}
+		s.sessMap[sid] = sess
+		s.changed = true
+	}
+}
+
+// Info returns lifetime of a session
+func (s *Sessions) Info(sid string) (*xsapiv1.SessionInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessMap[sid]
+	if !ok {
+		return nil, fmt.Errorf("unknown session")
+	}
+	info := sess.info()
+	return &info, nil
+}
+
+// GetAll returns details of active sessions (sessions not used yet by
+// client are excluded, see refresh), resources are not set
+func (s *Sessions) GetAll() []xsapiv1.SessionDetails {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := []xsapiv1.SessionDetails{}
+	for _, sess := range s.sessMap {
+		if sess.MaxAge <= initSessionMaxAge && sess.identity == nil {
+			continue
+		}
+		d := xsapiv1.SessionDetails{
+			SessionInfo:   sess.info(),
+			Authenticated: sess.IsAuthenticated(),
+			ClientIP:      sess.clientIP,
+			UserAgent:     sess.userAgent,
+			Connected:     sess.IOSocket != nil,
+		}
+		if sess.identity != nil {
+			d.Subject = sess.identity.subject
+		}
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt < res[j].CreatedAt })
+	return res
+}
+
+// Close forces logout of a session: session is removed, its websocket is
+// disconnected and its locks are released
+func (s *Sessions) Close(sid string) error {
+	s.mutex.Lock()
+	sess, ok := s.sessMap[sid]
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("unknown session")
+	}
+	s.deleteUnsafe(sess)
+	if err := s.save(); err != nil {
+		s.Log.Errorf("Cannot save sessions: %v", err)
+	}
+	s.mutex.Unlock()
+
+	if sess.IOSocket != nil {
+		(*sess.IOSocket).Disconnect()
+	}
+	s.sessionClosed(sid)
+	s.Log.Infof("Session %s (user %s) closed", sid, sess.User)
+	return nil
+}
+
+// deleteUnsafe removes a session (mutex must be locked)
+func (s *Sessions) deleteUnsafe(sess ClientSession) {
+	delete(s.sessMap, sess.ID)
+	if sess.bound && sess.identity != nil && s.bound[sess.identity.subject] == sess.ID {
+		delete(s.bound, sess.identity.subject)
+	}
+}
+
+// CloseBound forces logout of the session bound to an identity subject (see
+// boundSession), nothing is done when there is no such session
+func (s *Sessions) CloseBound(subject string) error {
+	s.mutex.Lock()
+	sid, ok := s.bound[subject]
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.Close(sid)
+}
+
+// info returns lifetime of a session
+func (sess *ClientSession) info() xsapiv1.SessionInfo {
+	deadline, reason := sess.deadline()
+	return xsapiv1.SessionInfo{
+		ID:           sess.ID,
+		User:         sess.User,
+		MaxAge:       sess.MaxAge,
+		IdleTimeout:  int64(sess.idleTimeout / time.Second),
+		CreatedAt:    sess.createdAt.Format(time.RFC3339),
+		LastUsedAt:   sess.lastUsedAt.Format(time.RFC3339),
+		ExpireAt:     deadline.Format(time.RFC3339),
+		ExpireReason: reason,
+	}
+}
+
+// SetLifetime sets max age (from session creation) and idle timeout of a
+// session, values cannot exceed the ones of server config
+func (s *Sessions) SetLifetime(sid string, maxAge, idleTimeout int64) error {
+	if maxAge < 0 || idleTimeout < 0 {
+		return fmt.Errorf("invalid negative value")
+	}
+	if maxAge > s.cookieMaxAge {
+		return fmt.Errorf("max age cannot exceed %d seconds", s.cookieMaxAge)
+	}
+	if s.idleTimeout > 0 && time.Duration(idleTimeout)*time.Second > s.idleTimeout {
+		return fmt.Errorf("idle timeout cannot exceed %v", s.idleTimeout)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessMap[sid]
+	if !ok {
+		return fmt.Errorf("unknown session")
+	}
+	if maxAge > 0 {
+		sess.MaxAge = maxAge
+		sess.expireAt = sess.createdAt.Add(time.Duration(maxAge) * time.Second)
+		sess.lifetimeSet = true
+	}
+	if idleTimeout > 0 {
+		sess.idleTimeout = time.Duration(idleTimeout) * time.Second
+	}
+	s.sessMap[sid] = sess
+	s.changed = true
+	return nil
+}
+
+// deadline returns date and reason of session expiration
+func (sess *ClientSession) deadline() (time.Time, string) {
+	if sess.idleTimeout > 0 && !sess.lastUsedAt.IsZero() {
+		if idle := sess.lastUsedAt.Add(sess.idleTimeout); idle.Before(sess.expireAt) {
+			return idle, xsapiv1.SessionExpireIdle
+		}
+	}
+	return sess.expireAt, xsapiv1.SessionExpireMaxAge
+}
+
+// IsAuthenticated returns true when session has a valid identity
+func (sess *ClientSession) IsAuthenticated() bool {
+	return sess.identity != nil && (sess.identity.expireAt.IsZero() || time.Now().Before(sess.identity.expireAt))
+}
+
 // refresh Move this session ID to the head of the list
 func (s *Sessions) refresh(sid string) {
 	s.mutex.Lock()
@@ -199,9 +564,11 @@ func (s *Sessions) refresh(sid string) {
 
 	sess := s.sessMap[sid]
 	sess.useCount++
-	if sess.MaxAge < s.cookieMaxAge && sess.useCount > 1 {
+	sess.lastUsedAt = time.Now()
+	if sess.MaxAge < s.cookieMaxAge && sess.useCount > 1 && !sess.lifetimeSet {
 		sess.MaxAge = s.cookieMaxAge
 		sess.expireAt = time.Now().Add(time.Duration(sess.MaxAge) * time.Second)
+		s.changed = true
 	}
 
 	// TODO - Add flood detection (like limit_req of nginx)
@@ -224,14 +591,61 @@ func (s *Sessions) monitorSessMap() {
 				s.Log.Errorln("TOO MUCH sessions, cleanup old ones !")
 			}
 
+			expired := []string{}
+			expiring := []xsapiv1.SessionExpiring{}
 			s.mutex.Lock()
 			for _, ss := range s.sessMap {
-				if ss.expireAt.Sub(time.Now()) < 0 {
+				deadline, reason := ss.deadline()
+				if deadline.Sub(time.Now()) < 0 {
 					s.Log.Debugf("Delete expired session id: %s", ss.ID)
-					delete(s.sessMap, ss.ID)
+					s.deleteUnsafe(ss)
+					expired = append(expired, ss.ID)
+					s.changed = true
+				} else if deadline.Sub(time.Now()) < s.warnBefore && !deadline.Equal(ss.warnedAt) && ss.MaxAge > initSessionMaxAge {
+					// Warn once per deadline (idle deadline moves when session is used)
+					ss.warnedAt = deadline
+					s.sessMap[ss.ID] = ss
+					expiring = append(expiring, xsapiv1.SessionExpiring{
+						SessionID: ss.ID,
+						ExpireAt:  deadline.Format(time.RFC3339),
+						Reason:    reason,
+					})
+				}
+			}
+			if s.changed {
+				if err := s.save(); err != nil {
+					s.Log.Errorf("Cannot save sessions: %v", err)
 				}
 			}
 			s.mutex.Unlock()
+
+			for _, ev := range expiring {
+				if err := s.events.EmitSession(xsapiv1.EVTSessionExpiring, ev, ev.SessionID); err != nil {
+					s.Log.Debugf("Cannot notify session expiring: %v", err)
+				}
+			}
+
+			for _, sid := range expired {
+				s.sessionClosed(sid)
+			}
 		}
 	}
 }
+
+// sessionClosed releases resources of an expired or closed session
+func (s *Sessions) sessionClosed(sid string) {
+	// Lock encrypted folders unlocked by session
+	if s.mfolders != nil {
+		s.mfolders.SessionClosed(sid)
+	}
+
+	// Kill debug sessions
+	if s.debugs != nil {
+		s.debugs.SessionClosed(sid)
+	}
+
+	// Forget events stream
+	if s.events != nil {
+		s.events.SessionClosed(sid)
+	}
+}
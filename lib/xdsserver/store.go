@@ -0,0 +1,294 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const storeIndexFilename = "index.xml"
+
+// Store Content-addressed store used to save logs and artifacts
+// Contents are identified by their sha256, saved only once (deduplication)
+// and compressed on disk.
+type Store struct {
+	*Context
+	rootDir string
+	blobs   map[string]*xsapiv1.StoreBlob
+	mutex   sync.Mutex
+}
+
+// Use XML format to be consistent with other files saved by server
+type xmlStoreIndex struct {
+	XMLName xml.Name            `xml:"store"`
+	Version string              `xml:"version,attr"`
+	Blobs   []xsapiv1.StoreBlob `xml:"blobs"`
+}
+
+// countWriter Writer that counts written bytes
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// NewStore creates a new instance of Store
+func NewStore(ctx *Context) (*Store, error) {
+	s := Store{
+		Context: ctx,
+		rootDir: ctx.Config.FileConf.StoreDir,
+		blobs:   make(map[string]*xsapiv1.StoreBlob),
+		mutex:   sync.NewMutex(),
+	}
+
+	for _, d := range []string{"objects", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(s.rootDir, d), 0770); err != nil {
+			return &s, fmt.Errorf("Cannot create store directory: %v", err)
+		}
+	}
+
+	if err := s.indexRead(); err != nil {
+		return &s, err
+	}
+	s.Log.Infof("Store directory: %s (%d blobs)", s.rootDir, len(s.blobs))
+
+	return &s, nil
+}
+
+// Put saves a content in store and adds a reference on it
+// (content is only saved once when already present)
+func (s *Store) Put(r io.Reader) (*xsapiv1.StoreBlob, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.rootDir, "tmp"), "blob-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Compute digest while compressing (favor speed for big images)
+	hasher := sha256.New()
+	cw := &countWriter{w: tmp}
+	gz, _ := gzip.NewWriterLevel(cw, gzip.BestSpeed)
+	size, err := io.Copy(io.MultiWriter(hasher, gz), r)
+	if err == nil {
+		err = gz.Close()
+	}
+	if errC := tmp.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot save content in store: %v", err)
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blob, exist := s.blobs[digest]
+	if !exist {
+		objFile := s.objectPath(digest)
+		if err := os.MkdirAll(filepath.Dir(objFile), 0770); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp.Name(), objFile); err != nil {
+			return nil, err
+		}
+		blob = &xsapiv1.StoreBlob{
+			Digest:     digest,
+			Size:       size,
+			StoredSize: cw.n,
+			CreatedAt:  time.Now().String(),
+		}
+		s.blobs[digest] = blob
+	}
+	blob.RefCount++
+
+	if err := s.indexWrite(); err != nil {
+		s.Log.Errorf("Cannot save store index: %v", err)
+	}
+
+	res := *blob
+	return &res, nil
+}
+
+// PutFile saves a file in store (see Put)
+func (s *Store) PutFile(file string) (*xsapiv1.StoreBlob, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return s.Put(fd)
+}
+
+// Get returns definition of a content
+func (s *Store) Get(digest string) *xsapiv1.StoreBlob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blob, exist := s.blobs[digest]
+	if !exist {
+		return nil
+	}
+	res := *blob
+	return &res
+}
+
+// Open returns a reader on an (uncompressed) content
+func (s *Store) Open(digest string) (io.ReadCloser, error) {
+	fd, err := s.OpenRaw(digest)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &storeReader{Reader: gz, fd: fd}, nil
+}
+
+// OpenRaw returns a reader on the compressed (gzip) content
+func (s *Store) OpenRaw(digest string) (*os.File, error) {
+	if s.Get(digest) == nil {
+		return nil, fmt.Errorf("unknown digest")
+	}
+	return os.Open(s.objectPath(digest))
+}
+
+// Release removes a reference on a content (content deleted when unused)
+func (s *Store) Release(digest string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blob, exist := s.blobs[digest]
+	if !exist {
+		return fmt.Errorf("unknown digest")
+	}
+	blob.RefCount--
+	if blob.RefCount <= 0 {
+		delete(s.blobs, digest)
+		if err := os.Remove(s.objectPath(digest)); err != nil && !os.IsNotExist(err) {
+			s.Log.Errorf("Cannot remove store object %s: %v", digest, err)
+		}
+	}
+	return s.indexWrite()
+}
+
+// Stats returns store usage statistics
+func (s *Store) Stats() xsapiv1.StoreStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := xsapiv1.StoreStats{NbBlobs: len(s.blobs)}
+	for _, b := range s.blobs {
+		st.NbRefs += b.RefCount
+		st.LogicalSize += b.Size * int64(b.RefCount)
+		st.StoredSize += b.StoredSize
+	}
+	st.SavedSize = st.LogicalSize - st.StoredSize
+	return st
+}
+
+/*** Private functions ***/
+
+// storeReader Close both gzip reader and underlying file
+type storeReader struct {
+	*gzip.Reader
+	fd *os.File
+}
+
+func (r *storeReader) Close() error {
+	r.Reader.Close()
+	return r.fd.Close()
+}
+
+func (s *Store) objectPath(digest string) string {
+	return filepath.Join(s.rootDir, "objects", digest[:2], digest+".gz")
+}
+
+// indexRead loads store index from disk
+func (s *Store) indexRead() error {
+	file := filepath.Join(s.rootDir, storeIndexFilename)
+	if !common.Exists(file) {
+		return nil
+	}
+
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	data := xmlStoreIndex{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		return fmt.Errorf("Cannot decode store index: %v", err)
+	}
+	for i, b := range data.Blobs {
+		if !common.Exists(s.objectPath(b.Digest)) {
+			s.Log.Warningf("Store object %s missing, ignored", b.Digest)
+			continue
+		}
+		s.blobs[b.Digest] = &data.Blobs[i]
+	}
+	return nil
+}
+
+// indexWrite saves store index on disk (mutex must be locked)
+func (s *Store) indexWrite() error {
+	data := &xmlStoreIndex{
+		Version: "1",
+		Blobs:   []xsapiv1.StoreBlob{},
+	}
+	for _, b := range s.blobs {
+		data.Blobs = append(data.Blobs, *b)
+	}
+
+	// Write in a temporary file first to never get a truncated index
+	file := filepath.Join(s.rootDir, storeIndexFilename)
+	fd, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	err = enc.Encode(data)
+	if errC := fd.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const syncBandwidthMonitorTime = 60 // Time (in seconds) between two schedule evaluations
+
+// Days names used in schedule (index is time.Weekday)
+var syncBandwidthDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// SyncBandwidth Apply Syncthing rate limits according to a schedule
+type SyncBandwidth struct {
+	*Context
+	status xsapiv1.SyncBandwidthStatus
+	mutex  sync.Mutex
+	stop   chan struct{} // signals intentional stop
+}
+
+type xmlSyncBandwidth struct {
+	XMLName xml.Name                    `xml:"sync-bandwidth"`
+	Version string                      `xml:"version,attr"`
+	Config  xsapiv1.SyncBandwidthConfig `xml:"config"`
+}
+
+// NewSyncBandwidth creates a new instance of SyncBandwidth
+func NewSyncBandwidth(ctx *Context) *SyncBandwidth {
+	b := SyncBandwidth{
+		Context: ctx,
+		status:  xsapiv1.SyncBandwidthStatus{ActiveSlot: -1},
+		mutex:   sync.NewMutex(),
+		stop:    make(chan struct{}),
+	}
+
+	// Config set using REST API overwrites the one of config file
+	if cfg, err := b.loadConfig(); err == nil {
+		b.status.Config = *cfg
+	} else if stCfg := ctx.Config.FileConf.SThgConf; stCfg != nil && stCfg.Bandwidth != nil {
+		b.status.Config = *stCfg.Bandwidth
+	}
+	if err := checkSyncBandwidthConfig(&b.status.Config); err != nil {
+		b.Log.Errorf("Invalid sync bandwidth config, limits disabled: %v", err)
+		b.status.Config = xsapiv1.SyncBandwidthConfig{}
+	}
+	if b.status.Config.Schedule == nil {
+		b.status.Config.Schedule = []xsapiv1.SyncBandwidthSlot{}
+	}
+
+	return &b
+}
+
+// Start applies limits and starts schedule monitoring
+func (b *SyncBandwidth) Start() {
+	if err := b.apply(); err != nil {
+		b.Log.Errorf("Cannot set sync bandwidth limits: %v", err)
+	}
+	go b.monitorSchedule()
+}
+
+// Stop stops schedule monitoring
+func (b *SyncBandwidth) Stop() {
+	close(b.stop)
+}
+
+// Get returns current config and applied limits
+func (b *SyncBandwidth) Get() xsapiv1.SyncBandwidthStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.status
+}
+
+// Set changes limits config, applies and saves it
+func (b *SyncBandwidth) Set(cfg xsapiv1.SyncBandwidthConfig) (xsapiv1.SyncBandwidthStatus, error) {
+	if err := checkSyncBandwidthConfig(&cfg); err != nil {
+		return b.Get(), err
+	}
+	if cfg.Schedule == nil {
+		cfg.Schedule = []xsapiv1.SyncBandwidthSlot{}
+	}
+
+	b.mutex.Lock()
+	b.status.Config = cfg
+	b.mutex.Unlock()
+
+	if err := b.saveConfig(cfg); err != nil {
+		b.Log.Errorf("Cannot save sync bandwidth config: %v", err)
+	}
+	if err := b.apply(); err != nil {
+		return b.Get(), err
+	}
+	return b.Get(), nil
+}
+
+/*** Private functions ***/
+
+// apply sets in Syncthing the limits matching current time
+func (b *SyncBandwidth) apply() error {
+	b.mutex.Lock()
+	cfg := b.status.Config
+	b.mutex.Unlock()
+
+	slot, send, recv := activeSyncBandwidth(&cfg, time.Now())
+	if err := b.SThg.BandwidthSet(send, recv); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if slot != b.status.ActiveSlot || send != b.status.MaxSendKbps || recv != b.status.MaxRecvKbps {
+		b.Log.Infof("Sync bandwidth limits set: send %d KiB/s, receive %d KiB/s (slot %d)", send, recv, slot)
+	}
+	b.status.ActiveSlot = slot
+	b.status.MaxSendKbps = send
+	b.status.MaxRecvKbps = recv
+	return nil
+}
+
+func (b *SyncBandwidth) monitorSchedule() {
+	for {
+		select {
+		case <-b.stop:
+			b.Log.Debugln("Stop sync bandwidth monitorSchedule")
+			return
+		case <-time.After(syncBandwidthMonitorTime * time.Second):
+			if err := b.apply(); err != nil {
+				b.Log.Errorf("Cannot set sync bandwidth limits: %v", err)
+			}
+		}
+	}
+}
+
+// loadConfig reads config saved by Set
+func (b *SyncBandwidth) loadConfig() (*xsapiv1.SyncBandwidthConfig, error) {
+	file, err := xdsconfig.SyncBandwidthConfigFilenameGet()
+	if err != nil {
+		return nil, err
+	}
+	if !common.Exists(file) {
+		return nil, fmt.Errorf("no config saved")
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	data := xmlSyncBandwidth{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data.Config, nil
+}
+
+// saveConfig writes config on disk
+func (b *SyncBandwidth) saveConfig(cfg xsapiv1.SyncBandwidthConfig) error {
+	file, err := xdsconfig.SyncBandwidthConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlSyncBandwidth{Version: "1", Config: cfg})
+}
+
+// checkSyncBandwidthConfig validates (and normalizes) limits config
+func checkSyncBandwidthConfig(cfg *xsapiv1.SyncBandwidthConfig) error {
+	if cfg.MaxSendKbps < 0 || cfg.MaxRecvKbps < 0 {
+		return fmt.Errorf("limits must be positive")
+	}
+	for i := range cfg.Schedule {
+		sl := &cfg.Schedule[i]
+		if _, err := parseDayTime(sl.Start); err != nil {
+			return fmt.Errorf("slot %d: invalid start time '%s'", i, sl.Start)
+		}
+		if _, err := parseDayTime(sl.End); err != nil {
+			return fmt.Errorf("slot %d: invalid end time '%s'", i, sl.End)
+		}
+		if sl.MaxSendKbps < 0 || sl.MaxRecvKbps < 0 {
+			return fmt.Errorf("slot %d: limits must be positive", i)
+		}
+		for j, d := range sl.Days {
+			sl.Days[j] = strings.ToLower(d)
+			if stringInList(sl.Days[j], syncBandwidthDays) {
+				continue
+			}
+			return fmt.Errorf("slot %d: invalid day '%s'", i, d)
+		}
+	}
+	return nil
+}
+
+// activeSyncBandwidth returns the slot index and limits to apply at a given time
+func activeSyncBandwidth(cfg *xsapiv1.SyncBandwidthConfig, now time.Time) (int, int, int) {
+	minutes := now.Hour()*60 + now.Minute()
+	day := syncBandwidthDays[now.Weekday()]
+	prevDay := syncBandwidthDays[(now.Weekday()+6)%7]
+
+	for i, sl := range cfg.Schedule {
+		start, err1 := parseDayTime(sl.Start)
+		end, err2 := parseDayTime(sl.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		match := false
+		if start <= end {
+			match = minutes >= start && minutes < end && slotOnDay(sl, day)
+		} else {
+			// Slot spans midnight: days refer to slot start
+			match = (minutes >= start && slotOnDay(sl, day)) || (minutes < end && slotOnDay(sl, prevDay))
+		}
+		if match {
+			return i, sl.MaxSendKbps, sl.MaxRecvKbps
+		}
+	}
+	return -1, cfg.MaxSendKbps, cfg.MaxRecvKbps
+}
+
+func slotOnDay(sl xsapiv1.SyncBandwidthSlot, day string) bool {
+	return len(sl.Days) == 0 || stringInList(day, sl.Days)
+}
+
+// parseDayTime converts HH:MM into minutes since midnight
+func parseDayTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func stringInList(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
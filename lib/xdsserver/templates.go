@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Keyword replaced by project name in template files
+const templateProjectKey = "@PROJECT_NAME@"
+
+// projectTemplate Definition of a project template
+type projectTemplate struct {
+	description string
+	files       map[string]string
+}
+
+var projectTemplates = map[string]projectTemplate{
+	"helloworld-native": {
+		description: "Native C helloworld built using make",
+		files: map[string]string{
+			"main.c": "#include <stdio.h>\n\nint main(void)\n{\n\tprintf(\"Hello @PROJECT_NAME@ !\\n\");\n\treturn 0;\n}\n",
+			"Makefile": "CC ?= gcc\n\n@PROJECT_NAME@: main.c\n\t$(CC) $(CFLAGS) -o $@ $<\n\n" +
+				"clean:\n\trm -f @PROJECT_NAME@\n\n.PHONY: clean\n",
+		},
+	},
+	"cmake-agl-service": {
+		description: "AGL service (application framework binding) built using CMake",
+		files: map[string]string{
+			"CMakeLists.txt": "cmake_minimum_required(VERSION 3.3)\nproject(@PROJECT_NAME@ C)\n\n" +
+				"include(FindPkgConfig)\npkg_check_modules(AFB REQUIRED afb-daemon)\n\n" +
+				"add_library(@PROJECT_NAME@-binding MODULE src/@PROJECT_NAME@-binding.c)\n" +
+				"target_include_directories(@PROJECT_NAME@-binding PRIVATE ${AFB_INCLUDE_DIRS})\n" +
+				"target_link_libraries(@PROJECT_NAME@-binding ${AFB_LIBRARIES})\n" +
+				"set_target_properties(@PROJECT_NAME@-binding PROPERTIES PREFIX \"\")\n",
+			"src/@PROJECT_NAME@-binding.c": "#define AFB_BINDING_VERSION 2\n#include <afb/afb-binding.h>\n\n" +
+				"static void ping(struct afb_req req)\n{\n\tafb_req_success(req, NULL, \"pong\");\n}\n\n" +
+				"static const struct afb_verb_v2 verbs[] = {\n\t{ .verb = \"ping\", .callback = ping, .session = AFB_SESSION_NONE },\n\t{ .verb = NULL }\n};\n\n" +
+				"const struct afb_binding_v2 afbBindingV2 = {\n\t.api = \"@PROJECT_NAME@\",\n\t.verbs = verbs,\n};\n",
+			"conf.d/wgt/config.xml": "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+				"<widget xmlns=\"http://www.w3.org/ns/widgets\" id=\"@PROJECT_NAME@\" version=\"1.0\">\n" +
+				"  <name>@PROJECT_NAME@</name>\n  <content src=\"lib/@PROJECT_NAME@-binding.so\" type=\"application/vnd.agl.service\"/>\n" +
+				"  <feature name=\"urn:AGL:widget:provided-api\">\n    <param name=\"@PROJECT_NAME@\" value=\"ws\"/>\n  </feature>\n</widget>\n",
+		},
+	},
+	"wgt-app": {
+		description: "HTML5 application packaged as a widget (.wgt)",
+		files: map[string]string{
+			"config.xml": "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+				"<widget xmlns=\"http://www.w3.org/ns/widgets\" id=\"@PROJECT_NAME@\" version=\"1.0\">\n" +
+				"  <name>@PROJECT_NAME@</name>\n  <content src=\"index.html\" type=\"text/html\"/>\n</widget>\n",
+			"index.html": "<!DOCTYPE html>\n<html>\n<head>\n  <meta charset=\"utf-8\">\n  <title>@PROJECT_NAME@</title>\n</head>\n" +
+				"<body>\n  <h1>Hello @PROJECT_NAME@ !</h1>\n</body>\n</html>\n",
+			"Makefile": "@PROJECT_NAME@.wgt: config.xml index.html\n\tzip -r $@ $^\n\n" +
+				"clean:\n\trm -f @PROJECT_NAME@.wgt\n\n.PHONY: clean\n",
+		},
+	},
+}
+
+// Characters allowed in project name used in template files
+var reTemplateName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// GetTemplates returns the list of project templates
+func GetTemplates() []xsapiv1.Template {
+	names := []string{}
+	for name := range projectTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := []xsapiv1.Template{}
+	for _, name := range names {
+		tpl := projectTemplates[name]
+		files := []string{}
+		for fn := range tpl.files {
+			files = append(files, fn)
+		}
+		sort.Strings(files)
+		res = append(res, xsapiv1.Template{Name: name, Description: tpl.description, Files: files})
+	}
+	return res
+}
+
+/*** Private functions ***/
+
+// checkTemplate validates template parameter of a new folder
+func checkTemplate(cfg *xsapiv1.FolderConfig) error {
+	if cfg.Template == "" {
+		return nil
+	}
+	if _, exist := projectTemplates[cfg.Template]; !exist {
+		return fmt.Errorf("unknown template %s", cfg.Template)
+	}
+	if cfg.GitClone != nil {
+		return fmt.Errorf("template and gitClone cannot be used together")
+	}
+	return nil
+}
+
+// applyTemplate creates template files into folder directory
+// (existing files are never overwritten)
+func applyTemplate(name, label, dir string) error {
+	tpl, exist := projectTemplates[name]
+	if !exist {
+		return fmt.Errorf("unknown template %s", name)
+	}
+	if dir == "" {
+		return fmt.Errorf("folder path not available")
+	}
+
+	prjName := strings.Trim(reTemplateName.ReplaceAllString(label, "-"), "-")
+	if prjName == "" {
+		prjName = "project"
+	}
+
+	for fn, content := range tpl.files {
+		dst := filepath.Join(dir, strings.Replace(fn, templateProjectKey, prjName, -1))
+		if common.Exists(dst) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("Cannot create template directory: %v", err)
+		}
+		data := strings.Replace(content, templateProjectKey, prjName, -1)
+		if err := ioutil.WriteFile(dst, []byte(data), 0644); err != nil {
+			return fmt.Errorf("Cannot create template file: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,481 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const webhookDefaultTimeout = 10    // Default maximum duration (in seconds) of a request
+const webhookDefaultAttempts = 5    // Default number of attempts before a delivery fails
+const webhookDefaultRetryDelay = 10 // Default delay (in seconds) before first retry
+const webhookMaxPending = 100       // Maximum number of pending deliveries per webhook
+const webhookMaxDeliveries = 50     // Number of last deliveries kept per webhook
+const webhookEventHeader = "X-XDS-Event"
+const webhookDeliveryHeader = "X-XDS-Delivery"
+
+var webhookNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Webhooks Notification of server events to registered HTTP endpoints
+// (deliveries of a webhook are sent in order and retried on failure)
+type Webhooks struct {
+	*Context
+	disabled    bool
+	maxAttempts int
+	retryDelay  time.Duration
+	client      *http.Client
+	hooks       []xsapiv1.Webhook
+	queues      map[string]*webhookQueue
+	mutex       sync.Mutex
+	stop        chan struct{} // signals intentional stop
+}
+
+// webhookQueue Deliveries of a webhook
+type webhookQueue struct {
+	pending    []*webhookJob              // oldest first
+	deliveries []*xsapiv1.WebhookDelivery // last deliveries, oldest first
+	delivered  uint64
+	failed     uint64
+	running    bool // sender routine is running
+}
+
+// webhookJob Pending delivery
+type webhookJob struct {
+	status *xsapiv1.WebhookDelivery
+	body   []byte
+	next   time.Time
+}
+
+// xmlWebhooks On disk format of registered webhooks
+type xmlWebhooks struct {
+	XMLName  xml.Name          `xml:"Webhooks"`
+	Version  string            `xml:"version,attr"`
+	Webhooks []xsapiv1.Webhook `xml:"webhook"`
+}
+
+// NewWebhooks creates a new instance of Webhooks
+func NewWebhooks(ctx *Context) *Webhooks {
+	w := Webhooks{
+		Context:     ctx,
+		maxAttempts: webhookDefaultAttempts,
+		retryDelay:  webhookDefaultRetryDelay * time.Second,
+		hooks:       []xsapiv1.Webhook{},
+		queues:      make(map[string]*webhookQueue),
+		mutex:       sync.NewMutex(),
+		stop:        make(chan struct{}),
+	}
+	timeout := webhookDefaultTimeout * time.Second
+	if cfg := ctx.Config.FileConf.WebhooksConf; cfg != nil {
+		w.disabled = cfg.Disabled
+		if cfg.TimeoutS > 0 {
+			timeout = time.Duration(cfg.TimeoutS) * time.Second
+		}
+		if cfg.MaxAttempts > 0 {
+			w.maxAttempts = cfg.MaxAttempts
+		}
+		if cfg.RetryDelayS > 0 {
+			w.retryDelay = time.Duration(cfg.RetryDelayS) * time.Second
+		}
+	}
+	w.client = &http.Client{Timeout: timeout}
+	w.load()
+	return &w
+}
+
+// Stop webhooks deliveries (pending deliveries are lost)
+func (w *Webhooks) Stop() {
+	close(w.stop)
+}
+
+// GetAll returns registered webhooks and their deliveries status
+func (w *Webhooks) GetAll() []xsapiv1.WebhookStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	res := []xsapiv1.WebhookStatus{}
+	for _, hook := range w.hooks {
+		st := xsapiv1.WebhookStatus{Webhook: hook}
+		if q, exist := w.queues[hook.Name]; exist {
+			st.Pending = len(q.pending)
+			st.Delivered = q.delivered
+			st.Failed = q.failed
+			if n := len(q.deliveries); n > 0 {
+				last := *q.deliveries[n-1]
+				st.LastDelivery = &last
+			}
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Set registers (or replaces) a webhook
+func (w *Webhooks) Set(hook xsapiv1.Webhook) (*xsapiv1.Webhook, error) {
+	if !webhookNameRe.MatchString(hook.Name) {
+		return nil, fmt.Errorf("invalid webhook name")
+	}
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url")
+	}
+	if hook.Secret != "" && !w.secrets.Exists(hook.Secret) {
+		return nil, fmt.Errorf("unknown secret %s", hook.Secret)
+	}
+	evs := []string{}
+	for _, ev := range hook.Events {
+		if ev == xsapiv1.EVTAll {
+			evs = []string{}
+			break
+		}
+		if _, ok := w.events.eventsMap[ev]; !ok {
+			return nil, fmt.Errorf("Unsupported event type name '%s'", ev)
+		}
+		evs = append(evs, ev)
+	}
+	hook.Events = evs
+	if hook.FolderIDs == nil {
+		hook.FolderIDs = []string{}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	replaced := false
+	for i := range w.hooks {
+		if w.hooks[i].Name == hook.Name {
+			w.hooks[i] = hook
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		w.hooks = append(w.hooks, hook)
+	}
+	if err := w.save(); err != nil {
+		return nil, fmt.Errorf("Cannot save webhooks: %v", err)
+	}
+	return &hook, nil
+}
+
+// Delete removes a webhook (and its pending deliveries)
+func (w *Webhooks) Delete(name string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for i, hook := range w.hooks {
+		if hook.Name == name {
+			w.hooks = append(w.hooks[:i], w.hooks[i+1:]...)
+			delete(w.queues, name)
+			return w.save()
+		}
+	}
+	return fmt.Errorf("unknown webhook %s", name)
+}
+
+// Deliveries returns last deliveries of a webhook
+func (w *Webhooks) Deliveries(name string) ([]xsapiv1.WebhookDelivery, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, err := w.getUnsafe(name); err != nil {
+		return nil, err
+	}
+	res := []xsapiv1.WebhookDelivery{}
+	if q, exist := w.queues[name]; exist {
+		for _, d := range q.deliveries {
+			res = append(res, *d)
+		}
+	}
+	return res, nil
+}
+
+// Notify queues delivery of an event to the webhooks it matches
+func (w *Webhooks) Notify(msg xsapiv1.EventMsg) {
+	if w.disabled {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var body []byte
+	fldID := ""
+	for _, hook := range w.hooks {
+		if !webhookAccepted(hook, msg.Type, msg.Data, &fldID) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(msg.External()); err != nil {
+				w.Log.Errorf("Cannot encode event %s for webhooks: %v", msg.Type, err)
+				return
+			}
+		}
+		w.queueUnsafe(hook.Name, msg, body)
+	}
+}
+
+/*** Private functions ***/
+
+// webhookAccepted returns true when a webhook is notified of an event (folder
+// ID is only retrieved once for all webhooks)
+func webhookAccepted(hook xsapiv1.Webhook, evName string, data interface{}, fldID *string) bool {
+	if hook.Disabled {
+		return false
+	}
+	if len(hook.Events) > 0 && !webhookListHas(hook.Events, evName) {
+		return false
+	}
+	if len(hook.FolderIDs) > 0 {
+		if *fldID == "" {
+			*fldID = eventFolderID(data)
+		}
+		if *fldID != "" && !webhookListHas(hook.FolderIDs, *fldID) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookListHas returns true when list contains value
+func webhookListHas(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// getUnsafe returns a registered webhook (mutex must be locked)
+func (w *Webhooks) getUnsafe(name string) (*xsapiv1.Webhook, error) {
+	for _, hook := range w.hooks {
+		if hook.Name == name {
+			res := hook
+			return &res, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown webhook %s", name)
+}
+
+// queueUnsafe adds a delivery and starts sender routine of webhook (mutex
+// must be locked)
+func (w *Webhooks) queueUnsafe(name string, msg xsapiv1.EventMsg, body []byte) {
+	q, exist := w.queues[name]
+	if !exist {
+		q = &webhookQueue{}
+		w.queues[name] = q
+	}
+
+	now := time.Now()
+	d := &xsapiv1.WebhookDelivery{
+		ID:            uuid.NewV1().String(),
+		Webhook:       name,
+		EventType:     msg.Type,
+		EventSeq:      msg.Seq,
+		Status:        xsapiv1.WebhookDeliveryPending,
+		CreatedAt:     now.Format(time.RFC3339),
+		NextAttemptAt: now.Format(time.RFC3339),
+	}
+	q.deliveries = append(q.deliveries, d)
+	if len(q.deliveries) > webhookMaxDeliveries {
+		q.deliveries = q.deliveries[len(q.deliveries)-webhookMaxDeliveries:]
+	}
+
+	if len(q.pending) >= webhookMaxPending {
+		w.Log.Warningf("Webhook %s: too many pending deliveries, drop event %s", name, msg.Type)
+		d.Status = xsapiv1.WebhookDeliveryFailed
+		d.Error = "too many pending deliveries"
+		d.NextAttemptAt = ""
+		q.failed++
+		return
+	}
+	q.pending = append(q.pending, &webhookJob{status: d, body: body, next: now})
+
+	if !q.running {
+		q.running = true
+		go w.sender(name, q)
+	}
+}
+
+// sender posts pending deliveries of a webhook in order, routine exits when
+// no more delivery is pending
+func (w *Webhooks) sender(name string, q *webhookQueue) {
+	for {
+		w.mutex.Lock()
+		if w.queues[name] != q || len(q.pending) == 0 {
+			// No more pending or webhook deleted
+			q.running = false
+			w.mutex.Unlock()
+			return
+		}
+		job := q.pending[0]
+		wait := job.next.Sub(time.Now())
+		w.mutex.Unlock()
+
+		if wait > 0 {
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		w.mutex.Lock()
+		hook, err := w.getUnsafe(name)
+		w.mutex.Unlock()
+		if err != nil {
+			continue
+		}
+
+		code, err := w.post(*hook, job)
+
+		w.mutex.Lock()
+		now := time.Now()
+		d := job.status
+		d.Attempts++
+		d.StatusCode = code
+		d.LastAttemptAt = now.Format(time.RFC3339)
+		d.NextAttemptAt = ""
+		d.Error = ""
+		if err == nil {
+			d.Status = xsapiv1.WebhookDeliveryDelivered
+			q.delivered++
+			q.pending = q.pending[1:]
+		} else {
+			d.Error = err.Error()
+			if d.Attempts < w.maxAttempts && webhookRetryable(code) {
+				job.next = now.Add(w.retryDelay << uint(d.Attempts-1))
+				d.NextAttemptAt = job.next.Format(time.RFC3339)
+				w.Log.Debugf("Webhook %s: delivery %s failed (attempt %d), retry at %v: %v", name, d.ID, d.Attempts, job.next, err)
+			} else {
+				w.Log.Warningf("Webhook %s: delivery %s of event %s failed: %v", name, d.ID, d.EventType, err)
+				d.Status = xsapiv1.WebhookDeliveryFailed
+				q.failed++
+				q.pending = q.pending[1:]
+			}
+		}
+		w.mutex.Unlock()
+
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+	}
+}
+
+// webhookRetryable returns false when endpoint rejected a request (4xx
+// status, except timeout and rate limiting)
+func webhookRetryable(code int) bool {
+	if code >= 400 && code < 500 {
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// post sends an event, payload is signed (HMAC-SHA256) when a secret is set
+func (w *Webhooks) post(hook xsapiv1.Webhook, job *webhookJob) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, job.status.EventType)
+	req.Header.Set(webhookDeliveryHeader, job.status.ID)
+	if hook.Secret != "" {
+		secret, err := w.secrets.Get(hook.Secret)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set(hookSignatureHeader, hookSignature(secret, job.body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// load reads registered webhooks from disk
+func (w *Webhooks) load() {
+	file, err := xdsconfig.WebhooksConfigFilenameGet()
+	if err != nil || !common.Exists(file) {
+		return
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		w.Log.Errorf("Cannot read webhooks: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	data := xmlWebhooks{}
+	if err := xml.NewDecoder(fd).Decode(&data); err != nil {
+		w.Log.Errorf("Cannot decode webhooks: %v", err)
+		return
+	}
+	w.hooks = data.Webhooks
+}
+
+// save writes registered webhooks on disk (mutex must be locked)
+func (w *Webhooks) save() error {
+	file, err := xdsconfig.WebhooksConfigFilenameGet()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Only owner can read file (webhooks may hold credentials in URL)
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	return enc.Encode(&xmlWebhooks{Version: "1", Webhooks: w.hooks})
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+const corsDefaultMaxAge = 3600
+
+var corsDefaultMethods = []string{"GET", "POST", "PUT", "DELETE"}
+var corsDefaultHeaders = []string{"Content-Type", "Authorization", sessionHeaderName, sessionUserHeaderName}
+var corsDefaultExposed = []string{sessionHeaderName, "XDS-Version", "XDS-API-Version"}
+
+// corsPolicy Cross-origin requests policy defined in config
+type corsPolicy struct {
+	origins     []string
+	anyOrigin   bool
+	methods     string
+	headers     string
+	anyHeader   bool
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// newCORSPolicy creates a policy from config
+func newCORSPolicy(cfg *xdsconfig.CORSConf) *corsPolicy {
+	p := corsPolicy{
+		credentials: cfg.AllowCredentials,
+		maxAge:      strconv.Itoa(corsDefaultMaxAge),
+	}
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			p.anyOrigin = true
+		}
+		p.origins = append(p.origins, strings.ToLower(strings.TrimRight(o, "/")))
+	}
+	methods, headers, exposed := cfg.AllowedMethods, cfg.AllowedHeaders, cfg.ExposedHeaders
+	if len(methods) == 0 {
+		methods = corsDefaultMethods
+	}
+	if len(headers) == 0 {
+		headers = corsDefaultHeaders
+	}
+	if len(exposed) == 0 {
+		exposed = corsDefaultExposed
+	}
+	for _, h := range headers {
+		if h == "*" {
+			p.anyHeader = true
+		}
+	}
+	p.methods = strings.ToUpper(strings.Join(methods, ", "))
+	p.headers = strings.Join(headers, ", ")
+	p.exposed = strings.Join(exposed, ", ")
+	if cfg.MaxAgeS > 0 {
+		p.maxAge = strconv.Itoa(cfg.MaxAgeS)
+	}
+	return &p
+}
+
+// allowed returns true when an origin matches one of allowed origins
+func (p *corsPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.anyOrigin {
+		return true
+	}
+	for _, o := range p.origins {
+		if o == origin {
+			return true
+		}
+		if strings.Contains(o, "*") {
+			if ok, _ := path.Match(o, origin); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handle sets CORS headers, returns false when request has been answered
+// (preflight requests)
+func (p *corsPolicy) handle(c *gin.Context) bool {
+	origin := c.Request.Header.Get("Origin")
+	preflight := c.Request.Method == "OPTIONS" && c.Request.Header.Get("Access-Control-Request-Method") != ""
+	if origin == "" {
+		return true
+	}
+	c.Writer.Header().Add("Vary", "Origin")
+	if !p.allowed(origin) {
+		if preflight {
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+		// Browser rejects reply without CORS headers
+		return true
+	}
+
+	// Wildcard cannot be used with credentials
+	if p.anyOrigin && !p.credentials {
+		c.Header("Access-Control-Allow-Origin", "*")
+	} else {
+		c.Header("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		c.Header("Access-Control-Expose-Headers", p.exposed)
+		return true
+	}
+	c.Header("Access-Control-Allow-Methods", p.methods)
+	if p.anyHeader {
+		c.Header("Access-Control-Allow-Headers", c.Request.Header.Get("Access-Control-Request-Headers"))
+	} else {
+		c.Header("Access-Control-Allow-Headers", p.headers)
+	}
+	c.Header("Access-Control-Max-Age", p.maxAge)
+	c.AbortWithStatus(http.StatusNoContent)
+	return false
+}
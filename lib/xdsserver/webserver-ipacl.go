@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Minimum delay between 2 audit entries of denied requests of a same address
+const ipACLAuditInterval = time.Minute
+
+// ipACL Network access control list
+type ipACL struct {
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	trustProxy bool
+	audited    map[string]time.Time // last audit entry per address
+	suppressed map[string]int       // denied requests not yet audited per address
+	mutex      sync.Mutex
+}
+
+// newIPACL creates an access control list from config
+func newIPACL(cfg *xdsconfig.IPACLConf) (*ipACL, error) {
+	acl := ipACL{
+		trustProxy: cfg.TrustProxy,
+		audited:    make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		mutex:      sync.NewMutex(),
+	}
+	var err error
+	if acl.allow, err = parseIPNets(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseIPNets(cfg.Deny); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// allowed returns true when an address is allowed to access server
+func (a *ipACL) allowed(ip net.IP) bool {
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns address of peer (or the one set by reverse proxy)
+func (a *ipACL) clientIP(c *gin.Context) string {
+	if a.trustProxy {
+		return c.ClientIP()
+	}
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// toAudit returns true when a denied request must be added to audit trail,
+// with the number of previous denied requests that have not been audited
+func (a *ipACL) toAudit(ip string) (bool, int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if last, exist := a.audited[ip]; exist && now.Sub(last) < ipACLAuditInterval {
+		a.suppressed[ip]++
+		return false, 0
+	}
+	// Forget addresses that have not been audited recently
+	for addr, last := range a.audited {
+		if now.Sub(last) >= ipACLAuditInterval && addr != ip {
+			delete(a.audited, addr)
+			delete(a.suppressed, addr)
+		}
+	}
+	a.audited[ip] = now
+	n := a.suppressed[ip]
+	delete(a.suppressed, ip)
+	return true, n
+}
+
+// IP access control middleware (applied before authentication)
+func (s *WebServer) middlewareIPACL(acl *ipACL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Access to Unix socket is controlled by file permissions
+		if _, isUnix := c.Request.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); isUnix {
+			c.Next()
+			return
+		}
+
+		addr := acl.clientIP(c)
+		if ip := net.ParseIP(addr); ip != nil && acl.allowed(ip) {
+			c.Next()
+			return
+		}
+
+		s.Log.Warningf("Access denied to %s (%s %s)", addr, c.Request.Method, c.Request.URL.Path)
+		if audit, n := acl.toAudit(addr); audit && s.audit != nil {
+			details := fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path)
+			if n > 0 {
+				details += fmt.Sprintf(" (%d previous attempts not recorded)", n)
+			}
+			s.audit.Add(xsapiv1.AuditEntry{
+				Action:   xsapiv1.AuditActionAccessDenied,
+				Target:   addr,
+				Details:  details,
+				ClientIP: addr,
+				Result:   xsapiv1.AuditResultFailure,
+				Error:    "address not allowed",
+			})
+		}
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": "Access denied"})
+		c.Abort()
+	}
+}
+
+/*** Private functions ***/
+
+// parseIPNets parses a list of addresses or networks (CIDR notation)
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	res := []*net.IPNet{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network ACL entry '%s'", s)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const tlsDefaultReloadCheck = 60                   // Time (in seconds) between two checks of certificate files
+const tlsSelfSignedDuration = 365 * 24 * time.Hour // Validity of generated self-signed certificates
+
+// TLSCerts Certificate of web server, reloaded on SIGHUP or when files changed
+type TLSCerts struct {
+	*Context
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time // most recent modification time of certificate files
+	check    time.Duration
+	mutex    sync.Mutex
+	stop     chan struct{} // signals intentional stop
+}
+
+// NewTLSCerts creates a new instance of TLSCerts (a self-signed certificate
+// is generated when requested)
+func NewTLSCerts(ctx *Context, cfg *xdsconfig.TLSConf) (*TLSCerts, error) {
+	t := TLSCerts{
+		Context:  ctx,
+		certFile: cfg.CertFile,
+		keyFile:  cfg.KeyFile,
+		check:    tlsDefaultReloadCheck * time.Second,
+		mutex:    sync.NewMutex(),
+		stop:     make(chan struct{}),
+	}
+	if cfg.ReloadCheckS > 0 {
+		t.check = time.Duration(cfg.ReloadCheckS) * time.Second
+	} else if cfg.ReloadCheckS < 0 {
+		t.check = 0
+	}
+
+	var err error
+	if t.certFile == "" && t.keyFile == "" && cfg.SelfSigned {
+		if t.certFile, err = xdsconfig.TLSCertFilenameGet(); err != nil {
+			return nil, err
+		}
+		if t.keyFile, err = xdsconfig.TLSKeyFilenameGet(); err != nil {
+			return nil, err
+		}
+	}
+	if t.certFile == "" || t.keyFile == "" {
+		return nil, fmt.Errorf("TLS: certFile and keyFile must be set (or use selfSigned)")
+	}
+	if cfg.SelfSigned && !common.Exists(t.certFile) && !common.Exists(t.keyFile) {
+		if err := t.generateSelfSigned(); err != nil {
+			return nil, fmt.Errorf("Cannot generate self-signed certificate: %v", err)
+		}
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Start starts monitoring of SIGHUP and of certificate files
+func (t *TLSCerts) Start() {
+	go t.monitorLoop()
+}
+
+// Stop stops monitoring
+func (t *TLSCerts) Stop() {
+	close(t.stop)
+}
+
+// Config returns the TLS configuration used by web server
+func (t *TLSCerts) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: t.getCertificate,
+	}
+}
+
+// Reload loads certificate files (previous certificate is kept on error)
+func (t *TLSCerts) Reload() error {
+	modTime := t.filesModTime()
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		// Don't retry until files change again
+		t.mutex.Lock()
+		t.modTime = modTime
+		t.mutex.Unlock()
+		return fmt.Errorf("Cannot load TLS certificate: %v", err)
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		t.Log.Infof("TLS certificate loaded: %s (expire %v)", leaf.Subject.CommonName, leaf.NotAfter)
+		if time.Now().After(leaf.NotAfter) {
+			t.Log.Warningf("TLS certificate %s expired", t.certFile)
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.cert = &cert
+	t.modTime = modTime
+	return nil
+}
+
+/*** Private functions ***/
+
+func (t *TLSCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.cert, nil
+}
+
+func (t *TLSCerts) monitorLoop() {
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	defer signal.Stop(sigHup)
+
+	var tick <-chan time.Time
+	if t.check > 0 {
+		ticker := time.NewTicker(t.check)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-t.stop:
+			t.Log.Debugln("Stop TLS certificate monitorLoop")
+			return
+		case <-sigHup:
+			t.Log.Infof("SIGHUP received, reload TLS certificate")
+			if err := t.Reload(); err != nil {
+				t.Log.Errorf("%v", err)
+			}
+		case <-tick:
+			t.mutex.Lock()
+			changed := t.filesModTime().After(t.modTime)
+			t.mutex.Unlock()
+			if changed {
+				t.Log.Infof("TLS certificate files changed, reload them")
+				if err := t.Reload(); err != nil {
+					t.Log.Errorf("%v", err)
+				}
+			}
+		}
+	}
+}
+
+// filesModTime returns the most recent modification time of certificate files
+func (t *TLSCerts) filesModTime() time.Time {
+	res := time.Time{}
+	for _, f := range []string{t.certFile, t.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(res) {
+			res = fi.ModTime()
+		}
+	}
+	return res
+}
+
+// generateSelfSigned creates a certificate valid for host name and local addresses
+func (t *TLSCerts) generateSelfSigned() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"XDS server (self-signed)"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(tlsSelfSignedDuration),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.certFile), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.keyFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(t.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(t.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	t.Log.Infof("Self-signed TLS certificate generated: %s", t.certFile)
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+const unixSocketDefaultMode = 0660
+
+// listenUnix creates the Unix domain socket used to serve API, access is
+// controlled by socket file permissions and group owner
+func (s *WebServer) listenUnix(cfg *xdsconfig.UnixConf) (net.Listener, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("Unix socket path not set")
+	}
+	mode := os.FileMode(unixSocketDefaultMode)
+	if cfg.Mode != "" {
+		m, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Unix socket mode '%s': %v", cfg.Mode, err)
+		}
+		mode = os.FileMode(m)
+	}
+	gid := -1
+	if cfg.Group != "" {
+		grp, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Unix socket group: %v", err)
+		}
+		if gid, err = strconv.Atoi(grp.Gid); err != nil {
+			return nil, fmt.Errorf("Invalid Unix socket group: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create Unix socket directory: %v", err)
+	}
+
+	// Remove stale socket (left by a previous instance), but never a regular file
+	if fi, err := os.Lstat(cfg.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", cfg.Path)
+		}
+		if conn, err := net.Dial("unix", cfg.Path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s already used by another server", cfg.Path)
+		}
+		os.Remove(cfg.Path)
+	}
+
+	l, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(cfg.Path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Cannot set Unix socket permissions: %v", err)
+	}
+	if gid != -1 {
+		if err := os.Chown(cfg.Path, -1, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Cannot set Unix socket group: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// serveUnix serves API on Unix domain socket (never returns unless error)
+func (s *WebServer) serveUnix(l net.Listener) error {
+	srv := &http.Server{Handler: s.router}
+	msg := fmt.Sprintf("Web Server running on unix:%s ...\n", l.Addr().String())
+	s.Log.Infof(msg)
+	fmt.Printf(msg)
+	return srv.Serve(l)
+}
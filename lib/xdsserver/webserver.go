@@ -20,6 +20,7 @@ package xdsserver
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 
@@ -29,6 +30,7 @@ import (
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 	"github.com/googollee/go-socket.io"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
 // WebServer .
@@ -38,6 +40,8 @@ type WebServer struct {
 	api       *APIService
 	sIOServer *socketio.Server
 	webApp    *gin.RouterGroup
+	tlsCerts  *TLSCerts
+	unixLn    net.Listener
 	stop      chan struct{} // signals intentional stop
 }
 
@@ -82,6 +86,14 @@ func (s *WebServer) Serve() error {
 	// Setup middlewares
 	s.router.Use(gin.Logger())
 	s.router.Use(gin.Recovery())
+	if aclCfg := s.Config.FileConf.IPACLConf; aclCfg != nil {
+		acl, err := newIPACL(aclCfg)
+		if err != nil {
+			return err
+		}
+		s.Log.Infof("Network ACL: allow %v, deny %v", aclCfg.Allow, aclCfg.Deny)
+		s.router.Use(s.middlewareIPACL(acl))
+	}
 	s.router.Use(s.middlewareXDSDetails())
 	s.router.Use(s.middlewareCORS())
 
@@ -113,14 +125,48 @@ func (s *WebServer) Serve() error {
 		s.webApp.GET("/")
 	}
 
+	// Native HTTPS support
+	srv := &http.Server{Addr: ":" + s.Config.FileConf.HTTPPort, Handler: s.router}
+	scheme := "http"
+	if tlsCfg := s.Config.FileConf.TLSConf; tlsCfg != nil {
+		if s.tlsCerts, err = NewTLSCerts(s.Context, tlsCfg); err != nil {
+			return err
+		}
+		s.tlsCerts.Start()
+		srv.TLSConfig = s.tlsCerts.Config()
+		if s.agentsCA != nil {
+			s.agentsCA.SetupTLS(srv.TLSConfig)
+		}
+		scheme = "https"
+	}
+
+	// Local-only access using a Unix domain socket
+	unixCfg := s.Config.FileConf.UnixConf
+	if unixCfg != nil {
+		if s.unixLn, err = s.listenUnix(unixCfg); err != nil {
+			return err
+		}
+	}
+
 	// Serve in the background
-	serveError := make(chan error, 1)
-	go func() {
-		msg := fmt.Sprintf("Web Server running on localhost:%s ...\n", s.Config.FileConf.HTTPPort)
-		s.Log.Infof(msg)
-		fmt.Printf(msg)
-		serveError <- http.ListenAndServe(":"+s.Config.FileConf.HTTPPort, s.router)
-	}()
+	serveError := make(chan error, 2)
+	if s.unixLn != nil {
+		go func() {
+			serveError <- s.serveUnix(s.unixLn)
+		}()
+	}
+	if unixCfg == nil || !unixCfg.DisableTCP {
+		go func() {
+			msg := fmt.Sprintf("Web Server running on %s://localhost:%s ...\n", scheme, s.Config.FileConf.HTTPPort)
+			s.Log.Infof(msg)
+			fmt.Printf(msg)
+			if srv.TLSConfig != nil {
+				serveError <- srv.ListenAndServeTLS("", "")
+			} else {
+				serveError <- srv.ListenAndServe()
+			}
+		}()
+	}
 
 	// Wait for stop, restart or error signals
 	select {
@@ -128,12 +174,52 @@ func (s *WebServer) Serve() error {
 		// Shutting down permanently
 		s.sessions.Stop()
 		s.sdks.Stop()
+		s.approvals.Stop()
+		s.audit.Stop()
+		s.apiTokens.Stop()
+		s.folderWatch.Stop()
+		s.folderHealth.Stop()
+		s.autoBuild.Stop()
+		s.schedules.Stop()
+		s.nodes.Stop()
+		s.folderCrypt.Stop()
+		s.execPtys.Stop()
+		s.debugs.Stop()
+		s.execMetrics.Stop()
+		s.outStreams.Stop()
+		s.webhooks.Stop()
+		if s.inotify != nil {
+			s.inotify.Stop()
+		}
+		if s.syncProgress != nil {
+			s.syncProgress.Stop()
+		}
+		if s.conflicts != nil {
+			s.conflicts.Stop()
+		}
+		if s.bandwidth != nil {
+			s.bandwidth.Stop()
+		}
+		if s.tlsCerts != nil {
+			s.tlsCerts.Stop()
+		}
+		if s.rateLimit != nil {
+			s.rateLimit.Stop()
+		}
+		if s.mqtt != nil {
+			s.mqtt.Stop()
+		}
 		s.Log.Infoln("shutting down (stop)")
 	case err = <-serveError:
 		// Error due to listen/serve failure
 		s.Log.Errorln(err)
 	}
 
+	// Closing listener also removes socket file
+	if s.unixLn != nil {
+		s.unixLn.Close()
+	}
+
 	return nil
 }
 
@@ -156,9 +242,20 @@ func (s *WebServer) middlewareXDSDetails() gin.HandlerFunc {
 	}
 }
 
-// CORS middleware
+// CORS middleware (policy defined in config, or only answer preflight requests)
 func (s *WebServer) middlewareCORS() gin.HandlerFunc {
+	var policy *corsPolicy
+	if cfg := s.Config.FileConf.CORSConf; cfg != nil {
+		policy = newCORSPolicy(cfg)
+		s.Log.Infof("CORS allowed origins: %v", cfg.AllowedOrigins)
+	}
 	return func(c *gin.Context) {
+		if policy != nil {
+			if policy.handle(c) {
+				c.Next()
+			}
+			return
+		}
 		if c.Request.Method == "OPTIONS" {
 			c.Header("Access-Control-Allow-Origin", "*")
 			c.Header("Access-Control-Allow-Headers", "Content-Type")
@@ -181,14 +278,50 @@ func (s *WebServer) socketHandler(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Cannot retrieve session"})
 		return
 	}
+	if s.authRequired() && !sess.IsAuthenticated() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	if s.agentsCA != nil && s.agentsCA.Required() && s.agentsCA.Verified(c.Request) == nil && !sess.IsAuthenticated() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Valid agent certificate required"})
+		return
+	}
 
+	// Handler is shared by all sockets, so session must be retrieved from
+	// handshake request of each socket (not from this request)
 	s.sIOServer.On("connection", func(so socketio.Socket) {
 		s.Log.Debugf("WS Connected (SID=%v)", so.Id())
-		s.sessions.UpdateIOSocket(sess.ID, &so)
+		sess := s.sessions.GetRequest(so.Request())
+		if sess == nil {
+			s.Log.Debugf("WS SID=%v: unknown session", so.Id())
+			so.Disconnect()
+			return
+		}
+		sid := sess.ID
+		s.sessions.UpdateIOSocket(sid, &so)
 
 		so.On("disconnection", func() {
 			s.Log.Debugf("WS disconnected (SID=%v)", so.Id())
-			s.sessions.UpdateIOSocket(sess.ID, nil)
+			s.sessions.UpdateIOSocket(sid, nil)
+		})
+
+		// Keystrokes and terminal resize of commands running in a pty
+		so.On(xsapiv1.ExecPtyInEvent, func(msg xsapiv1.ExecInMsg) {
+			if err := s.execPtys.Write(msg.CmdID, s.socketSessionID(so), msg.Stdin); err != nil {
+				s.Log.Debugf("%s: %v", xsapiv1.ExecPtyInEvent, err)
+			}
+		})
+		so.On(xsapiv1.ExecPtyResizeEvent, func(args xsapiv1.ExecResizeArgs) {
+			if err := s.execPtys.Resize(args.CmdID, s.socketSessionID(so), args.Rows, args.Cols); err != nil {
+				s.Log.Debugf("%s: %v", xsapiv1.ExecPtyResizeEvent, err)
+			}
+		})
+
+		// GDB/MI commands of debug sessions
+		so.On(xsapiv1.DebugMIInEvent, func(msg xsapiv1.DebugMIInMsg) {
+			if err := s.debugs.Write(msg.ID, s.socketSessionID(so), msg.Line); err != nil {
+				s.Log.Debugf("%s: %v", xsapiv1.DebugMIInEvent, err)
+			}
 		})
 	})
 
@@ -198,3 +331,12 @@ func (s *WebServer) socketHandler(c *gin.Context) {
 
 	s.sIOServer.ServeHTTP(c.Writer, c.Request)
 }
+
+// socketSessionID returns the ID of the session of a socket (retrieved from
+// its handshake request, empty when session is closed or token revoked)
+func (s *WebServer) socketSessionID(so socketio.Socket) string {
+	if sess := s.sessions.GetRequest(so.Request()); sess != nil {
+		return sess.ID
+	}
+	return ""
+}
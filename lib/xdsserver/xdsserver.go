@@ -52,6 +52,50 @@ type Context struct {
 	WWWServer     *WebServer
 	sessions      *Sessions
 	events        *Events
+	approvals     *Approvals
+	audit         *Audit
+	apiTokens     *APITokens
+	oidc          *OIDC
+	ldap          *LDAP
+	roles         *Roles
+	agentsCA      *AgentsCA
+	rateLimit     *RateLimiter
+	inotify       *InotifyMonitor
+	syncProgress  *SyncProgressMonitor
+	conflicts     *ConflictMonitor
+	bandwidth     *SyncBandwidth
+	folderStats   *FolderStats
+	secrets       *Secrets
+	folderWatch   *FolderWatcher
+	folderCrypt   *FolderCrypt
+	folderHealth  *FolderHealthMonitor
+	autoBuild     *AutoBuilder
+	builds        *Builds
+	matrices      *Matrices
+	deploys       *Deployments
+	schedules     *Schedules
+	nodes         *Nodes
+	execInputs    *ExecInputs
+	execSteps     *ExecSteps
+	execPtys      *ExecPtys
+	debugs        *DebugSessions
+	scheduler     *ExecScheduler
+	execHistory   *ExecHistory
+	execHooks     *ExecHooks
+	webhooks      *Webhooks
+	mqtt          *MQTTBridge
+	execMetrics   *ExecMetrics
+	execOutputs   *ExecOutputs
+	outStreams    *OutputStreams
+	presets       *ExecPresets
+	ccache        *Ccache
+	artifacts     *Artifacts
+	containers    *Containers
+	cancels       *ExecCancels
+	store         *Store
+	snapshots     *FolderSnapshots
+	fileAttrs     *FileAttrs
+	chaos         chaosHooks
 	Exit          chan os.Signal
 }
 
@@ -137,6 +181,9 @@ func (ctx *Context) Run() (int, error) {
 		ctx.SThg = st.NewSyncThing(ctx.Config, ctx.Log)
 	}
 
+	// Fault injection hooks (only enabled when built with chaos tag)
+	ctx.chaos.init(ctx)
+
 	// Start local instance of Syncthing and Syncthing-notify
 	if ctx.SThg != nil {
 		ctx.Log.Infof("Starting Syncthing...")
@@ -178,20 +225,202 @@ func (ctx *Context) Run() (int, error) {
 		ctx.Config.SupportedSharing[xsapiv1.TypeCloudSync] = true
 	}
 
+	// rsync folders only require rsync and ssh tools
+	if _, err := exec.LookPath("rsync"); err == nil {
+		ctx.Config.SupportedSharing[xsapiv1.TypeRsync] = true
+	}
+	ctx.Config.SupportedSharing[xsapiv1.TypeNfs] = true
+	ctx.Config.SupportedSharing[xsapiv1.TypeCifsSmb] = true
+
+	// Credentials used to access external resources
+	ctx.secrets = NewSecrets(ctx)
+
+	// At rest encryption of folders (must be ready before folders setup)
+	ctx.folderCrypt = NewFolderCrypt(ctx)
+
 	// Init model folder
 	ctx.mfolders = FoldersNew(ctx)
+	ctx.folderStats = NewFolderStats(ctx)
 
 	// Load initial folders config from disk
 	if err := ctx.mfolders.LoadConfig(); err != nil {
 		return -5, err
 	}
 
+	// Files change notification of watched folders
+	ctx.folderWatch = NewFolderWatcher(ctx)
+	ctx.folderWatch.Start()
+
+	// Periodic folders health check and auto-repair
+	ctx.folderHealth = NewFolderHealthMonitor(ctx)
+	ctx.folderHealth.Start()
+
+	// Graceful cancellation of commands
+	ctx.cancels = NewExecCancels(ctx)
+
+	// Batched output sent to clients (commands and SDKs installation)
+	ctx.outStreams = NewOutputStreams(ctx)
+
 	// Init cross SDKs
 	ctx.sdks, err = NewSDKs(ctx)
 	if err != nil {
 		return -6, err
 	}
 
+	// Compiler cache directories of folders or SDKs
+	ctx.ccache = NewCcache(ctx)
+
+	// Resources used by commands (time, CPU, memory, output)
+	ctx.execMetrics = NewExecMetrics(ctx)
+
+	// Sequencing of commands output
+	ctx.execOutputs = NewExecOutputs(ctx)
+
+	// Build-on-sync of folders with auto build enabled
+	ctx.autoBuild = NewAutoBuilder(ctx)
+	ctx.autoBuild.Start()
+
+	// Builds of folders and of their dependencies
+	ctx.builds = NewBuilds(ctx)
+
+	// Executions of a command against several SDKs
+	ctx.matrices = NewMatrices(ctx)
+
+	// Deployment of built files on targets
+	ctx.deploys = NewDeployments(ctx)
+
+	// Input channels of executed commands
+	ctx.execInputs = NewExecInputs(ctx)
+	ctx.execSteps = NewExecSteps(ctx)
+
+	// Commands running in a pseudo-terminal
+	ctx.execPtys = NewExecPtys(ctx)
+
+	// gdb debug sessions (GDB/MI over WebSocket)
+	ctx.debugs = NewDebugSessions(ctx)
+
+	// Scheduler of exec commands (concurrency limits)
+	ctx.scheduler = NewExecScheduler(ctx)
+
+	// History of executed commands
+	ctx.execHistory = NewExecHistory(ctx)
+
+	// Actions triggered when commands exited (folder hooks)
+	ctx.execHooks = NewExecHooks(ctx)
+
+	// Server events notified to HTTP endpoints
+	ctx.webhooks = NewWebhooks(ctx)
+
+	// Command templates (build presets)
+	ctx.presets = NewExecPresets(ctx)
+
+	// Artifacts collected after commands exit (saved in store)
+	ctx.artifacts = NewArtifacts(ctx)
+
+	// Execution of commands in container images
+	ctx.containers = NewContainers(ctx)
+
+	// Commands executed periodically (cron expressions)
+	ctx.schedules = NewSchedules(ctx)
+	ctx.schedules.Start()
+
+	// Builder nodes (dispatch of commands, registration on primary server)
+	ctx.nodes = NewNodes(ctx)
+	if err := ctx.nodes.Start(); err != nil {
+		ctx.Log.Warningf("%v", err)
+	}
+
+	// Seed demo data when requested
+	if ctx.Config.Options.SeedDemo {
+		if _, err := ctx.SeedDemo(); err != nil {
+			ctx.Log.Errorf("Cannot seed demo data: %v", err)
+		}
+	}
+
+	// Policy used to preserve file attributes
+	ctx.fileAttrs, err = NewFileAttrs(ctx.Config.FileConf.FileAttrsConf)
+	if err != nil {
+		return -8, err
+	}
+
+	// Deduplicated store of logs and artifacts
+	ctx.store, err = NewStore(ctx)
+	if err != nil {
+		return -8, err
+	}
+	ctx.snapshots = NewFolderSnapshots(ctx)
+
+	// Dangerous operations approval management
+	ctx.approvals = NewApprovals(ctx)
+
+	// Long-lived tokens used by non-browser clients
+	ctx.apiTokens = NewAPITokens(ctx)
+
+	// OpenID Connect authentication (SSO)
+	ctx.oidc, err = NewOIDC(ctx)
+	if err != nil {
+		return -8, err
+	}
+
+	// LDAP/Active Directory authentication
+	ctx.ldap, err = NewLDAP(ctx)
+	if err != nil {
+		return -8, err
+	}
+
+	// Role-based access control
+	ctx.roles, err = NewRoles(ctx)
+	if err != nil {
+		return -8, err
+	}
+
+	// Audit trail of operations requested by clients
+	ctx.audit, err = NewAudit(ctx)
+	if err != nil {
+		return -8, err
+	}
+
+	// Protection against clients sending too many requests
+	ctx.rateLimit = NewRateLimiter(ctx)
+
+	// Events published on a MQTT broker
+	ctx.mqtt, err = NewMQTTBridge(ctx)
+	if err != nil {
+		return -8, err
+	}
+	if ctx.mqtt != nil {
+		ctx.mqtt.Start()
+	}
+
+	// Mutual TLS between xds-agent and xds-server
+	if tlsCfg := ctx.Config.FileConf.TLSConf; tlsCfg != nil && tlsCfg.MTLSConf != nil {
+		ctx.agentsCA, err = NewAgentsCA(ctx, tlsCfg.MTLSConf)
+		if err != nil {
+			return -8, err
+		}
+	}
+
+	// Detect when inotify watches limit is reached (fallback to periodic scan)
+	if ctx.SThg != nil {
+		ctx.inotify = NewInotifyMonitor(ctx)
+		if err := ctx.inotify.Start(); err != nil {
+			ctx.Log.Warningf("%v", err)
+			ctx.inotify = nil
+		}
+
+		// Periodic notification of folders synchronization progress
+		ctx.syncProgress = NewSyncProgressMonitor(ctx)
+		ctx.syncProgress.Start()
+
+		// Sync conflicts detection
+		ctx.conflicts = NewConflictMonitor(ctx)
+		ctx.conflicts.Start()
+
+		// Synchronization rate limits
+		ctx.bandwidth = NewSyncBandwidth(ctx)
+		ctx.bandwidth.Start()
+	}
+
 	// Create Web Server
 	ctx.WWWServer = NewWebServer(ctx)
 
@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// AgentCert Client certificate issued to a paired xds-agent (mutual TLS)
+type AgentCert struct {
+	Serial      string `json:"serial" xml:"serial,attr"`
+	Name        string `json:"name" xml:"name,attr"` // agent name (certificate common name)
+	Fingerprint string `json:"fingerprint" xml:"fingerprint"`
+	IssuedAt    string `json:"issuedAt" xml:"issuedAt"`
+	ExpireAt    string `json:"expireAt" xml:"expireAt"`
+	Revoked     bool   `json:"revoked" xml:"revoked"`
+	IssuedBy    string `json:"issuedBy" xml:"issuedBy"` // user that created the pairing code
+}
+
+// AgentPairingCode One-time code used by an agent to get its certificate
+type AgentPairingCode struct {
+	Code     string `json:"code"`
+	ExpireAt string `json:"expireAt"`
+}
+
+// AgentPairArgs JSON parameters of POST /agents/pair command
+type AgentPairArgs struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	CSR  string `json:"csr"` // PEM certificate request (key generated by server when not set)
+}
+
+// AgentPairResult JSON result of POST /agents/pair command
+type AgentPairResult struct {
+	Agent  AgentCert `json:"agent"`
+	Cert   string    `json:"cert"`          // PEM client certificate
+	Key    string    `json:"key,omitempty"` // PEM private key (only when no CSR given)
+	CACert string    `json:"caCert"`        // PEM CA certificate
+}
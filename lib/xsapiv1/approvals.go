@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Dangerous operations that may require an approval (server has no factory
+// reset operation, so there is nothing to protect for it)
+const (
+	ApprovalOpFolderDelete = "folder-delete" // delete a folder that contains files
+	ApprovalOpSdkRemove    = "sdk-remove"    // remove an installed SDK
+
+	ApprovalOpFolderRestore = "folder-restore" // replace folder content by a snapshot
+)
+
+// Approval modes definition
+const (
+	ApprovalModeDelay    = "delay"    // requester must confirm using token after a delay
+	ApprovalModeApproval = "approval" // another authenticated user must approve operation
+)
+
+// Pending operation status definition
+const (
+	PendingOpStatusWaiting   = "Waiting"
+	PendingOpStatusDone      = "Done"
+	PendingOpStatusFailed    = "Failed"
+	PendingOpStatusCancelled = "Cancelled"
+)
+
+// PendingOperation Dangerous operation waiting for confirmation or approval
+type PendingOperation struct {
+	ID           string `json:"id"`
+	Operation    string `json:"operation"`   // operation name (eg. folder-delete)
+	TargetID     string `json:"targetID"`    // id of folder or sdk
+	Description  string `json:"description"` // human readable description
+	Mode         string `json:"mode"`        // delay or approval
+	Status       string `json:"status"`
+	RequestedBy  string `json:"requestedBy"`  // session ID of requester
+	ApprovedBy   string `json:"approvedBy"`   // session ID of approver
+	CreatedAt    string `json:"createdAt"`    // creation date (RFC3339)
+	ConfirmAfter string `json:"confirmAfter"` // date after which operation can be confirmed (RFC3339)
+	ExpireAt     string `json:"expireAt"`     // date of pending operation expiration (RFC3339)
+	Error        string `json:"error"`
+
+	// Token only returned once to the requester (used to confirm in delay mode)
+	Token string `json:"token,omitempty"`
+}
+
+// PendingOpConfirmArgs JSON parameters of POST /admin/pending/:id/confirm command
+type PendingOpConfirmArgs struct {
+	Token string `json:"token"`
+}
+
+// PendingOpResult JSON result of confirm or approve commands
+type PendingOpResult struct {
+	Operation PendingOperation `json:"operation"`
+	Result    interface{}      `json:"result"` // result of executed operation
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Audited operations
+const (
+	AuditActionExec          = "exec"
+	AuditActionSdkInstall    = "sdk-install"
+	AuditActionSdkRemove     = "sdk-remove"
+	AuditActionFolderAdd     = "folder-add"
+	AuditActionFolderUpdate  = "folder-update"
+	AuditActionFolderDelete  = "folder-delete"
+	AuditActionFolderRestore = "folder-restore" // restore of a snapshot
+	AuditActionPendingOp     = "pending-op"     // confirmation, approval or cancellation of a pending operation
+	AuditActionTokenCreate   = "token-create"   // creation of an API token
+	AuditActionTokenRevoke   = "token-revoke"
+	AuditActionLogin         = "login"      // OpenID Connect login
+	AuditActionRoleSet       = "role-set"   // assignment (or removal) of a user role
+	AuditActionAgentPair     = "agent-pair" // certificate issued to an agent
+	AuditActionAgentRevoke   = "agent-revoke"
+	AuditActionAccessDenied  = "access-denied" // request rejected by network ACL
+	AuditActionSecretSet     = "secret-set"
+	AuditActionSecretDelete  = "secret-delete"
+	AuditActionSessionClose  = "session-close" // forced logout of a client session
+	AuditActionSyncKeyRotate = "syncthing-apikey-rotate"
+	AuditActionWebhookSet    = "webhook-set"
+	AuditActionWebhookDelete = "webhook-delete"
+)
+
+// Audited operation result definition
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+	AuditResultPending = "pending" // operation waiting for approval (see PendingOperation)
+)
+
+// AuditEntry Record of an operation requested by a client
+// Entries are chained (each Hash covers previous one) to detect tampering.
+type AuditEntry struct {
+	Seq       int64  `json:"seq"`
+	Date      string `json:"date"`
+	Action    string `json:"action"`  // see AuditAction*
+	Target    string `json:"target"`  // id of folder, SDK, pending operation or API token
+	Details   string `json:"details"` // human readable description (eg. command line)
+	SessionID string `json:"sessionID"`
+	User      string `json:"user"` // client user name (see XDS-User header)
+	ClientIP  string `json:"clientIP"`
+	Result    string `json:"result"` // see AuditResult*
+	Error     string `json:"error,omitempty"`
+	PrevHash  string `json:"prevHash"`
+	Hash      string `json:"hash"` // sha256 of entry (Hash excluded)
+}
+
+// AuditLog JSON result of GET /admin/audit command
+type AuditLog struct {
+	Total   int          `json:"total"` // number of entries matching filters
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+	Entries []AuditEntry `json:"entries"` // most recent first
+}
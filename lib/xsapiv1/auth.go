@@ -0,0 +1,44 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Authentication methods definition
+const (
+	AuthMethodOIDC = "oidc" // OpenID Connect login (see GET /auth/login)
+	AuthMethodLDAP = "ldap" // LDAP/Active Directory password (see POST /auth/ldap/login)
+)
+
+// AuthUser JSON result of GET /auth/user command
+type AuthUser struct {
+	Enabled       bool     `json:"enabled"`  // authentication configured
+	Methods       []string `json:"methods"`  // see AuthMethod*
+	Required      bool     `json:"required"` // API requests rejected when not authenticated
+	Authenticated bool     `json:"authenticated"`
+	User          string   `json:"user"`    // xds user (see XDS-User header)
+	Role          string   `json:"role"`    // see Role*
+	Subject       string   `json:"subject"` // identifier of user at identity provider
+	Email         string   `json:"email"`
+	Name          string   `json:"name"`
+	ExpireAt      string   `json:"expireAt"` // expiration date of identity token
+}
+
+// AuthLoginArgs JSON parameters of POST /auth/ldap/login command
+type AuthLoginArgs struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Build status definition
+const (
+	BuildStatusPending = "pending"
+	BuildStatusRunning = "running"
+	BuildStatusDone    = "done"
+	BuildStatusFailed  = "failed"
+	BuildStatusSkipped = "skipped" // not executed because a dependency failed
+)
+
+// BuildArgs JSON parameters of POST /builds command
+type BuildArgs struct {
+	FolderID string `json:"folderID"` // folder to build (its dependencies are built first)
+	SdkID    string `json:"sdkID"`    // sdk used to setup env (default sdk of each folder when not set)
+	TimeoutS int    `json:"timeoutS"` // maximum duration of each build step (default 1 hour)
+}
+
+// BuildStep Build of one folder
+type BuildStep struct {
+	FolderID string `json:"folderID"`
+	Label    string `json:"label"`
+	CmdID    string `json:"cmdID"` // command ID used in exec events
+	Cmd      string `json:"cmd"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error"`
+}
+
+// Build Orchestrated build of a folder and its dependencies (steps are
+// executed in dependency order, see EVTBuild)
+type Build struct {
+	ID        string      `json:"id"`
+	FolderID  string      `json:"folderID"`
+	Status    string      `json:"status"`
+	Steps     []BuildStep `json:"steps"`
+	StartedBy string      `json:"startedBy"` // session ID of requester
+	StartedAt string      `json:"startedAt"`
+	EndedAt   string      `json:"endedAt"`
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Ccache scope definition
+const (
+	CcacheScopeFolder = "folder" // one cache per folder
+	CcacheScopeSdk    = "sdk"    // one cache per SDK (shared by folders)
+)
+
+// CcacheInfo Statistics of a ccache directory (GET /ccache/:scope/:id)
+type CcacheInfo struct {
+	Scope   string  `json:"scope"`
+	ID      string  `json:"id"` // folder or SDK ID
+	Dir     string  `json:"dir"`
+	MaxSize string  `json:"maxSize"` // size limit (empty: ccache default)
+	Size    int64   `json:"size"`    // in bytes
+	Files   int     `json:"files"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hitRate"` // in percent
+	Error   string  `json:"error"`   // hit statistics not available (eg. ccache not installed)
+}
+
+// CcacheSetArgs JSON parameters of PUT /ccache/:scope/:id command
+type CcacheSetArgs struct {
+	MaxSize string `json:"maxSize" binding:"required"` // eg. "500M", "5G" or "0" (no limit)
+}
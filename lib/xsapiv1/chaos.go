@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Targets of fault injection kill command
+const (
+	ChaosKillSyncthing        = "syncthing"
+	ChaosKillSyncthingInotify = "syncthing-inotify"
+	ChaosKillCommand          = "cmd" // exec command identified by CmdID
+)
+
+// ChaosStatus Current state of fault injection (only available when server
+// is built with chaos tag)
+type ChaosStatus struct {
+	DropEvents      int `json:"dropEvents"`      // number of next events that will be dropped
+	DroppedEvents   int `json:"droppedEvents"`   // number of events dropped so far
+	SyncthingDelay  int `json:"syncthingDelay"`  // delay (in ms) added to Syncthing requests
+	SyncthingDelayN int `json:"syncthingDelayN"` // number of next delayed requests (0 = all)
+}
+
+// ChaosDropEventsArgs JSON parameters of POST /admin/chaos/events/drop command
+type ChaosDropEventsArgs struct {
+	Count int `json:"count"`
+}
+
+// ChaosSyncthingDelayArgs JSON parameters of POST /admin/chaos/syncthing/delay command
+type ChaosSyncthingDelayArgs struct {
+	DelayMs int `json:"delayMs"`
+	Count   int `json:"count"` // 0 means delay all requests until reset
+}
+
+// ChaosKillArgs JSON parameters of POST /admin/chaos/kill command
+type ChaosKillArgs struct {
+	Target string `json:"target"` // syncthing, syncthing-inotify or cmd
+	CmdID  string `json:"cmdID"`  // used when target is cmd
+}
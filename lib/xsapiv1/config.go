@@ -27,6 +27,39 @@ type APIConfig struct {
 	Builder          BuilderConfig   `json:"builder"`
 }
 
+// SyncBandwidthConfig CloudSync (Syncthing) rate limits, used in server config
+// file (syncthing.bandwidth) and by GET/PUT /config/sync commands
+type SyncBandwidthConfig struct {
+	MaxSendKbps int                 `json:"maxSendKbps"` // default send limit (0 = unlimited)
+	MaxRecvKbps int                 `json:"maxRecvKbps"` // default receive limit (0 = unlimited)
+	Schedule    []SyncBandwidthSlot `json:"schedule"`    // limits by time of day (first match is used)
+}
+
+// SyncBandwidthSlot Rate limits applied during a period of the day
+type SyncBandwidthSlot struct {
+	Start       string   `json:"start"` // HH:MM
+	End         string   `json:"end"`   // HH:MM (may be lower than Start to span midnight)
+	Days        []string `json:"days"`  // mon, tue, wed, thu, fri, sat, sun (all days when empty)
+	MaxSendKbps int      `json:"maxSendKbps"`
+	MaxRecvKbps int      `json:"maxRecvKbps"`
+}
+
+// SyncBandwidthStatus Result of GET/PUT /config/sync commands
+type SyncBandwidthStatus struct {
+	Config      SyncBandwidthConfig `json:"config"`
+	ActiveSlot  int                 `json:"activeSlot"` // index of applied schedule slot (-1 = default limits)
+	MaxSendKbps int                 `json:"maxSendKbps"`
+	MaxRecvKbps int                 `json:"maxRecvKbps"`
+}
+
+// SyncAPIKeyStatus Result of GET /admin/syncthing/apikey and POST
+// /admin/syncthing/apikey/rotate commands (key itself is never returned)
+type SyncAPIKeyStatus struct {
+	Managed   bool   `json:"managed"`   // false when key is set in server config file (cannot be rotated)
+	CreatedAt string `json:"createdAt"` // generation date of managed key
+	ExpireAt  string `json:"expireAt"`  // date after which key is renewed on startup (empty = never)
+}
+
 // BuilderConfig represents the builder container configuration
 type BuilderConfig struct {
 	IP          string `json:"ip"`
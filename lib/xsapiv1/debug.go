@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Debug session status definition
+const (
+	DebugStatusRunning = "running"
+	DebugStatusExited  = "exited"
+)
+
+const (
+	// DebugMIInEvent Event send in WS to send a GDB/MI command to a debug session
+	DebugMIInEvent = "debug:mi-input"
+
+	// DebugMIOutEvent Event send in WS when a line is received from gdb
+	DebugMIOutEvent = "debug:mi-output"
+
+	// DebugExitEvent Event send in WS when gdb exited
+	DebugExitEvent = "debug:exit"
+)
+
+// DebugStartArgs JSON parameters of POST /debug command
+type DebugStartArgs struct {
+	FolderID string   `json:"folderID" binding:"required"`
+	SdkID    string   `json:"sdkID"`   // sdk used to setup env (default sdk of folder when not set)
+	Program  string   `json:"program"` // binary to debug (relative to folder)
+	Args     []string `json:"args"`    // program arguments (local debug only)
+	RPath    string   `json:"rpath"`   // working directory (relative to folder)
+	Target   string   `json:"target"`  // address of a gdbserver (eg. 192.168.1.10:2345), program runs locally when empty
+}
+
+// DebugBreakpoint Breakpoint of a debug session (tracked from GDB/MI output)
+type DebugBreakpoint struct {
+	Number    string `json:"number"`
+	Type      string `json:"type"`
+	Enabled   bool   `json:"enabled"`
+	File      string `json:"file"` // client path
+	Line      string `json:"line"`
+	Func      string `json:"func"`
+	Cond      string `json:"cond"`
+	Location  string `json:"location"` // original location
+	HitsCount string `json:"hitsCount"`
+}
+
+// DebugSession gdb process controlled using GDB/MI
+type DebugSession struct {
+	ID          string            `json:"id"`
+	FolderID    string            `json:"folderID"`
+	SdkID       string            `json:"sdkID"`
+	Program     string            `json:"program"`
+	Target      string            `json:"target"`
+	Status      string            `json:"status"`
+	ExitCode    int               `json:"exitCode"`
+	SessionID   string            `json:"sessionID"` // owner session, gdb is killed when session is closed
+	StartedAt   string            `json:"startedAt"`
+	OutputSeq   uint64            `json:"outputSeq"`   // sequence number of last line received from gdb
+	Breakpoints []DebugBreakpoint `json:"breakpoints"` // ordered by number
+}
+
+// DebugMIInMsg GDB/MI command sent to a debug session (also used as JSON
+// parameters of POST /debug/:id/mi command)
+type DebugMIInMsg struct {
+	ID   string `json:"id"`
+	Line string `json:"line" binding:"required"`
+}
+
+// DebugMIOutMsg Line received from gdb (MI records or inferior output)
+type DebugMIOutMsg struct {
+	ID        string `json:"id"`
+	Seq       uint64 `json:"seq"` // line sequence number (starting at 1)
+	Timestamp string `json:"timestamp"`
+	Line      string `json:"line"`
+}
+
+// DebugExitMsg Message sent when gdb exited
+type DebugExitMsg struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Code      int    `json:"code"`
+	Error     string `json:"error"`
+}
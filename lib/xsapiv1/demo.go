@@ -0,0 +1,31 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// DemoJob A build job of demo data that can be replayed using /exec command
+type DemoJob struct {
+	Name string   `json:"name"`
+	Exec ExecArgs `json:"exec"` // arguments to POST on /exec
+}
+
+// DemoData JSON result of GET /admin/demo or POST /admin/demo/seed commands
+type DemoData struct {
+	Folders []FolderConfig `json:"folders"`
+	Sdks    []SDK          `json:"sdks"`
+	Jobs    []DemoJob      `json:"jobs"`
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Deployment status definition
+const (
+	DeployStatusPending = "pending"
+	DeployStatusRunning = "running"
+	DeployStatusDone    = "done"
+	DeployStatusFailed  = "failed"
+	DeployStatusSkipped = "skipped" // not executed because a previous step failed
+)
+
+// DeployTarget Device on which built files can be deployed (using ssh)
+type DeployTarget struct {
+	Name        string   `json:"name" xml:"name,attr"`
+	Description string   `json:"description" xml:"description"`
+	Host        string   `json:"host" xml:"host"`              // IP address or hostname
+	Port        int      `json:"port" xml:"port"`              // ssh port (default 22)
+	User        string   `json:"user" xml:"user"`              // default root
+	Secret      string   `json:"secret" xml:"secret"`          // name of server-side secret (ssh private key or password)
+	Dir         string   `json:"dir" xml:"dir"`                // default destination directory (default /tmp)
+	InstallCmds []string `json:"installCmds" xml:"installCmd"` // default commands executed on target after copy
+}
+
+// DeployArgs JSON parameters of POST /deploy command
+type DeployArgs struct {
+	FolderID    string   `json:"folderID" binding:"required"`
+	Target      string   `json:"target" binding:"required"` // name of a registered target
+	Files       []string `json:"files"`                     // files (glob patterns relative to folder) copied in remote directory
+	RemoteDir   string   `json:"remoteDir"`                 // destination directory (target directory when not set)
+	InstallCmds []string `json:"installCmds"`               // commands executed on target after copy (eg. afm-util install <file>)
+	TimeoutS    int      `json:"timeoutS"`                  // maximum duration of each step (default 1 hour)
+}
+
+// DeployStep Copy or install command of a deployment
+type DeployStep struct {
+	Name     string `json:"name"`  // copy or install
+	CmdID    string `json:"cmdID"` // command ID used in exec events
+	Cmd      string `json:"cmd"`   // install command (executed on target)
+	Status   string `json:"status"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error"`
+}
+
+// Deploy Deployment of folder files on a target (see EVTDeploy, output of
+// steps is sent using exec events)
+type Deploy struct {
+	ID        string       `json:"id"`
+	FolderID  string       `json:"folderID"`
+	Target    string       `json:"target"`
+	RemoteDir string       `json:"remoteDir"`
+	Files     []string     `json:"files"` // copied files (relative to folder)
+	Status    string       `json:"status"`
+	Steps     []DeployStep `json:"steps"`
+	StartedBy string       `json:"startedBy"` // session ID of requester
+	StartedAt string       `json:"startedAt"` // RFC3339 date
+	EndedAt   string       `json:"endedAt"`   // RFC3339 date
+}
@@ -22,26 +22,93 @@ import (
 	"fmt"
 )
 
-// EventRegisterArgs Parameters (json format) of /events/register command
+// EventRegisterArgs Parameters (json format) of /events/register command,
+// each filter only applies to events that refer to a folder, a SDK or a command
 type EventRegisterArgs struct {
-	Name   string `json:"name"`
-	Filter string `json:"filter"`
+	Name      string   `json:"name"`
+	Types     []string `json:"types"`     // register several events at once (in addition to name)
+	Filter    string   `json:"filter"`    // see EventFilter* (folder events only)
+	FolderIDs []string `json:"folderIDs"` // only send events of these folders (all when empty)
+	SdkIDs    []string `json:"sdkIDs"`    // only send events of these SDKs (all when empty)
+	CmdIDs    []string `json:"cmdIDs"`    // only send events of these commands (all when empty)
+	Versions  []int    `json:"versions"`  // event payload versions supported by client (default version 1)
 }
 
+// EventRegisterResult JSON result of /events/register command
+type EventRegisterResult struct {
+	Status  string `json:"status"`
+	Version int    `json:"version"` // payload version of events sent to client (see EventVersion*)
+}
+
+// Event payload versions definition, a client gets events using the highest
+// version it supports (announced on registration)
+const (
+	EventVersion1      = 1 // initial format (no version and seq fields)
+	EventVersion2      = 2 // version, sequence numbers and cmdID fields
+	EventVersionLatest = EventVersion2
+)
+
+// EventVersionsSupported List of payload versions supported by server
+var EventVersionsSupported = []int{EventVersion1, EventVersion2}
+
+// Events filter definition (only apply to folder events, events of folders
+// that are neither owned by nor shared with client are never sent)
+const (
+	EventFilterNone       = ""            // events of all accessible folders
+	EventFilterOwnFolders = "own-folders" // events of folders owned by client
+)
+
 // EventUnRegisterArgs Parameters of /events/unregister command
 type EventUnRegisterArgs struct {
-	Name string `json:"name"`
-	ID   int    `json:"id"`
+	Name  string   `json:"name"`
+	Types []string `json:"types"` // un-register several events at once (in addition to name)
+	ID    int      `json:"id"`
 }
 
 // EventMsg Message send
 type EventMsg struct {
+	Version       int         `json:"version"` // payload version (see EventVersion*)
 	Time          string      `json:"time"`
-	FromSessionID string      `json:"sessionID"` // Session ID of client who produce this event
+	Seq           uint64      `json:"seq"`                 // sequence number (shared by all events types, see EventHistory)
+	StreamSeq     uint64      `json:"streamSeq,omitempty"` // sequence number of events sent to client (a gap means lost events)
+	CmdID         string      `json:"cmdID,omitempty"`     // command the event refers to
+	CmdSeq        uint64      `json:"cmdSeq,omitempty"`    // sequence number of events of command
+	FromSessionID string      `json:"sessionID"`           // Session ID of client who produce this event
 	Type          string      `json:"type"`
 	Data          interface{} `json:"data"` // Data
 }
 
+// EventMsgV1 Message send to clients supporting only payload version 1
+type EventMsgV1 struct {
+	Time          string      `json:"time"`
+	FromSessionID string      `json:"sessionID"`
+	Type          string      `json:"type"`
+	Data          interface{} `json:"data"`
+}
+
+// EventMsgExternal Message sent outside of server (webhooks and MQTT), IDs of
+// sessions are credentials and are never sent
+type EventMsgExternal struct {
+	Version int         `json:"version"`
+	Time    string      `json:"time"`
+	Seq     uint64      `json:"seq"`
+	CmdID   string      `json:"cmdID,omitempty"`
+	CmdSeq  uint64      `json:"cmdSeq,omitempty"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+}
+
+// EventHistory Result of GET /events/history command
+type EventHistory struct {
+	LastSeq   uint64     `json:"lastSeq"`   // sequence number of last emitted event
+	Truncated bool       `json:"truncated"` // events following since have been removed from history
+	Events    []EventMsg `json:"events"`    // oldest first
+}
+
+// EventStreamTruncated Event sent by GET /events/stream when some events
+// following Last-Event-ID have been removed from history (data type EventHistory)
+const EventStreamTruncated = "stream-truncated"
+
 // EventEvent Event send in WS when an internal event (eg. Syncthing event is received)
 const (
 	// EventTypePrefix Used as event prefix
@@ -54,6 +121,25 @@ const (
 	EVTSDKInstall        = EventTypePrefix + "sdk-install"         // type EventMsg with Data type xsapiv1.SDKManagementMsg
 	EVTSDKRemove         = EventTypePrefix + "sdk-remove"          // type EventMsg with Data type xsapiv1.SDKManagementMsg
 	EVTSDKStateChange    = EventTypePrefix + "sdk-state-change"    // type EventMsg with Data type xsapiv1.SDK
+	EVTInotifyLimit      = EventTypePrefix + "inotify-limit"       // type EventMsg with Data type xsapiv1.InotifyStatus
+	EVTSDKHealth         = EventTypePrefix + "sdk-health"          // type EventMsg with Data type xsapiv1.SDK
+	EVTSDKFamilyChange   = EventTypePrefix + "sdk-family-change"   // type EventMsg with Data type xsapiv1.SDKFamiliesReload
+	EVTFolderConflict    = EventTypePrefix + "folder-conflict"     // type EventMsg with Data type xsapiv1.FolderConflict
+	EVTFolderFileChange  = EventTypePrefix + "folder-file-change"  // type EventMsg with Data type xsapiv1.FolderFileChanges
+	EVTFolderQuota       = EventTypePrefix + "folder-quota"        // type EventMsg with Data type xsapiv1.FolderDiskUsage
+	EVTFolderAutoBuild   = EventTypePrefix + "folder-autobuild"    // type EventMsg with Data type xsapiv1.FolderAutoBuildMsg
+	EVTBuild             = EventTypePrefix + "build"               // type EventMsg with Data type xsapiv1.Build
+	EVTExecQueue         = EventTypePrefix + "exec-queue"          // type EventMsg with Data type xsapiv1.ExecJob
+	EVTMatrix            = EventTypePrefix + "matrix"              // type EventMsg with Data type xsapiv1.Matrix
+	EVTDeploy            = EventTypePrefix + "deploy"              // type EventMsg with Data type xsapiv1.Deploy
+	EVTSchedule          = EventTypePrefix + "schedule"            // type EventMsg with Data type xsapiv1.CmdSchedule
+	EVTExecHook          = EventTypePrefix + "exec-hook"           // type EventMsg with Data type xsapiv1.ExecHookMsg
+	EVTExecProblem       = EventTypePrefix + "exec-problem"        // type EventMsg with Data type xsapiv1.ExecProblem
+	EVTSessionExpiring   = EventTypePrefix + "session-expiring"    // type EventMsg with Data type xsapiv1.SessionExpiring
+	EVTExecExit          = EventTypePrefix + "exec-exit"           // type EventMsg with Data type xsapiv1.ExecExitMsg
+
+	// Periodic events
+	EVTFolderSyncProgress = EventTypePrefix + "folder-sync-progress" // type EventMsg with Data type xsapiv1.FolderSyncProgress
 )
 
 // EVTAllList List of all supported events
@@ -63,6 +149,50 @@ var EVTAllList = []string{
 	EVTSDKInstall,
 	EVTSDKRemove,
 	EVTSDKStateChange,
+	EVTInotifyLimit,
+	EVTSDKHealth,
+	EVTSDKFamilyChange,
+	EVTFolderSyncProgress,
+	EVTFolderConflict,
+	EVTFolderFileChange,
+	EVTFolderQuota,
+	EVTFolderAutoBuild,
+	EVTBuild,
+	EVTExecQueue,
+	EVTMatrix,
+	EVTDeploy,
+	EVTSchedule,
+	EVTExecHook,
+	EVTExecProblem,
+	EVTSessionExpiring,
+	EVTExecExit,
+}
+
+// Format returns message using format of a payload version (message itself
+// when version is the one of message)
+func (e *EventMsg) Format(version int) interface{} {
+	if version >= e.Version {
+		return *e
+	}
+	return EventMsgV1{
+		Time:          e.Time,
+		FromSessionID: e.FromSessionID,
+		Type:          e.Type,
+		Data:          e.Data,
+	}
+}
+
+// External returns message sent outside of server
+func (e *EventMsg) External() EventMsgExternal {
+	return EventMsgExternal{
+		Version: e.Version,
+		Time:    e.Time,
+		Seq:     e.Seq,
+		CmdID:   e.CmdID,
+		CmdSeq:  e.CmdSeq,
+		Type:    e.Type,
+		Data:    e.Data,
+	}
 }
 
 // DecodeFolderConfig Helper to decode Data field type FolderConfig
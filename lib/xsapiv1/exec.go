@@ -20,23 +20,52 @@ package xsapiv1
 type (
 	// ExecArgs JSON parameters of /exec command
 	ExecArgs struct {
-		ID              string   `json:"id" binding:"required"`
-		SdkID           string   `json:"sdkID"` // sdk ID to use for setting env
-		CmdID           string   `json:"cmdID"` // command unique ID
-		Cmd             string   `json:"cmd" binding:"required"`
-		Args            []string `json:"args"`
-		Env             []string `json:"env"`
-		RPath           string   `json:"rpath"`           // relative path into project
-		TTY             bool     `json:"tty"`             // Use a tty, specific to gdb --tty option
-		TTYGdbserverFix bool     `json:"ttyGdbserverFix"` // Set to true to activate gdbserver workaround about inferior output
-		ExitImmediate   bool     `json:"exitImmediate"`   // when true, exit event sent immediately when command exited (IOW, don't wait file synchronization)
-		CmdTimeout      int      `json:"timeout"`         // command completion timeout in Second
+		ID              string     `json:"id" binding:"required"`
+		SdkID           string     `json:"sdkID"`    // sdk ID to use for setting env
+		NoSdkEnv        bool       `json:"noSdkEnv"` // don't source environment of SDK bound to project (when sdkID is not set)
+		CmdID           string     `json:"cmdID"`    // command unique ID
+		Cmd             string     `json:"cmd"`      // command to execute (required when steps are not set)
+		Args            []string   `json:"args"`
+		Env             []string   `json:"env"`
+		RPath           string     `json:"rpath"`           // relative path into project
+		TTY             bool       `json:"tty"`             // Use a tty, specific to gdb --tty option
+		TTYGdbserverFix bool       `json:"ttyGdbserverFix"` // Set to true to activate gdbserver workaround about inferior output
+		ExitImmediate   bool       `json:"exitImmediate"`   // when true, exit event sent immediately when command exited (IOW, don't wait file synchronization)
+		CmdTimeout      int        `json:"timeout"`         // command completion timeout in Second
+		Stdin           bool       `json:"stdin"`           // open an input channel to send data on command stdin (see POST /input)
+		PTY             bool       `json:"pty"`             // run command in a pseudo-terminal (interactive/curses tools, raw output)
+		Rows            int        `json:"rows"`            // initial terminal size when pty is set
+		Cols            int        `json:"cols"`
+		Priority        int        `json:"priority"`       // scheduling priority when concurrency limits are reached (higher first)
+		EnvPassThrough  []string   `json:"envPassThrough"` // only inject these client variables (shell patterns), restricts server whitelist
+		Artifacts       []string   `json:"artifacts"`      // files (glob patterns relative to project) collected after command exit
+		Nice            *int       `json:"nice"`           // CPU niceness 0 (default) to 19 (lowest priority), server default when not set
+		IONice          string     `json:"ionice"`         // I/O priority: idle or best-effort[:0-7], server default when not set
+		Container       bool       `json:"container"`      // run command in a container (project and SDK are bind mounted)
+		Image           string     `json:"image"`          // container image (default: image of SDK or server default image)
+		Steps           []ExecStep `json:"steps"`          // pipeline: steps executed sequentially (replace cmd/args)
+		OutputLimit     int64      `json:"outputLimit"`    // maximum output size in bytes (cannot exceed server limit)
+		OutputPolicy    string     `json:"outputPolicy"`   // policy applied when output limit is reached (see ExecOutputPolicy*)
+		Node            string     `json:"node"`           // builder node that executes command (see ExecNode*, default: least loaded node)
+		OutputMode      string     `json:"outputMode"`     // raw (default) or terminal (see ExecOutputMode*)
+		Problems        bool       `json:"problems"`       // parse compiler diagnostics in output (see EVTExecProblem)
+		Shell           string     `json:"shell"`          // shell that interprets cmd (see ExecShell*, server default when not set)
+		ShellOptions    []string   `json:"shellOptions"`   // shell options (see ExecShellOpt*, server default when not set)
+	}
+
+	// ExecStep Definition of a step of a pipeline
+	ExecStep struct {
+		Name            string   `json:"name"`
+		Cmd             string   `json:"cmd"`
+		Env             []string `json:"env"`             // variables only set for this step
+		ContinueOnError bool     `json:"continueOnError"` // when false, remaining steps are skipped when this step failed
 	}
 
 	// ExecResult JSON result of /exec command
 	ExecResult struct {
-		Status string `json:"status"` // status OK
-		CmdID  string `json:"cmdID"`  // command unique ID
+		Status   string `json:"status"`             // status OK
+		CmdID    string `json:"cmdID"`              // command unique ID
+		Position int    `json:"position,omitempty"` // position in scheduler queue when command is queued
 	}
 
 	// ExecSigResult JSON result of /signal command
@@ -46,10 +75,18 @@ type (
 	}
 
 	// ExecInMsg Message used to received input characters (stdin)
+	// (also used as JSON parameters of /input command)
 	ExecInMsg struct {
 		CmdID     string `json:"cmdID"`
 		Timestamp string `json:"timestamp"`
 		Stdin     string `json:"stdin"`
+		EOF       bool   `json:"eof"` // close command stdin (after data has been sent)
+	}
+
+	// ExecInResult JSON result of /input command
+	ExecInResult struct {
+		Status string `json:"status"` // status OK
+		CmdID  string `json:"cmdID"`  // command unique ID
 	}
 
 	// ExecOutMsg Message used to send output characters (stdout+stderr)
@@ -58,23 +95,269 @@ type (
 		Timestamp string `json:"timestamp"`
 		Stdout    string `json:"stdout"`
 		Stderr    string `json:"stderr"`
+		Seq       uint64 `json:"seq"`               // chunk sequence number (per command, starting at 1)
+		Stream    string `json:"stream"`            // stream of chunk: stdout or stderr
+		Channel   string `json:"channel,omitempty"` // run of a multiplexed command (eg. SDK of a matrix)
+	}
+
+	// ExecOutReplay JSON result of GET /exec/:id/output command (output chunks
+	// kept by server, used by reconnecting clients to retrieve lost output)
+	ExecOutReplay struct {
+		CmdID     string       `json:"cmdID"`
+		FirstSeq  uint64       `json:"firstSeq"`  // sequence number of oldest chunk kept
+		LastSeq   uint64       `json:"lastSeq"`   // sequence number of last chunk sent
+		Truncated bool         `json:"truncated"` // some requested chunks are not available anymore
+		Exited    bool         `json:"exited"`    // command exited (see GET /exec/history for exit code)
+		Chunks    []ExecOutMsg `json:"chunks"`
+	}
+
+	// ExecOutTruncatedMsg Message sent when output limit of a command is reached
+	ExecOutTruncatedMsg struct {
+		CmdID     string `json:"cmdID"`
+		Timestamp string `json:"timestamp"`
+		Policy    string `json:"policy"`
+		Limit     int64  `json:"limit"`
+		Seq       uint64 `json:"seq"`     // sequence number of last chunk sent before truncation
+		LogFile   bool   `json:"logFile"` // complete output can be retrieved using GET /exec/:id/log
+	}
+
+	// ExecStepMsg Message sent when a step of a pipeline started or ended
+	ExecStepMsg struct {
+		CmdID      string `json:"cmdID"`
+		Timestamp  string `json:"timestamp"`
+		Index      int    `json:"index"`
+		Name       string `json:"name"`
+		Status     string `json:"status"` // see BuildStatus* constants
+		ExitCode   int    `json:"exitCode"`
+		DurationMs int64  `json:"durationMs"`
 	}
 
 	// ExecExitMsg Message sent when executed command exited
 	ExecExitMsg struct {
+		CmdID     string       `json:"cmdID"`
+		Timestamp string       `json:"timestamp"`
+		Code      int          `json:"code"`
+		Error     error        `json:"error"`
+		Metrics   *ExecMetrics `json:"metrics,omitempty"` // not set when command has not been started
+		Channel   string       `json:"channel,omitempty"`
+		OutputSeq uint64       `json:"outputSeq"` // sequence number of last output chunk (0: no output)
+		FolderID  string       `json:"folderID,omitempty"`
+	}
+
+	// ExecProblem Compiler diagnostic (gcc/clang) found in output of a command
+	ExecProblem struct {
 		CmdID     string `json:"cmdID"`
+		FolderID  string `json:"folderID"`
 		Timestamp string `json:"timestamp"`
-		Code      int    `json:"code"`
-		Error     error  `json:"error"`
+		File      string `json:"file"` // client path
+		Line      int    `json:"line"`
+		Column    int    `json:"column"`   // 0 when not reported
+		Severity  string `json:"severity"` // see ProblemSeverity*
+		Message   string `json:"message"`
+	}
+
+	// ExecMetrics Resources used by an executed command
+	ExecMetrics struct {
+		WallTimeMs  int64 `json:"wallTimeMs" xml:"wallTimeMs"`
+		UserTimeMs  int64 `json:"userTimeMs" xml:"userTimeMs"` // CPU time in user mode (command and its children)
+		SysTimeMs   int64 `json:"sysTimeMs" xml:"sysTimeMs"`
+		MaxRSSKb    int64 `json:"maxRSSKb" xml:"maxRSSKb"`       // peak resident memory of the largest process
+		OutputBytes int64 `json:"outputBytes" xml:"outputBytes"` // stdout+stderr
+		Sampled     bool  `json:"sampled" xml:"sampled"`         // CPU and memory periodically sampled (approximate values)
 	}
 
 	// ExecSignalArgs JSON parameters of /exec/signal command
 	ExecSignalArgs struct {
 		CmdID  string `json:"cmdID" binding:"required"`  // command id
-		Signal string `json:"signal" binding:"required"` // signal number
+		Signal string `json:"signal" binding:"required"` // signal name (eg. SIGUSR1, HUP) or number
+		Group  bool   `json:"group"`                     // send signal to all processes of command (default: command shell only)
+	}
+
+	// ExecCancelArgs JSON parameters of /cancel command
+	ExecCancelArgs struct {
+		CmdID  string `json:"cmdID" binding:"required"` // command id
+		GraceS int    `json:"graceS"`                   // delay before processes are killed (0: server default)
+	}
+
+	// ExecReniceArgs JSON parameters of /renice command (priorities of all
+	// processes of a running command)
+	ExecReniceArgs struct {
+		CmdID  string `json:"cmdID" binding:"required"` // command id
+		Nice   *int   `json:"nice"`                     // CPU niceness (unchanged when not set)
+		IONice string `json:"ionice"`                   // I/O priority (unchanged when not set)
+	}
+
+	// ExecReniceResult JSON result of /renice command
+	ExecReniceResult struct {
+		Status    string `json:"status"`    // status OK
+		CmdID     string `json:"cmdID"`     // command unique ID
+		Processes int    `json:"processes"` // number of processes updated
+	}
+
+	// ExecCancelResult JSON result of /cancel command
+	ExecCancelResult struct {
+		Status string `json:"status"` // status OK
+		CmdID  string `json:"cmdID"`  // command unique ID
+	}
+
+	// ExecResizeArgs JSON parameters of /resize command (also used by pty resize WS event)
+	ExecResizeArgs struct {
+		CmdID string `json:"cmdID" binding:"required"` // command id
+		Rows  int    `json:"rows"`
+		Cols  int    `json:"cols"`
+	}
+
+	// ExecArtifact File collected after command exit
+	ExecArtifact struct {
+		Path    string              `json:"path" xml:"path,attr"` // relative to project ('/' separated)
+		Size    int64               `json:"size" xml:"size"`
+		Mode    uint32              `json:"mode" xml:"mode"` // permission bits
+		ModTime string              `json:"modTime" xml:"modTime"`
+		Digest  string              `json:"digest" xml:"digest"`                    // content saved in store
+		UID     int                 `json:"uid,omitempty" xml:"uid,omitempty"`      // owner (according to server fileAttributes policy)
+		GID     int                 `json:"gid,omitempty" xml:"gid,omitempty"`      // group (according to server fileAttributes policy)
+		Xattrs  []ExecArtifactXattr `json:"xattrs,omitempty" xml:"xattr,omitempty"` // extended attributes (when preserved by server)
+	}
+
+	// ExecArtifactXattr Extended attribute of an artifact
+	ExecArtifactXattr struct {
+		Name  string `json:"name" xml:"name,attr"`
+		Value string `json:"value" xml:",chardata"` // base64 encoded
+	}
+
+	// ExecArtifacts JSON result of GET /exec/:id/artifacts command
+	ExecArtifacts struct {
+		CmdID     string         `json:"cmdID" xml:"id,attr"`
+		FolderID  string         `json:"folderID" xml:"folderID"`
+		Patterns  []string       `json:"patterns" xml:"pattern"`
+		CreatedAt string         `json:"createdAt" xml:"createdAt"`
+		Files     []ExecArtifact `json:"files" xml:"file"`
+		Error     string         `json:"error" xml:"error"` // collection error (files are partially collected)
+	}
+
+	// ExecHistoryEntry Record of an executed command
+	ExecHistoryEntry struct {
+		CmdID      string `json:"cmdID" xml:"id,attr"`
+		FolderID   string `json:"folderID" xml:"folderID"`
+		Cmd        string `json:"cmd" xml:"cmd"` // command line (command and arguments)
+		RPath      string `json:"rpath" xml:"rpath"`
+		SdkID      string `json:"sdkID" xml:"sdkID"`
+		SdkName    string `json:"sdkName" xml:"sdkName"`
+		SessionID  string `json:"sessionID" xml:"sessionID"` // session that executed command
+		User       string `json:"user" xml:"user,omitempty"` // authenticated user of session
+		StartedAt  string `json:"startedAt" xml:"startedAt"`
+		EndedAt    string `json:"endedAt" xml:"endedAt"`
+		ExitCode   int    `json:"exitCode" xml:"exitCode"`
+		DurationMs int64  `json:"durationMs" xml:"durationMs"`
+		Node       string `json:"node,omitempty" xml:"node,omitempty"` // builder node that executed command
+
+		Metrics *ExecMetrics `json:"metrics,omitempty" xml:"metrics,omitempty"`
+	}
+
+	// ExecRunningCmd JSON result of GET /exec (list) and GET /exec/:id commands
+	ExecRunningCmd struct {
+		CmdID        string        `json:"cmdID"`
+		FolderID     string        `json:"folderID"`
+		Cmd          string        `json:"cmd"`
+		RPath        string        `json:"rpath"`
+		SdkID        string        `json:"sdkID"`
+		SdkName      string        `json:"sdkName"`
+		SessionID    string        `json:"sessionID"` // session that executed command
+		User         string        `json:"user"`      // authenticated user of session
+		Status       string        `json:"status"`    // Queued or Running
+		Position     int           `json:"position"`  // position in queue (0 when running)
+		SubmittedAt  string        `json:"submittedAt"`
+		StartedAt    string        `json:"startedAt"`         // empty when queued
+		LastOutputAt string        `json:"lastOutputAt"`      // empty when no output has been sent
+		OutputSeq    uint64        `json:"outputSeq"`         // sequence number of last output chunk
+		Metrics      *ExecMetrics  `json:"metrics,omitempty"` // current metrics (only returned by GET /exec/:id)
+		Steps        []ExecStepMsg `json:"steps,omitempty"`   // steps state of a pipeline
+		Node         string        `json:"node,omitempty"`    // builder node that executes command
+	}
+
+	// ExecHistory JSON result of GET /exec/history command
+	ExecHistory struct {
+		Total   int                `json:"total"` // number of recorded commands
+		Offset  int                `json:"offset"`
+		Limit   int                `json:"limit"`
+		Entries []ExecHistoryEntry `json:"entries"` // most recent first
+	}
+
+	// ExecBuildStats JSON result of GET /folders/:id/build-stats command
+	ExecBuildStats struct {
+		FolderID string         `json:"folderID"`
+		Commands []ExecCmdStats `json:"commands"` // most recently executed first
+	}
+
+	// ExecCmdStats Aggregated metrics of a command line executed in a folder
+	// (times are computed using successful executions)
+	ExecCmdStats struct {
+		Cmd            string  `json:"cmd"`
+		Count          int     `json:"count"`
+		Failed         int     `json:"failed"` // non-zero exit code
+		LastAt         string  `json:"lastAt"` // end of last execution
+		LastWallMs     int64   `json:"lastWallMs"`
+		AvgWallMs      int64   `json:"avgWallMs"`
+		MedianWallMs   int64   `json:"medianWallMs"`
+		MinWallMs      int64   `json:"minWallMs"`
+		MaxWallMs      int64   `json:"maxWallMs"`
+		AvgUserMs      int64   `json:"avgUserMs"`
+		AvgSysMs       int64   `json:"avgSysMs"`
+		MaxRSSKb       int64   `json:"maxRSSKb"`
+		AvgOutputBytes int64   `json:"avgOutputBytes"`
+		Recent         []int64 `json:"recent"`   // wall time of last executions (oldest first)
+		TrendPct       float64 `json:"trendPct"` // last execution compared to median (eg. 20 means 20% slower)
+	}
+
+	// ExecResizeResult JSON result of /resize command
+	ExecResizeResult struct {
+		Status string `json:"status"` // status OK
+		CmdID  string `json:"cmdID"`  // command unique ID
 	}
 )
 
+// Output streams definition
+const (
+	ExecStreamStdout = "stdout"
+	ExecStreamStderr = "stderr"
+)
+
+// Output policies applied when output limit of a command is reached
+const (
+	ExecOutputPolicyTruncateTail = "truncate-tail" // following output is dropped (default)
+	ExecOutputPolicyTruncateHead = "truncate-head" // only last output (up to limit) is sent when command exits
+	ExecOutputPolicySpill        = "spill"         // following output is not sent, complete output is kept in a log (GET /exec/:id/log once exited)
+)
+
+// Shells that interpret commands
+const (
+	ExecShellBash = "bash" // default
+	ExecShellSh   = "sh"
+	ExecShellZsh  = "zsh"
+	ExecShellNone = "none" // cmd is a program executed directly with args (no shell interpretation)
+)
+
+// Shell options of commands
+const (
+	ExecShellOptPipefail = "pipefail"
+	ExecShellOptErrexit  = "errexit"
+	ExecShellOptNounset  = "nounset"
+	ExecShellOptXtrace   = "xtrace"
+)
+
+// Severities of compiler diagnostics
+const (
+	ProblemSeverityError   = "error"
+	ProblemSeverityWarning = "warning"
+	ProblemSeverityNote    = "note"
+)
+
+// Output modes of a command
+const (
+	ExecOutputModeRaw      = "raw"      // output sent as produced (default)
+	ExecOutputModeTerminal = "terminal" // colors forced and progress lines (\r) coalesced into updates
+)
+
 const (
 	// ExecInEvent Event send in WS when characters are sent (stdin)
 	ExecInEvent = "exec:input"
@@ -85,9 +368,21 @@ const (
 	// ExecExitEvent Event send in WS when program exited
 	ExecExitEvent = "exec:exit"
 
+	// ExecOutTruncatedEvent Event send in WS when output limit of a command is reached
+	ExecOutTruncatedEvent = "exec:output-truncated"
+
+	// ExecStepEvent Event send in WS when a step of a pipeline started or ended
+	ExecStepEvent = "exec:step"
+
 	// ExecInferiorInEvent Event send in WS when characters are sent to an inferior (used by gdb inferior/tty)
 	ExecInferiorInEvent = "exec:inferior-input"
 
 	// ExecInferiorOutEvent Event send in WS when characters are received by an inferior
 	ExecInferiorOutEvent = "exec:inferior-output"
+
+	// ExecPtyInEvent Event send in WS when characters are sent to a command running in a pty
+	ExecPtyInEvent = "exec:pty-input"
+
+	// ExecPtyResizeEvent Event send in WS when client terminal has been resized
+	ExecPtyResizeEvent = "exec:pty-resize"
 )
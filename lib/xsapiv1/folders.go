@@ -24,6 +24,9 @@ const (
 	TypePathMap   = "PathMap"
 	TypeCloudSync = "CloudSync"
 	TypeCifsSmb   = "CIFS"
+	TypeRsync     = "Rsync"
+	TypeNfs       = "NFS"
+	TypeImport    = "Import"
 )
 
 // Folder Status definition
@@ -44,6 +47,7 @@ type FolderConfig struct {
 	Status     string     `json:"status"`
 	IsInSync   bool       `json:"isInSync"`
 	DefaultSdk string     `json:"defaultSdk"`
+	WatchFiles bool       `json:"watchFiles"` // emit file change events (see EVTFolderFileChange)
 	ClientData string     `json:"clientData"` // free form field that can used by client
 
 	// Not exported fields from REST API point of view
@@ -56,11 +60,140 @@ type FolderConfig struct {
 	// Specific data depending on which Type is used
 	DataPathMap   PathMapConfig   `json:"dataPathMap,omitempty"`
 	DataCloudSync CloudSyncConfig `json:"dataCloudSync,omitempty"`
+	DataRsync     RsyncConfig     `json:"dataRsync,omitempty"`
+	DataNetMount  NetMountConfig  `json:"dataNetMount,omitempty"`
+	DataImport    ImportConfig    `json:"dataImport,omitempty"`
+
+	// Initial content cloned by server from a Git repository (optional)
+	GitClone *GitCloneConfig `json:"gitClone,omitempty"`
+
+	// Project template used to pre-populate folder on creation (see GET /templates)
+	Template string `json:"template,omitempty"`
+
+	// Read-only folder: sync is receive-only and commands can only write
+	// in OutputPath (relative to folder, read-only everywhere when not set)
+	ReadOnly   bool   `json:"readOnly"`
+	OutputPath string `json:"outputPath"`
+
+	// Client that registered folder and clients it is shared with
+	// (folders without owner are accessible by all clients)
+	Owner     string        `json:"owner"`
+	OwnerUser string        `json:"ownerUser"` // authenticated user of owner session (all its sessions are owner)
+	Shares    []FolderShare `json:"shares"`
+	Access    string        `json:"access,omitempty" xml:"-"` // access of requesting client
+
+	// Handling of symlinks, permissions and ownership during sync
+	FileAttrs FolderFileAttrs `json:"fileAttrs"`
+
+	// Previous versions of files kept on server side (CloudSync only)
+	Versioning FolderVersioning `json:"versioning"`
+
+	// Command automatically executed when folder files changed
+	AutoBuild *FolderAutoBuild `json:"autoBuild,omitempty"`
+
+	// Actions (script, webhook, email) triggered when commands exited
+	Hooks []ExecHook `json:"hooks,omitempty"`
+
+	// At rest encryption of folder files on server side (CloudSync only, set on creation)
+	Encryption *FolderEncryption `json:"encryption,omitempty"`
+
+	// Folders (eg. libraries) that must be built before this one (see POST /builds)
+	Dependencies *FolderDependencies `json:"dependencies,omitempty"`
+
+	// Disk quota in MB (0: use server default quota, negative: no quota)
+	QuotaMB   int64            `json:"quotaMB"`
+	DiskUsage *FolderDiskUsage `json:"diskUsage,omitempty" xml:"-"`
+
+	// Result of last periodic health check
+	Health *FolderHealth `json:"health,omitempty" xml:"-"`
 }
 
 // FolderConfigUpdatableFields List fields that can be updated using Update function
 var FolderConfigUpdatableFields = []string{
-	"Label", "DefaultSdk", "ClientData",
+	"Label", "ClientPath", "DefaultSdk", "ClientData", "WatchFiles", "QuotaMB",
+	"ReadOnly", "OutputPath", "FileAttrs", "Versioning", "AutoBuild",
+	"Dependencies", "Hooks",
+}
+
+// Auto build status definition
+const (
+	AutoBuildStatusStarted = "started"
+	AutoBuildStatusDone    = "done"
+	AutoBuildStatusFailed  = "failed"
+)
+
+// FolderAutoBuild Command executed when synchronization of changed files is
+// completed (output is sent using usual exec:output and exec:exit events)
+type FolderAutoBuild struct {
+	Enabled   bool     `json:"enabled"`
+	Cmd       string   `json:"cmd"`       // shell command (eg. make)
+	SdkID     string   `json:"sdkID"`     // sdk used to setup env (folder default sdk when not set)
+	RPath     string   `json:"rpath"`     // relative path into folder where command is executed
+	Paths     []string `json:"paths"`     // only build when matching files changed (patterns, all files when empty)
+	DebounceS int      `json:"debounceS"` // delay without changes before build starts (default 5)
+	TimeoutS  int      `json:"timeoutS"`  // build maximum duration (default 1 hour)
+}
+
+// FolderAutoBuildMsg Auto build status (see EVTFolderAutoBuild)
+type FolderAutoBuildMsg struct {
+	FolderID  string `json:"folderID"`
+	CmdID     string `json:"cmdID"` // command ID used in exec events
+	Cmd       string `json:"cmd"`
+	Status    string `json:"status"`
+	ExitCode  int    `json:"exitCode"`
+	Error     string `json:"error"`
+	Timestamp string `json:"timestamp"`
+}
+
+// FolderEncryption At rest encryption of folder files (files are only
+// accessible and synchronized while folder is unlocked by a client session)
+type FolderEncryption struct {
+	Enabled bool `json:"enabled"`
+	Locked  bool `json:"locked" xml:"-"`
+
+	// Only used on creation to initialize encryption key (never saved)
+	Passphrase string `json:"passphrase,omitempty" xml:"-"`
+}
+
+// FolderUnlockArgs JSON parameters of POST /folders/:id/unlock command
+type FolderUnlockArgs struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// FolderDependencies Build dependencies between folders
+type FolderDependencies struct {
+	DependsOn  []string `json:"dependsOn"`  // IDs of folders built before this one
+	BuildCmd   string   `json:"buildCmd"`   // command used to build folder (eg. make install)
+	RPath      string   `json:"rpath"`      // relative path into folder where build command is executed
+	StagingDir string   `json:"stagingDir"` // build output used by dependent folders (relative to folder, folder root when not set)
+}
+
+// Symlinks handling modes definition
+const (
+	SymlinkModeKeep   = "keep"   // synchronize symlinks as symlinks (default)
+	SymlinkModeFollow = "follow" // synchronize content of symlinks target (Rsync only)
+	SymlinkModeIgnore = "ignore" // don't synchronize symlinks (Rsync only)
+)
+
+// FolderFileAttrs Handling of file attributes when folder files are synchronized
+type FolderFileAttrs struct {
+	Symlinks    string `json:"symlinks"`    // keep (default), follow or ignore
+	IgnorePerms bool   `json:"ignorePerms"` // don't preserve permissions (IOW executable bits)
+	IgnoreOwner bool   `json:"ignoreOwner"` // don't preserve ownership (Rsync, never preserved by CloudSync)
+}
+
+// Folder access rights definition
+const (
+	FolderAccessRead      = "read"      // view folder and its files
+	FolderAccessReadWrite = "readwrite" // also modify folder and execute commands
+	FolderAccessOwner     = "owner"     // also delete folder and manage sharing
+)
+
+// FolderShare Access granted on a folder to another client
+// (array used as JSON parameters of PUT /folders/:id/shares command)
+type FolderShare struct {
+	ClientID string `json:"clientID"` // session ID of client
+	Access   string `json:"access"`   // read or readwrite
 }
 
 // PathMapConfig Path mapping specific data
@@ -72,9 +205,19 @@ type PathMapConfig struct {
 	CheckContent string `json:"checkContent" xml:"-"`
 }
 
+// ImportConfig Import specific data (existing server directory used as is,
+// its content is never wiped nor overwritten by a sync)
+type ImportConfig struct {
+	ServerPath string `json:"serverPath"`
+
+	// Device that receives a one-way copy of server files (optional)
+	ExportSyncThingID string `json:"exportSyncThingID"`
+}
+
 // CloudSyncConfig CloudSync (AKA Syncthing) specific data
 type CloudSyncConfig struct {
-	SyncThingID string `json:"syncThingID"`
+	SyncThingID  string   `json:"syncThingID"`
+	ExtraDevices []string `json:"extraDevices"` // other devices synchronized with folder (eg. laptop and desktop)
 
 	// Not exported fields (only used internally)
 	STSvrStatus   string `json:"-"`
@@ -82,3 +225,283 @@ type CloudSyncConfig struct {
 	STLocStatus   string `json:"-"`
 	STLocIsInSync bool   `json:"-"`
 }
+
+// FolderDeviceArgs JSON parameters of POST /folders/:id/devices command
+type FolderDeviceArgs struct {
+	DeviceID string `json:"deviceID"` // Syncthing device ID
+}
+
+// FolderIgnores Ignore patterns of a CloudSync folder (Syncthing .stignore file)
+// also used as JSON parameters of PUT /folders/:id/ignores command
+type FolderIgnores struct {
+	Ignore   []string `json:"ignore"`
+	Expanded []string `json:"expanded"` // patterns including #include files (read only)
+}
+
+// FolderSyncProgress Synchronization progress of a CloudSync folder
+type FolderSyncProgress struct {
+	FolderID       string `json:"folderID"`
+	State          string `json:"state"` // Syncthing folder state (eg. idle, scanning, syncing)
+	BytesTotal     int64  `json:"bytesTotal"`
+	BytesRemaining int64  `json:"bytesRemaining"`
+	ItemsTotal     int    `json:"itemsTotal"`
+	ItemsRemaining int    `json:"itemsRemaining"`
+	Percent        int    `json:"percent"` // 0 to 100
+}
+
+// Folder disk quota state definition
+const (
+	QuotaStateOk       = "ok"
+	QuotaStateWarning  = "warning"  // usage is above warning threshold
+	QuotaStateExceeded = "exceeded" // sync is paused and commands are rejected
+)
+
+// FolderDiskUsage Disk usage of a folder with a quota
+type FolderDiskUsage struct {
+	FolderID   string `json:"folderID"`
+	UsedBytes  int64  `json:"usedBytes"`
+	QuotaBytes int64  `json:"quotaBytes"`
+	Percent    int    `json:"percent"`
+	State      string `json:"state"`     // ok, warning or exceeded
+	CheckedAt  string `json:"checkedAt"` // date of last usage computation
+}
+
+// Folder health status definition
+const (
+	FolderHealthOK        = "OK"
+	FolderHealthRepairing = "Repairing" // issues detected, auto-repair in progress
+	FolderHealthError     = "Error"     // auto-repair failed, user action required
+)
+
+// FolderHealth Result of folder health check
+type FolderHealth struct {
+	Status         string   `json:"status"`
+	Issues         []string `json:"issues"`
+	RepairAttempts int      `json:"repairAttempts"`
+	LastRepair     string   `json:"lastRepair"` // last auto-repair action
+	CheckedAt      string   `json:"checkedAt"`
+}
+
+// Git clone status definition
+const (
+	GitCloneStatusCloning = "Cloning"
+	GitCloneStatusDone    = "Done"
+	GitCloneStatusFailed  = "Failed"
+)
+
+// GitCloneConfig Git repository cloned on server side when a folder is created
+type GitCloneConfig struct {
+	URL    string `json:"url"`    // https://, ssh://, git:// or [user@]host:path URL
+	Branch string `json:"branch"` // default branch of repository when not set
+	Depth  int    `json:"depth"`  // shallow clone when set
+	Secret string `json:"secret"` // name of server-side secret used as credentials (must be bound to URL host, see gitClone config)
+
+	Status string `json:"status" xml:"-"`
+	Error  string `json:"error" xml:"-"`
+}
+
+// File change operations definition
+const (
+	FileChangeCreate = "create"
+	FileChangeWrite  = "write"
+	FileChangeRemove = "remove"
+	FileChangeRename = "rename"
+	FileChangeChmod  = "chmod"
+)
+
+// FolderFileChange Change of a folder file
+type FolderFileChange struct {
+	Path      string `json:"path"` // relative to folder
+	Op        string `json:"op"`
+	Timestamp string `json:"timestamp"`
+}
+
+// FolderFileChanges Changes of folder files detected during throttling period
+type FolderFileChanges struct {
+	FolderID string             `json:"folderID"`
+	Changes  []FolderFileChange `json:"changes"`
+	Dropped  int                `json:"dropped"` // number of changes not reported (overflow)
+}
+
+// FolderStats Statistics of folder files (GET /folders/:id/stats)
+type FolderStats struct {
+	FolderID     string           `json:"folderID"`
+	TotalSize    int64            `json:"totalSize"` // in bytes
+	FileCount    int              `json:"fileCount"`
+	DirCount     int              `json:"dirCount"`
+	LargestFiles []FolderFileSize `json:"largestFiles"`
+	BrokenLinks  []string         `json:"brokenLinks"` // symlinks with missing target
+	LastSync     string           `json:"lastSync"`    // empty when unknown
+	LastBuild    string           `json:"lastBuild"`   // end of last command executed in folder
+	ComputedAt   string           `json:"computedAt"`  // empty when never computed
+	Computing    bool             `json:"computing"`   // statistics are being (re)computed
+	Error        string           `json:"error"`
+}
+
+// Versioning types definition (see Syncthing file versioning)
+const (
+	VersioningNone      = ""
+	VersioningSimple    = "simple"    // keep the Keep most recent versions of a file
+	VersioningTrashcan  = "trashcan"  // keep last version of deleted or replaced files
+	VersioningStaggered = "staggered" // keep versions with a decreasing frequency
+)
+
+// FolderVersioning File versioning settings of a CloudSync folder
+type FolderVersioning struct {
+	Type         string `json:"type"`
+	Keep         int    `json:"keep"`         // simple: number of versions kept (default 5)
+	CleanoutDays int    `json:"cleanoutDays"` // simple, trashcan: versions removed after this delay (0: never)
+	MaxAgeDays   int    `json:"maxAgeDays"`   // staggered: maximum age of versions (0: forever)
+}
+
+// FileVersion Previous version of a file (GET /folders/:id/versions)
+type FileVersion struct {
+	Path        string `json:"path"`        // file path relative to folder
+	Version     string `json:"version"`     // version identifier (used to restore it)
+	VersionTime string `json:"versionTime"` // date when file was replaced or deleted
+	Size        int64  `json:"size"`
+}
+
+// FileVersionRestoreArgs JSON parameters of POST /folders/:id/versions command
+type FileVersionRestoreArgs struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// FolderFSEntry File or directory of a folder (GET /folders/:id/fs)
+type FolderFSEntry struct {
+	Path       string          `json:"path"` // relative to folder
+	Name       string          `json:"name"`
+	IsDir      bool            `json:"isDir"`
+	Size       int64           `json:"size"`
+	Mode       string          `json:"mode"`
+	ModTime    string          `json:"modTime"`
+	LinkTarget string          `json:"linkTarget,omitempty"` // set for symlinks
+	Entries    []FolderFSEntry `json:"entries,omitempty"`    // directory content
+	Content    *string         `json:"content,omitempty"`    // file content (when requested using ?content=1)
+}
+
+// FolderFSWriteArgs JSON parameters of PUT /folders/:id/fs command
+type FolderFSWriteArgs struct {
+	Content string `json:"content"`
+}
+
+// FolderFileSize Size of a folder file
+type FolderFileSize struct {
+	Path string `json:"path"` // relative to folder
+	Size int64  `json:"size"`
+}
+
+// Folder snapshot methods definition
+const (
+	SnapshotMethodTar   = "tar"   // tarball saved in server store
+	SnapshotMethodBtrfs = "btrfs" // read-only snapshot of folder btrfs subvolume
+)
+
+// FolderSnapshot Saved content of a folder
+type FolderSnapshot struct {
+	FolderID    string `json:"folderID"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Method      string `json:"method"` // tar or btrfs
+	Size        int64  `json:"size"`   // size of folder files in bytes
+	CreatedAt   string `json:"createdAt"`
+
+	// Not exported fields (only used internally)
+	Digest string `json:"-"` // store content (tar method)
+	Path   string `json:"-"` // snapshot subvolume (btrfs method)
+}
+
+// FolderSnapshotArgs JSON parameters of POST /folders/:id/snapshots command
+type FolderSnapshotArgs struct {
+	Name        string `json:"name"` // creation date is used when not set
+	Description string `json:"description"`
+	Method      string `json:"method"` // btrfs is used when available if not set
+}
+
+// Folder archive formats definition (GET /folders/:id/archive?format=)
+const (
+	ArchiveFormatTar   = "tar"
+	ArchiveFormatTarGz = "tar.gz"
+	ArchiveFormatZip   = "zip"
+)
+
+// FolderRestoreArgs JSON parameters of POST /folders/:id/restore command
+type FolderRestoreArgs struct {
+	Name string `json:"name"` // snapshot name
+}
+
+// Sync conflict resolution definition
+const (
+	ConflictKeepLocal  = "local"  // keep current file, delete conflict copy
+	ConflictKeepRemote = "remote" // replace current file by conflict copy
+	ConflictKeepBoth   = "both"   // keep both files (conflict copy is renamed)
+)
+
+// FolderConflict Syncthing conflict copy (*.sync-conflict-*) of a file
+type FolderConflict struct {
+	FolderID     string `json:"folderID"`
+	Path         string `json:"path"`     // conflict copy (relative to folder)
+	Original     string `json:"original"` // conflicting file (relative to folder)
+	Date         string `json:"date"`     // date of conflict
+	DeviceID     string `json:"deviceID"` // short ID of device that modified conflict copy
+	Size         int64  `json:"size"`
+	OriginalSize int64  `json:"originalSize"` // -1 when original file has been deleted
+}
+
+// FolderConflictResolveArgs JSON parameters of POST /folders/:id/conflicts command
+type FolderConflictResolveArgs struct {
+	Path string `json:"path"` // conflict copy as returned by GET /folders/:id/conflicts
+	Keep string `json:"keep"` // local, remote or both
+}
+
+// Rsync folder synchronization direction
+const (
+	RsyncDirectionPull = "pull" // remote (client) files are copied on server
+	RsyncDirectionPush = "push" // server files are copied on remote (client)
+)
+
+// RsyncConfig rsync over SSH specific data
+type RsyncConfig struct {
+	ServerPath string   `json:"serverPath"` // located under shareRootDir (relative to it when not absolute)
+	RemoteHost string   `json:"remoteHost"` // [user@]host reachable over SSH from server
+	RemotePath string   `json:"remotePath"` // directory on remote host
+	SSHPort    int      `json:"sshPort"`    // 22 when not set
+	SSHKey     string   `json:"sshKey"`     // name of server secret holding SSH private key
+	Direction  string   `json:"direction"`  // pull (default) or push
+	IntervalS  int      `json:"intervalS"`  // periodic sync interval (0 = default, -1 = on-demand only)
+	Excludes   []string `json:"excludes"`   // rsync exclude patterns
+
+	// Status of last synchronization
+	LastSync  string `json:"lastSync" xml:"-"`
+	LastError string `json:"lastError" xml:"-"`
+}
+
+// Network mount state definition
+const (
+	MountStateMounted    = "Mounted"
+	MountStateNotMounted = "NotMounted"
+	MountStateUnhealthy  = "Unhealthy" // mounted but not accessible (eg. stale NFS)
+)
+
+// NetMountConfig Network mounted folder (NFS or CIFS) specific data
+type NetMountConfig struct {
+	ServerPath string `json:"serverPath"` // mount point on server
+	Source     string `json:"source"`     // eg. host:/export (NFS) or //host/share (CIFS)
+	Options    string `json:"options"`    // mount options
+	AutoMount  bool   `json:"autoMount"`  // mount/umount by server (require mount helpers)
+
+	// Status of the mount
+	MountState string `json:"mountState" xml:"-"`
+	FsType     string `json:"fsType" xml:"-"`
+	LastError  string `json:"lastError" xml:"-"`
+}
+
+// InotifyStatus Status of inotify watches used to detect files changes
+type InotifyStatus struct {
+	MaxUserWatches  int      `json:"maxUserWatches"`  // current kernel limit (fs.inotify.max_user_watches)
+	RequiredWatches int      `json:"requiredWatches"` // estimated number of watches needed by all folders
+	LimitReached    bool     `json:"limitReached"`
+	SysctlHint      string   `json:"sysctlHint"`      // command to run to increase limit
+	FallbackFolders []string `json:"fallbackFolders"` // IDs of folders that use periodic scanning
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Hook types definition
+const (
+	HookTypeScript  = "script"  // shell command executed in folder
+	HookTypeWebhook = "webhook" // command metadata posted as JSON
+	HookTypeEmail   = "email"   // mail sent to recipients
+)
+
+// Hook triggers definition
+const (
+	HookOnAlways  = "always" // default
+	HookOnSuccess = "success"
+	HookOnFailure = "failure"
+)
+
+// Hook execution status definition
+const (
+	HookStatusDone   = "done"
+	HookStatusFailed = "failed"
+)
+
+// ExecHook Action triggered when a command executed in a folder exited
+type ExecHook struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`   // script, webhook or email (see HookType*)
+	On     string   `json:"on"`     // success, failure or always (see HookOn*)
+	Script string   `json:"script"` // script hook: shell command (metadata set in XDS_HOOK_* variables)
+	URL    string   `json:"url"`    // webhook: URL that receives ExecHookPayload
+	Secret string   `json:"secret"` // webhook: name of server secret used to sign payload (optional, must be allowed for URL host in server config)
+	To     []string `json:"to"`     // email hook: recipients (must be allowed in server config)
+}
+
+// ExecHookPayload Metadata of exited command sent to hooks
+type ExecHookPayload struct {
+	Status      string `json:"status"` // success or failure
+	FolderID    string `json:"folderID"`
+	FolderLabel string `json:"folderLabel"`
+	CmdID       string `json:"cmdID"`
+	Cmd         string `json:"cmd"`
+	RPath       string `json:"rpath"`
+	SdkID       string `json:"sdkID"`
+	SdkName     string `json:"sdkName"`
+	SessionID   string `json:"sessionID"`
+	Node        string `json:"node,omitempty"`
+	StartedAt   string `json:"startedAt"`
+	EndedAt     string `json:"endedAt"`
+	ExitCode    int    `json:"exitCode"`
+	DurationMs  int64  `json:"durationMs"`
+}
+
+// ExecHookMsg Result of a hook execution (see EVTExecHook)
+type ExecHookMsg struct {
+	FolderID  string `json:"folderID"`
+	CmdID     string `json:"cmdID"`
+	Hook      string `json:"hook"` // hook name
+	Type      string `json:"type"`
+	Status    string `json:"status"` // see HookStatus*
+	Error     string `json:"error"`
+	Timestamp string `json:"timestamp"`
+}
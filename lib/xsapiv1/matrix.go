@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// MatrixArgs JSON parameters of POST /matrix command
+type MatrixArgs struct {
+	FolderID string   `json:"folderID"`
+	SdkIDs   []string `json:"sdkIDs"` // command is executed once per SDK
+	Cmd      string   `json:"cmd"`
+	RPath    string   `json:"rpath"`    // relative path into project
+	Parallel int      `json:"parallel"` // maximum number of concurrent runs (default 1: sequential)
+	FailFast bool     `json:"failFast"` // skip runs not started yet when one failed
+	TimeoutS int      `json:"timeoutS"` // maximum duration of each run (default 1 hour)
+}
+
+// MatrixRun Execution of the command with one SDK
+type MatrixRun struct {
+	SdkID      string `json:"sdkID"`
+	SdkName    string `json:"sdkName"`
+	Channel    string `json:"channel"` // tag set in exec events of this run
+	CmdID      string `json:"cmdID"`   // command ID used in exec events
+	Status     string `json:"status"`  // see BuildStatus* constants
+	ExitCode   int    `json:"exitCode"`
+	Error      string `json:"error"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Matrix Same command executed against several SDKs (see EVTMatrix)
+type Matrix struct {
+	ID        string      `json:"id"`
+	FolderID  string      `json:"folderID"`
+	Cmd       string      `json:"cmd"`
+	Status    string      `json:"status"` // failed when at least one run failed
+	Runs      []MatrixRun `json:"runs"`
+	Passed    int         `json:"passed"`
+	Failed    int         `json:"failed"`
+	Skipped   int         `json:"skipped"`
+	StartedBy string      `json:"startedBy"` // session ID of requester
+	StartedAt string      `json:"startedAt"`
+	EndedAt   string      `json:"endedAt"`
+}
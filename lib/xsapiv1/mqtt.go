@@ -0,0 +1,29 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// MQTTStatus Result of GET /admin/mqtt command
+type MQTTStatus struct {
+	Enabled     bool   `json:"enabled"`
+	Broker      string `json:"broker"`
+	Connected   bool   `json:"connected"`
+	ConnectedAt string `json:"connectedAt"`
+	Published   uint64 `json:"published"` // number of published events
+	Dropped     uint64 `json:"dropped"`   // events dropped (queue full while broker unreachable)
+	LastError   string `json:"lastError"`
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Builder node status definition
+const (
+	NodeStatusOnline  = "Online"
+	NodeStatusOffline = "Offline" // no heartbeat received recently
+)
+
+// Special values of ExecArgs node
+const (
+	ExecNodeAuto  = ""      // dispatch on least loaded node, local execution when none fits
+	ExecNodeLocal = "local" // never dispatch
+)
+
+// BuilderNode Secondary server that executes commands dispatched by primary
+type BuilderNode struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`       // API URL of node (eg. http://node1:8000/api/v1)
+	SdkIDs    []string `json:"sdkIDs"`    // installed SDKs
+	FolderIDs []string `json:"folderIDs"` // folders enabled and in sync on node
+	Capacity  int      `json:"capacity"`  // maximum number of dispatched commands
+	Running   int      `json:"running"`   // commands currently executed on node
+	Status    string   `json:"status"`
+	LastSeen  string   `json:"lastSeen"` // date of last heartbeat
+}
+
+// NodeRegisterArgs JSON parameters of POST /nodes command (node heartbeat)
+type NodeRegisterArgs struct {
+	Name      string   `json:"name" binding:"required"`
+	URL       string   `json:"url" binding:"required"`
+	SdkIDs    []string `json:"sdkIDs"`
+	FolderIDs []string `json:"folderIDs"`
+	Capacity  int      `json:"capacity"`
+	Running   int      `json:"running"`
+}
+
+// NodeExecArgs JSON parameters of POST /executor/exec command (sent by
+// primary to a node)
+type NodeExecArgs struct {
+	CmdID        string   `json:"cmdID" binding:"required"`
+	FolderID     string   `json:"folderID" binding:"required"`
+	SdkID        string   `json:"sdkID"`
+	NoSdkEnv     bool     `json:"noSdkEnv"`
+	RPath        string   `json:"rpath"`
+	Cmd          string   `json:"cmd" binding:"required"`
+	Args         []string `json:"args"` // client paths are translated by node
+	Shell        string   `json:"shell"`
+	ShellOptions []string `json:"shellOptions"`
+	Env          []string `json:"env"`
+	TimeoutS     int      `json:"timeout"`
+	Nice         *int     `json:"nice"`
+	IONice       string   `json:"ionice"`
+}
+
+// NodeExecMsg Line (JSON) of POST /executor/exec response: output chunk or
+// exit status (last line)
+type NodeExecMsg struct {
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	Exited bool   `json:"exited,omitempty"`
+	Code   int    `json:"code"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NodeSignalArgs JSON parameters of POST /executor/signal command
+type NodeSignalArgs struct {
+	CmdID  string `json:"cmdID" binding:"required"`
+	Signal string `json:"signal" binding:"required"`
+	Group  bool   `json:"group"`
+}
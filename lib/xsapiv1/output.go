@@ -0,0 +1,36 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Policies applied when output is produced faster than a client connection
+// can receive it (see outputStream section of server config)
+const (
+	OutputStreamPolicySpill = "spill" // waiting output is written on disk and sent once connection recovers (default)
+	OutputStreamPolicyDrop  = "drop"  // following output is dropped (command output can be replayed, see ExecOutReplay)
+)
+
+// OutputDroppedEvent Event send in WS once connection recovered when output
+// events have been dropped
+const OutputDroppedEvent = "output:dropped"
+
+// OutputDroppedMsg Message of OutputDroppedEvent
+type OutputDroppedMsg struct {
+	Timestamp string `json:"timestamp"`
+	Events    int    `json:"events"` // number of dropped events
+	Bytes     int    `json:"bytes"`  // size of dropped output
+}
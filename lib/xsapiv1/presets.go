@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Presets scope definition
+const (
+	ExecPresetScopeBuiltIn = "builtin" // defined by server (cannot be modified)
+	ExecPresetScopeGlobal  = "global"  // available in all folders
+	ExecPresetScopeFolder  = "folder"  // only available in one folder
+)
+
+// ExecPreset Named command template (parameters are referenced in Command
+// using {{name}} and replaced as is by their value)
+type ExecPreset struct {
+	Name        string            `json:"name" xml:"name,attr"`
+	FolderID    string            `json:"folderID" xml:"folderID,omitempty"` // folder of preset (global preset when empty)
+	Description string            `json:"description" xml:"description"`
+	Command     string            `json:"command" xml:"command"` // shell command line
+	Params      []ExecPresetParam `json:"params" xml:"param"`
+	Scope       string            `json:"scope" xml:"-"`
+}
+
+// ExecPresetParam Parameter of a command template
+type ExecPresetParam struct {
+	Name        string `json:"name" xml:"name,attr"`
+	Description string `json:"description" xml:"description"`
+	Default     string `json:"default" xml:"default"`   // value used when parameter is not set (may use shell expansion)
+	Required    bool   `json:"required" xml:"required"` // value cannot be empty
+}
+
+// ExecPresetArgs JSON parameters of POST /exec/preset/:name command
+type ExecPresetArgs struct {
+	ExecArgs `binding:"-"`     // command options (cmd and args are set from preset)
+	Params   map[string]string `json:"params"` // values of preset parameters
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Roles definition (see RBAC configuration)
+const (
+	RoleAdmin     = "admin"     // manage SDKs, server configuration and roles
+	RoleDeveloper = "developer" // manage own folders and commands
+	RoleReadOnly  = "read-only" // watch events, logs and outputs
+)
+
+// UserRole Role of a user (GET /admin/roles)
+type UserRole struct {
+	User   string `json:"user"`
+	Role   string `json:"role"`
+	Static bool   `json:"static"` // set in server configuration (cannot be changed using API)
+}
+
+// RoleSetArgs JSON parameters of PUT /admin/roles/:user command
+type RoleSetArgs struct {
+	Role string `json:"role"`
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Exec job status definition
+const (
+	ExecJobStatusQueued    = "Queued"
+	ExecJobStatusRunning   = "Running"
+	ExecJobStatusCancelled = "Cancelled"
+)
+
+// ExecJob Command executed (or waiting to be executed) by the exec scheduler
+type ExecJob struct {
+	CmdID     string `json:"cmdID"`
+	SessionID string `json:"sessionID"`
+	FolderID  string `json:"folderID"`
+	Cmd       string `json:"cmd"`
+	Priority  int    `json:"priority"`
+	Status    string `json:"status"`
+	Position  int    `json:"position"` // position in queue (1 is the next job to run, 0 when not queued)
+	QueuedAt  string `json:"queuedAt"`
+	StartedAt string `json:"startedAt"`
+}
+
+// ExecQueue JSON result of GET /admin/queue command
+type ExecQueue struct {
+	MaxJobs           int       `json:"maxJobs"`           // 0: no limit
+	MaxJobsPerSession int       `json:"maxJobsPerSession"` // 0: no limit
+	Running           []ExecJob `json:"running"`
+	Queued            []ExecJob `json:"queued"`
+}
+
+// ExecQueueMoveArgs JSON parameters of PUT /admin/queue/:id command
+type ExecQueueMoveArgs struct {
+	Position int `json:"position" binding:"required"` // new position in queue (starting at 1)
+}
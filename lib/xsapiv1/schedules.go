@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Scheduled run status definition
+const (
+	ScheduleRunStatusRunning = "running"
+	ScheduleRunStatusDone    = "done"
+	ScheduleRunStatusFailed  = "failed"
+	ScheduleRunStatusSkipped = "skipped" // folder busy (used by a command of another client)
+)
+
+// CmdSchedule Command executed periodically in a folder (results are stored
+// in command history and notified using EVTSchedule)
+type CmdSchedule struct {
+	ID        string          `json:"id" xml:"id,attr"`
+	FolderID  string          `json:"folderID" xml:"folderID" binding:"required"`
+	Name      string          `json:"name" xml:"name"`
+	Cron      string          `json:"cron" xml:"cron" binding:"required"` // "minute hour day-of-month month day-of-week" or @hourly, @daily, @weekly, @monthly
+	Cmd       string          `json:"cmd" xml:"cmd" binding:"required"`
+	SdkID     string          `json:"sdkID" xml:"sdkID"` // SDK used to setup env (default: SDK bound to folder)
+	RPath     string          `json:"rpath" xml:"rpath"` // relative path into project
+	TimeoutS  int             `json:"timeoutS" xml:"timeoutS"`
+	Disabled  bool            `json:"disabled" xml:"disabled"`
+	CreatedBy string          `json:"createdBy" xml:"createdBy"` // session ID of creator
+	NextRunAt string          `json:"nextRunAt" xml:"-"`
+	LastRun   *CmdScheduleRun `json:"lastRun" xml:"lastRun,omitempty"`
+}
+
+// CmdScheduleRun Result of a scheduled command execution
+type CmdScheduleRun struct {
+	CmdID     string `json:"cmdID" xml:"cmdID"` // see GET /exec/history
+	Status    string `json:"status" xml:"status"`
+	ExitCode  int    `json:"exitCode" xml:"exitCode"`
+	Error     string `json:"error" xml:"error"`
+	StartedAt string `json:"startedAt" xml:"startedAt"`
+	EndedAt   string `json:"endedAt" xml:"endedAt"`
+}
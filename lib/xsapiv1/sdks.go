@@ -24,6 +24,7 @@ const (
 	SdkStatusInstalling   = "Installing"
 	SdkStatusUninstalling = "Un-installing"
 	SdkStatusInstalled    = "Installed"
+	SdkStatusRemoved      = "Removed" // SDK no longer exists (only reported to changedSince requests)
 )
 
 // SDK Define a cross tool chain used to build application
@@ -43,10 +44,49 @@ type SDK struct {
 	SetupFile   string `json:"setupFile"`
 	LastError   string `json:"lastError"`
 
+	Health SDKHealth `json:"health"` // result of last integrity verification
+
+	// Usage statistics (updated each time an exec command sources this SDK)
+	LastUsed   string `json:"lastUsed"`
+	UsageCount int    `json:"usageCount"`
+
+	// Session (and authenticated user) that installed SDK, only this session
+	// and admins can abort install or remove it (empty when not installed
+	// using XDS)
+	Owner     string `json:"owner"`
+	OwnerUser string `json:"ownerUser"`
+
 	// Not exported fields
 	FamilyConf SDKFamilyConfig `json:"-"`
 }
 
+// SDK health status definition
+const (
+	SdkHealthUnknown = "Unknown"
+	SdkHealthOK      = "OK"
+	SdkHealthFailed  = "Failed"
+)
+
+// SDKHealth Result of the last integrity verification of a SDK
+type SDKHealth struct {
+	Status string           `json:"status"`
+	Date   string           `json:"date"`
+	Checks []SDKHealthCheck `json:"checks"`
+}
+
+// SDKHealthCheck Result of one verification step
+type SDKHealthCheck struct {
+	Name    string `json:"name"` // setup, sysroot, compiler or manifest
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped"`
+	Message string `json:"message"`
+}
+
+// SDKVerifyArgs JSON parameters of POST /sdks/:id/verify command
+type SDKVerifyArgs struct {
+	CreateManifest bool `json:"createManifest"` // (re)create files checksums manifest
+}
+
 // SDKFamilyConfig Configuration structure to define a SDKs family
 type SDKFamilyConfig struct {
 	FamilyName   string `json:"familyName"`
@@ -54,12 +94,41 @@ type SDKFamilyConfig struct {
 	RootDir      string `json:"rootDir"`
 	EnvSetupFile string `json:"envSetupFilename"`
 	ScriptsDir   string `json:"scriptsDir"`
+
+	Prerequisites []string `json:"prerequisites"` // host binaries needed to install SDKs
+}
+
+// SDKFamiliesReload Result of POST /sdks/families/reload command
+type SDKFamiliesReload struct {
+	Added   []string `json:"added"`   // names of new families
+	Removed []string `json:"removed"` // names of removed families
+}
+
+// SDKPrerequisites Result of host prerequisites check of a SDKs family
+// (GET /sdks/prerequisites)
+type SDKPrerequisites struct {
+	FamilyName string   `json:"familyName"`
+	Required   []string `json:"required"` // binaries declared by family config
+	Missing    []string `json:"missing"`  // missing binaries or packages
+	OK         bool     `json:"ok"`
+	Error      string   `json:"error"`
 }
 
+// SDK installation stages definition (see SDKManagementMsg)
+const (
+	SdkInstallStageQueued      = "queued"
+	SdkInstallStageDownloading = "downloading"
+	SdkInstallStageVerifying   = "verifying"
+	SdkInstallStageExtracting  = "extracting"
+	SdkInstallStageRelocating  = "relocating"
+	SdkInstallStageDone        = "done"
+)
+
 // SDKInstallArgs JSON parameters of POST /sdks or /sdks/abortinstall commands
 type SDKInstallArgs struct {
 	ID          string   `json:"id"`          // install by ID (must be part of GET /sdks result)
 	Filename    string   `json:"filename"`    // install by using a file
+	Dir         string   `json:"dir"`         // install by using an already extracted SDK directory
 	Force       bool     `json:"force"`       // force SDK install when already existing
 	Timeout     int      `json:"timeout"`     // 1800 == default 30 minutes
 	InstallArgs []string `json:"installArgs"` // args directly passed to add/install script
@@ -76,4 +145,7 @@ type SDKManagementMsg struct {
 	Exited    bool   `json:"exited"`
 	Code      int    `json:"code"`
 	Error     string `json:"error"`
+
+	Stage         string `json:"stage"`         // current installation stage (see SdkInstallStage*)
+	StageProgress int    `json:"stageProgress"` // progress of current stage (0 to 100, -1 when unknown)
 }
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Secret types definition (usage of credentials)
+const (
+	SecretTypeRegistry = "registry" // SDK registry credentials
+	SecretTypeGit      = "git"      // Git clone credentials
+	SecretTypeDevice   = "device"   // target device password
+	SecretTypeWebhook  = "webhook"  // webhook token
+	SecretTypeOther    = "other"
+)
+
+// Secret sources definition
+const (
+	SecretSourceStore = "store" // encrypted store managed using REST API
+	SecretSourceFile  = "file"  // file of secretsDir (read-only)
+)
+
+// Secret Credentials used to access external resources (value is never returned)
+type Secret struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // see SecretType*
+	Description string `json:"description"`
+	Source      string `json:"source"`    // see SecretSource*
+	UpdatedBy   string `json:"updatedBy"` // user that set value
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+
+	// Encrypted value
+	Value string `json:"-"`
+}
+
+// SecretSetArgs JSON parameters of PUT /admin/secrets/:name command
+type SecretSetArgs struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Value       string `json:"value"` // mandatory on creation, empty to keep current value
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Session expiration reasons
+const (
+	SessionExpireMaxAge = "max-age" // maximum lifetime reached
+	SessionExpireIdle   = "idle"    // no request during idle timeout
+)
+
+// SessionInfo Lifetime of the client session
+type SessionInfo struct {
+	ID           string `json:"id"`
+	User         string `json:"user"`
+	MaxAge       int64  `json:"maxAge"`      // in seconds
+	IdleTimeout  int64  `json:"idleTimeout"` // in seconds (0 when disabled)
+	CreatedAt    string `json:"createdAt"`
+	LastUsedAt   string `json:"lastUsedAt"`
+	ExpireAt     string `json:"expireAt"`     // date of forced logout
+	ExpireReason string `json:"expireReason"` // see SessionExpire*
+}
+
+// SessionResources Resources owned by a client session
+type SessionResources struct {
+	Folders         []string `json:"folders"`         // IDs of folders created by session
+	UnlockedFolders []string `json:"unlockedFolders"` // IDs of encrypted folders unlocked by session
+	RunningCmds     []string `json:"runningCmds"`     // IDs of running commands
+	DebugSessions   []string `json:"debugSessions"`   // IDs of debug sessions
+}
+
+// SessionDetails JSON result of GET /sessions command (admin only)
+type SessionDetails struct {
+	SessionInfo
+	Authenticated bool             `json:"authenticated"`
+	Subject       string           `json:"subject"`   // identifier of authenticated user (eg. ldap:<DN>, apitoken:<ID>)
+	ClientIP      string           `json:"clientIP"`  // address of last request
+	UserAgent     string           `json:"userAgent"` // user agent of last request
+	Connected     bool             `json:"connected"` // websocket connected
+	Resources     SessionResources `json:"resources"`
+}
+
+// SessionSetArgs JSON parameters of PUT /sessions/current command (values
+// cannot exceed the ones of server config, 0 keeps current value)
+type SessionSetArgs struct {
+	MaxAge      int64 `json:"maxAge"`
+	IdleTimeout int64 `json:"idleTimeout"`
+}
+
+// SessionExpiring Data of EVTSessionExpiring event (only sent to the session)
+type SessionExpiring struct {
+	SessionID string `json:"sessionID"`
+	ExpireAt  string `json:"expireAt"`
+	Reason    string `json:"reason"` // see SessionExpire*
+}
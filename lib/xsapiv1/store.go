@@ -0,0 +1,36 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// StoreBlob Content saved in the deduplicated store (logs, artifacts, ...)
+type StoreBlob struct {
+	Digest     string `json:"digest"`     // sha256 of uncompressed content
+	Size       int64  `json:"size"`       // uncompressed size in bytes
+	StoredSize int64  `json:"storedSize"` // compressed size on disk in bytes
+	RefCount   int    `json:"refCount"`   // number of references
+	CreatedAt  string `json:"createdAt"`
+}
+
+// StoreStats Statistics of the deduplicated store (GET /admin/store)
+type StoreStats struct {
+	NbBlobs     int   `json:"nbBlobs"`
+	NbRefs      int   `json:"nbRefs"`
+	LogicalSize int64 `json:"logicalSize"` // size used without deduplication nor compression
+	StoredSize  int64 `json:"storedSize"`  // size really used on disk
+	SavedSize   int64 `json:"savedSize"`
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// APIToken Long-lived token used by non-browser clients (CLI tools, CI
+// jobs) to authenticate using header "Authorization: Bearer <token>"
+type APIToken struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	User       string `json:"user"` // client user name bound to token (see XDS-User header)
+	CreatedAt  string `json:"createdAt"`
+	ExpireAt   string `json:"expireAt"` // empty when token never expires
+	LastUsedAt string `json:"lastUsedAt"`
+
+	// Token only returned once on creation (only its hash is saved)
+	Token string `json:"token,omitempty"`
+	Hash  string `json:"-"`
+}
+
+// APITokenCreateArgs JSON parameters of POST /tokens command
+type APITokenCreateArgs struct {
+	Name       string `json:"name"`
+	User       string `json:"user"`       // default: user of calling session
+	ExpireDays int    `json:"expireDays"` // 0: never expires
+}
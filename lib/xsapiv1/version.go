@@ -23,4 +23,5 @@ type Version struct {
 	Version       string `json:"version"`
 	APIVersion    string `json:"apiVersion"`
 	VersionGitTag string `json:"gitTag"`
+	EventVersions []int  `json:"eventVersions"` // supported event payload versions
 }
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// Webhook delivery status definition
+const (
+	WebhookDeliveryPending   = "pending" // waiting for first attempt or for a retry
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed" // all attempts failed (or dropped)
+)
+
+// Webhook HTTP endpoint that receives (POST) server events (EventMsgExternal)
+type Webhook struct {
+	Name      string   `json:"name" xml:"name,attr"`
+	URL       string   `json:"url" xml:"url"`
+	Events    []string `json:"events" xml:"event"`       // event types (see EVT*, all when empty)
+	FolderIDs []string `json:"folderIDs" xml:"folderID"` // only events of these folders (all when empty)
+	Secret    string   `json:"secret" xml:"secret"`      // name of server secret used to sign payload (optional)
+	Disabled  bool     `json:"disabled" xml:"disabled"`
+}
+
+// WebhookDelivery Notification of an event to a webhook
+type WebhookDelivery struct {
+	ID            string `json:"id"` // also set in X-XDS-Delivery header
+	Webhook       string `json:"webhook"`
+	EventType     string `json:"eventType"`
+	EventSeq      uint64 `json:"eventSeq"`
+	Status        string `json:"status"` // see WebhookDelivery*
+	Attempts      int    `json:"attempts"`
+	StatusCode    int    `json:"statusCode"` // HTTP status returned by last attempt
+	Error         string `json:"error"`
+	CreatedAt     string `json:"createdAt"`     // RFC3339 date
+	LastAttemptAt string `json:"lastAttemptAt"` // RFC3339 date
+	NextAttemptAt string `json:"nextAttemptAt"` // RFC3339 date (pending deliveries only)
+}
+
+// WebhookStatus Result of GET /admin/webhooks command
+type WebhookStatus struct {
+	Webhook
+	Pending      int              `json:"pending"` // number of pending deliveries
+	Delivered    uint64           `json:"delivered"`
+	Failed       uint64           `json:"failed"`
+	LastDelivery *WebhookDelivery `json:"lastDelivery"`
+}
@@ -109,6 +109,11 @@ func main() {
 			Usage:  fmt.Sprintf("Do not read folder config file (%s)\n\t", xdsconfig.FoldersConfigFilename),
 			EnvVar: "NO_FOLDERCONFIG",
 		},
+		cli.BoolFlag{
+			Name:   "seed-demo",
+			Usage:  "Create demo folders, SDK and build jobs (to explore XDS without real SDKs)\n\t",
+			EnvVar: "XDS_SEED_DEMO",
+		},
 	}
 
 	// only one action: Web Server